@@ -0,0 +1,26 @@
+package main
+
+import (
+	"io"
+
+	"github.com/zijiren233/sshgate/config"
+)
+
+// runCheckConfigCommand loads and validates the configuration as the gateway
+// does, from the environment and the flags in args, and prints it with its
+// secrets redacted
+func runCheckConfigCommand(args []string, stdout io.Writer) error {
+	cfg, err := config.Load(args...)
+	if err != nil {
+		return err
+	}
+
+	dump, err := cfg.Dump()
+	if err != nil {
+		return err
+	}
+
+	_, err = stdout.Write(dump)
+
+	return err
+}
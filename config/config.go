@@ -4,58 +4,171 @@ package config
 import (
 	"errors"
 	"fmt"
+	"os"
+	"slices"
+	"strings"
 	"time"
 
-	"github.com/caarlos0/env/v9"
-	"github.com/joho/godotenv"
-	"github.com/zijiren233/sshgate/gateway"
+	"github.com/zijiren233/sshgate/hostkey"
+	"github.com/zijiren233/sshgate/informer"
+	"github.com/zijiren233/sshgate/kubeclient"
+	"github.com/zijiren233/sshgate/listen"
+	"github.com/zijiren233/sshgate/logger"
+	"github.com/zijiren233/sshgate/registry"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
+// SeedStrictAuto refuses weak host key seeds when running in a cluster
+const SeedStrictAuto = "auto"
+
 // Config holds all configuration for the SSH gateway
 type Config struct {
 	// Server configuration
-	SSHListenAddr string `env:"SSH_LISTEN_ADDR" envDefault:":2222"`
+	// SSHListenAddrs are the addresses accepting SSH connections,
+	// unix:///path/to/socket listens on a Unix socket
+	SSHListenAddrs []string `env:"SSH_LISTEN_ADDR" envDefault:":2222"`
+	// SSHListenReusePort lets a new process bind the address during a rolling restart
+	SSHListenReusePort bool `env:"SSH_LISTEN_REUSE_PORT" envDefault:"false"`
+	// SSHListenFD is an inherited listening socket used instead of SSHListenAddrs
+	SSHListenFD int `env:"SSH_LISTEN_FD" envDefault:"0"`
+	// Permission and owner of Unix socket files, -1 keeps the process' own ids
+	SSHListenSocketMode listen.FileMode `env:"SSH_LISTEN_SOCKET_MODE" envDefault:"0660"`
+	SSHListenSocketUID  int             `env:"SSH_LISTEN_SOCKET_UID"  envDefault:"-1"`
+	SSHListenSocketGID  int             `env:"SSH_LISTEN_SOCKET_GID"  envDefault:"-1"`
+
+	// WebSocket listener configuration, an empty address disables it
+	WebSocketListenAddr     string   `env:"WEBSOCKET_LISTEN_ADDR"`
+	WebSocketPath           string   `env:"WEBSOCKET_PATH"            envDefault:"/ssh"`
+	WebSocketTLSCertFile    string   `env:"WEBSOCKET_TLS_CERT_FILE"`
+	WebSocketTLSKeyFile     string   `env:"WEBSOCKET_TLS_KEY_FILE"`
+	WebSocketBearerToken    string   `env:"WEBSOCKET_BEARER_TOKEN" redact:"true"`
+	WebSocketTrustedProxies []string `env:"WEBSOCKET_TRUSTED_PROXIES"`
 
 	// Logging configuration
 	Debug     bool   `env:"DEBUG"      envDefault:"false"`
 	LogLevel  string `env:"LOG_LEVEL"  envDefault:"info"`
 	LogFormat string `env:"LOG_FORMAT" envDefault:"text"`
+	// Logs written to stdout, to LOG_FILE or to both, the file being rotated
+	// past its size in megabytes, 0 leaving rotation to another program
+	LogOutput         string        `env:"LOG_OUTPUT"           envDefault:"stdout"`
+	LogFile           string        `env:"LOG_FILE"`
+	LogFileMaxSize    int           `env:"LOG_FILE_MAX_SIZE"    envDefault:"100"`
+	LogFileMaxBackups int           `env:"LOG_FILE_MAX_BACKUPS"`
+	LogFileMaxAge     time.Duration `env:"LOG_FILE_MAX_AGE"`
+	LogFileCompress   bool          `env:"LOG_FILE_COMPRESS"    envDefault:"false"`
+	// Failures repeated as clients retry, such as failures to connect to a
+	// backend, are logged this many times per interval and devbox, 0 logs them all
+	LogRepeatLimit    int           `env:"LOG_REPEAT_LIMIT"    envDefault:"10"`
+	LogRepeatInterval time.Duration `env:"LOG_REPEAT_INTERVAL" envDefault:"1m"`
+	// Destination of the JSON audit log: stdout, stderr or a file path, empty disables it
+	AuditLogOutput string `env:"AUDIT_LOG_OUTPUT"`
+
+	// Kubernetes client configuration
+	// Kubeconfig files read outside a cluster, the default ones when empty.
+	// A context reads them in a cluster too.
+	Kubeconfig  string `env:"KUBECONFIG"`
+	KubeContext string `env:"KUBE_CONTEXT"`
+	// Requests per second and burst allowed to the API server, and the
+	// timeout of requests, 0 for none
+	KubeAPIQPS     float32       `env:"KUBE_API_QPS"     envDefault:"50"`
+	KubeAPIBurst   int           `env:"KUBE_API_BURST"   envDefault:"100"`
+	KubeAPITimeout time.Duration `env:"KUBE_API_TIMEOUT"`
+	// Contexts of the kubeconfig files naming remote member clusters whose
+	// devboxes are served too, in order of precedence after the cluster of the
+	// gateway. Their devboxes are dialed through CLUSTER_PROXIES.
+	Clusters []string `env:"CLUSTERS"`
 
 	// Informer configuration
 	InformerResyncPeriod time.Duration `env:"INFORMER_RESYNC_PERIOD" envDefault:"30s"`
+	// Namespaces of the watched devboxes, the whole cluster when empty
+	InformerNamespaces []string `env:"INFORMER_NAMESPACES"`
+	// How long the informers may fail to list and watch before the gateway is
+	// reported unready, 0 never does, and whether the gateway exits then
+	InformerUnhealthyTimeout time.Duration `env:"INFORMER_UNHEALTHY_TIMEOUT" envDefault:"5m"`
+	InformerUnhealthyExit    bool          `env:"INFORMER_UNHEALTHY_EXIT"    envDefault:"false"`
+	// How often the registry is rebuilt from the informer caches, dropping
+	// what missed deletions left, 0 never does
+	InformerReconcileInterval time.Duration `env:"INFORMER_RECONCILE_INTERVAL"`
+	// Devbox custom resource read for the desired state of devboxes, as
+	// resource.version.group, e.g. devboxes.v1alpha1.devbox.sealos.io, empty
+	// disables it
+	DevboxResource string `env:"DEVBOX_RESOURCE"`
+	// Objects devboxes are discovered from, pods or the endpointslices of
+	// their Service
+	DiscoveryMode string `env:"DISCOVERY_MODE" envDefault:"pods"`
+	// Address serving /healthz and /readyz for Kubernetes probes, empty disables it
+	HealthListenAddr string `env:"HEALTH_LISTEN_ADDR"`
+
+	// Registry snapshot file serving lookups while the informers sync, empty disables it
+	RegistrySnapshotPath     string        `env:"REGISTRY_SNAPSHOT_PATH"`
+	RegistrySnapshotInterval time.Duration `env:"REGISTRY_SNAPSHOT_INTERVAL" envDefault:"1m"`
+
+	// Backend addressing, pod annotations override it per devbox
+	BackendAddressing   string `env:"BACKEND_ADDRESSING"    envDefault:"pod-ip"`
+	BackendHostTemplate string `env:"BACKEND_HOST_TEMPLATE" envDefault:"{devbox}.{namespace}.svc"`
+	// Preferred pod IP family of dual-stack devboxes, ipv4 or ipv6, empty uses the primary IP
+	BackendIPFamily string `env:"BACKEND_IP_FAMILY"`
+
+	// Secret data fields holding the keys of devboxes, each tried in order
+	DevboxPublicKeyFields  []string `env:"DEVBOX_PUBLIC_KEY_FIELDS"  envDefault:"SEALOS_DEVBOX_PUBLIC_KEY"`
+	DevboxPrivateKeyFields []string `env:"DEVBOX_PRIVATE_KEY_FIELDS" envDefault:"SEALOS_DEVBOX_PRIVATE_KEY"`
+	// Label of the secrets and pods of devboxes, key=value
+	DevboxSelectorLabel string `env:"DEVBOX_SELECTOR_LABEL" envDefault:"app.kubernetes.io/part-of=devbox"`
+	// Kind of the owner reference naming the devbox of secrets and pods
+	DevboxOwnerKind string `env:"DEVBOX_OWNER_KIND" envDefault:"Devbox"`
 
 	// Security configuration
-	SSHHostKeySeed string `env:"SSH_HOST_KEY_SEED" envDefault:"sealos-devbox"`
+	SSHHostKeySeed string `env:"SSH_HOST_KEY_SEED" envDefault:"sealos-devbox" redact:"true"`
+	// Refuse weak seeds, auto when running in a cluster, and their minimum length
+	SSHHostKeySeedStrict    string `env:"SSH_HOST_KEY_SEED_STRICT"     envDefault:"auto" redact:"false"`
+	SSHHostKeySeedMinLength int    `env:"SSH_HOST_KEY_SEED_MIN_LENGTH" envDefault:"32"`
+	// Types of the host keys derived from the seed, ed25519, ecdsa or rsa
+	SSHHostKeyTypes []string `env:"SSH_HOST_KEY_TYPES" envDefault:"ed25519"`
+	// Seeds of the host keys before a rotation, most recent first, whose keys
+	// are still served for SSHHostKeyGracePeriod after SSHHostKeyRotatedAt
+	SSHHostKeyPreviousSeeds []string      `env:"SSH_HOST_KEY_PREVIOUS_SEEDS" redact:"true"`
+	SSHHostKeyRotatedAt     time.Time     `env:"SSH_HOST_KEY_ROTATED_AT"`
+	SSHHostKeyGracePeriod   time.Duration `env:"SSH_HOST_KEY_GRACE_PERIOD"   envDefault:"168h"`
+	// Host key read from a PEM file, else from a base64-encoded PEM, in place
+	// of the key derived from the seed, and the passphrase of an encrypted one
+	SSHHostKeyFile       string `env:"SSH_HOST_KEY_FILE"`
+	SSHHostKeyPEM        string `env:"SSH_HOST_KEY_PEM"        redact:"true"`
+	SSHHostKeyPassphrase string `env:"SSH_HOST_KEY_PASSPHRASE" redact:"true"`
+	// Secret holding the host key, namespace/name, created with a new key when
+	// missing
+	SSHHostKeySecret string `env:"SSH_HOST_KEY_SECRET"`
+	// OpenSSH host certificate of the host key, in place of the certificate
+	// field of the host key secret
+	SSHHostCertificateFile string `env:"SSH_HOST_CERTIFICATE_FILE"`
+	// Secret holding the TOTP secrets of second factor authentication, namespace/name
+	OTPSecret string `env:"OTP_SECRET"`
+	// ConfigMap listing the fingerprints of revoked keys, namespace/name
+	RevocationConfigMap string `env:"REVOCATION_CONFIGMAP"`
+	// Seeds of additional host keys advertised to clients during a rotation window
+	SSHHostKeyExtraSeeds []string `env:"SSH_HOST_KEY_EXTRA_SEEDS" redact:"true"`
+
+	// Record Kubernetes events about gateway activity on Devbox objects
+	KubernetesEventsEnabled bool `env:"KUBERNETES_EVENTS_ENABLED" envDefault:"false"`
 
 	// Pprof configuration
 	PprofEnabled bool `env:"PPROF_ENABLED" envDefault:"true"`
 	PprofPort    int  `env:"PPROF_PORT"    envDefault:"0"`
+	// Serve a redacted dump of the registry at /debug/registry of the pprof server
+	DebugRegistryEnabled bool `env:"DEBUG_REGISTRY_ENABLED" envDefault:"false"`
 
 	// Gateway configuration
-	Gateway gateway.Options `envPrefix:""`
-}
-
-// Load loads configuration from environment variables
-// It will attempt to load .env file if it exists
-func Load() (*Config, error) {
-	// Try to load .env file, but don't fail if it doesn't exist
-	_ = godotenv.Load()
+	Gateway GatewayOptions `envPrefix:""`
 
-	cfg := &Config{}
-	if err := env.Parse(cfg); err != nil {
-		return nil, fmt.Errorf("failed to parse environment variables: %w", err)
-	}
-
-	// Validate configuration
-	if err := cfg.validate(); err != nil {
-		return nil, fmt.Errorf("invalid configuration: %w", err)
-	}
-
-	return cfg, nil
+	// sources tells where the values set by Load come from, by environment variable
+	sources map[string]string
+	// dumpConfig is set by the --dump-config flag of Load
+	dumpConfig bool
 }
 
-// validate validates the configuration
-func (c *Config) validate() error {
+// Validate validates the configuration, as done by Load, errors about a value
+// being a *FieldError
+func (c *Config) Validate() error {
 	// Validate log level
 	validLogLevels := map[string]bool{
 		"debug": true,
@@ -64,7 +177,9 @@ func (c *Config) validate() error {
 		"error": true,
 	}
 	if !validLogLevels[c.LogLevel] {
-		return fmt.Errorf("invalid log level: %s (must be debug, info, warn, or error)", c.LogLevel)
+		return c.invalid("LOG_LEVEL", fmt.Errorf(
+			"invalid log level: %s (must be debug, info, warn, or error)", c.LogLevel,
+		))
 	}
 
 	// Validate log format
@@ -73,39 +188,413 @@ func (c *Config) validate() error {
 		"json": true,
 	}
 	if !validLogFormats[c.LogFormat] {
-		return fmt.Errorf("invalid log format: %s (must be text or json)", c.LogFormat)
+		return c.invalid("LOG_FORMAT",
+			fmt.Errorf("invalid log format: %s (must be text or json)", c.LogFormat))
+	}
+
+	if err := c.validateLogFile(); err != nil {
+		return err
 	}
 
 	// Validate port numbers
 	if c.Gateway.SSHBackendPort < 1 || c.Gateway.SSHBackendPort > 65535 {
-		return fmt.Errorf("invalid SSH backend port: %d", c.Gateway.SSHBackendPort)
+		return c.invalid("SSH_BACKEND_PORT",
+			fmt.Errorf("invalid SSH backend port: %d", c.Gateway.SSHBackendPort))
+	}
+
+	if len(c.SSHListenAddrs) == 0 && c.SSHListenFD == 0 {
+		return c.invalid("SSH_LISTEN_ADDR",
+			errors.New("at least one SSH listen address is required (SSH_LISTEN_ADDR)"))
+	}
+
+	if (c.WebSocketTLSCertFile == "") != (c.WebSocketTLSKeyFile == "") {
+		return c.invalid("WEBSOCKET_TLS_CERT_FILE", errors.New(
+			"WEBSOCKET_TLS_CERT_FILE and WEBSOCKET_TLS_KEY_FILE must be set together",
+		))
+	}
+
+	if c.SSHListenFD < 0 {
+		return c.invalid("SSH_LISTEN_FD", fmt.Errorf("invalid SSH listen fd: %d", c.SSHListenFD))
+	}
+
+	for _, namespace := range c.InformerNamespaces {
+		if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+			return c.invalid("INFORMER_NAMESPACES",
+				fmt.Errorf("invalid informer namespace %q: %s", namespace, errs[0]))
+		}
+	}
+
+	if c.KubeAPIQPS <= 0 || c.KubeAPIBurst <= 0 {
+		key := "KUBE_API_QPS"
+		if c.KubeAPIQPS > 0 {
+			key = "KUBE_API_BURST"
+		}
+
+		return c.invalid(key, fmt.Errorf(
+			"invalid Kubernetes API rate limit: %v QPS, burst %d", c.KubeAPIQPS, c.KubeAPIBurst,
+		))
+	}
+
+	if c.KubeAPITimeout < 0 {
+		return c.invalid("KUBE_API_TIMEOUT",
+			fmt.Errorf("invalid Kubernetes API timeout: %s", c.KubeAPITimeout))
+	}
+
+	if err := c.validateClusters(); err != nil {
+		return err
+	}
+
+	if c.InformerUnhealthyTimeout < 0 {
+		return c.invalid("INFORMER_UNHEALTHY_TIMEOUT",
+			fmt.Errorf("invalid informer unhealthy timeout: %s", c.InformerUnhealthyTimeout))
+	}
+
+	if c.InformerReconcileInterval < 0 {
+		return c.invalid("INFORMER_RECONCILE_INTERVAL", fmt.Errorf(
+			"invalid informer reconcile interval: %s", c.InformerReconcileInterval,
+		))
+	}
+
+	if c.InformerUnhealthyExit && c.InformerUnhealthyTimeout == 0 {
+		return c.invalid("INFORMER_UNHEALTHY_EXIT",
+			errors.New("INFORMER_UNHEALTHY_EXIT requires INFORMER_UNHEALTHY_TIMEOUT"))
+	}
+
+	if c.DevboxResource != "" {
+		if _, ok := c.DevboxResourceGVR(); !ok {
+			return c.invalid("DEVBOX_RESOURCE", fmt.Errorf(
+				"invalid devbox resource %q, want resource.version.group", c.DevboxResource,
+			))
+		}
+	}
+
+	if _, err := informer.ParseDiscoveryMode(c.DiscoveryMode); err != nil {
+		return c.invalid("DISCOVERY_MODE", err)
+	}
+
+	if _, err := registry.ParseBackendAddressing(c.BackendAddressing); err != nil {
+		return c.invalid("BACKEND_ADDRESSING", err)
+	}
+
+	if _, err := registry.ParseIPFamily(c.BackendIPFamily); err != nil {
+		return c.invalid("BACKEND_IP_FAMILY", err)
+	}
+
+	if len(c.DevboxPublicKeyFields) == 0 || slices.Contains(c.DevboxPublicKeyFields, "") ||
+		len(c.DevboxPrivateKeyFields) == 0 || slices.Contains(c.DevboxPrivateKeyFields, "") {
+		key := "DEVBOX_PUBLIC_KEY_FIELDS"
+		if len(c.DevboxPublicKeyFields) > 0 && !slices.Contains(c.DevboxPublicKeyFields, "") {
+			key = "DEVBOX_PRIVATE_KEY_FIELDS"
+		}
+
+		return c.invalid(key, errors.New(
+			"DEVBOX_PUBLIC_KEY_FIELDS and DEVBOX_PRIVATE_KEY_FIELDS must list field names",
+		))
+	}
+
+	// The label also selects the objects the informers list and watch
+	if key, value := c.DevboxSelectorLabelRef(); !strings.Contains(c.DevboxSelectorLabel, "=") ||
+		len(validation.IsQualifiedName(key)) > 0 || len(validation.IsValidLabelValue(value)) > 0 {
+		return c.invalid("DEVBOX_SELECTOR_LABEL", fmt.Errorf(
+			"invalid devbox selector label: %s (must be key=value)",
+			c.DevboxSelectorLabel,
+		))
+	}
+
+	if c.DevboxOwnerKind == "" {
+		return c.invalid("DEVBOX_OWNER_KIND", errors.New("DEVBOX_OWNER_KIND is required"))
+	}
+
+	if c.OTPSecret != "" {
+		if namespace, name := c.OTPSecretRef(); namespace == "" || name == "" {
+			return c.invalid("OTP_SECRET",
+				fmt.Errorf("invalid OTP secret: %s (must be namespace/name)", c.OTPSecret))
+		}
+	}
+
+	if len(c.SSHHostKeyTypes) == 0 {
+		return c.invalid("SSH_HOST_KEY_TYPES", errors.New("SSH_HOST_KEY_TYPES is required"))
+	}
+
+	if _, err := hostkey.ParseKeyTypes(c.SSHHostKeyTypes); err != nil {
+		return c.invalid("SSH_HOST_KEY_TYPES", err)
+	}
+
+	switch c.SSHHostKeySeedStrict {
+	case SeedStrictAuto, "true", "false":
+	default:
+		return c.invalid("SSH_HOST_KEY_SEED_STRICT", fmt.Errorf(
+			"invalid SSH_HOST_KEY_SEED_STRICT: %s (must be auto, true or false)",
+			c.SSHHostKeySeedStrict,
+		))
+	}
+
+	if c.SSHHostKeySeedMinLength < 1 {
+		return c.invalid("SSH_HOST_KEY_SEED_MIN_LENGTH", fmt.Errorf(
+			"invalid host key seed min length: %d (must be positive)",
+			c.SSHHostKeySeedMinLength,
+		))
+	}
+
+	if err := c.validateHostKeyRotation(); err != nil {
+		return err
+	}
+
+	if c.SSHHostKeySecret != "" {
+		if namespace, name := c.SSHHostKeySecretRef(); namespace == "" || name == "" {
+			return c.invalid("SSH_HOST_KEY_SECRET", fmt.Errorf(
+				"invalid host key secret: %s (must be namespace/name)", c.SSHHostKeySecret,
+			))
+		}
+	}
+
+	if c.RevocationConfigMap != "" {
+		if namespace, name := c.RevocationConfigMapRef(); namespace == "" || name == "" {
+			return c.invalid("REVOCATION_CONFIGMAP", fmt.Errorf(
+				"invalid revocation ConfigMap: %s (must be namespace/name)",
+				c.RevocationConfigMap,
+			))
+		}
+	}
+
+	if c.RegistrySnapshotPath != "" && c.RegistrySnapshotInterval <= 0 {
+		return c.invalid("REGISTRY_SNAPSHOT_INTERVAL", fmt.Errorf(
+			"invalid registry snapshot interval: %s (must be positive)",
+			c.RegistrySnapshotInterval,
+		))
+	}
+
+	if len(c.Gateway.OTPNamespaces) > 0 && c.OTPSecret == "" {
+		return c.invalid("OTP_NAMESPACES", errors.New("OTP_NAMESPACES requires OTP_SECRET"))
 	}
 
 	if c.PprofPort < 0 || c.PprofPort > 65535 {
-		return fmt.Errorf("invalid pprof port: %d", c.PprofPort)
+		return c.invalid("PPROF_PORT", fmt.Errorf("invalid pprof port: %d", c.PprofPort))
+	}
+
+	if c.DebugRegistryEnabled && !c.PprofEnabled {
+		return c.invalid("DEBUG_REGISTRY_ENABLED",
+			errors.New("DEBUG_REGISTRY_ENABLED requires PPROF_ENABLED"))
 	}
 
 	// Validate that at least one proxy mode is enabled
-	if !c.Gateway.EnableAgentForward && !c.Gateway.EnableProxyJump {
-		return errors.New(
-			"at least one proxy mode must be enabled (ENABLE_AGENT_FORWARD or ENABLE_PROXY_JUMP)",
-		)
+	if options := c.Gateway.Options(); (options.DisableAgentForwardingMode ||
+		!options.EnableAgentForward) && !options.EnableProxyJump {
+		return c.invalid("ENABLE_PROXY_JUMP", errors.New(
+			"at least one proxy mode must be enabled (agent forwarding mode, "+
+				"see DISABLE_AGENT_FORWARDING_MODE, or ENABLE_PROXY_JUMP)",
+		))
+	}
+
+	if err := c.Gateway.Validate(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// validateLogFile checks the log output, the rotation of the log file and the
+// limit of repeated logs
+func (c *Config) validateLogFile() error {
+	switch c.LogOutput {
+	case logger.OutputStdout:
+	case logger.OutputFile, logger.OutputBoth:
+		if c.LogFile == "" {
+			return c.invalid("LOG_FILE",
+				fmt.Errorf("LOG_FILE is required with LOG_OUTPUT=%s", c.LogOutput))
+		}
+	default:
+		return c.invalid("LOG_OUTPUT", fmt.Errorf(
+			"invalid log output: %s (must be stdout, file, or both)", c.LogOutput))
+	}
+
+	if c.LogFileMaxSize < 0 {
+		return c.invalid("LOG_FILE_MAX_SIZE",
+			fmt.Errorf("invalid log file max size: %d", c.LogFileMaxSize))
+	}
+
+	if c.LogFileMaxBackups < 0 {
+		return c.invalid("LOG_FILE_MAX_BACKUPS",
+			fmt.Errorf("invalid log file max backups: %d", c.LogFileMaxBackups))
+	}
+
+	if c.LogFileMaxAge < 0 {
+		return c.invalid("LOG_FILE_MAX_AGE",
+			fmt.Errorf("invalid log file max age: %s", c.LogFileMaxAge))
+	}
+
+	if c.LogRepeatLimit < 0 {
+		return c.invalid("LOG_REPEAT_LIMIT",
+			fmt.Errorf("invalid log repeat limit: %d", c.LogRepeatLimit))
+	}
+
+	if c.LogRepeatLimit > 0 && c.LogRepeatInterval <= 0 {
+		return c.invalid("LOG_REPEAT_INTERVAL",
+			fmt.Errorf("invalid log repeat interval: %s", c.LogRepeatInterval))
+	}
+
+	return nil
+}
+
+// LogRotation returns the rotation of the log file
+func (c *Config) LogRotation() logger.Rotation {
+	return logger.Rotation{
+		MaxSize:    int64(c.LogFileMaxSize) << 20,
+		MaxBackups: c.LogFileMaxBackups,
+		MaxAge:     c.LogFileMaxAge,
+		Compress:   c.LogFileCompress,
+	}
+}
+
+// validateClusters checks that the remote clusters are named once each and
+// that cluster proxies name one of them
+func (c *Config) validateClusters() error {
+	for i, cluster := range c.Clusters {
+		if cluster == "" {
+			return c.invalid("CLUSTERS", errors.New("invalid cluster: empty name"))
+		}
+
+		if slices.Contains(c.Clusters[:i], cluster) {
+			return c.invalid("CLUSTERS", fmt.Errorf("invalid cluster %q: listed twice", cluster))
+		}
+	}
+
+	for _, entry := range c.Gateway.ClusterProxies {
+		cluster, _, _ := strings.Cut(entry, "=")
+		if !slices.Contains(c.Clusters, cluster) {
+			return c.invalid("CLUSTER_PROXIES",
+				fmt.Errorf("invalid cluster proxy %q: %q is not in CLUSTERS", entry, cluster))
+		}
+	}
+
+	return nil
+}
+
+// OTPSecretRef returns the namespace and name of the OTP secret
+func (c *Config) OTPSecretRef() (namespace, name string) {
+	namespace, name, _ = strings.Cut(c.OTPSecret, "/")
+	return namespace, name
+}
+
+// validateHostKeyRotation checks the previous seeds of a host key rotation
+func (c *Config) validateHostKeyRotation() error {
+	if len(c.SSHHostKeyPreviousSeeds) == 0 {
+		return nil
+	}
+
+	if c.SSHHostKeyRotatedAt.IsZero() {
+		return c.invalid("SSH_HOST_KEY_ROTATED_AT",
+			errors.New("SSH_HOST_KEY_ROTATED_AT is required with SSH_HOST_KEY_PREVIOUS_SEEDS"))
+	}
+
+	if c.SSHHostKeyGracePeriod <= 0 {
+		return c.invalid("SSH_HOST_KEY_GRACE_PERIOD", fmt.Errorf(
+			"invalid host key grace period: %s (must be positive)", c.SSHHostKeyGracePeriod,
+		))
+	}
+
+	for i, seed := range c.SSHHostKeyPreviousSeeds {
+		if seed == "" {
+			return c.invalid("SSH_HOST_KEY_PREVIOUS_SEEDS",
+				errors.New("invalid previous host key seeds: empty seed"))
+		}
+
+		// The keys of the seed would be served as both the new and the old ones
+		if seed == c.SSHHostKeySeed {
+			return c.invalid("SSH_HOST_KEY_PREVIOUS_SEEDS", errors.New(
+				"invalid previous host key seeds: SSH_HOST_KEY_SEED is listed, "+
+					"a rotation needs a new seed",
+			))
+		}
+
+		if slices.Contains(c.SSHHostKeyPreviousSeeds[:i], seed) {
+			return c.invalid("SSH_HOST_KEY_PREVIOUS_SEEDS",
+				errors.New("invalid previous host key seeds: a seed is listed twice"))
+		}
 	}
 
 	return nil
 }
 
+// SSHHostKeySeedStrictMode returns whether weak host key seeds are refused, by
+// default when running in a Kubernetes pod
+func (c *Config) SSHHostKeySeedStrictMode() bool {
+	if c.SSHHostKeySeedStrict == SeedStrictAuto {
+		return os.Getenv("KUBERNETES_SERVICE_HOST") != ""
+	}
+
+	return c.SSHHostKeySeedStrict == "true"
+}
+
+// SSHHostKeyGraceUntil returns when the keys of the previous seeds stop being
+// served
+func (c *Config) SSHHostKeyGraceUntil() time.Time {
+	return c.SSHHostKeyRotatedAt.Add(c.SSHHostKeyGracePeriod)
+}
+
+// SSHHostKeySecretRef returns the namespace and name of the host key secret
+func (c *Config) SSHHostKeySecretRef() (namespace, name string) {
+	namespace, name, _ = strings.Cut(c.SSHHostKeySecret, "/")
+	return namespace, name
+}
+
+// DevboxSelectorLabelRef returns the key and value of the label of devboxes
+func (c *Config) DevboxSelectorLabelRef() (key, value string) {
+	key, value, _ = strings.Cut(c.DevboxSelectorLabel, "=")
+	return key, value
+}
+
+// DevboxResourceGVR returns the Devbox custom resource to watch, false unless
+// DevboxResource names a resource, version and group
+func (c *Config) DevboxResourceGVR() (schema.GroupVersionResource, bool) {
+	gvr, _ := schema.ParseResourceArg(c.DevboxResource)
+	if gvr == nil || gvr.Resource == "" || gvr.Version == "" || gvr.Group == "" {
+		return schema.GroupVersionResource{}, false
+	}
+
+	return *gvr, true
+}
+
+// RevocationConfigMapRef returns the namespace and name of the revocation ConfigMap
+func (c *Config) RevocationConfigMapRef() (namespace, name string) {
+	namespace, name, _ = strings.Cut(c.RevocationConfigMap, "/")
+	return namespace, name
+}
+
 // NewDefaultConfig creates a config for testing with sensible defaults
 func NewDefaultConfig() *Config {
 	return &Config{
-		SSHListenAddr:        ":2222",
-		Debug:                false,
-		LogLevel:             "info",
-		LogFormat:            "text",
-		InformerResyncPeriod: 30 * time.Second,
-		SSHHostKeySeed:       "sealos-devbox",
-		PprofEnabled:         true,
-		PprofPort:            0,
-		Gateway:              gateway.DefaultOptions(),
+		SSHListenAddrs:           []string{":2222"},
+		SSHListenSocketMode:      0o660,
+		SSHListenSocketUID:       -1,
+		SSHListenSocketGID:       -1,
+		WebSocketPath:            listen.DefaultWebSocketPath,
+		Debug:                    false,
+		LogLevel:                 "info",
+		LogFormat:                "text",
+		LogOutput:                logger.OutputStdout,
+		LogFileMaxSize:           100,
+		LogRepeatLimit:           10,
+		LogRepeatInterval:        time.Minute,
+		KubeAPIQPS:               kubeclient.DefaultQPS,
+		KubeAPIBurst:             kubeclient.DefaultBurst,
+		InformerResyncPeriod:     30 * time.Second,
+		InformerUnhealthyTimeout: informer.DefaultUnhealthyTimeout,
+		RegistrySnapshotInterval: time.Minute,
+		DiscoveryMode:            string(informer.DiscoveryPods),
+		BackendAddressing:        string(registry.BackendAddressingPodIP),
+		BackendHostTemplate:      registry.DefaultBackendHostTemplate,
+		DevboxPublicKeyFields:    []string{registry.DevboxPublicKeyField},
+		DevboxPrivateKeyFields:   []string{registry.DevboxPrivateKeyField},
+		DevboxSelectorLabel:      registry.DevboxPartOfLabel + "=" + registry.DevboxPartOfValue,
+		DevboxOwnerKind:          registry.DevboxOwnerKind,
+		SSHHostKeySeed:           "sealos-devbox",
+		SSHHostKeySeedStrict:     SeedStrictAuto,
+		SSHHostKeySeedMinLength:  hostkey.DefaultSeedMinLength,
+		SSHHostKeyTypes:          []string{string(hostkey.KeyTypeED25519)},
+		SSHHostKeyGracePeriod:    7 * 24 * time.Hour,
+		PprofEnabled:             true,
+		PprofPort:                0,
+		Gateway:                  DefaultGatewayOptions(),
 	}
 }
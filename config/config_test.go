@@ -1,11 +1,15 @@
 package config_test
 
 import (
+	"slices"
 	"testing"
 	"time"
 
 	"github.com/zijiren233/sshgate/config"
 	"github.com/zijiren233/sshgate/gateway"
+	"github.com/zijiren233/sshgate/informer"
+	"github.com/zijiren233/sshgate/kubeclient"
+	"github.com/zijiren233/sshgate/registry"
 )
 
 //nolint:gocyclo // Test function with multiple sub-tests
@@ -17,8 +21,8 @@ func TestLoad(t *testing.T) {
 		}
 
 		// Verify default values
-		if cfg.SSHListenAddr != ":2222" {
-			t.Errorf("SSHListenAddr = %s, want :2222", cfg.SSHListenAddr)
+		if !slices.Equal(cfg.SSHListenAddrs, []string{":2222"}) {
+			t.Errorf("SSHListenAddrs = %v, want [:2222]", cfg.SSHListenAddrs)
 		}
 
 		if cfg.Debug != false {
@@ -37,8 +41,8 @@ func TestLoad(t *testing.T) {
 			t.Errorf("Gateway.SSHBackendPort = %d, want 22", cfg.Gateway.SSHBackendPort)
 		}
 
-		if cfg.Gateway.EnableAgentForward != true {
-			t.Errorf("Gateway.EnableAgentForward = %v, want true", cfg.Gateway.EnableAgentForward)
+		if cfg.Gateway.EnableAgentForward != nil {
+			t.Errorf("Gateway.EnableAgentForward = %v, want unset", *cfg.Gateway.EnableAgentForward)
 		}
 
 		if cfg.Gateway.EnableProxyJump != true {
@@ -63,8 +67,8 @@ func TestLoad(t *testing.T) {
 			t.Fatalf("Load() failed: %v", err)
 		}
 
-		if cfg.SSHListenAddr != ":3333" {
-			t.Errorf("SSHListenAddr = %s, want :3333", cfg.SSHListenAddr)
+		if !slices.Equal(cfg.SSHListenAddrs, []string{":3333"}) {
+			t.Errorf("SSHListenAddrs = %v, want [:3333]", cfg.SSHListenAddrs)
 		}
 
 		if cfg.Debug != true {
@@ -83,8 +87,8 @@ func TestLoad(t *testing.T) {
 			t.Errorf("Gateway.SSHBackendPort = %d, want 2222", cfg.Gateway.SSHBackendPort)
 		}
 
-		if cfg.Gateway.EnableAgentForward != false {
-			t.Errorf("Gateway.EnableAgentForward = %v, want false", cfg.Gateway.EnableAgentForward)
+		if options := cfg.Gateway.Options(); options.EnableAgentForward {
+			t.Error("EnableAgentForward = true with ENABLE_AGENT_FORWARD=false, want false")
 		}
 
 		if cfg.Gateway.EnableProxyJump != true {
@@ -136,6 +140,33 @@ func TestLoad(t *testing.T) {
 		}
 	})
 
+	t.Run("LoadWithInvalidBackendHostKeyPolicy", func(t *testing.T) {
+		t.Setenv("BACKEND_HOST_KEY_POLICY", "ca")
+
+		_, err := config.Load()
+		if err == nil {
+			t.Fatal("Expected error for ca policy without CA keys, got nil")
+		}
+	})
+
+	t.Run("LoadWithInvalidBackendAddressing", func(t *testing.T) {
+		t.Setenv("BACKEND_ADDRESSING", "service")
+
+		_, err := config.Load()
+		if err == nil {
+			t.Fatal("Expected error for invalid backend addressing, got nil")
+		}
+	})
+
+	t.Run("LoadWithInvalidBackendIPFamily", func(t *testing.T) {
+		t.Setenv("BACKEND_IP_FAMILY", "ipv5")
+
+		_, err := config.Load()
+		if err == nil {
+			t.Fatal("Expected error for invalid backend IP family, got nil")
+		}
+	})
+
 	t.Run("LoadWithBothProxyModesDisabled", func(t *testing.T) {
 		t.Setenv("ENABLE_AGENT_FORWARD", "false")
 		t.Setenv("ENABLE_PROXY_JUMP", "false")
@@ -146,6 +177,16 @@ func TestLoad(t *testing.T) {
 		}
 	})
 
+	t.Run("LoadWithDeprecatedAgentForwardAndPublicKeyModeDisabled", func(t *testing.T) {
+		t.Setenv("ENABLE_AGENT_FORWARD", "false")
+		t.Setenv("DISABLE_PUBLIC_KEY_MODE", "true")
+
+		_, err := config.Load()
+		if err == nil {
+			t.Fatal("Expected error when public key and agent forwarding modes are disabled, got nil")
+		}
+	})
+
 	t.Run("LoadWithTimeoutValues", func(t *testing.T) {
 		t.Setenv("SSH_HANDSHAKE_TIMEOUT", "30s")
 		t.Setenv("BACKEND_CONNECT_TIMEOUT_PUBLICKEY", "20s")
@@ -190,6 +231,20 @@ func TestLoad(t *testing.T) {
 		}
 	})
 
+	t.Run("LoadWithMultipleListenAddrs", func(t *testing.T) {
+		t.Setenv("SSH_LISTEN_ADDR", "0.0.0.0:22,[::]:22,:2222")
+
+		cfg, err := config.Load()
+		if err != nil {
+			t.Fatalf("Load() failed: %v", err)
+		}
+
+		want := []string{"0.0.0.0:22", "[::]:22", ":2222"}
+		if !slices.Equal(cfg.SSHListenAddrs, want) {
+			t.Errorf("SSHListenAddrs = %v, want %v", cfg.SSHListenAddrs, want)
+		}
+	})
+
 	t.Run("LoadWithSecurityOptions", func(t *testing.T) {
 		t.Setenv("MAX_CACHED_REQUESTS", "10")
 
@@ -212,8 +267,8 @@ func TestNewDefaultConfig(t *testing.T) {
 	}
 
 	// Test basic fields
-	if cfg.SSHListenAddr != ":2222" {
-		t.Errorf("SSHListenAddr = %s, want :2222", cfg.SSHListenAddr)
+	if !slices.Equal(cfg.SSHListenAddrs, []string{":2222"}) {
+		t.Errorf("SSHListenAddrs = %v, want [:2222]", cfg.SSHListenAddrs)
 	}
 
 	if cfg.Debug != false {
@@ -263,11 +318,11 @@ func TestNewDefaultConfig(t *testing.T) {
 		)
 	}
 
-	if cfg.Gateway.EnableAgentForward != defaultGateway.EnableAgentForward {
+	if cfg.Gateway.DisableAgentForwardingMode != defaultGateway.DisableAgentForwardingMode {
 		t.Errorf(
-			"Gateway.EnableAgentForward = %v, want %v",
-			cfg.Gateway.EnableAgentForward,
-			defaultGateway.EnableAgentForward,
+			"Gateway.DisableAgentForwardingMode = %v, want %v",
+			cfg.Gateway.DisableAgentForwardingMode,
+			defaultGateway.DisableAgentForwardingMode,
 		)
 	}
 
@@ -320,46 +375,60 @@ func TestValidLogFormats(t *testing.T) {
 
 func TestProxyModeValidation(t *testing.T) {
 	tests := []struct {
-		name             string
-		enableAgentForwd string
-		enableProxyJump  string
-		shouldFail       bool
-		description      string
+		name                 string
+		disableAgentForwMode string
+		enableProxyJump      string
+		disablePublicKeyMode string
+		shouldFail           bool
+		description          string
 	}{
 		{
-			name:             "BothEnabled",
-			enableAgentForwd: "true",
-			enableProxyJump:  "true",
-			shouldFail:       false,
-			description:      "Both modes enabled should succeed",
+			name:                 "BothEnabled",
+			disableAgentForwMode: "false",
+			enableProxyJump:      "true",
+			disablePublicKeyMode: "false",
+			shouldFail:           false,
+			description:          "Both modes enabled should succeed",
 		},
 		{
-			name:             "OnlyAgentForward",
-			enableAgentForwd: "true",
-			enableProxyJump:  "false",
-			shouldFail:       false,
-			description:      "Only agent forward enabled should succeed",
+			name:                 "OnlyAgentForward",
+			disableAgentForwMode: "false",
+			enableProxyJump:      "false",
+			disablePublicKeyMode: "false",
+			shouldFail:           false,
+			description:          "Only agent forward enabled should succeed",
 		},
 		{
-			name:             "OnlyProxyJump",
-			enableAgentForwd: "false",
-			enableProxyJump:  "true",
-			shouldFail:       false,
-			description:      "Only proxy jump enabled should succeed",
+			name:                 "OnlyProxyJump",
+			disableAgentForwMode: "true",
+			enableProxyJump:      "true",
+			disablePublicKeyMode: "false",
+			shouldFail:           false,
+			description:          "Only proxy jump enabled should succeed",
 		},
 		{
-			name:             "BothDisabled",
-			enableAgentForwd: "false",
-			enableProxyJump:  "false",
-			shouldFail:       true,
-			description:      "Both modes disabled should fail",
+			name:                 "BothDisabled",
+			disableAgentForwMode: "true",
+			enableProxyJump:      "false",
+			disablePublicKeyMode: "false",
+			shouldFail:           true,
+			description:          "Both modes disabled should fail",
+		},
+		{
+			name:                 "NoPublicKeyNorAgentForward",
+			disableAgentForwMode: "true",
+			enableProxyJump:      "true",
+			disablePublicKeyMode: "true",
+			shouldFail:           true,
+			description:          "Public key and agent forwarding modes disabled should fail",
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			t.Setenv("ENABLE_AGENT_FORWARD", tt.enableAgentForwd)
+			t.Setenv("DISABLE_AGENT_FORWARDING_MODE", tt.disableAgentForwMode)
 			t.Setenv("ENABLE_PROXY_JUMP", tt.enableProxyJump)
+			t.Setenv("DISABLE_PUBLIC_KEY_MODE", tt.disablePublicKeyMode)
 
 			_, err := config.Load()
 
@@ -374,6 +443,26 @@ func TestProxyModeValidation(t *testing.T) {
 	}
 }
 
+func TestAgentForwardingModeValidation(t *testing.T) {
+	t.Setenv("DISABLE_AGENT_FORWARDING_MODE", "true")
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("Load() failed: %v", err)
+	}
+
+	if !cfg.Gateway.DisableAgentForwardingMode {
+		t.Error("Gateway.DisableAgentForwardingMode = false, want true")
+	}
+
+	// Custom keys could reach no devbox without either mode
+	t.Setenv("DISABLE_PUBLIC_KEY_MODE", "true")
+
+	if _, err := config.Load(); err == nil {
+		t.Error("Load() with public key and agent forwarding modes disabled succeeded")
+	}
+}
+
 func TestPortValidation(t *testing.T) {
 	tests := []struct {
 		name       string
@@ -409,3 +498,424 @@ func TestPortValidation(t *testing.T) {
 		})
 	}
 }
+
+func TestOTPValidation(t *testing.T) {
+	tests := []struct {
+		name       string
+		secret     string
+		namespaces string
+		shouldFail bool
+	}{
+		{"Disabled", "", "", false},
+		{"Enabled", "sshgate/otp", "ns-a,ns-b", false},
+		{"SecretWithoutNamespace", "otp", "", true},
+		{"NamespacesWithoutSecret", "", "ns-a", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OTP_SECRET", tt.secret)
+			t.Setenv("OTP_NAMESPACES", tt.namespaces)
+
+			cfg, err := config.Load()
+
+			if tt.shouldFail {
+				if err == nil {
+					t.Error("Expected error, got none")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if namespace, name := cfg.OTPSecretRef(); tt.secret != "" &&
+				namespace+"/"+name != tt.secret {
+				t.Errorf("OTPSecretRef() = %s, %s, want %s", namespace, name, tt.secret)
+			}
+		})
+	}
+}
+
+func TestRevocationConfigMapValidation(t *testing.T) {
+	t.Setenv("REVOCATION_CONFIGMAP", "revoked-keys")
+
+	if _, err := config.Load(); err == nil {
+		t.Error("Expected error for a ConfigMap without namespace, got none")
+	}
+
+	t.Setenv("REVOCATION_CONFIGMAP", "sshgate/revoked-keys")
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if namespace, name := cfg.RevocationConfigMapRef(); namespace != "sshgate" ||
+		name != "revoked-keys" {
+		t.Errorf("RevocationConfigMapRef() = %s, %s, want sshgate, revoked-keys", namespace, name)
+	}
+}
+
+func TestHostKeyTypesValidation(t *testing.T) {
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Only the ed25519 key of existing known_hosts entries by default
+	if !slices.Equal(cfg.SSHHostKeyTypes, []string{"ed25519"}) {
+		t.Errorf("SSHHostKeyTypes = %v, want [ed25519]", cfg.SSHHostKeyTypes)
+	}
+
+	for _, types := range []string{"ed25519,dsa", "rsa,rsa"} {
+		t.Setenv("SSH_HOST_KEY_TYPES", types)
+
+		if _, err := config.Load(); err == nil {
+			t.Errorf("Expected error for host key types %s, got none", types)
+		}
+	}
+
+	t.Setenv("SSH_HOST_KEY_TYPES", "ed25519,ecdsa,rsa")
+
+	if _, err := config.Load(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestHostKeySeedStrictMode(t *testing.T) {
+	tests := []struct {
+		name       string
+		strict     string
+		inCluster  bool
+		wantStrict bool
+	}{
+		{name: "auto in a cluster", strict: "auto", inCluster: true, wantStrict: true},
+		{name: "auto outside of a cluster", strict: "auto"},
+		{name: "forced", strict: "true", wantStrict: true},
+		{name: "disabled in a cluster", strict: "false", inCluster: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SSH_HOST_KEY_SEED_STRICT", tt.strict)
+
+			if tt.inCluster {
+				t.Setenv("KUBERNETES_SERVICE_HOST", "10.96.0.1")
+			} else {
+				t.Setenv("KUBERNETES_SERVICE_HOST", "")
+			}
+
+			cfg, err := config.Load()
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if got := cfg.SSHHostKeySeedStrictMode(); got != tt.wantStrict {
+				t.Errorf("SSHHostKeySeedStrictMode() = %v, want %v", got, tt.wantStrict)
+			}
+		})
+	}
+
+	t.Setenv("SSH_HOST_KEY_SEED_STRICT", "yes")
+
+	if _, err := config.Load(); err == nil {
+		t.Error("Expected error for an invalid SSH_HOST_KEY_SEED_STRICT, got none")
+	}
+
+	t.Setenv("SSH_HOST_KEY_SEED_STRICT", "auto")
+	t.Setenv("SSH_HOST_KEY_SEED_MIN_LENGTH", "0")
+
+	if _, err := config.Load(); err == nil {
+		t.Error("Expected error for a zero seed min length, got none")
+	}
+}
+
+func TestHostKeyRotationValidation(t *testing.T) {
+	t.Setenv("SSH_HOST_KEY_SEED", "new-seed")
+	t.Setenv("SSH_HOST_KEY_PREVIOUS_SEEDS", "old-seed")
+
+	if _, err := config.Load(); err == nil {
+		t.Error("Expected error for previous seeds without a rotation time, got none")
+	}
+
+	t.Setenv("SSH_HOST_KEY_ROTATED_AT", "2026-01-02T15:04:05Z")
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	want := time.Date(2026, 1, 9, 15, 4, 5, 0, time.UTC)
+	if got := cfg.SSHHostKeyGraceUntil(); !got.Equal(want) {
+		t.Errorf("SSHHostKeyGraceUntil() = %s, want %s", got, want)
+	}
+
+	for _, seeds := range []string{"new-seed", "old-seed,old-seed"} {
+		t.Setenv("SSH_HOST_KEY_PREVIOUS_SEEDS", seeds)
+
+		if _, err := config.Load(); err == nil {
+			t.Errorf("Expected error for previous seeds %s, got none", seeds)
+		}
+	}
+}
+
+func TestRegistrySnapshotValidation(t *testing.T) {
+	t.Setenv("REGISTRY_SNAPSHOT_PATH", "/var/lib/sshgate/registry.snapshot")
+	t.Setenv("REGISTRY_SNAPSHOT_INTERVAL", "0s")
+
+	if _, err := config.Load(); err == nil {
+		t.Error("Expected error for a zero snapshot interval, got none")
+	}
+
+	t.Setenv("REGISTRY_SNAPSHOT_INTERVAL", "")
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if cfg.RegistrySnapshotInterval != time.Minute {
+		t.Errorf("RegistrySnapshotInterval = %v, want 1m", cfg.RegistrySnapshotInterval)
+	}
+}
+
+func TestDebugRegistryValidation(t *testing.T) {
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if cfg.DebugRegistryEnabled {
+		t.Error("DebugRegistryEnabled = true, want it disabled by default")
+	}
+
+	t.Setenv("DEBUG_REGISTRY_ENABLED", "true")
+	t.Setenv("PPROF_ENABLED", "false")
+
+	if _, err := config.Load(); err == nil {
+		t.Error("Expected error for the registry dump without pprof server, got none")
+	}
+}
+
+func TestDevboxLayoutConfig(t *testing.T) {
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if key, value := cfg.DevboxSelectorLabelRef(); key != registry.DevboxPartOfLabel ||
+		value != registry.DevboxPartOfValue || cfg.DevboxOwnerKind != registry.DevboxOwnerKind {
+		t.Errorf("Devbox selector %s=%s owned by %s, want the Sealos defaults",
+			key, value, cfg.DevboxOwnerKind)
+	}
+
+	t.Setenv("DEVBOX_PUBLIC_KEY_FIELDS", "SEALOS_DEVBOX_PUBLIC_KEY,ssh-publickey")
+	t.Setenv("DEVBOX_PRIVATE_KEY_FIELDS", "ssh-privatekey")
+	t.Setenv("DEVBOX_SELECTOR_LABEL", "example.com/workspace=")
+
+	cfg, err = config.Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if !slices.Equal(cfg.DevboxPublicKeyFields,
+		[]string{"SEALOS_DEVBOX_PUBLIC_KEY", "ssh-publickey"}) {
+		t.Errorf("DevboxPublicKeyFields = %v", cfg.DevboxPublicKeyFields)
+	}
+
+	if key, value := cfg.DevboxSelectorLabelRef(); key != "example.com/workspace" || value != "" {
+		t.Errorf("DevboxSelectorLabelRef() = %s, %s, want an empty value", key, value)
+	}
+
+	for env, value := range map[string]string{
+		"DEVBOX_SELECTOR_LABEL":    "example.com/workspace",
+		"DEVBOX_PUBLIC_KEY_FIELDS": "a,,b",
+	} {
+		t.Run(env, func(t *testing.T) {
+			t.Setenv(env, value)
+
+			if _, err := config.Load(); err == nil {
+				t.Errorf("Expected error for %s=%s, got none", env, value)
+			}
+		})
+	}
+
+	// The label is also a selector of the informers, it must be a single label
+	t.Setenv("DEVBOX_SELECTOR_LABEL", "app=devbox,team=a")
+
+	if _, err := config.Load(); err == nil {
+		t.Error("Expected error for a selector of several labels, got none")
+	}
+}
+
+func TestInformerNamespacesConfig(t *testing.T) {
+	t.Setenv("INFORMER_NAMESPACES", "tenant-a,tenant-b")
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if !slices.Equal(cfg.InformerNamespaces, []string{"tenant-a", "tenant-b"}) {
+		t.Errorf("InformerNamespaces = %v", cfg.InformerNamespaces)
+	}
+
+	t.Setenv("INFORMER_NAMESPACES", "tenant-a,Tenant_B")
+
+	if _, err := config.Load(); err == nil {
+		t.Error("Expected error for an invalid namespace, got none")
+	}
+}
+
+func TestInformerHealthConfig(t *testing.T) {
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if cfg.InformerUnhealthyTimeout != informer.DefaultUnhealthyTimeout ||
+		cfg.InformerUnhealthyExit || cfg.HealthListenAddr != "" {
+		t.Errorf("Informer health config = %s, %t, %q, want the defaults",
+			cfg.InformerUnhealthyTimeout, cfg.InformerUnhealthyExit, cfg.HealthListenAddr)
+	}
+
+	for env, value := range map[string]string{
+		"INFORMER_UNHEALTHY_TIMEOUT": "-1m",
+		"INFORMER_UNHEALTHY_EXIT":    "true",
+	} {
+		t.Run(env, func(t *testing.T) {
+			t.Setenv("INFORMER_UNHEALTHY_TIMEOUT", "0")
+			t.Setenv(env, value)
+
+			if _, err := config.Load(); err == nil {
+				t.Errorf("Expected error for %s=%s, got none", env, value)
+			}
+		})
+	}
+}
+
+func TestKubeClientConfig(t *testing.T) {
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if cfg.KubeAPIQPS != kubeclient.DefaultQPS || cfg.KubeAPIBurst != kubeclient.DefaultBurst {
+		t.Errorf("Rate limit = %v QPS, burst %d, want the defaults",
+			cfg.KubeAPIQPS, cfg.KubeAPIBurst)
+	}
+
+	t.Setenv("KUBE_CONTEXT", "staging")
+	t.Setenv("KUBE_API_QPS", "12.5")
+	t.Setenv("KUBE_API_TIMEOUT", "30s")
+
+	cfg, err = config.Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if cfg.KubeContext != "staging" || cfg.KubeAPIQPS != 12.5 ||
+		cfg.KubeAPITimeout != 30*time.Second {
+		t.Errorf("Kubernetes client config = %q, %v QPS, %s",
+			cfg.KubeContext, cfg.KubeAPIQPS, cfg.KubeAPITimeout)
+	}
+
+	for name, value := range map[string]string{
+		"KUBE_API_QPS":     "0",
+		"KUBE_API_BURST":   "-1",
+		"KUBE_API_TIMEOUT": "-1s",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+
+			if _, err := config.Load(); err == nil {
+				t.Errorf("Expected error for %s=%s, got none", name, value)
+			}
+		})
+	}
+}
+
+func TestDiscoveryModeConfig(t *testing.T) {
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if cfg.DiscoveryMode != string(informer.DiscoveryPods) {
+		t.Errorf("DiscoveryMode = %q, want pods", cfg.DiscoveryMode)
+	}
+
+	t.Setenv("DISCOVERY_MODE", "endpointslices")
+
+	if _, err := config.Load(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	t.Setenv("DISCOVERY_MODE", "services")
+
+	if _, err := config.Load(); err == nil {
+		t.Error("Expected error for an unknown discovery mode, got none")
+	}
+}
+
+func TestClustersConfig(t *testing.T) {
+	t.Setenv("CLUSTERS", "hk,sg")
+	t.Setenv("CLUSTER_PROXIES", "hk=proxy.hk.example.com:1080")
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if !slices.Equal(cfg.Clusters, []string{"hk", "sg"}) ||
+		len(cfg.Gateway.ClusterProxies) != 1 {
+		t.Errorf("Clusters = %v, proxies %v", cfg.Clusters, cfg.Gateway.ClusterProxies)
+	}
+
+	for name, env := range map[string]map[string]string{
+		"duplicate cluster":  {"CLUSTERS": "hk,hk"},
+		"unknown proxy":      {"CLUSTER_PROXIES": "us=proxy.us.example.com:1080"},
+		"proxy without port": {"CLUSTER_PROXIES": "hk=proxy.hk.example.com"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			for key, value := range env {
+				t.Setenv(key, value)
+			}
+
+			if _, err := config.Load(); err == nil {
+				t.Error("Expected error, got none")
+			}
+		})
+	}
+}
+
+func TestDevboxResourceConfig(t *testing.T) {
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if _, ok := cfg.DevboxResourceGVR(); ok {
+		t.Error("Devbox resource watched by default")
+	}
+
+	t.Setenv("DEVBOX_RESOURCE", "devboxes.v1alpha1.devbox.sealos.io")
+
+	cfg, err = config.Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if gvr, ok := cfg.DevboxResourceGVR(); !ok || gvr != informer.DefaultDevboxResource {
+		t.Errorf("DevboxResourceGVR() = %v, %t, want %v", gvr, ok, informer.DefaultDevboxResource)
+	}
+
+	t.Setenv("DEVBOX_RESOURCE", "devboxes")
+
+	if _, err := config.Load(); err == nil {
+		t.Error("Expected error for a resource without version and group, got none")
+	}
+}
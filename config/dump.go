@@ -0,0 +1,91 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/zijiren233/sshgate/listen"
+	"sigs.k8s.io/yaml"
+)
+
+// Redacted replaces the values of the fields tagged redact:"true" in Dump
+const Redacted = "***"
+
+// DumpRequested returns whether the --dump-config flag was passed to Load
+func (c *Config) DumpRequested() bool {
+	return c.dumpConfig
+}
+
+// Dump returns the configuration as YAML, in the layout of the --config file of
+// Load. The values of the fields tagged redact:"true" are replaced by Redacted
+// followed by a short hash of the value, telling whether replicas run with the
+// same secrets without revealing them.
+func (c *Config) Dump() ([]byte, error) {
+	document := make(map[string]any)
+	gatewayDocument := make(map[string]any)
+
+	for _, f := range configFields() {
+		section := document
+		if f.section == gatewaySection {
+			section = gatewayDocument
+		}
+
+		section[f.yamlKey()] = dumpValue(c.value(f), f.redact)
+	}
+
+	document[gatewaySection] = gatewayDocument
+
+	dump, err := yaml.Marshal(document)
+	if err != nil {
+		return nil, fmt.Errorf("dump configuration: %w", err)
+	}
+
+	return dump, nil
+}
+
+// dumpValue returns v as a YAML value Load reads back, redacted when redact is
+// set
+func dumpValue(v reflect.Value, redact bool) any {
+	switch value := v.Interface().(type) {
+	case time.Duration:
+		return value.String()
+	case time.Time:
+		if value.IsZero() {
+			return ""
+		}
+
+		return value.Format(time.RFC3339)
+	case listen.FileMode:
+		return fmt.Sprintf("%04o", uint32(value))
+	}
+
+	if v.Kind() == reflect.Slice {
+		items := make([]any, 0, v.Len())
+		for i := range v.Len() {
+			items = append(items, dumpValue(v.Index(i), redact))
+		}
+
+		return items
+	}
+
+	if redact {
+		return redactValue(fmt.Sprint(v.Interface()))
+	}
+
+	return v.Interface()
+}
+
+// redactValue returns Redacted and the first bytes of the SHA-256 hash of
+// value, empty values being left empty
+func redactValue(value string) string {
+	if value == "" {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(value))
+
+	return Redacted + " sha256:" + hex.EncodeToString(sum[:4])
+}
@@ -0,0 +1,110 @@
+package config_test
+
+import (
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/config"
+)
+
+// sensitiveName matches the names of the fields that may hold secrets, which
+// must tell whether Dump redacts them
+var sensitiveName = regexp.MustCompile(`Seed|PEM|Passphrase|Password|Token|Credential`)
+
+func TestSensitiveFieldsTagged(t *testing.T) {
+	types := []reflect.Type{
+		reflect.TypeFor[config.Config](), reflect.TypeFor[config.GatewayOptions](),
+	}
+
+	for _, typ := range types {
+		for i := range typ.NumField() {
+			field := typ.Field(i)
+
+			textual := field.Type.Kind() == reflect.String ||
+				field.Type.Kind() == reflect.Slice && field.Type.Elem().Kind() == reflect.String
+			if field.Tag.Get("env") == "" || !textual || !sensitiveName.MatchString(field.Name) {
+				continue
+			}
+
+			if redact := field.Tag.Get("redact"); redact != "true" && redact != "false" {
+				t.Errorf("%s.%s may hold a secret, tag it redact:\"true\" or redact:\"false\"",
+					typ.Name(), field.Name)
+			}
+		}
+	}
+}
+
+func TestDump(t *testing.T) {
+	const seed = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+	t.Setenv("SSH_HOST_KEY_SEED", seed)
+	t.Setenv("SSH_HOST_KEY_PREVIOUS_SEEDS", "previous-seed-1,previous-seed-2")
+	t.Setenv("SSH_HOST_KEY_ROTATED_AT", "2026-01-02T03:04:05Z")
+	t.Setenv("WEBSOCKET_BEARER_TOKEN", "bearer-token")
+	t.Setenv("SSH_LISTEN_ADDR", ":2222,:2223")
+	t.Setenv("SESSION_REQUEST_TIMEOUT", "4s")
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("Load() failed: %v", err)
+	}
+
+	dump, err := cfg.Dump()
+	if err != nil {
+		t.Fatalf("Dump() failed: %v", err)
+	}
+
+	for _, secret := range []string{seed, "previous-seed-1", "previous-seed-2", "bearer-token"} {
+		if strings.Contains(string(dump), secret) {
+			t.Errorf("Dump() reveals %q:\n%s", secret, dump)
+		}
+	}
+
+	if !strings.Contains(string(dump), "ssh_host_key_seed: '"+config.Redacted+" sha256:") {
+		t.Errorf("Dump() does not redact the seed with a hash:\n%s", dump)
+	}
+
+	// The same secrets hash the same, in any replica
+	again, err := cfg.Dump()
+	if err != nil || string(again) != string(dump) {
+		t.Errorf("Dump() is not stable: %v", err)
+	}
+
+	// Loading the dump back gives the same configuration, secrets aside
+	t.Setenv("SSH_HOST_KEY_SEED", seed)
+	t.Setenv("WEBSOCKET_BEARER_TOKEN", "bearer-token")
+	t.Setenv("SSH_HOST_KEY_PREVIOUS_SEEDS", "previous-seed-1,previous-seed-2")
+
+	loaded, err := config.Load("--config", writeConfigFile(t, string(dump)))
+	if err != nil {
+		t.Fatalf("Load() of the dump failed: %v", err)
+	}
+
+	if changed := cfg.Changed(loaded); len(changed) != 0 {
+		t.Errorf("Load() of the dump changed %v", changed)
+	}
+
+	if !slices.Equal(loaded.SSHListenAddrs, []string{":2222", ":2223"}) {
+		t.Errorf("SSHListenAddrs = %v, want [:2222 :2223]", loaded.SSHListenAddrs)
+	}
+
+	if loaded.Gateway.SessionRequestTimeout != 4*time.Second {
+		t.Errorf("Gateway.SessionRequestTimeout = %s, want 4s",
+			loaded.Gateway.SessionRequestTimeout)
+	}
+}
+
+func TestDumpRequested(t *testing.T) {
+	cfg, err := config.Load("--dump-config")
+	if err != nil {
+		t.Fatalf("Load() failed: %v", err)
+	}
+
+	if !cfg.DumpRequested() {
+		t.Error("DumpRequested() = false, want true")
+	}
+}
@@ -0,0 +1,342 @@
+package config
+
+import (
+	"time"
+
+	"github.com/zijiren233/sshgate/gateway"
+)
+
+// GatewayOptions is the schema of the gateway settings, read from the
+// environment, the flags and the gateway section of the --config file. Options
+// converts them into the gateway.Options of the same names.
+type GatewayOptions struct {
+	SSHHandshakeTimeout                time.Duration `env:"SSH_HANDSHAKE_TIMEOUT"                  yaml:"ssh_handshake_timeout"                  envDefault:"15s"`
+	SSHBackendPort                     int           `env:"SSH_BACKEND_PORT"                       yaml:"ssh_backend_port"                       envDefault:"22"`
+	BackendConnectTimeoutPublicKey     time.Duration `env:"BACKEND_CONNECT_TIMEOUT_PUBLICKEY"      yaml:"backend_connect_timeout_publickey"      envDefault:"10s"`
+	BackendConnectTimeoutAgent         time.Duration `env:"BACKEND_CONNECT_TIMEOUT_AGENT"          yaml:"backend_connect_timeout_agent"          envDefault:"5s"`
+	ProxyJumpTimeout                   time.Duration `env:"PROXY_JUMP_TIMEOUT"                     yaml:"proxy_jump_timeout"                     envDefault:"5s"`
+	SessionRequestTimeout              time.Duration `env:"SESSION_REQUEST_TIMEOUT"                yaml:"session_request_timeout"                envDefault:"3s"`
+	MaxCachedRequests                  int           `env:"MAX_CACHED_REQUESTS"                    yaml:"max_cached_requests"                    envDefault:"6"`
+	MaxSessionsPerConn                 int           `env:"MAX_SESSIONS_PER_CONN"                  yaml:"max_sessions_per_conn"                  envDefault:"0"`
+	ServerVersion                      string        `env:"SSH_SERVER_VERSION"                     yaml:"ssh_server_version"`
+	EnableAgentForward                 *bool         `env:"ENABLE_AGENT_FORWARD"                   yaml:"enable_agent_forward"`
+	EnableProxyJump                    bool          `env:"ENABLE_PROXY_JUMP"                      yaml:"enable_proxy_jump"                      envDefault:"true"`
+	BackendHostKeyPolicy               string        `env:"BACKEND_HOST_KEY_POLICY"                yaml:"backend_host_key_policy"                envDefault:"insecure"`
+	BackendHostKeys                    []string      `env:"BACKEND_HOST_KEYS"                      yaml:"backend_host_keys"`
+	BackendHostCAKeys                  []string      `env:"BACKEND_HOST_CA_KEYS"                   yaml:"backend_host_ca_keys"`
+	MaxAuthTries                       int           `env:"MAX_AUTH_TRIES"                         yaml:"max_auth_tries"                         envDefault:"6"`
+	Banner                             string        `env:"BANNER"                                 yaml:"banner"`
+	BannerShowDevboxStatus             bool          `env:"BANNER_SHOW_DEVBOX_STATUS"              yaml:"banner_show_devbox_status"              envDefault:"false"`
+	BannerDevboxStoppedTemplate        string        `env:"BANNER_DEVBOX_STOPPED_TEMPLATE"         yaml:"banner_devbox_stopped_template"         envDefault:"devbox {namespace}/{devbox} is stopped"`
+	BannerDevboxUnavailableTemplate    string        `env:"BANNER_DEVBOX_UNAVAILABLE_TEMPLATE"     yaml:"banner_devbox_unavailable_template"     envDefault:"devbox {namespace}/{devbox} should be running but its pod is unavailable"`
+	BannerUnknownDevboxTemplate        string        `env:"BANNER_UNKNOWN_DEVBOX_TEMPLATE"         yaml:"banner_unknown_devbox_template"         envDefault:"unknown devbox {namespace}/{devbox}"`
+	BannerInvalidUsernameTemplate      string        `env:"BANNER_INVALID_USERNAME_TEMPLATE"       yaml:"banner_invalid_username_template"       envDefault:"invalid username {user}, expected format user@namespace-devbox"`
+	AuthHelpEnabled                    bool          `env:"AUTH_HELP_ENABLED"                      yaml:"auth_help_enabled"                      envDefault:"true"`
+	AuthHelpMessage                    string        `env:"AUTH_HELP_MESSAGE"                      yaml:"auth_help_message"`
+	VerboseAuthErrors                  bool          `env:"VERBOSE_AUTH_ERRORS"                    yaml:"verbose_auth_errors"                    envDefault:"false"`
+	AuthFailureMinDuration             time.Duration `env:"AUTH_FAILURE_MIN_DURATION"              yaml:"auth_failure_min_duration"              envDefault:"0s"`
+	UserCAKeys                         []string      `env:"USER_CA_KEYS"                           yaml:"user_ca_keys"`
+	AdminKeys                          []string      `env:"ADMIN_KEYS"                             yaml:"admin_keys"`
+	AdminDeniedNamespaces              []string      `env:"ADMIN_DENIED_NAMESPACES"                yaml:"admin_denied_namespaces"`
+	DefaultBackendUser                 string        `env:"DEFAULT_BACKEND_USER"                   yaml:"default_backend_user"`
+	BackendUserMap                     []string      `env:"BACKEND_USER_MAP"                       yaml:"backend_user_map"`
+	OTPNamespaces                      []string      `env:"OTP_NAMESPACES"                         yaml:"otp_namespaces"`
+	OTPExemptAdmins                    bool          `env:"OTP_EXEMPT_ADMINS"                      yaml:"otp_exempt_admins"                      envDefault:"false"`
+	OTPSkew                            int           `env:"OTP_SKEW"                               yaml:"otp_skew"                               envDefault:"1"`
+	OTPMaxFailures                     int           `env:"OTP_MAX_FAILURES"                       yaml:"otp_max_failures"                       envDefault:"5"`
+	OTPLockout                         time.Duration `env:"OTP_LOCKOUT"                            yaml:"otp_lockout"                            envDefault:"5m"`
+	TokenIssuer                        string        `env:"TOKEN_ISSUER"                           yaml:"token_issuer"                           redact:"false"`
+	TokenAudience                      string        `env:"TOKEN_AUDIENCE"                         yaml:"token_audience"                         redact:"false"`
+	TokenJWKSURL                       string        `env:"TOKEN_JWKS_URL"                         yaml:"token_jwks_url"                         redact:"false"`
+	TokenJWKSRefresh                   time.Duration `env:"TOKEN_JWKS_REFRESH"                     yaml:"token_jwks_refresh"                     envDefault:"15m"`
+	TokenLeeway                        time.Duration `env:"TOKEN_LEEWAY"                           yaml:"token_leeway"                           envDefault:"30s"`
+	AllowedCIDRsFailOpen               bool          `env:"ALLOWED_CIDRS_FAIL_OPEN"                yaml:"allowed_cidrs_fail_open"                envDefault:"false"`
+	DisablePublicKeyMode               bool          `env:"DISABLE_PUBLIC_KEY_MODE"                yaml:"disable_public_key_mode"                envDefault:"false"`
+	DisableAgentForwardingMode         bool          `env:"DISABLE_AGENT_FORWARDING_MODE"          yaml:"disable_agent_forwarding_mode"          envDefault:"false"`
+	AgentHelpURL                       string        `env:"AGENT_HELP_URL"                         yaml:"agent_help_url"`
+	AgentAllowedFingerprints           []string      `env:"AGENT_ALLOWED_FINGERPRINTS"             yaml:"agent_allowed_fingerprints"`
+	AgentForwardOnward                 string        `env:"AGENT_FORWARD_ONWARD"                   yaml:"agent_forward_onward"                   envDefault:"off"`
+	BackendPoolEnabled                 bool          `env:"BACKEND_POOL_ENABLED"                   yaml:"backend_pool_enabled"                   envDefault:"false"`
+	BackendPoolMaxIdle                 int           `env:"BACKEND_POOL_MAX_IDLE"                  yaml:"backend_pool_max_idle"                  envDefault:"2"`
+	BackendPoolIdleTTL                 time.Duration `env:"BACKEND_POOL_IDLE_TTL"                  yaml:"backend_pool_idle_ttl"                  envDefault:"2m"`
+	HostKeyUpdatesEnabled              bool          `env:"HOST_KEY_UPDATES_ENABLED"               yaml:"host_key_updates_enabled"               envDefault:"false"`
+	TCPKeepAlivePeriod                 time.Duration `env:"TCP_KEEPALIVE_PERIOD"                   yaml:"tcp_keepalive_period"                   envDefault:"30s"`
+	TCPNoDelay                         bool          `env:"TCP_NODELAY"                            yaml:"tcp_nodelay"                            envDefault:"true"`
+	BandwidthLimit                     string        `env:"BANDWIDTH_LIMIT"                        yaml:"bandwidth_limit"`
+	BandwidthLimitBurst                string        `env:"BANDWIDTH_LIMIT_BURST"                  yaml:"bandwidth_limit_burst"                  envDefault:"256K"`
+	BandwidthLimitNamespaces           []string      `env:"BANDWIDTH_LIMIT_NAMESPACES"             yaml:"bandwidth_limit_namespaces"`
+	SessionIDEnv                       string        `env:"SESSION_ID_ENV"                         yaml:"session_id_env"`
+	ClientEnv                          bool          `env:"CLIENT_ENV"                             yaml:"client_env"                             envDefault:"true"`
+	TerminateRevokedConns              bool          `env:"TERMINATE_REVOKED_CONNECTIONS"          yaml:"terminate_revoked_connections"          envDefault:"true"`
+	TerminateRestartedPodConns         bool          `env:"TERMINATE_RESTARTED_POD_CONNECTIONS"    yaml:"terminate_restarted_pod_connections"    envDefault:"true"`
+	SessionRecordingEnabled            bool          `env:"SESSION_RECORDING_ENABLED"              yaml:"session_recording_enabled"              envDefault:"false"`
+	SessionRecordingNamespaces         []string      `env:"SESSION_RECORDING_NAMESPACES"           yaml:"session_recording_namespaces"`
+	SessionRecordingDir                string        `env:"SESSION_RECORDING_DIR"                  yaml:"session_recording_dir"`
+	SessionRecordingMaxSize            string        `env:"SESSION_RECORDING_MAX_SIZE"             yaml:"session_recording_max_size"             envDefault:"64M"`
+	BackendHealthCheckEnabled          bool          `env:"BACKEND_HEALTH_CHECK_ENABLED"           yaml:"backend_health_check_enabled"           envDefault:"false"`
+	BackendHealthCheckInterval         time.Duration `env:"BACKEND_HEALTH_CHECK_INTERVAL"          yaml:"backend_health_check_interval"          envDefault:"30s"`
+	BackendHealthCheckTimeout          time.Duration `env:"BACKEND_HEALTH_CHECK_TIMEOUT"           yaml:"backend_health_check_timeout"           envDefault:"3s"`
+	BackendHealthCheckConcurrency      int           `env:"BACKEND_HEALTH_CHECK_CONCURRENCY"       yaml:"backend_health_check_concurrency"       envDefault:"16"`
+	BackendHealthCheckFailureThreshold int           `env:"BACKEND_HEALTH_CHECK_FAILURE_THRESHOLD" yaml:"backend_health_check_failure_threshold" envDefault:"3"`
+	AuditLogSessions                   bool          `env:"AUDIT_LOG_SESSIONS"                     yaml:"audit_log_sessions"                     envDefault:"false"`
+	KubernetesEventInterval            time.Duration `env:"KUBERNETES_EVENT_INTERVAL"              yaml:"kubernetes_event_interval"              envDefault:"10m"`
+	SFTPOnly                           bool          `env:"SFTP_ONLY"                              yaml:"sftp_only"                              envDefault:"false"`
+	ClientErrorDetails                 bool          `env:"CLIENT_ERROR_DETAILS"                   yaml:"client_error_details"                   envDefault:"false"`
+	DisabledGatewayCommands            []string      `env:"DISABLED_GATEWAY_COMMANDS"              yaml:"disabled_gateway_commands"`
+	MaskBackendAddress                 bool          `env:"MASK_BACKEND_ADDRESS"                   yaml:"mask_backend_address"                   envDefault:"false"`
+	MOTDEnabled                        bool          `env:"MOTD_ENABLED"                           yaml:"motd_enabled"                           envDefault:"false"`
+	MOTDTemplate                       string        `env:"MOTD_TEMPLATE"                          yaml:"motd_template"                          envDefault:"Connected to devbox {devbox} in namespace {namespace} via sshgate"`
+	MOTDResourceUsage                  bool          `env:"MOTD_RESOURCE_USAGE"                    yaml:"motd_resource_usage"                    envDefault:"false"`
+	MOTDResourceUsageTimeout           time.Duration `env:"MOTD_RESOURCE_USAGE_TIMEOUT"            yaml:"motd_resource_usage_timeout"            envDefault:"300ms"`
+	ClusterProxies                     []string      `env:"CLUSTER_PROXIES"                        yaml:"cluster_proxies"`
+	HostCertificateExpiryWarning       time.Duration `env:"HOST_CERTIFICATE_EXPIRY_WARNING"        yaml:"host_certificate_expiry_warning"        envDefault:"168h"`
+}
+
+// DefaultGatewayOptions returns the defaults of the gateway settings
+func DefaultGatewayOptions() GatewayOptions {
+	return NewGatewayOptions(gateway.DefaultOptions())
+}
+
+// NewGatewayOptions returns the settings of options
+func NewGatewayOptions(options gateway.Options) GatewayOptions {
+	return GatewayOptions{
+		SSHHandshakeTimeout:                options.SSHHandshakeTimeout,
+		SSHBackendPort:                     options.SSHBackendPort,
+		BackendConnectTimeoutPublicKey:     options.BackendConnectTimeoutPublicKey,
+		BackendConnectTimeoutAgent:         options.BackendConnectTimeoutAgent,
+		ProxyJumpTimeout:                   options.ProxyJumpTimeout,
+		SessionRequestTimeout:              options.SessionRequestTimeout,
+		MaxCachedRequests:                  options.MaxCachedRequests,
+		MaxSessionsPerConn:                 options.MaxSessionsPerConn,
+		ServerVersion:                      options.ServerVersion,
+		EnableAgentForward:                 deprecatedEnableAgentForward(options.EnableAgentForward),
+		EnableProxyJump:                    options.EnableProxyJump,
+		BackendHostKeyPolicy:               options.BackendHostKeyPolicy,
+		BackendHostKeys:                    options.BackendHostKeys,
+		BackendHostCAKeys:                  options.BackendHostCAKeys,
+		MaxAuthTries:                       options.MaxAuthTries,
+		Banner:                             options.Banner,
+		BannerShowDevboxStatus:             options.BannerShowDevboxStatus,
+		BannerDevboxStoppedTemplate:        options.BannerDevboxStoppedTemplate,
+		BannerDevboxUnavailableTemplate:    options.BannerDevboxUnavailableTemplate,
+		BannerUnknownDevboxTemplate:        options.BannerUnknownDevboxTemplate,
+		BannerInvalidUsernameTemplate:      options.BannerInvalidUsernameTemplate,
+		AuthHelpEnabled:                    options.AuthHelpEnabled,
+		AuthHelpMessage:                    options.AuthHelpMessage,
+		VerboseAuthErrors:                  options.VerboseAuthErrors,
+		AuthFailureMinDuration:             options.AuthFailureMinDuration,
+		UserCAKeys:                         options.UserCAKeys,
+		AdminKeys:                          options.AdminKeys,
+		AdminDeniedNamespaces:              options.AdminDeniedNamespaces,
+		DefaultBackendUser:                 options.DefaultBackendUser,
+		BackendUserMap:                     options.BackendUserMap,
+		OTPNamespaces:                      options.OTPNamespaces,
+		OTPExemptAdmins:                    options.OTPExemptAdmins,
+		OTPSkew:                            options.OTPSkew,
+		OTPMaxFailures:                     options.OTPMaxFailures,
+		OTPLockout:                         options.OTPLockout,
+		TokenIssuer:                        options.TokenIssuer,
+		TokenAudience:                      options.TokenAudience,
+		TokenJWKSURL:                       options.TokenJWKSURL,
+		TokenJWKSRefresh:                   options.TokenJWKSRefresh,
+		TokenLeeway:                        options.TokenLeeway,
+		AllowedCIDRsFailOpen:               options.AllowedCIDRsFailOpen,
+		DisablePublicKeyMode:               options.DisablePublicKeyMode,
+		DisableAgentForwardingMode:         options.DisableAgentForwardingMode,
+		AgentHelpURL:                       options.AgentHelpURL,
+		AgentAllowedFingerprints:           options.AgentAllowedFingerprints,
+		AgentForwardOnward:                 options.AgentForwardOnward,
+		BackendPoolEnabled:                 options.BackendPoolEnabled,
+		BackendPoolMaxIdle:                 options.BackendPoolMaxIdle,
+		BackendPoolIdleTTL:                 options.BackendPoolIdleTTL,
+		HostKeyUpdatesEnabled:              options.HostKeyUpdatesEnabled,
+		TCPKeepAlivePeriod:                 options.TCPKeepAlivePeriod,
+		TCPNoDelay:                         options.TCPNoDelay,
+		BandwidthLimit:                     options.BandwidthLimit,
+		BandwidthLimitBurst:                options.BandwidthLimitBurst,
+		BandwidthLimitNamespaces:           options.BandwidthLimitNamespaces,
+		SessionIDEnv:                       options.SessionIDEnv,
+		ClientEnv:                          options.ClientEnv,
+		TerminateRevokedConns:              options.TerminateRevokedConns,
+		TerminateRestartedPodConns:         options.TerminateRestartedPodConns,
+		SessionRecordingEnabled:            options.SessionRecordingEnabled,
+		SessionRecordingNamespaces:         options.SessionRecordingNamespaces,
+		SessionRecordingDir:                options.SessionRecordingDir,
+		SessionRecordingMaxSize:            options.SessionRecordingMaxSize,
+		BackendHealthCheckEnabled:          options.BackendHealthCheckEnabled,
+		BackendHealthCheckInterval:         options.BackendHealthCheckInterval,
+		BackendHealthCheckTimeout:          options.BackendHealthCheckTimeout,
+		BackendHealthCheckConcurrency:      options.BackendHealthCheckConcurrency,
+		BackendHealthCheckFailureThreshold: options.BackendHealthCheckFailureThreshold,
+		AuditLogSessions:                   options.AuditLogSessions,
+		KubernetesEventInterval:            options.KubernetesEventInterval,
+		SFTPOnly:                           options.SFTPOnly,
+		ClientErrorDetails:                 options.ClientErrorDetails,
+		DisabledGatewayCommands:            options.DisabledGatewayCommands,
+		MaskBackendAddress:                 options.MaskBackendAddress,
+		MOTDEnabled:                        options.MOTDEnabled,
+		MOTDTemplate:                       options.MOTDTemplate,
+		MOTDResourceUsage:                  options.MOTDResourceUsage,
+		MOTDResourceUsageTimeout:           options.MOTDResourceUsageTimeout,
+		ClusterProxies:                     options.ClusterProxies,
+		HostCertificateExpiryWarning:       options.HostCertificateExpiryWarning,
+	}
+}
+
+// Options returns the gateway options of the settings. Zero values of the
+// settings the gateway can't do without, such as timeouts, ports, templates and
+// policies, map to the gateway defaults.
+func (o *GatewayOptions) Options() gateway.Options {
+	opts := gateway.Options{
+		SSHHandshakeTimeout:                o.SSHHandshakeTimeout,
+		SSHBackendPort:                     o.SSHBackendPort,
+		BackendConnectTimeoutPublicKey:     o.BackendConnectTimeoutPublicKey,
+		BackendConnectTimeoutAgent:         o.BackendConnectTimeoutAgent,
+		ProxyJumpTimeout:                   o.ProxyJumpTimeout,
+		SessionRequestTimeout:              o.SessionRequestTimeout,
+		MaxCachedRequests:                  o.MaxCachedRequests,
+		MaxSessionsPerConn:                 o.MaxSessionsPerConn,
+		ServerVersion:                      o.ServerVersion,
+		EnableProxyJump:                    o.EnableProxyJump,
+		BackendHostKeyPolicy:               o.BackendHostKeyPolicy,
+		BackendHostKeys:                    o.BackendHostKeys,
+		BackendHostCAKeys:                  o.BackendHostCAKeys,
+		MaxAuthTries:                       o.MaxAuthTries,
+		Banner:                             o.Banner,
+		BannerShowDevboxStatus:             o.BannerShowDevboxStatus,
+		BannerDevboxStoppedTemplate:        o.BannerDevboxStoppedTemplate,
+		BannerDevboxUnavailableTemplate:    o.BannerDevboxUnavailableTemplate,
+		BannerUnknownDevboxTemplate:        o.BannerUnknownDevboxTemplate,
+		BannerInvalidUsernameTemplate:      o.BannerInvalidUsernameTemplate,
+		AuthHelpEnabled:                    o.AuthHelpEnabled,
+		AuthHelpMessage:                    o.AuthHelpMessage,
+		VerboseAuthErrors:                  o.VerboseAuthErrors,
+		AuthFailureMinDuration:             o.AuthFailureMinDuration,
+		UserCAKeys:                         o.UserCAKeys,
+		AdminKeys:                          o.AdminKeys,
+		AdminDeniedNamespaces:              o.AdminDeniedNamespaces,
+		DefaultBackendUser:                 o.DefaultBackendUser,
+		BackendUserMap:                     o.BackendUserMap,
+		OTPNamespaces:                      o.OTPNamespaces,
+		OTPExemptAdmins:                    o.OTPExemptAdmins,
+		OTPSkew:                            o.OTPSkew,
+		OTPMaxFailures:                     o.OTPMaxFailures,
+		OTPLockout:                         o.OTPLockout,
+		TokenIssuer:                        o.TokenIssuer,
+		TokenAudience:                      o.TokenAudience,
+		TokenJWKSURL:                       o.TokenJWKSURL,
+		TokenJWKSRefresh:                   o.TokenJWKSRefresh,
+		TokenLeeway:                        o.TokenLeeway,
+		AllowedCIDRsFailOpen:               o.AllowedCIDRsFailOpen,
+		DisablePublicKeyMode:               o.DisablePublicKeyMode,
+		DisableAgentForwardingMode:         o.DisableAgentForwardingMode,
+		AgentHelpURL:                       o.AgentHelpURL,
+		AgentAllowedFingerprints:           o.AgentAllowedFingerprints,
+		AgentForwardOnward:                 o.AgentForwardOnward,
+		BackendPoolEnabled:                 o.BackendPoolEnabled,
+		BackendPoolMaxIdle:                 o.BackendPoolMaxIdle,
+		BackendPoolIdleTTL:                 o.BackendPoolIdleTTL,
+		HostKeyUpdatesEnabled:              o.HostKeyUpdatesEnabled,
+		TCPKeepAlivePeriod:                 o.TCPKeepAlivePeriod,
+		TCPNoDelay:                         o.TCPNoDelay,
+		BandwidthLimit:                     o.BandwidthLimit,
+		BandwidthLimitBurst:                o.BandwidthLimitBurst,
+		BandwidthLimitNamespaces:           o.BandwidthLimitNamespaces,
+		SessionIDEnv:                       o.SessionIDEnv,
+		ClientEnv:                          o.ClientEnv,
+		TerminateRevokedConns:              o.TerminateRevokedConns,
+		TerminateRestartedPodConns:         o.TerminateRestartedPodConns,
+		SessionRecordingEnabled:            o.SessionRecordingEnabled,
+		SessionRecordingNamespaces:         o.SessionRecordingNamespaces,
+		SessionRecordingDir:                o.SessionRecordingDir,
+		SessionRecordingMaxSize:            o.SessionRecordingMaxSize,
+		BackendHealthCheckEnabled:          o.BackendHealthCheckEnabled,
+		BackendHealthCheckInterval:         o.BackendHealthCheckInterval,
+		BackendHealthCheckTimeout:          o.BackendHealthCheckTimeout,
+		BackendHealthCheckConcurrency:      o.BackendHealthCheckConcurrency,
+		BackendHealthCheckFailureThreshold: o.BackendHealthCheckFailureThreshold,
+		AuditLogSessions:                   o.AuditLogSessions,
+		KubernetesEventInterval:            o.KubernetesEventInterval,
+		SFTPOnly:                           o.SFTPOnly,
+		ClientErrorDetails:                 o.ClientErrorDetails,
+		DisabledGatewayCommands:            o.DisabledGatewayCommands,
+		MaskBackendAddress:                 o.MaskBackendAddress,
+		MOTDEnabled:                        o.MOTDEnabled,
+		MOTDTemplate:                       o.MOTDTemplate,
+		MOTDResourceUsage:                  o.MOTDResourceUsage,
+		MOTDResourceUsageTimeout:           o.MOTDResourceUsageTimeout,
+		ClusterProxies:                     o.ClusterProxies,
+		HostCertificateExpiryWarning:       o.HostCertificateExpiryWarning,
+	}
+
+	// ENABLE_AGENT_FORWARD, deprecated, only disables agent forwarding mode
+	// when set to false
+	opts.EnableAgentForward = o.EnableAgentForward == nil || *o.EnableAgentForward
+
+	d := gateway.DefaultOptions()
+	orDefault(&opts.SSHHandshakeTimeout, d.SSHHandshakeTimeout)
+	orDefault(&opts.SSHBackendPort, d.SSHBackendPort)
+	orDefault(&opts.BackendConnectTimeoutPublicKey, d.BackendConnectTimeoutPublicKey)
+	orDefault(&opts.BackendConnectTimeoutAgent, d.BackendConnectTimeoutAgent)
+	orDefault(&opts.ProxyJumpTimeout, d.ProxyJumpTimeout)
+	orDefault(&opts.SessionRequestTimeout, d.SessionRequestTimeout)
+	orDefault(&opts.BackendHostKeyPolicy, d.BackendHostKeyPolicy)
+	orDefault(&opts.MaxAuthTries, d.MaxAuthTries)
+	orDefault(&opts.BannerDevboxStoppedTemplate, d.BannerDevboxStoppedTemplate)
+	orDefault(&opts.BannerDevboxUnavailableTemplate, d.BannerDevboxUnavailableTemplate)
+	orDefault(&opts.BannerUnknownDevboxTemplate, d.BannerUnknownDevboxTemplate)
+	orDefault(&opts.BannerInvalidUsernameTemplate, d.BannerInvalidUsernameTemplate)
+	orDefault(&opts.OTPLockout, d.OTPLockout)
+	orDefault(&opts.TokenJWKSRefresh, d.TokenJWKSRefresh)
+	orDefault(&opts.AgentForwardOnward, d.AgentForwardOnward)
+	orDefault(&opts.BackendPoolMaxIdle, d.BackendPoolMaxIdle)
+	orDefault(&opts.BackendPoolIdleTTL, d.BackendPoolIdleTTL)
+	orDefault(&opts.TCPKeepAlivePeriod, d.TCPKeepAlivePeriod)
+	orDefault(&opts.BandwidthLimitBurst, d.BandwidthLimitBurst)
+	orDefault(&opts.SessionRecordingMaxSize, d.SessionRecordingMaxSize)
+	orDefault(&opts.BackendHealthCheckInterval, d.BackendHealthCheckInterval)
+	orDefault(&opts.BackendHealthCheckTimeout, d.BackendHealthCheckTimeout)
+	orDefault(&opts.BackendHealthCheckConcurrency, d.BackendHealthCheckConcurrency)
+	orDefault(&opts.BackendHealthCheckFailureThreshold, d.BackendHealthCheckFailureThreshold)
+	orDefault(&opts.KubernetesEventInterval, d.KubernetesEventInterval)
+	orDefault(&opts.MOTDTemplate, d.MOTDTemplate)
+	orDefault(&opts.MOTDResourceUsageTimeout, d.MOTDResourceUsageTimeout)
+
+	return opts
+}
+
+// orDefault sets value to def when it is the zero value
+func orDefault[T comparable](value *T, def T) {
+	var zero T
+	if *value == zero {
+		*value = def
+	}
+}
+
+// GatewayOptionKey returns the environment variable of the setting of the
+// gateway.Options named name, empty when it is not read from the configuration
+func GatewayOptionKey(name string) string {
+	for _, f := range configFields() {
+		if f.section == gatewaySection && f.name == name {
+			return f.key
+		}
+	}
+
+	return ""
+}
+
+// Validate validates the gateway options of the settings
+func (o *GatewayOptions) Validate() error {
+	options := o.Options()
+	return options.Validate()
+}
+
+// deprecatedEnableAgentForward returns the ENABLE_AGENT_FORWARD setting of the
+// deprecated gateway option enable, left unset when agent forwarding is enabled
+func deprecatedEnableAgentForward(enable bool) *bool {
+	if enable {
+		return nil
+	}
+
+	return &enable
+}
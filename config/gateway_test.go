@@ -0,0 +1,170 @@
+package config_test
+
+import (
+	"reflect"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/config"
+	"github.com/zijiren233/sshgate/gateway"
+)
+
+// runtimeGatewayOptions are the gateway options set by the process rather than
+// read from the configuration
+var runtimeGatewayOptions = []string{
+	"HostCertificate", "HostKeys", "PreviousHostKeys", "HostKeyGraceUntil",
+	"AdditionalHostKeys", "BackendDialer", "SessionRecorder", "AuditLogger",
+	"EventRecorder", "PodMetrics", "LogLimiter", "Metrics",
+}
+
+// deprecatedGatewayOptions are the settings converted into other gateway options
+var deprecatedGatewayOptions = []string{"EnableAgentForward"}
+
+// fillDistinct sets every field of v to a distinct non-zero value
+func fillDistinct(t *testing.T, v reflect.Value) {
+	t.Helper()
+
+	for i := range v.NumField() {
+		field := v.Field(i)
+		n := i + 1
+
+		if slices.Contains(deprecatedGatewayOptions, v.Type().Field(i).Name) {
+			continue
+		}
+
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString("value-" + strconv.Itoa(n))
+		case reflect.Bool:
+			field.SetBool(true)
+		case reflect.Int, reflect.Int64:
+			if field.Type() == reflect.TypeFor[time.Duration]() {
+				field.SetInt(int64(time.Duration(n) * time.Second))
+			} else {
+				field.SetInt(int64(n))
+			}
+		case reflect.Slice:
+			field.Set(reflect.ValueOf([]string{"item-" + strconv.Itoa(n)}))
+		default:
+			t.Fatalf("Unsupported type %s of %s", field.Type(), v.Type().Field(i).Name)
+		}
+	}
+}
+
+func TestGatewayOptions_MatchGatewayOptions(t *testing.T) {
+	settings := reflect.TypeFor[config.GatewayOptions]()
+	options := reflect.TypeFor[gateway.Options]()
+
+	for i := range settings.NumField() {
+		setting := settings.Field(i)
+		if slices.Contains(deprecatedGatewayOptions, setting.Name) {
+			continue
+		}
+
+		option, ok := options.FieldByName(setting.Name)
+		if !ok {
+			t.Errorf("gateway.Options has no field %s", setting.Name)
+			continue
+		}
+
+		if option.Type != setting.Type {
+			t.Errorf("%s is a %s in gateway.Options, a %s in config.GatewayOptions",
+				setting.Name, option.Type, setting.Type)
+		}
+
+		if setting.Tag.Get("env") == "" || setting.Tag.Get("yaml") == "" {
+			t.Errorf("config.GatewayOptions.%s has no env or yaml tag", setting.Name)
+		}
+	}
+
+	for i := range options.NumField() {
+		name := options.Field(i).Name
+		if _, ok := settings.FieldByName(name); ok || slices.Contains(runtimeGatewayOptions, name) {
+			continue
+		}
+
+		t.Errorf("gateway.Options.%s is missing from config.GatewayOptions", name)
+	}
+}
+
+func TestGatewayOptions_RoundTrip(t *testing.T) {
+	var settings config.GatewayOptions
+	fillDistinct(t, reflect.ValueOf(&settings).Elem())
+
+	options := settings.Options()
+	if got := config.NewGatewayOptions(options); !reflect.DeepEqual(got, settings) {
+		t.Errorf("NewGatewayOptions(Options()) = %+v, want %+v", got, settings)
+	}
+
+	// Every setting reaches the gateway option of its name
+	optionsValue := reflect.ValueOf(options)
+	settingsValue := reflect.ValueOf(settings)
+
+	for i := range settingsValue.NumField() {
+		name := settingsValue.Type().Field(i).Name
+		if slices.Contains(deprecatedGatewayOptions, name) {
+			continue
+		}
+
+		if !reflect.DeepEqual(optionsValue.FieldByName(name).Interface(),
+			settingsValue.Field(i).Interface()) {
+			t.Errorf("Options().%s = %v, want %v", name,
+				optionsValue.FieldByName(name), settingsValue.Field(i))
+		}
+	}
+}
+
+func TestGatewayOptions_ZeroValuesMapToDefaults(t *testing.T) {
+	var settings config.GatewayOptions
+
+	options := settings.Options()
+	defaults := gateway.DefaultOptions()
+
+	if options.SSHHandshakeTimeout != defaults.SSHHandshakeTimeout ||
+		options.SSHBackendPort != defaults.SSHBackendPort ||
+		options.BackendConnectTimeoutPublicKey != defaults.BackendConnectTimeoutPublicKey ||
+		options.MOTDTemplate != defaults.MOTDTemplate ||
+		options.BackendHostKeyPolicy != defaults.BackendHostKeyPolicy {
+		t.Errorf("Options() of zero settings = %+v, want the gateway defaults", options)
+	}
+
+	// Zero values meaning something are kept
+	if options.MaxSessionsPerConn != 0 || options.OTPMaxFailures != 0 {
+		t.Errorf("Options() of zero settings changed meaningful zero values: %+v", options)
+	}
+
+	// The deprecated ENABLE_AGENT_FORWARD left unset keeps agent forwarding mode
+	if !options.EnableAgentForward || options.DisableAgentForwardingMode {
+		t.Errorf("Options() of zero settings disabled agent forwarding mode: %+v", options)
+	}
+
+	if err := settings.Validate(); err != nil {
+		t.Errorf("Validate() of zero settings failed: %v", err)
+	}
+
+	defaultSettings := config.DefaultGatewayOptions()
+	if got := defaultSettings.Options(); !reflect.DeepEqual(got, defaults) {
+		t.Errorf("DefaultGatewayOptions().Options() = %+v, want %+v", got, defaults)
+	}
+}
+
+func TestGatewayOptions_DeprecatedEnableAgentForward(t *testing.T) {
+	disabled := false
+	settings := config.GatewayOptions{EnableAgentForward: &disabled}
+
+	options := settings.Options()
+	if options.EnableAgentForward {
+		t.Error("Options().EnableAgentForward = true with ENABLE_AGENT_FORWARD=false")
+	}
+
+	got := config.NewGatewayOptions(options).EnableAgentForward
+	if got == nil || *got {
+		t.Errorf("NewGatewayOptions().EnableAgentForward = %v, want false", got)
+	}
+
+	if got := config.NewGatewayOptions(gateway.DefaultOptions()).EnableAgentForward; got != nil {
+		t.Errorf("NewGatewayOptions(defaults).EnableAgentForward = %v, want unset", *got)
+	}
+}
@@ -0,0 +1,424 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/caarlos0/env/v9"
+	"github.com/joho/godotenv"
+	"sigs.k8s.io/yaml"
+)
+
+// Sources of configuration values, by increasing precedence
+const (
+	SourceDefault     = "default"
+	SourceFile        = "file"
+	SourceEnvironment = "environment"
+	SourceFlag        = "flag"
+)
+
+// gatewaySection is the YAML section of the gateway options
+const gatewaySection = "gateway"
+
+// FieldError is an invalid configuration value, naming its environment variable
+// and where the value comes from
+type FieldError struct {
+	Field  string
+	Source string
+	Err    error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s (%s): %v", e.Field, e.Source, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// field is a configuration value settable by environment variable
+type field struct {
+	// key is the environment variable
+	key string
+	// name is the name of the struct field
+	name string
+	// section is the YAML section, empty at the top level
+	section string
+	// yaml is the key in the YAML section, the lowercase key when empty
+	yaml   string
+	isBool bool
+	// redact hides the value in Dump
+	redact bool
+}
+
+// flagName returns the command-line flag of the field
+func (f field) flagName() string {
+	return strings.ToLower(strings.ReplaceAll(f.key, "_", "-"))
+}
+
+// yamlKey returns the key of the field in its YAML section
+func (f field) yamlKey() string {
+	if f.yaml != "" {
+		return f.yaml
+	}
+
+	return strings.ToLower(f.key)
+}
+
+// configFields returns the fields of Config and of its gateway options
+func configFields() []field {
+	var fields []field
+
+	var walk func(t reflect.Type, section string)
+
+	walk = func(t reflect.Type, section string) {
+		for i := range t.NumField() {
+			sf := t.Field(i)
+
+			if _, ok := sf.Tag.Lookup("envPrefix"); ok && sf.Type.Kind() == reflect.Struct {
+				walk(sf.Type, gatewaySection)
+				continue
+			}
+
+			key, _, _ := strings.Cut(sf.Tag.Get("env"), ",")
+			if key == "" {
+				continue
+			}
+
+			fields = append(fields, field{
+				key:     key,
+				name:    sf.Name,
+				section: section,
+				yaml:    sf.Tag.Get("yaml"),
+				isBool:  sf.Type.Kind() == reflect.Bool || sf.Type == reflect.TypeFor[*bool](),
+				redact:  sf.Tag.Get("redact") == "true",
+			})
+		}
+	}
+
+	walk(reflect.TypeFor[Config](), "")
+
+	return fields
+}
+
+// Load loads the configuration, by decreasing precedence, from the command-line
+// flags in args, the environment, a .env file being read into it, the YAML file
+// of the --config flag and the defaults. Each environment variable has a flag,
+// e.g. --log-level for LOG_LEVEL, and a key of the YAML file, log_level, the
+// gateway options being in its gateway section. Invalid values are reported as
+// a *FieldError naming the variable and its source. --dump-config requests a
+// Dump of the configuration, see DumpRequested.
+func Load(args ...string) (*Config, error) {
+	// Try to load .env file, but don't fail if it doesn't exist
+	_ = godotenv.Load()
+
+	fields := configFields()
+
+	flagValues, cmd, err := parseFlags(fields, args)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string)
+	sources := make(map[string]string)
+
+	if cmd.configFile != "" {
+		fileValues, err := readConfigFile(fields, cmd.configFile)
+		if err != nil {
+			return nil, err
+		}
+
+		for key, value := range fileValues {
+			values[key], sources[key] = value, SourceFile+" "+cmd.configFile
+		}
+	}
+
+	for _, f := range fields {
+		if value, ok := os.LookupEnv(f.key); ok {
+			values[f.key], sources[f.key] = value, SourceEnvironment
+		}
+	}
+
+	for key, value := range flagValues {
+		values[key], sources[key] = value, SourceFlag
+	}
+
+	cfg := &Config{sources: sources, dumpConfig: cmd.dumpConfig}
+	if err := env.ParseWithOptions(cfg, env.Options{Environment: values}); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", cfg.parseError(fields, err))
+	}
+
+	// Validate configuration
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	return cfg, nil
+}
+
+// commandFlags are the flags of Load not setting a value
+type commandFlags struct {
+	configFile string
+	dumpConfig bool
+}
+
+// parseFlags returns the values of the flags set in args by environment
+// variable, and the other flags
+func parseFlags(fields []field, args []string) (map[string]string, commandFlags, error) {
+	var cmd commandFlags
+
+	flags := flag.NewFlagSet("sshgate", flag.ContinueOnError)
+	flags.StringVar(&cmd.configFile, "config", "", "YAML configuration file")
+	flags.BoolVar(&cmd.dumpConfig, "dump-config", false,
+		"print the effective configuration, secrets redacted, before serving")
+
+	values := make(map[string]string)
+
+	for _, f := range fields {
+		usage := "sets " + f.key
+		if f.isBool {
+			flags.Var(&boolFlag{key: f.key, values: values}, f.flagName(), usage)
+		} else {
+			flags.Func(f.flagName(), usage, func(value string) error {
+				values[f.key] = value
+				return nil
+			})
+		}
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return nil, cmd, err
+	}
+
+	if flags.NArg() > 0 {
+		return nil, cmd, fmt.Errorf("unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+
+	return values, cmd, nil
+}
+
+// boolFlag sets a boolean variable, --debug meaning --debug=true
+type boolFlag struct {
+	key    string
+	values map[string]string
+}
+
+func (b *boolFlag) String() string {
+	return ""
+}
+
+func (b *boolFlag) Set(value string) error {
+	if _, err := strconv.ParseBool(value); err != nil {
+		return err
+	}
+
+	b.values[b.key] = value
+
+	return nil
+}
+
+func (b *boolFlag) IsBoolFlag() bool {
+	return true
+}
+
+// readConfigFile returns the values of the YAML file by environment variable,
+// rejecting unknown keys
+func readConfigFile(fields []field, path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read configuration file: %w", err)
+	}
+
+	jsonData, err := yaml.YAMLToJSONStrict(data)
+	if err != nil {
+		return nil, fmt.Errorf("parse configuration file %s: %w", path, err)
+	}
+
+	var document map[string]any
+
+	decoder := json.NewDecoder(bytes.NewReader(jsonData))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&document); err != nil {
+		return nil, fmt.Errorf("parse configuration file %s: %w", path, err)
+	}
+
+	values := make(map[string]string)
+
+	if err := collectFileValues(fields, "", document, values); err != nil {
+		return nil, fmt.Errorf("configuration file %s: %w", path, err)
+	}
+
+	if section, ok := document[gatewaySection]; ok {
+		gatewayDocument, ok := section.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("configuration file %s: %s must be a mapping", path,
+				gatewaySection)
+		}
+
+		if err := collectFileValues(fields, gatewaySection, gatewayDocument, values); err != nil {
+			return nil, fmt.Errorf("configuration file %s: %w", path, err)
+		}
+	}
+
+	return values, nil
+}
+
+// collectFileValues adds the values of the keys of a section of the YAML file
+func collectFileValues(
+	fields []field,
+	section string,
+	document map[string]any,
+	values map[string]string,
+) error {
+	for key, value := range document {
+		if section == "" && key == gatewaySection {
+			continue
+		}
+
+		i := slices.IndexFunc(fields, func(f field) bool {
+			return f.section == section && f.yamlKey() == key
+		})
+		if i < 0 {
+			if section != "" {
+				key = section + "." + key
+			}
+
+			return fmt.Errorf("unknown key %s", key)
+		}
+
+		str, err := fileValueString(value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+
+		values[fields[i].key] = str
+	}
+
+	return nil
+}
+
+// fileValueString returns a YAML value as the value of an environment variable,
+// lists being comma separated
+func fileValueString(value any) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case nil:
+		return "", nil
+	case []any:
+		items := make([]string, 0, len(v))
+
+		for _, item := range v {
+			str, err := fileValueString(item)
+			if err != nil {
+				return "", err
+			}
+
+			if _, ok := item.([]any); ok {
+				return "", errors.New("nested lists are not supported")
+			}
+
+			items = append(items, str)
+		}
+
+		return strings.Join(items, ","), nil
+	default:
+		return "", errors.New("must be a scalar or a list")
+	}
+}
+
+// parseError returns err of parsing the values with the errors about a field
+// as *FieldError
+func (c *Config) parseError(fields []field, err error) error {
+	var aggregate env.AggregateError
+	if !errors.As(err, &aggregate) {
+		return err
+	}
+
+	errs := make([]error, 0, len(aggregate.Errors))
+
+	for _, err := range aggregate.Errors {
+		var parseErr env.ParseError
+		if !errors.As(err, &parseErr) {
+			errs = append(errs, err)
+			continue
+		}
+
+		i := slices.IndexFunc(fields, func(f field) bool { return f.name == parseErr.Name })
+		if i < 0 {
+			errs = append(errs, err)
+			continue
+		}
+
+		errs = append(errs, c.invalid(fields[i].key, parseErr.Err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// source returns where the value of the environment variable key comes from
+func (c *Config) source(key string) string {
+	if source, ok := c.sources[key]; ok {
+		return source
+	}
+
+	return SourceDefault
+}
+
+// IsSet returns whether the environment variable key was set by the file, the
+// environment or a flag rather than left to its default
+func (c *Config) IsSet(key string) bool {
+	return c.source(key) != SourceDefault
+}
+
+// invalid returns err about the value of the environment variable key, naming
+// its source
+func (c *Config) invalid(key string, err error) error {
+	return &FieldError{Field: key, Source: c.source(key), Err: err}
+}
+
+// value returns the field of c holding the value of f
+func (c *Config) value(f field) reflect.Value {
+	value := reflect.ValueOf(c).Elem()
+	if f.section == gatewaySection {
+		value = value.FieldByName("Gateway")
+	}
+
+	return value.FieldByName(f.name)
+}
+
+// Changed returns the environment variables of the values other sets differently
+// than c
+func (c *Config) Changed(other *Config) []string {
+	var changed []string
+
+	for _, f := range configFields() {
+		if !reflect.DeepEqual(c.value(f).Interface(), other.value(f).Interface()) {
+			changed = append(changed, f.key)
+		}
+	}
+
+	return changed
+}
+
+// Set sets the values of the environment variables keys to those of other
+func (c *Config) Set(other *Config, keys ...string) {
+	for _, f := range configFields() {
+		if slices.Contains(keys, f.key) {
+			c.value(f).Set(other.value(f))
+		}
+	}
+}
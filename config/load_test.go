@@ -0,0 +1,280 @@
+package config_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/config"
+)
+
+// writeConfigFile writes a YAML configuration file, returning its path
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "sshgate.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write configuration file: %v", err)
+	}
+
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := `
+log_level: warn
+ssh_listen_addr: [":4444", ":5555"]
+pprof_port: 6060
+informer_resync_period: 10m
+gateway:
+  ssh_backend_port: 2200
+  ssh_handshake_timeout: 45s
+`
+
+	tests := []struct {
+		name      string
+		env       map[string]string
+		args      []string
+		wantLevel string
+		wantPort  int
+	}{
+		{
+			name:      "File",
+			wantLevel: "warn",
+			wantPort:  2200,
+		},
+		{
+			name:      "EnvironmentOverridesFile",
+			env:       map[string]string{"LOG_LEVEL": "error", "SSH_BACKEND_PORT": "2300"},
+			wantLevel: "error",
+			wantPort:  2300,
+		},
+		{
+			name:      "FlagsOverrideEnvironment",
+			env:       map[string]string{"LOG_LEVEL": "error", "SSH_BACKEND_PORT": "2300"},
+			args:      []string{"--log-level", "debug", "--ssh-backend-port=2400"},
+			wantLevel: "debug",
+			wantPort:  2400,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			args := append([]string{"--config", writeConfigFile(t, file)}, tt.args...)
+
+			cfg, err := config.Load(args...)
+			if err != nil {
+				t.Fatalf("Load() failed: %v", err)
+			}
+
+			if cfg.LogLevel != tt.wantLevel {
+				t.Errorf("LogLevel = %s, want %s", cfg.LogLevel, tt.wantLevel)
+			}
+
+			if cfg.Gateway.SSHBackendPort != tt.wantPort {
+				t.Errorf("Gateway.SSHBackendPort = %d, want %d",
+					cfg.Gateway.SSHBackendPort, tt.wantPort)
+			}
+
+			// Values set only by the file
+			if !slices.Equal(cfg.SSHListenAddrs, []string{":4444", ":5555"}) {
+				t.Errorf("SSHListenAddrs = %v, want [:4444 :5555]", cfg.SSHListenAddrs)
+			}
+
+			if cfg.PprofPort != 6060 {
+				t.Errorf("PprofPort = %d, want 6060", cfg.PprofPort)
+			}
+
+			if cfg.InformerResyncPeriod != 10*time.Minute {
+				t.Errorf("InformerResyncPeriod = %s, want 10m", cfg.InformerResyncPeriod)
+			}
+
+			if cfg.Gateway.SSHHandshakeTimeout != 45*time.Second {
+				t.Errorf("Gateway.SSHHandshakeTimeout = %s, want 45s",
+					cfg.Gateway.SSHHandshakeTimeout)
+			}
+
+			// Values set by none keep their defaults
+			if cfg.LogFormat != "text" {
+				t.Errorf("LogFormat = %s, want text", cfg.LogFormat)
+			}
+
+			if !cfg.IsSet("LOG_LEVEL") || !cfg.IsSet("SSH_HANDSHAKE_TIMEOUT") {
+				t.Error("IsSet() = false for values set, want true")
+			}
+
+			if cfg.IsSet("LOG_FORMAT") {
+				t.Error("IsSet(LOG_FORMAT) = true for its default, want false")
+			}
+		})
+	}
+}
+
+func TestLoadBoolFlag(t *testing.T) {
+	t.Setenv("DEBUG", "false")
+
+	cfg, err := config.Load("--debug", "--enable-agent-forward=false")
+	if err != nil {
+		t.Fatalf("Load() failed: %v", err)
+	}
+
+	if !cfg.Debug {
+		t.Error("Debug = false, want true")
+	}
+
+	if cfg.Gateway.EnableAgentForward == nil || *cfg.Gateway.EnableAgentForward {
+		t.Error("Gateway.EnableAgentForward is not false")
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		file       string
+		env        map[string]string
+		args       []string
+		wantField  string
+		wantSource string
+		wantErr    string
+	}{
+		{
+			name:       "InvalidValueFromFile",
+			file:       "log_level: verbose\n",
+			wantField:  "LOG_LEVEL",
+			wantSource: "file ",
+			wantErr:    "invalid log level",
+		},
+		{
+			name:       "InvalidValueFromEnvironment",
+			env:        map[string]string{"PPROF_PORT": "70000"},
+			wantField:  "PPROF_PORT",
+			wantSource: config.SourceEnvironment,
+			wantErr:    "invalid pprof port",
+		},
+		{
+			name:       "InvalidValueFromFlag",
+			args:       []string{"--ssh-backend-port", "0"},
+			wantField:  "SSH_BACKEND_PORT",
+			wantSource: config.SourceFlag,
+			wantErr:    "invalid SSH backend port",
+		},
+		{
+			name:       "UnparsableDuration",
+			file:       "gateway:\n  ssh_handshake_timeout: 30\n",
+			wantField:  "SSH_HANDSHAKE_TIMEOUT",
+			wantSource: "file ",
+			wantErr:    "missing unit",
+		},
+		{
+			name:       "UnparsableNumber",
+			env:        map[string]string{"PPROF_PORT": "six"},
+			wantField:  "PPROF_PORT",
+			wantSource: config.SourceEnvironment,
+			wantErr:    "invalid syntax",
+		},
+		{
+			name:       "InvalidDefaultCombination",
+			args:       []string{"--enable-agent-forward=false", "--enable-proxy-jump=false"},
+			wantField:  "ENABLE_PROXY_JUMP",
+			wantSource: config.SourceFlag,
+			wantErr:    "at least one proxy mode",
+		},
+		{
+			name:    "UnknownKey",
+			file:    "log_levle: debug\n",
+			wantErr: "unknown key log_levle",
+		},
+		{
+			name:    "UnknownGatewayKey",
+			file:    "gateway:\n  log_level: debug\n",
+			wantErr: "unknown key gateway.log_level",
+		},
+		{
+			name:    "GatewayOptionAtTopLevel",
+			file:    "ssh_backend_port: 2200\n",
+			wantErr: "unknown key ssh_backend_port",
+		},
+		{
+			name:    "UnknownFlag",
+			args:    []string{"--log-levle", "debug"},
+			wantErr: "flag provided but not defined",
+		},
+		{
+			name:    "MissingFile",
+			args:    []string{"--config", "/nonexistent/sshgate.yaml"},
+			wantErr: "read configuration file",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"--config", writeConfigFile(t, tt.file)}, args...)
+			}
+
+			_, err := config.Load(args...)
+			if err == nil {
+				t.Fatal("Load() succeeded, want an error")
+			}
+
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Load() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+
+			if tt.wantField == "" {
+				return
+			}
+
+			var fieldErr *config.FieldError
+			if !errors.As(err, &fieldErr) {
+				t.Fatalf("Load() error = %v, want a *config.FieldError", err)
+			}
+
+			if fieldErr.Field != tt.wantField {
+				t.Errorf("FieldError.Field = %s, want %s", fieldErr.Field, tt.wantField)
+			}
+
+			if !strings.HasPrefix(fieldErr.Source, tt.wantSource) {
+				t.Errorf("FieldError.Source = %s, want %s", fieldErr.Source, tt.wantSource)
+			}
+		})
+	}
+}
+
+func TestConfigChanged(t *testing.T) {
+	cfg := config.NewDefaultConfig()
+	next := config.NewDefaultConfig()
+
+	if changed := cfg.Changed(next); len(changed) != 0 {
+		t.Errorf("Changed() = %v, want nothing", changed)
+	}
+
+	next.LogLevel = "debug"
+	next.SSHListenAddrs = []string{":2223"}
+	next.Gateway.Banner = "reloaded"
+
+	want := []string{"SSH_LISTEN_ADDR", "LOG_LEVEL", "BANNER"}
+	if changed := cfg.Changed(next); !slices.Equal(changed, want) {
+		t.Errorf("Changed() = %v, want %v", changed, want)
+	}
+
+	cfg.Set(next, "LOG_LEVEL", "BANNER")
+
+	want = []string{"SSH_LISTEN_ADDR"}
+	if changed := cfg.Changed(next); !slices.Equal(changed, want) {
+		t.Errorf("Changed() after Set() = %v, want %v", changed, want)
+	}
+}
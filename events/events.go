@@ -0,0 +1,96 @@
+package events
+
+import (
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// Component is the source component of the events recorded by the gateway
+const Component = "sshgate"
+
+// NewRecorder returns an event recorder writing Kubernetes events through the
+// API server, and a function flushing and stopping it. When the gateway is not
+// allowed to create events, a warning is logged once and events are dropped.
+func NewRecorder(clientset kubernetes.Interface) (record.EventRecorder, func()) {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&sink{
+		EventSinkImpl: typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")},
+		logger:        log.WithField("component", "events"),
+	})
+
+	recorder := broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: Component})
+
+	return recorder, broadcaster.Shutdown
+}
+
+// sink writes events to the API server until it forbids their creation
+type sink struct {
+	typedcorev1.EventSinkImpl
+
+	logger    *log.Entry
+	forbidden atomic.Bool
+}
+
+func (s *sink) Create(event *corev1.Event) (*corev1.Event, error) {
+	if s.forbidden.Load() {
+		return event, nil
+	}
+
+	created, err := s.EventSinkImpl.Create(event)
+	if s.checkForbidden(event, err) {
+		return event, nil
+	}
+
+	return created, err
+}
+
+func (s *sink) Update(event *corev1.Event) (*corev1.Event, error) {
+	if s.forbidden.Load() {
+		return event, nil
+	}
+
+	updated, err := s.EventSinkImpl.Update(event)
+	if s.checkForbidden(event, err) {
+		return event, nil
+	}
+
+	return updated, err
+}
+
+func (s *sink) Patch(event *corev1.Event, data []byte) (*corev1.Event, error) {
+	if s.forbidden.Load() {
+		return event, nil
+	}
+
+	patched, err := s.EventSinkImpl.Patch(event, data)
+	if s.checkForbidden(event, err) {
+		return event, nil
+	}
+
+	return patched, err
+}
+
+// checkForbidden reports whether the API server forbids creating events, then
+// stops writing them. The error is swallowed so the broadcaster does not log
+// every dropped event.
+func (s *sink) checkForbidden(event *corev1.Event, err error) bool {
+	if !apierrors.IsForbidden(err) {
+		return false
+	}
+
+	if s.forbidden.CompareAndSwap(false, true) {
+		s.logger.WithFields(log.Fields{
+			"namespace": event.Namespace,
+			"reason":    event.Reason,
+		}).WithError(err).Warn("Not allowed to create Kubernetes events, they are only logged")
+	}
+
+	return true
+}
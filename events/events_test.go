@@ -0,0 +1,90 @@
+package events_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/events"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+var devboxRef = &corev1.ObjectReference{
+	APIVersion: "devbox.sealos.io/v1alpha1",
+	Kind:       "Devbox",
+	Namespace:  "ns-test",
+	Name:       "test-devbox",
+}
+
+func TestNewRecorder_CreatesEvents(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+
+	recorder, stop := events.NewRecorder(clientset)
+	defer stop()
+
+	recorder.Event(devboxRef, corev1.EventTypeNormal, "SSHConnected", "connected")
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		list, err := clientset.CoreV1().Events("ns-test").List(
+			context.Background(),
+			metav1.ListOptions{},
+		)
+		if err != nil {
+			t.Fatalf("Failed to list events: %v", err)
+		}
+
+		if len(list.Items) == 1 {
+			event := list.Items[0]
+			if event.Reason != "SSHConnected" || event.InvolvedObject.Name != "test-devbox" ||
+				event.Source.Component != events.Component {
+				t.Errorf("Event = %+v, want SSHConnected on test-devbox", event)
+			}
+
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Got %d events, want 1", len(list.Items))
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNewRecorder_ForbiddenStopsCreatingEvents(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+
+	var attempts atomic.Int32
+
+	clientset.PrependReactor("create", "events",
+		func(k8stesting.Action) (bool, runtime.Object, error) {
+			attempts.Add(1)
+
+			return true, nil, apierrors.NewForbidden(
+				schema.GroupResource{Resource: "events"}, "", nil,
+			)
+		},
+	)
+
+	recorder, stop := events.NewRecorder(clientset)
+
+	recorder.Event(devboxRef, corev1.EventTypeWarning, "SSHAuthFailed", "first")
+	recorder.Event(devboxRef, corev1.EventTypeWarning, "SSHHostKeyMismatch", "second")
+
+	// Shutdown flushes the queued events
+	time.Sleep(100 * time.Millisecond)
+	stop()
+
+	if got := attempts.Load(); got != 1 {
+		t.Errorf("Attempted to create %d events, want 1", got)
+	}
+}
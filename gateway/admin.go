@@ -0,0 +1,77 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// isAdminKey reports whether key is one of the configured admin keys
+func (g *Gateway) isAdminKey(key ssh.PublicKey) bool {
+	_, ok := g.adminKeys[string(key.Marshal())]
+	return ok
+}
+
+// authenticateAdmin authenticates an admin key. Admin keys can reach any devbox
+// selected by the username, except in namespaces denied by configuration.
+// The backend is reached with the devbox's stored private key.
+func (g *Gateway) authenticateAdmin(
+	conn ssh.ConnMetadata,
+	key ssh.PublicKey,
+	authLogger *log.Entry,
+) (*ssh.Permissions, error) {
+	parsed, err := g.parser.Resolve(conn.User())
+	if err != nil && !errors.Is(err, ErrDevboxNotFound) {
+		return nil, err
+	}
+
+	username, fullNamespace, devboxName := parsed.Username, parsed.Namespace, parsed.DevboxName
+
+	// Admin sessions authenticate to the backend with the devbox private key
+	if g.opts().DisablePublicKeyMode {
+		return nil, fmt.Errorf("%w: public key mode is disabled", ErrAdminAccessDenied)
+	}
+
+	if slices.Contains(g.opts().AdminDeniedNamespaces, fullNamespace) {
+		return nil, fmt.Errorf("%w: namespace %s", ErrAdminAccessDenied, fullNamespace)
+	}
+
+	info, ok := g.registry.GetDevboxInfo(fullNamespace, devboxName)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s/%s", ErrDevboxNotFound, fullNamespace, devboxName)
+	}
+
+	backendUser, err := g.backendUser(info, parsed.Login(), true)
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprint := ssh.FingerprintSHA256(key)
+
+	adminLogger := authLogger.WithFields(log.Fields{
+		"auth_mode":             AuthModeAdmin.String(),
+		"namespace":             fullNamespace,
+		"devbox":                devboxName,
+		"admin_key_fingerprint": fingerprint,
+		"username_form":         parsed.Form,
+	})
+
+	adminLogger.WithField("backend_user", backendUser).Info("authentication accept")
+
+	return &ssh.Permissions{
+		Extensions: map[string]string{
+			"username":              username,
+			"claimed_user":          parsed.Login(),
+			"backend_user":          backendUser,
+			"auth_mode":             AuthModeAdmin.String(),
+			"admin_key_fingerprint": fingerprint,
+		},
+		ExtraData: map[any]any{
+			"devbox_info": info,
+			"logger":      adminLogger,
+		},
+	}, nil
+}
@@ -0,0 +1,93 @@
+package gateway_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestPublicKeyCallback_AdminKey(t *testing.T) {
+	hostKey, _, _, _ := generateTestKeys(t)
+	_, adminPub, adminBytes, _ := generateTestKeys(t)
+	reg := newBannerTestRegistry(t)
+
+	gw := gateway.New(hostKey, reg,
+		gateway.WithAdminKeys([]string{string(adminBytes)}, []string{"ns-restricted"}),
+	)
+
+	tests := []struct {
+		name    string
+		user    string
+		wantErr error
+	}{
+		{name: "selects devbox by username", user: "root@team-running"},
+		{name: "plain username", user: "root", wantErr: gateway.ErrInvalidUsername},
+		{
+			name:    "denied namespace",
+			user:    "root@restricted-running",
+			wantErr: gateway.ErrAdminAccessDenied,
+		},
+		{name: "missing devbox", user: "root@team-missing", wantErr: gateway.ErrDevboxNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			perms, err := gw.PublicKeyCallback(newMockConnMetadata(tt.user), adminPub)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Expected error %v, got: %v", tt.wantErr, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Expected admin key to be accepted, got: %v", err)
+			}
+
+			if got := perms.Extensions["auth_mode"]; got != gateway.AuthModeAdmin.String() {
+				t.Errorf("auth_mode = %q, want %q", got, gateway.AuthModeAdmin.String())
+			}
+
+			wantFingerprint := ssh.FingerprintSHA256(adminPub)
+			if got := perms.Extensions["admin_key_fingerprint"]; got != wantFingerprint {
+				t.Errorf("admin_key_fingerprint = %q, want %q", got, wantFingerprint)
+			}
+
+			username, _ := gateway.GetUsernameFromPermissions(perms)
+			if username != "root" {
+				t.Errorf("username = %q, want root", username)
+			}
+
+			info, err := gateway.GetDevboxInfoFromPermissions(perms)
+			if err != nil {
+				t.Fatalf("GetDevboxInfoFromPermissions() failed: %v", err)
+			}
+
+			if info.DevboxName != "running" || info.PrivateKey == nil {
+				t.Errorf("Expected devbox running with its private key, got %+v", info)
+			}
+		})
+	}
+}
+
+func TestPublicKeyCallback_AdminKeyDoesNotAffectOtherKeys(t *testing.T) {
+	hostKey, _, _, _ := generateTestKeys(t)
+	_, _, adminBytes, _ := generateTestKeys(t)
+	_, otherPub, _, _ := generateTestKeys(t)
+
+	gw := gateway.New(hostKey, newBannerTestRegistry(t),
+		gateway.WithAdminKeys([]string{string(adminBytes)}, nil),
+	)
+
+	perms, err := gw.PublicKeyCallback(newMockConnMetadata("root@team-running"), otherPub)
+	if err != nil {
+		t.Fatalf("Expected custom key mode to accept the key, got: %v", err)
+	}
+
+	if got := perms.Extensions["auth_mode"]; got != gateway.AuthModeCustomKey.String() {
+		t.Errorf("auth_mode = %q, want %q", got, gateway.AuthModeCustomKey.String())
+	}
+}
@@ -1,19 +1,27 @@
 package gateway
 
 import (
+	"context"
 	"fmt"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/zijiren233/sshgate/registry"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 )
 
+// agentRequestType is the channel request asking for agent forwarding
+const agentRequestType = "auth-agent-req@openssh.com"
+
 func (g *Gateway) handleAgentForwardMode(
+	connCtx context.Context,
 	newChannel ssh.NewChannel,
 	ctx *sessionContext,
+	cio *connIO,
+	logger *log.Entry,
 ) {
-	sessionLogger := ctx.logger.WithField("mode", "agent_forwarding")
+	sessionLogger := logger.WithField("mode", "agent_forwarding")
 
 	channel, requests, err := newChannel.Accept()
 	if err != nil {
@@ -21,70 +29,168 @@ func (g *Gateway) handleAgentForwardMode(
 		return
 	}
 	defer channel.Close()
+	defer cio.live.trackSession(channel)()
+
+	requests = restrictRequests(connCtx, requests, channel, cio.sftpOnly, sessionLogger)
+
+	// Later sessions open a channel on the backend connection of the first one
+	if backendConn := ctx.currentBackend(); backendConn != nil {
+		sessionLogger.Debug("Reusing backend connection")
+
+		err := g.serveSession(connCtx, channel, requests, nil, false, backendConn, ctx, cio,
+			sessionLogger)
+		if err == nil {
+			return
+		}
+
+		sessionLogger.WithError(err).Warn("Shared backend connection failed, reconnecting")
+		ctx.dropBackend(backendConn)
+	}
 
 	// Process channel requests to handle auth-agent-req@openssh.com
 	// This implements the OpenSSH standard where auth-agent-req is a CHANNEL request
 	// Returns agent channel and cached requests
-	sessionResult := g.handleSessionRequests(requests, ctx)
+	sessionResult := g.handleSessionRequests(connCtx, requests, ctx)
 
 	// Check if agent forwarding was successful
 	if sessionResult == nil || sessionResult.AgentChannel == nil {
+		if connCtx.Err() != nil {
+			return
+		}
+
+		var cached []*ssh.Request
+		if sessionResult != nil {
+			cached = sessionResult.CachedRequests
+
+			// Clients opening many channels at once, like IDEs, may only ask for
+			// the agent on some, the others use the backend connection those set up
+			backendConn := ctx.awaitBackend(connCtx, g.opts().SessionRequestTimeout)
+			if backendConn != nil && g.serveSession(connCtx, channel, requests, cached, false,
+				backendConn, ctx, cio, sessionLogger) == nil {
+				return
+			}
+		}
+
 		sessionLogger.Warn("Failed to establish agent forwarding")
-		fmt.Fprintf(channel,
-			"Failed to establish agent forwarding\r\n"+
-				"Make sure your SSH agent is running and has the correct keys\r\n",
-		)
+
+		message := g.message(msgAgentUnavailable, ctx.info, nil)
+		if g.opts().AgentHelpURL != "" {
+			message += "\r\nSee " + g.opts().AgentHelpURL
+		}
+
+		failSession(channel, cached, requests, message)
 
 		return
 	}
 
-	// Connect to backend with agent authentication if available
-	backendConn, err := g.connectToBackend(ctx, sessionResult.AgentChannel)
-	// close agent channel
+	// Connect to backend with agent authentication unless another session already did,
+	// the agent channel is only needed while authenticating
+	backendConn, reused, err := ctx.sharedBackend(func() (*ssh.Client, error) {
+		return g.connectToBackend(connCtx, ctx, sessionResult.AgentChannel)
+	})
 	_ = sessionResult.AgentChannel.Close()
 
 	if err != nil {
-		sessionLogger.WithError(err).Error("Failed to connect to backend")
-		fmt.Fprintf(channel,
-			"Failed to connect to devbox: %v\r\n"+
-				"Make sure your SSH agent has the correct key and that the key is in ~/.ssh/authorized_keys on the devbox\r\n",
-			err,
+		// The client is gone, the dial was abandoned rather than failed
+		if connCtx.Err() != nil {
+			sessionLogger.WithError(err).Info("Client disconnected while connecting to backend")
+			return
+		}
+
+		g.opts().LogLimiter.Log(sessionLogger.WithError(err), log.ErrorLevel,
+			"Failed to connect to backend", "namespace", "devbox")
+		failSession(
+			channel,
+			sessionResult.CachedRequests,
+			requests,
+			g.message(backendFailureMessage(err, ctx.info), ctx.info, err),
 		)
 
 		return
 	}
 
-	defer backendConn.Close()
+	if !reused {
+		sessionLogger.Info("Backend connected via agent forwarding")
+	}
 
-	sessionLogger.Info("Backend connected via agent forwarding")
+	err = g.serveSession(connCtx, channel, requests, sessionResult.CachedRequests, true,
+		backendConn, ctx, cio, sessionLogger)
+	if err != nil {
+		sessionLogger.WithError(err).Error("Failed to open backend channel")
+		ctx.dropBackend(backendConn)
+		failSession(
+			channel,
+			sessionResult.CachedRequests,
+			requests,
+			g.message(msgBackendUnavailable, ctx.info, err),
+		)
+	}
+}
 
+// serveSession proxies a session over a new channel of the backend connection,
+// forwarding the cached requests first. agentRequested tells whether one of them
+// asked for the agent. The session is left untouched if the backend channel
+// cannot be opened.
+func (g *Gateway) serveSession(
+	connCtx context.Context,
+	channel ssh.Channel,
+	requests <-chan *ssh.Request,
+	cached []*ssh.Request,
+	agentRequested bool,
+	backendConn *ssh.Client,
+	ctx *sessionContext,
+	cio *connIO,
+	logger *log.Entry,
+) error {
 	backendChannel, backendRequests, err := backendConn.OpenChannel("session", nil)
 	if err != nil {
-		sessionLogger.WithError(err).Error("Failed to open backend channel")
-		return
+		return err
 	}
 	defer backendChannel.Close()
 
+	g.sendSessionEnv(backendChannel, cio)
+
+	// Agent requests of the session are forwarded onward if configured
+	agentSession := ctx.agent.session(backendChannel, logger)
+	defer agentSession.close()
+
+	if agentRequested {
+		agentSession.enable()
+	}
+
 	// Forward cached requests to backend
-	g.forwardCachedRequests(sessionResult.CachedRequests, backendChannel, sessionLogger)
+	g.forwardCachedRequests(cached, backendChannel, cio.forceCommand, logger)
 
 	// Use synchronized proxy to ensure exit-status is forwarded before closing
 	g.proxyChannelWithRequests(
+		connCtx,
 		channel,
 		backendChannel,
-		requests,
+		agentSession.requests(connCtx, requests),
 		backendRequests,
-		sessionLogger,
+		cio,
+		logger,
 	)
+
+	return nil
 }
 
-// forwardCachedRequests forwards cached SSH requests to the backend
+// forwardCachedRequests forwards cached SSH requests but the agent request to the
+// backend, replacing the requested command with forceCommand if set
 func (g *Gateway) forwardCachedRequests(
 	cachedRequests []*ssh.Request,
 	backendChannel ssh.Channel,
+	forceCommand string,
 	logger *log.Entry,
 ) {
 	for _, req := range cachedRequests {
+		// The gateway answered the agent request, onward forwarding is separate
+		if req.Type == agentRequestType {
+			continue
+		}
+
+		g.forceCommand(req, backendChannel, forceCommand, logger)
+
 		ok, err := backendChannel.SendRequest(req.Type, req.WantReply, req.Payload)
 
 		if req.WantReply {
@@ -109,18 +215,20 @@ type SessionRequestsResult struct {
 
 // handleSessionRequests processes channel requests for a session
 // This handles auth-agent-req@openssh.com as a CHANNEL request (OpenSSH standard)
-// Returns a result with agent request status and cached non-agent requests
+// Returns a result with agent request status and cached non-agent requests,
+// or nil once connCtx is done
 func (g *Gateway) handleSessionRequests(
+	connCtx context.Context,
 	requests <-chan *ssh.Request,
 	ctx *sessionContext,
 ) *SessionRequestsResult {
 	result := &SessionRequestsResult{
 		AgentChannel:   nil,
-		CachedRequests: make([]*ssh.Request, 0, g.options.MaxCachedRequests),
+		CachedRequests: make([]*ssh.Request, 0, g.opts().MaxCachedRequests),
 	}
 
 	// Process requests until we've handled all initial setup requests
-	timeout := time.NewTimer(g.options.SessionRequestTimeout)
+	timeout := time.NewTimer(g.opts().SessionRequestTimeout)
 	defer timeout.Stop()
 
 	for {
@@ -135,9 +243,14 @@ func (g *Gateway) handleSessionRequests(
 				"want_reply":   req.WantReply,
 			}).Debug("Session channel request")
 
+			// Requests answered by the gateway take no room in the cache
+			if answerLocalRequest(req) {
+				continue
+			}
+
 			// Handle auth-agent-req@openssh.com as a channel request (OpenSSH standard)
-			if req.Type == "auth-agent-req@openssh.com" {
-				ctx.logger.Info("Agent forwarding requested by client")
+			if req.Type == agentRequestType {
+				ctx.logger.Debug("Agent forwarding requested by client")
 
 				if req.WantReply {
 					_ = req.Reply(true, nil)
@@ -154,9 +267,15 @@ func (g *Gateway) handleSessionRequests(
 			}
 
 			// For all other request types, cache them for forwarding
-			if len(result.CachedRequests) < g.options.MaxCachedRequests {
+			if len(result.CachedRequests) < g.opts().MaxCachedRequests {
 				result.CachedRequests = append(result.CachedRequests, req)
 
+				// Clients ask for the agent before starting the session, such as
+				// WinSCP starting SFTP, none is coming
+				if req.Type == "shell" || req.Type == "exec" || req.Type == "subsystem" {
+					return result
+				}
+
 				timeout.Reset(time.Second)
 				continue
 			}
@@ -166,6 +285,9 @@ func (g *Gateway) handleSessionRequests(
 		case <-timeout.C:
 			// Timeout - stop processing initial requests
 			return result
+
+		case <-connCtx.Done():
+			return nil
 		}
 	}
 }
@@ -176,13 +298,13 @@ func (g *Gateway) handleSessionRequests(
 func (g *Gateway) createAgentChannelToClient(ctx *sessionContext) ssh.Channel {
 	// Use the client connection to open an agent channel
 	// This tells the client "I want to access your SSH agent"
-	agentChannel, agentReqs, err := ctx.conn.OpenChannel("auth-agent@openssh.com", nil)
+	agentChannel, agentReqs, err := ctx.conn.OpenChannel(agentChannelType, nil)
 	if err != nil {
 		ctx.logger.WithError(err).Error("Failed to open agent channel to client")
 		return nil
 	}
 
-	ctx.logger.Info("Agent channel to client established")
+	ctx.logger.Debug("Agent channel to client established")
 
 	// Discard requests on the agent channel
 	go ssh.DiscardRequests(agentReqs)
@@ -191,30 +313,80 @@ func (g *Gateway) createAgentChannelToClient(ctx *sessionContext) ssh.Channel {
 }
 
 func (g *Gateway) connectToBackend(
+	connCtx context.Context,
 	ctx *sessionContext,
 	agentChannel ssh.Channel,
 ) (*ssh.Client, error) {
-	backendAddr := fmt.Sprintf("%s:%d", ctx.info.PodIP, g.options.SSHBackendPort)
+	// The devbox may have been deleted or stopped since the client authenticated
+	info, ok := g.registry.GetDevboxInfo(ctx.info.Namespace, ctx.info.DevboxName)
+	if !ok {
+		return nil, fmt.Errorf(
+			"%w: %s/%s",
+			ErrDevboxNotFound,
+			ctx.info.Namespace,
+			ctx.info.DevboxName,
+		)
+	}
+
+	switch info.PodState() {
+	case registry.PodStateNone:
+		return nil, fmt.Errorf(
+			"%w: %s/%s",
+			ErrDevboxNotRunning,
+			ctx.info.Namespace,
+			ctx.info.DevboxName,
+		)
+	case registry.PodStateStarting:
+		return nil, fmt.Errorf(
+			"%w: %s/%s",
+			ErrDevboxStarting,
+			ctx.info.Namespace,
+			ctx.info.DevboxName,
+		)
+	}
 
-	agentClient := agent.NewClient(agentChannel)
+	backendAddr, addressing := g.backendAddr(
+		connCtx,
+		ctx.info,
+		g.backendSSHPort(ctx.info),
+		ctx.logger,
+	)
+
+	// Only the identities relevant to the devbox are offered to the backend
+	agentClient := NewFilteringAgent(agent.NewClient(agentChannel), g.agentFingerprints(ctx))
 
 	backendConfig := &ssh.ClientConfig{
-		User: ctx.realUser,
-		Auth: []ssh.AuthMethod{ssh.PublicKeysCallback(agentClient.Signers)},
-		//nolint:gosec
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         g.options.BackendConnectTimeoutAgent,
+		User:            ctx.realUser,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeysCallback(agentClient.Signers)},
+		HostKeyCallback: g.hostKeyVerifier.callback(ctx.info),
+		Timeout:         g.opts().BackendConnectTimeoutAgent,
 	}
 
 	ctx.logger.WithFields(log.Fields{
-		"backend_addr": backendAddr,
-		"backend_user": ctx.realUser,
-	}).Info("Connecting to backend with agent authentication")
+		"backend_addr":       backendAddr,
+		"backend_addressing": addressing,
+		"backend_user":       ctx.realUser,
+	}).Debug("Connecting to backend with agent authentication")
+
+	ctx.io.audit.setBackendAddr(backendAddr)
 
-	conn, err := ssh.Dial("tcp", backendAddr, backendConfig)
+	conn, err := g.dialBackendSSH(
+		withBackendCluster(connCtx, ctx.info.Cluster),
+		backendAddr,
+		backendConfig,
+	)
 	if err != nil {
+		if connCtx.Err() == nil {
+			g.events.recordBackendFailure(ctx.info, err)
+		}
+
 		return nil, err
 	}
 
+	ctx.logger.WithField("agent_identity", agentClient.LastSigned()).
+		Info("Backend accepted agent identity")
+
+	ctx.agent.serve(conn)
+
 	return conn, nil
 }
@@ -0,0 +1,98 @@
+package gateway_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestPublicKeyCallback_AgentForwardDisabled(t *testing.T) {
+	hostKey, _, _, _ := generateTestKeys(t)
+	_, unknownPub, _, _ := generateTestKeys(t)
+
+	// ProxyJump is left enabled, it does not serve keys the devbox does not know
+	gw := gateway.New(hostKey, newBannerTestRegistry(t),
+		gateway.WithDisableAgentForwardingMode(true))
+
+	_, err := gw.PublicKeyCallback(newMockConnMetadata("dev@team-running"), unknownPub)
+	if !errors.Is(err, gateway.ErrAgentForwardingDisabled) {
+		t.Fatalf("Expected %v, got: %v", gateway.ErrAgentForwardingDisabled, err)
+	}
+
+	_, err = gw.NoClientAuthCallback(newMockConnMetadata("dev@team-running"))
+	if !errors.Is(err, gateway.ErrAgentForwardingDisabled) {
+		t.Fatalf("Expected %v without client auth, got: %v",
+			gateway.ErrAgentForwardingDisabled, err)
+	}
+}
+
+func TestAgentForwardDisabled_UnknownKeyRefused(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t, gateway.WithDisableAgentForwardingMode(true))
+
+	userSigner, _, _, _ := generateTestKeys(t)
+
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User: "testuser@test-test-devbox",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(userSigner)},
+		//nolint:gosec // acceptable for testing
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err == nil {
+		client.Close()
+		t.Fatal("Key the devbox does not know authenticated with agent forwarding mode disabled")
+	}
+}
+
+func TestAgentForwardDisabled_SessionUsesInjectedKey(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t, gateway.WithDisableAgentForwardingMode(true))
+
+	signer, err := ssh.ParsePrivateKey(env.privBytes)
+	if err != nil {
+		t.Fatalf("Failed to parse private key: %v", err)
+	}
+
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User: "testuser",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		//nolint:gosec // acceptable for testing
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Failed to dial gateway: %v", err)
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer session.Close()
+
+	// The mock backend accepts agent forwarding requests,
+	// a refusal means the gateway did not forward it
+	if err := agent.RequestAgentForwarding(session); err == nil {
+		t.Error("Expected agent forwarding request to be refused")
+	}
+
+	if err := session.Run("exit 0"); err != nil {
+		t.Fatalf("Expected session to succeed with the injected key, got: %v", err)
+	}
+}
+
+func TestOptionsValidate_PublicKeyAndAgentForwardDisabled(t *testing.T) {
+	opts := gateway.DefaultOptions()
+	opts.DisablePublicKeyMode = true
+	opts.DisableAgentForwardingMode = true
+
+	if err := opts.Validate(); err == nil {
+		t.Error("Expected validation error, got nil")
+	}
+}
@@ -0,0 +1,292 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Onward agent forwarding modes
+const (
+	// AgentForwardOnwardOff keeps the client agent to the gateway, which only
+	// uses it to authenticate to the backend
+	AgentForwardOnwardOff = "off"
+	// AgentForwardOnwardFiltered exposes to backend sessions the identities of the
+	// client agent the gateway offers to the backend
+	AgentForwardOnwardFiltered = "filtered"
+	// AgentForwardOnwardAll exposes the whole client agent to backend sessions
+	AgentForwardOnwardAll = "all"
+)
+
+// agentChannelType is the channel type of connections to a forwarded agent
+const agentChannelType = "auth-agent@openssh.com"
+
+// validateAgentForwardOnward checks the onward agent forwarding mode
+func validateAgentForwardOnward(mode string) error {
+	switch mode {
+	case "", AgentForwardOnwardOff, AgentForwardOnwardFiltered, AgentForwardOnwardAll:
+		return nil
+	default:
+		return fmt.Errorf(
+			"invalid onward agent forwarding mode: %s (must be off, filtered, or all)",
+			mode,
+		)
+	}
+}
+
+// agentBridge bridges the agent channels opened by the backend connection of an
+// agent forwarding mode client to agent channels opened on the client connection,
+// while at least one session of the client forwards its agent onward. A nil
+// agentBridge keeps the agent to the gateway.
+type agentBridge struct {
+	mode string
+	conn ssh.Conn
+	// fingerprints are the identities exposed in filtered mode
+	fingerprints []string
+	logger       *log.Entry
+
+	mu sync.Mutex
+	// sessions is the number of sessions forwarding the agent onward
+	sessions int
+	// channels are both ends of the bridged agent channels
+	channels map[ssh.Channel]struct{}
+}
+
+func (g *Gateway) newAgentBridge(ctx *sessionContext) *agentBridge {
+	if g.opts().AgentForwardOnward == "" ||
+		g.opts().AgentForwardOnward == AgentForwardOnwardOff {
+		return nil
+	}
+
+	return &agentBridge{
+		mode:         g.opts().AgentForwardOnward,
+		conn:         ctx.conn,
+		fingerprints: g.agentFingerprints(ctx),
+		logger:       ctx.logger,
+		channels:     make(map[ssh.Channel]struct{}),
+	}
+}
+
+// serve bridges the agent channels opened by a backend connection until it is closed
+func (b *agentBridge) serve(backend *ssh.Client) {
+	if b == nil {
+		return
+	}
+
+	newChannels := backend.HandleChannelOpen(agentChannelType)
+	if newChannels == nil {
+		return
+	}
+
+	go func() {
+		for newChannel := range newChannels {
+			go b.bridge(newChannel)
+		}
+	}()
+}
+
+// bridge connects an agent channel opened by the backend to the client agent
+func (b *agentBridge) bridge(newChannel ssh.NewChannel) {
+	if !b.active() {
+		_ = newChannel.Reject(ssh.Prohibited, "agent forwarding is not enabled")
+		return
+	}
+
+	clientChannel, clientReqs, err := b.conn.OpenChannel(agentChannelType, nil)
+	if err != nil {
+		b.logger.WithError(err).Warn("Failed to open onward agent channel to client")
+		_ = newChannel.Reject(ssh.ConnectionFailed, "client agent unavailable")
+
+		return
+	}
+	defer clientChannel.Close()
+
+	go ssh.DiscardRequests(clientReqs)
+
+	backendChannel, backendReqs, err := newChannel.Accept()
+	if err != nil {
+		b.logger.WithError(err).Warn("Failed to accept backend agent channel")
+		return
+	}
+	defer backendChannel.Close()
+
+	go ssh.DiscardRequests(backendReqs)
+
+	if !b.track(clientChannel, backendChannel) {
+		return
+	}
+	defer b.untrack(clientChannel, backendChannel)
+
+	b.logger.WithField("mode", b.mode).Debug("Bridging backend agent channel to client")
+
+	if b.mode == AgentForwardOnwardFiltered {
+		upstream := NewFilteringAgent(agent.NewClient(clientChannel), b.fingerprints)
+		_ = agent.ServeAgent(upstream, backendChannel)
+
+		return
+	}
+
+	go func() {
+		_, _ = io.Copy(clientChannel, backendChannel)
+		_ = clientChannel.CloseWrite()
+	}()
+
+	_, _ = io.Copy(backendChannel, clientChannel)
+}
+
+func (b *agentBridge) active() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.sessions > 0
+}
+
+// track registers the ends of a bridged channel, unless no session forwards the
+// agent anymore
+func (b *agentBridge) track(channels ...ssh.Channel) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.sessions == 0 {
+		return false
+	}
+
+	for _, channel := range channels {
+		b.channels[channel] = struct{}{}
+	}
+
+	return true
+}
+
+func (b *agentBridge) untrack(channels ...ssh.Channel) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, channel := range channels {
+		delete(b.channels, channel)
+	}
+}
+
+// acquire counts a session forwarding the agent onward
+func (b *agentBridge) acquire() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.sessions++
+}
+
+// release ends the onward forwarding of a session, tearing down the bridged
+// channels once no session forwards the agent
+func (b *agentBridge) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.sessions--
+	if b.sessions > 0 {
+		return
+	}
+
+	for channel := range b.channels {
+		_ = channel.Close()
+	}
+
+	clear(b.channels)
+}
+
+// agentSession is the onward agent forwarding of a session
+type agentSession struct {
+	bridge         *agentBridge
+	backendChannel ssh.Channel
+	logger         *log.Entry
+
+	mu      sync.Mutex
+	enabled bool
+	closed  bool
+}
+
+// session returns the onward agent forwarding of a session to backendChannel
+func (b *agentBridge) session(backendChannel ssh.Channel, logger *log.Entry) *agentSession {
+	return &agentSession{
+		bridge:         b,
+		backendChannel: backendChannel,
+		logger:         logger,
+	}
+}
+
+// enable asks the backend session for agent forwarding, once, reporting whether
+// the agent is forwarded onward
+func (s *agentSession) enable() bool {
+	if s.bridge == nil {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.enabled || s.closed {
+		return s.enabled
+	}
+
+	ok, err := s.backendChannel.SendRequest(agentRequestType, true, nil)
+	if err != nil || !ok {
+		s.logger.WithError(err).Warn("Backend refused onward agent forwarding")
+		return false
+	}
+
+	s.logger.Info("Agent forwarded onward to the backend session")
+
+	s.enabled = true
+	s.bridge.acquire()
+
+	return true
+}
+
+// close ends the onward agent forwarding of the session
+func (s *agentSession) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+
+	if s.enabled {
+		s.enabled = false
+		s.bridge.release()
+	}
+}
+
+// requests answers the agent forwarding requests of the session, returning the
+// other requests until ctx is done. They enable onward forwarding if configured,
+// otherwise the gateway keeps the agent to itself and only acknowledges them.
+func (s *agentSession) requests(
+	ctx context.Context,
+	in <-chan *ssh.Request,
+) <-chan *ssh.Request {
+	out := make(chan *ssh.Request)
+
+	go func() {
+		defer close(out)
+
+		for req := range in {
+			if req.Type != agentRequestType {
+				select {
+				case out <- req:
+					continue
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			ok := s.bridge == nil || s.enable()
+			if req.WantReply {
+				_ = req.Reply(ok, nil)
+			}
+		}
+	}()
+
+	return out
+}
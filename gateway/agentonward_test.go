@@ -0,0 +1,165 @@
+package gateway_test
+
+import (
+	"bufio"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// onwardKeyring returns an agent holding the devbox key and another key, with
+// the fingerprints of both
+func onwardKeyring(t *testing.T, env *backendTestEnv) (agent.Agent, string, string) {
+	t.Helper()
+
+	keyring := agent.NewKeyring()
+
+	devboxKey, err := ssh.ParseRawPrivateKey(env.privBytes)
+	if err != nil {
+		t.Fatalf("Failed to parse private key: %v", err)
+	}
+
+	_, otherPub, _, otherPriv := generateTestKeys(t)
+
+	otherKey, err := ssh.ParseRawPrivateKey(otherPriv)
+	if err != nil {
+		t.Fatalf("Failed to parse private key: %v", err)
+	}
+
+	for _, key := range []any{devboxKey, otherKey} {
+		if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+			t.Fatalf("Failed to add key to keyring: %v", err)
+		}
+	}
+
+	signer, err := ssh.NewSignerFromKey(devboxKey)
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+
+	return keyring, ssh.FingerprintSHA256(signer.PublicKey()), ssh.FingerprintSHA256(otherPub)
+}
+
+// listBackendAgent lists the agent identities seen by a backend session
+func listBackendAgent(t *testing.T, client *ssh.Client) []string {
+	t.Helper()
+
+	output := runForcedSession(t, client, func(s *ssh.Session) error {
+		return agent.RequestAgentForwarding(s)
+	}, func(s *ssh.Session) error {
+		return s.Start("agent-list")
+	})
+
+	fingerprints := strings.Split(output, "\n")
+	slices.Sort(fingerprints)
+
+	return fingerprints
+}
+
+func TestAgentForwardOnward(t *testing.T) {
+	tests := []struct {
+		mode string
+		want func(devbox, other string) []string
+	}{
+		{
+			mode: gateway.AgentForwardOnwardOff,
+			want: func(_, _ string) []string { return []string{"no agent"} },
+		},
+		{
+			mode: gateway.AgentForwardOnwardFiltered,
+			want: func(devbox, _ string) []string { return []string{devbox} },
+		},
+		{
+			mode: gateway.AgentForwardOnwardAll,
+			want: func(devbox, other string) []string {
+				want := []string{devbox, other}
+				slices.Sort(want)
+
+				return want
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			env := newBackendTestEnv(t)
+			addr := env.start(t, gateway.WithAgentForwardOnward(tt.mode))
+
+			keyring, devbox, other := onwardKeyring(t, env)
+
+			client := dialWithAgent(t, addr, keyring)
+			defer client.Close()
+
+			want := tt.want(devbox, other)
+
+			// The first session connects the backend, later ones reuse the connection
+			for range 2 {
+				if got := listBackendAgent(t, client); !slices.Equal(got, want) {
+					t.Errorf("Backend agent identities = %v, want %v", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAgentForwardOnward_TornDownWithSessions(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t, gateway.WithAgentForwardOnward(gateway.AgentForwardOnwardAll))
+
+	keyring, _, _ := onwardKeyring(t, env)
+
+	client := dialWithAgent(t, addr, keyring)
+	defer client.Close()
+
+	// The forwarding session stays open until its stdin is closed
+	forwarding, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer forwarding.Close()
+
+	stdin, err := forwarding.StdinPipe()
+	if err != nil {
+		t.Fatalf("Failed to open stdin: %v", err)
+	}
+	defer stdin.Close()
+
+	if err := agent.RequestAgentForwarding(forwarding); err != nil {
+		t.Fatalf("Failed to request agent forwarding: %v", err)
+	}
+
+	if err := forwarding.Start("discard"); err != nil {
+		t.Fatalf("Failed to start forwarding session: %v", err)
+	}
+
+	holding, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer holding.Close()
+
+	stdout, err := holding.StdoutPipe()
+	if err != nil {
+		t.Fatalf("Failed to open stdout: %v", err)
+	}
+
+	if err := holding.Start("agent-hold"); err != nil {
+		t.Fatalf("Failed to start holding session: %v", err)
+	}
+
+	lines := bufio.NewScanner(stdout)
+	if !lines.Scan() || lines.Text() != "held" {
+		t.Fatalf("Backend agent channel not bridged: %q", lines.Text())
+	}
+
+	// Ending the last forwarding session tears down the bridged channel
+	forwarding.Close()
+
+	if !lines.Scan() || lines.Text() != "released" {
+		t.Fatalf("Backend agent channel not torn down: %q", lines.Text())
+	}
+}
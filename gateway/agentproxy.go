@@ -0,0 +1,221 @@
+package gateway
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// FilteringAgent proxies a client agent, exposing only the identities relevant
+// to the devbox and denying every operation that modifies the agent
+type FilteringAgent struct {
+	agent agent.ExtendedAgent
+	// SHA256 fingerprint -> struct{}
+	allowed map[string]struct{}
+
+	mu sync.Mutex
+	// lastSigned is the fingerprint of the identity that signed most recently
+	lastSigned string
+}
+
+var _ agent.ExtendedAgent = (*FilteringAgent)(nil)
+
+// NewFilteringAgent wraps upstream, exposing only identities with an allowed fingerprint
+func NewFilteringAgent(upstream agent.ExtendedAgent, fingerprints []string) *FilteringAgent {
+	allowed := make(map[string]struct{}, len(fingerprints))
+	for _, fp := range fingerprints {
+		if fp != "" {
+			allowed[fp] = struct{}{}
+		}
+	}
+
+	return &FilteringAgent{
+		agent:   upstream,
+		allowed: allowed,
+	}
+}
+
+// agentFingerprints returns the fingerprints of the client identities exposed to
+// the backend of a session: the key the client authenticated to the gateway with,
+// the devbox's registered key and the configured allowlist
+func (g *Gateway) agentFingerprints(ctx *sessionContext) []string {
+	fingerprints := make([]string, 0, 2+len(g.opts().AgentAllowedFingerprints))
+	fingerprints = append(fingerprints, ctx.keyFingerprint)
+
+	if ctx.info.PublicKey != nil {
+		fingerprints = append(fingerprints, ssh.FingerprintSHA256(ctx.info.PublicKey))
+	}
+
+	return append(fingerprints, g.opts().AgentAllowedFingerprints...)
+}
+
+func (a *FilteringAgent) isAllowed(key ssh.PublicKey) bool {
+	_, ok := a.allowed[ssh.FingerprintSHA256(key)]
+	return ok
+}
+
+// List returns the allowed identities of the upstream agent
+func (a *FilteringAgent) List() ([]*agent.Key, error) {
+	keys, err := a.agent.List()
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := make([]*agent.Key, 0, len(keys))
+	for _, key := range keys {
+		if a.isAllowed(key) {
+			filtered = append(filtered, key)
+		}
+	}
+
+	return filtered, nil
+}
+
+// Sign signs data with an allowed identity
+func (a *FilteringAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return a.SignWithFlags(key, data, 0)
+}
+
+// SignWithFlags signs data with an allowed identity
+func (a *FilteringAgent) SignWithFlags(
+	key ssh.PublicKey,
+	data []byte,
+	flags agent.SignatureFlags,
+) (*ssh.Signature, error) {
+	if !a.isAllowed(key) {
+		return nil, fmt.Errorf(
+			"%w: identity %s is not exposed",
+			ErrAgentOperationDenied,
+			ssh.FingerprintSHA256(key),
+		)
+	}
+
+	sig, err := a.agent.SignWithFlags(key, data, flags)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	a.lastSigned = ssh.FingerprintSHA256(key)
+	a.mu.Unlock()
+
+	return sig, nil
+}
+
+// Signers returns signers for the allowed identities
+func (a *FilteringAgent) Signers() ([]ssh.Signer, error) {
+	keys, err := a.List()
+	if err != nil {
+		return nil, err
+	}
+
+	signers := make([]ssh.Signer, 0, len(keys))
+	for _, key := range keys {
+		signers = append(signers, &agentProxySigner{agent: a, pub: key})
+	}
+
+	return signers, nil
+}
+
+// LastSigned returns the fingerprint of the identity that signed most recently
+func (a *FilteringAgent) LastSigned() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.lastSigned
+}
+
+// Add is denied
+func (a *FilteringAgent) Add(agent.AddedKey) error {
+	return ErrAgentOperationDenied
+}
+
+// Remove is denied
+func (a *FilteringAgent) Remove(ssh.PublicKey) error {
+	return ErrAgentOperationDenied
+}
+
+// RemoveAll is denied
+func (a *FilteringAgent) RemoveAll() error {
+	return ErrAgentOperationDenied
+}
+
+// Lock is denied
+func (a *FilteringAgent) Lock([]byte) error {
+	return ErrAgentOperationDenied
+}
+
+// Unlock is denied
+func (a *FilteringAgent) Unlock([]byte) error {
+	return ErrAgentOperationDenied
+}
+
+// Extension is denied
+func (a *FilteringAgent) Extension(string, []byte) ([]byte, error) {
+	return nil, agent.ErrExtensionUnsupported
+}
+
+// agentProxySigner signs through a FilteringAgent
+type agentProxySigner struct {
+	agent *FilteringAgent
+	pub   ssh.PublicKey
+}
+
+var _ ssh.AlgorithmSigner = (*agentProxySigner)(nil)
+
+func (s *agentProxySigner) PublicKey() ssh.PublicKey {
+	return s.pub
+}
+
+func (s *agentProxySigner) Sign(_ io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.agent.Sign(s.pub, data)
+}
+
+// certAlgorithms maps the algorithms of certificates to the signature
+// algorithms of their keys
+var certAlgorithms = map[string]string{
+	ssh.CertAlgoRSAv01:        ssh.KeyAlgoRSA,
+	ssh.CertAlgoRSASHA256v01:  ssh.KeyAlgoRSASHA256,
+	ssh.CertAlgoRSASHA512v01:  ssh.KeyAlgoRSASHA512,
+	ssh.CertAlgoECDSA256v01:   ssh.KeyAlgoECDSA256,
+	ssh.CertAlgoECDSA384v01:   ssh.KeyAlgoECDSA384,
+	ssh.CertAlgoECDSA521v01:   ssh.KeyAlgoECDSA521,
+	ssh.CertAlgoSKECDSA256v01: ssh.KeyAlgoSKECDSA256,
+	ssh.CertAlgoED25519v01:    ssh.KeyAlgoED25519,
+	ssh.CertAlgoSKED25519v01:  ssh.KeyAlgoSKED25519,
+}
+
+// underlyingAlgorithm returns the signature algorithm of algorithm, that of
+// the key of a certificate algorithm
+func underlyingAlgorithm(algorithm string) string {
+	if underlying, ok := certAlgorithms[algorithm]; ok {
+		return underlying
+	}
+
+	return algorithm
+}
+
+// SignWithAlgorithm signs data with the identity, certificate algorithms
+// being signed with the algorithm of the key of the certificate
+func (s *agentProxySigner) SignWithAlgorithm(
+	_ io.Reader,
+	data []byte,
+	algorithm string,
+) (*ssh.Signature, error) {
+	var flags agent.SignatureFlags
+
+	switch underlyingAlgorithm(algorithm) {
+	case "", underlyingAlgorithm(s.pub.Type()):
+	case ssh.KeyAlgoRSASHA256:
+		flags = agent.SignatureFlagRsaSha256
+	case ssh.KeyAlgoRSASHA512:
+		flags = agent.SignatureFlagRsaSha512
+	default:
+		return nil, fmt.Errorf("unsupported signature algorithm %s", algorithm)
+	}
+
+	return s.agent.SignWithFlags(s.pub, data, flags)
+}
@@ -0,0 +1,234 @@
+package gateway_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"testing"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// newTestKeyring returns an in-memory agent holding n ed25519 identities
+func newTestKeyring(t *testing.T, n int) (agent.ExtendedAgent, []ssh.PublicKey) {
+	t.Helper()
+
+	keyring, ok := agent.NewKeyring().(agent.ExtendedAgent)
+	if !ok {
+		t.Fatal("Keyring does not implement agent.ExtendedAgent")
+	}
+
+	pubs := make([]ssh.PublicKey, 0, n)
+
+	for range n {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatalf("Failed to generate key: %v", err)
+		}
+
+		if err := keyring.Add(agent.AddedKey{PrivateKey: priv}); err != nil {
+			t.Fatalf("Failed to add key to keyring: %v", err)
+		}
+
+		signer, err := ssh.NewSignerFromKey(priv)
+		if err != nil {
+			t.Fatalf("Failed to create signer: %v", err)
+		}
+
+		pubs = append(pubs, signer.PublicKey())
+	}
+
+	return keyring, pubs
+}
+
+func TestFilteringAgent_ExposesAllowedIdentities(t *testing.T) {
+	keyring, pubs := newTestKeyring(t, 3)
+
+	proxy := gateway.NewFilteringAgent(keyring, []string{
+		ssh.FingerprintSHA256(pubs[0]),
+		ssh.FingerprintSHA256(pubs[2]),
+	})
+
+	keys, err := proxy.List()
+	if err != nil {
+		t.Fatalf("List() failed: %v", err)
+	}
+
+	if len(keys) != 2 {
+		t.Fatalf("List() returned %d keys, want 2", len(keys))
+	}
+
+	for _, key := range keys {
+		if ssh.FingerprintSHA256(key) == ssh.FingerprintSHA256(pubs[1]) {
+			t.Error("List() exposed an identity outside the allowlist")
+		}
+	}
+
+	signers, err := proxy.Signers()
+	if err != nil {
+		t.Fatalf("Signers() failed: %v", err)
+	}
+
+	if len(signers) != 2 {
+		t.Fatalf("Signers() returned %d signers, want 2", len(signers))
+	}
+
+	data := []byte("session data")
+
+	sig, err := signers[1].Sign(rand.Reader, data)
+	if err != nil {
+		t.Fatalf("Sign() failed: %v", err)
+	}
+
+	if err := signers[1].PublicKey().Verify(data, sig); err != nil {
+		t.Errorf("Signature does not verify: %v", err)
+	}
+
+	if got, want := proxy.LastSigned(), ssh.FingerprintSHA256(signers[1].PublicKey()); got != want {
+		t.Errorf("LastSigned() = %s, want %s", got, want)
+	}
+}
+
+func TestFilteringAgent_DeniesHiddenIdentityAndMutations(t *testing.T) {
+	keyring, pubs := newTestKeyring(t, 2)
+	proxy := gateway.NewFilteringAgent(keyring, []string{ssh.FingerprintSHA256(pubs[0])})
+
+	_, err := proxy.Sign(pubs[1], []byte("data"))
+	if !errors.Is(err, gateway.ErrAgentOperationDenied) {
+		t.Errorf("Sign() with hidden identity error = %v, want %v",
+			err, gateway.ErrAgentOperationDenied)
+	}
+
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+
+	mutations := map[string]func() error{
+		"Add":       func() error { return proxy.Add(agent.AddedKey{PrivateKey: priv}) },
+		"Remove":    func() error { return proxy.Remove(pubs[0]) },
+		"RemoveAll": proxy.RemoveAll,
+		"Lock":      func() error { return proxy.Lock([]byte("passphrase")) },
+		"Unlock":    func() error { return proxy.Unlock([]byte("passphrase")) },
+	}
+
+	for name, mutate := range mutations {
+		if err := mutate(); !errors.Is(err, gateway.ErrAgentOperationDenied) {
+			t.Errorf("%s() error = %v, want %v", name, err, gateway.ErrAgentOperationDenied)
+		}
+	}
+
+	// The upstream agent is left untouched
+	keys, err := keyring.List()
+	if err != nil {
+		t.Fatalf("List() failed: %v", err)
+	}
+
+	if len(keys) != 2 {
+		t.Errorf("Upstream agent holds %d keys, want 2", len(keys))
+	}
+}
+
+func TestFilteringAgent_SignsWithCertificates(t *testing.T) {
+	_, caPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate CA key: %v", err)
+	}
+
+	ca, err := ssh.NewSignerFromKey(caPriv)
+	if err != nil {
+		t.Fatalf("Failed to create CA signer: %v", err)
+	}
+
+	_, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	rsaPriv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		key        any
+		algorithm  string
+		wantFormat string
+	}{
+		{
+			name:       "Ed25519",
+			key:        edPriv,
+			algorithm:  ssh.CertAlgoED25519v01,
+			wantFormat: ssh.KeyAlgoED25519,
+		},
+		{
+			name:       "RSASHA512",
+			key:        rsaPriv,
+			algorithm:  ssh.CertAlgoRSASHA512v01,
+			wantFormat: ssh.KeyAlgoRSASHA512,
+		},
+		{
+			name:       "RSASHA256",
+			key:        rsaPriv,
+			algorithm:  ssh.CertAlgoRSASHA256v01,
+			wantFormat: ssh.KeyAlgoRSASHA256,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer, err := ssh.NewSignerFromKey(tt.key)
+			if err != nil {
+				t.Fatalf("Failed to create signer: %v", err)
+			}
+
+			cert := &ssh.Certificate{
+				Key:             signer.PublicKey(),
+				CertType:        ssh.UserCert,
+				ValidPrincipals: []string{"testuser"},
+				ValidBefore:     ssh.CertTimeInfinity,
+			}
+			if err := cert.SignCert(rand.Reader, ca); err != nil {
+				t.Fatalf("Failed to sign certificate: %v", err)
+			}
+
+			keyring, ok := agent.NewKeyring().(agent.ExtendedAgent)
+			if !ok {
+				t.Fatal("Keyring does not implement agent.ExtendedAgent")
+			}
+
+			err = keyring.Add(agent.AddedKey{PrivateKey: tt.key, Certificate: cert})
+			if err != nil {
+				t.Fatalf("Failed to add certificate to keyring: %v", err)
+			}
+
+			proxy := gateway.NewFilteringAgent(keyring, []string{ssh.FingerprintSHA256(cert)})
+
+			signers, err := proxy.Signers()
+			if err != nil || len(signers) != 1 {
+				t.Fatalf("Signers() = %d signers, %v, want the certificate", len(signers), err)
+			}
+
+			algorithmSigner, ok := signers[0].(ssh.AlgorithmSigner)
+			if !ok {
+				t.Fatal("Signer does not implement ssh.AlgorithmSigner")
+			}
+
+			data := []byte("session data")
+
+			sig, err := algorithmSigner.SignWithAlgorithm(rand.Reader, data, tt.algorithm)
+			if err != nil {
+				t.Fatalf("SignWithAlgorithm(%s) failed: %v", tt.algorithm, err)
+			}
+
+			if sig.Format != tt.wantFormat {
+				t.Errorf("Signature format = %s, want %s", sig.Format, tt.wantFormat)
+			}
+
+			if err := cert.Key.Verify(data, sig); err != nil {
+				t.Errorf("Signature does not verify: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,326 @@
+package gateway
+
+import (
+	"maps"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+)
+
+// Audit record events, the value of the "event" field
+const (
+	AuditEventConnection      = "connection"
+	AuditEventChannel         = "channel"
+	AuditEventHandshakeFailed = "handshake_failed"
+)
+
+// Termination reasons of audited connections, the value of the "reason" field
+const (
+	// AuditReasonClosed is a connection closed by the client or the backend
+	AuditReasonClosed            = "closed"
+	AuditReasonHandshakeFailed   = "handshake_failed"
+	AuditReasonDevboxNotFound    = "devbox_not_found"
+	AuditReasonDevboxNotRunning  = "devbox_not_running"
+	AuditReasonDevboxStarting    = "devbox_starting"
+	AuditReasonDevboxUnreachable = "devbox_unreachable"
+	AuditReasonBackendFailed     = "backend_failed"
+	// AuditReasonRevoked is a connection terminated after its devbox key was revoked
+	AuditReasonRevoked = "revoked"
+	// AuditReasonKeyRevoked is a connection terminated after the fingerprint of
+	// its key was added to the revocation list
+	AuditReasonKeyRevoked = "key_revoked"
+	// AuditReasonPodRestarted is a connection terminated after the pod of its
+	// devbox restarted or was deleted
+	AuditReasonPodRestarted = "pod_restarted"
+)
+
+// connAudit collects the audit record of a connection while it is served.
+// A nil connAudit records nothing.
+//
+// Every record is a JSON object with these stable fields, absent values are
+// written as empty strings or zeros:
+//
+//	event         connection, channel or handshake_failed
+//	conn_id       connection ID, shared with the operational log
+//	start, end    RFC 3339 timestamps of the connection or channel
+//	remote_addr   client address
+//	listener      listener the connection was accepted on
+//	user          SSH username claimed by the client
+//	claimed_user  user the client asked to log into the devbox as
+//	backend_user  user logging into the devbox, claimed_user unless mapped to
+//	              another, see DefaultBackendUser and BackendUserMap
+//	fingerprint   SHA256 fingerprint of the accepted key, or of the last offered one
+//	key_source    primary or authorized_keys for the keys of the devbox, whether the
+//	              controller issued it or users added it, empty otherwise
+//	key_comment   comment of the authorized_keys line of user added keys
+//	auth_mode     public-key, custom-key, no-auth, admin or token, empty if not
+//	              authenticated
+//	auth_factors  comma-separated factors satisfied, publickey or token and
+//	              otp, even by connections failing a later factor
+//	auth_failure  failure reason of the last refused authentication attempt, one
+//	              of the AuthFailure constants
+//	token_subject subject of the authentication token, once its signature was
+//	              verified, the token itself is never recorded
+//	namespace     namespace of the devbox
+//	devbox        name of the devbox
+//	backend_addr  last backend address dialed
+//	bytes_in      bytes sent by the client
+//	bytes_out     bytes sent to the client
+//	reason        termination reason, one of the AuditReason constants
+//
+// Connection records also carry channels, the number of channels opened by the
+// client keyed by channel type. Channel records also carry session_id and
+// channel_type, and their reason is always closed.
+type connAudit struct {
+	logger *log.Logger
+	fields log.Fields
+	start  time.Time
+
+	mu          sync.Mutex
+	backendAddr string
+	reason      string
+	channels    map[string]int
+	traffic     *trafficCounter
+	sessions    bool
+}
+
+// newConnAudit returns the audit record of an authenticated connection, nil if
+// audit records are disabled
+func (g *Gateway) newConnAudit(
+	conn *ssh.ServerConn,
+	connID, listener string,
+	start time.Time,
+) *connAudit {
+	if g.opts().AuditLogger == nil {
+		return nil
+	}
+
+	return &connAudit{
+		logger: g.opts().AuditLogger,
+		fields: log.Fields{
+			"conn_id":       connID,
+			"remote_addr":   remoteAddr(conn.RemoteAddr()),
+			"listener":      listener,
+			"user":          redactUser(conn.User()),
+			"claimed_user":  permissionsExtension(conn.Permissions, "claimed_user"),
+			"backend_user":  permissionsExtension(conn.Permissions, "backend_user"),
+			"fingerprint":   permissionsFingerprint(conn.Permissions),
+			"key_source":    permissionsExtension(conn.Permissions, "key_source"),
+			"key_comment":   permissionsExtension(conn.Permissions, "key_comment"),
+			"auth_mode":     g.determineAuthMode(conn).String(),
+			"auth_factors":  permissionsFactors(conn.Permissions),
+			"auth_failure":  "",
+			"token_subject": permissionsExtension(conn.Permissions, "token_subject"),
+			"namespace":     "",
+			"devbox":        "",
+		},
+		start:    start,
+		channels: make(map[string]int),
+		sessions: g.opts().AuditLogSessions,
+	}
+}
+
+// auditHandshakeFailure writes the audit record of a connection that failed
+// to authenticate
+func (g *Gateway) auditHandshakeFailure(
+	nConn net.Conn,
+	connID, listener string,
+	start time.Time,
+	state *authState,
+) {
+	if g.opts().AuditLogger == nil {
+		return
+	}
+
+	g.opts().AuditLogger.WithTime(time.Now()).WithFields(log.Fields{
+		"event":         AuditEventHandshakeFailed,
+		"conn_id":       connID,
+		"start":         start,
+		"end":           time.Now(),
+		"remote_addr":   remoteAddr(nConn.RemoteAddr()),
+		"listener":      listener,
+		"user":          state.user,
+		"claimed_user":  "",
+		"backend_user":  "",
+		"fingerprint":   state.lastKeyFingerprint,
+		"key_source":    "",
+		"key_comment":   "",
+		"auth_mode":     "",
+		"auth_factors":  strings.Join(state.factors, ","),
+		"auth_failure":  state.lastFailure,
+		"token_subject": state.tokenSubject,
+		"namespace":     "",
+		"devbox":        "",
+		"backend_addr":  "",
+		"bytes_in":      0,
+		"bytes_out":     0,
+		"channels":      map[string]int{},
+		"reason":        AuditReasonHandshakeFailed,
+	}).Info("SSH handshake failed")
+}
+
+// setDevbox records the devbox of the connection
+func (a *connAudit) setDevbox(info *registry.DevboxInfo) {
+	if a == nil {
+		return
+	}
+
+	a.fields["namespace"] = info.Namespace
+	a.fields["devbox"] = info.DevboxName
+}
+
+// setTraffic records the traffic counter of the connection
+func (a *connAudit) setTraffic(traffic *trafficCounter) {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.traffic = traffic
+}
+
+// setBackendAddr records the backend address last dialed for the connection
+func (a *connAudit) setBackendAddr(addr string) {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.backendAddr = addr
+}
+
+// setReason records why the connection ends, the first reason wins
+func (a *connAudit) setReason(reason string) {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.reason == "" {
+		a.reason = reason
+	}
+}
+
+// countChannels counts the channels opened by the client by type
+func (a *connAudit) countChannels(in <-chan ssh.NewChannel) <-chan ssh.NewChannel {
+	if a == nil {
+		return in
+	}
+
+	out := make(chan ssh.NewChannel)
+
+	go func() {
+		defer close(out)
+
+		for newChannel := range in {
+			a.mu.Lock()
+			a.channels[newChannel.ChannelType()]++
+			a.mu.Unlock()
+
+			out <- newChannel
+		}
+	}()
+
+	return out
+}
+
+// trafficFields returns the byte counts of a traffic counter, which may be nil
+func trafficFields(traffic *trafficCounter) log.Fields {
+	var stats TrafficStats
+	if traffic != nil {
+		stats = traffic.stats()
+	}
+
+	return log.Fields{"bytes_in": stats.BytesIn, "bytes_out": stats.BytesOut}
+}
+
+// auditChannel writes the audit record of a channel when per channel records
+// are enabled
+func (a *connAudit) auditChannel(cio *connIO, channelType string) {
+	if a == nil || !a.sessions {
+		return
+	}
+
+	a.mu.Lock()
+	backendAddr := a.backendAddr
+	a.mu.Unlock()
+
+	end := time.Now()
+
+	a.logger.WithTime(end).
+		WithFields(a.fields).
+		WithFields(trafficFields(cio.traffic)).
+		WithFields(log.Fields{
+			"event":        AuditEventChannel,
+			"session_id":   cio.id,
+			"channel_type": channelType,
+			"start":        cio.start,
+			"end":          end,
+			"backend_addr": backendAddr,
+			"reason":       AuditReasonClosed,
+		}).Info("Channel closed")
+}
+
+// close writes the audit record of the connection
+func (a *connAudit) close() {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	reason := a.reason
+	if reason == "" {
+		reason = AuditReasonClosed
+	}
+
+	end := time.Now()
+
+	a.logger.WithTime(end).
+		WithFields(a.fields).
+		WithFields(trafficFields(a.traffic)).
+		WithFields(log.Fields{
+			"event":        AuditEventConnection,
+			"start":        a.start,
+			"end":          end,
+			"backend_addr": a.backendAddr,
+			"channels":     maps.Clone(a.channels),
+			"reason":       reason,
+		}).Info("Connection closed")
+}
+
+// permissionsExtension returns an extension of the permissions of a connection,
+// empty when unset
+func permissionsExtension(perms *ssh.Permissions, name string) string {
+	if perms == nil {
+		return ""
+	}
+
+	return perms.Extensions[name]
+}
+
+// permissionsFingerprint returns the fingerprint of the key a connection was
+// accepted with, empty if it authenticated without a key
+func permissionsFingerprint(perms *ssh.Permissions) string {
+	if perms == nil {
+		return ""
+	}
+
+	if fingerprint := perms.Extensions["key_fingerprint"]; fingerprint != "" {
+		return fingerprint
+	}
+
+	return perms.Extensions["admin_key_fingerprint"]
+}
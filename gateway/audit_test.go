@@ -0,0 +1,182 @@
+package gateway_test
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"github.com/zijiren233/sshgate/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+// auditFields are the fields of every audit record, besides those of logrus
+var auditFields = []string{
+	"event", "conn_id", "start", "end", "remote_addr", "listener", "user",
+	"claimed_user", "backend_user", "fingerprint", "key_source", "key_comment",
+	"auth_mode", "auth_factors", "auth_failure", "token_subject", "namespace",
+	"devbox", "backend_addr", "bytes_in", "bytes_out", "reason",
+}
+
+// newAuditLog returns an audit logger writing to a file and the path of the file
+func newAuditLog(t *testing.T) (gateway.Option, string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	auditLogger, err := logger.NewAuditLogger(path)
+	if err != nil {
+		t.Fatalf("NewAuditLogger() error = %v", err)
+	}
+
+	return gateway.WithAuditLogger(auditLogger, true), path
+}
+
+// waitForAudit waits for an audit record of the given event and returns it
+func waitForAudit(t *testing.T, path, event string) map[string]any {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		data, _ := os.ReadFile(path)
+
+		for line := range strings.Lines(string(data)) {
+			var record map[string]any
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				t.Fatalf("Invalid audit record %q: %v", line, err)
+			}
+
+			if record["event"] == event {
+				return record
+			}
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("No %s audit record in %q", event, data)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// checkAuditSchema checks a record has exactly the audit fields, the extra
+// fields of its event and those of logrus
+func checkAuditSchema(t *testing.T, record map[string]any, extra ...string) {
+	t.Helper()
+
+	want := slices.Concat(auditFields, extra, []string{"time", "level", "msg"})
+	slices.Sort(want)
+
+	got := make([]string, 0, len(record))
+	for key := range record {
+		got = append(got, key)
+	}
+
+	slices.Sort(got)
+
+	if !slices.Equal(got, want) {
+		t.Errorf("Audit record fields = %v, want %v", got, want)
+	}
+
+	for _, key := range []string{"start", "end"} {
+		if _, err := time.Parse(time.RFC3339Nano, record[key].(string)); err != nil {
+			t.Errorf("Field %s = %v, want an RFC 3339 timestamp", key, record[key])
+		}
+	}
+}
+
+func TestAudit_PublicKeyMode(t *testing.T) {
+	env := newBackendTestEnv(t)
+	opt, path := newAuditLog(t)
+	addr := env.start(t, opt)
+
+	client := dialPublicKeyMode(t, addr, env)
+	runEchoSession(t, client, false, "data")
+	client.Close()
+
+	record := waitForAudit(t, path, gateway.AuditEventConnection)
+	checkAuditSchema(t, record, "channels")
+
+	backendAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(env.backendPort))
+	if record["auth_mode"] != "public-key" || record["user"] != "testuser" ||
+		record["claimed_user"] != "testuser" || record["backend_user"] != "testuser" ||
+		record["namespace"] != "ns-test" || record["devbox"] != "test-devbox" ||
+		record["backend_addr"] != backendAddr || record["fingerprint"] == "" ||
+		record["reason"] != gateway.AuditReasonClosed {
+		t.Errorf("Connection record = %v", record)
+	}
+
+	if record["bytes_in"].(float64) != 4 || record["bytes_out"].(float64) != 4 {
+		t.Errorf("Bytes in %v and out %v, want 4", record["bytes_in"], record["bytes_out"])
+	}
+
+	if channels := record["channels"].(map[string]any); channels["session"] != float64(1) {
+		t.Errorf("Channels = %v, want one session", channels)
+	}
+
+	channel := waitForAudit(t, path, gateway.AuditEventChannel)
+	checkAuditSchema(t, channel, "session_id", "channel_type")
+
+	if channel["channel_type"] != "session" ||
+		!strings.HasPrefix(channel["session_id"].(string), record["conn_id"].(string)) {
+		t.Errorf("Channel record = %v", channel)
+	}
+}
+
+func TestAudit_AgentForwardMode(t *testing.T) {
+	env := newBackendTestEnv(t)
+	opt, path := newAuditLog(t)
+	addr := env.start(t, opt)
+
+	client := dialAgentForwardMode(t, addr, env)
+	runAgentForwardSession(t, client)
+	client.Close()
+
+	record := waitForAudit(t, path, gateway.AuditEventConnection)
+	checkAuditSchema(t, record, "channels")
+
+	if record["auth_mode"] != "custom-key" || record["user"] != "testuser@test-test-devbox" ||
+		record["devbox"] != "test-devbox" || record["backend_addr"] == "" ||
+		record["reason"] != gateway.AuditReasonClosed {
+		t.Errorf("Connection record = %v", record)
+	}
+
+	if channels := record["channels"].(map[string]any); channels["session"] != float64(1) {
+		t.Errorf("Channels = %v, want one session", channels)
+	}
+}
+
+func TestAudit_HandshakeFailed(t *testing.T) {
+	env := newBackendTestEnv(t)
+	opt, path := newAuditLog(t)
+	addr := env.start(t, opt)
+
+	signer, _, _, _ := generateTestKeys(t)
+
+	_, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User: "testuser",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		//nolint:gosec // acceptable for testing
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err == nil {
+		t.Fatal("Unknown key authenticated")
+	}
+
+	record := waitForAudit(t, path, gateway.AuditEventHandshakeFailed)
+	checkAuditSchema(t, record, "channels")
+
+	if record["user"] != "testuser" ||
+		record["fingerprint"] != ssh.FingerprintSHA256(signer.PublicKey()) ||
+		record["auth_mode"] != "" || record["reason"] != gateway.AuditReasonHandshakeFailed {
+		t.Errorf("Handshake failure record = %v", record)
+	}
+}
@@ -1,7 +1,10 @@
 package gateway
 
 import (
+	"cmp"
 	"errors"
+	"fmt"
+	"slices"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/zijiren233/sshgate/registry"
@@ -16,6 +19,8 @@ const (
 	AuthModePublicKey          // Public key authentication mode
 	AuthModeCustomKey          // Custom key authentication mode (user-defined public keys)
 	AuthModeNoAuth             // No client authentication mode
+	AuthModeAdmin              // Admin key authentication mode (operator access to any devbox)
+	AuthModeToken              // Token authentication mode (JWT selecting the devbox)
 )
 
 func (m AuthMode) String() string {
@@ -26,54 +31,141 @@ func (m AuthMode) String() string {
 		return "custom-key"
 	case AuthModeNoAuth:
 		return "no-auth"
+	case AuthModeAdmin:
+		return "admin"
+	case AuthModeToken:
+		return "token"
 	default:
 		return "unknown"
 	}
 }
 
-// publicKeyCallback handles public key authentication
+// PublicKeyCallback handles public key authentication
 func (g *Gateway) PublicKeyCallback(
 	conn ssh.ConnMetadata,
 	key ssh.PublicKey,
 ) (*ssh.Permissions, error) {
-	username := conn.User()
+	return g.publicKeyCallback(conn, key, g.logger)
+}
 
+// publicKeyCallback authenticates a public key, logging with the connection logger
+func (g *Gateway) publicKeyCallback(
+	conn ssh.ConnMetadata,
+	key ssh.PublicKey,
+	logger *log.Entry,
+) (*ssh.Permissions, error) {
 	// Create auth logger with base fields
-	authLogger := g.logger.WithFields(log.Fields{
+	authLogger := logger.WithFields(log.Fields{
 		"auth_type":   "public_key",
-		"remote_addr": conn.RemoteAddr().String(),
-		"user":        username,
+		"remote_addr": remoteAddr(conn.RemoteAddr()),
+		"user":        redactUser(conn.User()),
 	})
 
-	authLogger.Info("authentication attempt")
+	authLogger.Debug("authentication attempt")
+
+	// Revoked keys are rejected whatever else would accept them
+	if fingerprint, ok := g.revokedFingerprint(key); ok {
+		authLogger.WithField("fingerprint", fingerprint).Warn("authentication with revoked key")
+		return nil, fmt.Errorf("%w: %s", ErrKeyRevoked, fingerprint)
+	}
+
+	perms, err := g.authenticatePublicKey(conn, key, authLogger)
+	if err != nil {
+		return nil, err
+	}
+
+	// The devbox may only be reachable from some networks
+	if info, err := g.getDevboxInfoFromPermissions(perms); err == nil {
+		if err := g.allowSourceAddress(conn, info, authLogger); err != nil {
+			return nil, err
+		}
+	}
+
+	return perms, nil
+}
+
+// authenticatePublicKey selects the devbox a public key gives access to
+func (g *Gateway) authenticatePublicKey(
+	conn ssh.ConnMetadata,
+	key ssh.PublicKey,
+	authLogger *log.Entry,
+) (*ssh.Permissions, error) {
+	username := conn.User()
+
+	// Certificates signed by a trusted user CA never fall back to custom key mode
+	if cert, ok := g.isTrustedUserCertificate(key); ok {
+		return g.authenticateCertificate(conn, cert, authLogger)
+	}
+
+	// Admin keys skip the registry lookup and select the devbox by username
+	if g.isAdminKey(key) {
+		return g.authenticateAdmin(conn, key, authLogger)
+	}
 
 	// Look up devbox by public key
 	info, ok := g.registry.GetByPublicKey(key)
 	if !ok {
-		// Parse username: username@short_user_namespace-devboxname
-		username, fullNamespace, devboxName, err := g.parser.Parse(conn.User())
-		if err != nil {
+		// Parse username: username@namespace/devboxname or one of its other forms
+		parsed, err := g.parser.Resolve(conn.User())
+		if err != nil && !errors.Is(err, ErrDevboxNotFound) {
+			// A plain username means the client only offered a key we don't know
+			if !g.parser.SelectsDevbox(conn.User()) {
+				return nil, fmt.Errorf("%w: %s", ErrUnknownKey, ssh.FingerprintSHA256(key))
+			}
+
 			return nil, err
 		}
 
+		username, fullNamespace, devboxName := parsed.Username, parsed.Namespace, parsed.DevboxName
+
+		// Keys users added to several devboxes select one with the username
+		if info, ok := g.registry.GetDevboxInfo(fullNamespace, devboxName); ok {
+			if source, _ := info.KeySource(key); source != "" {
+				backendUser, err := g.backendUser(info, parsed.Login(), false)
+				if err != nil {
+					return nil, err
+				}
+
+				perms := g.registeredKeyPermissions(
+					key, info, username, parsed.Login(), backendUser, authLogger,
+				)
+
+				return perms, nil
+			}
+		}
+
+		// Keys the devbox does not know are only served by agent forwarding mode
+		if g.opts().agentForwardingModeDisabled() {
+			return nil, ErrAgentForwardingDisabled
+		}
+
 		// Update logger with devbox info for custom key mode
 		customKeyLogger := authLogger.WithFields(log.Fields{
-			"auth_mode": AuthModeCustomKey.String(),
-			"namespace": fullNamespace,
-			"devbox":    devboxName,
+			"auth_mode":     AuthModeCustomKey.String(),
+			"namespace":     fullNamespace,
+			"devbox":        devboxName,
+			"username_form": parsed.Form,
 		})
 
 		info, ok := g.registry.GetDevboxInfo(fullNamespace, devboxName)
 		if !ok {
-			return nil, errors.New("devbox not found")
+			return nil, fmt.Errorf("%w: %s/%s", ErrDevboxNotFound, fullNamespace, devboxName)
 		}
 
-		customKeyLogger.Info("authentication accept")
+		backendUser, err := g.backendUser(info, parsed.Login(), false)
+		if err != nil {
+			return nil, err
+		}
+
+		customKeyLogger.WithField("backend_user", backendUser).Info("authentication accept")
 
 		return &ssh.Permissions{
 			Extensions: map[string]string{
-				"username":  username,
-				"auth_mode": AuthModeCustomKey.String(),
+				"username":        username,
+				"claimed_user":    parsed.Login(),
+				"backend_user":    backendUser,
+				"auth_mode":       AuthModeCustomKey.String(),
+				"key_fingerprint": ssh.FingerprintSHA256(key),
 			},
 			ExtraData: map[any]any{
 				"devbox_info": info,
@@ -82,24 +174,72 @@ func (g *Gateway) PublicKeyCallback(
 		}, nil
 	}
 
+	// The devbox is selected by the key, the username may only pick the backend user
+	login, username, err := g.parser.SplitBackendUser(username)
+	if err != nil {
+		return nil, err
+	}
+
+	claimedUser := cmp.Or(login, username)
+
+	backendUser, err := g.backendUser(info, claimedUser, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return g.registeredKeyPermissions(
+		key, info, username, claimedUser, backendUser, authLogger,
+	), nil
+}
+
+// registeredKeyPermissions returns the permissions of a client authenticated by
+// one of the keys of a devbox, its primary key or one added by users
+func (g *Gateway) registeredKeyPermissions(
+	key ssh.PublicKey,
+	info *registry.DevboxInfo,
+	username, claimedUser, backendUser string,
+	authLogger *log.Entry,
+) *ssh.Permissions {
+	source, comment := info.KeySource(key)
+
 	// Update logger with matched devbox info
 	pkLogger := authLogger.WithFields(log.Fields{
-		"namespace": info.Namespace,
-		"devbox":    info.DevboxName,
+		"namespace":  info.Namespace,
+		"devbox":     info.DevboxName,
+		"key_source": string(source),
 	})
 
-	authLogger.Info("authentication accept")
+	pkLogger.WithFields(log.Fields{
+		"backend_user": backendUser,
+		"key_comment":  comment,
+	}).Info("authentication accept")
 
 	return &ssh.Permissions{
 		Extensions: map[string]string{
-			"username":  username,
-			"auth_mode": AuthModePublicKey.String(),
+			"username":        username,
+			"claimed_user":    claimedUser,
+			"backend_user":    backendUser,
+			"auth_mode":       g.registeredKeyAuthMode().String(),
+			"key_fingerprint": ssh.FingerprintSHA256(key),
+			"key_source":      string(source),
+			"key_comment":     comment,
 		},
 		ExtraData: map[any]any{
 			"devbox_info": info,
 			"logger":      pkLogger,
 		},
-	}, nil
+	}
+}
+
+// registeredKeyAuthMode returns the mode of sessions authenticated by a key the
+// gateway trusts. With public key mode disabled they go through agent forwarding,
+// since the gateway holds no devbox private keys.
+func (g *Gateway) registeredKeyAuthMode() AuthMode {
+	if g.opts().DisablePublicKeyMode {
+		return AuthModeCustomKey
+	}
+
+	return AuthModePublicKey
 }
 
 // NoClientAuthCallback handles no client authentication
@@ -110,36 +250,51 @@ func (g *Gateway) NoClientAuthCallback(conn ssh.ConnMetadata) (*ssh.Permissions,
 	// Create auth logger with base fields
 	authLogger := g.logger.WithFields(log.Fields{
 		"auth_type":   "no_auth",
-		"remote_addr": conn.RemoteAddr().String(),
+		"remote_addr": remoteAddr(conn.RemoteAddr()),
 		"user":        username,
 	})
 
-	authLogger.Info("authentication attempt")
+	authLogger.Debug("authentication attempt")
 
-	// Parse username: username@short_user_namespace-devboxname
-	parsedUsername, fullNamespace, devboxName, err := g.parser.Parse(username)
-	if err != nil {
+	// Parse username: username@namespace/devboxname or one of its other forms
+	parsed, err := g.parser.Resolve(username)
+	if err != nil && !errors.Is(err, ErrDevboxNotFound) {
 		return nil, err
 	}
 
+	parsedUsername := parsed.Username
+	fullNamespace, devboxName := parsed.Namespace, parsed.DevboxName
+
+	if g.opts().agentForwardingModeDisabled() {
+		return nil, ErrAgentForwardingDisabled
+	}
+
 	// Update logger with devbox info
 	noAuthLogger := authLogger.WithFields(log.Fields{
-		"namespace": fullNamespace,
-		"devbox":    devboxName,
+		"namespace":     fullNamespace,
+		"devbox":        devboxName,
+		"username_form": parsed.Form,
 	})
 
-	noAuthLogger.Info("authentication accept")
-
 	// Get devbox info
 	info, ok := g.registry.GetDevboxInfo(fullNamespace, devboxName)
 	if !ok {
-		return nil, errors.New("devbox not found")
+		return nil, fmt.Errorf("%w: %s/%s", ErrDevboxNotFound, fullNamespace, devboxName)
+	}
+
+	backendUser, err := g.backendUser(info, parsed.Login(), false)
+	if err != nil {
+		return nil, err
 	}
 
+	noAuthLogger.WithField("backend_user", backendUser).Info("authentication accept")
+
 	return &ssh.Permissions{
 		Extensions: map[string]string{
-			"username":  parsedUsername,
-			"auth_mode": AuthModeNoAuth.String(),
+			"username":     parsedUsername,
+			"claimed_user": parsed.Login(),
+			"backend_user": backendUser,
+			"auth_mode":    AuthModeNoAuth.String(),
 		},
 		ExtraData: map[any]any{
 			"devbox_info": info,
@@ -158,11 +313,17 @@ func (g *Gateway) determineAuthMode(conn *ssh.ServerConn) AuthMode {
 	switch authMode {
 	case AuthModePublicKey.String():
 		return AuthModePublicKey
-	case AuthModeNoAuth.String():
+	case AuthModeAdmin.String():
+		return AuthModeAdmin
+	case AuthModeToken.String():
+		return AuthModeToken
+	}
+
+	if authMode == AuthModeNoAuth.String() {
 		return AuthModeNoAuth
-	default:
-		return AuthModeCustomKey
 	}
+
+	return AuthModeCustomKey
 }
 
 func (g *Gateway) getDevboxInfoFromPermissions(
@@ -205,15 +366,41 @@ func GetUsernameFromPermissions(perms *ssh.Permissions) (string, error) {
 	return username, nil
 }
 
+// backendUserFromPermissions returns the user logging into the backend, the
+// username unless the client picked another backend user
+func backendUserFromPermissions(perms *ssh.Permissions) string {
+	return cmp.Or(perms.Extensions["backend_user"], perms.Extensions["username"])
+}
+
+// allowBackendUser checks the devbox allows logging in as the backend user
+func allowBackendUser(info *registry.DevboxInfo, user string) error {
+	if len(info.BackendUsers) == 0 || slices.Contains(info.BackendUsers, user) {
+		return nil
+	}
+
+	return fmt.Errorf(
+		"%w: %s on %s/%s",
+		ErrBackendUserDenied,
+		user,
+		info.Namespace,
+		info.DevboxName,
+	)
+}
+
 // NewPublicKeyCallback creates a public key callback for testing
 func NewPublicKeyCallback(
-	reg *registry.Registry,
+	reg DevboxResolver,
 ) func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
 	gw := &Gateway{
-		registry: reg,
-		parser:   &UsernameParser{},
-		logger:   log.WithField("component", "gateway"),
+		registry:     reg,
+		parser:       newUsernameParser(reg),
+		authCounters: newAuthCounters(),
+		userCAKeys:   map[string]struct{}{},
+		adminKeys:    map[string]struct{}{},
+		logger:       log.WithField("component", "gateway"),
 	}
 
+	gw.options.Store(&Options{EnableAgentForward: true})
+
 	return gw.PublicKeyCallback
 }
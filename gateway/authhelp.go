@@ -0,0 +1,52 @@
+package gateway
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultAuthHelpMessage is shown through keyboard-interactive authentication
+// after public key authentication has been refused
+const DefaultAuthHelpMessage = "Public key authentication was refused " +
+	"for devbox {namespace}/{devbox}.\n" +
+	"Register your public key with the devbox, " +
+	"or connect with agent forwarding:\n" +
+	"  ssh -A <user>@<namespace>/<devbox>@<gateway>\n"
+
+// keyboardInteractiveHelp is a keyboard-interactive callback that never grants
+// access. After a public key attempt on the same connection has been refused
+// it presents a single informational prompt explaining how to get access.
+// It refuses silently before any public key attempt, so clients preferring
+// keyboard-interactive fall through to public key authentication.
+func (g *Gateway) keyboardInteractiveHelp(
+	conn ssh.ConnMetadata,
+	client ssh.KeyboardInteractiveChallenge,
+	state *authState,
+) (*ssh.Permissions, error) {
+	if !state.publicKeyAttempted || state.authHelpShown {
+		return nil, ErrAuthHelpOnly
+	}
+
+	state.authHelpShown = true
+
+	// No questions are asked, the client only displays the instruction
+	_, _ = client("", g.authHelpMessage(conn.User()), nil, nil)
+
+	return nil, ErrAuthHelpOnly
+}
+
+// authHelpMessage renders the help message for the claimed username
+func (g *Gateway) authHelpMessage(user string) string {
+	template := g.opts().AuthHelpMessage
+	if template == "" {
+		template = DefaultAuthHelpMessage
+	}
+
+	username, namespace, devboxName, err := g.parser.Parse(user)
+	if err != nil && !errors.Is(err, ErrDevboxNotFound) {
+		return renderBanner(template, user, "<namespace>", "<devbox>")
+	}
+
+	return renderBanner(template, username, namespace, devboxName)
+}
@@ -0,0 +1,145 @@
+package gateway_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"golang.org/x/crypto/ssh"
+)
+
+// recordingChallenge records the instructions presented through keyboard-interactive
+type recordingChallenge struct {
+	instructions []string
+}
+
+func (r *recordingChallenge) challenge(
+	_, instruction string,
+	questions []string,
+	_ []bool,
+) ([]string, error) {
+	r.instructions = append(r.instructions, instruction)
+	return make([]string, len(questions)), nil
+}
+
+func TestKeyboardInteractiveHelp_AfterPublicKey(t *testing.T) {
+	env := newBackendTestEnv(t)
+	unknownSigner, _, _, _ := generateTestKeys(t)
+	gw := gateway.New(env.hostKey, env.reg)
+
+	var rec recordingChallenge
+
+	_, err := dialGateway(t, gw, &ssh.ClientConfig{
+		User: "dev@team-missing",
+		Auth: []ssh.AuthMethod{
+			ssh.PublicKeys(unknownSigner),
+			ssh.KeyboardInteractive(rec.challenge),
+		},
+	})
+	if err == nil {
+		t.Fatal("Expected handshake to fail")
+	}
+
+	if len(rec.instructions) != 1 {
+		t.Fatalf("Expected a single help prompt, got %d", len(rec.instructions))
+	}
+
+	if !strings.Contains(rec.instructions[0], "devbox ns-team/missing") {
+		t.Errorf("Expected help to name the devbox, got: %q", rec.instructions[0])
+	}
+
+	stats := gw.AuthStats()
+	if got := stats.Failures[gateway.AuthFailureOther]; got != 0 {
+		t.Errorf("Failures[%s] = %d, want 0", gateway.AuthFailureOther, got)
+	}
+}
+
+func TestKeyboardInteractiveHelp_SilentBeforePublicKey(t *testing.T) {
+	env := newBackendTestEnv(t)
+	unknownSigner, _, _, _ := generateTestKeys(t)
+	gw := gateway.New(env.hostKey, env.reg)
+
+	knownSigner, err := ssh.ParsePrivateKey(env.privBytes)
+	if err != nil {
+		t.Fatalf("Failed to parse private key: %v", err)
+	}
+
+	// Only keyboard-interactive is offered, no help may be shown
+	var rec recordingChallenge
+
+	_, err = dialGateway(t, gw, &ssh.ClientConfig{
+		User: "testuser",
+		Auth: []ssh.AuthMethod{ssh.KeyboardInteractive(rec.challenge)},
+	})
+	if err == nil {
+		t.Fatal("Expected handshake to fail")
+	}
+
+	if len(rec.instructions) != 0 {
+		t.Errorf("Expected no help prompt, got: %q", rec.instructions)
+	}
+
+	// Clients preferring keyboard-interactive still reach public key authentication
+	client, err := dialGateway(t, gw, &ssh.ClientConfig{
+		User: "testuser",
+		Auth: []ssh.AuthMethod{
+			ssh.KeyboardInteractive(rec.challenge),
+			ssh.PublicKeys(unknownSigner, knownSigner),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Expected handshake to succeed, got: %v", err)
+	}
+	defer client.Close()
+}
+
+func TestKeyboardInteractiveHelp_Configurable(t *testing.T) {
+	env := newBackendTestEnv(t)
+	unknownSigner, _, _, _ := generateTestKeys(t)
+
+	tests := []struct {
+		name    string
+		enable  bool
+		message string
+		want    string
+	}{
+		{
+			name:    "custom message",
+			enable:  true,
+			message: "ask {user} about {devbox}",
+			want:    "ask dev about missing\r\n",
+		},
+		{name: "disabled", enable: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gw := gateway.New(env.hostKey, env.reg, gateway.WithAuthHelp(tt.enable, tt.message))
+
+			var rec recordingChallenge
+
+			_, err := dialGateway(t, gw, &ssh.ClientConfig{
+				User: "dev@team-missing",
+				Auth: []ssh.AuthMethod{
+					ssh.PublicKeys(unknownSigner),
+					ssh.KeyboardInteractive(rec.challenge),
+				},
+			})
+			if err == nil {
+				t.Fatal("Expected handshake to fail")
+			}
+
+			if tt.want == "" {
+				if len(rec.instructions) != 0 {
+					t.Errorf("Expected no help prompt, got: %q", rec.instructions)
+				}
+
+				return
+			}
+
+			if len(rec.instructions) != 1 || rec.instructions[0] != tt.want {
+				t.Errorf("instructions = %q, want [%q]", rec.instructions, tt.want)
+			}
+		})
+	}
+}
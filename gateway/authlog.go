@@ -0,0 +1,347 @@
+package gateway
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// Authentication failure reasons
+const (
+	AuthFailureUnknownKey        = "unknown_key"
+	AuthFailureRevokedKey        = "revoked_key"
+	AuthFailureDevboxNotFound    = "devbox_not_found"
+	AuthFailureDevboxNotRunning  = "devbox_not_running"
+	AuthFailureDevboxStarting    = "devbox_starting"
+	AuthFailureDevboxUnreachable = "devbox_unreachable"
+	AuthFailureBadUsername       = "bad_username"
+	AuthFailureBadCertificate    = "bad_certificate"
+	AuthFailureAdminDenied       = "admin_denied"
+	AuthFailureModeDisabled      = "mode_disabled"
+	AuthFailureBackendUserDenied = "backend_user_denied"
+	AuthFailureSourceNotAllowed  = "source_not_allowed"
+	AuthFailureBadOTP            = "bad_otp"
+	AuthFailureOTPRateLimited    = "otp_rate_limited"
+	AuthFailureOTPNotEnrolled    = "otp_not_enrolled"
+	AuthFailureBadToken          = "bad_token"
+	AuthFailureTokenExpired      = "token_expired"
+	AuthFailureTokenKeys         = "token_keys_unavailable"
+	AuthFailureOther             = "other"
+)
+
+var authFailureReasons = []string{
+	AuthFailureUnknownKey,
+	AuthFailureRevokedKey,
+	AuthFailureDevboxNotFound,
+	AuthFailureDevboxNotRunning,
+	AuthFailureDevboxStarting,
+	AuthFailureDevboxUnreachable,
+	AuthFailureBadUsername,
+	AuthFailureBadCertificate,
+	AuthFailureAdminDenied,
+	AuthFailureModeDisabled,
+	AuthFailureBackendUserDenied,
+	AuthFailureSourceNotAllowed,
+	AuthFailureBadOTP,
+	AuthFailureOTPRateLimited,
+	AuthFailureOTPNotEnrolled,
+	AuthFailureBadToken,
+	AuthFailureTokenExpired,
+	AuthFailureTokenKeys,
+	AuthFailureOther,
+}
+
+// AuthStats is a snapshot of the authentication counters
+type AuthStats struct {
+	Successes uint64
+	// Failures is keyed by failure reason
+	Failures map[string]uint64
+}
+
+// authCounters holds the authentication counters of a gateway
+type authCounters struct {
+	successes atomic.Uint64
+	failures  map[string]*atomic.Uint64
+}
+
+func newAuthCounters() *authCounters {
+	c := &authCounters{
+		failures: make(map[string]*atomic.Uint64, len(authFailureReasons)),
+	}
+	for _, reason := range authFailureReasons {
+		c.failures[reason] = &atomic.Uint64{}
+	}
+
+	return c
+}
+
+func (c *authCounters) recordFailure(reason string) {
+	counter, ok := c.failures[reason]
+	if !ok {
+		counter = c.failures[AuthFailureOther]
+	}
+
+	counter.Add(1)
+}
+
+func (c *authCounters) snapshot() AuthStats {
+	stats := AuthStats{
+		Successes: c.successes.Load(),
+		Failures:  make(map[string]uint64, len(c.failures)),
+	}
+	for reason, counter := range c.failures {
+		stats.Failures[reason] = counter.Load()
+	}
+
+	return stats
+}
+
+// authFailureReason classifies an authentication error into a failure reason
+func authFailureReason(err error) string {
+	switch {
+	case errors.Is(err, ErrUnknownKey):
+		return AuthFailureUnknownKey
+	case errors.Is(err, ErrKeyRevoked):
+		return AuthFailureRevokedKey
+	case errors.Is(err, ErrDevboxNotFound):
+		return AuthFailureDevboxNotFound
+	case errors.Is(err, ErrDevboxNotRunning):
+		return AuthFailureDevboxNotRunning
+	case errors.Is(err, ErrDevboxStarting):
+		return AuthFailureDevboxStarting
+	case errors.Is(err, ErrInvalidUsername):
+		return AuthFailureBadUsername
+	case errors.Is(err, ErrInvalidCertificate):
+		return AuthFailureBadCertificate
+	case errors.Is(err, ErrAdminAccessDenied):
+		return AuthFailureAdminDenied
+	case errors.Is(err, ErrAgentForwardingDisabled):
+		return AuthFailureModeDisabled
+	case errors.Is(err, ErrBackendUserDenied):
+		return AuthFailureBackendUserDenied
+	case errors.Is(err, ErrSourceNotAllowed):
+		return AuthFailureSourceNotAllowed
+	case errors.Is(err, ErrInvalidOTP):
+		return AuthFailureBadOTP
+	case errors.Is(err, ErrOTPRateLimited):
+		return AuthFailureOTPRateLimited
+	case errors.Is(err, ErrOTPNotEnrolled):
+		return AuthFailureOTPNotEnrolled
+	case errors.Is(err, ErrInvalidToken):
+		return AuthFailureBadToken
+	case errors.Is(err, ErrTokenExpired):
+		return AuthFailureTokenExpired
+	case errors.Is(err, ErrTokenKeysUnavailable):
+		return AuthFailureTokenKeys
+	default:
+		return AuthFailureOther
+	}
+}
+
+// authState tracks authentication progress of a single client connection
+type authState struct {
+	// logger carries the fields identifying the connection, like its ID and listener
+	logger *log.Entry
+	// user is the username claimed by the client
+	user string
+	// lastKeyFingerprint is the fingerprint of the most recently offered public key
+	lastKeyFingerprint string
+	// lastCertificate is the most recently offered user certificate, if any
+	lastCertificate *ssh.Certificate
+	// publicKeyAttempted reports whether the client offered any public key
+	publicKeyAttempted bool
+	// authHelpShown reports whether the keyboard-interactive help was presented
+	authHelpShown bool
+	// factors are the authentication factors satisfied so far when more than
+	// one is required
+	factors []string
+	// tokenSubject is the subject of the last authentication token whose
+	// signature was verified
+	tokenSubject string
+	// lastFailure is the failure reason of the last refused attempt
+	lastFailure string
+}
+
+// connConfig returns a per-connection copy of the server config whose callbacks
+// share the given authentication state
+func (g *Gateway) connConfig(state *authState) *ssh.ServerConfig {
+	config := *g.Config()
+
+	config.PublicKeyCallback = func(
+		conn ssh.ConnMetadata,
+		key ssh.PublicKey,
+	) (*ssh.Permissions, error) {
+		state.lastKeyFingerprint = ssh.FingerprintSHA256(key)
+		state.lastCertificate, _ = key.(*ssh.Certificate)
+		state.publicKeyAttempted = true
+
+		start := time.Now()
+
+		perms, err := g.publicKeyCallback(conn, key, state.logger)
+		if err != nil {
+			return nil, g.clientAuthError(err, start)
+		}
+
+		if g.requiresOTP(perms) {
+			return nil, g.otpChallenge(perms, state, AuthFactorPublicKey)
+		}
+
+		return perms, nil
+	}
+
+	if g.tokenVerifier != nil {
+		config.PasswordCallback = func(
+			conn ssh.ConnMetadata,
+			password []byte,
+		) (*ssh.Permissions, error) {
+			start := time.Now()
+
+			perms, err := g.tokenCallback(conn, password, state)
+			if err != nil {
+				return nil, g.clientAuthError(err, start)
+			}
+
+			if g.requiresOTP(perms) {
+				return nil, g.otpChallenge(perms, state, AuthFactorToken)
+			}
+
+			return perms, nil
+		}
+
+		// Usernames carrying a token authenticate without any method, the
+		// others go on to the methods above
+		config.NoClientAuth = true
+		config.NoClientAuthCallback = func(conn ssh.ConnMetadata) (*ssh.Permissions, error) {
+			if !hasTokenUsername(conn.User()) {
+				return nil, ErrNoTokenUsername
+			}
+
+			start := time.Now()
+
+			perms, err := g.tokenCallback(conn, nil, state)
+			if err != nil {
+				return nil, g.clientAuthError(err, start)
+			}
+
+			if g.requiresOTP(perms) {
+				return nil, g.otpChallenge(perms, state, AuthFactorToken)
+			}
+
+			return perms, nil
+		}
+	}
+
+	if g.opts().AuthHelpEnabled {
+		config.KeyboardInteractiveCallback = func(
+			conn ssh.ConnMetadata,
+			client ssh.KeyboardInteractiveChallenge,
+		) (*ssh.Permissions, error) {
+			return g.keyboardInteractiveHelp(conn, client, state)
+		}
+	}
+
+	config.AuthLogCallback = func(conn ssh.ConnMetadata, method string, err error) {
+		state.user = redactUser(conn.User())
+		g.logAuthAttempt(conn, method, err, state)
+	}
+
+	return &config
+}
+
+// clientAuthError returns a refused authentication attempt as the client sees
+// it. The error keeps its reason for logs and audit records, but clients are
+// only told about it with VerboseAuthErrors: otherwise unknown keys, usernames
+// and devboxes are refused alike. The refusal is padded to
+// AuthFailureMinDuration so that its timing does not tell them apart either.
+func (g *Gateway) clientAuthError(err error, start time.Time) error {
+	if wait := g.opts().AuthFailureMinDuration - time.Since(start); wait > 0 {
+		time.Sleep(wait)
+	}
+
+	if !g.opts().VerboseAuthErrors {
+		return err
+	}
+
+	return &ssh.BannerError{Err: err, Message: err.Error() + "\n"}
+}
+
+// logAuthAttempt emits a structured record for an authentication attempt
+// and updates the authentication counters. Only key fingerprints are logged,
+// never raw key material.
+func (g *Gateway) logAuthAttempt(
+	conn ssh.ConnMetadata,
+	method string,
+	err error,
+	state *authState,
+) {
+	fields := log.Fields{
+		"remote_addr": remoteAddr(conn.RemoteAddr()),
+		"user":        redactUser(conn.User()),
+		"method":      method,
+	}
+
+	if method == "publickey" && state.lastKeyFingerprint != "" {
+		fields["fingerprint"] = state.lastKeyFingerprint
+		if cert := state.lastCertificate; cert != nil {
+			fields["cert_key_id"] = cert.KeyId
+			fields["cert_serial"] = cert.Serial
+		}
+	}
+
+	if (method == "password" || method == "none") && state.tokenSubject != "" {
+		fields["token_subject"] = state.tokenSubject
+	}
+
+	authLogger := state.logger.WithFields(fields)
+
+	// The initial "none" attempt only probes the supported methods, unless the
+	// username carries a token
+	if method == "none" && (g.tokenVerifier == nil || !hasTokenUsername(conn.User())) {
+		authLogger.Debug("authentication method probe")
+		return
+	}
+
+	// The keyboard-interactive help never grants access, it is not a real attempt
+	if errors.Is(err, ErrAuthHelpOnly) {
+		authLogger.Debug("authentication help requested")
+		return
+	}
+
+	// The first factor passed, the next one is asked for
+	var partialSuccess *ssh.PartialSuccessError
+	if errors.As(err, &partialSuccess) {
+		authLogger.Info("authentication partially succeeded")
+		return
+	}
+
+	if err == nil {
+		g.authCounters.successes.Add(1)
+
+		if len(state.factors) > 0 {
+			authLogger = authLogger.WithField("auth_factors", strings.Join(state.factors, ","))
+		}
+
+		authLogger.Info("authentication succeeded")
+
+		return
+	}
+
+	reason := authFailureReason(err)
+	state.lastFailure = reason
+	g.authCounters.recordFailure(reason)
+	authLogger.WithField("reason", reason).WithError(err).Info("authentication failed")
+}
+
+// AuthLogCallback logs an authentication attempt without per-connection state
+func (g *Gateway) AuthLogCallback(conn ssh.ConnMetadata, method string, err error) {
+	g.logAuthAttempt(conn, method, err, &authState{logger: g.logger})
+}
+
+// AuthStats returns a snapshot of the authentication counters
+func (g *Gateway) AuthStats() AuthStats {
+	return g.authCounters.snapshot()
+}
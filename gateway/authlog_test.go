@@ -0,0 +1,239 @@
+package gateway_test
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"golang.org/x/crypto/ssh"
+)
+
+// dialGateway performs an SSH handshake against gw over a loopback connection
+func dialGateway(
+	t *testing.T,
+	gw *gateway.Gateway,
+	config *ssh.ClientConfig,
+) (*ssh.Client, error) {
+	t.Helper()
+
+	var lc net.ListenConfig
+
+	listener, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start gateway listener: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		gw.HandleConnection(conn)
+	}()
+
+	var d net.Dialer
+
+	clientConn, err := d.DialContext(context.Background(), "tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial gateway: %v", err)
+	}
+
+	if config.HostKeyCallback == nil {
+		//nolint:gosec // acceptable for testing
+		config.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	}
+
+	if config.Timeout == 0 {
+		config.Timeout = 5 * time.Second
+	}
+
+	conn, chans, reqs, err := ssh.NewClientConn(clientConn, "pipe", config)
+	if err != nil {
+		clientConn.Close()
+		return nil, err
+	}
+
+	return ssh.NewClient(conn, chans, reqs), nil
+}
+
+func TestAuthLogCallback_CountsAcceptedAndRejectedKeys(t *testing.T) {
+	env := newBackendTestEnv(t)
+
+	unknownSigner, _, _, _ := generateTestKeys(t)
+
+	knownSigner, err := ssh.ParsePrivateKey(env.privBytes)
+	if err != nil {
+		t.Fatalf("Failed to parse private key: %v", err)
+	}
+
+	gw := gateway.New(env.hostKey, env.reg)
+
+	client, err := dialGateway(t, gw, &ssh.ClientConfig{
+		User: "testuser",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(unknownSigner, knownSigner)},
+	})
+	if err != nil {
+		t.Fatalf("Expected handshake to succeed with the known key, got: %v", err)
+	}
+	defer client.Close()
+
+	stats := gw.AuthStats()
+	if stats.Successes != 1 {
+		t.Errorf("Successes = %d, want 1", stats.Successes)
+	}
+
+	if got := stats.Failures[gateway.AuthFailureUnknownKey]; got != 1 {
+		t.Errorf("Failures[%s] = %d, want 1", gateway.AuthFailureUnknownKey, got)
+	}
+}
+
+func TestAuthLogCallback_FailureReasons(t *testing.T) {
+	env := newBackendTestEnv(t)
+	unknownSigner, _, _, _ := generateTestKeys(t)
+
+	tests := []struct {
+		user   string
+		reason string
+	}{
+		{user: "testuser", reason: gateway.AuthFailureUnknownKey},
+		{user: "testuser@", reason: gateway.AuthFailureBadUsername},
+		{user: "testuser@missing-devbox", reason: gateway.AuthFailureDevboxNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.reason, func(t *testing.T) {
+			gw := gateway.New(env.hostKey, env.reg)
+
+			_, err := dialGateway(t, gw, &ssh.ClientConfig{
+				User: tt.user,
+				Auth: []ssh.AuthMethod{ssh.PublicKeys(unknownSigner)},
+			})
+			if err == nil {
+				t.Fatal("Expected handshake to fail")
+			}
+
+			stats := gw.AuthStats()
+			if got := stats.Failures[tt.reason]; got != 1 {
+				t.Errorf("Failures[%s] = %d, want 1 (all: %v)", tt.reason, got, stats.Failures)
+			}
+
+			if stats.Successes != 0 {
+				t.Errorf("Successes = %d, want 0", stats.Successes)
+			}
+		})
+	}
+}
+
+func TestMaxAuthTries(t *testing.T) {
+	env := newBackendTestEnv(t)
+
+	signers := make([]ssh.Signer, 0, 3)
+	for range 3 {
+		signer, _, _, _ := generateTestKeys(t)
+		signers = append(signers, signer)
+	}
+
+	gw := gateway.New(env.hostKey, env.reg, gateway.WithMaxAuthTries(2))
+
+	_, err := dialGateway(t, gw, &ssh.ClientConfig{
+		User: "testuser",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+	})
+	if err == nil {
+		t.Fatal("Expected handshake to fail")
+	}
+
+	if got := gw.AuthStats().Failures[gateway.AuthFailureUnknownKey]; got != 2 {
+		t.Errorf("Failures[%s] = %d, want 2", gateway.AuthFailureUnknownKey, got)
+	}
+}
+
+// refusedAuth dials gw as user with a key unknown to it, returning the
+// banners the client was shown and the handshake error
+func refusedAuth(t *testing.T, gw *gateway.Gateway, user string) ([]string, error) {
+	t.Helper()
+
+	signer, _, _, _ := generateTestKeys(t)
+
+	var banners []string
+
+	_, err := dialGateway(t, gw, &ssh.ClientConfig{
+		User: user,
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		BannerCallback: func(message string) error {
+			banners = append(banners, message)
+			return nil
+		},
+	})
+	if err == nil {
+		t.Fatalf("Handshake as %s succeeded, want it refused", user)
+	}
+
+	return banners, err
+}
+
+func TestClientAuthError_Uniform(t *testing.T) {
+	env := newBackendTestEnv(t)
+	gw := gateway.New(env.hostKey, env.reg)
+
+	// Unknown key, invalid username and unknown devbox
+	users := []string{"testuser", "testuser@", "testuser@ns-test/missing-devbox"}
+
+	var want string
+
+	for _, user := range users {
+		banners, err := refusedAuth(t, gw, user)
+
+		if len(banners) > 0 {
+			t.Errorf("Banners as %s = %q, want none", user, banners)
+		}
+
+		if want == "" {
+			want = err.Error()
+		} else if err.Error() != want {
+			t.Errorf("Error as %s = %q, want %q", user, err, want)
+		}
+	}
+
+	// The reasons are still told apart server side
+	failures := gw.AuthStats().Failures
+	for _, reason := range []string{
+		gateway.AuthFailureUnknownKey,
+		gateway.AuthFailureBadUsername,
+		gateway.AuthFailureDevboxNotFound,
+	} {
+		if failures[reason] != 1 {
+			t.Errorf("Failures[%s] = %d, want 1", reason, failures[reason])
+		}
+	}
+}
+
+func TestClientAuthError_Verbose(t *testing.T) {
+	env := newBackendTestEnv(t)
+	gw := gateway.New(env.hostKey, env.reg, gateway.WithVerboseAuthErrors(true))
+
+	banners, _ := refusedAuth(t, gw, "testuser@ns-test/missing-devbox")
+
+	if len(banners) != 1 || !strings.Contains(banners[0], "devbox not found") {
+		t.Errorf("Banners = %q, want the devbox not found reason", banners)
+	}
+}
+
+func TestClientAuthError_MinDuration(t *testing.T) {
+	env := newBackendTestEnv(t)
+	gw := gateway.New(env.hostKey, env.reg,
+		gateway.WithAuthFailureMinDuration(200*time.Millisecond))
+
+	start := time.Now()
+
+	refusedAuth(t, gw, "testuser")
+
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("Refused handshake took %s, want at least 200ms", elapsed)
+	}
+}
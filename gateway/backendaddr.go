@@ -0,0 +1,69 @@
+package gateway
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zijiren233/sshgate/registry"
+)
+
+// backendDNSTimeout bounds the resolution of a backend DNS name
+const backendDNSTimeout = 5 * time.Second
+
+// Backend addressing modes recorded in access logs
+const (
+	addressingPodIP         = string(registry.BackendAddressingPodIP)
+	addressingDNS           = string(registry.BackendAddressingDNS)
+	addressingPodIPFallback = "pod-ip-fallback"
+)
+
+// backendSSHPort returns the port of the SSH server of a devbox: the target
+// port of its endpoint in EndpointSlice discovery, else the Devbox custom
+// resource may override the gateway default
+func (g *Gateway) backendSSHPort(info *registry.DevboxInfo) int {
+	if info.BackendPort > 0 {
+		return info.BackendPort
+	}
+
+	if info.SSHPort > 0 {
+		return info.SSHPort
+	}
+
+	return g.opts().SSHBackendPort
+}
+
+// backendAddr returns the address of the SSH server of a devbox on port and the
+// addressing mode used. DNS names are resolved up front so that a resolution
+// failure falls back to the pod IP, except in remote clusters dialed through a
+// proxy, which resolves them within its cluster.
+func (g *Gateway) backendAddr(
+	ctx context.Context,
+	info *registry.DevboxInfo,
+	port int,
+	logger *log.Entry,
+) (addr, addressing string) {
+	if info.Addressing != registry.BackendAddressingDNS || info.BackendHost == "" {
+		return net.JoinHostPort(info.PodIP, strconv.Itoa(port)), addressingPodIP
+	}
+
+	if _, ok := g.clusterProxy(withBackendCluster(ctx, info.Cluster)); ok {
+		return net.JoinHostPort(info.BackendHost, strconv.Itoa(port)), addressingDNS
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, backendDNSTimeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, info.BackendHost)
+	if err == nil && len(addrs) > 0 {
+		return net.JoinHostPort(addrs[0], strconv.Itoa(port)), addressingDNS
+	}
+
+	logger.WithField("backend_host", info.BackendHost).
+		WithError(err).
+		Warn("Failed to resolve backend host, falling back to pod IP")
+
+	return net.JoinHostPort(info.PodIP, strconv.Itoa(port)), addressingPodIPFallback
+}
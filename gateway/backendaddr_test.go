@@ -0,0 +1,147 @@
+package gateway_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"github.com/zijiren233/sshgate/registry"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// setBackendHost annotates the test devbox pod to be addressed by host
+func setBackendHost(t *testing.T, reg *registry.Registry, podIP, host string) {
+	t.Helper()
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pod",
+			Namespace: "ns-test",
+			Annotations: map[string]string{
+				registry.BackendHostAnnotation: host,
+			},
+			Labels: map[string]string{
+				registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: registry.DevboxOwnerKind, Name: "test-devbox"},
+			},
+		},
+		Status: corev1.PodStatus{PodIP: podIP},
+	}
+	if err := reg.UpdatePod(pod); err != nil {
+		t.Fatalf("Failed to update pod: %v", err)
+	}
+}
+
+func TestBackendAddressing_DNS(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t)
+
+	// Nothing listens on the pod IP, the backend is only reachable by its host
+	setBackendHost(t, env.reg, "127.0.0.2", "127.0.0.1")
+
+	runPublicKeySession(t, addr, env, "testuser")
+
+	client := dialAgentForwardMode(t, addr, env)
+	defer client.Close()
+
+	runAgentForwardSession(t, client)
+}
+
+func TestBackendAddressing_FallsBackToPodIP(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t)
+
+	setBackendHost(t, env.reg, "127.0.0.1", "devbox.invalid")
+
+	runPublicKeySession(t, addr, env, "testuser")
+}
+
+func TestBackendAddressing_IPv6PodIP(t *testing.T) {
+	env := newBackendTestEnv(t)
+
+	var lc net.ListenConfig
+
+	ln, err := lc.Listen(context.Background(), "tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+
+	t.Cleanup(func() { ln.Close() })
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	env.backendListener = &trackingListener{Listener: ln}
+	env.backendPort = mustAtoi(t, port)
+
+	addr := env.start(t)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pod",
+			Namespace: "ns-test",
+			Labels: map[string]string{
+				registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: registry.DevboxOwnerKind, Name: "test-devbox"},
+			},
+		},
+		Status: corev1.PodStatus{
+			PodIP:  "::1",
+			PodIPs: []corev1.PodIP{{IP: "::1"}},
+		},
+	}
+	if err := env.reg.UpdatePod(pod); err != nil {
+		t.Fatalf("Failed to update pod: %v", err)
+	}
+
+	runPublicKeySession(t, addr, env, "testuser")
+
+	client := dialAgentForwardMode(t, addr, env)
+	defer client.Close()
+
+	runAgentForwardSession(t, client)
+}
+
+func TestBackendAddressing_EndpointSlice(t *testing.T) {
+	env := newBackendTestEnv(t)
+
+	// Devboxes have no pods in EndpointSlice discovery
+	env.reg.DeletePod(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pod",
+			Namespace: "ns-test",
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: registry.DevboxOwnerKind, Name: "test-devbox"},
+			},
+		},
+	})
+
+	port := int32(env.backendPort)
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-devbox-abcde",
+			Namespace: "ns-test",
+			Labels: map[string]string{
+				registry.DevboxPartOfLabel:   registry.DevboxPartOfValue,
+				discoveryv1.LabelServiceName: "test-devbox",
+			},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Endpoints:   []discoveryv1.Endpoint{{Addresses: []string{"127.0.0.1"}}},
+		Ports:       []discoveryv1.EndpointPort{{Port: &port}},
+	}
+	if err := env.reg.UpdateEndpointSlice(slice); err != nil {
+		t.Fatalf("Failed to update endpoint slice: %v", err)
+	}
+
+	// Nothing listens on the default port, the backend is only reachable on
+	// the target port of its endpoint
+	addr := env.start(t, gateway.WithSSHBackendPort(1))
+
+	runPublicKeySession(t, addr, env, "testuser")
+}
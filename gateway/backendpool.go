@@ -0,0 +1,336 @@
+package gateway
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+)
+
+// backendProbeTimeout bounds the keepalive checking that a pooled backend
+// connection is still alive before reusing it
+const backendProbeTimeout = 2 * time.Second
+
+// BackendPoolStats is a snapshot of the backend connection pool counters
+type BackendPoolStats struct {
+	Hits   uint64
+	Misses uint64
+	// Evictions counts idle connections closed because they expired, overflowed
+	// the idle limit or belonged to a devbox whose pod changed
+	Evictions uint64
+	Idle      int
+}
+
+// backendPoolKey identifies backend connections that may be shared.
+// Connections authenticated as different backend users are never mixed.
+type backendPoolKey struct {
+	namespace  string
+	devboxName string
+	user       string
+}
+
+// pooledBackend is an idle backend connection
+type pooledBackend struct {
+	client *ssh.Client
+	podIP  string
+	expiry *time.Timer
+}
+
+// backendPool keeps idle public key mode backend connections per devbox and backend user
+type backendPool struct {
+	maxIdle int
+	idleTTL time.Duration
+
+	mu   sync.Mutex
+	idle map[backendPoolKey][]*pooledBackend
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+}
+
+func newBackendPool(maxIdle int, idleTTL time.Duration) *backendPool {
+	return &backendPool{
+		maxIdle: maxIdle,
+		idleTTL: idleTTL,
+		idle:    make(map[backendPoolKey][]*pooledBackend),
+	}
+}
+
+// get takes an idle connection to podIP out of the pool, it returns nil on a miss
+func (p *backendPool) get(key backendPoolKey, podIP string) *ssh.Client {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entries := p.idle[key]
+	for len(entries) > 0 {
+		entry := entries[len(entries)-1]
+		entries = entries[:len(entries)-1]
+
+		// Whoever takes an entry out of the idle list evicts it,
+		// a pending expiry finds nothing left to remove
+		if !entry.expiry.Stop() || entry.podIP != podIP {
+			p.evict(entry)
+			continue
+		}
+
+		p.setIdle(key, entries)
+		p.hits.Add(1)
+
+		return entry.client
+	}
+
+	p.setIdle(key, entries)
+	p.misses.Add(1)
+
+	return nil
+}
+
+// put returns a connection to the pool, closing it if the idle limit is reached
+func (p *backendPool) put(key backendPoolKey, podIP string, client *ssh.Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.idle[key]) >= p.maxIdle {
+		p.evictions.Add(1)
+
+		go client.Close()
+
+		return
+	}
+
+	entry := &pooledBackend{client: client, podIP: podIP}
+	entry.expiry = time.AfterFunc(p.idleTTL, func() { p.remove(key, entry) })
+
+	p.idle[key] = append(p.idle[key], entry)
+}
+
+// watch removes client from the pool once the backend drops it
+func (p *backendPool) watch(key backendPoolKey, client *ssh.Client) {
+	go func() {
+		_ = client.Wait()
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		for _, entry := range p.idle[key] {
+			if entry.client == client {
+				p.removeLocked(key, entry)
+				return
+			}
+		}
+	}()
+}
+
+// remove evicts an idle entry
+func (p *backendPool) remove(key backendPoolKey, entry *pooledBackend) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.removeLocked(key, entry)
+}
+
+func (p *backendPool) removeLocked(key backendPoolKey, entry *pooledBackend) {
+	entries := p.idle[key]
+	for i, e := range entries {
+		if e == entry {
+			p.setIdle(key, append(entries[:i:i], entries[i+1:]...))
+			p.evict(entry)
+
+			return
+		}
+	}
+}
+
+// invalidate evicts every idle connection to the given devbox
+func (p *backendPool) invalidate(namespace, devboxName string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for key, entries := range p.idle {
+		if key.namespace != namespace || key.devboxName != devboxName {
+			continue
+		}
+
+		for _, entry := range entries {
+			p.evict(entry)
+		}
+
+		delete(p.idle, key)
+	}
+}
+
+// handleRegistryEvent invalidates pooled connections to devboxes whose pod or
+// key changed, connections authenticated with a replaced key are not reused
+func (p *backendPool) handleRegistryEvent(event registry.Event) {
+	switch event.Type {
+	case registry.EventPodIPChanged, registry.EventPodDeleted, registry.EventSecretDeleted,
+		registry.EventPublicKeyChanged:
+		p.invalidate(event.Namespace, event.DevboxName)
+	}
+}
+
+func (p *backendPool) setIdle(key backendPoolKey, entries []*pooledBackend) {
+	if len(entries) == 0 {
+		delete(p.idle, key)
+		return
+	}
+
+	p.idle[key] = entries
+}
+
+func (p *backendPool) evict(entry *pooledBackend) {
+	entry.expiry.Stop()
+	p.evictions.Add(1)
+
+	go entry.client.Close()
+}
+
+func (p *backendPool) stats() BackendPoolStats {
+	p.mu.Lock()
+
+	idle := 0
+	for _, entries := range p.idle {
+		idle += len(entries)
+	}
+
+	p.mu.Unlock()
+
+	return BackendPoolStats{
+		Hits:      p.hits.Load(),
+		Misses:    p.misses.Load(),
+		Evictions: p.evictions.Load(),
+		Idle:      idle,
+	}
+}
+
+// backendLease tracks the use of a backend connection by one client connection
+type backendLease struct {
+	client *ssh.Client
+	wg     sync.WaitGroup
+
+	mu       sync.Mutex
+	channels map[ssh.Channel]struct{}
+
+	// dirty is set once state outliving channels, like remote port forwards,
+	// was created on the backend connection. Dirty connections are never reused.
+	dirty atomic.Bool
+}
+
+func newBackendLease(client *ssh.Client) *backendLease {
+	return &backendLease{
+		client:   client,
+		channels: make(map[ssh.Channel]struct{}),
+	}
+}
+
+func (l *backendLease) track(channel ssh.Channel) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.channels[channel] = struct{}{}
+}
+
+func (l *backendLease) untrack(channel ssh.Channel) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.channels, channel)
+}
+
+// closeChannels closes the backend channels still open for the client connection
+func (l *backendLease) closeChannels() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for channel := range l.channels {
+		_ = channel.Close()
+	}
+}
+
+// markGlobalRequest records a global request forwarded on the backend connection
+func (l *backendLease) markGlobalRequest(requestType string) {
+	if !strings.HasPrefix(requestType, "keepalive@") {
+		l.dirty.Store(true)
+	}
+}
+
+// acquireBackend returns a pooled backend connection to podIP, or dials a new one
+func (g *Gateway) acquireBackend(
+	key backendPoolKey,
+	podIP string,
+	dial func() (*ssh.Client, error),
+) (*ssh.Client, error) {
+	if g.backendPool != nil {
+		if client := g.backendPool.get(key, podIP); client != nil {
+			// The backend may have dropped the idle connection without us noticing yet
+			if probeBackend(client) {
+				return client, nil
+			}
+
+			_ = client.Close()
+		}
+	}
+
+	client, err := dial()
+	if err != nil {
+		return nil, err
+	}
+
+	if g.backendPool != nil {
+		g.backendPool.watch(key, client)
+	}
+
+	return client, nil
+}
+
+// probeBackend reports whether a pooled backend connection answers a keepalive
+// within backendProbeTimeout, a hung backend must not hold up the client
+func probeBackend(client *ssh.Client) bool {
+	answered := make(chan error, 1)
+
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		answered <- err
+	}()
+
+	select {
+	case err := <-answered:
+		return err == nil
+	case <-time.After(backendProbeTimeout):
+		return false
+	}
+}
+
+// releaseBackend ends the use of a backend connection by a client connection,
+// returning it to the pool when it can be reused
+func (g *Gateway) releaseBackend(key backendPoolKey, podIP string, lease *backendLease) {
+	if g.backendPool == nil {
+		_ = lease.client.Close()
+		return
+	}
+
+	// Channels of the client connection must not outlive it on a shared connection
+	lease.closeChannels()
+	lease.wg.Wait()
+
+	if lease.dirty.Load() {
+		_ = lease.client.Close()
+		return
+	}
+
+	g.backendPool.put(key, podIP, lease.client)
+}
+
+// BackendPoolStats returns a snapshot of the backend connection pool counters,
+// all counters are zero when pooling is disabled
+func (g *Gateway) BackendPoolStats() BackendPoolStats {
+	if g.backendPool == nil {
+		return BackendPoolStats{}
+	}
+
+	return g.backendPool.stats()
+}
@@ -0,0 +1,227 @@
+package gateway_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/zijiren233/sshgate/gateway"
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// runPublicKeySession runs one session as user in public key mode and disconnects
+func runPublicKeySession(t *testing.T, addr string, env *backendTestEnv, user string) {
+	t.Helper()
+
+	signer, err := ssh.ParsePrivateKey(env.privBytes)
+	if err != nil {
+		t.Fatalf("Failed to parse private key: %v", err)
+	}
+
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User: user,
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		//nolint:gosec // acceptable for testing
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Failed to dial gateway: %v", err)
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer session.Close()
+
+	if err := session.Run("exit 0"); err != nil {
+		t.Fatalf("Session failed: %v", err)
+	}
+}
+
+// waitForIdle waits until the gateway pool holds idle backend connections
+func waitForIdle(t *testing.T, gw *gateway.Gateway, idle int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for gw.BackendPoolStats().Idle != idle {
+		if time.Now().After(deadline) {
+			t.Fatalf("Pool holds %d idle connections, want %d", gw.BackendPoolStats().Idle, idle)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// setPodIP updates the pod IP of the test devbox
+func setPodIP(t *testing.T, reg *registry.Registry, podIP string) {
+	t.Helper()
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pod",
+			Namespace: "ns-test",
+			Labels: map[string]string{
+				registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: registry.DevboxOwnerKind, Name: "test-devbox"},
+			},
+		},
+		Status: corev1.PodStatus{PodIP: podIP},
+	}
+	if err := reg.UpdatePod(pod); err != nil {
+		t.Fatalf("Failed to update pod: %v", err)
+	}
+}
+
+func TestBackendPool_ReusesConnection(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t, gateway.WithBackendPool(true, 2, time.Minute))
+
+	runPublicKeySession(t, addr, env, "testuser")
+	waitForIdle(t, env.gateway, 1)
+	runPublicKeySession(t, addr, env, "testuser")
+	waitForIdle(t, env.gateway, 1)
+
+	if got := env.backendListener.accepted(); got != 1 {
+		t.Errorf("Backend accepted %d connections, want 1", got)
+	}
+
+	stats := env.gateway.BackendPoolStats()
+	if stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("Pool hits/misses = %d/%d, want 1/1", stats.Hits, stats.Misses)
+	}
+}
+
+func TestBackendPool_InvalidatedOnPodIPChange(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t, gateway.WithBackendPool(true, 2, time.Minute))
+
+	runPublicKeySession(t, addr, env, "testuser")
+	waitForIdle(t, env.gateway, 1)
+
+	// The pod restarts and comes back on the same address
+	setPodIP(t, env.reg, "10.0.0.9")
+	waitForIdle(t, env.gateway, 0)
+	setPodIP(t, env.reg, "127.0.0.1")
+
+	runPublicKeySession(t, addr, env, "testuser")
+
+	if got := env.backendListener.accepted(); got != 2 {
+		t.Errorf("Backend accepted %d connections, want 2", got)
+	}
+
+	stats := env.gateway.BackendPoolStats()
+	if stats.Hits != 0 || stats.Evictions != 1 {
+		t.Errorf("Pool hits/evictions = %d/%d, want 0/1", stats.Hits, stats.Evictions)
+	}
+}
+
+func TestBackendPool_DoesNotMixBackendUsers(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t, gateway.WithBackendPool(true, 2, time.Minute))
+
+	runPublicKeySession(t, addr, env, "alice")
+	waitForIdle(t, env.gateway, 1)
+	runPublicKeySession(t, addr, env, "bob")
+	waitForIdle(t, env.gateway, 2)
+
+	if got := env.backendListener.accepted(); got != 2 {
+		t.Errorf("Backend accepted %d connections, want 2", got)
+	}
+
+	if hits := env.gateway.BackendPoolStats().Hits; hits != 0 {
+		t.Errorf("Pool hits = %d, want 0", hits)
+	}
+}
+
+func TestBackendPool_DisabledByDefault(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t)
+
+	runPublicKeySession(t, addr, env, "testuser")
+	runPublicKeySession(t, addr, env, "testuser")
+
+	if got := env.backendListener.accepted(); got != 2 {
+		t.Errorf("Backend accepted %d connections, want 2", got)
+	}
+}
+
+func TestOptionsValidate_BackendPool(t *testing.T) {
+	opts := gateway.DefaultOptions()
+	opts.BackendPoolEnabled = true
+	opts.BackendPoolMaxIdle = 0
+
+	if err := opts.Validate(); err == nil {
+		t.Error("Expected validation error, got nil")
+	}
+}
+
+// counterValue returns the value of the counter of name gathered from gatherer
+func counterValue(t *testing.T, gatherer prometheus.Gatherer, name string) float64 {
+	t.Helper()
+
+	families, err := gatherer.Gather()
+	if err != nil {
+		t.Fatalf("Gather failed: %v", err)
+	}
+
+	for _, family := range families {
+		if family.GetName() == name && len(family.GetMetric()) == 1 {
+			return family.GetMetric()[0].GetCounter().GetValue()
+		}
+	}
+
+	t.Fatalf("No series %s", name)
+
+	return 0
+}
+
+func TestBackendPool_Metrics(t *testing.T) {
+	promReg := prometheus.NewRegistry()
+
+	env := newBackendTestEnv(t)
+	addr := env.start(t,
+		gateway.WithBackendPool(true, 2, time.Minute),
+		gateway.WithMetrics(promReg),
+	)
+
+	runPublicKeySession(t, addr, env, "testuser")
+	waitForIdle(t, env.gateway, 1)
+	runPublicKeySession(t, addr, env, "testuser")
+	waitForIdle(t, env.gateway, 1)
+
+	if got := counterValue(t, promReg, "sshgate_backend_pool_hits_total"); got != 1 {
+		t.Errorf("sshgate_backend_pool_hits_total = %v, want 1", got)
+	}
+
+	if got := counterValue(t, promReg, "sshgate_backend_pool_misses_total"); got != 1 {
+		t.Errorf("sshgate_backend_pool_misses_total = %v, want 1", got)
+	}
+}
+
+func TestBackendPool_InvalidatedOnKeyRotation(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t, gateway.WithBackendPool(true, 2, time.Minute))
+
+	runPublicKeySession(t, addr, env, "testuser")
+	waitForIdle(t, env.gateway, 1)
+
+	// The devbox key is rotated, the pooled connection authenticated with the old one
+	_, _, pubBytes, privBytes := generateTestKeys(t)
+	if err := env.reg.AddSecret(nil, testSecret(pubBytes, privBytes)); err != nil {
+		t.Fatalf("Failed to rotate secret: %v", err)
+	}
+
+	waitForIdle(t, env.gateway, 0)
+
+	if evictions := env.gateway.BackendPoolStats().Evictions; evictions != 1 {
+		t.Errorf("Pool evictions = %d, want 1", evictions)
+	}
+}
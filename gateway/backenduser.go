@@ -0,0 +1,89 @@
+package gateway
+
+import (
+	"cmp"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/zijiren233/sshgate/registry"
+)
+
+// backendUserAdminSuffix restricts a backend user map rule to admin keys
+const backendUserAdminSuffix = ":admin"
+
+// backendUserRule maps the users claimed by clients matching pattern to user
+type backendUserRule struct {
+	pattern *regexp.Regexp
+	// user may refer to the submatches of pattern, like $1
+	user      string
+	adminOnly bool
+}
+
+// parseBackendUserMap parses backend user map rules of the form pattern=user,
+// pattern=user:admin applying to admin keys only. Patterns are regular
+// expressions matching the whole claimed user.
+func parseBackendUserMap(rules []string) ([]backendUserRule, error) {
+	parsed := make([]backendUserRule, 0, len(rules))
+
+	for _, rule := range rules {
+		pattern, user, ok := strings.Cut(strings.TrimSpace(rule), "=")
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("invalid backend user map rule %q, expected pattern=user", rule)
+		}
+
+		user, adminOnly := strings.CutSuffix(user, backendUserAdminSuffix)
+		if user == "" {
+			return nil, fmt.Errorf("invalid backend user map rule %q: no user", rule)
+		}
+
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid backend user map rule %q: %w", rule, err)
+		}
+
+		parsed = append(parsed, backendUserRule{pattern: re, user: user, adminOnly: adminOnly})
+	}
+
+	return parsed, nil
+}
+
+// mapBackendUser returns the user logging into the devbox for the user claimed
+// by a client, in order of precedence:
+//   - the first backend user map rule matching it, admin only rules for admin keys
+//   - the backend user annotated on the devbox
+//   - the default backend user of the gateway
+//   - the claimed user itself
+func (g *Gateway) mapBackendUser(info *registry.DevboxInfo, claimed string, admin bool) string {
+	for _, rule := range g.backendUserMap {
+		if rule.adminOnly && !admin {
+			continue
+		}
+
+		match := rule.pattern.FindStringSubmatchIndex(claimed)
+		if match == nil {
+			continue
+		}
+
+		if user := string(rule.pattern.ExpandString(nil, rule.user, claimed, match)); user != "" {
+			return user
+		}
+	}
+
+	return cmp.Or(info.BackendUser, g.opts().DefaultBackendUser, claimed)
+}
+
+// backendUser maps the user claimed by a client, see mapBackendUser, and checks
+// the devbox allows logging in as the resulting user
+func (g *Gateway) backendUser(
+	info *registry.DevboxInfo,
+	claimed string,
+	admin bool,
+) (string, error) {
+	user := g.mapBackendUser(info, claimed, admin)
+	if err := allowBackendUser(info, user); err != nil {
+		return "", err
+	}
+
+	return user, nil
+}
@@ -0,0 +1,338 @@
+package gateway_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// dialAs connects to the gateway as user, with the devbox key in public key mode
+// or with a foreign key forwarding an agent holding the devbox key otherwise
+func dialAs(
+	t *testing.T,
+	addr string,
+	env *backendTestEnv,
+	user string,
+	publicKeyMode bool,
+) (*ssh.Client, error) {
+	t.Helper()
+
+	devboxKey, err := ssh.ParseRawPrivateKey(env.privBytes)
+	if err != nil {
+		t.Fatalf("Failed to parse private key: %v", err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(devboxKey)
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+
+	if !publicKeyMode {
+		signer, _, _, _ = generateTestKeys(t)
+	}
+
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User: user,
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		//nolint:gosec // acceptable for testing
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	t.Cleanup(func() { client.Close() })
+
+	if !publicKeyMode {
+		keyring := agent.NewKeyring()
+		if err := keyring.Add(agent.AddedKey{PrivateKey: devboxKey}); err != nil {
+			t.Fatalf("Failed to add key to keyring: %v", err)
+		}
+
+		if err := agent.ForwardToAgent(client, keyring); err != nil {
+			t.Fatalf("Failed to forward agent: %v", err)
+		}
+	}
+
+	return client, nil
+}
+
+// backendWhoami returns the user a new session of client logged into the backend as
+func backendWhoami(t *testing.T, client *ssh.Client, publicKeyMode bool) string {
+	t.Helper()
+
+	var setup func(*ssh.Session) error
+	if !publicKeyMode {
+		setup = func(s *ssh.Session) error { return agent.RequestAgentForwarding(s) }
+	}
+
+	return runForcedSession(t, client, setup, func(s *ssh.Session) error {
+		return s.Start("whoami")
+	})
+}
+
+func TestBackendUser(t *testing.T) {
+	tests := []struct {
+		name          string
+		user          string
+		publicKeyMode bool
+		want          string
+	}{
+		{name: "public key default", user: "testuser", publicKeyMode: true, want: "testuser"},
+		{name: "public key explicit", user: "root+testuser", publicKeyMode: true, want: "root"},
+		{
+			name:          "public key URL encoded",
+			user:          "root%2Btestuser",
+			publicKeyMode: true,
+			want:          "root",
+		},
+		{name: "agent default", user: "testuser@ns-test/test-devbox", want: "testuser"},
+		{name: "agent explicit", user: "root+testuser@ns-test/test-devbox", want: "root"},
+		{name: "agent without username", user: "root+test-test-devbox", want: "root"},
+		{name: "agent underscore form", user: "root+testuser__ns-test__test-devbox", want: "root"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newBackendTestEnv(t)
+			addr := env.start(t)
+
+			client, err := dialAs(t, addr, env, tt.user, tt.publicKeyMode)
+			if err != nil {
+				t.Fatalf("Failed to dial gateway as %s: %v", tt.user, err)
+			}
+
+			if got := backendWhoami(t, client, tt.publicKeyMode); got != tt.want {
+				t.Errorf("Backend user = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackendUser_AnnotationRestricts(t *testing.T) {
+	tests := []struct {
+		name          string
+		user          string
+		publicKeyMode bool
+		allowed       bool
+	}{
+		{name: "public key allowed", user: "testuser", publicKeyMode: true, allowed: true},
+		{name: "public key denied", user: "root+testuser", publicKeyMode: true},
+		{name: "agent allowed", user: "testuser@ns-test/test-devbox", allowed: true},
+		{name: "agent denied", user: "root@ns-test/test-devbox"},
+		{name: "agent explicit denied", user: "root+testuser@ns-test/test-devbox"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newBackendTestEnv(t)
+			addr := env.start(t)
+
+			setPodAnnotations(t, env.reg, map[string]string{
+				registry.BackendUsersAnnotation: "ubuntu, testuser",
+			})
+
+			client, err := dialAs(t, addr, env, tt.user, tt.publicKeyMode)
+			if !tt.allowed {
+				if err == nil {
+					t.Fatalf("Dial as %s succeeded, want the backend user denied", tt.user)
+				}
+
+				failures := env.gateway.AuthStats().Failures
+				if got := failures[gateway.AuthFailureBackendUserDenied]; got == 0 {
+					t.Errorf("Failures = %v, want a backend user denial", failures)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Failed to dial gateway as %s: %v", tt.user, err)
+			}
+
+			if got := backendWhoami(t, client, tt.publicKeyMode); got != "testuser" {
+				t.Errorf("Backend user = %q, want testuser", got)
+			}
+		})
+	}
+}
+
+func TestBackendUser_Mapping(t *testing.T) {
+	_, adminPub, adminBytes, _ := generateTestKeys(t)
+
+	tests := []struct {
+		name        string
+		opts        []gateway.Option
+		annotations map[string]string
+		user        string
+		admin       bool
+		want        string
+		wantErr     error
+	}{
+		{name: "claimed user", user: "alice", want: "alice"},
+		{
+			name: "gateway default",
+			opts: []gateway.Option{gateway.WithDefaultBackendUser("devbox")},
+			user: "alice",
+			want: "devbox",
+		},
+		{
+			name:        "devbox annotation over gateway default",
+			opts:        []gateway.Option{gateway.WithDefaultBackendUser("devbox")},
+			annotations: map[string]string{registry.BackendUserAnnotation: "ubuntu"},
+			user:        "alice",
+			want:        "ubuntu",
+		},
+		{
+			name: "map rule over devbox annotation",
+			opts: []gateway.Option{
+				gateway.WithDefaultBackendUser("devbox"),
+				gateway.WithBackendUserMap("ci-(.+)=$1", "root=root:admin"),
+			},
+			annotations: map[string]string{registry.BackendUserAnnotation: "ubuntu"},
+			user:        "ci-runner",
+			want:        "runner",
+		},
+		{
+			name: "map rule matches the whole user",
+			opts: []gateway.Option{gateway.WithBackendUserMap("ci=runner")},
+			user: "ci-build",
+			want: "ci-build",
+		},
+		{
+			name: "admin rule skipped for other keys",
+			opts: []gateway.Option{
+				gateway.WithDefaultBackendUser("devbox"),
+				gateway.WithBackendUserMap("root=root:admin"),
+			},
+			user: "root",
+			want: "devbox",
+		},
+		{
+			name: "admin rule for admin keys",
+			opts: []gateway.Option{
+				gateway.WithDefaultBackendUser("devbox"),
+				gateway.WithBackendUserMap("root=root:admin"),
+			},
+			user:  "root@ns-test/test-devbox",
+			admin: true,
+			want:  "root",
+		},
+		{
+			name:        "mapped user allowed by the devbox",
+			opts:        []gateway.Option{gateway.WithDefaultBackendUser("devbox")},
+			annotations: map[string]string{registry.BackendUsersAnnotation: "devbox"},
+			user:        "alice",
+			want:        "devbox",
+		},
+		{
+			name: "mapped user denied by the devbox",
+			opts: []gateway.Option{gateway.WithBackendUserMap("root=root:admin")},
+			annotations: map[string]string{
+				registry.BackendUsersAnnotation: "devbox",
+			},
+			user:    "root@ns-test/test-devbox",
+			admin:   true,
+			wantErr: gateway.ErrBackendUserDenied,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newBackendTestEnv(t)
+			setPodAnnotations(t, env.reg, tt.annotations)
+
+			signer, err := ssh.ParsePrivateKey(env.privBytes)
+			if err != nil {
+				t.Fatalf("Failed to parse private key: %v", err)
+			}
+
+			key := signer.PublicKey()
+			if tt.admin {
+				key = adminPub
+			}
+
+			gw := gateway.New(env.hostKey, env.reg, append([]gateway.Option{
+				gateway.WithAdminKeys([]string{string(adminBytes)}, nil),
+			}, tt.opts...)...)
+
+			perms, err := gw.PublicKeyCallback(newMockConnMetadata(tt.user), key)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Expected error %v, got: %v", tt.wantErr, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Authentication failed: %v", err)
+			}
+
+			if got := perms.Extensions["backend_user"]; got != tt.want {
+				t.Errorf("backend_user = %q, want %q", got, tt.want)
+			}
+
+			claimed := strings.Split(tt.user, "@")[0]
+			if got := perms.Extensions["claimed_user"]; got != claimed {
+				t.Errorf("claimed_user = %q, want %q", got, claimed)
+			}
+		})
+	}
+}
+
+// TestBackendUser_MappingLogsIn checks both modes log into the devbox as the
+// mapped user
+func TestBackendUser_MappingLogsIn(t *testing.T) {
+	tests := []struct {
+		name          string
+		user          string
+		publicKeyMode bool
+	}{
+		{name: "public key", user: "alice", publicKeyMode: true},
+		{name: "agent", user: "alice@ns-test/test-devbox"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newBackendTestEnv(t)
+			addr := env.start(t, gateway.WithDefaultBackendUser("devbox"))
+
+			client, err := dialAs(t, addr, env, tt.user, tt.publicKeyMode)
+			if err != nil {
+				t.Fatalf("Failed to dial gateway as %s: %v", tt.user, err)
+			}
+
+			if got := backendWhoami(t, client, tt.publicKeyMode); got != "devbox" {
+				t.Errorf("Backend user = %q, want devbox", got)
+			}
+		})
+	}
+}
+
+func TestOptionsValidate_BackendUserMap(t *testing.T) {
+	for _, rule := range []string{"root", "=root", "root=", "root=:admin", "(=root"} {
+		t.Run(rule, func(t *testing.T) {
+			opts := gateway.DefaultOptions()
+			gateway.WithBackendUserMap(rule)(&opts)
+
+			if err := opts.Validate(); err == nil {
+				t.Error("Expected validation error, got nil")
+			}
+		})
+	}
+
+	opts := gateway.DefaultOptions()
+	gateway.WithBackendUserMap("ci-(.+)=$1", "root=root:admin")(&opts)
+
+	if err := opts.Validate(); err != nil {
+		t.Errorf("Validate() failed: %v", err)
+	}
+}
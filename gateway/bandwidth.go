@@ -0,0 +1,157 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/time/rate"
+)
+
+// bandwidthPolicy holds the parsed bandwidth limits in bytes per second
+type bandwidthPolicy struct {
+	limit int64
+	burst int
+	// namespace -> limit, 0 means unlimited
+	namespaces map[string]int64
+}
+
+// parseBandwidthPolicy parses the bandwidth options, it returns nil when no
+// connection can be limited
+func parseBandwidthPolicy(o *Options) (*bandwidthPolicy, error) {
+	policy := &bandwidthPolicy{namespaces: make(map[string]int64)}
+
+	if o.BandwidthLimit != "" {
+		limit, err := parseByteSize(o.BandwidthLimit)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bandwidth limit: %w", err)
+		}
+
+		policy.limit = limit
+	}
+
+	for _, entry := range o.BandwidthLimitNamespaces {
+		namespace, value, ok := strings.Cut(entry, "=")
+		if !ok || namespace == "" {
+			return nil, fmt.Errorf(
+				"invalid namespace bandwidth limit %q, expected namespace=limit",
+				entry,
+			)
+		}
+
+		limit, err := parseByteSize(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bandwidth limit for namespace %s: %w", namespace, err)
+		}
+
+		policy.namespaces[namespace] = limit
+	}
+
+	burst, err := parseByteSize(o.BandwidthLimitBurst)
+	if err != nil || burst <= 0 {
+		return nil, fmt.Errorf("invalid bandwidth limit burst %q", o.BandwidthLimitBurst)
+	}
+
+	policy.burst = int(burst)
+
+	if policy.limit == 0 && len(policy.namespaces) == 0 {
+		return nil, nil //nolint:nilnil // no policy means unlimited
+	}
+
+	return policy, nil
+}
+
+// parseByteSize parses a byte count with an optional K, M or G suffix (powers of 1024)
+func parseByteSize(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+
+	multiplier := int64(1)
+
+	switch {
+	case strings.HasSuffix(s, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		multiplier = 1 << 30
+	}
+
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid byte size %q", s)
+	}
+
+	return n * multiplier, nil
+}
+
+// limitFor returns the bandwidth limit of connections to a namespace, 0 if unlimited
+func (p *bandwidthPolicy) limitFor(namespace string) int64 {
+	if limit, ok := p.namespaces[namespace]; ok {
+		return limit
+	}
+
+	return p.limit
+}
+
+// bandwidthLimiter is a token bucket shared by every channel of a client connection,
+// counting data in both directions
+type bandwidthLimiter struct {
+	limiter *rate.Limiter
+	limit   int64
+	burst   int
+}
+
+// newBandwidthLimiter returns the limiter of a connection to namespace,
+// or nil if the connection is unlimited
+func (g *Gateway) newBandwidthLimiter(namespace string) *bandwidthLimiter {
+	policy := g.bandwidth.Load()
+	if policy == nil {
+		return nil
+	}
+
+	limit := policy.limitFor(namespace)
+	if limit == 0 {
+		return nil
+	}
+
+	return &bandwidthLimiter{
+		limiter: rate.NewLimiter(rate.Limit(limit), policy.burst),
+		limit:   limit,
+		burst:   policy.burst,
+	}
+}
+
+// reader returns r limited by l, r itself if l is nil
+func (l *bandwidthLimiter) reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+
+	return &limitedReader{r: r, limiter: l}
+}
+
+type limitedReader struct {
+	r       io.Reader
+	limiter *bandwidthLimiter
+}
+
+// Read reads at most a burst worth of data and waits for the tokens to pass it on,
+// small interactive writes go through immediately while tokens are left
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > r.limiter.burst {
+		p = p[:r.limiter.burst]
+	}
+
+	n, err := r.r.Read(p)
+	if n > 0 {
+		_ = r.limiter.limiter.WaitN(context.Background(), n)
+	}
+
+	return n, err
+}
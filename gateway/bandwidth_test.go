@@ -0,0 +1,144 @@
+package gateway_test
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"golang.org/x/crypto/ssh"
+)
+
+// uploadToDiscard streams size bytes to the mock backend over a new session
+func uploadToDiscard(t *testing.T, client *ssh.Client, size int) {
+	t.Helper()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Errorf("Failed to create session: %v", err)
+		return
+	}
+	defer session.Close()
+
+	session.Stdin = bytes.NewReader(make([]byte, size))
+
+	if err := session.Run("discard"); err != nil {
+		t.Errorf("Upload failed: %v", err)
+	}
+}
+
+func TestBandwidthLimit_SharedAcrossChannels(t *testing.T) {
+	const (
+		limit = 512 << 10
+		burst = 64 << 10
+		total = 1 << 20
+	)
+
+	env := newBackendTestEnv(t)
+	addr := env.start(t, gateway.WithBandwidthLimit("512K", "64K", nil))
+
+	signer, err := ssh.ParsePrivateKey(env.privBytes)
+	if err != nil {
+		t.Fatalf("Failed to parse private key: %v", err)
+	}
+
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User: "testuser",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		//nolint:gosec // acceptable for testing
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Failed to dial gateway: %v", err)
+	}
+	defer client.Close()
+
+	start := time.Now()
+
+	// Two channels share the connection's budget
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Go(func() {
+			uploadToDiscard(t, client, total/2)
+		})
+	}
+
+	wg.Wait()
+
+	elapsed := time.Since(start)
+
+	// The burst passes immediately, the rest at the limit
+	observed := float64(total-burst) / elapsed.Seconds()
+	if observed > limit*1.1 {
+		t.Errorf("Observed %.0f B/s, want at most %d B/s +10%%", observed, limit)
+	}
+
+	if observed < limit*0.5 {
+		t.Errorf("Observed %.0f B/s, far below the %d B/s limit", observed, limit)
+	}
+}
+
+func TestBandwidthLimit_NamespaceOverride(t *testing.T) {
+	env := newBackendTestEnv(t)
+
+	// The test devbox lives in ns-test, which is exempt
+	addr := env.start(t, gateway.WithBandwidthLimit("64K", "16K", []string{"ns-test=0"}))
+
+	signer, err := ssh.ParsePrivateKey(env.privBytes)
+	if err != nil {
+		t.Fatalf("Failed to parse private key: %v", err)
+	}
+
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User: "testuser",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		//nolint:gosec // acceptable for testing
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Failed to dial gateway: %v", err)
+	}
+	defer client.Close()
+
+	start := time.Now()
+
+	uploadToDiscard(t, client, 1<<20)
+
+	// At 64K/s the upload would take 16 seconds
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Upload took %s, namespace override not applied", elapsed)
+	}
+}
+
+func TestOptionsValidate_BandwidthLimit(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  gateway.Option
+	}{
+		{"bad limit", gateway.WithBandwidthLimit("fast", "256K", nil)},
+		{"bad burst", gateway.WithBandwidthLimit("50M", "0", nil)},
+		{"bad namespace entry", gateway.WithBandwidthLimit("50M", "256K", []string{"ns-free"})},
+		{"bad namespace limit", gateway.WithBandwidthLimit("", "256K", []string{"ns-free=10X"})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := gateway.DefaultOptions()
+			tt.opt(&opts)
+
+			if err := opts.Validate(); err == nil {
+				t.Error("Expected validation error, got nil")
+			}
+		})
+	}
+
+	opts := gateway.DefaultOptions()
+	gateway.WithBandwidthLimit("50M", "256K", []string{"ns-free=10M"})(&opts)
+
+	if err := opts.Validate(); err != nil {
+		t.Errorf("Validate() failed: %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package gateway
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+)
+
+// Banner template placeholders
+const (
+	BannerPlaceholderUser      = "{user}"
+	BannerPlaceholderNamespace = "{namespace}"
+	BannerPlaceholderDevbox    = "{devbox}"
+)
+
+// Default devbox status banner templates
+const (
+	DefaultBannerDevboxStoppedTemplate     = "devbox {namespace}/{devbox} is stopped"
+	DefaultBannerDevboxUnavailableTemplate = "devbox {namespace}/{devbox} should be running " +
+		"but its pod is unavailable"
+	DefaultBannerUnknownDevboxTemplate   = "unknown devbox {namespace}/{devbox}"
+	DefaultBannerInvalidUsernameTemplate = "invalid username {user}, " +
+		"expected format user@namespace-devbox"
+)
+
+// BannerCallback returns the pre-authentication banner for a connection.
+// Per-devbox state is only revealed when BannerShowDevboxStatus is enabled,
+// otherwise every client sees the generic banner so unauthenticated clients
+// cannot probe which devboxes exist.
+func (g *Gateway) BannerCallback(conn ssh.ConnMetadata) string {
+	generic := renderBanner(g.opts().Banner, conn.User(), "", "")
+
+	// Every session is recorded, users are told before authenticating
+	if g.opts().SessionRecordingEnabled {
+		generic += renderBanner(sessionRecordingNotice, "", "", "")
+	}
+
+	if !g.opts().BannerShowDevboxStatus {
+		return generic
+	}
+
+	return generic + g.devboxStatusBanner(conn.User())
+}
+
+// devboxStatusBanner describes the devbox selected by the username,
+// it returns an empty string when there is nothing worth reporting
+func (g *Gateway) devboxStatusBanner(user string) string {
+	username, namespace, devboxName, err := g.parser.Parse(user)
+	if err != nil && !errors.Is(err, ErrDevboxNotFound) {
+		// A plain username selects the devbox by public key, nothing to report
+		if !g.parser.SelectsDevbox(user) {
+			return ""
+		}
+
+		return renderBanner(g.opts().BannerInvalidUsernameTemplate, user, "", "")
+	}
+
+	info, ok := g.registry.GetDevboxInfo(namespace, devboxName)
+	if !ok {
+		return renderBanner(
+			g.opts().BannerUnknownDevboxTemplate,
+			username,
+			namespace,
+			devboxName,
+		)
+	}
+
+	if info.PodState() == registry.PodStateNone {
+		template := g.opts().BannerDevboxStoppedTemplate
+		if info.DesiredState == registry.DesiredStateRunning {
+			template = g.opts().BannerDevboxUnavailableTemplate
+		}
+
+		return renderBanner(template, username, namespace, devboxName)
+	}
+
+	return ""
+}
+
+// renderBanner substitutes the placeholders in template and terminates it with a newline
+func renderBanner(template, user, namespace, devboxName string) string {
+	if template == "" {
+		return ""
+	}
+
+	banner := strings.NewReplacer(
+		BannerPlaceholderUser, user,
+		BannerPlaceholderNamespace, namespace,
+		BannerPlaceholderDevbox, devboxName,
+	).Replace(template)
+
+	if !strings.HasSuffix(banner, "\n") {
+		banner += "\r\n"
+	}
+
+	return banner
+}
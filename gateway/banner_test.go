@@ -0,0 +1,157 @@
+package gateway_test
+
+import (
+	"testing"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"github.com/zijiren233/sshgate/registry"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newBannerTestRegistry(t *testing.T) *registry.Registry {
+	t.Helper()
+
+	reg := registry.New()
+
+	for _, name := range []string{"running", "stopped", "unavailable"} {
+		_, _, pubBytes, privBytes := generateTestKeys(t)
+
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name + "-secret",
+				Namespace: "ns-team",
+				Labels: map[string]string{
+					registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+				},
+				OwnerReferences: []metav1.OwnerReference{
+					{Kind: registry.DevboxOwnerKind, Name: name},
+				},
+			},
+			Data: map[string][]byte{
+				registry.DevboxPublicKeyField:  pubBytes,
+				registry.DevboxPrivateKeyField: privBytes,
+			},
+		}
+		// The pod of this devbox is missing although it should run
+		if name == "unavailable" {
+			secret.Annotations = map[string]string{
+				registry.DesiredStateAnnotation: string(registry.DesiredStateRunning),
+			}
+		}
+
+		if err := reg.AddSecret(nil, secret); err != nil {
+			t.Fatalf("Failed to add secret: %v", err)
+		}
+	}
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "running-pod",
+			Namespace: "ns-team",
+			Labels: map[string]string{
+				registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: registry.DevboxOwnerKind, Name: "running"},
+			},
+		},
+		Status: corev1.PodStatus{PodIP: "10.0.0.1"},
+	}
+	if err := reg.UpdatePod(pod); err != nil {
+		t.Fatalf("Failed to update pod: %v", err)
+	}
+
+	return reg
+}
+
+func TestBannerCallback(t *testing.T) {
+	hostKey, _, _, _ := generateTestKeys(t)
+	reg := newBannerTestRegistry(t)
+
+	tests := []struct {
+		name       string
+		showStatus bool
+		user       string
+		want       string
+	}{
+		{
+			name: "generic banner hides devbox state",
+			user: "dev@team-stopped",
+			want: "Welcome to Acme\r\n",
+		},
+		{
+			name:       "stopped devbox",
+			showStatus: true,
+			user:       "dev@team-stopped",
+			want:       "Welcome to Acme\r\ndevbox ns-team/stopped is stopped\r\n",
+		},
+		{
+			name:       "devbox without its pod",
+			showStatus: true,
+			user:       "dev@team-unavailable",
+			want: "Welcome to Acme\r\n" +
+				"devbox ns-team/unavailable should be running but its pod is unavailable\r\n",
+		},
+		{
+			name:       "unknown devbox",
+			showStatus: true,
+			user:       "dev@team-missing",
+			want:       "Welcome to Acme\r\nunknown devbox ns-team/missing\r\n",
+		},
+		{
+			name:       "invalid username",
+			showStatus: true,
+			user:       "dev@team",
+			want: "Welcome to Acme\r\n" +
+				"invalid username dev@team, expected format user@namespace-devbox\r\n",
+		},
+		{
+			name:       "running devbox",
+			showStatus: true,
+			user:       "dev@team-running",
+			want:       "Welcome to Acme\r\n",
+		},
+		{
+			name:       "public key mode username",
+			showStatus: true,
+			user:       "dev",
+			want:       "Welcome to Acme\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gw := gateway.New(hostKey, reg,
+				gateway.WithBanner("Welcome to Acme"),
+				gateway.WithBannerShowDevboxStatus(tt.showStatus),
+			)
+
+			if got := gw.BannerCallback(newMockConnMetadata(tt.user)); got != tt.want {
+				t.Errorf("BannerCallback() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBannerCallback_Templates(t *testing.T) {
+	hostKey, _, _, _ := generateTestKeys(t)
+
+	gw := gateway.New(hostKey, newBannerTestRegistry(t),
+		gateway.WithBannerShowDevboxStatus(true),
+		gateway.WithBannerTemplates(
+			"{user}: start {devbox} in {namespace} first\n",
+			"no such devbox",
+			"bad username",
+		),
+	)
+
+	want := "dev: start stopped in ns-team first\n"
+	if got := gw.BannerCallback(newMockConnMetadata("dev@team-stopped")); got != want {
+		t.Errorf("BannerCallback() = %q, want %q", got, want)
+	}
+
+	if got := gw.BannerCallback(newMockConnMetadata("dev@team-running")); got != "" {
+		t.Errorf("BannerCallback() = %q, want empty banner", got)
+	}
+}
@@ -0,0 +1,81 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/net/proxy"
+)
+
+// backendClusterKey is the context key of the cluster of the devbox dialed
+type backendClusterKey struct{}
+
+// withBackendCluster returns ctx carrying the cluster of the devbox dialed
+func withBackendCluster(ctx context.Context, cluster string) context.Context {
+	return context.WithValue(ctx, backendClusterKey{}, cluster)
+}
+
+// BackendCluster returns the member cluster of the devbox a backend dial is
+// for, empty for the cluster of the gateway. A custom BackendDialer reads it
+// from the context of DialSSH to reach the devboxes of remote clusters.
+func BackendCluster(ctx context.Context) string {
+	cluster, _ := ctx.Value(backendClusterKey{}).(string)
+	return cluster
+}
+
+// parseClusterProxies parses the cluster=host:port entries of ClusterProxies
+// into the SOCKS5 proxy address of each cluster
+func parseClusterProxies(entries []string) (map[string]string, error) {
+	proxies := make(map[string]string, len(entries))
+
+	for _, entry := range entries {
+		cluster, addr, ok := strings.Cut(entry, "=")
+		if !ok || cluster == "" {
+			return nil, fmt.Errorf("invalid cluster proxy %q, expected cluster=host:port", entry)
+		}
+
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid proxy address of cluster %s: %w", cluster, err)
+		}
+
+		proxies[cluster] = addr
+	}
+
+	return proxies, nil
+}
+
+// clusterProxy returns the SOCKS5 proxy of the cluster of the devbox dialed
+// in ctx, if any. The cluster of the gateway and remote clusters without a
+// proxy are dialed directly.
+func (g *Gateway) clusterProxy(ctx context.Context) (string, bool) {
+	cluster := BackendCluster(ctx)
+	if cluster == "" {
+		return "", false
+	}
+
+	addr, ok := g.clusterProxies[cluster]
+
+	return addr, ok
+}
+
+// dialClusterProxy dials addr through the SOCKS5 proxy at proxyAddr, reached
+// with d. The proxy resolves DNS names, from within its cluster.
+func dialClusterProxy(
+	ctx context.Context,
+	d *net.Dialer,
+	proxyAddr, network, addr string,
+) (net.Conn, error) {
+	dialer, err := proxy.SOCKS5("tcp", proxyAddr, nil, d)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dialer.(proxy.ContextDialer).DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial %s through cluster proxy %s: %w", addr, proxyAddr, err)
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,199 @@
+package gateway_test
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"github.com/zijiren233/sshgate/registry"
+)
+
+// socksProxy serves SOCKS5 CONNECT requests without authentication, resolving
+// the hosts of its cluster and recording the addresses requested
+type socksProxy struct {
+	hosts map[string]string
+
+	mu      sync.Mutex
+	targets []string
+}
+
+// start serves the proxy on a loopback port, returning its address
+func (p *socksProxy) start(t *testing.T) string {
+	t.Helper()
+
+	var lc net.ListenConfig
+
+	ln, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start proxy listener: %v", err)
+	}
+
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go p.serve(conn)
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func (p *socksProxy) serve(conn net.Conn) {
+	defer conn.Close()
+
+	// Greeting: version, methods, answered with no authentication
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+
+	if _, err := io.ReadFull(conn, make([]byte, header[1])); err != nil {
+		return
+	}
+
+	if _, err := conn.Write([]byte{5, 0}); err != nil {
+		return
+	}
+
+	// Request: version, command, reserved, address type, address, port
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return
+	}
+
+	var host string
+
+	switch request[3] {
+	case 1, 4:
+		ip := make(net.IP, map[byte]int{1: net.IPv4len, 4: net.IPv6len}[request[3]])
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return
+		}
+
+		host = ip.String()
+	case 3:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return
+		}
+
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return
+		}
+
+		host = string(name)
+	default:
+		return
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return
+	}
+
+	portNumber := strconv.Itoa(int(binary.BigEndian.Uint16(port)))
+	target := net.JoinHostPort(host, portNumber)
+
+	p.mu.Lock()
+	p.targets = append(p.targets, target)
+	p.mu.Unlock()
+
+	if resolved, ok := p.hosts[host]; ok {
+		host = resolved
+	}
+
+	var d net.Dialer
+
+	backend, err := d.DialContext(context.Background(), "tcp", net.JoinHostPort(host, portNumber))
+	if err != nil {
+		_, _ = conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer backend.Close()
+
+	if _, err := conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		return
+	}
+
+	go func() {
+		_, _ = io.Copy(backend, conn)
+		_ = backend.Close()
+	}()
+
+	_, _ = io.Copy(conn, backend)
+}
+
+// requested returns the addresses requested from the proxy
+func (p *socksProxy) requested() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]string(nil), p.targets...)
+}
+
+func TestClusterProxies(t *testing.T) {
+	tests := []struct {
+		name        string
+		backendHost string
+		podIP       string
+		wantHost    string
+	}{
+		{
+			name:     "pod IP",
+			podIP:    "127.0.0.1",
+			wantHost: "127.0.0.1",
+		},
+		{
+			// The name only resolves within the remote cluster
+			name:        "DNS",
+			backendHost: "test-devbox.ns-test.svc",
+			podIP:       "127.0.0.2",
+			wantHost:    "test-devbox.ns-test.svc",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newBackendTestEnv(t, registry.WithCluster("remote"))
+			proxy := &socksProxy{hosts: map[string]string{tt.backendHost: "127.0.0.1"}}
+
+			if tt.backendHost != "" {
+				setBackendHost(t, env.reg, tt.podIP, tt.backendHost)
+			}
+
+			addr := env.start(t, gateway.WithClusterProxies("remote="+proxy.start(t)))
+
+			runPublicKeySession(t, addr, env, "testuser")
+
+			want := net.JoinHostPort(tt.wantHost, strconv.Itoa(env.backendPort))
+			if targets := proxy.requested(); len(targets) == 0 || targets[0] != want {
+				t.Errorf("Proxy requested %v, want %s", targets, want)
+			}
+		})
+	}
+}
+
+func TestClusterProxies_LocalClusterDialedDirectly(t *testing.T) {
+	env := newBackendTestEnv(t)
+	proxy := &socksProxy{}
+
+	addr := env.start(t, gateway.WithClusterProxies("remote="+proxy.start(t)))
+
+	runPublicKeySession(t, addr, env, "testuser")
+
+	if targets := proxy.requested(); len(targets) != 0 {
+		t.Errorf("Proxy requested %v for the local cluster", targets)
+	}
+}
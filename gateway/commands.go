@@ -0,0 +1,523 @@
+package gateway
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+)
+
+// gatewayCommand answers an exec request at the gateway instead of the devbox,
+// writing its output to the session and returning the exit status. ctx is done
+// once the client is gone.
+type gatewayCommand func(g *Gateway, ctx context.Context, call *commandCall) uint32
+
+// commandCall is an exec request answered by a gateway command
+type commandCall struct {
+	// args are the words of the command line following the command name
+	args   []string
+	stdout io.Writer
+	stderr io.Writer
+	conn   *ssh.ServerConn
+	// info is the devbox the client connected to
+	info *registry.DevboxInfo
+}
+
+// gatewayCommands are the commands answered by the gateway, by name. Each can be
+// disabled with DISABLED_GATEWAY_COMMANDS.
+var gatewayCommands = map[string]gatewayCommand{
+	"list": (*Gateway).listCommand,
+	"info": (*Gateway).infoCommand,
+}
+
+// lookupCommand returns the enabled gateway command named by the first word of
+// an exec command line, along with the remaining words
+func (g *Gateway) lookupCommand(commandLine string) (gatewayCommand, []string, bool) {
+	words := strings.Fields(commandLine)
+	if len(words) == 0 || slices.Contains(g.opts().DisabledGatewayCommands, words[0]) {
+		return nil, nil, false
+	}
+
+	command, ok := gatewayCommands[words[0]]
+
+	return command, words[1:], ok
+}
+
+// commandsAllowed reports whether the sessions of a devbox may run gateway
+// commands. Connections restricted to SFTP or to a forced command may not.
+func (g *Gateway) commandsAllowed(info *registry.DevboxInfo) bool {
+	if g.sftpOnly(info) || info.ForceCommand != "" {
+		return false
+	}
+
+	for name := range gatewayCommands {
+		if !slices.Contains(g.opts().DisabledGatewayCommands, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// routeCommands answers the sessions running a gateway command, see
+// routeSession, returning the other channels until ctx is done. It serves
+// connections refused before their sessions are admitted.
+func (g *Gateway) routeCommands(
+	ctx context.Context,
+	conn *ssh.ServerConn,
+	in <-chan ssh.NewChannel,
+	info *registry.DevboxInfo,
+	logger *log.Entry,
+) <-chan ssh.NewChannel {
+	if !g.commandsAllowed(info) {
+		return in
+	}
+
+	out := make(chan ssh.NewChannel)
+
+	go func() {
+		var wg sync.WaitGroup
+
+		defer close(out)
+		defer wg.Wait()
+
+		for newChannel := range in {
+			wg.Go(func() {
+				routed := g.routeSession(ctx, conn, newChannel, info, logger)
+				if routed == nil {
+					return
+				}
+
+				select {
+				case out <- routed:
+				case <-ctx.Done():
+				}
+			})
+		}
+	}()
+
+	return out
+}
+
+// routeSession accepts a session channel and waits for its command. A gateway
+// command is answered and nil returned, any other session is returned already
+// accepted to be handled as usual, see routedChannel. Like OpenSSH clients,
+// clients must not wait for replies to the requests setting up the session, a
+// request wanting a reply before the command hands the session on. Other
+// channels are returned as is.
+func (g *Gateway) routeSession(
+	ctx context.Context,
+	conn *ssh.ServerConn,
+	newChannel ssh.NewChannel,
+	info *registry.DevboxInfo,
+	logger *log.Entry,
+) ssh.NewChannel {
+	if newChannel.ChannelType() != "session" || !g.commandsAllowed(info) {
+		return newChannel
+	}
+
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		logger.WithError(err).Warn("Failed to accept session channel")
+		return nil
+	}
+
+	routed := &routedChannel{
+		NewChannel: newChannel,
+		ctx:        ctx,
+		channel:    channel,
+		requests:   requests,
+	}
+
+	timeout := time.NewTimer(g.opts().SessionRequestTimeout)
+	defer timeout.Stop()
+
+	for len(routed.cached) < g.opts().MaxCachedRequests {
+		select {
+		case req, ok := <-requests:
+			if !ok {
+				return routed
+			}
+
+			// Requests answered by the gateway neither count nor hand the session on
+			if answerLocalRequest(req) {
+				continue
+			}
+
+			routed.cached = append(routed.cached, req)
+
+			if req.Type != "exec" {
+				if req.WantReply || req.Type == "shell" || req.Type == "subsystem" {
+					return routed
+				}
+
+				continue
+			}
+
+			var exec struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &exec); err != nil {
+				return routed
+			}
+
+			command, args, ok := g.lookupCommand(exec.Command)
+			if !ok {
+				return routed
+			}
+
+			g.runCommand(ctx, channel, routed.cached, requests, command, &commandCall{
+				args: args,
+				conn: conn,
+				info: info,
+			}, logger.WithField("gateway_command", exec.Command))
+
+			return nil
+
+		case <-timeout.C:
+			return routed
+
+		case <-ctx.Done():
+			_ = channel.Close()
+			return nil
+		}
+	}
+
+	return routed
+}
+
+// runCommand runs a gateway command on a session, acknowledging the requests
+// setting it up, and ends the session with the exit status of the command
+func (g *Gateway) runCommand(
+	ctx context.Context,
+	channel ssh.Channel,
+	cached []*ssh.Request,
+	requests <-chan *ssh.Request,
+	command gatewayCommand,
+	call *commandCall,
+	logger *log.Entry,
+) {
+	defer channel.Close()
+	defer func() { go ssh.DiscardRequests(requests) }()
+
+	for _, req := range cached {
+		if req.WantReply {
+			_ = req.Reply(true, nil)
+		}
+	}
+
+	call.stdout, call.stderr = channel, channel.Stderr()
+
+	status := command(g, ctx, call)
+
+	logger.WithField("exit_status", status).Info("Gateway command run")
+
+	_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+}
+
+// routedChannel is a session channel accepted to see its command, handed on as
+// if it was still to be accepted. The requests read so far are replayed.
+type routedChannel struct {
+	ssh.NewChannel
+
+	ctx      context.Context
+	channel  ssh.Channel
+	cached   []*ssh.Request
+	requests <-chan *ssh.Request
+}
+
+// Accept returns the accepted channel and its requests, the cached ones first
+func (c *routedChannel) Accept() (ssh.Channel, <-chan *ssh.Request, error) {
+	out := make(chan *ssh.Request)
+
+	go func() {
+		defer close(out)
+
+		for _, req := range c.cached {
+			select {
+			case out <- req:
+			case <-c.ctx.Done():
+				return
+			}
+		}
+
+		for req := range c.requests {
+			select {
+			case out <- req:
+			case <-c.ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return c.channel, out, nil
+}
+
+// Reject explains the refusal on the already accepted channel, see failSession
+func (c *routedChannel) Reject(_ ssh.RejectionReason, message string) error {
+	go failSession(c.channel, c.cached, c.requests, message)
+
+	return nil
+}
+
+// listedDevbox is a devbox in the output of the list command
+type listedDevbox struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	HasPodIP  bool   `json:"has_pod_ip"`
+}
+
+// listCommand prints the devboxes reachable with the key the client
+// authenticated with, or for admin keys every devbox of a namespace:
+//
+//	list [--json] [namespace]
+//
+// Admins list the namespace of the devbox they connected to by default, others
+// may narrow their devboxes down to a namespace.
+func (g *Gateway) listCommand(_ context.Context, call *commandCall) uint32 {
+	var asJSON bool
+
+	var namespace string
+
+	for _, arg := range call.args {
+		switch {
+		case arg == "--json":
+			asJSON = true
+		case !strings.HasPrefix(arg, "-") && namespace == "":
+			namespace = arg
+		default:
+			_, _ = fmt.Fprintf(call.stderr, "usage: list [--json] [namespace]\r\n")
+			return 2
+		}
+	}
+
+	admin := g.determineAuthMode(call.conn) == AuthModeAdmin
+	if admin {
+		namespace = cmp.Or(namespace, call.info.Namespace)
+
+		if slices.Contains(g.opts().AdminDeniedNamespaces, namespace) {
+			_, _ = fmt.Fprintf(call.stderr, "namespace %s is not allowed\r\n", namespace)
+			return 1
+		}
+	}
+
+	fingerprint := call.conn.Permissions.Extensions["key_fingerprint"]
+
+	devboxes := []listedDevbox{}
+
+	for _, info := range g.registry.Devboxes() {
+		if namespace != "" && info.Namespace != namespace {
+			continue
+		}
+
+		if !admin && (info.PublicKey == nil ||
+			fingerprint == "" || ssh.FingerprintSHA256(info.PublicKey) != fingerprint) {
+			continue
+		}
+
+		devboxes = append(devboxes, listedDevbox{
+			Namespace: info.Namespace,
+			Name:      info.DevboxName,
+			Status:    g.devboxStatus(&info),
+			HasPodIP:  info.PodIP != "",
+		})
+	}
+
+	slices.SortFunc(devboxes, func(a, b listedDevbox) int {
+		return cmp.Or(cmp.Compare(a.Namespace, b.Namespace), cmp.Compare(a.Name, b.Name))
+	})
+
+	if asJSON {
+		return writeJSON(call.stdout, devboxes)
+	}
+
+	w := tabwriter.NewWriter(call.stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprint(w, "NAMESPACE\tNAME\tSTATUS\tPOD IP\n")
+
+	for _, devbox := range devboxes {
+		podIP := "no"
+		if devbox.HasPodIP {
+			podIP = "yes"
+		}
+
+		_, _ = fmt.Fprintf(
+			w,
+			"%s\t%s\t%s\t%s\n",
+			devbox.Namespace,
+			devbox.Name,
+			devbox.Status,
+			podIP,
+		)
+	}
+
+	if err := w.Flush(); err != nil {
+		return 1
+	}
+
+	return 0
+}
+
+// connectionInfo describes a client connection in the output of the info command
+type connectionInfo struct {
+	User              string `json:"user"`
+	BackendUser       string `json:"backend_user"`
+	AuthMode          string `json:"auth_mode"`
+	KeyFingerprint    string `json:"key_fingerprint,omitempty"`
+	Namespace         string `json:"namespace"`
+	Devbox            string `json:"devbox"`
+	Status            string `json:"status"`
+	BackendAddr       string `json:"backend_address"`
+	BackendAddressing string `json:"backend_addressing,omitempty"`
+	GatewayVersion    string `json:"gateway_version"`
+	HostKey           string `json:"host_key_fingerprint"`
+}
+
+// infoCommand prints how the gateway routes the client connection, to debug
+// routing without the gateway logs:
+//
+//	info [--json]
+//
+// The backend address is the one the next session would dial, it is hidden
+// with MaskBackendAddress.
+func (g *Gateway) infoCommand(ctx context.Context, call *commandCall) uint32 {
+	var asJSON bool
+
+	for _, arg := range call.args {
+		if arg != "--json" {
+			_, _ = fmt.Fprintf(call.stderr, "usage: info [--json]\r\n")
+			return 2
+		}
+
+		asJSON = true
+	}
+
+	perms := call.conn.Permissions
+	authMode := g.determineAuthMode(call.conn)
+
+	// Sessions read the devbox from the registry, it may have changed since
+	info, ok := g.registry.GetDevboxInfo(call.info.Namespace, call.info.DevboxName)
+	if !ok {
+		info = call.info
+	}
+
+	connInfo := connectionInfo{
+		User:        redactUser(call.conn.User()),
+		BackendUser: backendUserFromPermissions(perms),
+		AuthMode:    authMode.String(),
+		KeyFingerprint: cmp.Or(
+			perms.Extensions["key_fingerprint"],
+			perms.Extensions["admin_key_fingerprint"],
+		),
+		Namespace:      info.Namespace,
+		Devbox:         info.DevboxName,
+		Status:         g.devboxStatus(info),
+		GatewayVersion: gatewayVersion(),
+		HostKey:        ssh.FingerprintSHA256(g.advertisedKeys()[0].PublicKey()),
+	}
+
+	if !ok {
+		connInfo.Status = "deleted"
+	}
+
+	switch {
+	case g.opts().MaskBackendAddress:
+		connInfo.BackendAddr = "hidden"
+	case info.PodIP == "" && info.Addressing != registry.BackendAddressingDNS:
+		connInfo.BackendAddr = "none"
+	default:
+		connInfo.BackendAddr, connInfo.BackendAddressing = g.backendAddr(
+			ctx,
+			info,
+			g.backendSSHPort(info),
+			g.logger,
+		)
+	}
+
+	if asJSON {
+		return writeJSON(call.stdout, connInfo)
+	}
+
+	mode := connInfo.AuthMode
+	if authMode == AuthModeCustomKey || authMode == AuthModeNoAuth {
+		mode += " (agent forwarding)"
+	}
+
+	w := tabwriter.NewWriter(call.stdout, 0, 0, 2, ' ', 0)
+
+	for _, field := range [][2]string{
+		{"User", connInfo.User},
+		{"Backend user", connInfo.BackendUser},
+		{"Auth mode", mode},
+		{"Key fingerprint", cmp.Or(connInfo.KeyFingerprint, "none")},
+		{"Devbox", connInfo.Namespace + "/" + connInfo.Devbox},
+		{"Status", connInfo.Status},
+		{"Backend address", connInfo.BackendAddr},
+		{"Backend addressing", cmp.Or(connInfo.BackendAddressing, "-")},
+		{"Gateway version", connInfo.GatewayVersion},
+		{"Host key", connInfo.HostKey},
+	} {
+		_, _ = fmt.Fprintf(w, "%s:\t%s\n", field[0], field[1])
+	}
+
+	if err := w.Flush(); err != nil {
+		return 1
+	}
+
+	return 0
+}
+
+// gatewayVersion returns the version of the gateway binary, with the VCS
+// revision it was built from when known
+func gatewayVersion() string {
+	buildInfo, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+
+	version := buildInfo.Main.Version
+
+	for _, setting := range buildInfo.Settings {
+		if setting.Key == "vcs.revision" {
+			version += " (" + setting.Value + ")"
+		}
+	}
+
+	return cmp.Or(version, "unknown")
+}
+
+// writeJSON writes v as a line of JSON, returning the exit status
+func writeJSON(w io.Writer, v any) uint32 {
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		return 1
+	}
+
+	return 0
+}
+
+// devboxStatus describes whether a devbox is running, starting, stopped or
+// unreachable
+func (g *Gateway) devboxStatus(info *registry.DevboxInfo) string {
+	switch info.PodState() {
+	case registry.PodStateNone:
+		return "stopped"
+	case registry.PodStateStarting:
+		return "starting"
+	}
+
+	if health, ok := g.registry.BackendHealth(info.Namespace, info.DevboxName); ok &&
+		health.Unreachable {
+		return "unreachable"
+	}
+
+	return "running"
+}
@@ -0,0 +1,278 @@
+package gateway_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// addDevbox registers a stopped devbox with its own key pair
+func addDevbox(t *testing.T, reg *registry.Registry, namespace, devboxName string) {
+	t.Helper()
+
+	_, _, pubBytes, privBytes := generateTestKeys(t)
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      devboxName + "-secret",
+			Namespace: namespace,
+			Labels: map[string]string{
+				registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: registry.DevboxOwnerKind, Name: devboxName},
+			},
+		},
+		Data: map[string][]byte{
+			registry.DevboxPublicKeyField:  pubBytes,
+			registry.DevboxPrivateKeyField: privBytes,
+		},
+	}
+	if err := reg.AddSecret(nil, secret); err != nil {
+		t.Fatalf("Failed to add secret: %v", err)
+	}
+}
+
+// runCommand runs command on a new session of client, returning its output
+func runCommand(t *testing.T, client *ssh.Client, command string) string {
+	t.Helper()
+
+	return runForcedSession(t, client, nil, func(s *ssh.Session) error {
+		return s.Start(command)
+	})
+}
+
+func TestListCommand(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addDevbox(t, env.reg, "ns-test", "other-devbox")
+	addr := env.start(t)
+
+	client := dialPublicKeyMode(t, addr, env)
+
+	output := runCommand(t, client, "list")
+
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Output = %q, want a header and the devbox of the key", output)
+	}
+
+	const want = "ns-test test-devbox running yes"
+	if got := strings.Join(strings.Fields(lines[1]), " "); got != want {
+		t.Errorf("Devbox line = %q, want %q", lines[1], want)
+	}
+
+	// The command is answered by the gateway alone
+	if got := env.backendListener.accepted(); got != 1 {
+		t.Errorf("Backend accepted %d connections, want only the public key mode one", got)
+	}
+}
+
+func TestListCommand_JSON(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t)
+
+	client := dialPublicKeyMode(t, addr, env)
+
+	var devboxes []map[string]any
+	if err := json.Unmarshal([]byte(runCommand(t, client, "list --json")), &devboxes); err != nil {
+		t.Fatalf("Failed to parse list output: %v", err)
+	}
+
+	want := map[string]any{
+		"namespace":  "ns-test",
+		"name":       "test-devbox",
+		"status":     "running",
+		"has_pod_ip": true,
+	}
+
+	if len(devboxes) != 1 || !maps.Equal(devboxes[0], want) {
+		t.Errorf("Devboxes = %v, want [%v]", devboxes, want)
+	}
+}
+
+func TestListCommand_StoppedDevbox(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t)
+
+	setPodIP(t, env.reg, "")
+
+	client := dialPublicKeyMode(t, addr, env)
+
+	if output := runCommand(t, client, "list"); !strings.Contains(output, "stopped") {
+		t.Errorf("Output = %q, want the devbox stopped", output)
+	}
+}
+
+func TestListCommand_AdminListsNamespace(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addDevbox(t, env.reg, "ns-test", "other-devbox")
+	addDevbox(t, env.reg, "ns-other", "foreign-devbox")
+	addDevbox(t, env.reg, "ns-restricted", "secret-devbox")
+
+	adminSigner, _, adminBytes, _ := generateTestKeys(t)
+	addr := env.start(t,
+		gateway.WithAdminKeys([]string{string(adminBytes)}, []string{"ns-restricted"}),
+	)
+
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User: "root@ns-test/test-devbox",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(adminSigner)},
+		//nolint:gosec // acceptable for testing
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Failed to dial gateway: %v", err)
+	}
+	defer client.Close()
+
+	output := runCommand(t, client, "list")
+	for _, want := range []string{"other-devbox", "test-devbox"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Output = %q, want %s listed", output, want)
+		}
+	}
+
+	if strings.Contains(output, "foreign-devbox") {
+		t.Errorf("Output = %q, want only ns-test listed", output)
+	}
+
+	output = runCommand(t, client, "list ns-other")
+	if !strings.Contains(output, "foreign-devbox") {
+		t.Errorf("Output = %q, want foreign-devbox listed", output)
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer session.Close()
+
+	message, err := session.CombinedOutput("list ns-restricted")
+
+	var exitErr *ssh.ExitError
+	if !errors.As(err, &exitErr) || !strings.Contains(string(message), "not allowed") {
+		t.Errorf("list ns-restricted = %q, %v, want it refused", message, err)
+	}
+}
+
+func TestListCommand_Disabled(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t, gateway.WithDisabledGatewayCommands([]string{"list"}))
+
+	client := dialPublicKeyMode(t, addr, env)
+
+	// The mock backend prints nothing for unknown commands
+	if output := runCommand(t, client, "list"); output != "" {
+		t.Errorf("Output = %q, want the command run on the devbox", output)
+	}
+}
+
+func TestListCommand_AgentForwardMode(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t)
+
+	client := dialAgentForwardMode(t, addr, env)
+	defer client.Close()
+
+	// Like OpenSSH, the agent is requested without waiting for the reply
+	output := runForcedSession(
+		t,
+		client,
+		func(s *ssh.Session) error {
+			_, err := s.SendRequest("auth-agent-req@openssh.com", false, nil)
+			return err
+		},
+		func(s *ssh.Session) error { return s.Start("list") },
+	)
+
+	// The agent forwarding client did not authenticate with the devbox key
+	if strings.Contains(output, "test-devbox") || !strings.HasPrefix(output, "NAMESPACE") {
+		t.Errorf("Output = %q, want only the header", output)
+	}
+
+	if got := env.backendListener.accepted(); got != 0 {
+		t.Errorf("Backend accepted %d connections, want none", got)
+	}
+}
+
+func TestOptionsValidate_DisabledGatewayCommands(t *testing.T) {
+	opts := gateway.DefaultOptions()
+	opts.DisabledGatewayCommands = []string{"unknown"}
+
+	if err := opts.Validate(); err == nil {
+		t.Error("Expected validation error, got nil")
+	}
+}
+
+func TestInfoCommand(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t)
+
+	client := dialPublicKeyMode(t, addr, env)
+
+	output := runCommand(t, client, "info")
+
+	signer, err := ssh.ParsePrivateKey(env.privBytes)
+	if err != nil {
+		t.Fatalf("Failed to parse private key: %v", err)
+	}
+
+	for _, want := range []string{
+		"public-key",
+		"ns-test/test-devbox",
+		"running",
+		ssh.FingerprintSHA256(signer.PublicKey()),
+		ssh.FingerprintSHA256(env.hostKey.PublicKey()),
+		fmt.Sprintf("127.0.0.1:%d", env.backendPort),
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Output = %q, want %q", output, want)
+		}
+	}
+}
+
+func TestInfoCommand_StoppedDevbox(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t)
+
+	setPodIP(t, env.reg, "")
+
+	client := dialAgentForwardMode(t, addr, env)
+	defer client.Close()
+
+	var info map[string]any
+	if err := json.Unmarshal([]byte(runCommand(t, client, "info --json")), &info); err != nil {
+		t.Fatalf("Failed to parse info output: %v", err)
+	}
+
+	if info["status"] != "stopped" || info["backend_address"] != "none" {
+		t.Errorf("Info = %v, want the devbox stopped without backend address", info)
+	}
+
+	if info["auth_mode"] != gateway.AuthModeCustomKey.String() {
+		t.Errorf("Auth mode = %v, want %s", info["auth_mode"], gateway.AuthModeCustomKey)
+	}
+}
+
+func TestInfoCommand_MaskBackendAddress(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t, gateway.WithMaskBackendAddress(true))
+
+	client := dialPublicKeyMode(t, addr, env)
+
+	output := runCommand(t, client, "info")
+	if strings.Contains(output, "127.0.0.1") || !strings.Contains(output, "hidden") {
+		t.Errorf("Output = %q, want the backend address hidden", output)
+	}
+}
@@ -1,6 +1,12 @@
 package gateway
 
 import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
 	log "github.com/sirupsen/logrus"
 	"github.com/zijiren233/sshgate/registry"
 	"golang.org/x/crypto/ssh"
@@ -10,21 +16,175 @@ type sessionContext struct {
 	conn     *ssh.ServerConn
 	info     *registry.DevboxInfo
 	realUser string
-	logger   *log.Entry
+	// keyFingerprint is the fingerprint of the key the client authenticated with
+	keyFingerprint string
+	// io shapes and accounts the data of every channel of the connection
+	io     *connIO
+	logger *log.Entry
+
+	// backendMu guards backend, the backend connection shared by the
+	// session channels of the client connection, backendSet, closed
+	// once it is established for channels awaiting it, and backendDialing,
+	// closed once the dial in progress, dialed without holding backendMu, ends.
+	// backendClosed is set once the client connection is gone.
+	backendMu      sync.Mutex
+	backend        *ssh.Client
+	backendSet     chan struct{}
+	backendDialing chan struct{}
+	backendClosed  bool
+
+	sessions *sessionGate
+	// agent bridges the agent channels of the backend to the client, nil unless
+	// the agent is forwarded onward
+	agent *agentBridge
+}
+
+// currentBackend returns the shared backend connection, or nil if none is established
+func (ctx *sessionContext) currentBackend() *ssh.Client {
+	ctx.backendMu.Lock()
+	defer ctx.backendMu.Unlock()
+
+	return ctx.backend
+}
+
+// sharedBackend returns the shared backend connection, establishing it with dial
+// if none is alive. Concurrent callers wait for a single dial, which leaves the
+// shared backend connection readable by currentBackend meanwhile.
+func (ctx *sessionContext) sharedBackend(
+	dial func() (*ssh.Client, error),
+) (client *ssh.Client, reused bool, err error) {
+	ctx.backendMu.Lock()
+
+	for ctx.backendDialing != nil {
+		dialing := ctx.backendDialing
+		ctx.backendMu.Unlock()
+		<-dialing
+		ctx.backendMu.Lock()
+	}
+
+	if ctx.backendClosed {
+		ctx.backendMu.Unlock()
+		return nil, false, net.ErrClosed
+	}
+
+	if ctx.backend != nil {
+		defer ctx.backendMu.Unlock()
+		return ctx.backend, true, nil
+	}
+
+	dialing := make(chan struct{})
+	ctx.backendDialing = dialing
+	ctx.backendMu.Unlock()
+
+	client, err = dial()
+
+	ctx.backendMu.Lock()
+	defer ctx.backendMu.Unlock()
+
+	ctx.backendDialing = nil
+	close(dialing)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	// The client connection went away during the dial
+	if ctx.backendClosed {
+		_ = client.Close()
+		return nil, false, net.ErrClosed
+	}
+
+	ctx.backend = client
+
+	if ctx.backendSet != nil {
+		close(ctx.backendSet)
+		ctx.backendSet = nil
+	}
+
+	// Forget the connection once the backend drops so the next session re-dials
+	go func() {
+		_ = client.Wait()
+		ctx.dropBackend(client)
+	}()
+
+	return client, false, nil
+}
+
+// awaitBackend returns the shared backend connection, waiting up to timeout for
+// a session bringing the agent to establish it. It returns nil if none did.
+func (ctx *sessionContext) awaitBackend(
+	connCtx context.Context,
+	timeout time.Duration,
+) *ssh.Client {
+	ctx.backendMu.Lock()
+
+	if ctx.backend != nil {
+		defer ctx.backendMu.Unlock()
+		return ctx.backend
+	}
+
+	if ctx.backendSet == nil {
+		ctx.backendSet = make(chan struct{})
+	}
+
+	set := ctx.backendSet
+	ctx.backendMu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-set:
+		return ctx.currentBackend()
+	case <-timer.C:
+		return nil
+	case <-connCtx.Done():
+		return nil
+	}
 }
 
+// dropBackend closes client and forgets it if it is still the shared backend connection
+func (ctx *sessionContext) dropBackend(client *ssh.Client) {
+	ctx.backendMu.Lock()
+	if ctx.backend == client {
+		ctx.backend = nil
+	}
+	ctx.backendMu.Unlock()
+
+	_ = client.Close()
+}
+
+// closeBackend closes the shared backend connection, if any, along with the
+// one being dialed once established
+func (ctx *sessionContext) closeBackend() {
+	ctx.backendMu.Lock()
+	ctx.backendClosed = true
+	ctx.backendMu.Unlock()
+
+	if client := ctx.currentBackend(); client != nil {
+		ctx.dropBackend(client)
+	}
+}
+
+// handleCustomKeyOrNoAuthMode serves a client connection through agent forwarding,
+// connCtx is cancelled once the client connection is gone
 func (g *Gateway) handleCustomKeyOrNoAuthMode(
+	connCtx context.Context,
 	conn *ssh.ServerConn,
 	chans <-chan ssh.NewChannel,
 	reqs <-chan *ssh.Request,
 	info *registry.DevboxInfo,
 	username string,
+	cio *connIO,
 	logger *log.Entry,
 ) {
 	ctx := &sessionContext{
-		conn:     conn,
-		info:     info,
-		realUser: username,
+		conn:           conn,
+		info:           info,
+		realUser:       username,
+		keyFingerprint: conn.Permissions.Extensions["key_fingerprint"],
+		io:             cio,
+		sessions:       newSessionGate(g.opts().MaxSessionsPerConn),
 		logger: logger.WithFields(log.Fields{
 			"namespace": info.Namespace,
 			"devbox":    info.DevboxName,
@@ -32,29 +192,110 @@ func (g *Gateway) handleCustomKeyOrNoAuthMode(
 		}),
 	}
 
-	go ssh.DiscardRequests(reqs)
+	ctx.agent = g.newAgentBridge(ctx)
+
+	defer ctx.closeBackend()
+
+	go g.handleGlobalRequestsCustomKeyOrNoAuth(reqs, ctx)
 
 	for newChannel := range chans {
-		g.handleChannelCustomKeyOrNoAuth(newChannel, ctx)
+		if !ctx.sessions.admit(newChannel, ctx.logger) {
+			continue
+		}
+
+		go func() {
+			defer ctx.sessions.release(newChannel)
+
+			// Gateway commands are answered without connecting to the backend
+			routed := g.routeSession(connCtx, conn, newChannel, info, ctx.logger)
+			if routed == nil {
+				return
+			}
+
+			g.handleChannelCustomKeyOrNoAuth(connCtx, routed, ctx)
+		}()
+	}
+}
+
+// handleGlobalRequestsCustomKeyOrNoAuth answers client global requests. Keepalives
+// are relayed to the shared backend connection once it exists, so a dead backend
+// shows up on the client, and answered by the gateway before. no-more-sessions is
+// honored by the gateway, other requests are refused.
+func (g *Gateway) handleGlobalRequestsCustomKeyOrNoAuth(
+	reqs <-chan *ssh.Request,
+	ctx *sessionContext,
+) {
+	for req := range reqs {
+		if ctx.sessions.handleRequest(req) {
+			continue
+		}
+
+		if !strings.HasPrefix(req.Type, "keepalive@") {
+			ctx.logger.WithField("request_type", req.Type).Debug("Refusing global request")
+
+			if req.WantReply {
+				_ = req.Reply(false, nil)
+			}
+
+			continue
+		}
+
+		ok := true
+
+		if backend := ctx.currentBackend(); backend != nil {
+			var err error
+
+			ok, _, err = backend.SendRequest(req.Type, req.WantReply, req.Payload)
+			if err != nil {
+				ctx.logger.WithField("request_type", req.Type).
+					WithError(err).
+					Debug("Error relaying keepalive to backend")
+			}
+		}
+
+		if req.WantReply {
+			_ = req.Reply(ok, nil)
+		}
 	}
 }
 
 func (g *Gateway) handleChannelCustomKeyOrNoAuth(
+	connCtx context.Context,
 	newChannel ssh.NewChannel,
 	ctx *sessionContext,
 ) {
 	channelType := newChannel.ChannelType()
-	ctx.logger.WithField("channel_type", channelType).Info("New channel")
+	cio := ctx.io.channel()
+	channelLogger := ctx.logger.WithFields(log.Fields{
+		"channel_type": channelType,
+		"session_id":   cio.id,
+	})
+	channelLogger.Debug("New channel")
+
+	defer cio.audit.auditChannel(cio, channelType)
 
 	switch channelType {
 	case "session":
-		g.handleAgentForwardMode(newChannel, ctx)
+		if g.opts().agentForwardingModeDisabled() {
+			channelLogger.Info("Rejecting session, agent forwarding mode is disabled")
+
+			_ = newChannel.Reject(ssh.Prohibited, ErrAgentForwardingDisabled.Error())
+
+			return
+		}
+
+		g.handleAgentForwardMode(connCtx, newChannel, ctx, cio, channelLogger)
 
 	case "direct-tcpip":
-		g.handleProxyJumpMode(newChannel, ctx)
+		if isPortForward(newChannel) {
+			g.handlePortForward(connCtx, newChannel, ctx, cio, channelLogger)
+			return
+		}
+
+		g.handleProxyJumpMode(connCtx, newChannel, ctx, cio, channelLogger)
 
 	default:
-		ctx.logger.WithField("channel_type", channelType).Warn("Rejecting unknown channel type")
+		channelLogger.Warn("Rejecting unknown channel type")
 
 		_ = newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
 	}
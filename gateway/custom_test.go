@@ -0,0 +1,247 @@
+package gateway_test
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// dialAgentForwardMode connects in custom key mode with a client agent
+// holding the devbox key, so the gateway reaches the backend through agent forwarding
+func dialAgentForwardMode(tb testing.TB, addr string, env *backendTestEnv) *ssh.Client {
+	tb.Helper()
+
+	devboxKey, err := ssh.ParseRawPrivateKey(env.privBytes)
+	if err != nil {
+		tb.Fatalf("Failed to parse private key: %v", err)
+	}
+
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: devboxKey}); err != nil {
+		tb.Fatalf("Failed to add key to keyring: %v", err)
+	}
+
+	return dialWithAgent(tb, addr, keyring)
+}
+
+// dialWithAgent connects to the gateway in agent forwarding mode, forwarding keyring
+func dialWithAgent(tb testing.TB, addr string, keyring agent.Agent) *ssh.Client {
+	tb.Helper()
+
+	// Authenticate to the gateway with a key it doesn't know
+	userSigner, _, _, _ := generateTestKeys(tb)
+
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User: "testuser@test-test-devbox",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(userSigner)},
+		//nolint:gosec // acceptable for testing
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		tb.Fatalf("Failed to dial gateway: %v", err)
+	}
+
+	if err := agent.ForwardToAgent(client, keyring); err != nil {
+		tb.Fatalf("Failed to forward agent: %v", err)
+	}
+
+	return client
+}
+
+func runAgentForwardSession(tb testing.TB, client *ssh.Client) {
+	tb.Helper()
+
+	session, err := client.NewSession()
+	if err != nil {
+		tb.Fatalf("Failed to create session: %v", err)
+	}
+	defer session.Close()
+
+	if err := agent.RequestAgentForwarding(session); err != nil {
+		tb.Fatalf("Failed to request agent forwarding: %v", err)
+	}
+
+	if err := session.Run("exit 0"); err != nil {
+		tb.Fatalf("Session failed: %v", err)
+	}
+}
+
+func TestAgentForwardMode_ReusesBackendConnection(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t)
+
+	client := dialAgentForwardMode(t, addr, env)
+	defer client.Close()
+
+	for range 3 {
+		runAgentForwardSession(t, client)
+	}
+
+	if got := env.backendListener.accepted(); got != 1 {
+		t.Errorf("Backend accepted %d connections, want 1", got)
+	}
+}
+
+func TestAgentForwardMode_ReconnectsDroppedBackend(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t)
+
+	client := dialAgentForwardMode(t, addr, env)
+	defer client.Close()
+
+	runAgentForwardSession(t, client)
+	env.backendListener.dropAll()
+	runAgentForwardSession(t, client)
+
+	if got := env.backendListener.accepted(); got != 2 {
+		t.Errorf("Backend accepted %d connections, want 2", got)
+	}
+}
+
+func BenchmarkAgentForwardMode_FirstSession(b *testing.B) {
+	env := newBackendTestEnv(b)
+	addr := env.start(b)
+
+	for b.Loop() {
+		client := dialAgentForwardMode(b, addr, env)
+		runAgentForwardSession(b, client)
+		client.Close()
+	}
+}
+
+func BenchmarkAgentForwardMode_LaterSessions(b *testing.B) {
+	env := newBackendTestEnv(b)
+	addr := env.start(b)
+
+	client := dialAgentForwardMode(b, addr, env)
+	defer client.Close()
+
+	runAgentForwardSession(b, client)
+
+	for b.Loop() {
+		runAgentForwardSession(b, client)
+	}
+}
+
+// sendKeepalives sends n keepalives at interval like an OpenSSH client with
+// ServerAliveInterval set, failing if one goes unanswered
+func sendKeepalives(t *testing.T, client *ssh.Client, n int, interval time.Duration) {
+	t.Helper()
+
+	for i := range n {
+		if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+			t.Fatalf("Keepalive %d failed: %v", i, err)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+func TestAgentForwardMode_AnswersKeepalives(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t)
+
+	client := dialAgentForwardMode(t, addr, env)
+	defer client.Close()
+
+	ok, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+	if err != nil || !ok {
+		t.Fatalf("Keepalive before backend = %v, %v, want success", ok, err)
+	}
+
+	sendKeepalives(t, client, 10, 10*time.Millisecond)
+
+	// Keepalives are relayed once the backend connection exists
+	runAgentForwardSession(t, client)
+	sendKeepalives(t, client, 10, 10*time.Millisecond)
+	runAgentForwardSession(t, client)
+
+	ok, _, err = client.SendRequest("tcpip-forward", true, ssh.Marshal(struct {
+		Addr string
+		Port uint32
+	}{"127.0.0.1", 0}))
+	if err != nil || ok {
+		t.Errorf("tcpip-forward = %v, %v, want refusal", ok, err)
+	}
+}
+
+// blockingAgent signs only once released, like an agent waiting for a touch
+type blockingAgent struct {
+	agent.Agent
+	release chan struct{}
+}
+
+func (a *blockingAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	<-a.release
+	return a.Agent.Sign(key, data)
+}
+
+func (a *blockingAgent) SignWithFlags(
+	key ssh.PublicKey,
+	data []byte,
+	flags agent.SignatureFlags,
+) (*ssh.Signature, error) {
+	<-a.release
+
+	extended, ok := a.Agent.(agent.ExtendedAgent)
+	if !ok {
+		return a.Agent.Sign(key, data)
+	}
+
+	return extended.SignWithFlags(key, data, flags)
+}
+
+func TestAgentForwardMode_AnswersKeepalivesDuringDial(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t)
+
+	devboxKey, err := ssh.ParseRawPrivateKey(env.privBytes)
+	if err != nil {
+		t.Fatalf("Failed to parse private key: %v", err)
+	}
+
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: devboxKey}); err != nil {
+		t.Fatalf("Failed to add key to keyring: %v", err)
+	}
+
+	blocking := &blockingAgent{
+		Agent:   keyring.(agent.ExtendedAgent),
+		release: make(chan struct{}),
+	}
+
+	client := dialWithAgent(t, addr, blocking)
+	defer client.Close()
+
+	// The session dials the backend, waiting for the agent to sign
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		runAgentForwardSession(t, client)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	answered := make(chan error, 1)
+
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		answered <- err
+	}()
+
+	select {
+	case err := <-answered:
+		if err != nil {
+			t.Errorf("Keepalive during the dial failed: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Keepalive unanswered while the backend was being dialed")
+	}
+
+	close(blocking.release)
+	<-done
+}
@@ -0,0 +1,261 @@
+package gateway_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"golang.org/x/crypto/ssh"
+	"k8s.io/client-go/tools/record"
+)
+
+// memPipe returns both ends of an in-memory connection. Unlike net.Pipe writes
+// are buffered, SSH peers send their version before reading the other's.
+func memPipe() (net.Conn, net.Conn) {
+	a, b := newHalfPipe(), newHalfPipe()
+
+	return &memConn{r: a, w: b}, &memConn{r: b, w: a}
+}
+
+// halfPipe carries the bytes of one direction of a memPipe
+type halfPipe struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    bytes.Buffer
+	closed bool
+}
+
+func newHalfPipe() *halfPipe {
+	p := &halfPipe{}
+	p.cond = sync.NewCond(&p.mu)
+
+	return p
+}
+
+func (p *halfPipe) read(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for p.buf.Len() == 0 && !p.closed {
+		p.cond.Wait()
+	}
+
+	if p.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+
+	return p.buf.Read(b)
+}
+
+func (p *halfPipe) write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return 0, net.ErrClosed
+	}
+
+	p.cond.Broadcast()
+
+	return p.buf.Write(b)
+}
+
+func (p *halfPipe) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	p.cond.Broadcast()
+}
+
+type memConn struct {
+	r, w *halfPipe
+}
+
+func (c *memConn) Read(b []byte) (int, error)  { return c.r.read(b) }
+func (c *memConn) Write(b []byte) (int, error) { return c.w.write(b) }
+
+func (c *memConn) Close() error {
+	c.r.close()
+	c.w.close()
+
+	return nil
+}
+
+func (c *memConn) LocalAddr() net.Addr              { return memAddr{} }
+func (c *memConn) RemoteAddr() net.Addr             { return memAddr{} }
+func (c *memConn) SetDeadline(time.Time) error      { return nil }
+func (c *memConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *memConn) SetWriteDeadline(time.Time) error { return nil }
+
+type memAddr struct{}
+
+func (memAddr) Network() string { return "mem" }
+func (memAddr) String() string  { return "mem" }
+
+// pipeDialer is a gateway.BackendDialer serving every connection with the mock
+// backend over an in-memory pipe
+type pipeDialer struct {
+	config   *ssh.ServerConfig
+	exitCode int
+
+	mu    sync.Mutex
+	addrs []string
+	users []string
+}
+
+func newPipeDialer(t *testing.T, env *backendTestEnv) *pipeDialer {
+	t.Helper()
+
+	return &pipeDialer{config: mockBackendConfig(t, env.backendKey, env.privBytes)}
+}
+
+func (d *pipeDialer) DialSSH(
+	_ context.Context,
+	_, addr string,
+	config *ssh.ClientConfig,
+) (*ssh.Client, error) {
+	d.mu.Lock()
+	d.addrs = append(d.addrs, addr)
+	d.users = append(d.users, config.User)
+	d.mu.Unlock()
+
+	clientConn, serverConn := memPipe()
+
+	go handleMockBackendConnection(serverConn, d.config, d.exitCode)
+
+	conn, chans, reqs, err := ssh.NewClientConn(clientConn, addr, config)
+	if err != nil {
+		clientConn.Close()
+		return nil, err
+	}
+
+	return ssh.NewClient(conn, chans, reqs), nil
+}
+
+func (d *pipeDialer) dialed() ([]string, []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return append([]string(nil), d.addrs...), append([]string(nil), d.users...)
+}
+
+func TestBackendDialer_PublicKeyMode(t *testing.T) {
+	env := newBackendTestEnv(t)
+	dialer := newPipeDialer(t, env)
+	dialer.exitCode = 3
+	addr := env.start(t, gateway.WithBackendDialer(dialer))
+
+	client := dialPublicKeyMode(t, addr, env)
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer session.Close()
+
+	// The default exit code of the pipe backend shows it served the session
+	var exitErr *ssh.ExitError
+	if err := session.Run("true"); !errors.As(err, &exitErr) || exitErr.ExitStatus() != 3 {
+		t.Fatalf("Run() error = %v, want exit status 3", err)
+	}
+
+	addrs, users := dialer.dialed()
+	if len(addrs) != 1 || addrs[0] != net.JoinHostPort("127.0.0.1", strconv.Itoa(env.backendPort)) {
+		t.Errorf("Dialed %v, want the devbox backend address", addrs)
+	}
+
+	if len(users) != 1 || users[0] != "testuser" {
+		t.Errorf("Dialed as %v, want testuser", users)
+	}
+
+	if got := env.backendListener.accepted(); got != 0 {
+		t.Errorf("Backend listener accepted %d connections, want 0", got)
+	}
+}
+
+func TestBackendDialer_AgentForwardMode(t *testing.T) {
+	env := newBackendTestEnv(t)
+	dialer := newPipeDialer(t, env)
+	addr := env.start(t, gateway.WithBackendDialer(dialer))
+
+	client := dialAgentForwardMode(t, addr, env)
+	defer client.Close()
+
+	runAgentForwardSession(t, client)
+	runAgentForwardSession(t, client)
+
+	// Sessions of a connection share one backend connection
+	if addrs, _ := dialer.dialed(); len(addrs) != 1 {
+		t.Errorf("Dialed %d backend connections, want 1", len(addrs))
+	}
+
+	if got := env.backendListener.accepted(); got != 0 {
+		t.Errorf("Backend listener accepted %d connections, want 0", got)
+	}
+}
+
+func TestBackendDial_AbandonedWhenClientDisconnects(t *testing.T) {
+	env := newBackendTestEnv(t)
+	recorder := record.NewFakeRecorder(10)
+
+	// This backend accepts connections but never answers the SSH handshake
+	var lc net.ListenConfig
+
+	stalled, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start stalled backend: %v", err)
+	}
+
+	t.Cleanup(func() { stalled.Close() })
+
+	accepted := make(chan net.Conn, 1)
+
+	go func() {
+		if conn, err := stalled.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+
+	addr := env.start(t,
+		gateway.WithSSHBackendPort(stalled.Addr().(*net.TCPAddr).Port),
+		gateway.WithEventRecorder(recorder, time.Hour),
+	)
+
+	client := dialPublicKeyMode(t, addr, env)
+
+	nextEvent(t, recorder) // connected
+
+	var backendConn net.Conn
+
+	select {
+	case backendConn = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Backend was not dialed")
+	}
+	defer backendConn.Close()
+
+	client.Close()
+
+	// The gateway closes its end well before the 5s backend connect timeout
+	start := time.Now()
+	_ = backendConn.SetReadDeadline(start.Add(time.Second))
+
+	if _, err := io.Copy(io.Discard, backendConn); err != nil {
+		t.Fatalf("Backend socket still open after the client disconnected: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Backend socket closed after %s, want within milliseconds", elapsed)
+	}
+
+	// An abandoned dial is not a backend failure
+	noEvent(t, recorder)
+}
@@ -0,0 +1,67 @@
+package gateway
+
+import "errors"
+
+var (
+	// ErrUnknownKey is returned when the offered public key is not registered
+	// and the username does not select a devbox
+	ErrUnknownKey = errors.New("unknown public key")
+	// ErrKeyRevoked is returned when the offered public key, or the key of the
+	// offered certificate, is on the revocation list
+	ErrKeyRevoked = errors.New("public key revoked")
+	// ErrSourceNotAllowed is returned when the client address is outside the
+	// networks the devbox allows, or the allowed networks of the devbox are invalid
+	ErrSourceNotAllowed = errors.New("client address not allowed")
+	// ErrInvalidUsername is returned when the username cannot be parsed
+	ErrInvalidUsername = errors.New("invalid username format")
+	// ErrDevboxNotFound is returned when the selected devbox does not exist
+	ErrDevboxNotFound = errors.New("devbox not found")
+	// ErrDevboxNotRunning is returned when the selected devbox has no running pod
+	ErrDevboxNotRunning = errors.New("devbox not running")
+	// ErrDevboxStarting is returned when the pod of the selected devbox is not
+	// ready yet, or no longer ready
+	ErrDevboxStarting = errors.New("devbox starting")
+	// ErrInvalidCertificate is returned when a certificate signed by a trusted user CA
+	// fails validation
+	ErrInvalidCertificate = errors.New("invalid user certificate")
+	// ErrAdminAccessDenied is returned when an admin key targets a namespace
+	// denied for admin access
+	ErrAdminAccessDenied = errors.New("admin access denied")
+	// ErrBackendUserDenied is returned when the backend user is not among the
+	// users allowed by the devbox
+	ErrBackendUserDenied = errors.New("backend user not allowed")
+	// ErrAgentForwardingDisabled is returned when a username selects a devbox
+	// with a key it does not know while agent forwarding mode is disabled
+	ErrAgentForwardingDisabled = errors.New(
+		"agent forwarding mode is disabled, register your public key with the devbox",
+	)
+	// ErrAgentOperationDenied is returned for client agent operations the gateway
+	// never forwards to the backend
+	ErrAgentOperationDenied = errors.New("agent operation denied by gateway")
+	// ErrBackendHostKeyRejected is returned when a backend presents a host key
+	// the backend host key policy does not trust
+	ErrBackendHostKeyRejected = errors.New("backend host key rejected")
+	// ErrAuthHelpOnly is returned by the informational keyboard-interactive
+	// callback, which never grants access
+	ErrAuthHelpOnly = errors.New("keyboard-interactive authentication is informational only")
+	// ErrInvalidOTP is returned when the second factor TOTP code is wrong
+	ErrInvalidOTP = errors.New("invalid verification code")
+	// ErrOTPRateLimited is returned when a key failed too many second factor
+	// attempts lately, the code is not checked
+	ErrOTPRateLimited = errors.New("too many failed verification codes")
+	// ErrOTPNotEnrolled is returned when the second factor is required but no
+	// TOTP secret is configured for the key or its namespace
+	ErrOTPNotEnrolled = errors.New("no verification code enrolled")
+	// ErrInvalidToken is returned when an authentication token is malformed,
+	// badly signed or fails a claim check other than its expiry
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrTokenExpired is returned when an authentication token expired, beyond
+	// the allowed clock skew
+	ErrTokenExpired = errors.New("token expired")
+	// ErrTokenKeysUnavailable is returned when the keys verifying authentication
+	// tokens cannot be fetched from the JWKS URL
+	ErrTokenKeysUnavailable = errors.New("token signing keys unavailable")
+	// ErrNoTokenUsername is returned by the "none" authentication method, which
+	// only authenticates usernames carrying a token
+	ErrNoTokenUsername = errors.New("username carries no token")
+)
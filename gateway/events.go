@@ -0,0 +1,162 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zijiren233/sshgate/registry"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// Reasons of the Kubernetes events recorded on Devbox objects
+const (
+	EventReasonConnected         = "SSHConnected"
+	EventReasonAuthFailed        = "SSHAuthFailed"
+	EventReasonBackendDialFailed = "SSHBackendDialFailed"
+	EventReasonHostKeyMismatch   = "SSHHostKeyMismatch"
+)
+
+// eventAuthFailureThreshold is the number of backend authentication failures
+// within an event interval that makes them worth an event
+const eventAuthFailureThreshold = 3
+
+// devboxEvents records Kubernetes events on Devbox objects, at most one per
+// devbox and reason every interval. Occurrences in between are aggregated into
+// the next event. A nil devboxEvents records nothing.
+type devboxEvents struct {
+	recorder record.EventRecorder
+	interval time.Duration
+	logger   *log.Entry
+
+	mu sync.Mutex
+	// namespace/devboxName -> reason -> state
+	states map[string]map[string]*eventState
+}
+
+type eventState struct {
+	// count is the number of occurrences since the last event
+	count int
+	// first is the time of the first occurrence since the last event
+	first time.Time
+	// recorded is the time of the last event
+	recorded time.Time
+}
+
+func newDevboxEvents(
+	recorder record.EventRecorder,
+	interval time.Duration,
+	logger *log.Entry,
+) *devboxEvents {
+	if recorder == nil {
+		return nil
+	}
+
+	return &devboxEvents{
+		recorder: recorder,
+		interval: interval,
+		logger:   logger,
+		states:   make(map[string]map[string]*eventState),
+	}
+}
+
+// record counts an occurrence of reason for a devbox, recording an event once
+// minCount occurrences happened within an interval and no event of the same
+// reason was recorded during the last interval
+func (e *devboxEvents) record(
+	info *registry.DevboxInfo,
+	eventType, reason, message string,
+	minCount int,
+) {
+	if e == nil || info.DevboxRef.Name == "" {
+		return
+	}
+
+	key := info.Namespace + "/" + info.DevboxName
+	now := time.Now()
+
+	e.mu.Lock()
+
+	if e.states[key] == nil {
+		e.states[key] = make(map[string]*eventState)
+	}
+
+	state, ok := e.states[key][reason]
+	if !ok {
+		state = &eventState{}
+		e.states[key][reason] = state
+	}
+
+	// Occurrences too sparse to reach minCount within an interval are forgotten
+	if state.count > 0 && state.count < minCount && now.Sub(state.first) > e.interval {
+		state.count = 0
+	}
+
+	if state.count == 0 {
+		state.first = now
+	}
+
+	state.count++
+
+	if state.count < minCount || now.Sub(state.recorded) < e.interval {
+		e.mu.Unlock()
+		return
+	}
+
+	count := state.count
+	state.count = 0
+	state.recorded = now
+
+	e.mu.Unlock()
+
+	if count > 1 {
+		message = fmt.Sprintf("%s (%d times in the last %s)", message, count, e.interval)
+	}
+
+	e.logger.WithFields(log.Fields{
+		"namespace":  info.Namespace,
+		"devbox":     info.DevboxName,
+		"reason":     reason,
+		"event_type": eventType,
+	}).Info(message)
+
+	e.recorder.Event(&info.DevboxRef, eventType, reason, message)
+}
+
+// handleRegistryEvent forgets the events of deleted devboxes
+func (e *devboxEvents) handleRegistryEvent(event registry.Event) {
+	if event.Type != registry.EventSecretDeleted {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	delete(e.states, event.Namespace+"/"+event.DevboxName)
+}
+
+// recordConnected records a client connection to a devbox
+func (e *devboxEvents) recordConnected(info *registry.DevboxInfo, user, remoteAddr string) {
+	e.record(info, corev1.EventTypeNormal, EventReasonConnected,
+		fmt.Sprintf("SSH connection from %s as %s", remoteAddr, user), 1)
+}
+
+// recordBackendFailure records a failure to connect to the backend of a devbox,
+// telling host key mismatches and rejected credentials from other failures
+func (e *devboxEvents) recordBackendFailure(info *registry.DevboxInfo, err error) {
+	switch {
+	case errors.Is(err, ErrBackendHostKeyRejected):
+		e.record(info, corev1.EventTypeWarning, EventReasonHostKeyMismatch,
+			fmt.Sprintf("Backend host key rejected: %v", err), 1)
+	case strings.Contains(err.Error(), "unable to authenticate"):
+		e.record(info, corev1.EventTypeWarning, EventReasonAuthFailed,
+			"Backend rejected SSH authentication", eventAuthFailureThreshold)
+	default:
+		e.record(info, corev1.EventTypeWarning, EventReasonBackendDialFailed,
+			fmt.Sprintf("Failed to connect to the SSH server: %v", err), 1)
+	}
+}
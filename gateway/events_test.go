@@ -0,0 +1,138 @@
+package gateway_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"k8s.io/client-go/tools/record"
+)
+
+// nextEvent returns the next event of the fake recorder
+func nextEvent(t *testing.T, recorder *record.FakeRecorder) string {
+	t.Helper()
+
+	select {
+	case event := <-recorder.Events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("No Kubernetes event recorded")
+		return ""
+	}
+}
+
+// noEvent checks the fake recorder has no pending event
+func noEvent(t *testing.T, recorder *record.FakeRecorder) {
+	t.Helper()
+
+	select {
+	case event := <-recorder.Events:
+		t.Errorf("Unexpected Kubernetes event %q", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestEvents_ConnectedIsRateLimited(t *testing.T) {
+	env := newBackendTestEnv(t)
+	recorder := record.NewFakeRecorder(10)
+	addr := env.start(t, gateway.WithEventRecorder(recorder, time.Hour))
+
+	runPublicKeySession(t, addr, env, "testuser")
+
+	event := nextEvent(t, recorder)
+	if !strings.HasPrefix(event, "Normal "+gateway.EventReasonConnected+" SSH connection from") ||
+		!strings.Contains(event, "as testuser") {
+		t.Errorf("Event = %q, want a connection by testuser", event)
+	}
+
+	// Later connections within the interval are aggregated into the next event
+	runPublicKeySession(t, addr, env, "testuser")
+	noEvent(t, recorder)
+}
+
+func TestEvents_BackendDialFailed(t *testing.T) {
+	env := newBackendTestEnv(t)
+	recorder := record.NewFakeRecorder(10)
+	addr := env.start(t, gateway.WithEventRecorder(recorder, time.Hour))
+
+	// Nothing listens on the backend port of this address
+	setPodIP(t, env.reg, "127.0.0.2")
+	dialPublicKeyMode(t, addr, env)
+
+	nextEvent(t, recorder) // connected
+
+	event := nextEvent(t, recorder)
+	if !strings.HasPrefix(event, "Warning "+gateway.EventReasonBackendDialFailed) {
+		t.Errorf("Event = %q, want a backend dial failure", event)
+	}
+}
+
+func TestEvents_HostKeyMismatch(t *testing.T) {
+	env := newBackendTestEnv(t)
+	recorder := record.NewFakeRecorder(10)
+
+	_, trusted, _, _ := generateTestKeys(t)
+	addr := env.start(t,
+		gateway.WithEventRecorder(recorder, time.Hour),
+		gateway.WithBackendHostKeyPolicy(
+			gateway.BackendHostKeyPolicyFixed,
+			[]string{string(ssh.MarshalAuthorizedKey(trusted))},
+			nil,
+		),
+	)
+
+	dialPublicKeyMode(t, addr, env)
+
+	nextEvent(t, recorder) // connected
+
+	event := nextEvent(t, recorder)
+	if !strings.HasPrefix(event, "Warning "+gateway.EventReasonHostKeyMismatch) {
+		t.Errorf("Event = %q, want a host key mismatch", event)
+	}
+}
+
+func TestEvents_RepeatedAuthFailures(t *testing.T) {
+	env := newBackendTestEnv(t)
+	recorder := record.NewFakeRecorder(10)
+	addr := env.start(t, gateway.WithEventRecorder(recorder, time.Hour))
+
+	// The forwarded agent holds a key the backend does not accept
+	_, _, _, otherPriv := generateTestKeys(t)
+	env.privBytes = otherPriv
+
+	client := dialAgentForwardMode(t, addr, env)
+	defer client.Close()
+
+	nextEvent(t, recorder) // connected
+
+	for i := range 3 {
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatalf("Failed to create session: %v", err)
+		}
+
+		if err := agent.RequestAgentForwarding(session); err != nil {
+			t.Fatalf("Failed to request agent forwarding: %v", err)
+		}
+
+		if err := session.Run("exit 0"); err == nil {
+			t.Fatal("Session authenticated with a key the backend does not accept")
+		}
+
+		session.Close()
+
+		// A single failure is not worth an event
+		if i == 0 {
+			noEvent(t, recorder)
+		}
+	}
+
+	event := nextEvent(t, recorder)
+	if !strings.HasPrefix(event, "Warning "+gateway.EventReasonAuthFailed) ||
+		!strings.Contains(event, "3 times") {
+		t.Errorf("Event = %q, want 3 aggregated auth failures", event)
+	}
+}
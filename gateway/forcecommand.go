@@ -0,0 +1,73 @@
+package gateway
+
+import (
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// originalCommandEnv passes the command requested by the client to a forced command
+const originalCommandEnv = "SSH_ORIGINAL_COMMAND"
+
+// forceCommandRequests rewrites the shell, exec and subsystem requests of a
+// session into exec requests of the forced command, see forceCommand.
+// Without a forced command the requests are returned as is.
+func (g *Gateway) forceCommandRequests(
+	in <-chan *ssh.Request,
+	backendChannel ssh.Channel,
+	command string,
+	logger *log.Entry,
+) <-chan *ssh.Request {
+	if command == "" {
+		return in
+	}
+
+	out := make(chan *ssh.Request)
+
+	go func() {
+		defer close(out)
+
+		for req := range in {
+			g.forceCommand(req, backendChannel, command, logger)
+			out <- req
+		}
+	}()
+
+	return out
+}
+
+// forceCommand rewrites a shell, exec or subsystem request in place into an exec
+// request of command, like the ForceCommand of sshd. The command or subsystem
+// requested by the client is ignored, but logged and passed to the backend
+// session as SSH_ORIGINAL_COMMAND. PTY and other requests are left untouched.
+func (g *Gateway) forceCommand(
+	req *ssh.Request,
+	backendChannel ssh.Channel,
+	command string,
+	logger *log.Entry,
+) {
+	if command == "" {
+		return
+	}
+
+	switch req.Type {
+	case "shell":
+	case "exec", "subsystem":
+		var original struct{ Command string }
+		if err := ssh.Unmarshal(req.Payload, &original); err != nil {
+			break
+		}
+
+		logger.WithFields(log.Fields{
+			"request_type":     req.Type,
+			"original_command": original.Command,
+			"force_command":    command,
+		}).Info("Ignoring requested command, the devbox forces a command")
+
+		sendEnv(backendChannel, originalCommandEnv, original.Command)
+	default:
+		return
+	}
+
+	req.Type = "exec"
+	req.Payload = ssh.Marshal(struct{ Command string }{command})
+}
@@ -0,0 +1,170 @@
+package gateway_test
+
+import (
+	"io"
+	"testing"
+
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// setForceCommand annotates the secret of the test devbox with a force command
+func setForceCommand(t *testing.T, env *backendTestEnv, command string) {
+	t.Helper()
+
+	signer, err := ssh.ParsePrivateKey(env.privBytes)
+	if err != nil {
+		t.Fatalf("Failed to parse private key: %v", err)
+	}
+
+	secret := testSecret(ssh.MarshalAuthorizedKey(signer.PublicKey()), env.privBytes)
+	secret.Annotations = map[string]string{registry.ForceCommandAnnotation: command}
+
+	if err := env.reg.AddSecret(nil, secret); err != nil {
+		t.Fatalf("Failed to annotate secret: %v", err)
+	}
+}
+
+// runForcedSession runs a session started by start and returns its output
+func runForcedSession(
+	t *testing.T,
+	client *ssh.Client,
+	setup func(*ssh.Session) error,
+	start func(*ssh.Session) error,
+) string {
+	t.Helper()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer session.Close()
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatalf("Failed to open stdout: %v", err)
+	}
+
+	if setup != nil {
+		if err := setup(session); err != nil {
+			t.Fatalf("Failed to set up session: %v", err)
+		}
+	}
+
+	if err := start(session); err != nil {
+		t.Fatalf("Failed to start session: %v", err)
+	}
+
+	// Subsystem sessions are not started for the library, read until EOF
+	output, err := io.ReadAll(stdout)
+	if err != nil {
+		t.Fatalf("Failed to read session output: %v", err)
+	}
+
+	return string(output)
+}
+
+func TestForceCommand_PublicKeyMode(t *testing.T) {
+	env := newBackendTestEnv(t)
+	setForceCommand(t, env, "printenv SSH_ORIGINAL_COMMAND")
+	addr := env.start(t)
+
+	client := dialPublicKeyMode(t, addr, env)
+
+	tests := []struct {
+		name  string
+		setup func(*ssh.Session) error
+		start func(*ssh.Session) error
+		want  string
+	}{
+		{
+			name:  "exec",
+			start: func(s *ssh.Session) error { return s.Start("exit 3") },
+			want:  "exit 3",
+		},
+		{
+			name: "exec with PTY",
+			setup: func(s *ssh.Session) error {
+				return s.RequestPty("xterm", 24, 80, ssh.TerminalModes{})
+			},
+			start: func(s *ssh.Session) error { return s.Start("exit 3") },
+			want:  "exit 3",
+		},
+		{
+			name:  "subsystem",
+			start: func(s *ssh.Session) error { return s.RequestSubsystem("sftp") },
+			want:  "sftp",
+		},
+		{
+			name:  "shell",
+			start: func(s *ssh.Session) error { return s.Shell() },
+			want:  "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := runForcedSession(t, client, tt.setup, tt.start); got != tt.want {
+				t.Errorf("SSH_ORIGINAL_COMMAND = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForceCommand_AgentForwardMode(t *testing.T) {
+	env := newBackendTestEnv(t)
+	setForceCommand(t, env, "printenv SSH_ORIGINAL_COMMAND")
+	addr := env.start(t)
+
+	client := dialAgentForwardMode(t, addr, env)
+	defer client.Close()
+
+	requestAgent := func(s *ssh.Session) error { return agent.RequestAgentForwarding(s) }
+
+	// The first session connects the backend, later ones reuse the connection
+	for range 2 {
+		got := runForcedSession(t, client, requestAgent, func(s *ssh.Session) error {
+			return s.Start("exit 3")
+		})
+		if got != "exit 3" {
+			t.Errorf("SSH_ORIGINAL_COMMAND = %q, want exit 3", got)
+		}
+	}
+}
+
+func TestForceCommand_PodAnnotationTakesPrecedence(t *testing.T) {
+	env := newBackendTestEnv(t)
+	setForceCommand(t, env, "exit 1")
+	addr := env.start(t)
+
+	setPodAnnotations(t, env.reg, map[string]string{
+		registry.ForceCommandAnnotation: "printenv SSH_ORIGINAL_COMMAND",
+	})
+
+	client := dialPublicKeyMode(t, addr, env)
+
+	got := runForcedSession(t, client, nil, func(s *ssh.Session) error {
+		return s.Start("uptime")
+	})
+	if got != "uptime" {
+		t.Errorf("SSH_ORIGINAL_COMMAND = %q, want uptime", got)
+	}
+}
+
+// setPodAnnotations replaces the annotations of the test devbox pod
+func setPodAnnotations(t *testing.T, reg *registry.Registry, annotations map[string]string) {
+	t.Helper()
+
+	pod := &corev1.Pod{Status: corev1.PodStatus{PodIP: "127.0.0.1"}}
+	pod.Name = "test-pod"
+	pod.Namespace = "ns-test"
+	pod.Annotations = annotations
+	pod.Labels = map[string]string{registry.DevboxPartOfLabel: registry.DevboxPartOfValue}
+	pod.OwnerReferences = testSecret(nil, nil).OwnerReferences
+
+	if err := reg.UpdatePod(pod); err != nil {
+		t.Fatalf("Failed to update pod: %v", err)
+	}
+}
@@ -3,43 +3,370 @@
 package gateway
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
+	"github.com/zijiren233/sshgate/logger"
 	"github.com/zijiren233/sshgate/registry"
 	"golang.org/x/crypto/ssh"
+	"k8s.io/client-go/tools/record"
+	metricsv1beta1 "k8s.io/metrics/pkg/client/clientset/versioned/typed/metrics/v1beta1"
 )
 
-// Options holds gateway configuration options
+// Options holds gateway configuration options, read from the configuration as
+// config.GatewayOptions
 type Options struct {
-	SSHHandshakeTimeout            time.Duration `env:"SSH_HANDSHAKE_TIMEOUT"             envDefault:"15s"`
-	SSHBackendPort                 int           `env:"SSH_BACKEND_PORT"                  envDefault:"22"`
-	BackendConnectTimeoutPublicKey time.Duration `env:"BACKEND_CONNECT_TIMEOUT_PUBLICKEY" envDefault:"10s"`
-	BackendConnectTimeoutAgent     time.Duration `env:"BACKEND_CONNECT_TIMEOUT_AGENT"     envDefault:"5s"`
-	ProxyJumpTimeout               time.Duration `env:"PROXY_JUMP_TIMEOUT"                envDefault:"5s"`
-	SessionRequestTimeout          time.Duration `env:"SESSION_REQUEST_TIMEOUT"           envDefault:"3s"`
-	MaxCachedRequests              int           `env:"MAX_CACHED_REQUESTS"               envDefault:"6"`
-	EnableAgentForward             bool          `env:"ENABLE_AGENT_FORWARD"              envDefault:"true"`
-	EnableProxyJump                bool          `env:"ENABLE_PROXY_JUMP"                 envDefault:"true"`
+	SSHHandshakeTimeout                time.Duration
+	SSHBackendPort                     int
+	BackendConnectTimeoutPublicKey     time.Duration
+	BackendConnectTimeoutAgent         time.Duration
+	ProxyJumpTimeout                   time.Duration
+	SessionRequestTimeout              time.Duration
+	MaxCachedRequests                  int
+	MaxSessionsPerConn                 int
+	ServerVersion                      string
+	EnableProxyJump                    bool
+	BackendHostKeyPolicy               string
+	BackendHostKeys                    []string
+	BackendHostCAKeys                  []string
+	MaxAuthTries                       int
+	Banner                             string
+	BannerShowDevboxStatus             bool
+	BannerDevboxStoppedTemplate        string
+	BannerDevboxUnavailableTemplate    string
+	BannerUnknownDevboxTemplate        string
+	BannerInvalidUsernameTemplate      string
+	AuthHelpEnabled                    bool
+	AuthHelpMessage                    string
+	VerboseAuthErrors                  bool
+	AuthFailureMinDuration             time.Duration
+	UserCAKeys                         []string
+	AdminKeys                          []string
+	AdminDeniedNamespaces              []string
+	DefaultBackendUser                 string
+	BackendUserMap                     []string
+	OTPNamespaces                      []string
+	OTPExemptAdmins                    bool
+	OTPSkew                            int
+	OTPMaxFailures                     int
+	OTPLockout                         time.Duration
+	TokenIssuer                        string
+	TokenAudience                      string
+	TokenJWKSURL                       string
+	TokenJWKSRefresh                   time.Duration
+	TokenLeeway                        time.Duration
+	AllowedCIDRsFailOpen               bool
+	DisablePublicKeyMode               bool
+	DisableAgentForwardingMode         bool
+	AgentHelpURL                       string
+	AgentAllowedFingerprints           []string
+	AgentForwardOnward                 string
+	BackendPoolEnabled                 bool
+	BackendPoolMaxIdle                 int
+	BackendPoolIdleTTL                 time.Duration
+	HostKeyUpdatesEnabled              bool
+	TCPKeepAlivePeriod                 time.Duration
+	TCPNoDelay                         bool
+	BandwidthLimit                     string
+	BandwidthLimitBurst                string
+	BandwidthLimitNamespaces           []string
+	SessionIDEnv                       string
+	ClientEnv                          bool
+	TerminateRevokedConns              bool
+	TerminateRestartedPodConns         bool
+	SessionRecordingEnabled            bool
+	SessionRecordingNamespaces         []string
+	SessionRecordingDir                string
+	SessionRecordingMaxSize            string
+	BackendHealthCheckEnabled          bool
+	BackendHealthCheckInterval         time.Duration
+	BackendHealthCheckTimeout          time.Duration
+	BackendHealthCheckConcurrency      int
+	BackendHealthCheckFailureThreshold int
+	AuditLogSessions                   bool
+	KubernetesEventInterval            time.Duration
+	SFTPOnly                           bool
+	ClientErrorDetails                 bool
+	DisabledGatewayCommands            []string
+	MaskBackendAddress                 bool
+	MOTDEnabled                        bool
+	MOTDTemplate                       string
+	MOTDResourceUsage                  bool
+	MOTDResourceUsageTimeout           time.Duration
+	ClusterProxies                     []string
+	HostCertificateExpiryWarning       time.Duration
+	// HostCertificate presents an OpenSSH host certificate of the host key of
+	// New, along with the plain host keys
+	HostCertificate ssh.Signer
+	// HostKeys are served for handshakes along with the host key of New, one per
+	// type, for clients that don't accept its type
+	HostKeys []ssh.Signer
+	// PreviousHostKeys are served for handshakes in place of the keys of their
+	// type until HostKeyGraceUntil, for clients that pinned them before a
+	// rotation
+	PreviousHostKeys  []ssh.Signer
+	HostKeyGraceUntil time.Time
+	// AdditionalHostKeys are advertised to clients along with the serving host key
+	// when host key updates are enabled, they are not used for handshakes
+	AdditionalHostKeys []ssh.Signer
+	// BackendDialer connects to devbox SSH servers, nil dials TCP sockets
+	BackendDialer BackendDialer
+	// SessionRecorder stores session recordings, nil writes them under
+	// SessionRecordingDir when it is set
+	SessionRecorder SessionRecorder
+	// AuditLogger receives the audit records of connections, nil disables them
+	AuditLogger *log.Logger
+	// EventRecorder records Kubernetes events on Devbox objects, nil disables them
+	EventRecorder record.EventRecorder
+	// PodMetrics looks up the resource usage of devbox pods in metrics-server for
+	// the MOTD, nil disables it
+	PodMetrics metricsv1beta1.PodMetricsesGetter
+	// LogLimiter rate limits the logs of failures repeated as clients retry,
+	// nil writes them all
+	LogLimiter *logger.Limiter
+	// Metrics registers the gateway metrics, nil exposes none
+	Metrics prometheus.Registerer
+	// EnableAgentForward false disables agent forwarding mode as
+	// DisableAgentForwardingMode does.
+	//
+	// Deprecated: use DisableAgentForwardingMode.
+	EnableAgentForward bool
 }
 
 // DefaultOptions returns the default gateway options
 func DefaultOptions() Options {
 	return Options{
-		SSHHandshakeTimeout:            15 * time.Second,
-		SSHBackendPort:                 22,
-		BackendConnectTimeoutPublicKey: 10 * time.Second,
-		BackendConnectTimeoutAgent:     5 * time.Second,
-		ProxyJumpTimeout:               5 * time.Second,
-		SessionRequestTimeout:          3 * time.Second,
-		MaxCachedRequests:              6,
-		EnableAgentForward:             true,
-		EnableProxyJump:                true,
+		SSHHandshakeTimeout:                15 * time.Second,
+		SSHBackendPort:                     22,
+		BackendConnectTimeoutPublicKey:     10 * time.Second,
+		BackendConnectTimeoutAgent:         5 * time.Second,
+		ProxyJumpTimeout:                   5 * time.Second,
+		SessionRequestTimeout:              3 * time.Second,
+		MaxCachedRequests:                  6,
+		EnableAgentForward:                 true,
+		EnableProxyJump:                    true,
+		BackendHostKeyPolicy:               BackendHostKeyPolicyInsecure,
+		MaxAuthTries:                       6,
+		BannerDevboxStoppedTemplate:        DefaultBannerDevboxStoppedTemplate,
+		BannerDevboxUnavailableTemplate:    DefaultBannerDevboxUnavailableTemplate,
+		BannerUnknownDevboxTemplate:        DefaultBannerUnknownDevboxTemplate,
+		BannerInvalidUsernameTemplate:      DefaultBannerInvalidUsernameTemplate,
+		AuthHelpEnabled:                    true,
+		OTPSkew:                            1,
+		OTPMaxFailures:                     5,
+		OTPLockout:                         5 * time.Minute,
+		TokenJWKSRefresh:                   15 * time.Minute,
+		TokenLeeway:                        30 * time.Second,
+		AgentForwardOnward:                 AgentForwardOnwardOff,
+		BackendPoolMaxIdle:                 2,
+		BackendPoolIdleTTL:                 2 * time.Minute,
+		TCPKeepAlivePeriod:                 30 * time.Second,
+		TCPNoDelay:                         true,
+		BandwidthLimitBurst:                "256K",
+		ClientEnv:                          true,
+		TerminateRevokedConns:              true,
+		TerminateRestartedPodConns:         true,
+		SessionRecordingMaxSize:            "64M",
+		BackendHealthCheckInterval:         30 * time.Second,
+		BackendHealthCheckTimeout:          3 * time.Second,
+		BackendHealthCheckConcurrency:      16,
+		BackendHealthCheckFailureThreshold: 3,
+		HostCertificateExpiryWarning:       7 * 24 * time.Hour,
+		KubernetesEventInterval:            10 * time.Minute,
+		MOTDTemplate:                       DefaultMOTDTemplate,
+		MOTDResourceUsageTimeout:           300 * time.Millisecond,
 	}
 }
 
+// agentForwardingModeDisabled reports whether agent forwarding mode is disabled,
+// by DisableAgentForwardingMode or the deprecated EnableAgentForward
+func (o *Options) agentForwardingModeDisabled() bool {
+	return o.DisableAgentForwardingMode || !o.EnableAgentForward
+}
+
+// Validate validates the gateway options
+func (o *Options) Validate() error {
+	if o.DisablePublicKeyMode && o.agentForwardingModeDisabled() {
+		return errors.New(
+			"public key mode and agent forwarding mode cannot both be disabled " +
+				"(DISABLE_PUBLIC_KEY_MODE and DISABLE_AGENT_FORWARDING_MODE, " +
+				"or the deprecated ENABLE_AGENT_FORWARD=false)",
+		)
+	}
+
+	for name, timeout := range map[string]time.Duration{
+		"SSH handshake timeout":              o.SSHHandshakeTimeout,
+		"public key backend connect timeout": o.BackendConnectTimeoutPublicKey,
+		"agent backend connect timeout":      o.BackendConnectTimeoutAgent,
+		"proxy jump timeout":                 o.ProxyJumpTimeout,
+		"session request timeout":            o.SessionRequestTimeout,
+		"MOTD resource usage timeout":        o.MOTDResourceUsageTimeout,
+		"OTP lockout":                        o.OTPLockout,
+		"token leeway":                       o.TokenLeeway,
+		"auth failure min duration":          o.AuthFailureMinDuration,
+		"host certificate expiry warning":    o.HostCertificateExpiryWarning,
+	} {
+		if timeout < 0 {
+			return fmt.Errorf("invalid %s: %s must not be negative", name, timeout)
+		}
+	}
+
+	if o.SSHBackendPort < 1 || o.SSHBackendPort > 65535 {
+		return fmt.Errorf("invalid SSH backend port: %d", o.SSHBackendPort)
+	}
+
+	if o.MaxCachedRequests < 0 {
+		return fmt.Errorf("invalid max cached requests: %d", o.MaxCachedRequests)
+	}
+
+	if o.TokenJWKSURL != "" {
+		if o.TokenIssuer == "" || o.TokenAudience == "" {
+			return errors.New("token authentication requires an issuer and an audience")
+		}
+
+		if o.TokenJWKSRefresh <= 0 {
+			return fmt.Errorf("invalid token JWKS refresh: %s must be positive", o.TokenJWKSRefresh)
+		}
+
+		// Token sessions authenticate to the backend with the devbox private key
+		if o.DisablePublicKeyMode {
+			return errors.New(
+				"token authentication requires public key mode (DISABLE_PUBLIC_KEY_MODE)",
+			)
+		}
+	}
+
+	if o.OTPSkew < 0 {
+		return fmt.Errorf("invalid OTP skew: %d", o.OTPSkew)
+	}
+
+	if o.OTPMaxFailures < 0 {
+		return fmt.Errorf("invalid OTP max failures: %d", o.OTPMaxFailures)
+	}
+
+	if o.MaxSessionsPerConn < 0 {
+		return fmt.Errorf("invalid max sessions per connection: %d", o.MaxSessionsPerConn)
+	}
+
+	if o.ServerVersion != "" && !strings.HasPrefix(o.ServerVersion, "SSH-2.0-") {
+		return fmt.Errorf(
+			"invalid SSH server version %q, must start with SSH-2.0-",
+			o.ServerVersion,
+		)
+	}
+
+	if o.BackendPoolEnabled && (o.BackendPoolMaxIdle < 1 || o.BackendPoolIdleTTL <= 0) {
+		return fmt.Errorf(
+			"invalid backend pool: max idle %d and idle TTL %s must be positive",
+			o.BackendPoolMaxIdle,
+			o.BackendPoolIdleTTL,
+		)
+	}
+
+	if err := o.validateBackendHealthCheck(); err != nil {
+		return err
+	}
+
+	if err := o.validateSessionRecording(); err != nil {
+		return err
+	}
+
+	if o.EventRecorder != nil && o.KubernetesEventInterval <= 0 {
+		return fmt.Errorf("invalid Kubernetes event interval: %s", o.KubernetesEventInterval)
+	}
+
+	if err := validateAgentForwardOnward(o.AgentForwardOnward); err != nil {
+		return err
+	}
+
+	if _, err := parseBackendUserMap(o.BackendUserMap); err != nil {
+		return err
+	}
+
+	for _, name := range o.DisabledGatewayCommands {
+		if _, ok := gatewayCommands[name]; !ok {
+			return fmt.Errorf("invalid disabled gateway command: unknown command %q", name)
+		}
+	}
+
+	if _, err := newBackendHostKeyVerifier(o); err != nil {
+		return err
+	}
+
+	if _, err := parseAuthorizedKeys(o.UserCAKeys); err != nil {
+		return fmt.Errorf("invalid user CA key: %w", err)
+	}
+
+	if _, err := parseAuthorizedKeys(o.AdminKeys); err != nil {
+		return fmt.Errorf("invalid admin key: %w", err)
+	}
+
+	if _, err := parseBandwidthPolicy(o); err != nil {
+		return err
+	}
+
+	if _, err := parseClusterProxies(o.ClusterProxies); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (o *Options) validateBackendHealthCheck() error {
+	if !o.BackendHealthCheckEnabled {
+		return nil
+	}
+
+	if o.BackendHealthCheckInterval <= 0 || o.BackendHealthCheckTimeout <= 0 {
+		return fmt.Errorf(
+			"invalid backend health check: interval %s and timeout %s must be positive",
+			o.BackendHealthCheckInterval,
+			o.BackendHealthCheckTimeout,
+		)
+	}
+
+	if o.BackendHealthCheckConcurrency < 1 {
+		return fmt.Errorf(
+			"invalid backend health check concurrency: %d",
+			o.BackendHealthCheckConcurrency,
+		)
+	}
+
+	// A single transient failure must never mark a backend unreachable
+	if o.BackendHealthCheckFailureThreshold < 2 {
+		return fmt.Errorf(
+			"invalid backend health check failure threshold: %d, must be at least 2",
+			o.BackendHealthCheckFailureThreshold,
+		)
+	}
+
+	return nil
+}
+
+func (o *Options) validateSessionRecording() error {
+	if _, err := parseByteSize(o.SessionRecordingMaxSize); err != nil {
+		return fmt.Errorf("invalid session recording max size: %w", err)
+	}
+
+	recorded := o.SessionRecordingEnabled || len(o.SessionRecordingNamespaces) > 0
+	if recorded && o.SessionRecordingDir == "" && o.SessionRecorder == nil {
+		return errors.New(
+			"session recording requires a recording directory (SESSION_RECORDING_DIR)",
+		)
+	}
+
+	return nil
+}
+
 // Option is a functional option for configuring Gateway
 type Option func(*Options)
 
@@ -79,6 +406,48 @@ func WithProxyJumpTimeout(timeout time.Duration) Option {
 	}
 }
 
+// WithTCPKeepAlive sets the TCP keepalive period of client and backend sockets,
+// a negative period disables keepalives
+func WithTCPKeepAlive(period time.Duration) Option {
+	return func(o *Options) {
+		o.TCPKeepAlivePeriod = period
+	}
+}
+
+// WithTCPNoDelay sets whether client and backend sockets disable Nagle's algorithm
+func WithTCPNoDelay(noDelay bool) Option {
+	return func(o *Options) {
+		o.TCPNoDelay = noDelay
+	}
+}
+
+// WithBandwidthLimit sets the per-connection bandwidth limit, in bytes per second
+// with an optional K, M or G suffix, the burst allowance and namespace=limit
+// overrides. A limit of 0 or "" leaves connections unlimited.
+func WithBandwidthLimit(limit, burst string, namespaceLimits []string) Option {
+	return func(o *Options) {
+		o.BandwidthLimit = limit
+		o.BandwidthLimitBurst = burst
+		o.BandwidthLimitNamespaces = namespaceLimits
+	}
+}
+
+// WithSessionIDEnv sets the environment variable passing the session ID to backend
+// sessions, empty disables it
+func WithSessionIDEnv(name string) Option {
+	return func(o *Options) {
+		o.SessionIDEnv = name
+	}
+}
+
+// WithClientEnv sets whether backend sessions are passed the client address and
+// the connection ID in ClientAddrEnv and ConnIDEnv
+func WithClientEnv(enable bool) Option {
+	return func(o *Options) {
+		o.ClientEnv = enable
+	}
+}
+
 // WithSessionRequestTimeout sets the session request timeout
 func WithSessionRequestTimeout(timeout time.Duration) Option {
 	return func(o *Options) {
@@ -93,10 +462,26 @@ func WithMaxCachedRequests(maxRequests int) Option {
 	}
 }
 
-// WithEnableAgentForward sets whether agent forwarding is enabled
-func WithEnableAgentForward(enable bool) Option {
+// WithBackendDialer sets how the gateway connects to devbox SSH servers
+func WithBackendDialer(dialer BackendDialer) Option {
 	return func(o *Options) {
-		o.EnableAgentForward = enable
+		o.BackendDialer = dialer
+	}
+}
+
+// WithMaxSessionsPerConn limits the concurrent session channels of a client
+// connection, 0 means unlimited
+func WithMaxSessionsPerConn(maxSessions int) Option {
+	return func(o *Options) {
+		o.MaxSessionsPerConn = maxSessions
+	}
+}
+
+// WithServerVersion sets the SSH version string announced to clients,
+// empty keeps the library default
+func WithServerVersion(version string) Option {
+	return func(o *Options) {
+		o.ServerVersion = version
 	}
 }
 
@@ -107,17 +492,515 @@ func WithEnableProxyJump(enable bool) Option {
 	}
 }
 
+// WithBackendHostKeyPolicy sets how backend host keys are verified.
+// keys holds authorized_keys formatted host keys for the fixed policy,
+// caKeys holds authorized_keys formatted CA keys for the ca policy.
+func WithBackendHostKeyPolicy(policy string, keys, caKeys []string) Option {
+	return func(o *Options) {
+		o.BackendHostKeyPolicy = policy
+		o.BackendHostKeys = keys
+		o.BackendHostCAKeys = caKeys
+	}
+}
+
+// WithMaxAuthTries sets the maximum number of authentication attempts per connection.
+// A negative value means unlimited attempts.
+func WithMaxAuthTries(tries int) Option {
+	return func(o *Options) {
+		o.MaxAuthTries = tries
+	}
+}
+
+// WithBanner sets the generic pre-authentication banner
+func WithBanner(banner string) Option {
+	return func(o *Options) {
+		o.Banner = banner
+	}
+}
+
+// WithBannerShowDevboxStatus sets whether the banner reveals the state of the devbox
+// selected by the username to unauthenticated clients
+func WithBannerShowDevboxStatus(show bool) Option {
+	return func(o *Options) {
+		o.BannerShowDevboxStatus = show
+	}
+}
+
+// WithBannerTemplates sets the devbox status banner templates.
+// Templates support the {user}, {namespace} and {devbox} placeholders.
+func WithBannerTemplates(stopped, unknownDevbox, invalidUsername string) Option {
+	return func(o *Options) {
+		o.BannerDevboxStoppedTemplate = stopped
+		o.BannerUnknownDevboxTemplate = unknownDevbox
+		o.BannerInvalidUsernameTemplate = invalidUsername
+	}
+}
+
+// WithBannerDevboxUnavailableTemplate sets the banner template of devboxes that
+// should be running but have no pod, it supports the same placeholders as
+// WithBannerTemplates
+func WithBannerDevboxUnavailableTemplate(template string) Option {
+	return func(o *Options) {
+		o.BannerDevboxUnavailableTemplate = template
+	}
+}
+
+// WithAuthHelp sets whether the keyboard-interactive help is presented after public key
+// authentication has been refused. An empty message uses DefaultAuthHelpMessage,
+// messages support the {user}, {namespace} and {devbox} placeholders.
+func WithAuthHelp(enable bool, message string) Option {
+	return func(o *Options) {
+		o.AuthHelpEnabled = enable
+		o.AuthHelpMessage = message
+	}
+}
+
+// WithUserCAKeys sets the authorized_keys formatted CA keys trusted to sign user certificates
+func WithUserCAKeys(keys []string) Option {
+	return func(o *Options) {
+		o.UserCAKeys = keys
+	}
+}
+
+// WithAdminKeys sets the authorized_keys formatted admin keys that can reach any devbox,
+// except those in deniedNamespaces
+func WithAdminKeys(keys, deniedNamespaces []string) Option {
+	return func(o *Options) {
+		o.AdminKeys = keys
+		o.AdminDeniedNamespaces = deniedNamespaces
+	}
+}
+
+// WithDisablePublicKeyMode sets whether public key mode is disabled. When disabled
+// the gateway never authenticates to backends with devbox private keys and every
+// session goes through agent forwarding.
+func WithDisablePublicKeyMode(disable bool) Option {
+	return func(o *Options) {
+		o.DisablePublicKeyMode = disable
+	}
+}
+
+// WithEnableAgentForward sets whether agent forwarding mode is enabled.
+//
+// Deprecated: use WithDisableAgentForwardingMode.
+func WithEnableAgentForward(enable bool) Option {
+	return func(o *Options) {
+		o.EnableAgentForward = enable
+	}
+}
+
+// WithDisableAgentForwardingMode sets whether agent forwarding mode is disabled.
+// When disabled, clients whose key the devbox does not know are refused at
+// authentication, and agent forwarding requests of clients are never forwarded
+// to backends.
+func WithDisableAgentForwardingMode(disable bool) Option {
+	return func(o *Options) {
+		o.DisableAgentForwardingMode = disable
+	}
+}
+
+// WithAgentHelpURL sets the documentation URL shown when agent forwarding fails
+func WithAgentHelpURL(url string) Option {
+	return func(o *Options) {
+		o.AgentHelpURL = url
+	}
+}
+
+// WithAgentAllowedFingerprints sets the SHA256 fingerprints of client agent identities
+// always offered to backends, in addition to the key the client authenticated with
+// and the devbox's registered key
+func WithAgentAllowedFingerprints(fingerprints []string) Option {
+	return func(o *Options) {
+		o.AgentAllowedFingerprints = fingerprints
+	}
+}
+
+// WithAgentForwardOnward sets whether the agent of agent forwarding mode clients
+// is forwarded onward into backend sessions asking for it: off, filtered to the
+// identities offered to the backend, see WithAgentAllowedFingerprints, or all.
+func WithAgentForwardOnward(mode string) Option {
+	return func(o *Options) {
+		o.AgentForwardOnward = mode
+	}
+}
+
+// WithBackendPool sets whether public key mode backend connections are pooled per
+// devbox and backend user, keeping at most maxIdle idle connections for idleTTL
+func WithBackendPool(enable bool, maxIdle int, idleTTL time.Duration) Option {
+	return func(o *Options) {
+		o.BackendPoolEnabled = enable
+		o.BackendPoolMaxIdle = maxIdle
+		o.BackendPoolIdleTTL = idleTTL
+	}
+}
+
+// WithBackendHealthCheck sets whether the backend of every running devbox is probed
+// each interval, with at most concurrency probes in flight. A backend is marked
+// unreachable after failureThreshold consecutive failed probes, at least 2, and
+// connections to it are refused until a probe succeeds again.
+func WithBackendHealthCheck(
+	enable bool,
+	interval, timeout time.Duration,
+	concurrency, failureThreshold int,
+) Option {
+	return func(o *Options) {
+		o.BackendHealthCheckEnabled = enable
+		o.BackendHealthCheckInterval = interval
+		o.BackendHealthCheckTimeout = timeout
+		o.BackendHealthCheckConcurrency = concurrency
+		o.BackendHealthCheckFailureThreshold = failureThreshold
+	}
+}
+
+// WithTerminateRevokedConns sets whether established connections to a devbox are
+// closed when its secret is deleted or its public key replaced, and connections
+// authenticated with a key added to the revocation list. When disabled the
+// revocation is only logged.
+func WithTerminateRevokedConns(terminate bool) Option {
+	return func(o *Options) {
+		o.TerminateRevokedConns = terminate
+	}
+}
+
+// WithTerminateRestartedPodConns sets whether established connections to a devbox
+// are closed when its pod is deleted or gets another IP, ending their sessions with
+// PodRestartedExitStatus. When disabled they hang until their backend connections
+// time out.
+func WithTerminateRestartedPodConns(terminate bool) Option {
+	return func(o *Options) {
+		o.TerminateRestartedPodConns = terminate
+	}
+}
+
+// WithSessionRecording sets whether interactive sessions are recorded, either all
+// of them when enable is set or those to the given namespaces. Devboxes can opt in
+// with the registry.SessionRecordingAnnotation annotation. Recordings are
+// written under dir, or to the recorder set with WithSessionRecorder, and stop
+// at maxSize, with an optional K, M or G suffix. An empty or 0 size is unlimited.
+func WithSessionRecording(enable bool, namespaces []string, dir, maxSize string) Option {
+	return func(o *Options) {
+		o.SessionRecordingEnabled = enable
+		o.SessionRecordingNamespaces = namespaces
+		o.SessionRecordingDir = dir
+		o.SessionRecordingMaxSize = maxSize
+	}
+}
+
+// WithSessionRecorder sets the sink of session recordings, replacing the
+// recording directory
+func WithSessionRecorder(recorder SessionRecorder) Option {
+	return func(o *Options) {
+		o.SessionRecorder = recorder
+	}
+}
+
+// WithLogLimiter sets the limiter of the logs of failures repeated as clients
+// retry, such as failures to connect to a backend
+func WithLogLimiter(limiter *logger.Limiter) Option {
+	return func(o *Options) {
+		o.LogLimiter = limiter
+	}
+}
+
+// WithMetrics registers the gateway metrics, such as the backend pool hits and
+// misses, on registerer, they are not exposed otherwise
+func WithMetrics(registerer prometheus.Registerer) Option {
+	return func(o *Options) {
+		o.Metrics = registerer
+	}
+}
+
+// WithAuditLogger sets the logger receiving an audit record per connection, and
+// per channel when sessions is set. See connAudit for the record schema.
+func WithAuditLogger(logger *log.Logger, sessions bool) Option {
+	return func(o *Options) {
+		o.AuditLogger = logger
+		o.AuditLogSessions = sessions
+	}
+}
+
+// WithEventRecorder sets the recorder of the Kubernetes events emitted on Devbox
+// objects, and the minimum interval between two events of the same reason about
+// a devbox. Occurrences in between are aggregated into the next event.
+func WithEventRecorder(recorder record.EventRecorder, interval time.Duration) Option {
+	return func(o *Options) {
+		o.EventRecorder = recorder
+		o.KubernetesEventInterval = interval
+	}
+}
+
+// WithSFTPOnly sets whether connections are restricted to the sftp subsystem by
+// default: shells, commands and forwarding are rejected. Devboxes override the
+// default with the registry.SFTPOnlyAnnotation annotation.
+func WithSFTPOnly(sftpOnly bool) Option {
+	return func(o *Options) {
+		o.SFTPOnly = sftpOnly
+	}
+}
+
+// WithClientErrorDetails sets whether the messages explaining failures to clients
+// carry the underlying error, which may reveal internal details like pod IPs
+func WithClientErrorDetails(enable bool) Option {
+	return func(o *Options) {
+		o.ClientErrorDetails = enable
+	}
+}
+
+// WithDisabledGatewayCommands sets the gateway commands, like list, that are not
+// answered by the gateway but run on the devbox like any other command
+func WithDisabledGatewayCommands(names []string) Option {
+	return func(o *Options) {
+		o.DisabledGatewayCommands = names
+	}
+}
+
+// WithMaskBackendAddress sets whether backend addresses, which reveal pod IPs,
+// are hidden from the clients running the info command
+func WithMaskBackendAddress(mask bool) Option {
+	return func(o *Options) {
+		o.MaskBackendAddress = mask
+	}
+}
+
+// WithMOTD sets whether PTY shell sessions start with a MOTD describing the
+// devbox, and its template. Devbox annotations override the template.
+func WithMOTD(enable bool, template string) Option {
+	return func(o *Options) {
+		o.MOTDEnabled = enable
+		o.MOTDTemplate = template
+	}
+}
+
+// WithMOTDResourceUsage sets the metrics-server client looking up the CPU and
+// memory usage of devboxes, appended to their MOTD, and the timeout of lookups.
+// The usage is shown when podMetrics is not nil.
+func WithMOTDResourceUsage(
+	podMetrics metricsv1beta1.PodMetricsesGetter,
+	timeout time.Duration,
+) Option {
+	return func(o *Options) {
+		o.MOTDResourceUsage = podMetrics != nil
+		o.MOTDResourceUsageTimeout = timeout
+		o.PodMetrics = podMetrics
+	}
+}
+
+// WithOTP sets the namespaces whose devboxes require a TOTP code after public key
+// authentication, asked for through keyboard-interactive authentication, and
+// whether admin keys are exempted. The TOTP secrets are read from the registry,
+// see registry.WithOTPSecret.
+func WithOTP(namespaces []string, exemptAdmins bool) Option {
+	return func(o *Options) {
+		o.OTPNamespaces = namespaces
+		o.OTPExemptAdmins = exemptAdmins
+	}
+}
+
+// WithOTPSkew sets how many 30 second steps TOTP codes may be off by, in either
+// direction, to allow for clock skew
+func WithOTPSkew(steps int) Option {
+	return func(o *Options) {
+		o.OTPSkew = steps
+	}
+}
+
+// WithOTPRateLimit sets how many TOTP codes a key, a devbox or a client address
+// may fail in a row before its attempts are refused, until it made none for the
+// lockout duration. Zero maxFailures leaves attempts unlimited.
+func WithOTPRateLimit(maxFailures int, lockout time.Duration) Option {
+	return func(o *Options) {
+		o.OTPMaxFailures = maxFailures
+		o.OTPLockout = lockout
+	}
+}
+
+// WithTokenAuth enables authentication with JWTs issued by issuer for audience,
+// verified with the keys of the JWKS at jwksURL. Tokens are passed as the
+// password or in the username, as in token:<jwt>, and select the devbox with
+// their namespace and devbox claims.
+func WithTokenAuth(issuer, audience, jwksURL string) Option {
+	return func(o *Options) {
+		o.TokenIssuer = issuer
+		o.TokenAudience = audience
+		o.TokenJWKSURL = jwksURL
+	}
+}
+
+// WithTokenLeeway sets how far off the clock of the token issuer may be when
+// checking the expiry and not before times of tokens
+func WithTokenLeeway(leeway time.Duration) Option {
+	return func(o *Options) {
+		o.TokenLeeway = leeway
+	}
+}
+
+// WithTokenJWKSRefresh sets how long the keys fetched from the JWKS URL are
+// cached. Tokens signed by an unknown key fetch them again sooner.
+func WithTokenJWKSRefresh(refresh time.Duration) Option {
+	return func(o *Options) {
+		o.TokenJWKSRefresh = refresh
+	}
+}
+
+// WithAllowedCIDRsFailOpen sets whether devboxes whose allowed CIDRs annotation
+// does not parse accept clients from any address, instead of refusing them all
+func WithAllowedCIDRsFailOpen(failOpen bool) Option {
+	return func(o *Options) {
+		o.AllowedCIDRsFailOpen = failOpen
+	}
+}
+
+// WithVerboseAuthErrors sets whether clients are told why their authentication
+// attempts are refused, such as an unknown key or devbox. Without it every
+// refusal looks the same, so that clients cannot enumerate devboxes. Meant for
+// private clusters.
+func WithVerboseAuthErrors(verbose bool) Option {
+	return func(o *Options) {
+		o.VerboseAuthErrors = verbose
+	}
+}
+
+// WithAuthFailureMinDuration pads refused authentication attempts to take at
+// least d, so that their timing does not tell devbox lookups apart
+func WithAuthFailureMinDuration(d time.Duration) Option {
+	return func(o *Options) {
+		o.AuthFailureMinDuration = d
+	}
+}
+
+// WithDefaultBackendUser sets the user clients log into devboxes as, whatever
+// user they claim, unless a devbox annotates its own or a backend user map rule
+// applies
+func WithDefaultBackendUser(user string) Option {
+	return func(o *Options) {
+		o.DefaultBackendUser = user
+	}
+}
+
+// WithBackendUserMap sets the rules mapping the users claimed by clients to the
+// users logging into devboxes, see BACKEND_USER_MAP
+func WithBackendUserMap(rules ...string) Option {
+	return func(o *Options) {
+		o.BackendUserMap = rules
+	}
+}
+
+// WithHostKeyUpdates sets whether host keys are advertised to clients after the
+// handshake with hostkeys-00@openssh.com, letting OpenSSH clients with UpdateHostKeys
+// learn rotated keys
+func WithHostKeyUpdates(enable bool) Option {
+	return func(o *Options) {
+		o.HostKeyUpdatesEnabled = enable
+	}
+}
+
+// WithClusterProxies sets the SOCKS5 proxies the devboxes of remote clusters are
+// dialed through, as cluster=host:port entries. Remote clusters without a proxy
+// are dialed directly, like the cluster of the gateway.
+func WithClusterProxies(proxies ...string) Option {
+	return func(o *Options) {
+		o.ClusterProxies = proxies
+	}
+}
+
+// WithHostKeys sets host keys of other types served along with the host key of
+// New. Keys of a type already served are ignored.
+func WithHostKeys(keys ...ssh.Signer) Option {
+	return func(o *Options) {
+		o.HostKeys = keys
+	}
+}
+
+// WithPreviousHostKeys sets the host keys of a rotation, most recent first, served
+// in place of the keys of their type until the grace period ends. Meanwhile
+// clients with host key updates are told about the new keys too.
+func WithPreviousHostKeys(until time.Time, keys ...ssh.Signer) Option {
+	return func(o *Options) {
+		o.PreviousHostKeys = keys
+		o.HostKeyGraceUntil = until
+	}
+}
+
+// WithHostCertificate presents the OpenSSH host certificate of cert, a signer of
+// ssh.NewCertSigner certifying the host key of New, to clients trusting its CA.
+// Its expiry is checked while serving, warning from the expiry warning threshold.
+func WithHostCertificate(cert ssh.Signer) Option {
+	return func(o *Options) {
+		o.HostCertificate = cert
+	}
+}
+
+// WithHostCertificateExpiryWarning sets how long before the expiry of the host
+// certificate warnings are logged, 0 disables them
+func WithHostCertificateExpiryWarning(threshold time.Duration) Option {
+	return func(o *Options) {
+		o.HostCertificateExpiryWarning = threshold
+	}
+}
+
+// WithAdditionalHostKeys sets host keys advertised along with the serving host key,
+// typically the next key of a rotation
+func WithAdditionalHostKeys(keys ...ssh.Signer) Option {
+	return func(o *Options) {
+		o.AdditionalHostKeys = keys
+	}
+}
+
 // Gateway handles SSH connections and routes them to backend devbox pods
 type Gateway struct {
-	sshConfig *ssh.ServerConfig
-	registry  *registry.Registry
-	options   *Options
-	parser    *UsernameParser
-	logger    *log.Entry
+	sshConfig       *ssh.ServerConfig
+	registry        DevboxResolver
+	options         atomic.Pointer[Options]
+	parser          *UsernameParser
+	hostKeyVerifier *backendHostKeyVerifier
+	backendDialer   BackendDialer
+	// reloadMu serializes Reload
+	reloadMu sync.Mutex
+	// marshaled user CA public key -> struct{}
+	userCAKeys map[string]struct{}
+	// marshaled admin public key -> struct{}
+	adminKeys map[string]struct{}
+	// backendUserMap are the parsed rules of BackendUserMap
+	backendUserMap []backendUserRule
+	// backendPool is nil when backend connection pooling is disabled
+	backendPool *backendPool
+	// healthChecker is nil when backend health checks are disabled
+	healthChecker *backendHealthChecker
+	liveConns     *liveConns
+	// recorder is nil when no session recording sink is configured
+	recorder         SessionRecorder
+	recordingMaxSize int64
+	// bandwidth is nil when no connection is bandwidth limited
+	bandwidth atomic.Pointer[bandwidthPolicy]
+	traffic   *devboxTraffic
+	// clusterProxies are the SOCKS5 proxies of remote clusters by name
+	clusterProxies map[string]string
+	// events is nil when no Kubernetes event recorder is configured
+	events *devboxEvents
+	// usage is nil when the MOTD does not show resource usage
+	usage *resourceUsage
+	// graceConfig serves the previous host keys until graceUntil, graceHostKeys
+	// are advertised meanwhile
+	graceConfig        *ssh.ServerConfig
+	graceHostKeys      []ssh.Signer
+	graceUntil         time.Time
+	gracePresentedKeys []ssh.Signer
+	// presentedKeys are served for handshakes, one per type
+	presentedKeys []ssh.Signer
+	// hostCertificate is nil when no host certificate is presented
+	hostCertificate ssh.Signer
+	// hostKeys are advertised to clients, the serving host key first
+	hostKeys     []ssh.Signer
+	authCounters *authCounters
+	// otpLimiter is nil when OTP attempts are unlimited
+	otpLimiter *otpLimiter
+	// tokenVerifier is nil when token authentication is disabled
+	tokenVerifier *tokenVerifier
+	logger        *log.Entry
 }
 
 // New creates a new Gateway instance with functional options
-func New(hostKey ssh.Signer, reg *registry.Registry, opts ...Option) *Gateway {
+func New(hostKey ssh.Signer, reg DevboxResolver, opts ...Option) *Gateway {
 	// Start with default options
 	options := DefaultOptions()
 
@@ -127,52 +1010,284 @@ func New(hostKey ssh.Signer, reg *registry.Registry, opts ...Option) *Gateway {
 	}
 
 	gw := &Gateway{
-		registry: reg,
-		options:  &options,
-		parser:   &UsernameParser{},
-		logger:   log.WithField("component", "gateway"),
+		registry:     reg,
+		parser:       newUsernameParser(reg),
+		authCounters: newAuthCounters(),
+		logger:       log.WithField("component", "gateway"),
 	}
 
-	sshConfig := &ssh.ServerConfig{
-		// Ref: https://www.openssh.org/txt/release-7.2
-		// need disable no client auth mode
-		// because AddKeysToAgent need use public key auth
-		// NoClientAuth: true,
-		// NoClientAuthCallback: gw.NoClientAuthCallback,
-		PublicKeyCallback: gw.PublicKeyCallback,
+	gw.options.Store(&options)
+
+	verifier, err := newBackendHostKeyVerifier(&options)
+	if err != nil {
+		gw.logger.WithError(err).
+			Error("Invalid backend host key policy, all backend connections will be rejected")
+
+		verifier = &backendHostKeyVerifier{err: err}
+	}
+
+	gw.hostKeyVerifier = verifier
+
+	gw.backendDialer = options.BackendDialer
+	if gw.backendDialer == nil {
+		gw.backendDialer = socketDialer{g: gw}
 	}
-	sshConfig.AddHostKey(hostKey)
 
-	gw.sshConfig = sshConfig
+	userCAKeys, err := parseAuthorizedKeys(options.UserCAKeys)
+	if err != nil {
+		gw.logger.WithError(err).
+			Error("Invalid user CA keys, user certificates will not be trusted")
+
+		userCAKeys = map[string]struct{}{}
+	}
+
+	gw.userCAKeys = userCAKeys
+
+	adminKeys, err := parseAuthorizedKeys(options.AdminKeys)
+	if err != nil {
+		gw.logger.WithError(err).Error("Invalid admin keys, admin access is disabled")
+
+		adminKeys = map[string]struct{}{}
+	}
+
+	gw.adminKeys = adminKeys
+
+	backendUserMap, err := parseBackendUserMap(options.BackendUserMap)
+	if err != nil {
+		gw.logger.WithError(err).Error("Invalid backend user map, no rule applies")
+	}
+
+	gw.backendUserMap = backendUserMap
+
+	bandwidth, err := parseBandwidthPolicy(&options)
+	if err != nil {
+		gw.logger.WithError(err).Error("Invalid bandwidth limits, connections are unlimited")
+	}
+
+	gw.bandwidth.Store(bandwidth)
+
+	clusterProxies, err := parseClusterProxies(options.ClusterProxies)
+	if err != nil {
+		gw.logger.WithError(err).
+			Error("Invalid cluster proxies, remote clusters are dialed directly")
+	}
+
+	gw.clusterProxies = clusterProxies
+
+	gw.otpLimiter = newOTPLimiter(options.OTPMaxFailures, options.OTPLockout)
+	gw.tokenVerifier = newTokenVerifier(&options, gw.logger)
+
+	gw.traffic = newDevboxTraffic()
+	reg.Subscribe(gw.traffic.handleRegistryEvent)
+
+	gw.liveConns = newLiveConns()
+	reg.Subscribe(gw.handleRevocationEvent)
+
+	if options.TerminateRestartedPodConns {
+		reg.Subscribe(gw.handlePodRestartEvent)
+	}
+
+	if options.BackendPoolEnabled {
+		gw.backendPool = newBackendPool(options.BackendPoolMaxIdle, options.BackendPoolIdleTTL)
+		reg.Subscribe(gw.backendPool.handleRegistryEvent)
+	}
+
+	if options.BackendHealthCheckEnabled {
+		gw.healthChecker = newBackendHealthChecker(gw)
+	}
+
+	if err := gw.registerMetrics(options.Metrics); err != nil {
+		gw.logger.WithError(err).Warn("Failed to register gateway metrics")
+	}
+
+	gw.events = newDevboxEvents(options.EventRecorder, options.KubernetesEventInterval, gw.logger)
+	if gw.events != nil {
+		reg.Subscribe(gw.events.handleRegistryEvent)
+	}
+
+	if options.MOTDResourceUsage {
+		gw.usage = newResourceUsage(options.PodMetrics, options.MOTDResourceUsageTimeout, gw.logger)
+	}
+
+	gw.recorder = options.SessionRecorder
+	if gw.recorder == nil && options.SessionRecordingDir != "" {
+		gw.recorder = NewDirRecorder(options.SessionRecordingDir)
+	}
+
+	gw.recordingMaxSize, err = parseByteSize(options.SessionRecordingMaxSize)
+	if err != nil {
+		gw.logger.WithError(err).
+			Error("Invalid session recording max size, recordings are unlimited")
+	}
+
+	if options.HostCertificate != nil {
+		cert := hostCertificate(options.HostCertificate)
+		if cert == nil || cert.CertType != ssh.HostCert {
+			gw.logger.Error("Host certificate is not an SSH host certificate, it is not presented")
+		} else {
+			gw.hostCertificate = options.HostCertificate
+		}
+	}
+
+	served := servedHostKeys(hostKey, options.HostKeys, gw.logger)
+	gw.sshConfig = gw.newServerConfig(served)
+	gw.presentedKeys = served
+	gw.hostKeys = advertisedHostKeys(hostKey, slices.Concat(served[1:], options.AdditionalHostKeys))
+
+	if len(options.PreviousHostKeys) > 0 {
+		gw.setPreviousHostKeys(served, options.PreviousHostKeys, options.HostKeyGraceUntil)
+	}
 
 	return gw
 }
 
+// LogOptions logs the effective options of connections, defaults included,
+// once at startup
+func (g *Gateway) LogOptions() {
+	o := g.opts()
+
+	g.logger.WithFields(log.Fields{
+		"handshake_timeout":                 o.SSHHandshakeTimeout,
+		"backend_port":                      o.SSHBackendPort,
+		"backend_connect_timeout_publickey": o.BackendConnectTimeoutPublicKey,
+		"backend_connect_timeout_agent":     o.BackendConnectTimeoutAgent,
+		"proxy_jump_timeout":                o.ProxyJumpTimeout,
+		"session_request_timeout":           o.SessionRequestTimeout,
+		"max_sessions_per_conn":             o.MaxSessionsPerConn,
+		"max_cached_requests":               o.MaxCachedRequests,
+		"max_auth_tries":                    o.MaxAuthTries,
+		"server_version":                    o.ServerVersion,
+		"tcp_keepalive_period":              o.TCPKeepAlivePeriod,
+		"bandwidth_limit":                   o.BandwidthLimit,
+		"banner_show_devbox_status":         o.BannerShowDevboxStatus,
+		"disable_agent_forwarding_mode":     o.agentForwardingModeDisabled(),
+		"proxy_jump":                        o.EnableProxyJump,
+	}).Info("Gateway options")
+}
+
+// Serve runs an accept loop per listener, handling connections until ctx is done.
+// Connection logs carry the address of the listener that accepted the connection.
+// Backend health checks, when enabled, run for as long as Serve.
+func (g *Gateway) Serve(ctx context.Context, listeners ...net.Listener) {
+	var wg sync.WaitGroup
+
+	if g.healthChecker != nil {
+		wg.Go(func() {
+			g.healthChecker.run(ctx)
+		})
+	}
+
+	if g.hostCertificate != nil {
+		wg.Go(func() {
+			g.watchHostCertificate(ctx)
+		})
+	}
+
+	for _, ln := range listeners {
+		wg.Go(func() {
+			g.acceptLoop(ln)
+		})
+	}
+
+	<-ctx.Done()
+
+	for _, ln := range listeners {
+		_ = ln.Close()
+	}
+
+	wg.Wait()
+}
+
+func (g *Gateway) acceptLoop(ln net.Listener) {
+	label := ln.Addr().String()
+	g.logger.WithField("listener", label).Info("SSH Gateway listening")
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			g.logger.WithField("listener", label).WithError(err).Warn("Accept error")
+
+			continue
+		}
+
+		go g.handleConnection(conn, label)
+	}
+}
+
+// HandleConnection serves an SSH connection accepted outside of Serve
 func (g *Gateway) HandleConnection(nConn net.Conn) {
-	_ = nConn.SetDeadline(time.Now().Add(g.options.SSHHandshakeTimeout))
+	g.handleConnection(nConn, "")
+}
+
+func (g *Gateway) handleConnection(nConn net.Conn, listener string) {
+	g.tuneConn(nConn)
+
+	// Every log of the connection, from handshake to close, carries its ID
+	connID := newConnID()
+
+	baseLogger := g.logger.WithField("conn_id", connID)
+	if listener != "" {
+		baseLogger = baseLogger.WithField("listener", listener)
+	}
+
+	_ = nConn.SetDeadline(time.Now().Add(g.opts().SSHHandshakeTimeout))
 
-	conn, chans, reqs, err := ssh.NewServerConn(nConn, g.sshConfig)
+	start := time.Now()
+	state := &authState{logger: baseLogger}
+
+	conn, chans, reqs, err := ssh.NewServerConn(nConn, g.connConfig(state))
 	if err != nil {
-		g.logger.WithFields(log.Fields{
-			"remote_addr": nConn.RemoteAddr().String(),
-		}).WithError(err).Warn("SSH handshake failed")
+		baseLogger.WithField("remote_addr", remoteAddr(nConn.RemoteAddr())).
+			WithError(err).
+			Warn("SSH handshake failed")
+		g.auditHandshakeFailure(nConn, connID, listener, start, state)
+
 		return
 	}
 	defer conn.Close()
 
+	audit := g.newConnAudit(conn, connID, listener, start)
+	defer audit.close()
+
+	chans = audit.countChannels(chans)
+
 	_ = nConn.SetDeadline(time.Time{})
 
+	// ctx is cancelled once the client connection is gone, unwinding every
+	// operation still blocked on its behalf
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		_ = conn.Wait()
+
+		cancel()
+	}()
+
+	if g.opts().HostKeyUpdatesEnabled {
+		g.advertiseHostKeys(conn, baseLogger)
+		reqs = g.interceptHostKeyProofs(ctx, conn, reqs, baseLogger)
+	}
+
 	info, err := g.getDevboxInfoFromPermissions(conn.Permissions)
 	if err != nil {
-		g.logger.WithFields(log.Fields{
-			"remote_addr": conn.RemoteAddr().String(),
-			"user":        conn.User(),
+		baseLogger.WithFields(log.Fields{
+			"remote_addr": remoteAddr(conn.RemoteAddr()),
+			"user":        redactUser(conn.User()),
 		}).WithError(err).Error("Failed to get devbox info from permissions")
+		audit.setReason(AuditReasonDevboxNotFound)
+		refuseConnection(chans, reqs, g.message(msgInternalError, nil, err), baseLogger)
 
 		return
 	}
 
-	username := conn.Permissions.Extensions["username"]
+	audit.setDevbox(info)
+
+	backendUser := backendUserFromPermissions(conn.Permissions)
 
 	// Determine authentication mode
 	authMode := g.determineAuthMode(conn)
@@ -182,45 +1297,150 @@ func (g *Gateway) HandleConnection(nConn net.Conn) {
 
 	// Fallback: create logger if not found in ExtraData (shouldn't happen normally)
 	if connLogger == nil {
-		connLogger = g.logger.WithFields(log.Fields{
-			"remote_addr": conn.RemoteAddr().String(),
-			"ssh_user":    conn.User(),
+		connLogger = baseLogger.WithFields(log.Fields{
+			"remote_addr": remoteAddr(conn.RemoteAddr()),
+			"ssh_user":    redactUser(conn.User()),
 			"namespace":   info.Namespace,
 			"devbox":      info.DevboxName,
 			"auth_mode":   authMode.String(),
 		})
 	}
 
-	// Check if devbox is running
-	if info.PodIP == "" {
-		connLogger.Warn("Devbox not running")
-		// Reject all incoming channels and close connection
+	// Check if devbox is running, dialing a pod that is not ready is pointless
+	switch info.PodState() {
+	case registry.PodStateNone:
+		g.opts().LogLimiter.Log(connLogger.WithField("desired_state", info.DesiredState),
+			log.WarnLevel, "Devbox not running", "namespace", "devbox")
+		g.authCounters.recordFailure(AuthFailureDevboxNotRunning)
+		audit.setReason(AuditReasonDevboxNotRunning)
+		refuseConnection(
+			g.routeCommands(ctx, conn, chans, info, connLogger),
+			reqs,
+			g.message(notRunningMessage(info), info, nil),
+			connLogger,
+		)
 
-		go ssh.DiscardRequests(reqs)
+		return
+	case registry.PodStateStarting:
+		connLogger.WithFields(log.Fields{
+			"pod_phase": info.PodPhase,
+			"pod_ready": info.PodReady,
+		}).Warn("Devbox not ready")
+		g.authCounters.recordFailure(AuthFailureDevboxStarting)
+		audit.setReason(AuditReasonDevboxStarting)
+		refuseConnection(
+			g.routeCommands(ctx, conn, chans, info, connLogger),
+			reqs,
+			g.message(msgDevboxStarting, info, nil),
+			connLogger,
+		)
 
-		for newChannel := range chans {
-			_ = newChannel.Reject(
-				ssh.ConnectionFailed,
-				fmt.Sprintf("devbox %s/%s is not running", info.Namespace, info.DevboxName),
-			)
-		}
+		return
+	}
+
+	// Refuse early rather than letting sessions time out dialing the backend
+	if health, ok := g.registry.BackendHealth(info.Namespace, info.DevboxName); ok &&
+		health.Unreachable {
+		connLogger.WithField("unreachable_since", health.UnreachableSince).
+			Warn("Devbox unreachable")
+		g.authCounters.recordFailure(AuthFailureDevboxUnreachable)
+		audit.setReason(AuditReasonDevboxUnreachable)
+		refuseConnection(
+			g.routeCommands(ctx, conn, chans, info, connLogger),
+			reqs,
+			g.message(msgDevboxUnreachable, info, nil),
+			connLogger,
+		)
 
 		return
 	}
 
+	// Operators tell which pod a session landed on while a devbox has several
+	connLogger = connLogger.WithField("pod", info.PodName)
+	if info.Stale() {
+		connLogger = connLogger.WithField("stale", true)
+	}
+
 	connLogger.Info("Connection established")
+	g.events.recordConnected(info, redactUser(conn.User()), remoteAddr(conn.RemoteAddr()))
+
+	live := newLiveConn(conn, connLogger, audit, info.PodIP)
+	defer g.liveConns.add(info.Namespace, info.DevboxName, live)()
+
+	cio := g.newConnIO(connID, info, live)
+	cio.recording = g.recordingMetadata(conn, connID, info, connLogger)
+	cio.audit = audit
+	cio.clientAddr = remoteAddr(conn.RemoteAddr())
+	cio.forceCommand = info.ForceCommand
+	cio.sftpOnly = g.sftpOnly(info)
+	cio.motd = g.motd(ctx, info, backendUser)
+	audit.setTraffic(cio.traffic)
+	defer func() {
+		connLogger.WithFields(cio.fields()).Info("Connection closed")
+	}()
+
+	chans = restrictChannels(ctx, chans, cio.sftpOnly, connLogger)
+	reqs = restrictGlobalRequests(ctx, reqs, cio.sftpOnly, connLogger)
 
 	switch authMode {
-	case AuthModePublicKey:
-		g.handlePublicKeyMode(conn, chans, reqs, info, username, connLogger)
+	case AuthModeAdmin:
+		connLogger.WithField("audit", "admin_session").Warn("Admin session started")
+		g.handlePublicKeyMode(ctx, conn, chans, reqs, info, backendUser, cio, connLogger)
+		connLogger.WithField("audit", "admin_session").
+			WithFields(cio.fields()).
+			Warn("Admin session ended")
+	case AuthModePublicKey, AuthModeToken:
+		g.handlePublicKeyMode(ctx, conn, chans, reqs, info, backendUser, cio, connLogger)
 	case AuthModeCustomKey, AuthModeNoAuth:
-		g.handleCustomKeyOrNoAuthMode(conn, chans, reqs, info, username, connLogger)
+		g.handleCustomKeyOrNoAuthMode(ctx, conn, chans, reqs, info, backendUser, cio, connLogger)
 	default:
 		connLogger.Warn("Unknown auth mode, closing connection")
 	}
 }
 
+// newServerConfig returns the server config serving hostKeys
+func (g *Gateway) newServerConfig(hostKeys []ssh.Signer) *ssh.ServerConfig {
+	config := &ssh.ServerConfig{
+		// Ref: https://www.openssh.org/txt/release-7.2
+		// need disable no client auth mode
+		// because AddKeysToAgent need use public key auth
+		// NoClientAuth: true,
+		// NoClientAuthCallback: g.NoClientAuthCallback,
+		PublicKeyCallback: g.PublicKeyCallback,
+		AuthLogCallback:   g.AuthLogCallback,
+		BannerCallback:    g.BannerCallback,
+		MaxAuthTries:      g.opts().MaxAuthTries,
+		ServerVersion:     g.opts().ServerVersion,
+	}
+
+	for _, key := range hostKeys {
+		config.AddHostKey(key)
+	}
+
+	if g.hostCertificate != nil {
+		config.AddHostKey(g.hostCertificate)
+	}
+
+	return config
+}
+
+// HostKeys returns the host keys presented for handshakes, one per type, the
+// previous keys of a rotation during its grace period
+func (g *Gateway) HostKeys() []ssh.Signer {
+	if g.inHostKeyGracePeriod() {
+		return slices.Clone(g.gracePresentedKeys)
+	}
+
+	return slices.Clone(g.presentedKeys)
+}
+
+// Config returns the server config of new connections, serving the previous host
+// keys during the grace period of a rotation
 func (g *Gateway) Config() *ssh.ServerConfig {
+	if g.inHostKeyGracePeriod() {
+		return g.graceConfig
+	}
+
 	return g.sshConfig
 }
 
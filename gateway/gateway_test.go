@@ -1,20 +1,31 @@
 package gateway_test
 
 import (
+	"context"
 	"crypto/ed25519"
 	"crypto/rand"
+	"encoding/json"
 	"encoding/pem"
+	"errors"
+	stdlog "log"
 	"net"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/zijiren233/sshgate/gateway"
+	"github.com/zijiren233/sshgate/listen"
 	"github.com/zijiren233/sshgate/logger"
 	"github.com/zijiren233/sshgate/registry"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/websocket"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
 )
 
 func TestMain(m *testing.M) {
@@ -23,7 +34,7 @@ func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
 
-func generateTestKeys(t *testing.T) (ssh.Signer, ssh.PublicKey, []byte, []byte) {
+func generateTestKeys(t testing.TB) (ssh.Signer, ssh.PublicKey, []byte, []byte) {
 	t.Helper()
 
 	pub, priv, err := ed25519.GenerateKey(rand.Reader)
@@ -186,14 +197,11 @@ func TestPublicKeyCallback_AcceptKnownKey(t *testing.T) {
 }
 
 func TestPublicKeyCallback_RejectUnknownKey(t *testing.T) {
-	// Create empty registry
-	reg := registry.New()
-
 	// Generate an unknown key
 	_, unknownPub, _, _ := generateTestKeys(t)
 
-	// Create the PublicKeyCallback
-	callback := gateway.NewPublicKeyCallback(reg)
+	// Create the PublicKeyCallback on an empty registry
+	callback := gateway.NewPublicKeyCallback(&fakeResolver{})
 
 	// Test authentication with unknown key
 	conn := newMockConnMetadata("testuser")
@@ -310,6 +318,146 @@ func TestHandleConnection_Basic(t *testing.T) {
 	}
 }
 
+func TestServe_MultipleListeners(t *testing.T) {
+	env := newBackendTestEnv(t)
+	env.start(t)
+
+	var lc net.ListenConfig
+
+	listeners := make([]net.Listener, 0, 2)
+
+	for range 2 {
+		ln, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+
+		listeners = append(listeners, ln)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	served := make(chan struct{})
+	go func() {
+		env.gateway.Serve(ctx, listeners...)
+		close(served)
+	}()
+
+	for _, ln := range listeners {
+		code, err := runSSHCommand(t, ln.Addr().String(), env.privBytes, "exit 7")
+		if err != nil || code != 7 {
+			t.Errorf("Session via %s = %d, %v, want exit code 7", ln.Addr(), code, err)
+		}
+	}
+
+	cancel()
+
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after the context was canceled")
+	}
+}
+
+func TestServe_UnixSocket(t *testing.T) {
+	env := newBackendTestEnv(t)
+	env.start(t)
+
+	path := filepath.Join(t.TempDir(), "gw.sock")
+
+	ln, err := listen.Listen(context.Background(), "unix://"+path)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go env.gateway.Serve(ctx, ln)
+
+	signer, err := ssh.ParsePrivateKey(env.privBytes)
+	if err != nil {
+		t.Fatalf("Failed to parse private key: %v", err)
+	}
+
+	client, err := ssh.Dial("unix", path, &ssh.ClientConfig{
+		User: "testuser",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		//nolint:gosec // acceptable for testing
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Failed to dial gateway socket: %v", err)
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer session.Close()
+
+	if err := session.Run("exit 0"); err != nil {
+		t.Errorf("Session over unix socket failed: %v", err)
+	}
+}
+
+func TestServe_WebSocket(t *testing.T) {
+	env := newBackendTestEnv(t)
+	env.start(t)
+
+	ln, err := listen.ListenWebSocket(context.Background(), "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go env.gateway.Serve(ctx, ln)
+
+	wsConfig, err := websocket.NewConfig(ln.Addr().String(), "http://localhost/")
+	if err != nil {
+		t.Fatalf("Failed to create websocket config: %v", err)
+	}
+
+	ws, err := wsConfig.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to dial websocket: %v", err)
+	}
+
+	ws.PayloadType = websocket.BinaryFrame
+
+	signer, err := ssh.ParsePrivateKey(env.privBytes)
+	if err != nil {
+		t.Fatalf("Failed to parse private key: %v", err)
+	}
+
+	conn, chans, reqs, err := ssh.NewClientConn(ws, "gateway", &ssh.ClientConfig{
+		User: "testuser",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		//nolint:gosec // acceptable for testing
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("SSH handshake over websocket failed: %v", err)
+	}
+
+	client := ssh.NewClient(conn, chans, reqs)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer session.Close()
+
+	if err := session.Run("exit 0"); err != nil {
+		t.Errorf("Session over websocket failed: %v", err)
+	}
+}
+
 func TestPublicKeyCallback_DifferentUsernames(t *testing.T) {
 	reg := registry.New()
 
@@ -557,3 +705,224 @@ func TestPublicKeyCallback_WithPodIP(t *testing.T) {
 		t.Errorf("Expected PodIP '10.0.0.1', got: %s", info.PodIP)
 	}
 }
+
+func TestHandleConnection_CorrelatesLogs(t *testing.T) {
+	hook := logtest.NewGlobal()
+
+	level := log.GetLevel()
+	log.SetLevel(log.DebugLevel)
+
+	t.Cleanup(func() {
+		log.SetLevel(level)
+		log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+	})
+
+	env := newBackendTestEnv(t)
+	addr := env.start(t)
+
+	signer, err := ssh.ParsePrivateKey(env.privBytes)
+	if err != nil {
+		t.Fatalf("Failed to parse private key: %v", err)
+	}
+
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User: "testuser",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		//nolint:gosec // acceptable for testing
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Failed to dial gateway: %v", err)
+	}
+
+	clientAddr := client.LocalAddr().String()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+
+	if err := session.Run("exit 0"); err != nil {
+		t.Fatalf("Command failed: %v", err)
+	}
+
+	client.Close()
+
+	// Other tests may still be closing connections, only this client's logs count
+	var entries []*log.Entry
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		entries = entries[:0]
+		closed := false
+
+		for _, entry := range hook.AllEntries() {
+			if entry.Data["remote_addr"] == clientAddr {
+				entries = append(entries, entry)
+				closed = closed || entry.Message == "Connection closed"
+			}
+		}
+
+		if closed {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("Connection close was not logged")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	connIDs := make(map[string]bool)
+	sessionIDs := make(map[string]bool)
+
+	for _, entry := range entries {
+		connID, ok := entry.Data["conn_id"].(string)
+		if !ok {
+			t.Errorf("Log %q has no conn_id", entry.Message)
+			continue
+		}
+
+		connIDs[connID] = true
+
+		if sessionID, ok := entry.Data["session_id"].(string); ok {
+			sessionIDs[sessionID] = true
+		}
+	}
+
+	if len(connIDs) != 1 {
+		t.Fatalf("Logs carry %d connection IDs, want 1", len(connIDs))
+	}
+
+	if len(sessionIDs) != 1 {
+		t.Fatalf("Logs carry %d session IDs, want 1", len(sessionIDs))
+	}
+
+	for connID := range connIDs {
+		for sessionID := range sessionIDs {
+			if !strings.HasPrefix(sessionID, connID+"-") {
+				t.Errorf("Session ID %s does not extend connection ID %s", sessionID, connID)
+			}
+		}
+	}
+}
+
+func TestLogFormatJSON(t *testing.T) {
+	output := &syncBuffer{}
+	logger.InitLog(
+		logger.WithLevel("debug"),
+		logger.WithFormat("json"),
+		logger.WithStdout(output),
+	)
+
+	t.Cleanup(func() { logger.InitLog() })
+
+	env := newBackendTestEnv(t)
+	addr := env.start(t)
+
+	signer, err := ssh.ParsePrivateKey(env.privBytes)
+	if err != nil {
+		t.Fatalf("Failed to parse private key: %v", err)
+	}
+
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User: "testuser",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		//nolint:gosec // acceptable for testing
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Failed to dial gateway: %v", err)
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+
+	if err := session.Run("exit 0"); err != nil {
+		t.Fatalf("Command failed: %v", err)
+	}
+
+	client.Close()
+
+	// Logs of the standard library and of the Kubernetes client go through it too
+	stdlog.Print("http: TLS handshake error from 10.0.0.1:4242: EOF")
+	klog.InfoS("Watch ended", "resource", metav1.GroupResource{Resource: "devboxes"})
+	klog.ErrorS(errors.New("connection refused"), "Failed to list", "namespace", "ns-test")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(output.String(), `"msg":"Connection closed"`) {
+		if time.Now().After(deadline) {
+			t.Fatal("Connection close was not logged")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	components := make(map[string]bool)
+
+	for line := range strings.Lines(output.String()) {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Errorf("Log line is not JSON: %q", line)
+			continue
+		}
+
+		if entry["msg"] == nil || entry["level"] == nil || entry["time"] == nil {
+			t.Errorf("Log line has no msg, level or time: %q", line)
+		}
+
+		if component, ok := entry["component"].(string); ok {
+			components[component] = true
+		}
+	}
+
+	for _, component := range []string{"gateway", "stdlib", "kubernetes"} {
+		if !components[component] {
+			t.Errorf("No log of component %s, got %v", component, components)
+		}
+	}
+}
+
+func TestLogLimiter_BackendFailures(t *testing.T) {
+	hook := logtest.NewGlobal()
+	t.Cleanup(func() { log.StandardLogger().ReplaceHooks(make(log.LevelHooks)) })
+
+	limiter := logger.NewLimiter(1, time.Hour, 0)
+
+	env := newBackendTestEnv(t)
+	addr := env.start(t, gateway.WithLogLimiter(limiter))
+
+	// Nothing listens on the backend port of this address
+	setPodIP(t, env.reg, "127.0.0.2")
+
+	for range 3 {
+		client := dialPublicKeyMode(t, addr, env)
+		checkRefusal(t, client, nil, "failed to connect to devbox ns-test/test-devbox")
+	}
+
+	limiter.Flush()
+
+	var failures, summaries int
+
+	for _, entry := range hook.AllEntries() {
+		switch {
+		case entry.Message == "Failed to connect to backend":
+			failures++
+		case strings.HasPrefix(entry.Message, "Suppressed 2 similar messages"):
+			summaries++
+
+			if entry.Data["devbox"] != "test-devbox" || entry.Data["namespace"] != "ns-test" {
+				t.Errorf("Summary fields = %v, want the devbox", entry.Data)
+			}
+		}
+	}
+
+	if failures != 1 || summaries != 1 {
+		t.Errorf("Logged %d failures and %d summaries, want 1 of each", failures, summaries)
+	}
+}
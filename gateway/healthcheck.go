@@ -0,0 +1,181 @@
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zijiren233/sshgate/registry"
+)
+
+// backendHealthChecker periodically probes the SSH server of every running devbox,
+// recording its reachability in the registry
+type backendHealthChecker struct {
+	g           *Gateway
+	interval    time.Duration
+	timeout     time.Duration
+	concurrency int
+	// threshold is the number of consecutive failed probes marking a backend unreachable
+	threshold int
+	logger    *log.Entry
+}
+
+func newBackendHealthChecker(g *Gateway) *backendHealthChecker {
+	return &backendHealthChecker{
+		g:           g,
+		interval:    g.opts().BackendHealthCheckInterval,
+		timeout:     g.opts().BackendHealthCheckTimeout,
+		concurrency: g.opts().BackendHealthCheckConcurrency,
+		threshold:   g.opts().BackendHealthCheckFailureThreshold,
+		logger:      g.logger,
+	}
+}
+
+// run probes every backend each interval until ctx is done
+func (c *backendHealthChecker) run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		c.probeAll(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probeAll probes every devbox with a pod IP, at most concurrency at a time
+func (c *backendHealthChecker) probeAll(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	sem := make(chan struct{}, c.concurrency)
+
+	for _, info := range c.g.registry.Devboxes() {
+		if info.PodIP == "" {
+			continue
+		}
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		}
+
+		wg.Go(func() {
+			defer func() { <-sem }()
+
+			c.probe(ctx, &info)
+		})
+	}
+
+	wg.Wait()
+}
+
+// probe checks that the backend of a devbox accepts connections and announces
+// an SSH version, then records the result
+func (c *backendHealthChecker) probe(ctx context.Context, info *registry.DevboxInfo) {
+	logger := c.logger.WithFields(log.Fields{
+		"namespace": info.Namespace,
+		"devbox":    info.DevboxName,
+	})
+
+	err := c.probeBackend(ctx, info, logger)
+	if ctx.Err() != nil {
+		// A probe cut short by shutdown says nothing about the backend
+		return
+	}
+
+	now := time.Now()
+
+	c.g.registry.UpdateBackendHealth(
+		info.Namespace,
+		info.DevboxName,
+		info.PodIP,
+		func(h *registry.BackendHealth) {
+			if err == nil {
+				if h.Unreachable {
+					logger.WithField("unreachable_since", h.UnreachableSince).
+						Info("Backend reachable again")
+				}
+
+				*h = registry.BackendHealth{LastSuccess: now}
+
+				return
+			}
+
+			if h.ConsecutiveFailures == 0 {
+				h.UnreachableSince = now
+			}
+
+			h.ConsecutiveFailures++
+			h.LastError = err.Error()
+
+			if !h.Unreachable && h.ConsecutiveFailures >= c.threshold {
+				h.Unreachable = true
+
+				logger.WithField("failures", h.ConsecutiveFailures).
+					WithError(err).
+					Warn("Backend unreachable")
+			}
+		},
+	)
+}
+
+// probeBackend dials the backend and reads its SSH version line. Probes dial
+// sockets directly, bypassing a custom BackendDialer.
+func (c *backendHealthChecker) probeBackend(
+	ctx context.Context,
+	info *registry.DevboxInfo,
+	logger *log.Entry,
+) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	addr, _ := c.g.backendAddr(ctx, info, c.g.backendSSHPort(info), logger)
+
+	conn, err := c.g.dialBackend(withBackendCluster(ctx, info.Cluster), "tcp", addr, c.timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetReadDeadline(deadline)
+
+	// Servers may send other lines before the version line (RFC 4253 section 4.2)
+	reader := bufio.NewReaderSize(conn, 256)
+	for range 16 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("reading SSH version: %w", err)
+		}
+
+		if strings.HasPrefix(line, "SSH-") {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no SSH version announced by %s", addr)
+}
+
+// UnreachableDevboxes returns the devboxes whose backend failed enough
+// consecutive health probes, none when health checks are disabled
+func (g *Gateway) UnreachableDevboxes() []registry.DevboxInfo {
+	var unreachable []registry.DevboxInfo
+
+	for _, info := range g.registry.Devboxes() {
+		if info.Health.Unreachable {
+			unreachable = append(unreachable, info)
+		}
+	}
+
+	return unreachable
+}
@@ -0,0 +1,143 @@
+package gateway_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+)
+
+// waitForHealth waits until the backend health of the test devbox satisfies done
+func waitForHealth(
+	t *testing.T,
+	reg *registry.Registry,
+	done func(registry.BackendHealth) bool,
+) registry.BackendHealth {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		health, ok := reg.BackendHealth("ns-test", "test-devbox")
+		if !ok {
+			t.Fatal("Test devbox not found")
+		}
+
+		if done(health) {
+			return health
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Backend health %+v never reached the expected state", health)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBackendHealthCheck_MarksUnreachableBackend(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t, gateway.WithBackendHealthCheck(
+		true, 20*time.Millisecond, time.Second, 4, 3,
+	))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go env.gateway.Serve(ctx)
+
+	waitForHealth(t, env.reg, func(h registry.BackendHealth) bool {
+		return !h.LastSuccess.IsZero()
+	})
+
+	if got := env.gateway.UnreachableDevboxes(); len(got) != 0 {
+		t.Errorf("UnreachableDevboxes() = %d devboxes, want 0", len(got))
+	}
+
+	// Nothing listens on the backend port of this address
+	setPodIP(t, env.reg, "127.0.0.2")
+
+	health := waitForHealth(t, env.reg, func(h registry.BackendHealth) bool {
+		return h.Unreachable
+	})
+	if health.ConsecutiveFailures < 3 {
+		t.Errorf("Unreachable after %d failed probes, want at least 3", health.ConsecutiveFailures)
+	}
+
+	if got := env.gateway.UnreachableDevboxes(); len(got) != 1 {
+		t.Fatalf("UnreachableDevboxes() = %d devboxes, want 1", len(got))
+	}
+
+	signer, err := ssh.ParsePrivateKey(env.privBytes)
+	if err != nil {
+		t.Fatalf("Failed to parse private key: %v", err)
+	}
+
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User: "testuser",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		//nolint:gosec // acceptable for testing
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Failed to dial gateway: %v", err)
+	}
+	defer client.Close()
+
+	checkRefusal(t, client, nil, "unreachable since")
+
+	if got := env.gateway.AuthStats().Failures[gateway.AuthFailureDevboxUnreachable]; got != 1 {
+		t.Errorf("Unreachable failures = %d, want 1", got)
+	}
+
+	// A new pod starts with a clean slate
+	setPodIP(t, env.reg, "127.0.0.1")
+	runPublicKeySession(t, addr, env, "testuser")
+}
+
+func TestOptionsValidate_BackendHealthCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		opt     gateway.Option
+		wantErr bool
+	}{
+		{
+			name: "disabled ignores values",
+			opt:  gateway.WithBackendHealthCheck(false, 0, 0, 0, 0),
+		},
+		{
+			name: "valid",
+			opt:  gateway.WithBackendHealthCheck(true, time.Minute, time.Second, 8, 2),
+		},
+		{
+			name:    "single failure threshold",
+			opt:     gateway.WithBackendHealthCheck(true, time.Minute, time.Second, 8, 1),
+			wantErr: true,
+		},
+		{
+			name:    "zero interval",
+			opt:     gateway.WithBackendHealthCheck(true, 0, time.Second, 8, 3),
+			wantErr: true,
+		},
+		{
+			name:    "zero concurrency",
+			opt:     gateway.WithBackendHealthCheck(true, time.Minute, time.Second, 0, 3),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := gateway.DefaultOptions()
+			tt.opt(&opts)
+
+			if err := opts.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
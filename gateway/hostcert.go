@@ -0,0 +1,66 @@
+package gateway
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// hostCertificateCheckInterval is how often the expiry of the host certificate
+// is checked
+const hostCertificateCheckInterval = time.Hour
+
+// hostCertificate returns the certificate of signer, nil when signer presents a
+// plain key
+func hostCertificate(signer ssh.Signer) *ssh.Certificate {
+	if signer == nil {
+		return nil
+	}
+
+	cert, _ := signer.PublicKey().(*ssh.Certificate)
+
+	return cert
+}
+
+// watchHostCertificate checks the expiry of the host certificate each check
+// interval until ctx is done
+func (g *Gateway) watchHostCertificate(ctx context.Context) {
+	ticker := time.NewTicker(hostCertificateCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		g.checkHostCertificateExpiry(time.Now())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkHostCertificateExpiry logs a warning when the host certificate expires
+// within the warning threshold of now, and an error once it has expired
+func (g *Gateway) checkHostCertificateExpiry(now time.Time) {
+	cert := hostCertificate(g.hostCertificate)
+	if cert == nil || cert.ValidBefore == ssh.CertTimeInfinity {
+		return
+	}
+
+	expiry := time.Unix(int64(cert.ValidBefore), 0) //nolint:gosec // times of certificates fit
+	remaining := expiry.Sub(now)
+	logger := g.logger.WithFields(log.Fields{
+		"key_id":  cert.KeyId,
+		"expires": expiry,
+	})
+
+	switch {
+	case remaining <= 0:
+		logger.Error("Host certificate expired, clients trusting its CA no longer accept it")
+	case remaining <= g.opts().HostCertificateExpiryWarning:
+		logger.WithField("remaining", remaining.Round(time.Minute)).
+			Warn("Host certificate expires soon")
+	}
+}
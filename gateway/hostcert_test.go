@@ -0,0 +1,137 @@
+package gateway_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"golang.org/x/crypto/ssh"
+)
+
+// signHostCertificate returns a signer presenting a host certificate of key,
+// signed by ca for 127.0.0.1
+func signHostCertificate(t *testing.T, ca, key ssh.Signer) ssh.Signer {
+	t.Helper()
+
+	cert := &ssh.Certificate{
+		Key:             key.PublicKey(),
+		CertType:        ssh.HostCert,
+		KeyId:           "sshgate",
+		ValidPrincipals: []string{"127.0.0.1"},
+		//nolint:gosec // test timestamps are always positive
+		ValidAfter: uint64(time.Now().Add(-time.Minute).Unix()),
+		//nolint:gosec // test timestamps are always positive
+		ValidBefore: uint64(time.Now().Add(time.Hour).Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatalf("Failed to sign host certificate: %v", err)
+	}
+
+	signer, err := ssh.NewCertSigner(cert, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate signer: %v", err)
+	}
+
+	return signer
+}
+
+func TestHostCertificate_TrustedCA(t *testing.T) {
+	ca, _, _, _ := generateTestKeys(t)
+	otherCA, _, _, _ := generateTestKeys(t)
+
+	env := newBackendTestEnv(t)
+	addr := env.start(t, gateway.WithHostCertificate(signHostCertificate(t, ca, env.hostKey)))
+
+	signer, err := ssh.ParsePrivateKey(env.privBytes)
+	if err != nil {
+		t.Fatalf("Failed to parse private key: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		ca      ssh.Signer
+		wantErr bool
+	}{
+		{name: "trusted CA", ca: ca},
+		{name: "other CA", ca: otherCA, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Like a client with @cert-authority in known_hosts
+			checker := &ssh.CertChecker{
+				IsHostAuthority: func(auth ssh.PublicKey, _ string) bool {
+					return bytes.Equal(auth.Marshal(), tt.ca.PublicKey().Marshal())
+				},
+			}
+
+			client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+				User:              "testuser",
+				Auth:              []ssh.AuthMethod{ssh.PublicKeys(signer)},
+				HostKeyAlgorithms: []string{ssh.CertAlgoED25519v01},
+				HostKeyCallback:   checker.CheckHostKey,
+				Timeout:           5 * time.Second,
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Dial() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if client != nil {
+				client.Close()
+			}
+		})
+	}
+
+	// Clients without the CA are still presented the plain key
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:              "testuser",
+		Auth:              []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyAlgorithms: []string{ssh.KeyAlgoED25519},
+		HostKeyCallback:   ssh.FixedHostKey(env.hostKey.PublicKey()),
+		Timeout:           5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Dial() with the plain host key failed: %v", err)
+	}
+
+	client.Close()
+}
+
+func TestHostCertificate_UserCertificateIgnored(t *testing.T) {
+	ca, _, _, _ := generateTestKeys(t)
+	env := newBackendTestEnv(t)
+
+	cert := &ssh.Certificate{
+		Key:         env.hostKey.PublicKey(),
+		CertType:    ssh.UserCert,
+		ValidBefore: ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatalf("Failed to sign certificate: %v", err)
+	}
+
+	certSigner, err := ssh.NewCertSigner(cert, env.hostKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate signer: %v", err)
+	}
+
+	addr := env.start(t, gateway.WithHostCertificate(certSigner))
+
+	var presented ssh.PublicKey
+
+	_, _ = ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User: "testuser",
+		HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+			presented = key
+			return nil
+		},
+		Timeout: 5 * time.Second,
+	})
+
+	if _, ok := presented.(*ssh.Certificate); ok {
+		t.Error("Gateway presented a user certificate as host certificate")
+	}
+}
@@ -0,0 +1,216 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+)
+
+// Backend host key policies
+const (
+	// BackendHostKeyPolicyInsecure accepts any backend host key
+	BackendHostKeyPolicyInsecure = "insecure"
+	// BackendHostKeyPolicyFixed accepts only the configured backend host keys
+	BackendHostKeyPolicyFixed = "fixed"
+	// BackendHostKeyPolicyCA accepts backend host certificates signed by a configured CA
+	BackendHostKeyPolicyCA = "ca"
+)
+
+// backendHostKeyVerifier verifies the host keys presented by backend devboxes
+type backendHostKeyVerifier struct {
+	policy string
+	// marshaled public key -> struct{}
+	hostKeys map[string]struct{}
+	// marshaled CA public key -> struct{}
+	caKeys map[string]struct{}
+	// err is set when the configured policy is invalid, every dial is rejected with it
+	err error
+}
+
+// newBackendHostKeyVerifier creates a verifier from the gateway options
+func newBackendHostKeyVerifier(opts *Options) (*backendHostKeyVerifier, error) {
+	v := &backendHostKeyVerifier{
+		policy: opts.BackendHostKeyPolicy,
+	}
+
+	switch opts.BackendHostKeyPolicy {
+	case BackendHostKeyPolicyInsecure:
+	case BackendHostKeyPolicyFixed:
+		keys, err := parseAuthorizedKeys(opts.BackendHostKeys)
+		if err != nil {
+			return nil, fmt.Errorf("invalid backend host key: %w", err)
+		}
+
+		if len(keys) == 0 {
+			return nil, errors.New("backend host key policy fixed requires at least one host key")
+		}
+
+		v.hostKeys = keys
+	case BackendHostKeyPolicyCA:
+		keys, err := parseAuthorizedKeys(opts.BackendHostCAKeys)
+		if err != nil {
+			return nil, fmt.Errorf("invalid backend host CA key: %w", err)
+		}
+
+		if len(keys) == 0 {
+			return nil, errors.New("backend host key policy ca requires at least one CA key")
+		}
+
+		v.caKeys = keys
+	default:
+		return nil, fmt.Errorf(
+			"invalid backend host key policy: %s (must be insecure, fixed, or ca)",
+			opts.BackendHostKeyPolicy,
+		)
+	}
+
+	return v, nil
+}
+
+// callback returns the host key callback used when dialing the backend of the given devbox
+func (v *backendHostKeyVerifier) callback(info *registry.DevboxInfo) ssh.HostKeyCallback {
+	if v.err != nil {
+		return func(string, net.Addr, ssh.PublicKey) error {
+			return fmt.Errorf("backend host key policy is invalid: %w", v.err)
+		}
+	}
+
+	switch v.policy {
+	case BackendHostKeyPolicyFixed:
+		return func(_ string, _ net.Addr, key ssh.PublicKey) error {
+			if _, ok := v.hostKeys[string(key.Marshal())]; ok {
+				return nil
+			}
+
+			return fmt.Errorf(
+				"%w: %s for %s/%s is not trusted",
+				ErrBackendHostKeyRejected,
+				ssh.FingerprintSHA256(key),
+				info.Namespace,
+				info.DevboxName,
+			)
+		}
+	case BackendHostKeyPolicyCA:
+		return func(_ string, _ net.Addr, key ssh.PublicKey) error {
+			if err := v.checkHostCertificate(info, key); err != nil {
+				return fmt.Errorf("%w: %w", ErrBackendHostKeyRejected, err)
+			}
+
+			return nil
+		}
+	default:
+		//nolint:gosec
+		return ssh.InsecureIgnoreHostKey()
+	}
+}
+
+// checkHostCertificate validates that key is a host certificate signed by a trusted CA
+// for either the namespace-devbox principal or the pod IP of the devbox
+func (v *backendHostKeyVerifier) checkHostCertificate(
+	info *registry.DevboxInfo,
+	key ssh.PublicKey,
+) error {
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return fmt.Errorf(
+			"backend %s/%s presented a plain host key, a host certificate is required",
+			info.Namespace,
+			info.DevboxName,
+		)
+	}
+
+	if cert.CertType != ssh.HostCert {
+		return fmt.Errorf(
+			"backend %s/%s presented a certificate that is not a host certificate",
+			info.Namespace,
+			info.DevboxName,
+		)
+	}
+
+	if _, ok := v.caKeys[string(cert.SignatureKey.Marshal())]; !ok {
+		return fmt.Errorf(
+			"backend %s/%s host certificate is signed by an untrusted CA %s",
+			info.Namespace,
+			info.DevboxName,
+			ssh.FingerprintSHA256(cert.SignatureKey),
+		)
+	}
+
+	principals := []string{info.Namespace + "-" + info.DevboxName}
+	if info.PodIP != "" {
+		principals = append(principals, info.PodIP)
+	}
+
+	for _, podIP := range info.PodIPs {
+		if podIP != info.PodIP {
+			principals = append(principals, podIP)
+		}
+	}
+
+	principal, ok := matchPrincipal(cert.ValidPrincipals, principals)
+	if !ok {
+		return fmt.Errorf(
+			"backend %s/%s host certificate principals %q do not include any of %q",
+			info.Namespace,
+			info.DevboxName,
+			cert.ValidPrincipals,
+			principals,
+		)
+	}
+
+	checker := &ssh.CertChecker{}
+	if err := checker.CheckCert(principal, cert); err != nil {
+		return fmt.Errorf(
+			"backend %s/%s host certificate rejected: %w",
+			info.Namespace,
+			info.DevboxName,
+			err,
+		)
+	}
+
+	return nil
+}
+
+// matchPrincipal returns the first wanted principal present in valid
+func matchPrincipal(valid, wanted []string) (string, bool) {
+	for _, w := range wanted {
+		if slices.Contains(valid, w) {
+			return w, true
+		}
+	}
+
+	return "", false
+}
+
+// parseAuthorizedKeys parses authorized_keys formatted lines into a set of marshaled keys
+func parseAuthorizedKeys(lines []string) (map[string]struct{}, error) {
+	keys := make(map[string]struct{}, len(lines))
+
+	for _, line := range lines {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %q: %w", line, err)
+		}
+
+		keys[string(key.Marshal())] = struct{}{}
+	}
+
+	return keys, nil
+}
+
+// NewBackendHostKeyCallback creates a backend host key callback for testing
+func NewBackendHostKeyCallback(
+	opts Options,
+	info *registry.DevboxInfo,
+) (ssh.HostKeyCallback, error) {
+	v, err := newBackendHostKeyVerifier(&opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return v.callback(info), nil
+}
@@ -0,0 +1,226 @@
+package gateway_test
+
+import (
+	"crypto/rand"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+)
+
+func signHostCert(
+	t *testing.T,
+	ca ssh.Signer,
+	key ssh.PublicKey,
+	principals []string,
+	validAfter, validBefore time.Time,
+) *ssh.Certificate {
+	t.Helper()
+
+	cert := &ssh.Certificate{
+		Key:             key,
+		Serial:          1,
+		CertType:        ssh.HostCert,
+		KeyId:           "devbox-host",
+		ValidPrincipals: principals,
+		//nolint:gosec // test timestamps are always positive
+		ValidAfter: uint64(validAfter.Unix()),
+		//nolint:gosec // test timestamps are always positive
+		ValidBefore: uint64(validBefore.Unix()),
+	}
+
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatalf("Failed to sign host certificate: %v", err)
+	}
+
+	return cert
+}
+
+func TestBackendHostKeyCallback_CA(t *testing.T) {
+	ca, _, _, _ := generateTestKeys(t)
+	otherCA, _, _, _ := generateTestKeys(t)
+	_, hostPub, _, _ := generateTestKeys(t)
+
+	info := &registry.DevboxInfo{
+		Namespace:  "ns-test",
+		DevboxName: "devbox",
+		PodIP:      "10.0.0.1",
+	}
+
+	opts := gateway.DefaultOptions()
+	opts.BackendHostKeyPolicy = gateway.BackendHostKeyPolicyCA
+	opts.BackendHostCAKeys = []string{string(ssh.MarshalAuthorizedKey(ca.PublicKey()))}
+
+	callback, err := gateway.NewBackendHostKeyCallback(opts, info)
+	if err != nil {
+		t.Fatalf("NewBackendHostKeyCallback() failed: %v", err)
+	}
+
+	now := time.Now()
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+
+	tests := []struct {
+		name    string
+		key     ssh.PublicKey
+		wantErr string
+	}{
+		{
+			name: "devbox principal",
+			key: signHostCert(t, ca, hostPub, []string{"ns-test-devbox"},
+				now.Add(-time.Hour), now.Add(time.Hour)),
+		},
+		{
+			name: "pod IP principal",
+			key: signHostCert(t, ca, hostPub, []string{"10.0.0.1"},
+				now.Add(-time.Hour), now.Add(time.Hour)),
+		},
+		{
+			name: "wrong principal",
+			key: signHostCert(t, ca, hostPub, []string{"ns-other-devbox"},
+				now.Add(-time.Hour), now.Add(time.Hour)),
+			wantErr: "principals",
+		},
+		{
+			name: "expired",
+			key: signHostCert(t, ca, hostPub, []string{"ns-test-devbox"},
+				now.Add(-2*time.Hour), now.Add(-time.Hour)),
+			wantErr: "expired",
+		},
+		{
+			name: "untrusted CA",
+			key: signHostCert(t, otherCA, hostPub, []string{"ns-test-devbox"},
+				now.Add(-time.Hour), now.Add(time.Hour)),
+			wantErr: "untrusted CA",
+		},
+		{
+			name:    "plain host key",
+			key:     hostPub,
+			wantErr: "host certificate is required",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := callback("10.0.0.1:22", remote, tt.key)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Expected host key to be accepted, got: %v", err)
+				}
+
+				return
+			}
+
+			if err == nil {
+				t.Fatal("Expected host key to be rejected, got nil")
+			}
+
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Expected error containing %q, got: %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestBackendHostKeyCallback_Fixed(t *testing.T) {
+	_, trustedPub, trustedBytes, _ := generateTestKeys(t)
+	_, otherPub, _, _ := generateTestKeys(t)
+
+	info := &registry.DevboxInfo{Namespace: "ns-test", DevboxName: "devbox"}
+
+	opts := gateway.DefaultOptions()
+	opts.BackendHostKeyPolicy = gateway.BackendHostKeyPolicyFixed
+	opts.BackendHostKeys = []string{string(trustedBytes)}
+
+	callback, err := gateway.NewBackendHostKeyCallback(opts, info)
+	if err != nil {
+		t.Fatalf("NewBackendHostKeyCallback() failed: %v", err)
+	}
+
+	if err := callback("10.0.0.1:22", nil, trustedPub); err != nil {
+		t.Errorf("Expected trusted host key to be accepted, got: %v", err)
+	}
+
+	if err := callback("10.0.0.1:22", nil, otherPub); err == nil {
+		t.Error("Expected untrusted host key to be rejected")
+	}
+}
+
+func TestBackendHostKeyCallback_Insecure(t *testing.T) {
+	_, hostPub, _, _ := generateTestKeys(t)
+
+	callback, err := gateway.NewBackendHostKeyCallback(
+		gateway.DefaultOptions(),
+		&registry.DevboxInfo{Namespace: "ns-test", DevboxName: "devbox"},
+	)
+	if err != nil {
+		t.Fatalf("NewBackendHostKeyCallback() failed: %v", err)
+	}
+
+	if err := callback("10.0.0.1:22", nil, hostPub); err != nil {
+		t.Errorf("Expected any host key to be accepted, got: %v", err)
+	}
+}
+
+func TestBackendHostKeyPolicyValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		keys   []string
+		caKeys []string
+	}{
+		{name: "unknown policy", policy: "strict"},
+		{name: "fixed without keys", policy: gateway.BackendHostKeyPolicyFixed},
+		{name: "ca without keys", policy: gateway.BackendHostKeyPolicyCA},
+		{
+			name:   "malformed CA key",
+			policy: gateway.BackendHostKeyPolicyCA,
+			caKeys: []string{"not-a-key"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := gateway.DefaultOptions()
+			opts.BackendHostKeyPolicy = tt.policy
+			opts.BackendHostKeys = tt.keys
+			opts.BackendHostCAKeys = tt.caKeys
+
+			if err := opts.Validate(); err == nil {
+				t.Error("Expected validation error, got nil")
+			}
+		})
+	}
+}
+
+func TestPublicKeyMode_RejectsUntrustedBackendHostCert(t *testing.T) {
+	env := newBackendTestEnv(t)
+
+	ca, _, _, _ := generateTestKeys(t)
+	now := time.Now()
+	cert := signHostCert(t, ca, env.backendKey.PublicKey(), []string{"wrong-principal"},
+		now.Add(-time.Hour), now.Add(time.Hour))
+
+	certSigner, err := ssh.NewCertSigner(cert, env.backendKey)
+	if err != nil {
+		t.Fatalf("Failed to create cert signer: %v", err)
+	}
+
+	env.backendKey = certSigner
+
+	addr := env.start(t,
+		gateway.WithBackendHostKeyPolicy(
+			gateway.BackendHostKeyPolicyCA,
+			nil,
+			[]string{string(ssh.MarshalAuthorizedKey(ca.PublicKey()))},
+		),
+	)
+
+	// The session is refused with a non-zero exit status
+	if code, err := runSSHCommand(t, addr, env.privBytes, "exit 0"); err == nil && code == 0 {
+		t.Fatal("Expected session to fail with an untrusted backend host certificate")
+	}
+}
@@ -0,0 +1,247 @@
+package gateway
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// OpenSSH host key update extension, see PROTOCOL in the OpenSSH sources
+const (
+	hostKeysRequestType      = "hostkeys-00@openssh.com"
+	hostKeysProveRequestType = "hostkeys-prove-00@openssh.com"
+)
+
+var (
+	errMalformedHostKeyList = errors.New("malformed host key list")
+	errHostKeyNotAdvertised = errors.New("requested host key is not advertised")
+)
+
+// servedHostKeys returns hostKey followed by the keys of types it doesn't
+// serve, as AddHostKey replaces the key of a type already added
+func servedHostKeys(hostKey ssh.Signer, keys []ssh.Signer, logger *log.Entry) []ssh.Signer {
+	served := []ssh.Signer{hostKey}
+	types := map[string]struct{}{hostKey.PublicKey().Type(): {}}
+
+	for _, key := range keys {
+		keyType := key.PublicKey().Type()
+		if _, ok := types[keyType]; ok {
+			logger.WithField("type", keyType).
+				Warn("Ignoring host key of a type already served")
+
+			continue
+		}
+
+		types[keyType] = struct{}{}
+		served = append(served, key)
+	}
+
+	return served
+}
+
+// setPreviousHostKeys serves the first of previous of each type in place of the
+// served key of the type until until, logging how long remains
+func (g *Gateway) setPreviousHostKeys(served, previous []ssh.Signer, until time.Time) {
+	remaining := time.Until(until)
+	if remaining <= 0 {
+		g.logger.WithField("grace_until", until).
+			Info("Host key rotation grace period is over, previous host keys are not served")
+
+		return
+	}
+
+	graceKeys := make([]ssh.Signer, 0, len(served))
+	types := make(map[string]struct{})
+
+	for _, key := range slices.Concat(previous, served) {
+		keyType := key.PublicKey().Type()
+		if _, ok := types[keyType]; ok {
+			continue
+		}
+
+		types[keyType] = struct{}{}
+		graceKeys = append(graceKeys, key)
+	}
+
+	g.graceConfig = g.newServerConfig(graceKeys)
+	g.gracePresentedKeys = graceKeys
+	g.graceHostKeys = advertisedHostKeys(graceKeys[0], slices.Concat(graceKeys[1:], g.hostKeys))
+	g.graceUntil = until
+
+	fingerprints := make([]string, 0, len(previous))
+	for _, key := range previous {
+		fingerprints = append(fingerprints, ssh.FingerprintSHA256(key.PublicKey()))
+	}
+
+	g.logger.WithFields(log.Fields{
+		"fingerprints": fingerprints,
+		"grace_until":  until,
+		"remaining":    remaining.Round(time.Second),
+	}).Info("Serving previous host keys until the rotation grace period ends")
+}
+
+// inHostKeyGracePeriod returns whether the previous host keys of a rotation are
+// served
+func (g *Gateway) inHostKeyGracePeriod() bool {
+	return g.graceConfig != nil && time.Now().Before(g.graceUntil)
+}
+
+// advertisedKeys returns the host keys advertised to clients now
+func (g *Gateway) advertisedKeys() []ssh.Signer {
+	if g.inHostKeyGracePeriod() {
+		return g.graceHostKeys
+	}
+
+	return g.hostKeys
+}
+
+// advertisedHostKeys returns hostKey followed by the additional keys it doesn't duplicate
+func advertisedHostKeys(hostKey ssh.Signer, additional []ssh.Signer) []ssh.Signer {
+	keys := []ssh.Signer{hostKey}
+	seen := map[string]struct{}{string(hostKey.PublicKey().Marshal()): {}}
+
+	for _, key := range additional {
+		blob := string(key.PublicKey().Marshal())
+		if _, ok := seen[blob]; ok {
+			continue
+		}
+
+		seen[blob] = struct{}{}
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// advertiseHostKeys sends the client every host key of the gateway so clients with
+// UpdateHostKeys enabled can add keys of a rotation to their known_hosts
+func (g *Gateway) advertiseHostKeys(conn *ssh.ServerConn, logger *log.Entry) {
+	var payload []byte
+	for _, key := range g.advertisedKeys() {
+		payload = appendSSHString(payload, key.PublicKey().Marshal())
+	}
+
+	if _, _, err := conn.SendRequest(hostKeysRequestType, false, payload); err != nil {
+		logger.WithField("remote_addr", remoteAddr(conn.RemoteAddr())).
+			WithError(err).
+			Debug("Failed to advertise host keys")
+	}
+}
+
+// interceptHostKeyProofs answers hostkeys-prove requests of the client and passes
+// every other global request on through the returned channel
+func (g *Gateway) interceptHostKeyProofs(
+	ctx context.Context,
+	conn *ssh.ServerConn,
+	reqs <-chan *ssh.Request,
+	logger *log.Entry,
+) <-chan *ssh.Request {
+	out := make(chan *ssh.Request)
+
+	go func() {
+		defer close(out)
+
+		for req := range reqs {
+			if req.Type != hostKeysProveRequestType {
+				select {
+				case out <- req:
+				case <-ctx.Done():
+					return
+				}
+
+				continue
+			}
+
+			proof, err := g.proveHostKeys(conn.SessionID(), req.Payload)
+			if err != nil {
+				logger.WithField("remote_addr", remoteAddr(conn.RemoteAddr())).
+					WithError(err).
+					Warn("Failed to prove host keys")
+			}
+
+			if req.WantReply {
+				_ = req.Reply(err == nil, proof)
+			}
+		}
+	}()
+
+	return out
+}
+
+// proveHostKeys signs the proof of ownership of each requested host key, in order
+func (g *Gateway) proveHostKeys(sessionID, payload []byte) ([]byte, error) {
+	var proof []byte
+
+	for len(payload) > 0 {
+		blob, rest, ok := readSSHString(payload)
+		if !ok {
+			return nil, errMalformedHostKeyList
+		}
+
+		payload = rest
+
+		signer := g.hostKeyByBlob(blob)
+		if signer == nil {
+			return nil, errHostKeyNotAdvertised
+		}
+
+		var data []byte
+		data = appendSSHString(data, []byte(hostKeysProveRequestType))
+		data = appendSSHString(data, sessionID)
+		data = appendSSHString(data, blob)
+
+		sig, err := signHostKeyProof(signer, data)
+		if err != nil {
+			return nil, err
+		}
+
+		proof = appendSSHString(proof, ssh.Marshal(sig))
+	}
+
+	return proof, nil
+}
+
+// signHostKeyProof signs the proof of a host key. RSA keys sign with SHA-512 as
+// OpenSSH does, clients refusing the SHA-1 ssh-rsa signatures.
+func signHostKeyProof(signer ssh.Signer, data []byte) (*ssh.Signature, error) {
+	if algorithmSigner, ok := signer.(ssh.AlgorithmSigner); ok &&
+		signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		return algorithmSigner.SignWithAlgorithm(rand.Reader, data, ssh.KeyAlgoRSASHA512)
+	}
+
+	return signer.Sign(rand.Reader, data)
+}
+
+func (g *Gateway) hostKeyByBlob(blob []byte) ssh.Signer {
+	for _, key := range g.advertisedKeys() {
+		if string(key.PublicKey().Marshal()) == string(blob) {
+			return key
+		}
+	}
+
+	return nil
+}
+
+func appendSSHString(b, s []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s))) //nolint:gosec // keys are small
+	return append(b, s...)
+}
+
+func readSSHString(b []byte) (s, rest []byte, ok bool) {
+	if len(b) < 4 {
+		return nil, nil, false
+	}
+
+	n := binary.BigEndian.Uint32(b)
+	if uint64(len(b)-4) < uint64(n) {
+		return nil, nil, false
+	}
+
+	return b[4 : 4+n], b[4+n:], true
+}
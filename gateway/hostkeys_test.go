@@ -0,0 +1,348 @@
+package gateway_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"golang.org/x/crypto/ssh"
+)
+
+// dialWithGlobalRequests connects in public key mode, returning the global
+// requests the gateway sends to the client
+func dialWithGlobalRequests(
+	t *testing.T,
+	addr string,
+	env *backendTestEnv,
+) (ssh.Conn, <-chan *ssh.Request) {
+	t.Helper()
+
+	signer, err := ssh.ParsePrivateKey(env.privBytes)
+	if err != nil {
+		t.Fatalf("Failed to parse private key: %v", err)
+	}
+
+	var d net.Dialer
+
+	nConn, err := d.DialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial gateway: %v", err)
+	}
+
+	conn, chans, reqs, err := ssh.NewClientConn(nConn, addr, &ssh.ClientConfig{
+		User: "testuser",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		//nolint:gosec // acceptable for testing
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Failed to establish SSH connection: %v", err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		for newChannel := range chans {
+			_ = newChannel.Reject(ssh.Prohibited, "not accepted by the test client")
+		}
+	}()
+
+	return conn, reqs
+}
+
+func appendSSHString(b, s []byte) []byte {
+	//nolint:gosec // strings in tests are small
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+func splitSSHStrings(t *testing.T, b []byte) [][]byte {
+	t.Helper()
+
+	var out [][]byte
+
+	for len(b) > 0 {
+		if len(b) < 4 || uint64(len(b)-4) < uint64(binary.BigEndian.Uint32(b)) {
+			t.Fatalf("Malformed string list")
+		}
+
+		n := binary.BigEndian.Uint32(b)
+		out = append(out, b[4:4+n])
+		b = b[4+n:]
+	}
+
+	return out
+}
+
+func TestHostKeyUpdates_AdvertisesAndProvesKeys(t *testing.T) {
+	nextKey, _, _, _ := generateTestKeys(t)
+
+	env := newBackendTestEnv(t)
+	addr := env.start(t,
+		gateway.WithHostKeyUpdates(true),
+		gateway.WithAdditionalHostKeys(nextKey, env.hostKey),
+	)
+
+	conn, reqs := dialWithGlobalRequests(t, addr, env)
+
+	var req *ssh.Request
+	select {
+	case req = <-reqs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("No host keys advertised")
+	}
+
+	if req.Type != "hostkeys-00@openssh.com" {
+		t.Fatalf("Request type = %s, want hostkeys-00@openssh.com", req.Type)
+	}
+
+	// The serving key is listed first and duplicates are dropped
+	blobs := splitSSHStrings(t, req.Payload)
+	if len(blobs) != 2 {
+		t.Fatalf("Advertised %d host keys, want 2", len(blobs))
+	}
+
+	if string(blobs[0]) != string(env.hostKey.PublicKey().Marshal()) ||
+		string(blobs[1]) != string(nextKey.PublicKey().Marshal()) {
+		t.Fatal("Advertised host keys don't match the configured keys")
+	}
+
+	// Ask for a proof of the new key like OpenSSH does for keys missing from known_hosts
+	ok, response, err := conn.SendRequest(
+		"hostkeys-prove-00@openssh.com", true, appendSSHString(nil, blobs[1]),
+	)
+	if err != nil || !ok {
+		t.Fatalf("hostkeys-prove = %v, %v, want success", ok, err)
+	}
+
+	proofs := splitSSHStrings(t, response)
+	if len(proofs) != 1 {
+		t.Fatalf("Got %d proofs, want 1", len(proofs))
+	}
+
+	var sig ssh.Signature
+	if err := ssh.Unmarshal(proofs[0], &sig); err != nil {
+		t.Fatalf("Failed to parse signature: %v", err)
+	}
+
+	var data []byte
+	for _, s := range [][]byte{
+		[]byte("hostkeys-prove-00@openssh.com"), conn.SessionID(), blobs[1],
+	} {
+		data = appendSSHString(data, s)
+	}
+
+	if err := nextKey.PublicKey().Verify(data, &sig); err != nil {
+		t.Errorf("Proof does not verify: %v", err)
+	}
+
+	// Keys that were never advertised can't be proven
+	unknownKey, _, _, _ := generateTestKeys(t)
+	payload := appendSSHString(nil, unknownKey.PublicKey().Marshal())
+
+	ok, _, err = conn.SendRequest("hostkeys-prove-00@openssh.com", true, payload)
+	if err != nil || ok {
+		t.Errorf("hostkeys-prove for unknown key = %v, %v, want refusal", ok, err)
+	}
+}
+
+func TestHostKeyUpdates_ProvesRSAKeysWithSHA512(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+
+	nextKey, err := ssh.NewSignerFromKey(rsaKey)
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+
+	env := newBackendTestEnv(t)
+	addr := env.start(t,
+		gateway.WithHostKeyUpdates(true),
+		gateway.WithAdditionalHostKeys(nextKey),
+	)
+
+	conn, _ := dialWithGlobalRequests(t, addr, env)
+
+	blob := nextKey.PublicKey().Marshal()
+
+	ok, response, err := conn.SendRequest(
+		"hostkeys-prove-00@openssh.com", true, appendSSHString(nil, blob),
+	)
+	if err != nil || !ok {
+		t.Fatalf("hostkeys-prove = %v, %v, want success", ok, err)
+	}
+
+	proofs := splitSSHStrings(t, response)
+	if len(proofs) != 1 {
+		t.Fatalf("Got %d proofs, want 1", len(proofs))
+	}
+
+	var sig ssh.Signature
+	if err := ssh.Unmarshal(proofs[0], &sig); err != nil {
+		t.Fatalf("Failed to parse signature: %v", err)
+	}
+
+	if sig.Format != ssh.KeyAlgoRSASHA512 {
+		t.Errorf("Proof signed with %s, want %s", sig.Format, ssh.KeyAlgoRSASHA512)
+	}
+
+	var data []byte
+	for _, s := range [][]byte{
+		[]byte("hostkeys-prove-00@openssh.com"), conn.SessionID(), blob,
+	} {
+		data = appendSSHString(data, s)
+	}
+
+	if err := nextKey.PublicKey().Verify(data, &sig); err != nil {
+		t.Errorf("Proof does not verify: %v", err)
+	}
+}
+
+func TestHostKeyUpdates_DisabledByDefault(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t)
+
+	conn, reqs := dialWithGlobalRequests(t, addr, env)
+
+	// A round trip on the connection orders any advertisement before this point
+	if _, _, err := conn.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+		t.Fatalf("Keepalive failed: %v", err)
+	}
+
+	select {
+	case req := <-reqs:
+		t.Errorf("Unexpected global request %s", req.Type)
+	default:
+	}
+}
+
+func TestHostKeys_ServedByType(t *testing.T) {
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	ecdsaSigner, err := ssh.NewSignerFromKey(ecdsaKey)
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+
+	// A second ed25519 key is ignored, the host key of New stays served
+	otherED25519, _, _, _ := generateTestKeys(t)
+
+	env := newBackendTestEnv(t)
+	addr := env.start(t, gateway.WithHostKeys(ecdsaSigner, otherED25519))
+
+	tests := []struct {
+		algorithm string
+		want      ssh.Signer
+	}{
+		{algorithm: ssh.KeyAlgoED25519, want: env.hostKey},
+		{algorithm: ssh.KeyAlgoECDSA256, want: ecdsaSigner},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			var presented ssh.PublicKey
+
+			var d net.Dialer
+
+			nConn, err := d.DialContext(context.Background(), "tcp", addr)
+			if err != nil {
+				t.Fatalf("Failed to dial gateway: %v", err)
+			}
+			defer nConn.Close()
+
+			// Authentication fails, the host key is checked before
+			_, _, _, _ = ssh.NewClientConn(nConn, addr, &ssh.ClientConfig{
+				User:              "testuser",
+				HostKeyAlgorithms: []string{tt.algorithm},
+				HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+					presented = key
+					return nil
+				},
+				Timeout: 5 * time.Second,
+			})
+
+			if presented == nil ||
+				string(presented.Marshal()) != string(tt.want.PublicKey().Marshal()) {
+				t.Errorf("Gateway presented another host key for %s", tt.algorithm)
+			}
+		})
+	}
+}
+
+func TestHostKeyRotation_GracePeriod(t *testing.T) {
+	previousKey, _, _, _ := generateTestKeys(t)
+
+	tests := []struct {
+		name    string
+		until   time.Time
+		wantErr bool
+	}{
+		{name: "during the grace period", until: time.Now().Add(time.Hour)},
+		{name: "after the grace period", until: time.Now().Add(-time.Minute), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newBackendTestEnv(t)
+			addr := env.start(t,
+				gateway.WithHostKeyUpdates(true),
+				gateway.WithPreviousHostKeys(tt.until, previousKey),
+			)
+
+			signer, err := ssh.ParsePrivateKey(env.privBytes)
+			if err != nil {
+				t.Fatalf("Failed to parse private key: %v", err)
+			}
+
+			// The client pinned the key from before the rotation
+			client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+				User:            "testuser",
+				Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+				HostKeyCallback: ssh.FixedHostKey(previousKey.PublicKey()),
+				Timeout:         5 * time.Second,
+			})
+			if tt.wantErr {
+				if err == nil {
+					client.Close()
+					t.Fatal("Handshake with the previous host key succeeded after the grace period")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Handshake with the previous host key failed: %v", err)
+			}
+
+			client.Close()
+
+			// Clients with host key updates learn the new key meanwhile
+			_, reqs := dialWithGlobalRequests(t, addr, env)
+
+			select {
+			case req := <-reqs:
+				blobs := splitSSHStrings(t, req.Payload)
+				if len(blobs) != 2 ||
+					string(blobs[0]) != string(previousKey.PublicKey().Marshal()) ||
+					string(blobs[1]) != string(env.hostKey.PublicKey().Marshal()) {
+					t.Error("Advertised host keys are not the previous and the new key")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("No host keys advertised")
+			}
+		})
+	}
+}
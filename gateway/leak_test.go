@@ -0,0 +1,154 @@
+package gateway_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/goleak"
+	"golang.org/x/crypto/ssh"
+)
+
+// openAndDrop authenticates a client, runs start and cuts the TCP connection
+// without closing anything on the SSH level, like a client losing its network
+func openAndDrop(
+	t *testing.T,
+	addr string,
+	config *ssh.ClientConfig,
+	start func(*ssh.Client) error,
+) {
+	t.Helper()
+
+	var d net.Dialer
+
+	nConn, err := d.DialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial gateway: %v", err)
+	}
+	defer nConn.Close()
+
+	conn, chans, reqs, err := ssh.NewClientConn(nConn, addr, config)
+	if err != nil {
+		t.Fatalf("Failed to establish SSH connection: %v", err)
+	}
+
+	if start == nil {
+		return
+	}
+
+	if err := start(ssh.NewClient(conn, chans, reqs)); err != nil {
+		t.Fatalf("Failed to start: %v", err)
+	}
+}
+
+// startCommand opens a session running command, or no command if it is empty
+func startCommand(command string) func(*ssh.Client) error {
+	return func(client *ssh.Client) error {
+		session, err := client.NewSession()
+		if err != nil || command == "" {
+			return err
+		}
+
+		return session.Start(command)
+	}
+}
+
+// hangingListener accepts TCP connections and never speaks on them,
+// like a devbox whose SSH server is stuck
+func hangingListener(t *testing.T) int {
+	t.Helper()
+
+	var lc net.ListenConfig
+
+	ln, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	var (
+		mu    sync.Mutex
+		conns []net.Conn
+	)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+
+	t.Cleanup(func() {
+		ln.Close()
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestHandleConnection_NoGoroutineLeak(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t)
+
+	hung := newBackendTestEnv(t)
+	hung.backendPort = hangingListener(t)
+	hungAddr := hung.start(t)
+
+	userSigner, _, _, _ := generateTestKeys(t)
+
+	clientConfig := func(user string, key []byte) *ssh.ClientConfig {
+		signer := userSigner
+
+		if key != nil {
+			var err error
+			if signer, err = ssh.ParsePrivateKey(key); err != nil {
+				t.Fatalf("Failed to parse private key: %v", err)
+			}
+		}
+
+		return &ssh.ClientConfig{
+			User: user,
+			Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			//nolint:gosec // acceptable for testing
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		}
+	}
+
+	publicKey := clientConfig("testuser", env.privBytes)
+	hungPublicKey := clientConfig("testuser", hung.privBytes)
+	customKey := clientConfig("testuser@test-test-devbox", nil)
+
+	// Warm up so lazily started goroutines are part of the baseline
+	openAndDrop(t, addr, publicKey, startCommand("discard"))
+
+	time.Sleep(100 * time.Millisecond)
+
+	baseline := goleak.IgnoreCurrent()
+
+	for range 20 {
+		// Mid-transfer, the backend waits on more data
+		openAndDrop(t, addr, publicKey, startCommand("discard"))
+		// Before any command
+		openAndDrop(t, addr, publicKey, startCommand(""))
+		// Waiting on the agent forwarding request that never comes
+		openAndDrop(t, addr, customKey, startCommand(""))
+		// Waiting on the handshake of a stuck backend
+		openAndDrop(t, hungAddr, hungPublicKey, nil)
+	}
+
+	goleak.VerifyNone(t, baseline)
+}
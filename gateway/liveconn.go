@@ -0,0 +1,254 @@
+package gateway
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+)
+
+// revocationNoticeTimeout bounds the delivery of the notice to the sessions of a
+// terminated connection, a client not reading must not keep it open
+const revocationNoticeTimeout = time.Second
+
+// PodRestartedExitStatus is the exit status of the sessions ended because the pod
+// of their devbox restarted or stopped, the status OpenSSH exits with when the
+// connection is lost
+const PodRestartedExitStatus = 255
+
+// liveConn is an established client connection
+type liveConn struct {
+	conn   ssh.Conn
+	logger *log.Entry
+	audit  *connAudit
+	// podIP is the pod IP of the devbox when the connection was established
+	podIP string
+	// fingerprints are the SHA256 fingerprints of the key the connection was
+	// authenticated with, and of the certified key for certificates
+	fingerprints []string
+
+	mu sync.Mutex
+	// sessions are the session channels accepted from the client
+	sessions map[ssh.Channel]struct{}
+}
+
+func newLiveConn(
+	conn *ssh.ServerConn,
+	logger *log.Entry,
+	audit *connAudit,
+	podIP string,
+) *liveConn {
+	return &liveConn{
+		conn:         conn,
+		logger:       logger,
+		audit:        audit,
+		podIP:        podIP,
+		fingerprints: permissionsKeyFingerprints(conn.Permissions),
+		sessions:     make(map[ssh.Channel]struct{}),
+	}
+}
+
+// trackSession records a session channel to notify when the connection is
+// terminated, until the returned function is called
+func (c *liveConn) trackSession(channel ssh.Channel) (untrack func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.sessions[channel] = struct{}{}
+
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		delete(c.sessions, channel)
+	}
+}
+
+// terminate writes notice to the stderr of every session and closes the
+// connection, recording reason. Sessions end with exitStatus when it is set.
+func (c *liveConn) terminate(reason, notice string, exitStatus *uint32) {
+	c.audit.setReason(reason)
+
+	c.mu.Lock()
+
+	sessions := make([]ssh.Channel, 0, len(c.sessions))
+	for channel := range c.sessions {
+		sessions = append(sessions, channel)
+	}
+
+	c.mu.Unlock()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		for _, channel := range sessions {
+			fmt.Fprintf(channel.Stderr(), "\r\n%s\r\n", notice)
+
+			if exitStatus != nil {
+				_, _ = channel.SendRequest(
+					"exit-status",
+					false,
+					ssh.Marshal(struct{ Status uint32 }{*exitStatus}),
+				)
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(revocationNoticeTimeout):
+	}
+
+	_ = c.conn.Close()
+}
+
+// liveConns indexes the established client connections by devbox
+type liveConns struct {
+	mu sync.Mutex
+	// namespace/devboxName -> connections
+	conns map[string]map[*liveConn]struct{}
+}
+
+func newLiveConns() *liveConns {
+	return &liveConns{conns: make(map[string]map[*liveConn]struct{})}
+}
+
+// add indexes a connection to a devbox until the returned function is called
+func (l *liveConns) add(namespace, devboxName string, conn *liveConn) (remove func()) {
+	key := namespace + "/" + devboxName
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conns[key] == nil {
+		l.conns[key] = make(map[*liveConn]struct{})
+	}
+
+	l.conns[key][conn] = struct{}{}
+
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		delete(l.conns[key], conn)
+
+		if len(l.conns[key]) == 0 {
+			delete(l.conns, key)
+		}
+	}
+}
+
+// devbox returns the connections to a devbox
+func (l *liveConns) devbox(namespace, devboxName string) []*liveConn {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	conns := make([]*liveConn, 0, len(l.conns[namespace+"/"+devboxName]))
+	for conn := range l.conns[namespace+"/"+devboxName] {
+		conns = append(conns, conn)
+	}
+
+	return conns
+}
+
+// all returns every connection
+func (l *liveConns) all() []*liveConn {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var conns []*liveConn
+
+	for _, devboxConns := range l.conns {
+		for conn := range devboxConns {
+			conns = append(conns, conn)
+		}
+	}
+
+	return conns
+}
+
+// handleRevocationEvent terminates the connections to a devbox whose key was
+// replaced or whose secret was deleted, or only logs them in log only mode
+func (g *Gateway) handleRevocationEvent(event registry.Event) {
+	var notice string
+
+	switch event.Type {
+	case registry.EventSecretDeleted:
+		notice = fmt.Sprintf(
+			"devbox %s/%s was deleted or its key revoked, closing connection",
+			event.Namespace,
+			event.DevboxName,
+		)
+	case registry.EventPublicKeyChanged:
+		notice = fmt.Sprintf(
+			"the key of devbox %s/%s was changed, closing connection",
+			event.Namespace,
+			event.DevboxName,
+		)
+	case registry.EventKeysRevoked:
+		g.handleKeysRevokedEvent(event)
+		return
+	default:
+		return
+	}
+
+	for _, conn := range g.liveConns.devbox(event.Namespace, event.DevboxName) {
+		if !g.opts().TerminateRevokedConns {
+			conn.logger.Warn("Devbox key revoked, connection left open")
+			continue
+		}
+
+		conn.logger.Warn("Devbox key revoked, terminating connection")
+
+		go conn.terminate(AuditReasonRevoked, notice, nil)
+	}
+}
+
+// handlePodRestartEvent terminates the connections to a devbox whose pod was
+// deleted or got another IP, their backend connections are gone with the previous
+// pod. Sessions are told right away instead of hanging until TCP times out.
+// Connections to a pod the devbox still has, as when a newer pod is preferred
+// while the previous one runs, are left alone.
+func (g *Gateway) handlePodRestartEvent(event registry.Event) {
+	var notice string
+
+	switch event.Type {
+	case registry.EventPodIPChanged:
+		notice = fmt.Sprintf(
+			"the pod of devbox %s/%s restarted, closing connection, reconnect to continue",
+			event.Namespace,
+			event.DevboxName,
+		)
+	case registry.EventPodDeleted:
+		notice = fmt.Sprintf(
+			"the pod of devbox %s/%s was deleted, closing connection",
+			event.Namespace,
+			event.DevboxName,
+		)
+	default:
+		return
+	}
+
+	exitStatus := uint32(PodRestartedExitStatus)
+
+	for _, conn := range g.liveConns.devbox(event.Namespace, event.DevboxName) {
+		// Connections established to the new pod already are left alone
+		if event.Type == registry.EventPodIPChanged && conn.podIP == event.PodIP {
+			continue
+		}
+
+		if event.Info != nil && event.Info.HasAddress(conn.podIP) {
+			continue
+		}
+
+		conn.logger.WithField("pod_ip", event.PodIP).
+			Warn("Devbox pod restarted, terminating connection")
+
+		go conn.terminate(AuditReasonPodRestarted, notice, &exitStatus)
+	}
+}
@@ -0,0 +1,311 @@
+package gateway_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// testSecret returns the secret of the test devbox holding the given keys
+func testSecret(pubBytes, privBytes []byte) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-secret",
+			Namespace: "ns-test",
+			Labels: map[string]string{
+				registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: registry.DevboxOwnerKind, Name: "test-devbox"},
+			},
+		},
+		Data: map[string][]byte{
+			registry.DevboxPublicKeyField:  pubBytes,
+			registry.DevboxPrivateKeyField: privBytes,
+		},
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+// startLongSession starts a session that runs until its connection is closed,
+// collecting its stderr
+func startLongSession(t *testing.T, client *ssh.Client) (*ssh.Session, *syncBuffer) {
+	t.Helper()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+
+	stderr := &syncBuffer{}
+	session.Stderr = stderr
+
+	// Keep stdin open so the command never ends on its own
+	if _, err := session.StdinPipe(); err != nil {
+		t.Fatalf("Failed to open stdin: %v", err)
+	}
+
+	if err := session.Start("discard"); err != nil {
+		t.Fatalf("Failed to start session: %v", err)
+	}
+
+	return session, stderr
+}
+
+// waitForClose waits until the gateway closes the client connection
+func waitForClose(t *testing.T, client *ssh.Client) {
+	t.Helper()
+
+	done := make(chan struct{})
+
+	go func() {
+		_ = client.Wait()
+
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Connection still open 3s after the revocation")
+	}
+}
+
+func TestRevocation_SecretDeletedClosesConnections(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t)
+
+	pkClient := dialPublicKeyMode(t, addr, env)
+	defer pkClient.Close()
+
+	agentClient := dialAgentForwardMode(t, addr, env)
+	defer agentClient.Close()
+
+	pkSession, pkStderr := startLongSession(t, pkClient)
+	runAgentForwardSession(t, agentClient)
+
+	env.reg.DeleteSecret(testSecret(nil, nil))
+
+	waitForClose(t, pkClient)
+	waitForClose(t, agentClient)
+
+	// Wait returns once stderr is copied
+	_ = pkSession.Wait()
+
+	if !strings.Contains(pkStderr.String(), "was deleted or its key revoked") {
+		t.Errorf("Session stderr = %q, want a revocation notice", pkStderr.String())
+	}
+}
+
+func TestRevocation_KeyChangeClosesConnections(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t)
+
+	client := dialPublicKeyMode(t, addr, env)
+	defer client.Close()
+
+	session, stderr := startLongSession(t, client)
+
+	_, _, pubBytes, privBytes := generateTestKeys(t)
+	if err := env.reg.AddSecret(nil, testSecret(pubBytes, privBytes)); err != nil {
+		t.Fatalf("Failed to replace secret: %v", err)
+	}
+
+	waitForClose(t, client)
+
+	_ = session.Wait()
+
+	if !strings.Contains(stderr.String(), "was changed") {
+		t.Errorf("Session stderr = %q, want a key change notice", stderr.String())
+	}
+
+	// The replaced key no longer authenticates in public key mode
+	signer, err := ssh.ParsePrivateKey(env.privBytes)
+	if err != nil {
+		t.Fatalf("Failed to parse private key: %v", err)
+	}
+
+	_, err = ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User: "testuser",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		//nolint:gosec // acceptable for testing
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err == nil {
+		t.Error("Replaced key still authenticates")
+	}
+}
+
+func TestRevocation_LogOnly(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t, gateway.WithTerminateRevokedConns(false))
+
+	client := dialPublicKeyMode(t, addr, env)
+	defer client.Close()
+
+	env.reg.DeleteSecret(testSecret(nil, nil))
+
+	// The connection and its backend connection keep working
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to create session after revocation: %v", err)
+	}
+	defer session.Close()
+
+	if err := session.Run("exit 0"); err != nil {
+		t.Errorf("Session after revocation failed: %v", err)
+	}
+}
+
+func TestPodRestart_ClosesConnections(t *testing.T) {
+	tests := []struct {
+		name    string
+		restart func(reg *registry.Registry)
+		notice  string
+	}{
+		{
+			name: "new pod IP",
+			restart: func(reg *registry.Registry) {
+				setPodIP(t, reg, "127.0.0.2")
+			},
+			notice: "the pod of devbox ns-test/test-devbox restarted",
+		},
+		{
+			name: "pod deleted",
+			restart: func(reg *registry.Registry) {
+				reg.DeletePod(&corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "test-pod",
+						Namespace: "ns-test",
+						OwnerReferences: []metav1.OwnerReference{
+							{Kind: registry.DevboxOwnerKind, Name: "test-devbox"},
+						},
+					},
+				})
+			},
+			notice: "the pod of devbox ns-test/test-devbox was deleted",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newBackendTestEnv(t)
+			addr := env.start(t)
+
+			client := dialPublicKeyMode(t, addr, env)
+			defer client.Close()
+
+			session, stderr := startLongSession(t, client)
+
+			tt.restart(env.reg)
+
+			waitForClose(t, client)
+
+			var exitErr *ssh.ExitError
+			if err := session.Wait(); !errors.As(err, &exitErr) ||
+				exitErr.ExitStatus() != gateway.PodRestartedExitStatus {
+				t.Errorf("Session ended with %v, want exit status %d",
+					err, gateway.PodRestartedExitStatus)
+			}
+
+			if !strings.Contains(stderr.String(), tt.notice) {
+				t.Errorf("Session stderr = %q, want %q", stderr.String(), tt.notice)
+			}
+		})
+	}
+}
+
+func TestPodRestart_PreviousPodRunning(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t)
+
+	client := dialPublicKeyMode(t, addr, env)
+	defer client.Close()
+
+	// A newer pod is preferred while the pod of the connection still runs
+	newer := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "test-pod-2",
+			Namespace:         "ns-test",
+			CreationTimestamp: metav1.Now(),
+			Labels: map[string]string{
+				registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: registry.DevboxOwnerKind, Name: "test-devbox"},
+			},
+		},
+		Status: corev1.PodStatus{
+			Phase:      corev1.PodRunning,
+			PodIP:      "127.0.0.2",
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: "True"}},
+		},
+	}
+	if err := env.reg.UpdatePod(newer); err != nil {
+		t.Fatalf("Failed to update pod: %v", err)
+	}
+
+	if info, _ := env.reg.GetDevboxInfo("ns-test", "test-devbox"); info.PodIP != "127.0.0.2" {
+		t.Fatalf("Devbox routed to %s, want the newer pod", info.PodIP)
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to create session after the newer pod: %v", err)
+	}
+	defer session.Close()
+
+	if err := session.Run("exit 0"); err != nil {
+		t.Errorf("Session after the newer pod failed: %v", err)
+	}
+}
+
+func TestPodRestart_Disabled(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t, gateway.WithTerminateRestartedPodConns(false))
+
+	client := dialPublicKeyMode(t, addr, env)
+	defer client.Close()
+
+	setPodIP(t, env.reg, "127.0.0.2")
+
+	// The backend connection to the mock devbox survives the new pod IP
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to create session after restart: %v", err)
+	}
+	defer session.Close()
+
+	if err := session.Run("exit 0"); err != nil {
+		t.Errorf("Session after restart failed: %v", err)
+	}
+}
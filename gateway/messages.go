@@ -0,0 +1,195 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+)
+
+// clientMessage identifies a message explaining a failure to the client
+type clientMessage int
+
+const (
+	msgDevboxNotFound clientMessage = iota
+	msgDevboxStopped
+	msgDevboxStoppedOnPurpose
+	msgDevboxPodUnavailable
+	msgDevboxStarting
+	msgDevboxUnreachable
+	msgBackendUnavailable
+	msgBackendAuthRejected
+	msgBackendHostKeyRejected
+	msgAgentUnavailable
+	msgSFTPOnly
+	msgInternalError
+)
+
+// clientMessages are the texts of the messages explaining failures to clients,
+// kept together so they can be localized. {namespace}, {devbox} and {since} are
+// substituted. They never carry internal details such as pod IPs.
+var clientMessages = map[clientMessage]string{
+	msgDevboxNotFound: "unknown devbox {namespace}/{devbox}",
+	msgDevboxStopped:  "devbox {namespace}/{devbox} is stopped, start it and try again",
+	msgDevboxStoppedOnPurpose: "devbox {namespace}/{devbox} is stopped, " +
+		"start it from the dashboard and try again",
+	msgDevboxPodUnavailable: "devbox {namespace}/{devbox} should be running " +
+		"but its pod is unavailable, try again later",
+	msgDevboxStarting: "devbox {namespace}/{devbox} is starting, try again shortly",
+	msgDevboxUnreachable: "devbox {namespace}/{devbox} is unreachable since {since}, " +
+		"try again later",
+	msgBackendUnavailable: "failed to connect to devbox {namespace}/{devbox}, try again later",
+	msgBackendAuthRejected: "devbox {namespace}/{devbox} rejected your key, " +
+		"make sure your SSH agent holds it and it is in ~/.ssh/authorized_keys on the devbox",
+	msgBackendHostKeyRejected: "devbox {namespace}/{devbox} presented an untrusted host key",
+	msgAgentUnavailable: "failed to establish agent forwarding. " +
+		"Make sure your SSH agent is running and has the correct keys",
+	msgSFTPOnly:      "this devbox only allows SFTP",
+	msgInternalError: "internal gateway error, try again later",
+}
+
+// message renders a client message about a devbox. The internal cause is only
+// appended with ClientErrorDetails.
+func (g *Gateway) message(id clientMessage, info *registry.DevboxInfo, cause error) string {
+	var namespace, devboxName, since string
+	if info != nil {
+		namespace, devboxName = info.Namespace, info.DevboxName
+
+		health, ok := g.registry.BackendHealth(namespace, devboxName)
+		if ok && health.Unreachable {
+			since = health.UnreachableSince.Format(time.TimeOnly)
+		}
+	}
+
+	message := strings.NewReplacer(
+		BannerPlaceholderNamespace, namespace,
+		BannerPlaceholderDevbox, devboxName,
+		"{since}", since,
+	).Replace(clientMessages[id])
+
+	if cause != nil && g.opts().ClientErrorDetails {
+		message += ": " + cause.Error()
+	}
+
+	return message
+}
+
+// backendFailureMessage classifies why the backend of info could not be reached
+func backendFailureMessage(err error, info *registry.DevboxInfo) clientMessage {
+	switch {
+	case errors.Is(err, ErrDevboxNotFound):
+		return msgDevboxNotFound
+	case errors.Is(err, ErrDevboxNotRunning):
+		return notRunningMessage(info)
+	case errors.Is(err, ErrDevboxStarting):
+		return msgDevboxStarting
+	case errors.Is(err, ErrBackendHostKeyRejected):
+		return msgBackendHostKeyRejected
+	case isBackendAuthError(err):
+		return msgBackendAuthRejected
+	default:
+		return msgBackendUnavailable
+	}
+}
+
+// notRunningMessage tells a devbox without a pod stopped on purpose from one
+// that should be running, by the state requested for it
+func notRunningMessage(info *registry.DevboxInfo) clientMessage {
+	if info == nil {
+		return msgDevboxStopped
+	}
+
+	switch info.DesiredState {
+	case registry.DesiredStateStopped:
+		return msgDevboxStoppedOnPurpose
+	case registry.DesiredStateRunning:
+		return msgDevboxPodUnavailable
+	default:
+		return msgDevboxStopped
+	}
+}
+
+// isBackendAuthError reports whether the backend refused every offered key,
+// x/crypto/ssh has no typed error for it
+func isBackendAuthError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "ssh: unable to authenticate")
+}
+
+// failSession explains a failure on an accepted session channel once the client
+// starts it with a shell, command or subsystem, then ends the session with a
+// non-zero exit status. The requests setting up the session, cached ones first,
+// are acknowledged so the client gets that far.
+func failSession(
+	channel ssh.Channel,
+	cached []*ssh.Request,
+	requests <-chan *ssh.Request,
+	message string,
+) {
+	defer channel.Close()
+	defer func() { go ssh.DiscardRequests(requests) }()
+
+	for _, req := range cached {
+		// The gateway already answered the agent request
+		if req.Type != agentRequestType && answerFailedSession(channel, req, message) {
+			return
+		}
+	}
+
+	for req := range requests {
+		if answerFailedSession(channel, req, message) {
+			return
+		}
+	}
+}
+
+// answerFailedSession acknowledges a request of a failed session, explaining the
+// failure if it starts the session. It reports whether the session is over.
+func answerFailedSession(channel ssh.Channel, req *ssh.Request, message string) bool {
+	if req.WantReply {
+		_ = req.Reply(true, nil)
+	}
+
+	switch req.Type {
+	case "shell", "exec", "subsystem":
+		_, _ = fmt.Fprintf(channel.Stderr(), "%s\r\n", message)
+		_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{1}))
+
+		return true
+	default:
+		return false
+	}
+}
+
+// refuseConnection explains a failure of the whole connection. x/crypto/ssh cannot
+// send a disconnect message, so the first session channel is accepted to show it
+// and exit with a non-zero status, other channels are rejected with it until then.
+// It returns once the session ended or the client went away.
+func refuseConnection(
+	chans <-chan ssh.NewChannel,
+	reqs <-chan *ssh.Request,
+	message string,
+	logger *log.Entry,
+) {
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.ConnectionFailed, message)
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			logger.WithError(err).Debug("Failed to accept session channel to explain failure")
+			return
+		}
+
+		failSession(channel, nil, requests, message)
+
+		return
+	}
+}
@@ -0,0 +1,278 @@
+package gateway_test
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// refusedSession runs a command on a new session, returning what the session
+// wrote to stderr and its exit status
+func refusedSession(
+	t *testing.T,
+	client *ssh.Client,
+	setup func(*ssh.Session) error,
+) (string, int) {
+	t.Helper()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer session.Close()
+
+	stderr, err := session.StderrPipe()
+	if err != nil {
+		t.Fatalf("Failed to open stderr: %v", err)
+	}
+
+	if setup != nil {
+		if err := setup(session); err != nil {
+			t.Fatalf("Failed to set up session: %v", err)
+		}
+	}
+
+	if err := session.Start("exit 0"); err != nil {
+		t.Fatalf("Failed to start session: %v", err)
+	}
+
+	message, err := io.ReadAll(stderr)
+	if err != nil {
+		t.Fatalf("Failed to read stderr: %v", err)
+	}
+
+	err = session.Wait()
+
+	var exitErr *ssh.ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("Session ended with %v, want a non-zero exit status", err)
+	}
+
+	return string(message), exitErr.ExitStatus()
+}
+
+// checkRefusal checks a session was refused with a message containing want
+func checkRefusal(
+	t *testing.T,
+	client *ssh.Client,
+	setup func(*ssh.Session) error,
+	want string,
+) string {
+	t.Helper()
+
+	message, status := refusedSession(t, client, setup)
+	if status != 1 {
+		t.Errorf("Exit status = %d, want 1", status)
+	}
+
+	if !strings.Contains(message, want) {
+		t.Errorf("Message = %q, want %q", message, want)
+	}
+
+	return message
+}
+
+func requestAgent(s *ssh.Session) error {
+	return agent.RequestAgentForwarding(s)
+}
+
+func TestClientMessage_UnknownDevbox(t *testing.T) {
+	env := newBackendTestEnv(t)
+
+	// Connections to deleted devboxes are kept for their sessions to explain
+	addr := env.start(t, gateway.WithTerminateRevokedConns(false))
+
+	client := dialAgentForwardMode(t, addr, env)
+	defer client.Close()
+
+	// The devbox is deleted after the client authenticated
+	env.reg.DeleteSecret(testSecret(nil, nil))
+
+	checkRefusal(t, client, requestAgent, "unknown devbox ns-test/test-devbox")
+}
+
+func TestClientMessage_DevboxStopped(t *testing.T) {
+	t.Run("public key mode", func(t *testing.T) {
+		env := newBackendTestEnv(t)
+		addr := env.start(t)
+
+		setPodIP(t, env.reg, "")
+
+		client := dialPublicKeyMode(t, addr, env)
+
+		checkRefusal(t, client, nil, "devbox ns-test/test-devbox is stopped")
+	})
+
+	t.Run("agent forwarding mode", func(t *testing.T) {
+		env := newBackendTestEnv(t)
+		addr := env.start(t)
+
+		setPodIP(t, env.reg, "")
+
+		client := dialAgentForwardMode(t, addr, env)
+		defer client.Close()
+
+		checkRefusal(t, client, requestAgent, "devbox ns-test/test-devbox is stopped")
+	})
+}
+
+// setDesiredState annotates the secret of the test devbox with a desired state
+func setDesiredState(t *testing.T, env *backendTestEnv, state string) {
+	t.Helper()
+
+	signer, err := ssh.ParsePrivateKey(env.privBytes)
+	if err != nil {
+		t.Fatalf("Failed to parse private key: %v", err)
+	}
+
+	secret := testSecret(ssh.MarshalAuthorizedKey(signer.PublicKey()), env.privBytes)
+	secret.Annotations = map[string]string{registry.DesiredStateAnnotation: state}
+
+	if err := env.reg.AddSecret(nil, secret); err != nil {
+		t.Fatalf("Failed to annotate secret: %v", err)
+	}
+}
+
+func TestClientMessage_DesiredState(t *testing.T) {
+	tests := []struct {
+		state string
+		want  string
+	}{
+		{state: "", want: "devbox ns-test/test-devbox is stopped, start it and try again"},
+		{
+			state: "Stopped",
+			want: "devbox ns-test/test-devbox is stopped, " +
+				"start it from the dashboard and try again",
+		},
+		{
+			state: "running",
+			want: "devbox ns-test/test-devbox should be running " +
+				"but its pod is unavailable, try again later",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run("state "+tt.state, func(t *testing.T) {
+			env := newBackendTestEnv(t)
+			addr := env.start(t)
+
+			setDesiredState(t, env, tt.state)
+			setPodIP(t, env.reg, "")
+
+			client := dialPublicKeyMode(t, addr, env)
+
+			checkRefusal(t, client, nil, tt.want)
+		})
+	}
+}
+
+func TestClientMessage_DevboxStarting(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t)
+
+	// The pod has its IP but fails its readiness probe
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pod",
+			Namespace: "ns-test",
+			Labels: map[string]string{
+				registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: registry.DevboxOwnerKind, Name: "test-devbox"},
+			},
+		},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodRunning,
+			PodIP: "127.0.0.1",
+			Conditions: []corev1.PodCondition{
+				{Type: corev1.PodReady, Status: corev1.ConditionFalse},
+			},
+		},
+	}
+	if err := env.reg.UpdatePod(pod); err != nil {
+		t.Fatalf("Failed to update pod: %v", err)
+	}
+
+	client := dialPublicKeyMode(t, addr, env)
+
+	checkRefusal(t, client, nil, "devbox ns-test/test-devbox is starting")
+
+	stats := env.gateway.AuthStats()
+	if got := stats.Failures[gateway.AuthFailureDevboxStarting]; got != 1 {
+		t.Errorf("Failures[%s] = %d, want 1", gateway.AuthFailureDevboxStarting, got)
+	}
+
+	// Once ready, the devbox is reached
+	pod.Status.Conditions[0].Status = corev1.ConditionTrue
+	if err := env.reg.UpdatePod(pod); err != nil {
+		t.Fatalf("Failed to update pod: %v", err)
+	}
+
+	runPublicKeySession(t, addr, env, "testuser")
+}
+
+func TestClientMessage_BackendUnreachable(t *testing.T) {
+	tests := []struct {
+		name    string
+		details bool
+	}{
+		{name: "without details"},
+		{name: "with details", details: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newBackendTestEnv(t)
+			addr := env.start(t, gateway.WithClientErrorDetails(tt.details))
+
+			// Nothing listens on the backend port of this address
+			setPodIP(t, env.reg, "127.0.0.2")
+
+			client := dialPublicKeyMode(t, addr, env)
+
+			message := checkRefusal(
+				t,
+				client,
+				nil,
+				"failed to connect to devbox ns-test/test-devbox",
+			)
+
+			// The pod IP is an internal detail
+			if got := strings.Contains(message, "127.0.0.2"); got != tt.details {
+				t.Errorf("Message %q reveals the pod IP = %v, want %v", message, got, tt.details)
+			}
+		})
+	}
+}
+
+func TestClientMessage_BackendAuthRejected(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t)
+
+	// The agent holds a key the devbox does not know
+	_, _, _, otherPriv := generateTestKeys(t)
+
+	otherKey, err := ssh.ParseRawPrivateKey(otherPriv)
+	if err != nil {
+		t.Fatalf("Failed to parse private key: %v", err)
+	}
+
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: otherKey}); err != nil {
+		t.Fatalf("Failed to add key to keyring: %v", err)
+	}
+
+	client := dialWithAgent(t, addr, keyring)
+	defer client.Close()
+
+	checkRefusal(t, client, requestAgent, "devbox ns-test/test-devbox rejected your key")
+}
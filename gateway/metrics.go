@@ -0,0 +1,46 @@
+package gateway
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricsCollectors returns the collectors of the gateway metrics. The backend
+// pool counters are read from the pool when scraped, staying at zero when
+// pooling is disabled.
+func (g *Gateway) metricsCollectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "sshgate_backend_pool_hits_total",
+			Help: "Backend connections taken from the pool of idle connections.",
+		}, func() float64 { return float64(g.BackendPoolStats().Hits) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "sshgate_backend_pool_misses_total",
+			Help: "Backend connections dialed because the pool held no idle connection.",
+		}, func() float64 { return float64(g.BackendPoolStats().Misses) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "sshgate_backend_pool_evictions_total",
+			Help: "Idle backend connections closed because they expired, overflowed " +
+				"the idle limit or belonged to a devbox whose pod changed.",
+		}, func() float64 { return float64(g.BackendPoolStats().Evictions) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "sshgate_backend_pool_idle",
+			Help: "Idle backend connections in the pool.",
+		}, func() float64 { return float64(g.BackendPoolStats().Idle) }),
+	}
+}
+
+// registerMetrics registers the gateway metrics on registerer, a nil
+// registerer registers none
+func (g *Gateway) registerMetrics(registerer prometheus.Registerer) error {
+	if registerer == nil {
+		return nil
+	}
+
+	for _, collector := range g.metricsCollectors() {
+		if err := registerer.Register(collector); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
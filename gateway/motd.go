@@ -0,0 +1,82 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+)
+
+// MOTDPlaceholderPodIP is substituted with the pod IP of the devbox in MOTD
+// templates, along with the banner placeholders
+const MOTDPlaceholderPodIP = "{pod_ip}"
+
+// DefaultMOTDTemplate is the MOTD shown at the start of PTY shell sessions
+const DefaultMOTDTemplate = "Connected to devbox {devbox} in namespace {namespace} via sshgate"
+
+// motd renders the MOTD of the sessions of a devbox, empty when none is shown.
+// The annotation of the devbox overrides the template of the gateway. The
+// resource usage of the devbox, when enabled and known, is appended.
+func (g *Gateway) motd(ctx context.Context, info *registry.DevboxInfo, user string) string {
+	if !g.opts().MOTDEnabled {
+		return ""
+	}
+
+	template := g.opts().MOTDTemplate
+	if info.MOTD != nil {
+		template = *info.MOTD
+	}
+
+	motd := strings.NewReplacer(
+		BannerPlaceholderUser, user,
+		BannerPlaceholderNamespace, info.Namespace,
+		BannerPlaceholderDevbox, info.DevboxName,
+		MOTDPlaceholderPodIP, info.PodIP,
+	).Replace(template)
+
+	if usage := g.usage.line(ctx, info); usage != "" {
+		if motd == "" {
+			return usage
+		}
+
+		motd += "\r\n" + usage
+	}
+
+	return motd
+}
+
+// injectMOTD writes motd to the client once the session starts a shell on a
+// PTY, before the shell request reaches the backend so that it precedes the
+// output of the shell. Commands and subsystems, like scp and sftp, never get it,
+// their data must stay byte-clean. Without a MOTD the requests are returned as is.
+func injectMOTD(in <-chan *ssh.Request, channel ssh.Channel, motd string) <-chan *ssh.Request {
+	if motd == "" {
+		return in
+	}
+
+	out := make(chan *ssh.Request)
+
+	go func() {
+		defer close(out)
+
+		var pty, injected bool
+
+		for req := range in {
+			switch req.Type {
+			case "pty-req":
+				pty = true
+			case "shell":
+				if pty && !injected {
+					_, _ = fmt.Fprintf(channel, "%s\r\n", motd)
+					injected = true
+				}
+			}
+
+			out <- req
+		}
+	}()
+
+	return out
+}
@@ -0,0 +1,193 @@
+package gateway_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+)
+
+func requestPty(s *ssh.Session) error {
+	return s.RequestPty("xterm", 24, 80, ssh.TerminalModes{})
+}
+
+// runShell runs a PTY shell session, returning its output
+func runShell(t *testing.T, client *ssh.Client) string {
+	t.Helper()
+
+	return runForcedSession(t, client, requestPty, func(s *ssh.Session) error {
+		return s.Shell()
+	})
+}
+
+// sendThrough sends payload through a session echoing its stdin, returning
+// what came back
+func sendThrough(
+	t *testing.T,
+	client *ssh.Client,
+	setup func(*ssh.Session) error,
+	start func(*ssh.Session) error,
+	payload []byte,
+) []byte {
+	t.Helper()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer session.Close()
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatalf("Failed to open stdin: %v", err)
+	}
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatalf("Failed to open stdout: %v", err)
+	}
+
+	if setup != nil {
+		if err := setup(session); err != nil {
+			t.Fatalf("Failed to set up session: %v", err)
+		}
+	}
+
+	if err := start(session); err != nil {
+		t.Fatalf("Failed to start session: %v", err)
+	}
+
+	go func() {
+		_, _ = stdin.Write(payload)
+		_ = stdin.Close()
+	}()
+
+	output, err := io.ReadAll(stdout)
+	if err != nil {
+		t.Fatalf("Failed to read session output: %v", err)
+	}
+
+	return output
+}
+
+func TestMOTD_PTYShell(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t,
+		gateway.WithMOTD(true, "Hello {user}, this is {namespace}/{devbox} at {pod_ip}"),
+	)
+
+	client := dialPublicKeyMode(t, addr, env)
+
+	const want = "Hello testuser, this is ns-test/test-devbox at 127.0.0.1\r\n"
+	if got := runShell(t, client); got != want {
+		t.Errorf("Output = %q, want %q", got, want)
+	}
+}
+
+func TestMOTD_AgentForwardMode(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t, gateway.WithMOTD(true, gateway.DefaultMOTDTemplate))
+
+	client := dialAgentForwardMode(t, addr, env)
+	defer client.Close()
+
+	got := runForcedSession(
+		t,
+		client,
+		func(s *ssh.Session) error {
+			if err := requestAgent(s); err != nil {
+				return err
+			}
+
+			return requestPty(s)
+		},
+		func(s *ssh.Session) error { return s.Shell() },
+	)
+
+	const want = "Connected to devbox test-devbox in namespace ns-test via sshgate\r\n"
+	if got != want {
+		t.Errorf("Output = %q, want %q", got, want)
+	}
+}
+
+func TestMOTD_DisabledByDefault(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t)
+
+	client := dialPublicKeyMode(t, addr, env)
+
+	if got := runShell(t, client); got != "" {
+		t.Errorf("Output = %q, want no MOTD", got)
+	}
+}
+
+func TestMOTD_AnnotationOverrides(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{name: "template", template: "Devbox {devbox}", want: "Devbox test-devbox\r\n"},
+		{name: "empty disables", template: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newBackendTestEnv(t)
+			addr := env.start(t, gateway.WithMOTD(true, gateway.DefaultMOTDTemplate))
+
+			setPodAnnotations(t, env.reg, map[string]string{
+				registry.MOTDAnnotation: tt.template,
+			})
+
+			client := dialPublicKeyMode(t, addr, env)
+
+			if got := runShell(t, client); got != tt.want {
+				t.Errorf("Output = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMOTD_DataStreamsStayClean(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t, gateway.WithMOTD(true, gateway.DefaultMOTDTemplate))
+
+	client := dialPublicKeyMode(t, addr, env)
+
+	payload := make([]byte, 64*1024)
+	_, _ = rand.Read(payload)
+
+	execEcho := func(s *ssh.Session) error { return s.Start("echo") }
+	subsystemEcho := func(s *ssh.Session) error { return s.RequestSubsystem("echo") }
+
+	tests := []struct {
+		name  string
+		setup func(*ssh.Session) error
+		start func(*ssh.Session) error
+	}{
+		{name: "exec, like scp", start: execEcho},
+		{name: "exec with PTY", setup: requestPty, start: execEcho},
+		{name: "subsystem, like sftp", start: subsystemEcho},
+		{name: "subsystem with PTY", setup: requestPty, start: subsystemEcho},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sendThrough(t, client, tt.setup, tt.start, payload)
+			if !bytes.Equal(got, payload) {
+				t.Errorf("Got %d bytes back, want the %d sent unchanged", len(got), len(payload))
+			}
+		})
+	}
+
+	// Shells without a PTY carry data too
+	got := runForcedSession(t, client, nil, func(s *ssh.Session) error { return s.Shell() })
+	if got != "" {
+		t.Errorf("Shell without PTY output = %q, want no MOTD", got)
+	}
+}
@@ -0,0 +1,138 @@
+package gateway_test
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/gateway"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// multiplexModes dial a client connection in each mode, sessions ask for the
+// agent in agent forwarding mode like OpenSSH with ForwardAgent does
+var multiplexModes = []struct {
+	name        string
+	dial        func(t *testing.T, addr string, env *backendTestEnv) *ssh.Client
+	askForAgent bool
+}{
+	{
+		name: "public key",
+		dial: dialPublicKeyMode,
+	},
+	{
+		name: "agent forwarding",
+		dial: func(t *testing.T, addr string, env *backendTestEnv) *ssh.Client {
+			t.Helper()
+			return dialAgentForwardMode(t, addr, env)
+		},
+		askForAgent: true,
+	},
+}
+
+// runExec runs "exit <status>" in a new session of client, returning the exit
+// status the client saw
+func runExec(client *ssh.Client, askForAgent bool, status int) (int, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return 0, fmt.Errorf("failed to open session: %w", err)
+	}
+	defer session.Close()
+
+	if askForAgent {
+		if err := agent.RequestAgentForwarding(session); err != nil {
+			return 0, fmt.Errorf("failed to request agent forwarding: %w", err)
+		}
+	}
+
+	err = session.Run(fmt.Sprintf("exit %d", status))
+
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus(), nil
+	}
+
+	return 0, err
+}
+
+// TestMultiplexedExecs runs many short commands one after the other over one
+// client connection, like Ansible over an OpenSSH ControlMaster does. None may
+// wait on the session request timeout, and every exit status must arrive.
+func TestMultiplexedExecs(t *testing.T) {
+	const (
+		execs = 200
+		// Far below execs times the session request timeout
+		maxDuration = 10 * time.Second
+	)
+
+	for _, mode := range multiplexModes {
+		t.Run(mode.name, func(t *testing.T) {
+			env := newBackendTestEnv(t)
+			addr := env.start(t, gateway.WithSessionRequestTimeout(time.Minute))
+
+			client := mode.dial(t, addr, env)
+			defer client.Close()
+
+			start := time.Now()
+
+			for i := range execs {
+				status, err := runExec(client, mode.askForAgent, i%7)
+				if err != nil {
+					t.Fatalf("Exec %d failed: %v", i, err)
+				}
+
+				if status != i%7 {
+					t.Fatalf("Exec %d: expected exit status %d, got %d", i, i%7, status)
+				}
+			}
+
+			if elapsed := time.Since(start); elapsed > maxDuration {
+				t.Fatalf("Expected %d execs within %s, took %s", execs, maxDuration, elapsed)
+			}
+		})
+	}
+}
+
+// TestMultiplexedExecs_Parallel runs short commands concurrently over one
+// client connection, the first sessions of which race to connect the backend
+func TestMultiplexedExecs_Parallel(t *testing.T) {
+	const execs = 50
+
+	for _, mode := range multiplexModes {
+		t.Run(mode.name, func(t *testing.T) {
+			env := newBackendTestEnv(t)
+			addr := env.start(t, gateway.WithSessionRequestTimeout(time.Minute))
+
+			client := mode.dial(t, addr, env)
+			defer client.Close()
+
+			var wg sync.WaitGroup
+
+			errs := make(chan error, execs)
+
+			for i := range execs {
+				wg.Go(func() {
+					status, err := runExec(client, mode.askForAgent, i%7)
+					if err != nil {
+						errs <- fmt.Errorf("exec %d failed: %w", i, err)
+					} else if status != i%7 {
+						errs <- fmt.Errorf(
+							"exec %d: expected exit status %d, got %d", i, i%7, status,
+						)
+					}
+				})
+			}
+
+			wg.Wait()
+			close(errs)
+
+			for err := range errs {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package gateway_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// dialPublicKeyMode connects to the gateway as the public key mode test user
+func dialPublicKeyMode(t *testing.T, addr string, env *backendTestEnv) *ssh.Client {
+	t.Helper()
+
+	signer, err := ssh.ParsePrivateKey(env.privBytes)
+	if err != nil {
+		t.Fatalf("Failed to parse private key: %v", err)
+	}
+
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User: "testuser",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		//nolint:gosec // acceptable for testing
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Failed to dial gateway: %v", err)
+	}
+
+	t.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+func TestOptions_ServerVersion(t *testing.T) {
+	const version = "SSH-2.0-sshgate_test"
+
+	env := newBackendTestEnv(t)
+
+	opts := gateway.DefaultOptions()
+	opts.ServerVersion = version
+	addr := env.start(t, gateway.WithOptions(opts))
+
+	client := dialPublicKeyMode(t, addr, env)
+	if got := string(client.ServerVersion()); got != version {
+		t.Errorf("ServerVersion() = %q, want %q", got, version)
+	}
+
+	// The library default is kept when unset
+	defaultEnv := newBackendTestEnv(t)
+	client = dialPublicKeyMode(t, defaultEnv.start(t), defaultEnv)
+
+	if got := string(client.ServerVersion()); got != "SSH-2.0-Go" {
+		t.Errorf("Default ServerVersion() = %q, want SSH-2.0-Go", got)
+	}
+}
+
+func TestOptions_MaxSessionsPerConn(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t, gateway.WithMaxSessionsPerConn(1))
+
+	client := dialPublicKeyMode(t, addr, env)
+
+	first, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to create first session: %v", err)
+	}
+
+	stdin, err := first.StdinPipe()
+	if err != nil {
+		t.Fatalf("Failed to get stdin: %v", err)
+	}
+
+	if err := first.Start("discard"); err != nil {
+		t.Fatalf("Failed to start first session: %v", err)
+	}
+
+	_, err = client.NewSession()
+
+	var openErr *ssh.OpenChannelError
+	if !errors.As(err, &openErr) || openErr.Reason != ssh.ResourceShortage {
+		t.Fatalf("Second session error = %v, want resource shortage", err)
+	}
+
+	// Closing the first session frees its slot
+	stdin.Close()
+
+	if err := first.Wait(); err != nil {
+		t.Fatalf("First session failed: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		session, err := client.NewSession()
+		if err == nil {
+			session.Close()
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Session after release failed: %v", err)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestOptions_ClientEnv(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t)
+
+	printenv := func(name string) func(*ssh.Session) error {
+		return func(s *ssh.Session) error { return s.Start("printenv " + name) }
+	}
+
+	client := dialPublicKeyMode(t, addr, env)
+
+	got := runForcedSession(t, client, nil, printenv(gateway.ClientAddrEnv))
+	if want := client.LocalAddr().String(); got != want {
+		t.Errorf("%s = %q, want %q", gateway.ClientAddrEnv, got, want)
+	}
+
+	if got := runForcedSession(t, client, nil, printenv(gateway.ConnIDEnv)); got == "" {
+		t.Errorf("%s is not set", gateway.ConnIDEnv)
+	}
+
+	// Agent forwarding sessions are passed the environment before cached requests
+	agentClient := dialAgentForwardMode(t, addr, env)
+	defer agentClient.Close()
+
+	requestAgent := func(s *ssh.Session) error { return agent.RequestAgentForwarding(s) }
+
+	got = runForcedSession(t, agentClient, requestAgent, printenv(gateway.ClientAddrEnv))
+	if want := agentClient.LocalAddr().String(); got != want {
+		t.Errorf("Agent mode %s = %q, want %q", gateway.ClientAddrEnv, got, want)
+	}
+
+	// Backends with a restrictive AcceptEnv may be spared the variables
+	disabledEnv := newBackendTestEnv(t)
+	client = dialPublicKeyMode(t, disabledEnv.start(t, gateway.WithClientEnv(false)), disabledEnv)
+
+	if got := runForcedSession(t, client, nil, printenv(gateway.ClientAddrEnv)); got != "" {
+		t.Errorf("Disabled %s = %q, want unset", gateway.ClientAddrEnv, got)
+	}
+}
+
+func TestOptions_SSHHandshakeTimeout(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t, gateway.WithSSHHandshakeTimeout(100*time.Millisecond))
+
+	var d net.Dialer
+
+	conn, err := d.DialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial gateway: %v", err)
+	}
+	defer conn.Close()
+
+	// A client that never sends its version is dropped after the timeout
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	start := time.Now()
+	if _, err := io.Copy(io.Discard, conn); err != nil {
+		t.Fatalf("Gateway did not close the connection: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Connection closed after %s, want about 100ms", elapsed)
+	}
+}
+
+func TestOptionsValidate_InvalidValues(t *testing.T) {
+	opts := gateway.DefaultOptions()
+	if err := opts.Validate(); err != nil {
+		t.Fatalf("Default options are invalid: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		opt  gateway.Option
+	}{
+		{"negative handshake timeout", gateway.WithSSHHandshakeTimeout(-time.Second)},
+		{"negative backend timeout", gateway.WithBackendConnectTimeouts(-time.Second, time.Second)},
+		{"negative proxy jump timeout", gateway.WithProxyJumpTimeout(-time.Second)},
+		{"negative session request timeout", gateway.WithSessionRequestTimeout(-time.Second)},
+		{"backend port out of range", gateway.WithSSHBackendPort(70000)},
+		{"negative max cached requests", gateway.WithMaxCachedRequests(-1)},
+		{"negative max sessions", gateway.WithMaxSessionsPerConn(-1)},
+		{"bad server version", gateway.WithServerVersion("sshgate")},
+		{"cluster proxy without address", gateway.WithClusterProxies("remote")},
+		{"cluster proxy without port", gateway.WithClusterProxies("remote=proxy")},
+		{
+			"negative host certificate expiry warning",
+			gateway.WithHostCertificateExpiryWarning(-time.Hour),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := gateway.DefaultOptions()
+			tt.opt(&opts)
+
+			if err := opts.Validate(); err == nil {
+				t.Error("Expected validation error, got nil")
+			}
+		})
+	}
+}
@@ -0,0 +1,350 @@
+package gateway
+
+import (
+	"crypto/hmac"
+	"crypto/sha1" //nolint:gosec // TOTP is defined over HMAC-SHA1 (RFC 6238)
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// TOTPPeriod is the time step of TOTP codes
+	TOTPPeriod = 30 * time.Second
+	// TOTPDigits is the number of digits of TOTP codes
+	TOTPDigits = 6
+)
+
+// Authentication factors, listed in the auth_factors extension of permissions
+const (
+	AuthFactorPublicKey = "publickey"
+	AuthFactorToken     = "token"
+	AuthFactorOTP       = "otp"
+)
+
+// otpPrompt is the keyboard-interactive question asking for the TOTP code
+const otpPrompt = "Verification code: "
+
+// TOTPCode returns the TOTP code of a base32 encoded secret at t, as generated
+// by authenticator apps (RFC 6238, HMAC-SHA1, 6 digits, 30 second steps)
+func TOTPCode(secret string, t time.Time) (string, error) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return "", err
+	}
+
+	return totpCode(key, totpCounter(t)), nil
+}
+
+// decodeTOTPSecret decodes a base32 TOTP secret, ignoring case, spaces and padding
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Join(strings.Fields(secret), ""))
+
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).
+		DecodeString(strings.TrimRight(secret, "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid TOTP secret: %w", err)
+	}
+
+	return key, nil
+}
+
+func totpCounter(t time.Time) uint64 {
+	return uint64(t.Unix()) / uint64(TOTPPeriod/time.Second) //nolint:gosec // after 1970
+}
+
+// totpCode computes the HOTP code of key at counter (RFC 4226)
+func totpCode(key []byte, counter uint64) string {
+	mac := hmac.New(sha1.New, key)
+	_ = binary.Write(mac, binary.BigEndian, counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", TOTPDigits, code%1_000_000)
+}
+
+// verifyTOTP checks code against the codes of key within skew steps of now
+func verifyTOTP(key []byte, code string, now time.Time, skew int) bool {
+	if len(code) != TOTPDigits {
+		return false
+	}
+
+	counter := totpCounter(now)
+
+	valid := false
+
+	for step := -skew; step <= skew; step++ {
+		// Every candidate is compared so the timing reveals nothing
+		candidate := totpCode(key, counter+uint64(int64(step))) //nolint:gosec // wraps as intended
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(code)) == 1 {
+			valid = true
+		}
+	}
+
+	return valid
+}
+
+// otpLimiter locks out the keys, the devboxes and the client addresses that
+// failed too many OTP attempts in a row, for a code not to be guessed by
+// spreading attempts over keys or over devboxes sharing a secret
+type otpLimiter struct {
+	maxFailures int
+	lockout     time.Duration
+
+	mu sync.Mutex
+	// otpLimitKeys entry -> consecutive failures
+	failures map[string]*otpFailures
+}
+
+type otpFailures struct {
+	count int
+	last  time.Time
+}
+
+// newOTPLimiter returns nil when maxFailures is zero, leaving attempts unlimited
+func newOTPLimiter(maxFailures int, lockout time.Duration) *otpLimiter {
+	if maxFailures <= 0 {
+		return nil
+	}
+
+	return &otpLimiter{
+		maxFailures: maxFailures,
+		lockout:     lockout,
+		failures:    make(map[string]*otpFailures),
+	}
+}
+
+// otpLimitKeys are the entries of the otpLimiter an OTP attempt counts against
+type otpLimitKeys struct {
+	fingerprint string
+	// namespace/devbox of the secret checked
+	devbox string
+	// host of the client
+	addr string
+}
+
+// entries returns the keys of the failures of the attempt, an empty key
+// counting against nothing
+func (k otpLimitKeys) entries() []string {
+	var entries []string
+
+	for _, entry := range []struct{ kind, key string }{
+		{"key", k.fingerprint},
+		{"devbox", k.devbox},
+		{"addr", k.addr},
+	} {
+		if entry.key != "" {
+			entries = append(entries, entry.kind+":"+entry.key)
+		}
+	}
+
+	return entries
+}
+
+// allowed reports whether an OTP attempt may be checked, none of its key, its
+// devbox and its address being locked out. Failures are forgotten once no
+// attempt was made for the lockout duration.
+func (l *otpLimiter) allowed(keys otpLimitKeys, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, entry := range keys.entries() {
+		failures, ok := l.failures[entry]
+		if !ok {
+			continue
+		}
+
+		if now.Sub(failures.last) >= l.lockout {
+			delete(l.failures, entry)
+			continue
+		}
+
+		if failures.count >= l.maxFailures {
+			return false
+		}
+	}
+
+	return true
+}
+
+// record records the outcome of an OTP attempt. A success clears the failures
+// of the key and the devbox, not those of the address: a client knowing one
+// code must not reset the attempts it spread over other devboxes.
+func (l *otpLimiter) record(keys otpLimitKeys, success bool, now time.Time) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if success {
+		keys.addr = ""
+		for _, entry := range keys.entries() {
+			delete(l.failures, entry)
+		}
+
+		return
+	}
+
+	// Forget the entries whose lockout expired
+	for entry, failures := range l.failures {
+		if now.Sub(failures.last) >= l.lockout {
+			delete(l.failures, entry)
+		}
+	}
+
+	for _, entry := range keys.entries() {
+		failures, ok := l.failures[entry]
+		if !ok {
+			failures = &otpFailures{}
+			l.failures[entry] = failures
+		}
+
+		failures.count++
+		failures.last = now
+	}
+}
+
+// requiresOTP reports whether a connection authenticated with perms must also
+// pass the OTP factor: its devbox is in one of OTPNamespaces, unless it
+// authenticated with an admin key and OTPExemptAdmins is set
+func (g *Gateway) requiresOTP(perms *ssh.Permissions) bool {
+	if len(g.opts().OTPNamespaces) == 0 {
+		return false
+	}
+
+	if g.opts().OTPExemptAdmins && perms.Extensions["auth_mode"] == AuthModeAdmin.String() {
+		return false
+	}
+
+	info, err := g.getDevboxInfoFromPermissions(perms)
+	if err != nil {
+		return false
+	}
+
+	return slices.Contains(g.opts().OTPNamespaces, info.Namespace)
+}
+
+// otpChallenge returns the partial success asking a client that authenticated
+// with perms, satisfying factor, for a TOTP code through keyboard-interactive
+// authentication
+func (g *Gateway) otpChallenge(
+	perms *ssh.Permissions,
+	state *authState,
+	factor string,
+) *ssh.PartialSuccessError {
+	state.factors = []string{factor}
+
+	return &ssh.PartialSuccessError{
+		Next: ssh.ServerAuthCallbacks{
+			KeyboardInteractiveCallback: func(
+				conn ssh.ConnMetadata,
+				client ssh.KeyboardInteractiveChallenge,
+			) (*ssh.Permissions, error) {
+				if err := g.verifyOTP(conn, perms, client, state.logger); err != nil {
+					return nil, err
+				}
+
+				state.factors = append(state.factors, AuthFactorOTP)
+				perms.Extensions["auth_factors"] = strings.Join(state.factors, ",")
+
+				return perms, nil
+			},
+		},
+	}
+}
+
+// verifyOTP asks the client for the TOTP code of the key it authenticated with,
+// or of the namespace of its devbox for tokens
+func (g *Gateway) verifyOTP(
+	conn ssh.ConnMetadata,
+	perms *ssh.Permissions,
+	client ssh.KeyboardInteractiveChallenge,
+	logger *log.Entry,
+) error {
+	info, err := g.getDevboxInfoFromPermissions(perms)
+	if err != nil {
+		return err
+	}
+
+	fingerprint := permissionsFingerprint(perms)
+	limitKeys := otpLimitKeys{
+		fingerprint: fingerprint,
+		devbox:      info.Namespace + "/" + info.DevboxName,
+	}
+
+	if ip, ok := clientIP(conn.RemoteAddr()); ok {
+		limitKeys.addr = ip.String()
+	}
+
+	if !g.otpLimiter.allowed(limitKeys, time.Now()) {
+		return fmt.Errorf("%w: %s", ErrOTPRateLimited, fingerprint)
+	}
+
+	secret, ok := g.registry.OTPSecret(fingerprint, info.Namespace)
+	if !ok {
+		return fmt.Errorf("%w: %s in %s", ErrOTPNotEnrolled, fingerprint, info.Namespace)
+	}
+
+	key, err := decodeTOTPSecret(string(secret))
+	if err != nil {
+		logger.WithError(err).WithField("fingerprint", fingerprint).Error("Invalid OTP secret")
+		return fmt.Errorf("%w: %s in %s", ErrOTPNotEnrolled, fingerprint, info.Namespace)
+	}
+
+	answers, err := client("", "", []string{otpPrompt}, []bool{false})
+	if err != nil {
+		return err
+	}
+
+	if len(answers) != 1 {
+		return ErrInvalidOTP
+	}
+
+	now := time.Now()
+	valid := verifyTOTP(key, strings.TrimSpace(answers[0]), now, g.opts().OTPSkew)
+	g.otpLimiter.record(limitKeys, valid, now)
+
+	if !valid {
+		return ErrInvalidOTP
+	}
+
+	return nil
+}
+
+// permissionsFactors returns the authentication factors satisfied by a
+// connection, as a comma-separated list
+func permissionsFactors(perms *ssh.Permissions) string {
+	if perms == nil {
+		return ""
+	}
+
+	if factors := perms.Extensions["auth_factors"]; factors != "" {
+		return factors
+	}
+
+	if permissionsFingerprint(perms) != "" {
+		return AuthFactorPublicKey
+	}
+
+	if perms.Extensions["auth_mode"] == AuthModeToken.String() {
+		return AuthFactorToken
+	}
+
+	return ""
+}
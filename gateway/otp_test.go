@@ -0,0 +1,340 @@
+package gateway_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// testOTPSecret is the RFC 6238 test secret "12345678901234567890" in base32
+const testOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// newOTPTestEnv returns a test environment whose registry reads TOTP secrets
+// from the sshgate/otp secret, holding data
+func newOTPTestEnv(t *testing.T, data map[string][]byte) *backendTestEnv {
+	t.Helper()
+
+	env := newBackendTestEnv(t, registry.WithOTPSecret("sshgate", "otp"))
+	setOTPSecret(t, env, data)
+
+	return env
+}
+
+// setOTPSecret updates the sshgate/otp secret with data
+func setOTPSecret(t *testing.T, env *backendTestEnv, data map[string][]byte) {
+	t.Helper()
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "otp", Namespace: "sshgate"},
+		Data:       data,
+	}
+	if err := env.reg.AddSecret(nil, secret); err != nil {
+		t.Fatalf("Failed to add OTP secret: %v", err)
+	}
+}
+
+// newKeyOTPTestEnv returns an OTP test environment holding testOTPSecret for
+// the devbox key
+func newKeyOTPTestEnv(t *testing.T) *backendTestEnv {
+	t.Helper()
+
+	env := newOTPTestEnv(t, nil)
+
+	signer, err := ssh.ParsePrivateKey(env.privBytes)
+	if err != nil {
+		t.Fatalf("Failed to parse private key: %v", err)
+	}
+
+	key := registry.OTPSecretKey(ssh.FingerprintSHA256(signer.PublicKey()))
+	setOTPSecret(t, env, map[string][]byte{key: []byte(testOTPSecret)})
+
+	return env
+}
+
+// totpAt returns the code of testOTPSecret at t
+func totpAt(t *testing.T, at time.Time) string {
+	t.Helper()
+
+	code, err := gateway.TOTPCode(testOTPSecret, at)
+	if err != nil {
+		t.Fatalf("TOTPCode() error = %v", err)
+	}
+
+	return code
+}
+
+// dialWithOTP dials the gateway in public key mode, answering the verification
+// code prompt with code
+func dialWithOTP(addr string, env *backendTestEnv, code string) (*ssh.Client, error) {
+	signer, err := ssh.ParsePrivateKey(env.privBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User: "testuser",
+		Auth: []ssh.AuthMethod{
+			ssh.PublicKeys(signer),
+			ssh.KeyboardInteractive(
+				func(_, _ string, questions []string, _ []bool) ([]string, error) {
+					answers := make([]string, len(questions))
+					for i := range answers {
+						answers[i] = code
+					}
+
+					return answers, nil
+				},
+			),
+		},
+		//nolint:gosec // acceptable for testing
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+}
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, truncated to 6 digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{unix: 59, want: "287082"},
+		{unix: 1111111109, want: "081804"},
+		{unix: 1234567890, want: "005924"},
+		{unix: 2000000000, want: "279037"},
+	}
+
+	for _, tt := range tests {
+		if got := totpAt(t, time.Unix(tt.unix, 0)); got != tt.want {
+			t.Errorf("TOTPCode(%d) = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+
+	// Secrets are often written lowercase, grouped and padded
+	code, err := gateway.TOTPCode("gezd gnbv gy3t qojq gezd gnbv gy3t qojq", time.Unix(59, 0))
+	if err != nil || code != "287082" {
+		t.Errorf("TOTPCode() of a formatted secret = %s, %v, want 287082", code, err)
+	}
+}
+
+func TestOTP_CorrectCode(t *testing.T) {
+	env := newKeyOTPTestEnv(t)
+
+	auditOpt, auditPath := newAuditLog(t)
+	addr := env.start(t, gateway.WithOTP([]string{"ns-test"}, false), auditOpt)
+
+	client, err := dialWithOTP(addr, env, totpAt(t, time.Now()))
+	if err != nil {
+		t.Fatalf("Failed to dial gateway with a correct code: %v", err)
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+
+	if err := session.Run("exit 0"); err != nil {
+		t.Errorf("Session failed: %v", err)
+	}
+
+	client.Close()
+
+	record := waitForAudit(t, auditPath, gateway.AuditEventConnection)
+	if got := record["auth_factors"]; got != "publickey,otp" {
+		t.Errorf("auth_factors = %v, want publickey,otp", got)
+	}
+}
+
+func TestOTP_WrongCode(t *testing.T) {
+	env := newKeyOTPTestEnv(t)
+
+	auditOpt, auditPath := newAuditLog(t)
+	addr := env.start(t, gateway.WithOTP([]string{"ns-test"}, false), auditOpt)
+
+	if _, err := dialWithOTP(addr, env, "000000x"); err == nil {
+		t.Fatal("Dial with a wrong code succeeded")
+	}
+
+	if got := env.gateway.AuthStats().Failures[gateway.AuthFailureBadOTP]; got != 1 {
+		t.Errorf("bad_otp failures = %d, want 1", got)
+	}
+
+	// The public key was accepted before the code was refused
+	record := waitForAudit(t, auditPath, gateway.AuditEventHandshakeFailed)
+	if got := record["auth_factors"]; got != "publickey" {
+		t.Errorf("auth_factors = %v, want publickey", got)
+	}
+}
+
+func TestOTP_ClockSkew(t *testing.T) {
+	tests := []struct {
+		name   string
+		skew   int
+		offset time.Duration
+		want   bool
+	}{
+		{name: "previous step", skew: 1, offset: -gateway.TOTPPeriod, want: true},
+		{name: "next step", skew: 1, offset: gateway.TOTPPeriod, want: true},
+		{name: "three steps behind", skew: 1, offset: -3 * gateway.TOTPPeriod},
+		{name: "previous step without skew", skew: 0, offset: -gateway.TOTPPeriod},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newKeyOTPTestEnv(t)
+			addr := env.start(t,
+				gateway.WithOTP([]string{"ns-test"}, false),
+				gateway.WithOTPSkew(tt.skew),
+			)
+
+			client, err := dialWithOTP(addr, env, totpAt(t, time.Now().Add(tt.offset)))
+			if err == nil {
+				client.Close()
+			}
+
+			if got := err == nil; got != tt.want {
+				t.Errorf("Authenticated = %v (%v), want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestOTP_RateLimited(t *testing.T) {
+	env := newKeyOTPTestEnv(t)
+	addr := env.start(t,
+		gateway.WithOTP([]string{"ns-test"}, false),
+		gateway.WithOTPRateLimit(2, time.Minute),
+	)
+
+	for range 2 {
+		if _, err := dialWithOTP(addr, env, "000000"); err == nil {
+			t.Fatal("Dial with a wrong code succeeded")
+		}
+	}
+
+	// Locked out, even a correct code is refused
+	if _, err := dialWithOTP(addr, env, totpAt(t, time.Now())); err == nil {
+		t.Fatal("Dial of a locked out key succeeded")
+	}
+
+	if got := env.gateway.AuthStats().Failures[gateway.AuthFailureOTPRateLimited]; got != 1 {
+		t.Errorf("otp_rate_limited failures = %d, want 1", got)
+	}
+}
+
+func TestOTP_RateLimitedAcrossKeys(t *testing.T) {
+	env := newOTPTestEnv(t, map[string][]byte{
+		registry.OTPSecretNamespaceKey("ns-test"): []byte(testOTPSecret),
+	})
+	addr := env.start(t,
+		gateway.WithOTP([]string{"ns-test"}, false),
+		gateway.WithOTPRateLimit(2, time.Minute),
+	)
+
+	for range 2 {
+		if _, err := dialWithOTP(addr, env, "000000"); err == nil {
+			t.Fatal("Dial with a wrong code succeeded")
+		}
+	}
+
+	// The key of another devbox, from the same address, is locked out too
+	_, _, pubBytes, privBytes := generateTestKeys(t)
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "other-secret",
+			Namespace: "ns-test",
+			Labels: map[string]string{
+				registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: registry.DevboxOwnerKind, Name: "other-devbox"},
+			},
+		},
+		Data: map[string][]byte{
+			registry.DevboxPublicKeyField:  pubBytes,
+			registry.DevboxPrivateKeyField: privBytes,
+		},
+	}
+	if err := env.reg.AddSecret(nil, secret); err != nil {
+		t.Fatalf("Failed to add secret: %v", err)
+	}
+
+	other := *env
+	other.privBytes = privBytes
+
+	if _, err := dialWithOTP(addr, &other, totpAt(t, time.Now())); err == nil {
+		t.Fatal("Dial from a locked out address succeeded")
+	}
+
+	if got := env.gateway.AuthStats().Failures[gateway.AuthFailureOTPRateLimited]; got != 1 {
+		t.Errorf("otp_rate_limited failures = %d, want 1", got)
+	}
+}
+
+func TestOTP_NamespaceSecret(t *testing.T) {
+	env := newOTPTestEnv(t, map[string][]byte{
+		registry.OTPSecretNamespaceKey("ns-test"): []byte(testOTPSecret),
+	})
+	addr := env.start(t, gateway.WithOTP([]string{"ns-test"}, false))
+
+	client, err := dialWithOTP(addr, env, totpAt(t, time.Now()))
+	if err != nil {
+		t.Fatalf("Failed to dial gateway with the namespace code: %v", err)
+	}
+
+	client.Close()
+}
+
+func TestOTP_NotEnrolled(t *testing.T) {
+	env := newOTPTestEnv(t, nil)
+	addr := env.start(t, gateway.WithOTP([]string{"ns-test"}, false))
+
+	if _, err := dialWithOTP(addr, env, totpAt(t, time.Now())); err == nil {
+		t.Fatal("Dial without TOTP secret succeeded")
+	}
+
+	if got := env.gateway.AuthStats().Failures[gateway.AuthFailureOTPNotEnrolled]; got != 1 {
+		t.Errorf("otp_not_enrolled failures = %d, want 1", got)
+	}
+}
+
+func TestOTP_OtherNamespacesUnaffected(t *testing.T) {
+	env := newOTPTestEnv(t, nil)
+	addr := env.start(t, gateway.WithOTP([]string{"ns-other"}, false))
+
+	// Public key authentication alone is enough
+	dialPublicKeyMode(t, addr, env)
+}
+
+func TestOTP_ExemptAdmins(t *testing.T) {
+	for _, exempt := range []bool{false, true} {
+		env := newOTPTestEnv(t, nil)
+
+		adminSigner, _, adminBytes, _ := generateTestKeys(t)
+		addr := env.start(t,
+			gateway.WithAdminKeys([]string{string(adminBytes)}, nil),
+			gateway.WithOTP([]string{"ns-test"}, exempt),
+		)
+
+		client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+			User: "root@ns-test/test-devbox",
+			Auth: []ssh.AuthMethod{ssh.PublicKeys(adminSigner)},
+			//nolint:gosec // acceptable for testing
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		})
+		if err == nil {
+			client.Close()
+		}
+
+		if got := err == nil; got != exempt {
+			t.Errorf("Admin authenticated = %v (%v) with exempt %v", got, err, exempt)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// isPortForward reports whether a direct-tcpip channel forwards a port of the
+// devbox itself, like IDEs reaching their backend do, rather than proxy jumping
+// to the devbox. Such forwards ask for loopback addresses.
+func isPortForward(newChannel ssh.NewChannel) bool {
+	var msg directTCPIPMsg
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &msg); err != nil {
+		return false
+	}
+
+	if strings.EqualFold(msg.HostToConnect, "localhost") {
+		return true
+	}
+
+	addr, err := netip.ParseAddr(msg.HostToConnect)
+
+	return err == nil && addr.IsLoopback()
+}
+
+// handlePortForward forwards a port of the devbox over the backend connection
+// shared by the sessions of the client connection, which one of them brings the
+// agent to establish. The devbox decides whether the port may be forwarded.
+func (g *Gateway) handlePortForward(
+	connCtx context.Context,
+	newChannel ssh.NewChannel,
+	ctx *sessionContext,
+	cio *connIO,
+	logger *log.Entry,
+) {
+	forwardLogger := logger.WithField("mode", "port_forward")
+
+	backendConn := ctx.awaitBackend(connCtx, g.opts().ProxyJumpTimeout)
+	if backendConn == nil {
+		if connCtx.Err() != nil {
+			return
+		}
+
+		forwardLogger.Warn("No backend connection to forward the port over")
+
+		_ = newChannel.Reject(
+			ssh.ConnectionFailed,
+			g.message(msgAgentUnavailable, ctx.info, nil),
+		)
+
+		return
+	}
+
+	backendChannel, backendReqs, err := backendConn.OpenChannel(
+		newChannel.ChannelType(),
+		newChannel.ExtraData(),
+	)
+	if err != nil {
+		forwardLogger.WithError(err).Warn("Failed to open backend channel")
+
+		// The devbox explains its own refusals, anything else is the gateway's
+		var openErr *ssh.OpenChannelError
+		if errors.As(err, &openErr) {
+			_ = newChannel.Reject(openErr.Reason, openErr.Message)
+		} else {
+			_ = newChannel.Reject(
+				ssh.ConnectionFailed,
+				g.message(msgBackendUnavailable, ctx.info, err),
+			)
+		}
+
+		return
+	}
+	defer backendChannel.Close()
+
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		forwardLogger.WithError(err).Error("Failed to accept channel")
+		return
+	}
+	defer channel.Close()
+
+	forwardLogger.Info("Port forward established")
+
+	g.proxyChannelWithRequests(connCtx, channel, backendChannel, requests, backendReqs, cio,
+		forwardLogger)
+
+	forwardLogger.WithFields(cio.fields()).Info("Port forward closed")
+}
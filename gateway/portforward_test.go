@@ -0,0 +1,186 @@
+package gateway_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// forwardPort forwards a port of the devbox, whose mock backend echoes, and
+// checks data makes the round trip
+func forwardPort(client *ssh.Client, host string, port uint32, data []byte) error {
+	channel, reqs, err := client.OpenChannel("direct-tcpip", ssh.Marshal(struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}{host, port, "127.0.0.1", 40000}))
+	if err != nil {
+		return fmt.Errorf("failed to forward %s:%d: %w", host, port, err)
+	}
+	defer channel.Close()
+
+	go ssh.DiscardRequests(reqs)
+
+	return echoRoundTrip(channel, channel, channel.CloseWrite, data)
+}
+
+// echoRoundTrip sends data to an echoing peer, closing w after it, and checks
+// it comes back on r
+func echoRoundTrip(r io.Reader, w io.Writer, closeWrite func() error, data []byte) error {
+	writeErr := make(chan error, 1)
+
+	go func() {
+		_, err := w.Write(data)
+		_ = closeWrite()
+
+		writeErr <- err
+	}()
+
+	echoed, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to read echo: %w", err)
+	}
+
+	if err := <-writeErr; err != nil {
+		return fmt.Errorf("failed to write: %w", err)
+	}
+
+	if !bytes.Equal(echoed, data) {
+		return fmt.Errorf("echoed %d bytes, want the %d sent", len(echoed), len(data))
+	}
+
+	return nil
+}
+
+// transferSubsystem sends data through the echo subsystem of a session asking
+// for the agent, standing in for the SFTP transfers of IDEs
+func transferSubsystem(client *ssh.Client, data []byte) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to open session: %w", err)
+	}
+	defer session.Close()
+
+	if err := agent.RequestAgentForwarding(session); err != nil {
+		return fmt.Errorf("failed to request agent forwarding: %w", err)
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := session.RequestSubsystem("echo"); err != nil {
+		return fmt.Errorf("failed to start subsystem: %w", err)
+	}
+
+	return echoRoundTrip(stdout, stdin, stdin.Close, data)
+}
+
+// TestPortForward_IDEChannels opens channels the way IDEs like JetBrains Gateway
+// deploy their backend: a transfer, commands and port forwards at once over one
+// agent forwarding connection. Only the transfer asks for the agent, the others
+// share the backend connection it establishes.
+func TestPortForward_IDEChannels(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t)
+
+	client := dialAgentForwardMode(t, addr, env)
+	defer client.Close()
+
+	transfer := make([]byte, 8<<20)
+	_, _ = rand.Read(transfer)
+
+	var wg sync.WaitGroup
+
+	errs := make(chan error, 6)
+
+	start := time.Now()
+
+	wg.Go(func() {
+		errs <- transferSubsystem(client, transfer)
+	})
+
+	for i := range 3 {
+		wg.Go(func() {
+			status, err := runExec(client, false, i)
+			if err == nil && status != i {
+				err = fmt.Errorf("exec %d: expected exit status %d, got %d", i, i, status)
+			}
+
+			errs <- err
+		})
+	}
+
+	for _, host := range []string{"127.0.0.1", "localhost"} {
+		wg.Go(func() {
+			errs <- forwardPort(client, host, 63342, []byte("ide backend "+host))
+		})
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	t.Logf("IDE channels completed in %s", time.Since(start))
+}
+
+func TestPortForward_NoBackend(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t, gateway.WithProxyJumpTimeout(100*time.Millisecond))
+
+	client := dialAgentForwardMode(t, addr, env)
+	defer client.Close()
+
+	err := forwardPort(client, "127.0.0.1", 63342, []byte("ping"))
+
+	var openErr *ssh.OpenChannelError
+	if !errors.As(err, &openErr) || openErr.Reason != ssh.ConnectionFailed {
+		t.Fatalf("Expected the forward to fail without a backend connection, got %v", err)
+	}
+}
+
+// TestPortForward_ProxyJump checks other destinations still reach the SSH port
+// of the devbox, whatever they name
+func TestPortForward_ProxyJump(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t)
+
+	client := dialAgentForwardMode(t, addr, env)
+	defer client.Close()
+
+	conn, err := client.Dial("tcp", "my-devbox:22")
+	if err != nil {
+		t.Fatalf("Failed to proxy jump: %v", err)
+	}
+	defer conn.Close()
+
+	banner := make([]byte, len("SSH-2.0-"))
+	if _, err := io.ReadFull(conn, banner); err != nil {
+		t.Fatalf("Failed to read the devbox banner: %v", err)
+	}
+
+	if string(banner) != "SSH-2.0-" {
+		t.Fatalf("Expected the devbox SSH banner, got %q", banner)
+	}
+}
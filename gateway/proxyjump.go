@@ -1,9 +1,7 @@
 package gateway
 
 import (
-	"fmt"
-	"net"
-	"strconv"
+	"context"
 
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
@@ -20,10 +18,13 @@ type directTCPIPMsg struct {
 // handleProxyJumpMode handles SSH proxy jump (direct-tcpip) connections
 // It ignores the client's requested destination and forcibly connects to the devbox
 func (g *Gateway) handleProxyJumpMode(
+	connCtx context.Context,
 	newChannel ssh.NewChannel,
 	ctx *sessionContext,
+	cio *connIO,
+	logger *log.Entry,
 ) {
-	proxyLogger := ctx.logger.WithField("mode", "proxy_jump")
+	proxyLogger := logger.WithField("mode", "proxy_jump")
 
 	// Parse the direct-tcpip payload
 	var msg directTCPIPMsg
@@ -39,20 +40,42 @@ func (g *Gateway) handleProxyJumpMode(
 		"requested_port":  msg.PortToConnect,
 		"originator_ip":   msg.OriginatorIPAddr,
 		"originator_port": msg.OriginatorPort,
-	}).Info("Client requested proxy jump")
+	}).Debug("Client requested proxy jump")
 
 	// Force connection to devbox, ignoring client's requested address
-	devboxAddr := net.JoinHostPort(ctx.info.PodIP, strconv.Itoa(g.options.SSHBackendPort))
-	proxyLogger.WithField("devbox_addr", devboxAddr).Info("Forcing connection to devbox")
+	devboxAddr, addressing := g.backendAddr(
+		connCtx,
+		ctx.info,
+		g.backendSSHPort(ctx.info),
+		proxyLogger,
+	)
+	proxyLogger.WithFields(log.Fields{
+		"devbox_addr":        devboxAddr,
+		"backend_addressing": addressing,
+	}).Info("Forcing connection to devbox")
+
+	cio.audit.setBackendAddr(devboxAddr)
 
 	// Dial to devbox
-	//nolint:noctx
-	conn, err := net.DialTimeout("tcp", devboxAddr, g.options.ProxyJumpTimeout)
+	conn, err := g.DialBackend(
+		withBackendCluster(connCtx, ctx.info.Cluster),
+		devboxAddr,
+		g.opts().ProxyJumpTimeout,
+	)
 	if err != nil {
-		proxyLogger.WithField("devbox_addr", devboxAddr).
-			WithError(err).
-			Error("Failed to connect to devbox")
-		_ = newChannel.Reject(ssh.ConnectionFailed, fmt.Sprintf("failed to connect: %v", err))
+		// The client is gone, the dial was abandoned rather than failed
+		if connCtx.Err() != nil {
+			proxyLogger.WithError(err).Info("Client disconnected while connecting to devbox")
+			return
+		}
+
+		g.opts().LogLimiter.Log(proxyLogger.WithField("devbox_addr", devboxAddr).WithError(err),
+			log.ErrorLevel, "Failed to connect to devbox", "namespace", "devbox")
+		g.events.recordBackendFailure(ctx.info, err)
+		_ = newChannel.Reject(
+			ssh.ConnectionFailed,
+			g.message(backendFailureMessage(err, ctx.info), ctx.info, err),
+		)
 
 		return
 	}
@@ -71,8 +94,13 @@ func (g *Gateway) handleProxyJumpMode(
 
 	proxyLogger.Info("Tunnel established")
 
+	if cio.recording != nil {
+		proxyLogger.WithField("audit", "session_recording").
+			Info("Channel not recorded, port forwards are never recorded")
+	}
+
 	// Proxy data between client channel and devbox connection
-	g.proxyChannelToConn(channel, conn)
+	g.proxyChannelToConn(connCtx, channel, conn, cio)
 
-	proxyLogger.Info("Tunnel closed")
+	proxyLogger.WithFields(cio.fields()).Info("Tunnel closed")
 }
@@ -1,7 +1,10 @@
 package gateway
 
 import (
-	"fmt"
+	"context"
+	"errors"
+	"net"
+	"strconv"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/zijiren233/sshgate/registry"
@@ -9,50 +12,133 @@ import (
 )
 
 func (g *Gateway) handlePublicKeyMode(
-	_ *ssh.ServerConn,
+	ctx context.Context,
+	conn *ssh.ServerConn,
 	chans <-chan ssh.NewChannel,
 	reqs <-chan *ssh.Request,
 	info *registry.DevboxInfo,
 	username string,
+	cio *connIO,
 	logger *log.Entry,
 ) {
-	backendAddr := fmt.Sprintf("%s:%d", info.PodIP, g.options.SSHBackendPort)
+	// Devboxes loaded from a registry snapshot have no private key until their
+	// secret is seen again, as do secrets whose private key does not parse
+	if info.PrivateKey == nil {
+		logger.Warn("Devbox private key unavailable")
+		cio.audit.setReason(AuditReasonBackendFailed)
+		refuseConnection(
+			g.routeCommands(ctx, conn, chans, info, logger),
+			reqs,
+			g.message(msgBackendUnavailable, info, nil),
+			logger,
+		)
+
+		return
+	}
 
 	backendConfig := &ssh.ClientConfig{
 		User: username,
 		Auth: []ssh.AuthMethod{
 			ssh.PublicKeys(info.PrivateKey),
 		},
-		//nolint:gosec
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         g.options.BackendConnectTimeoutPublicKey,
+		HostKeyCallback: g.hostKeyVerifier.callback(info),
+		Timeout:         g.opts().BackendConnectTimeoutPublicKey,
+	}
+
+	poolKey := backendPoolKey{
+		namespace:  info.Namespace,
+		devboxName: info.DevboxName,
+		user:       username,
 	}
+	podIP := info.PodIP
 
-	backendConn, err := ssh.Dial("tcp", backendAddr, backendConfig)
+	// Pooled connections are reused without resolving the backend address
+	var backendAddr, addressing string
+
+	backendConn, err := g.acquireBackend(poolKey, podIP, func() (*ssh.Client, error) {
+		backendAddr, addressing = g.backendAddr(ctx, info, g.backendSSHPort(info), logger)
+		return g.dialBackendSSH(withBackendCluster(ctx, info.Cluster), backendAddr, backendConfig)
+	})
 	if err != nil {
-		logger.WithField("backend_addr", backendAddr).
-			WithError(err).
-			Error("Failed to connect to backend")
+		// The client is gone, the dial was abandoned rather than failed
+		if ctx.Err() != nil {
+			logger.WithError(err).Info("Client disconnected while connecting to backend")
+			return
+		}
+
+		g.opts().LogLimiter.Log(logger.WithFields(log.Fields{
+			"backend_addr":       backendAddr,
+			"backend_addressing": addressing,
+		}).WithError(err), log.ErrorLevel, "Failed to connect to backend", "namespace", "devbox")
+		cio.audit.setReason(AuditReasonBackendFailed)
+		g.events.recordBackendFailure(info, err)
+		refuseConnection(
+			g.routeCommands(ctx, conn, chans, info, logger),
+			reqs,
+			g.message(backendFailureMessage(err, info), info, err),
+			logger,
+		)
+
 		return
 	}
-	defer backendConn.Close()
 
-	logger.Info("Backend connected")
+	// Pooled connections were dialed for an earlier client connection
+	if backendAddr == "" {
+		backendAddr = net.JoinHostPort(podIP, strconv.Itoa(g.backendSSHPort(info)))
+	}
+
+	cio.audit.setBackendAddr(backendAddr)
+
+	lease := newBackendLease(backendConn)
+	defer g.releaseBackend(poolKey, podIP, lease)
+
+	connectedLogger := logger
+	if addressing != "" {
+		connectedLogger = logger.WithFields(log.Fields{
+			"backend_addr":       backendAddr,
+			"backend_addressing": addressing,
+		})
+	}
+
+	connectedLogger.Info("Backend connected")
+
+	sessions := newSessionGate(g.opts().MaxSessionsPerConn)
 
-	go g.handleGlobalRequestsPublicKey(reqs, backendConn, logger)
+	go g.handleGlobalRequestsPublicKey(reqs, lease, sessions, logger)
 
 	for newChannel := range chans {
-		go g.handleChannelPublicKey(newChannel, backendConn, logger)
+		if !sessions.admit(newChannel, logger) {
+			continue
+		}
+
+		lease.wg.Go(func() {
+			defer sessions.release(newChannel)
+
+			// Gateway commands are answered without a backend channel
+			routed := g.routeSession(ctx, conn, newChannel, info, logger)
+			if routed == nil {
+				return
+			}
+
+			g.handleChannelPublicKey(ctx, routed, lease, info, cio.channel(), logger)
+		})
 	}
 }
 
 func (g *Gateway) handleGlobalRequestsPublicKey(
 	reqs <-chan *ssh.Request,
-	backendConn *ssh.Client,
+	lease *backendLease,
+	sessions *sessionGate,
 	logger *log.Entry,
 ) {
 	for req := range reqs {
-		ok, response, err := backendConn.SendRequest(req.Type, req.WantReply, req.Payload)
+		if sessions.handleRequest(req) {
+			continue
+		}
+
+		lease.markGlobalRequest(req.Type)
+
+		ok, response, err := lease.client.SendRequest(req.Type, req.WantReply, req.Payload)
 		if req.WantReply {
 			_ = req.Reply(ok, response)
 		}
@@ -68,23 +154,45 @@ func (g *Gateway) handleGlobalRequestsPublicKey(
 }
 
 func (g *Gateway) handleChannelPublicKey(
+	ctx context.Context,
 	newChannel ssh.NewChannel,
-	backendConn *ssh.Client,
+	lease *backendLease,
+	info *registry.DevboxInfo,
+	cio *connIO,
 	logger *log.Entry,
 ) {
-	channelLogger := logger.WithField("channel_type", newChannel.ChannelType())
+	channelLogger := logger.WithFields(log.Fields{
+		"channel_type": newChannel.ChannelType(),
+		"session_id":   cio.id,
+	})
+
+	defer cio.audit.auditChannel(cio, newChannel.ChannelType())
 
-	backendChannel, backendReqs, err := backendConn.OpenChannel(
+	backendChannel, backendReqs, err := lease.client.OpenChannel(
 		newChannel.ChannelType(),
 		newChannel.ExtraData(),
 	)
 	if err != nil {
 		channelLogger.WithError(err).Warn("Failed to open backend channel")
-		_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+
+		// The devbox explains its own refusals, anything else is the gateway's
+		var openErr *ssh.OpenChannelError
+		if errors.As(err, &openErr) {
+			_ = newChannel.Reject(openErr.Reason, openErr.Message)
+		} else {
+			_ = newChannel.Reject(
+				ssh.ConnectionFailed,
+				g.message(msgBackendUnavailable, info, err),
+			)
+		}
+
 		return
 	}
 	defer backendChannel.Close()
 
+	lease.track(backendChannel)
+	defer lease.untrack(backendChannel)
+
 	channel, requests, err := newChannel.Accept()
 	if err != nil {
 		channelLogger.WithError(err).Warn("Failed to accept channel")
@@ -93,14 +201,24 @@ func (g *Gateway) handleChannelPublicKey(
 	}
 	defer channel.Close()
 
+	requests = restrictRequests(ctx, requests, channel, cio.sftpOnly, channelLogger)
+
 	channelLogger.Debug("Channel established")
 
+	if newChannel.ChannelType() == "session" {
+		defer cio.live.trackSession(channel)()
+
+		g.sendSessionEnv(backendChannel, cio)
+	}
+
 	// Use synchronized proxy to ensure exit-status is forwarded before closing
 	g.proxyChannelWithRequests(
+		ctx,
 		channel,
 		backendChannel,
 		requests,
 		backendReqs,
+		cio,
 		channelLogger,
 	)
 }
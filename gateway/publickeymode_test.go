@@ -0,0 +1,187 @@
+package gateway_test
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestPublicKeyCallback_DisablePublicKeyMode(t *testing.T) {
+	env := newBackendTestEnv(t)
+
+	signer, err := ssh.ParsePrivateKey(env.privBytes)
+	if err != nil {
+		t.Fatalf("Failed to parse private key: %v", err)
+	}
+
+	gw := gateway.New(env.hostKey, env.reg, gateway.WithDisablePublicKeyMode(true))
+
+	perms, err := gw.PublicKeyCallback(newMockConnMetadata("testuser"), signer.PublicKey())
+	if err != nil {
+		t.Fatalf("Expected registered key to be accepted, got: %v", err)
+	}
+
+	if got := perms.Extensions["auth_mode"]; got != gateway.AuthModeCustomKey.String() {
+		t.Errorf("auth_mode = %q, want %q", got, gateway.AuthModeCustomKey.String())
+	}
+}
+
+func TestDisablePublicKeyMode_RequiresAgent(t *testing.T) {
+	env := newBackendTestEnv(t)
+
+	addr := env.start(t,
+		gateway.WithDisablePublicKeyMode(true),
+		gateway.WithAgentHelpURL("https://docs.example.com/ssh-agent"),
+		gateway.WithSessionRequestTimeout(100*time.Millisecond),
+	)
+
+	signer, err := ssh.ParsePrivateKey(env.privBytes)
+	if err != nil {
+		t.Fatalf("Failed to parse private key: %v", err)
+	}
+
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User: "testuser",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		//nolint:gosec // acceptable for testing
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Failed to dial gateway: %v", err)
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer session.Close()
+
+	stderr, err := session.StderrPipe()
+	if err != nil {
+		t.Fatalf("Failed to get stderr pipe: %v", err)
+	}
+
+	// Without agent forwarding the gateway cannot reach the backend,
+	// the session is explained on stderr and closed
+	_ = session.Start("exit 0")
+
+	output, _ := io.ReadAll(stderr)
+
+	for _, want := range []string{
+		"Make sure your SSH agent is running",
+		"See https://docs.example.com/ssh-agent",
+	} {
+		if !strings.Contains(string(output), want) {
+			t.Errorf("Expected output to contain %q, got: %q", want, output)
+		}
+	}
+}
+
+// addAuthorizedKey adds key to the user added keys of the test devbox
+func addAuthorizedKey(t *testing.T, env *backendTestEnv, key ssh.PublicKey, comment string) {
+	t.Helper()
+
+	signer, err := ssh.ParsePrivateKey(env.privBytes)
+	if err != nil {
+		t.Fatalf("Failed to parse private key: %v", err)
+	}
+
+	secret := testSecret(ssh.MarshalAuthorizedKey(signer.PublicKey()), env.privBytes)
+	secret.Data[registry.DevboxAuthorizedKeysField] = []byte(
+		strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(key)), "\n") + " " + comment + "\n",
+	)
+
+	if err := env.reg.AddSecret(nil, secret); err != nil {
+		t.Fatalf("Failed to add secret: %v", err)
+	}
+}
+
+func TestPublicKeyMode_AuthorizedKey(t *testing.T) {
+	env := newBackendTestEnv(t)
+
+	laptop, laptopKey, _, _ := generateTestKeys(t)
+	addAuthorizedKey(t, env, laptopKey, "alice@laptop")
+
+	auditOpt, auditPath := newAuditLog(t)
+	addr := env.start(t, auditOpt)
+
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User: "testuser",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(laptop)},
+		//nolint:gosec // acceptable for testing
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Failed to dial gateway with a user added key: %v", err)
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+
+	if err := session.Run("exit 0"); err != nil {
+		t.Errorf("Session failed: %v", err)
+	}
+
+	client.Close()
+
+	record := waitForAudit(t, auditPath, gateway.AuditEventConnection)
+
+	for field, want := range map[string]string{
+		"auth_mode":   gateway.AuthModePublicKey.String(),
+		"fingerprint": ssh.FingerprintSHA256(laptopKey),
+		"key_source":  string(registry.KeySourceAuthorizedKeys),
+		"key_comment": "alice@laptop",
+	} {
+		if got := record[field]; got != want {
+			t.Errorf("%s = %v, want %s", field, got, want)
+		}
+	}
+}
+
+func TestPublicKeyMode_SharedAuthorizedKey(t *testing.T) {
+	env := newBackendTestEnv(t)
+
+	_, laptopKey, _, _ := generateTestKeys(t)
+	addAuthorizedKey(t, env, laptopKey, "alice@laptop")
+
+	// The same key added to another devbox
+	_, _, pubBytes, privBytes := generateTestKeys(t)
+	other := testSecret(pubBytes, privBytes)
+	other.Name = "other-secret"
+	other.OwnerReferences[0].Name = "other-devbox"
+	other.Data[registry.DevboxAuthorizedKeysField] = ssh.MarshalAuthorizedKey(laptopKey)
+
+	if err := env.reg.AddSecret(nil, other); err != nil {
+		t.Fatalf("Failed to add secret: %v", err)
+	}
+
+	gw := gateway.New(env.hostKey, env.reg, gateway.WithDisableAgentForwardingMode(true))
+
+	// The username picks the devbox, still in public key mode
+	perms, err := gw.PublicKeyCallback(
+		newMockConnMetadata("testuser@ns-test/test-devbox"),
+		laptopKey,
+	)
+	if err != nil {
+		t.Fatalf("Expected shared key to be accepted, got: %v", err)
+	}
+
+	info, err := gateway.GetDevboxInfoFromPermissions(perms)
+	if err != nil || info.DevboxName != "test-devbox" {
+		t.Errorf("Devbox = %v (%v), want test-devbox", info, err)
+	}
+
+	if got := perms.Extensions["auth_mode"]; got != gateway.AuthModePublicKey.String() {
+		t.Errorf("auth_mode = %q, want %q", got, gateway.AuthModePublicKey.String())
+	}
+}
@@ -0,0 +1,31 @@
+package gateway
+
+import "golang.org/x/crypto/ssh"
+
+// Channel requests of PuTTY and the clients built on it, like WinSCP, see
+// https://the.earth.li/~sgtatham/putty/0.83/htmldoc/AppendixF.html
+const (
+	// puttySimpleRequest tells the server the client needs no flow control on
+	// the session, it wants no reply
+	puttySimpleRequest = "simple@putty.projects.tartarus.org"
+	// puttyWinadjRequest measures the round trip time to size the window of
+	// the session, any reply will do and servers not knowing it fail it
+	puttyWinadjRequest = "winadj@putty.projects.tartarus.org"
+)
+
+// answerLocalRequest answers the channel requests the gateway handles itself,
+// reporting whether req was one of them. They are never forwarded to backends,
+// which would reject them, nor held up while the session is set up.
+func answerLocalRequest(req *ssh.Request) bool {
+	switch req.Type {
+	case puttySimpleRequest, puttyWinadjRequest:
+		// The gateway window is not the backend's, PuTTY only needs a reply
+		if req.WantReply {
+			_ = req.Reply(false, nil)
+		}
+
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,155 @@
+package gateway_test
+
+import (
+	"io"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"golang.org/x/crypto/ssh"
+)
+
+// puttyRequest is a channel request sent by PuTTY
+type puttyRequest struct {
+	Type      string
+	WantReply bool
+	Payload   []byte
+}
+
+var (
+	puttySimple = puttyRequest{Type: "simple@putty.projects.tartarus.org"}
+	puttyWinadj = puttyRequest{Type: "winadj@putty.projects.tartarus.org", WantReply: true}
+	puttyAgent  = puttyRequest{Type: "auth-agent-req@openssh.com", WantReply: true}
+)
+
+// puttyExec is the request of plink running command
+func puttyExec(command string) puttyRequest {
+	return puttyRequest{
+		Type:      "exec",
+		WantReply: true,
+		Payload:   ssh.Marshal(struct{ Command string }{command}),
+	}
+}
+
+// winscpSFTP is the request of WinSCP starting an SFTP session
+var winscpSFTP = puttyRequest{
+	Type:      "subsystem",
+	WantReply: true,
+	Payload:   ssh.Marshal(struct{ Name string }{"sftp"}),
+}
+
+// puttyModes are the authentication modes PuTTY sessions are replayed in, with
+// the requests setting up each
+var puttyModes = []struct {
+	name  string
+	dial  func(t *testing.T, addr string, env *backendTestEnv) *ssh.Client
+	setup []puttyRequest
+}{
+	{name: "public key", dial: dialPublicKeyMode},
+	{
+		name: "agent forwarding",
+		dial: func(t *testing.T, addr string, env *backendTestEnv) *ssh.Client {
+			t.Helper()
+			return dialAgentForwardMode(t, addr, env)
+		},
+		setup: []puttyRequest{puttyAgent},
+	},
+}
+
+// replayPuTTY replays the requests of a PuTTY session on a new session channel,
+// returning the replies of those wanting one and the output of the session
+func replayPuTTY(t *testing.T, client *ssh.Client, requests []puttyRequest) ([]bool, string) {
+	t.Helper()
+
+	channel, in, err := client.OpenChannel("session", nil)
+	if err != nil {
+		t.Fatalf("Failed to open session: %v", err)
+	}
+	defer channel.Close()
+
+	go ssh.DiscardRequests(in)
+
+	var replies []bool
+
+	for _, req := range requests {
+		ok, err := channel.SendRequest(req.Type, req.WantReply, req.Payload)
+		if err != nil {
+			t.Fatalf("Failed to send %s: %v", req.Type, err)
+		}
+
+		if req.WantReply {
+			replies = append(replies, ok)
+		}
+	}
+
+	output, err := io.ReadAll(channel)
+	if err != nil {
+		t.Fatalf("Failed to read session output: %v", err)
+	}
+
+	return replies, string(output)
+}
+
+func TestPuTTY_Requests(t *testing.T) {
+	for _, mode := range puttyModes {
+		t.Run(mode.name, func(t *testing.T) {
+			env := newBackendTestEnv(t)
+			// PuTTY requests are answered before the budget would run out
+			addr := env.start(t, gateway.WithMaxCachedRequests(2))
+
+			client := mode.dial(t, addr, env)
+			defer client.Close()
+
+			requests := []puttyRequest{puttySimple, puttyWinadj, puttyWinadj, puttyWinadj}
+			requests = append(requests, mode.setup...)
+			requests = append(requests, puttyExec("requests"))
+
+			replies, output := replayPuTTY(t, client, requests)
+
+			// winadj is failed like by servers not knowing it, the command starts
+			want := []bool{false, false, false}
+			for range mode.setup {
+				want = append(want, true)
+			}
+
+			want = append(want, true)
+
+			if !slices.Equal(replies, want) {
+				t.Errorf("Replies = %v, want %v", replies, want)
+			}
+
+			if strings.Contains(output, "putty") || !strings.HasSuffix(output, "exec") {
+				t.Errorf("Backend received %q, want no PuTTY request", output)
+			}
+		})
+	}
+}
+
+func TestPuTTY_WinSCPLogin(t *testing.T) {
+	for _, mode := range puttyModes {
+		t.Run(mode.name, func(t *testing.T) {
+			env := newBackendTestEnv(t)
+			addr := env.start(t)
+
+			client := mode.dial(t, addr, env)
+			defer client.Close()
+
+			// WinSCP checks the shell first, then starts SFTP on another session
+			_, output := replayPuTTY(t, client, append(
+				[]puttyRequest{puttySimple},
+				append(mode.setup, puttyExec("requests"))...,
+			))
+			if strings.Contains(output, "putty") {
+				t.Errorf("Backend received %q, want no PuTTY request", output)
+			}
+
+			requests := append([]puttyRequest{puttySimple}, mode.setup...)
+
+			replies, _ := replayPuTTY(t, client, append(requests, winscpSFTP, puttyWinadj))
+			if got := replies[len(replies)-2]; !got {
+				t.Error("SFTP subsystem refused")
+			}
+		})
+	}
+}
@@ -0,0 +1,343 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+)
+
+// sessionRecordingNotice tells users their session is recorded
+const sessionRecordingNotice = "This session is recorded"
+
+// RecordingMetadata describes a recorded session
+type RecordingMetadata struct {
+	SessionID   string
+	ConnID      string
+	Namespace   string
+	DevboxName  string
+	User        string
+	Fingerprint string
+	RemoteAddr  string
+	// Term, Width and Height are those of the PTY requested by the client
+	Term   string
+	Width  int
+	Height int
+	Start  time.Time
+}
+
+// SessionRecorder stores recordings of interactive sessions
+type SessionRecorder interface {
+	// Create returns the writer of a new recording, it is closed when the session ends
+	Create(meta *RecordingMetadata) (io.WriteCloser, error)
+}
+
+// dirRecorder stores recordings as files under a directory,
+// one subdirectory per namespace and devbox
+type dirRecorder struct {
+	dir string
+}
+
+// NewDirRecorder returns a SessionRecorder writing asciicast files under dir
+func NewDirRecorder(dir string) SessionRecorder {
+	return &dirRecorder{dir: dir}
+}
+
+func (r *dirRecorder) Create(meta *RecordingMetadata) (io.WriteCloser, error) {
+	dir := filepath.Join(r.dir, meta.Namespace, meta.DevboxName)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create recording directory: %w", err)
+	}
+
+	name := fmt.Sprintf("%s-%s.cast", meta.Start.UTC().Format("20060102T150405Z"), meta.SessionID)
+
+	//nolint:gosec // the path is built from Kubernetes object names
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording: %w", err)
+	}
+
+	return f, nil
+}
+
+// recordsSessions reports whether the interactive sessions of a devbox are recorded
+func (g *Gateway) recordsSessions(info *registry.DevboxInfo) bool {
+	return g.opts().SessionRecordingEnabled ||
+		slices.Contains(g.opts().SessionRecordingNamespaces, info.Namespace) ||
+		info.RecordSessions
+}
+
+// recordingMetadata returns the metadata shared by the recordings of a connection,
+// or nil if its sessions are not recorded
+func (g *Gateway) recordingMetadata(
+	conn *ssh.ServerConn,
+	connID string,
+	info *registry.DevboxInfo,
+	logger *log.Entry,
+) *RecordingMetadata {
+	if !g.recordsSessions(info) {
+		return nil
+	}
+
+	if g.recorder == nil {
+		logger.Warn("Session recording requested but no recorder is configured")
+		return nil
+	}
+
+	return &RecordingMetadata{
+		ConnID:      connID,
+		Namespace:   info.Namespace,
+		DevboxName:  info.DevboxName,
+		User:        redactUser(conn.User()),
+		Fingerprint: permissionsFingerprint(conn.Permissions),
+		RemoteAddr:  remoteAddr(conn.RemoteAddr()),
+	}
+}
+
+// sessionRecording records a session channel in asciicast v2 format once the
+// client requests a PTY. Sessions without a PTY, like sftp, are only noted in
+// the audit log. A nil sessionRecording records nothing.
+type sessionRecording struct {
+	g       *Gateway
+	channel ssh.Channel
+	logger  *log.Entry
+	maxSize int64
+
+	mu      sync.Mutex
+	meta    RecordingMetadata
+	w       io.WriteCloser
+	size    int64
+	stopped bool
+	// command is the exec command or subsystem of the session, for the audit log
+	command string
+}
+
+// newSessionRecording returns the recording of a channel, nil if the sessions
+// of its connection are not recorded
+func (g *Gateway) newSessionRecording(
+	cio *connIO,
+	channel ssh.Channel,
+	logger *log.Entry,
+) *sessionRecording {
+	if cio.recording == nil {
+		return nil
+	}
+
+	meta := *cio.recording
+	meta.SessionID = cio.id
+
+	return &sessionRecording{
+		g:       g,
+		channel: channel,
+		logger:  logger.WithField("audit", "session_recording"),
+		maxSize: g.recordingMaxSize,
+		meta:    meta,
+	}
+}
+
+// watch observes the requests of the client, starting the recording on a PTY
+// request and recording window changes
+func (r *sessionRecording) watch(in <-chan *ssh.Request) <-chan *ssh.Request {
+	if r == nil {
+		return in
+	}
+
+	out := make(chan *ssh.Request)
+
+	go func() {
+		defer close(out)
+
+		for req := range in {
+			r.observe(req)
+			out <- req
+		}
+	}()
+
+	return out
+}
+
+func (r *sessionRecording) observe(req *ssh.Request) {
+	switch req.Type {
+	case "pty-req":
+		var pty struct {
+			Term          string
+			Columns, Rows uint32
+			Width, Height uint32
+			Modes         string
+		}
+		if ssh.Unmarshal(req.Payload, &pty) == nil {
+			r.start(pty.Term, int(pty.Columns), int(pty.Rows))
+		}
+	case "window-change":
+		var size struct {
+			Columns, Rows uint32
+			Width, Height uint32
+		}
+		if ssh.Unmarshal(req.Payload, &size) == nil {
+			r.event("r", fmt.Sprintf("%dx%d", size.Columns, size.Rows))
+		}
+	case "exec", "subsystem":
+		var command struct{ Command string }
+		if ssh.Unmarshal(req.Payload, &command) == nil {
+			r.mu.Lock()
+			r.command = command.Command
+			r.mu.Unlock()
+		}
+	}
+
+	if req.Type == "shell" || req.Type == "exec" {
+		r.mu.Lock()
+		recording := r.w != nil
+		r.mu.Unlock()
+
+		if recording {
+			fmt.Fprintf(r.channel, "%s\r\n", sessionRecordingNotice)
+		}
+	}
+}
+
+// start creates the recording and writes the asciicast header
+func (r *sessionRecording) start(term string, width, height int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.w != nil || r.stopped {
+		return
+	}
+
+	r.meta.Term, r.meta.Width, r.meta.Height = term, width, height
+	r.meta.Start = time.Now()
+
+	w, err := r.g.recorder.Create(&r.meta)
+	if err != nil {
+		r.logger.WithError(err).Error("Failed to start session recording")
+		r.stopped = true
+
+		return
+	}
+
+	r.w = w
+	r.writeLocked(map[string]any{
+		"version":   2,
+		"width":     width,
+		"height":    height,
+		"timestamp": r.meta.Start.Unix(),
+		"title":     fmt.Sprintf("%s@%s/%s", r.meta.User, r.meta.Namespace, r.meta.DevboxName),
+		"env":       map[string]string{"TERM": term},
+		"sshgate": map[string]string{
+			"session_id":  r.meta.SessionID,
+			"conn_id":     r.meta.ConnID,
+			"namespace":   r.meta.Namespace,
+			"devbox":      r.meta.DevboxName,
+			"user":        r.meta.User,
+			"fingerprint": r.meta.Fingerprint,
+			"remote_addr": r.meta.RemoteAddr,
+		},
+	})
+
+	r.logger.Info("Session recording started")
+}
+
+// event records an asciicast event of the given code
+func (r *sessionRecording) event(code, data string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.w == nil || r.stopped {
+		return
+	}
+
+	r.writeLocked([]any{time.Since(r.meta.Start).Seconds(), code, data})
+}
+
+// writeLocked writes a line of the recording, stopping it at the size cap
+// so that the file always ends with a complete line
+func (r *sessionRecording) writeLocked(v any) {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+
+	line = append(line, '\n')
+
+	if r.maxSize > 0 && r.size+int64(len(line)) > r.maxSize {
+		r.logger.WithField("max_size", r.maxSize).Warn("Session recording reached its size cap")
+		r.stopped = true
+
+		return
+	}
+
+	n, err := r.w.Write(line)
+	r.size += int64(n)
+
+	if err != nil {
+		r.logger.WithError(err).Error("Failed to write session recording")
+		r.stopped = true
+	}
+}
+
+// upstream records the input of the client read from rd
+func (r *sessionRecording) upstream(rd io.Reader) io.Reader {
+	if r == nil {
+		return rd
+	}
+
+	return &recordingReader{r: rd, record: func(p []byte) { r.event("i", string(p)) }}
+}
+
+// downstream records the output of the backend read from rd
+func (r *sessionRecording) downstream(rd io.Reader) io.Reader {
+	if r == nil {
+		return rd
+	}
+
+	return &recordingReader{r: rd, record: func(p []byte) { r.event("o", string(p)) }}
+}
+
+// close ends the recording, channels without a PTY are noted in the audit log
+func (r *sessionRecording) close() {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.w == nil {
+		r.logger.WithField("command", r.command).Info("Channel not recorded, no PTY requested")
+		return
+	}
+
+	if err := r.w.Close(); err != nil {
+		r.logger.WithError(err).Error("Failed to close session recording")
+	}
+
+	r.logger.WithFields(log.Fields{
+		"recording_bytes": r.size,
+		"truncated":       r.stopped,
+	}).Info("Session recording ended")
+
+	r.stopped = true
+}
+
+type recordingReader struct {
+	r      io.Reader
+	record func([]byte)
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.record(p[:n])
+	}
+
+	return n, err
+}
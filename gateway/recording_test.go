@@ -0,0 +1,287 @@
+package gateway_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"golang.org/x/crypto/ssh"
+)
+
+// memRecorder keeps recordings in memory
+type memRecorder struct {
+	mu         sync.Mutex
+	recordings []*memRecording
+}
+
+type memRecording struct {
+	meta   gateway.RecordingMetadata
+	buf    syncBuffer
+	closed chan struct{}
+}
+
+func (r *memRecording) Write(p []byte) (int, error) { return r.buf.Write(p) }
+
+func (r *memRecording) Close() error {
+	close(r.closed)
+	return nil
+}
+
+func (r *memRecorder) Create(meta *gateway.RecordingMetadata) (io.WriteCloser, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rec := &memRecording{meta: *meta, closed: make(chan struct{})}
+	r.recordings = append(r.recordings, rec)
+
+	return rec, nil
+}
+
+func (r *memRecorder) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.recordings)
+}
+
+// waitClosed waits for the only recording to be closed and returns its lines
+func (r *memRecorder) waitClosed(t *testing.T) (*memRecording, []string) {
+	t.Helper()
+
+	if got := r.count(); got != 1 {
+		t.Fatalf("Got %d recordings, want 1", got)
+	}
+
+	rec := r.recordings[0]
+
+	select {
+	case <-rec.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Recording never closed")
+	}
+
+	return rec, strings.Split(strings.TrimSuffix(rec.buf.String(), "\n"), "\n")
+}
+
+// runEchoSession sends input to an echo session, with a PTY if pty is set,
+// and returns its output
+func runEchoSession(t *testing.T, client *ssh.Client, pty bool, input string) string {
+	t.Helper()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer session.Close()
+
+	if pty {
+		if err := session.RequestPty("xterm", 24, 80, ssh.TerminalModes{}); err != nil {
+			t.Fatalf("Failed to request PTY: %v", err)
+		}
+	}
+
+	var stdout bytes.Buffer
+
+	session.Stdout = &stdout
+	session.Stdin = strings.NewReader(input)
+
+	if err := session.Run("echo"); err != nil {
+		t.Fatalf("Session failed: %v", err)
+	}
+
+	return stdout.String()
+}
+
+func TestSessionRecording_RecordsPTYSession(t *testing.T) {
+	env := newBackendTestEnv(t)
+	recorder := &memRecorder{}
+	addr := env.start(t,
+		gateway.WithSessionRecording(true, nil, "", "64M"),
+		gateway.WithSessionRecorder(recorder),
+	)
+
+	client := dialPublicKeyMode(t, addr, env)
+	defer client.Close()
+
+	output := runEchoSession(t, client, true, "hello\n")
+	if !strings.HasPrefix(output, "This session is recorded") {
+		t.Errorf("Output = %q, want the recording notice first", output)
+	}
+
+	rec, lines := recorder.waitClosed(t)
+
+	if rec.meta.Namespace != "ns-test" || rec.meta.DevboxName != "test-devbox" ||
+		rec.meta.User != "testuser" || rec.meta.Fingerprint == "" ||
+		rec.meta.ConnID == "" || !strings.HasPrefix(rec.meta.SessionID, rec.meta.ConnID) {
+		t.Errorf("Metadata = %+v, want the devbox, user, fingerprint and IDs", rec.meta)
+	}
+
+	var header struct {
+		Version int               `json:"version"`
+		Width   int               `json:"width"`
+		Height  int               `json:"height"`
+		Env     map[string]string `json:"env"`
+		Sshgate map[string]string `json:"sshgate"`
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &header); err != nil {
+		t.Fatalf("Invalid header %q: %v", lines[0], err)
+	}
+
+	if header.Version != 2 || header.Width != 80 || header.Height != 24 ||
+		header.Env["TERM"] != "xterm" || header.Sshgate["devbox"] != "test-devbox" {
+		t.Errorf("Header = %+v, want a v2 80x24 xterm header for test-devbox", header)
+	}
+
+	var recordedIn, recordedOut string
+
+	for _, line := range lines[1:] {
+		var event []any
+		if err := json.Unmarshal([]byte(line), &event); err != nil || len(event) != 3 {
+			t.Fatalf("Invalid event %q: %v", line, err)
+		}
+
+		switch event[1] {
+		case "i":
+			recordedIn += event[2].(string)
+		case "o":
+			recordedOut += event[2].(string)
+		}
+	}
+
+	if recordedIn != "hello\n" || recordedOut != "hello\n" {
+		t.Errorf("Recorded input %q and output %q, want hello", recordedIn, recordedOut)
+	}
+}
+
+func TestSessionRecording_SkipsSessionsWithoutPTY(t *testing.T) {
+	env := newBackendTestEnv(t)
+	recorder := &memRecorder{}
+	addr := env.start(t,
+		gateway.WithSessionRecording(true, nil, "", "64M"),
+		gateway.WithSessionRecorder(recorder),
+	)
+
+	client := dialPublicKeyMode(t, addr, env)
+	defer client.Close()
+
+	if output := runEchoSession(t, client, false, "data"); output != "data" {
+		t.Errorf("Output = %q, want data", output)
+	}
+
+	if got := recorder.count(); got != 0 {
+		t.Errorf("Got %d recordings, want 0", got)
+	}
+}
+
+func TestSessionRecording_OnlySelectedNamespaces(t *testing.T) {
+	env := newBackendTestEnv(t)
+	recorder := &memRecorder{}
+	addr := env.start(t,
+		gateway.WithSessionRecording(false, []string{"ns-other"}, "", "64M"),
+		gateway.WithSessionRecorder(recorder),
+	)
+
+	client := dialPublicKeyMode(t, addr, env)
+	defer client.Close()
+
+	runEchoSession(t, client, true, "hello\n")
+
+	if got := recorder.count(); got != 0 {
+		t.Errorf("Got %d recordings, want 0", got)
+	}
+}
+
+func TestSessionRecording_SizeCap(t *testing.T) {
+	env := newBackendTestEnv(t)
+	recorder := &memRecorder{}
+	addr := env.start(t,
+		gateway.WithSessionRecording(true, nil, "", "1K"),
+		gateway.WithSessionRecorder(recorder),
+	)
+
+	client := dialPublicKeyMode(t, addr, env)
+	defer client.Close()
+
+	input := strings.Repeat("0123456789abcdef", 256)
+	if output := runEchoSession(t, client, true, input); !strings.HasSuffix(output, input) {
+		t.Error("Session output was cut by the recording size cap")
+	}
+
+	rec, lines := recorder.waitClosed(t)
+
+	if size := len(rec.buf.String()); size > 1024 {
+		t.Errorf("Recording is %d bytes, want at most 1024", size)
+	}
+
+	for _, line := range lines {
+		if !json.Valid([]byte(line)) {
+			t.Errorf("Recording ends with a partial line %q", line)
+		}
+	}
+}
+
+func TestSessionRecording_WritesDirectory(t *testing.T) {
+	env := newBackendTestEnv(t)
+	dir := t.TempDir()
+	addr := env.start(t, gateway.WithSessionRecording(true, nil, dir, "64M"))
+
+	client := dialPublicKeyMode(t, addr, env)
+	defer client.Close()
+
+	runEchoSession(t, client, true, "hello\n")
+
+	// The recording is closed once the gateway is done with the channel
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		files, _ := filepath.Glob(filepath.Join(dir, "ns-test", "test-devbox", "*.cast"))
+		if len(files) == 1 {
+			f, err := os.Open(files[0])
+			if err != nil {
+				t.Fatalf("Failed to open recording: %v", err)
+			}
+
+			scanner := bufio.NewScanner(f)
+			found := false
+
+			for scanner.Scan() {
+				found = found || strings.Contains(scanner.Text(), `"o","hello`)
+			}
+
+			f.Close()
+
+			if found {
+				return
+			}
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("No recording with the session output in %s, found %v", dir, files)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestOptionsValidate_SessionRecording(t *testing.T) {
+	opts := gateway.DefaultOptions()
+	gateway.WithSessionRecording(true, nil, "", "64M")(&opts)
+
+	if err := opts.Validate(); err == nil {
+		t.Error("Validate() accepted session recording without a directory")
+	}
+
+	gateway.WithSessionRecording(true, nil, t.TempDir(), "lots")(&opts)
+
+	if err := opts.Validate(); err == nil {
+		t.Error("Validate() accepted an invalid recording max size")
+	}
+}
@@ -0,0 +1,94 @@
+package gateway
+
+import "reflect"
+
+// ReloadableOptions are the options Reload applies, by name: timeouts,
+// connection caps, bandwidth limits, banners and messages, and allow and deny
+// lists. Settings read when a connection starts, such as its session cap and
+// bandwidth limit, apply to new connections; timeouts and lists apply to new
+// requests.
+var ReloadableOptions = []string{
+	"SSHHandshakeTimeout",
+	"BackendConnectTimeoutPublicKey",
+	"BackendConnectTimeoutAgent",
+	"ProxyJumpTimeout",
+	"SessionRequestTimeout",
+	"AuthFailureMinDuration",
+	"MaxCachedRequests",
+	"MaxSessionsPerConn",
+	"BandwidthLimit",
+	"BandwidthLimitBurst",
+	"BandwidthLimitNamespaces",
+	"Banner",
+	"BannerShowDevboxStatus",
+	"BannerDevboxStoppedTemplate",
+	"BannerDevboxUnavailableTemplate",
+	"BannerUnknownDevboxTemplate",
+	"BannerInvalidUsernameTemplate",
+	"AuthHelpEnabled",
+	"AuthHelpMessage",
+	"AgentHelpURL",
+	"MOTDEnabled",
+	"MOTDTemplate",
+	"AdminDeniedNamespaces",
+	"AgentAllowedFingerprints",
+	"DisabledGatewayCommands",
+}
+
+// opts returns the options in effect, read when they are used so that Reload
+// applies to new connections and requests
+func (g *Gateway) opts() *Options {
+	return g.options.Load()
+}
+
+// Options returns a copy of the options in effect
+func (g *Gateway) Options() Options {
+	return *g.opts()
+}
+
+// Reload applies the ReloadableOptions of options that differ from the options
+// in effect, leaving established connections be, and returns their names. The
+// other options are left as they are, they require a restart. Nothing is
+// applied when the resulting options are invalid.
+func (g *Gateway) Reload(options Options) ([]string, error) {
+	g.reloadMu.Lock()
+	defer g.reloadMu.Unlock()
+
+	current := g.opts()
+	next := *current
+
+	currentValue := reflect.ValueOf(current).Elem()
+	nextValue := reflect.ValueOf(&next).Elem()
+	optionsValue := reflect.ValueOf(options)
+
+	var applied []string
+
+	for _, name := range ReloadableOptions {
+		value := optionsValue.FieldByName(name)
+		if reflect.DeepEqual(currentValue.FieldByName(name).Interface(), value.Interface()) {
+			continue
+		}
+
+		nextValue.FieldByName(name).Set(value)
+
+		applied = append(applied, name)
+	}
+
+	if len(applied) == 0 {
+		return nil, nil
+	}
+
+	if err := next.Validate(); err != nil {
+		return nil, err
+	}
+
+	bandwidth, err := parseBandwidthPolicy(&next)
+	if err != nil {
+		return nil, err
+	}
+
+	g.bandwidth.Store(bandwidth)
+	g.options.Store(&next)
+
+	return applied, nil
+}
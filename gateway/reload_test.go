@@ -0,0 +1,131 @@
+package gateway_test
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+)
+
+// startDiscardSession starts a session running until its stdin is closed
+func startDiscardSession(t *testing.T, client *ssh.Client) func() {
+	t.Helper()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatalf("Failed to get stdin: %v", err)
+	}
+
+	if err := session.Start("discard"); err != nil {
+		t.Fatalf("Failed to start session: %v", err)
+	}
+
+	return func() {
+		stdin.Close()
+		_ = session.Wait()
+	}
+}
+
+func assertResourceShortage(t *testing.T, client *ssh.Client) {
+	t.Helper()
+
+	_, err := client.NewSession()
+
+	var openErr *ssh.OpenChannelError
+	if !errors.As(err, &openErr) || openErr.Reason != ssh.ResourceShortage {
+		t.Errorf("NewSession() error = %v, want resource shortage", err)
+	}
+}
+
+func TestReload_NewConnectionsObserveNewLimits(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t, gateway.WithMaxSessionsPerConn(1))
+
+	existing := dialPublicKeyMode(t, addr, env)
+
+	stop := startDiscardSession(t, existing)
+	defer stop()
+
+	options := env.gateway.Options()
+	options.MaxSessionsPerConn = 2
+	options.Banner = "reloaded"
+
+	applied, err := env.gateway.Reload(options)
+	if err != nil {
+		t.Fatalf("Reload() failed: %v", err)
+	}
+
+	if want := []string{"MaxSessionsPerConn", "Banner"}; !slices.Equal(applied, want) {
+		t.Errorf("Reload() = %v, want %v", applied, want)
+	}
+
+	if got := env.gateway.Options().MaxSessionsPerConn; got != 2 {
+		t.Errorf("MaxSessionsPerConn = %d, want 2", got)
+	}
+
+	// The established connection keeps the cap it started with
+	assertResourceShortage(t, existing)
+
+	client := dialPublicKeyMode(t, addr, env)
+
+	stopFirst := startDiscardSession(t, client)
+	defer stopFirst()
+
+	stopSecond := startDiscardSession(t, client)
+	defer stopSecond()
+
+	assertResourceShortage(t, client)
+}
+
+func TestReload_RestartRequired(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t)
+
+	options := env.gateway.Options()
+	backendPort := options.SSHBackendPort
+	options.SSHBackendPort = 1
+	options.SessionRequestTimeout = 7 * time.Second
+
+	applied, err := env.gateway.Reload(options)
+	if err != nil {
+		t.Fatalf("Reload() failed: %v", err)
+	}
+
+	if want := []string{"SessionRequestTimeout"}; !slices.Equal(applied, want) {
+		t.Errorf("Reload() = %v, want %v", applied, want)
+	}
+
+	if got := env.gateway.Options().SSHBackendPort; got != backendPort {
+		t.Errorf("SSHBackendPort = %d, want %d kept until a restart", got, backendPort)
+	}
+
+	// Backends are still reached on the port the gateway started with
+	runPublicKeySession(t, addr, env, "testuser")
+}
+
+func TestReload_InvalidOptionsNotApplied(t *testing.T) {
+	hostKey, _, _, _ := generateTestKeys(t)
+	gw := gateway.New(hostKey, registry.New(), gateway.WithMaxSessionsPerConn(3))
+
+	options := gw.Options()
+	options.MaxSessionsPerConn = -1
+	options.Banner = "reloaded"
+
+	if _, err := gw.Reload(options); err == nil {
+		t.Fatal("Reload() succeeded, want an error")
+	}
+
+	if got := gw.Options(); got.MaxSessionsPerConn != 3 || got.Banner != "" {
+		t.Errorf("Options() = %d sessions, banner %q, want the options before Reload",
+			got.MaxSessionsPerConn, got.Banner)
+	}
+}
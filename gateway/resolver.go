@@ -0,0 +1,36 @@
+package gateway
+
+import (
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+)
+
+// DevboxResolver is what the gateway needs of the registry of devboxes, it
+// resolves clients to devboxes and reports their changes. *registry.Registry
+// implements it, tests may provide a fake.
+type DevboxResolver interface {
+	// GetByPublicKey returns the devbox a key reaches
+	GetByPublicKey(key ssh.PublicKey) (*registry.DevboxInfo, bool)
+	// GetDevboxInfo returns a devbox by namespace and name
+	GetDevboxInfo(namespace, devboxName string) (*registry.DevboxInfo, bool)
+	// Devboxes returns every devbox
+	Devboxes() []registry.DevboxInfo
+	// BackendHealth returns the probed reachability of the backend of a devbox
+	BackendHealth(namespace, devboxName string) (registry.BackendHealth, bool)
+	// UpdateBackendHealth applies update to the backend health of a devbox
+	// unless its pod IP is no longer podIP, reporting whether it applied
+	UpdateBackendHealth(
+		namespace, devboxName, podIP string,
+		update func(*registry.BackendHealth),
+	) bool
+	// IsRevoked reports whether the key of a SHA256 fingerprint is revoked
+	IsRevoked(fingerprint string) bool
+	// OTPSecret returns the TOTP secret of a key fingerprint, falling back to
+	// the one of the namespace
+	OTPSecret(fingerprint, namespace string) ([]byte, bool)
+	// Subscribe calls fn after every devbox change until unsubscribed, fn must
+	// not block
+	Subscribe(fn func(registry.Event)) (unsubscribe func())
+}
+
+var _ DevboxResolver = (*registry.Registry)(nil)
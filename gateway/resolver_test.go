@@ -0,0 +1,153 @@
+package gateway_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeResolver is an in-memory DevboxResolver serving fixed devboxes
+type fakeResolver struct {
+	devboxes []*registry.DevboxInfo
+	// revoked holds the SHA256 fingerprints of revoked keys
+	revoked map[string]bool
+}
+
+func (f *fakeResolver) GetByPublicKey(key ssh.PublicKey) (*registry.DevboxInfo, bool) {
+	for _, info := range f.devboxes {
+		if source, _ := info.KeySource(key); source == registry.KeySourcePrimary {
+			return info, true
+		}
+	}
+
+	return nil, false
+}
+
+func (f *fakeResolver) GetDevboxInfo(namespace, devboxName string) (*registry.DevboxInfo, bool) {
+	for _, info := range f.devboxes {
+		if info.Namespace == namespace && info.DevboxName == devboxName {
+			return info, true
+		}
+	}
+
+	return nil, false
+}
+
+func (f *fakeResolver) Devboxes() []registry.DevboxInfo {
+	devboxes := make([]registry.DevboxInfo, 0, len(f.devboxes))
+	for _, info := range f.devboxes {
+		devboxes = append(devboxes, *info)
+	}
+
+	return devboxes
+}
+
+func (f *fakeResolver) BackendHealth(namespace, devboxName string) (registry.BackendHealth, bool) {
+	info, ok := f.GetDevboxInfo(namespace, devboxName)
+	if !ok {
+		return registry.BackendHealth{}, false
+	}
+
+	return info.Health, true
+}
+
+func (f *fakeResolver) UpdateBackendHealth(
+	_, _, _ string,
+	_ func(*registry.BackendHealth),
+) bool {
+	return false
+}
+
+func (f *fakeResolver) IsRevoked(fingerprint string) bool {
+	return f.revoked[fingerprint]
+}
+
+func (f *fakeResolver) OTPSecret(_, _ string) ([]byte, bool) {
+	return nil, false
+}
+
+func (f *fakeResolver) Subscribe(func(registry.Event)) func() {
+	return func() {}
+}
+
+func TestPublicKeyCallback_FakeResolver(t *testing.T) {
+	_, devboxKey, _, _ := generateTestKeys(t)
+	_, laptopKey, _, _ := generateTestKeys(t)
+	_, revokedKey, _, _ := generateTestKeys(t)
+	_, unknownKey, _, _ := generateTestKeys(t)
+
+	resolver := &fakeResolver{
+		devboxes: []*registry.DevboxInfo{
+			{
+				Namespace:  "ns-test",
+				DevboxName: "test-devbox",
+				PublicKey:  devboxKey,
+				AuthorizedKeys: []registry.AuthorizedKey{
+					{PublicKey: laptopKey, Comment: "alice@laptop"},
+				},
+			},
+			{
+				Namespace:  "ns-test",
+				DevboxName: "revoked-devbox",
+				PublicKey:  revokedKey,
+			},
+		},
+		revoked: map[string]bool{ssh.FingerprintSHA256(revokedKey): true},
+	}
+
+	callback := gateway.NewPublicKeyCallback(resolver)
+
+	tests := []struct {
+		name     string
+		user     string
+		key      ssh.PublicKey
+		wantMode gateway.AuthMode
+		wantErr  error
+	}{
+		{name: "devbox key", user: "root", key: devboxKey, wantMode: gateway.AuthModePublicKey},
+		{
+			name:     "authorized key selecting its devbox",
+			user:     "root@ns-test/test-devbox",
+			key:      laptopKey,
+			wantMode: gateway.AuthModePublicKey,
+		},
+		{
+			name:     "unknown key selecting a devbox",
+			user:     "root@ns-test/test-devbox",
+			key:      unknownKey,
+			wantMode: gateway.AuthModeCustomKey,
+		},
+		{name: "unknown key", user: "root", key: unknownKey, wantErr: gateway.ErrUnknownKey},
+		{
+			name:    "unknown key selecting a missing devbox",
+			user:    "root@ns-test/missing",
+			key:     unknownKey,
+			wantErr: gateway.ErrDevboxNotFound,
+		},
+		{name: "revoked key", user: "root", key: revokedKey, wantErr: gateway.ErrKeyRevoked},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			perms, err := callback(newMockConnMetadata(tt.user), tt.key)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Error = %v, want %v", err, tt.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if mode := perms.Extensions["auth_mode"]; mode != tt.wantMode.String() {
+				t.Errorf("Auth mode = %q, want %s", mode, tt.wantMode)
+			}
+		})
+	}
+}
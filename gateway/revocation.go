@@ -0,0 +1,69 @@
+package gateway
+
+import (
+	"slices"
+
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+)
+
+// keyRevokedNotice is written to the sessions of connections terminated after
+// their key was revoked
+const keyRevokedNotice = "the key of this connection was revoked, closing connection"
+
+// revokedFingerprint returns the fingerprint of key, or of the key certified by
+// a certificate, found on the revocation list
+func (g *Gateway) revokedFingerprint(key ssh.PublicKey) (string, bool) {
+	fingerprints := []string{ssh.FingerprintSHA256(key)}
+	if cert, ok := key.(*ssh.Certificate); ok {
+		fingerprints = append(fingerprints, ssh.FingerprintSHA256(cert.Key))
+	}
+
+	for _, fingerprint := range fingerprints {
+		if g.registry.IsRevoked(fingerprint) {
+			return fingerprint, true
+		}
+	}
+
+	return "", false
+}
+
+// permissionsKeyFingerprints returns the fingerprints a connection is revoked
+// by, none if it authenticated without a key
+func permissionsKeyFingerprints(perms *ssh.Permissions) []string {
+	var fingerprints []string
+
+	if fingerprint := permissionsFingerprint(perms); fingerprint != "" {
+		fingerprints = append(fingerprints, fingerprint)
+	}
+
+	if fingerprint := permissionsExtension(perms, "cert_key_fingerprint"); fingerprint != "" {
+		fingerprints = append(fingerprints, fingerprint)
+	}
+
+	return fingerprints
+}
+
+// handleKeysRevokedEvent terminates the connections authenticated with a newly
+// revoked key, or only logs them in log only mode
+func (g *Gateway) handleKeysRevokedEvent(event registry.Event) {
+	for _, conn := range g.liveConns.all() {
+		index := slices.IndexFunc(conn.fingerprints, func(fingerprint string) bool {
+			return slices.Contains(event.Fingerprints, fingerprint)
+		})
+		if index < 0 {
+			continue
+		}
+
+		logger := conn.logger.WithField("fingerprint", conn.fingerprints[index])
+
+		if !g.opts().TerminateRevokedConns {
+			logger.Warn("Key revoked, connection left open")
+			continue
+		}
+
+		logger.Warn("Key revoked, terminating connection")
+
+		go conn.terminate(AuditReasonKeyRevoked, keyRevokedNotice, nil)
+	}
+}
@@ -0,0 +1,121 @@
+package gateway_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// revokeKeys lists fingerprints in the revocation ConfigMap of the test env
+func revokeKeys(reg *registry.Registry, fingerprints ...string) {
+	reg.UpdateConfigMap(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "revoked-keys", Namespace: "sshgate"},
+		Data: map[string]string{
+			"fingerprints": "# leaked keys\n" + strings.Join(fingerprints, "\n"),
+		},
+	})
+}
+
+// devboxFingerprint returns the fingerprint of the devbox key of the test env
+func devboxFingerprint(t *testing.T, env *backendTestEnv) string {
+	t.Helper()
+
+	signer, err := ssh.ParsePrivateKey(env.privBytes)
+	if err != nil {
+		t.Fatalf("Failed to parse private key: %v", err)
+	}
+
+	return ssh.FingerprintSHA256(signer.PublicKey())
+}
+
+func TestKeyRevocation_RejectsKey(t *testing.T) {
+	env := newBackendTestEnv(t, registry.WithRevocationConfigMap("sshgate", "revoked-keys"))
+	opt, path := newAuditLog(t)
+	addr := env.start(t, opt)
+
+	fingerprint := devboxFingerprint(t, env)
+	revokeKeys(env.reg, fingerprint)
+
+	signer, err := ssh.ParsePrivateKey(env.privBytes)
+	if err != nil {
+		t.Fatalf("Failed to parse private key: %v", err)
+	}
+
+	_, err = ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User: "testuser",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		//nolint:gosec // acceptable for testing
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err == nil {
+		t.Fatal("Revoked key authenticated")
+	}
+
+	record := waitForAudit(t, path, gateway.AuditEventHandshakeFailed)
+	if record["fingerprint"] != fingerprint ||
+		record["auth_failure"] != gateway.AuthFailureRevokedKey {
+		t.Errorf("Handshake failure record = %v", record)
+	}
+
+	// Revocations are counted apart from unknown keys
+	stats := env.gateway.AuthStats()
+	if got := stats.Failures[gateway.AuthFailureRevokedKey]; got != 1 {
+		t.Errorf("Failures[%s] = %d, want 1", gateway.AuthFailureRevokedKey, got)
+	}
+
+	if got := stats.Failures[gateway.AuthFailureUnknownKey]; got != 0 {
+		t.Errorf("Failures[%s] = %d, want 0", gateway.AuthFailureUnknownKey, got)
+	}
+
+	// Removing the fingerprint lets the key in again
+	revokeKeys(env.reg)
+
+	client := dialPublicKeyMode(t, addr, env)
+	client.Close()
+}
+
+func TestKeyRevocation_ClosesConnections(t *testing.T) {
+	env := newBackendTestEnv(t, registry.WithRevocationConfigMap("sshgate", "revoked-keys"))
+	opt, path := newAuditLog(t)
+	addr := env.start(t, opt)
+
+	client := dialPublicKeyMode(t, addr, env)
+	defer client.Close()
+
+	session, stderr := startLongSession(t, client)
+
+	// Other fingerprints leave the connection open
+	revokeKeys(env.reg, "SHA256:unrelated")
+
+	other, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to create session after an unrelated revocation: %v", err)
+	}
+
+	if err := other.Run("exit 0"); err != nil {
+		t.Errorf("Session after an unrelated revocation failed: %v", err)
+	}
+
+	revokeKeys(env.reg, "SHA256:unrelated", devboxFingerprint(t, env))
+
+	waitForClose(t, client)
+
+	_ = session.Wait()
+
+	if !strings.Contains(stderr.String(), "was revoked") {
+		t.Errorf("Session stderr = %q, want a revocation notice", stderr.String())
+	}
+
+	record := waitForAudit(t, path, gateway.AuditEventConnection)
+	if record["reason"] != gateway.AuditReasonKeyRevoked {
+		t.Errorf("Connection record reason = %v, want %s",
+			record["reason"], gateway.AuditReasonKeyRevoked)
+	}
+}
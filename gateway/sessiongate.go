@@ -0,0 +1,76 @@
+package gateway
+
+import (
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// noMoreSessionsRequestType is sent by OpenSSH clients, notably ControlMaster
+// multiplexers, to forbid further session channels on the connection
+const noMoreSessionsRequestType = "no-more-sessions@openssh.com"
+
+// sessionGate records whether a client connection still accepts session channels.
+// The restriction applies to the client to gateway hop and is never forwarded.
+type sessionGate struct {
+	closed atomic.Bool
+	// max is the limit of concurrent session channels, 0 means unlimited
+	max  int64
+	open atomic.Int64
+}
+
+func newSessionGate(maxSessions int) *sessionGate {
+	return &sessionGate{max: int64(maxSessions)}
+}
+
+// handleRequest closes the gate on no-more-sessions, reporting whether req was consumed
+func (s *sessionGate) handleRequest(req *ssh.Request) bool {
+	if req.Type != noMoreSessionsRequestType {
+		return false
+	}
+
+	s.closed.Store(true)
+
+	if req.WantReply {
+		_ = req.Reply(true, nil)
+	}
+
+	return true
+}
+
+// admit rejects a session channel opened after no-more-sessions or beyond the
+// session limit, reporting whether newChannel may be handled. Admitted channels
+// must be released once handled.
+func (s *sessionGate) admit(newChannel ssh.NewChannel, logger *log.Entry) bool {
+	if newChannel.ChannelType() != "session" {
+		return true
+	}
+
+	if s.closed.Load() {
+		logger.Warn("Rejecting session channel after no-more-sessions")
+
+		_ = newChannel.Reject(ssh.Prohibited, "no more sessions allowed")
+
+		return false
+	}
+
+	if open := s.open.Add(1); s.max > 0 && open > s.max {
+		s.open.Add(-1)
+
+		logger.WithField("max_sessions", s.max).Warn("Rejecting session channel over the limit")
+
+		_ = newChannel.Reject(ssh.ResourceShortage, "too many sessions")
+
+		return false
+	}
+
+	return true
+}
+
+// release ends the use of an admitted channel
+func (s *sessionGate) release(newChannel ssh.NewChannel) {
+	if newChannel.ChannelType() == "session" {
+		s.open.Add(-1)
+	}
+}
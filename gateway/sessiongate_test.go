@@ -0,0 +1,83 @@
+package gateway_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sendNoMoreSessions sends no-more-sessions@openssh.com and waits for the gateway to take it
+func sendNoMoreSessions(t *testing.T, client *ssh.Client) {
+	t.Helper()
+
+	ok, _, err := client.SendRequest("no-more-sessions@openssh.com", true, nil)
+	if err != nil || !ok {
+		t.Fatalf("no-more-sessions = %v, %v, want success", ok, err)
+	}
+}
+
+func assertSessionProhibited(t *testing.T, client *ssh.Client) {
+	t.Helper()
+
+	_, err := client.NewSession()
+
+	var openErr *ssh.OpenChannelError
+	if !errors.As(err, &openErr) || openErr.Reason != ssh.Prohibited {
+		t.Errorf("NewSession() error = %v, want %v", err, ssh.Prohibited)
+	}
+}
+
+func TestNoMoreSessions_PublicKeyMode(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t)
+
+	signer, err := ssh.ParsePrivateKey(env.privBytes)
+	if err != nil {
+		t.Fatalf("Failed to parse private key: %v", err)
+	}
+
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User: "testuser",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		//nolint:gosec // acceptable for testing
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Failed to dial gateway: %v", err)
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer session.Close()
+
+	sendNoMoreSessions(t, client)
+	assertSessionProhibited(t, client)
+
+	// Channels opened before keep working
+	if err := session.Run("exit 0"); err != nil {
+		t.Errorf("Existing session failed: %v", err)
+	}
+}
+
+func TestNoMoreSessions_AgentForwardMode(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t)
+
+	client := dialAgentForwardMode(t, addr, env)
+	defer client.Close()
+
+	runAgentForwardSession(t, client)
+	sendNoMoreSessions(t, client)
+	assertSessionProhibited(t, client)
+
+	// The connection itself stays usable
+	if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+		t.Errorf("Keepalive after no-more-sessions failed: %v", err)
+	}
+}
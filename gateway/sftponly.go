@@ -0,0 +1,181 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+)
+
+// sftpOnly reports whether the connections to a devbox are restricted to SFTP,
+// its annotation overriding the gateway default
+func (g *Gateway) sftpOnly(info *registry.DevboxInfo) bool {
+	if info.SFTPOnly != nil {
+		return *info.SFTPOnly
+	}
+
+	return g.opts().SFTPOnly
+}
+
+// sftpOnlyAllowsChannel reports whether an SFTP only connection may open a
+// channel of the given type. Sessions are allowed, forwarding channels are not.
+func sftpOnlyAllowsChannel(channelType string) bool {
+	return channelType == "session"
+}
+
+// sftpOnlyAllowsGlobalRequest reports whether an SFTP only connection may send a
+// global request of the given type, anything but port and socket forwarding
+func sftpOnlyAllowsGlobalRequest(requestType string) bool {
+	switch requestType {
+	case "tcpip-forward", "cancel-tcpip-forward",
+		"streamlocal-forward@openssh.com", "cancel-streamlocal-forward@openssh.com":
+		return false
+	default:
+		return true
+	}
+}
+
+// sftpOnlyAllowsRequest reports whether a session of an SFTP only connection may
+// send a channel request. Shells, commands, X11 forwarding and subsystems other
+// than sftp are rejected, requests setting up the session are allowed.
+func sftpOnlyAllowsRequest(req *ssh.Request) bool {
+	switch req.Type {
+	case "shell", "exec", "x11-req":
+		return false
+	case "subsystem":
+		var subsystem struct{ Name string }
+		if err := ssh.Unmarshal(req.Payload, &subsystem); err != nil {
+			return false
+		}
+
+		return subsystem.Name == "sftp"
+	default:
+		return true
+	}
+}
+
+// restrictChannels rejects the channels SFTP only connections may not open,
+// returning the others until ctx is done. Without the restriction the channels are
+// returned as is.
+func restrictChannels(
+	ctx context.Context,
+	in <-chan ssh.NewChannel,
+	sftpOnly bool,
+	logger *log.Entry,
+) <-chan ssh.NewChannel {
+	if !sftpOnly {
+		return in
+	}
+
+	out := make(chan ssh.NewChannel)
+
+	go func() {
+		defer close(out)
+
+		for newChannel := range in {
+			if sftpOnlyAllowsChannel(newChannel.ChannelType()) {
+				select {
+				case out <- newChannel:
+					continue
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			logger.WithField("channel_type", newChannel.ChannelType()).
+				Info("Rejecting channel, the devbox only allows SFTP")
+
+			_ = newChannel.Reject(ssh.Prohibited, clientMessages[msgSFTPOnly])
+		}
+	}()
+
+	return out
+}
+
+// restrictGlobalRequests refuses the global requests SFTP only connections may
+// not send, returning the others until ctx is done. Without the restriction the
+// requests are returned as is.
+func restrictGlobalRequests(
+	ctx context.Context,
+	in <-chan *ssh.Request,
+	sftpOnly bool,
+	logger *log.Entry,
+) <-chan *ssh.Request {
+	if !sftpOnly {
+		return in
+	}
+
+	out := make(chan *ssh.Request)
+
+	go func() {
+		defer close(out)
+
+		for req := range in {
+			if sftpOnlyAllowsGlobalRequest(req.Type) {
+				select {
+				case out <- req:
+					continue
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			logger.WithField("request_type", req.Type).
+				Info("Refusing global request, the devbox only allows SFTP")
+
+			if req.WantReply {
+				_ = req.Reply(false, nil)
+			}
+		}
+	}()
+
+	return out
+}
+
+// restrictRequests rejects the session requests SFTP only connections may not
+// send, returning the others until ctx is done. A rejected request is explained
+// on the stderr of the channel, which is then closed. Without the restriction the
+// requests are returned as is.
+func restrictRequests(
+	ctx context.Context,
+	in <-chan *ssh.Request,
+	channel ssh.Channel,
+	sftpOnly bool,
+	logger *log.Entry,
+) <-chan *ssh.Request {
+	if !sftpOnly {
+		return in
+	}
+
+	out := make(chan *ssh.Request)
+
+	go func() {
+		defer close(out)
+
+		for req := range in {
+			if sftpOnlyAllowsRequest(req) {
+				select {
+				case out <- req:
+					continue
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			logger.WithField("request_type", req.Type).
+				Info("Rejecting request, the devbox only allows SFTP")
+
+			_, _ = fmt.Fprintf(channel.Stderr(), "%s\r\n", clientMessages[msgSFTPOnly])
+
+			if req.WantReply {
+				_ = req.Reply(false, nil)
+			}
+
+			_ = channel.Close()
+		}
+	}()
+
+	return out
+}
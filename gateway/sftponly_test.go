@@ -0,0 +1,233 @@
+package gateway_test
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// sftpOnlyRequests are the session requests of the SFTP only tests and whether
+// the restriction lets them through
+var sftpOnlyRequests = []struct {
+	name    string
+	reqType string
+	payload []byte
+	allowed bool
+}{
+	{
+		name:    "shell",
+		reqType: "shell",
+	},
+	{
+		name:    "exec",
+		reqType: "exec",
+		payload: ssh.Marshal(struct{ Command string }{"exit 0"}),
+	},
+	{
+		name:    "x11-req",
+		reqType: "x11-req",
+		payload: ssh.Marshal(struct {
+			SingleConnection bool
+			AuthProtocol     string
+			AuthCookie       string
+			ScreenNumber     uint32
+		}{false, "MIT-MAGIC-COOKIE-1", "00", 0}),
+	},
+	{
+		name:    "subsystem sftp",
+		reqType: "subsystem",
+		payload: ssh.Marshal(struct{ Name string }{"sftp"}),
+		allowed: true,
+	},
+	{
+		name:    "subsystem other",
+		reqType: "subsystem",
+		payload: ssh.Marshal(struct{ Name string }{"netconf"}),
+	},
+	{
+		name:    "pty-req",
+		reqType: "pty-req",
+		payload: ssh.Marshal(struct {
+			Term          string
+			Columns, Rows uint32
+			Width, Height uint32
+			Modes         string
+		}{"xterm", 80, 24, 0, 0, ""}),
+		allowed: true,
+	},
+}
+
+// sendSessionRequest sends a request on a new session after setup, returning
+// whether it was accepted and, when rejected, what the session wrote to stderr
+func sendSessionRequest(
+	t *testing.T,
+	client *ssh.Client,
+	setup func(*ssh.Session) error,
+	reqType string,
+	payload []byte,
+) (bool, string) {
+	t.Helper()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer session.Close()
+
+	stderr, err := session.StderrPipe()
+	if err != nil {
+		t.Fatalf("Failed to open stderr: %v", err)
+	}
+
+	if setup != nil {
+		if err := setup(session); err != nil {
+			t.Fatalf("Failed to set up session: %v", err)
+		}
+	}
+
+	ok, err := session.SendRequest(reqType, true, payload)
+	if err != nil {
+		t.Fatalf("Failed to send %s request: %v", reqType, err)
+	}
+
+	if ok {
+		return true, ""
+	}
+
+	// The rejected session is closed after the message
+	message, err := io.ReadAll(stderr)
+	if err != nil {
+		t.Fatalf("Failed to read stderr: %v", err)
+	}
+
+	return false, string(message)
+}
+
+// checkSFTPOnlyRequests checks every request of sftpOnlyRequests on a new session
+func checkSFTPOnlyRequests(t *testing.T, client *ssh.Client, setup func(*ssh.Session) error) {
+	t.Helper()
+
+	for _, tt := range sftpOnlyRequests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, message := sendSessionRequest(t, client, setup, tt.reqType, tt.payload)
+			if ok != tt.allowed {
+				t.Fatalf("%s request accepted = %v, want %v", tt.name, ok, tt.allowed)
+			}
+
+			if !ok && !strings.Contains(message, "only allows SFTP") {
+				t.Errorf("Rejection message = %q, want an SFTP only explanation", message)
+			}
+		})
+	}
+}
+
+// checkSFTPOnlyChannels checks forwarding channels are rejected
+func checkSFTPOnlyChannels(t *testing.T, client *ssh.Client) {
+	t.Helper()
+
+	tests := []struct {
+		channelType string
+		extraData   []byte
+	}{
+		{
+			channelType: "direct-tcpip",
+			extraData: ssh.Marshal(struct {
+				Host       string
+				Port       uint32
+				OriginHost string
+				OriginPort uint32
+			}{"127.0.0.1", 22, "127.0.0.1", 40000}),
+		},
+		{
+			channelType: "direct-streamlocal@openssh.com",
+			extraData: ssh.Marshal(struct {
+				Path      string
+				Reserved0 string
+				Reserved1 uint32
+			}{"/tmp/socket", "", 0}),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.channelType, func(t *testing.T) {
+			channel, _, err := client.OpenChannel(tt.channelType, tt.extraData)
+			if err == nil {
+				channel.Close()
+				t.Fatalf("%s channel opened on an SFTP only connection", tt.channelType)
+			}
+
+			var openErr *ssh.OpenChannelError
+			if !errors.As(err, &openErr) || openErr.Reason != ssh.Prohibited {
+				t.Errorf("Open %s = %v, want prohibited", tt.channelType, err)
+			}
+		})
+	}
+}
+
+func TestSFTPOnly_PublicKeyMode(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t, gateway.WithSFTPOnly(true))
+
+	client := dialPublicKeyMode(t, addr, env)
+
+	checkSFTPOnlyRequests(t, client, nil)
+	checkSFTPOnlyChannels(t, client)
+
+	ok, _, err := client.SendRequest("tcpip-forward", true, ssh.Marshal(struct {
+		Addr string
+		Port uint32
+	}{"127.0.0.1", 0}))
+	if err != nil || ok {
+		t.Errorf("tcpip-forward = %v, %v, want refusal", ok, err)
+	}
+}
+
+func TestSFTPOnly_AgentForwardMode(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t, gateway.WithSFTPOnly(true))
+
+	client := dialAgentForwardMode(t, addr, env)
+	defer client.Close()
+
+	checkSFTPOnlyRequests(t, client, func(s *ssh.Session) error {
+		return agent.RequestAgentForwarding(s)
+	})
+	checkSFTPOnlyChannels(t, client)
+}
+
+func TestSFTPOnly_PodAnnotationOverridesDefault(t *testing.T) {
+	tests := []struct {
+		name       string
+		sftpOnly   bool
+		annotation string
+		allowed    bool
+	}{
+		{name: "annotation lifts default", sftpOnly: true, annotation: "false", allowed: true},
+		{name: "annotation restricts", sftpOnly: false, annotation: "true", allowed: false},
+		{name: "invalid annotation keeps default", sftpOnly: true, annotation: "maybe"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newBackendTestEnv(t)
+			addr := env.start(t, gateway.WithSFTPOnly(tt.sftpOnly))
+
+			setPodAnnotations(t, env.reg, map[string]string{
+				registry.SFTPOnlyAnnotation: tt.annotation,
+			})
+
+			client := dialPublicKeyMode(t, addr, env)
+
+			ok, _ := sendSessionRequest(t, client, nil, "shell", nil)
+			if ok != tt.allowed {
+				t.Errorf("Shell accepted = %v, want %v", ok, tt.allowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// keepAliveConfig returns the TCP keepalive settings of client and backend sockets
+func (g *Gateway) keepAliveConfig() net.KeepAliveConfig {
+	period := g.opts().TCPKeepAlivePeriod
+
+	return net.KeepAliveConfig{
+		Enable:   period >= 0,
+		Idle:     period,
+		Interval: period,
+	}
+}
+
+// tuneConn applies the TCP socket options to conn, other connections are left as is
+func (g *Gateway) tuneConn(conn net.Conn) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+
+	_ = tcpConn.SetKeepAliveConfig(g.keepAliveConfig())
+	_ = tcpConn.SetNoDelay(g.opts().TCPNoDelay)
+}
+
+// DialBackend dials a devbox address with the gateway's TCP socket options.
+// It is exported for testing.
+func (g *Gateway) DialBackend(
+	ctx context.Context,
+	addr string,
+	timeout time.Duration,
+) (net.Conn, error) {
+	return g.dialBackend(ctx, "tcp", addr, timeout)
+}
+
+func (g *Gateway) dialBackend(
+	ctx context.Context,
+	network, addr string,
+	timeout time.Duration,
+) (net.Conn, error) {
+	d := net.Dialer{
+		Timeout:         timeout,
+		KeepAliveConfig: g.keepAliveConfig(),
+	}
+
+	if proxyAddr, ok := g.clusterProxy(ctx); ok {
+		return dialClusterProxy(ctx, &d, proxyAddr, network, addr)
+	}
+
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	g.tuneConn(conn)
+
+	return conn, nil
+}
+
+// BackendDialer connects to the SSH server of a devbox
+type BackendDialer interface {
+	// DialSSH connects to addr like ssh.Dial, abandoning the handshake once ctx is done
+	DialSSH(
+		ctx context.Context,
+		network, addr string,
+		config *ssh.ClientConfig,
+	) (*ssh.Client, error)
+}
+
+// socketDialer is the default BackendDialer, it dials sockets with the
+// gateway's TCP socket options
+type socketDialer struct {
+	g *Gateway
+}
+
+func (d socketDialer) DialSSH(
+	ctx context.Context,
+	network, addr string,
+	config *ssh.ClientConfig,
+) (*ssh.Client, error) {
+	conn, err := d.g.dialBackend(ctx, network, addr, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// The socket is closed as soon as the client gives up, aborting the handshake
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+
+	if !stop() && err == nil {
+		// The client gave up as the handshake completed
+		_ = c.Close()
+		return nil, ctx.Err()
+	}
+
+	if err != nil {
+		_ = conn.Close()
+
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("%w: %w", ctx.Err(), err)
+		}
+
+		return nil, err
+	}
+
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// dialBackendSSH connects to the SSH server of a devbox through the backend dialer
+func (g *Gateway) dialBackendSSH(
+	ctx context.Context,
+	addr string,
+	config *ssh.ClientConfig,
+) (*ssh.Client, error) {
+	return g.backendDialer.DialSSH(ctx, "tcp", addr, config)
+}
@@ -0,0 +1,180 @@
+package gateway_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/sys/unix"
+)
+
+type socketOptions struct {
+	keepAlive     int
+	keepAliveIdle int
+	noDelay       int
+}
+
+func readSocketOptions(t *testing.T, conn net.Conn) socketOptions {
+	t.Helper()
+
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		t.Fatalf("Connection is %T, want *net.TCPConn", conn)
+	}
+
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn() failed: %v", err)
+	}
+
+	var (
+		opts    socketOptions
+		sockErr error
+	)
+
+	err = raw.Control(func(fd uintptr) {
+		get := func(level, opt int) int {
+			v, err := unix.GetsockoptInt(int(fd), level, opt)
+			if err != nil && sockErr == nil {
+				sockErr = err
+			}
+
+			return v
+		}
+
+		opts.keepAlive = get(unix.SOL_SOCKET, unix.SO_KEEPALIVE)
+		opts.keepAliveIdle = get(unix.IPPROTO_TCP, unix.TCP_KEEPIDLE)
+		opts.noDelay = get(unix.IPPROTO_TCP, unix.TCP_NODELAY)
+	})
+	if err == nil {
+		err = sockErr
+	}
+
+	if err != nil {
+		t.Fatalf("Failed to read socket options: %v", err)
+	}
+
+	return opts
+}
+
+// newSocketTestListener returns a local listener accepting and holding connections
+func newSocketTestListener(t *testing.T) (string, <-chan net.Conn) {
+	t.Helper()
+
+	var lc net.ListenConfig
+
+	ln, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	t.Cleanup(func() { ln.Close() })
+
+	conns := make(chan net.Conn, 1)
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+
+		t.Cleanup(func() { conn.Close() })
+		conns <- conn
+	}()
+
+	return ln.Addr().String(), conns
+}
+
+func TestDialBackend_AppliesSocketOptions(t *testing.T) {
+	hostKey, _, _, _ := generateTestKeys(t)
+
+	tests := []struct {
+		name string
+		opts []gateway.Option
+		want socketOptions
+	}{
+		{"defaults", nil, socketOptions{keepAlive: 1, keepAliveIdle: 30, noDelay: 1}},
+		{
+			"tuned",
+			[]gateway.Option{
+				gateway.WithTCPKeepAlive(42 * time.Second),
+				gateway.WithTCPNoDelay(false),
+			},
+			socketOptions{keepAlive: 1, keepAliveIdle: 42, noDelay: 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gw := gateway.New(hostKey, registry.New(), tt.opts...)
+			addr, _ := newSocketTestListener(t)
+
+			conn, err := gw.DialBackend(context.Background(), addr, time.Second)
+			if err != nil {
+				t.Fatalf("DialBackend() failed: %v", err)
+			}
+			defer conn.Close()
+
+			if got := readSocketOptions(t, conn); got != tt.want {
+				t.Errorf("Socket options = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDialBackend_KeepAliveDisabled(t *testing.T) {
+	hostKey, _, _, _ := generateTestKeys(t)
+	gw := gateway.New(hostKey, registry.New(), gateway.WithTCPKeepAlive(-1))
+	addr, _ := newSocketTestListener(t)
+
+	conn, err := gw.DialBackend(context.Background(), addr, time.Second)
+	if err != nil {
+		t.Fatalf("DialBackend() failed: %v", err)
+	}
+	defer conn.Close()
+
+	if got := readSocketOptions(t, conn); got.keepAlive != 0 {
+		t.Errorf("SO_KEEPALIVE = %d, want 0", got.keepAlive)
+	}
+}
+
+func TestHandleConnection_AppliesSocketOptions(t *testing.T) {
+	hostKey, _, _, _ := generateTestKeys(t)
+	gw := gateway.New(hostKey, registry.New(),
+		gateway.WithTCPKeepAlive(42*time.Second),
+		gateway.WithTCPNoDelay(false),
+		gateway.WithSSHHandshakeTimeout(time.Second),
+	)
+
+	addr, conns := newSocketTestListener(t)
+
+	var d net.Dialer
+
+	client, err := d.DialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer client.Close()
+
+	serverConn := <-conns
+	go gw.HandleConnection(serverConn)
+
+	want := socketOptions{keepAlive: 1, keepAliveIdle: 42, noDelay: 0}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		got := readSocketOptions(t, serverConn)
+		if got == want {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Socket options = %+v, want %+v", got, want)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
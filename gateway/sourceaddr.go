@@ -0,0 +1,86 @@
+package gateway
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+)
+
+// allowSourceAddress checks the client address is within the networks the devbox
+// allows connections from, set with registry.AllowedCIDRsAnnotation. Clients
+// without an IP address, over Unix sockets, are outside of any network.
+func (g *Gateway) allowSourceAddress(
+	conn ssh.ConnMetadata,
+	info *registry.DevboxInfo,
+	authLogger *log.Entry,
+) error {
+	logger := authLogger.WithFields(log.Fields{
+		"namespace": info.Namespace,
+		"devbox":    info.DevboxName,
+	})
+
+	if info.AllowedCIDRsInvalid {
+		if g.opts().AllowedCIDRsFailOpen {
+			logger.Warn("Invalid allowed CIDRs annotation, allowing any client address")
+			return nil
+		}
+
+		logger.Warn("Invalid allowed CIDRs annotation, refusing every client address")
+
+		return fmt.Errorf(
+			"%w: invalid allowed CIDRs of %s/%s",
+			ErrSourceNotAllowed,
+			info.Namespace,
+			info.DevboxName,
+		)
+	}
+
+	if len(info.AllowedCIDRs) == 0 {
+		return nil
+	}
+
+	addr, ok := clientIP(conn.RemoteAddr())
+	if ok && slices.ContainsFunc(info.AllowedCIDRs, func(prefix netip.Prefix) bool {
+		return prefix.Contains(addr)
+	}) {
+		return nil
+	}
+
+	logger.WithField("allowed_cidrs", info.AllowedCIDRs).
+		Warn("Client address outside the allowed CIDRs")
+
+	return fmt.Errorf(
+		"%w: %s outside the allowed CIDRs of %s/%s",
+		ErrSourceNotAllowed,
+		remoteAddr(conn.RemoteAddr()),
+		info.Namespace,
+		info.DevboxName,
+	)
+}
+
+// clientIP returns the IP address of a client, IPv4-mapped IPv6 addresses as
+// IPv4. Addresses without an IP, such as Unix socket peers, return false.
+func clientIP(addr net.Addr) (netip.Addr, bool) {
+	var ip netip.Addr
+
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip, _ = netip.AddrFromSlice(addr.IP)
+	case nil:
+		return netip.Addr{}, false
+	default:
+		addrPort, err := netip.ParseAddrPort(addr.String())
+		if err != nil {
+			return netip.Addr{}, false
+		}
+
+		ip = addrPort.Addr()
+	}
+
+	return ip.Unmap(), ip.IsValid()
+}
@@ -0,0 +1,115 @@
+package gateway_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestAllowedCIDRs_Boundaries(t *testing.T) {
+	env := newBackendTestEnv(t)
+	setPodAnnotations(t, env.reg, map[string]string{
+		registry.AllowedCIDRsAnnotation: "10.0.0.0/8, 2001:db8::/32",
+	})
+
+	signer, err := ssh.ParsePrivateKey(env.privBytes)
+	if err != nil {
+		t.Fatalf("Failed to parse private key: %v", err)
+	}
+
+	callback := gateway.NewPublicKeyCallback(env.reg)
+
+	tests := []struct {
+		name    string
+		addr    net.Addr
+		allowed bool
+	}{
+		{name: "first IPv4", addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.0")}, allowed: true},
+		{name: "last IPv4", addr: &net.TCPAddr{IP: net.ParseIP("10.255.255.255")}, allowed: true},
+		{name: "before IPv4", addr: &net.TCPAddr{IP: net.ParseIP("9.255.255.255")}},
+		{name: "after IPv4", addr: &net.TCPAddr{IP: net.ParseIP("11.0.0.0")}},
+		{
+			name:    "IPv4-mapped",
+			addr:    &net.TCPAddr{IP: net.ParseIP("::ffff:10.1.2.3")},
+			allowed: true,
+		},
+		{name: "first IPv6", addr: &net.TCPAddr{IP: net.ParseIP("2001:db8::")}, allowed: true},
+		{
+			name:    "last IPv6",
+			addr:    &net.TCPAddr{IP: net.ParseIP("2001:db8:ffff:ffff:ffff:ffff:ffff:ffff")},
+			allowed: true,
+		},
+		{
+			name: "before IPv6",
+			addr: &net.TCPAddr{IP: net.ParseIP("2001:db7:ffff:ffff:ffff:ffff:ffff:ffff")},
+		},
+		{name: "after IPv6", addr: &net.TCPAddr{IP: net.ParseIP("2001:db9::")}},
+		{name: "unix socket", addr: &net.UnixAddr{Name: "@", Net: "unix"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := newMockConnMetadata("testuser")
+			conn.remoteAddr = tt.addr
+
+			_, err := callback(conn, signer.PublicKey())
+			if tt.allowed && err != nil {
+				t.Errorf("PublicKeyCallback() error = %v, want allowed", err)
+			}
+
+			if !tt.allowed && !errors.Is(err, gateway.ErrSourceNotAllowed) {
+				t.Errorf("PublicKeyCallback() error = %v, want %v",
+					err, gateway.ErrSourceNotAllowed)
+			}
+		})
+	}
+}
+
+func TestAllowedCIDRs_Dial(t *testing.T) {
+	tests := []struct {
+		name     string
+		cidrs    string
+		failOpen bool
+		allowed  bool
+	}{
+		{name: "inside", cidrs: "127.0.0.0/8", allowed: true},
+		{name: "outside", cidrs: "10.0.0.0/8"},
+		{name: "invalid fails closed", cidrs: "office"},
+		{name: "invalid fails open", cidrs: "office", failOpen: true, allowed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newBackendTestEnv(t)
+			opt, path := newAuditLog(t)
+			addr := env.start(t, opt, gateway.WithAllowedCIDRsFailOpen(tt.failOpen))
+
+			setPodAnnotations(t, env.reg, map[string]string{
+				registry.AllowedCIDRsAnnotation: tt.cidrs,
+			})
+
+			_, err := dialAs(t, addr, env, "testuser", true)
+			if tt.allowed {
+				if err != nil {
+					t.Errorf("Dial failed: %v", err)
+				}
+
+				return
+			}
+
+			if err == nil {
+				t.Fatal("Dial succeeded, want the client address refused")
+			}
+
+			record := waitForAudit(t, path, gateway.AuditEventHandshakeFailed)
+			if record["auth_failure"] != gateway.AuthFailureSourceNotAllowed {
+				t.Errorf("auth_failure = %v, want %s",
+					record["auth_failure"], gateway.AuthFailureSourceNotAllowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,313 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// TokenUsernamePrefix starts a username carrying an authentication token, as in
+// token:<jwt>. Such connections need no client authentication method at all.
+const TokenUsernamePrefix = "token:"
+
+// redactedToken replaces the token of usernames carrying one in logs and records
+const redactedToken = "REDACTED"
+
+const (
+	// jwksFetchTimeout bounds a JWKS fetch, the authentication waiting on it
+	// holds up the handshake
+	jwksFetchTimeout = 10 * time.Second
+	// jwksMaxSize bounds the size of a JWKS document
+	jwksMaxSize = 1 << 20
+	// jwksMinRefetchInterval is how often tokens signed with an unknown key may
+	// trigger a JWKS fetch, for keys rotated in before the cache expired
+	jwksMinRefetchInterval = 30 * time.Second
+)
+
+// tokenAlgorithms are the signature algorithms accepted for tokens, the
+// asymmetric ones issued by OIDC providers
+var tokenAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+// tokenClaims are the claims of a token selecting a devbox
+type tokenClaims struct {
+	jwt.Claims
+
+	Namespace string `json:"namespace"`
+	Devbox    string `json:"devbox"`
+	// User is the backend user, the SSH username when unset
+	User string `json:"user"`
+}
+
+// hasTokenUsername reports whether a username carries an authentication token
+func hasTokenUsername(user string) bool {
+	return strings.HasPrefix(user, TokenUsernamePrefix)
+}
+
+// redactUser returns a username safe to log, without the token it may carry
+func redactUser(user string) string {
+	if hasTokenUsername(user) {
+		return TokenUsernamePrefix + redactedToken
+	}
+
+	return user
+}
+
+// jwksCache caches the keys fetched from a JWKS URL. Keys are fetched again once
+// they are older than maxAge, or when a token is signed by an unknown key. The
+// previous keys are kept when a fetch fails.
+type jwksCache struct {
+	url    string
+	maxAge time.Duration
+	client *http.Client
+	logger *log.Entry
+
+	// mu is held during fetches, concurrent authentications share their result
+	mu      sync.Mutex
+	keys    *jose.JSONWebKeySet
+	fetched time.Time
+	// refetched is when a token signed by an unknown key last fetched the keys,
+	// successfully or not
+	refetched time.Time
+}
+
+func newJWKSCache(url string, maxAge time.Duration, logger *log.Entry) *jwksCache {
+	return &jwksCache{
+		url:    url,
+		maxAge: maxAge,
+		client: &http.Client{Timeout: jwksFetchTimeout},
+		logger: logger.WithField("jwks_url", url),
+	}
+}
+
+// get returns the cached keys, fetching them when missing, expired or lacking
+// the key with ID kid
+func (c *jwksCache) get(
+	ctx context.Context,
+	kid string,
+	now time.Time,
+) (*jose.JSONWebKeySet, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch {
+	case c.keys == nil, now.Sub(c.fetched) >= c.maxAge:
+		// Missing or expired keys are fetched, a failed first fetch is retried
+		// right away as there is nothing to fall back to
+	case len(c.keys.Key(kid)) == 0 && now.Sub(c.refetched) >= jwksMinRefetchInterval:
+		// Unknown keys fetch the keys at most once per interval
+		c.refetched = now
+	default:
+		return c.keys, nil
+	}
+
+	keys, err := c.fetch(ctx)
+	if err != nil {
+		if c.keys == nil {
+			return nil, err
+		}
+
+		c.logger.WithError(err).Warn("Failed to refresh JWKS, using cached keys")
+
+		return c.keys, nil
+	}
+
+	c.keys = keys
+	c.fetched = now
+
+	return keys, nil
+}
+
+func (c *jwksCache) fetch(ctx context.Context) (*jose.JSONWebKeySet, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching JWKS: unexpected status %s", resp.Status)
+	}
+
+	var keys jose.JSONWebKeySet
+	if err := json.NewDecoder(io.LimitReader(resp.Body, jwksMaxSize)).Decode(&keys); err != nil {
+		return nil, fmt.Errorf("decoding JWKS: %w", err)
+	}
+
+	c.logger.WithField("keys", len(keys.Keys)).Debug("JWKS fetched")
+
+	return &keys, nil
+}
+
+// tokenVerifier verifies authentication tokens against the issuer, audience
+// and JWKS URL of the options
+type tokenVerifier struct {
+	issuer   string
+	audience string
+	leeway   time.Duration
+	jwks     *jwksCache
+}
+
+// newTokenVerifier returns nil when token authentication is disabled
+func newTokenVerifier(options *Options, logger *log.Entry) *tokenVerifier {
+	if options.TokenJWKSURL == "" {
+		return nil
+	}
+
+	return &tokenVerifier{
+		issuer:   options.TokenIssuer,
+		audience: options.TokenAudience,
+		leeway:   options.TokenLeeway,
+		jwks:     newJWKSCache(options.TokenJWKSURL, options.TokenJWKSRefresh, logger),
+	}
+}
+
+// verify returns the claims of a valid token. Errors never include the token.
+func (v *tokenVerifier) verify(
+	ctx context.Context,
+	raw string,
+	now time.Time,
+) (*tokenClaims, error) {
+	token, err := jwt.ParseSigned(raw, tokenAlgorithms)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+
+	var kid string
+	if len(token.Headers) > 0 {
+		kid = token.Headers[0].KeyID
+	}
+
+	keys, err := v.jwks.get(ctx, kid, now)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrTokenKeysUnavailable, err)
+	}
+
+	var claims tokenClaims
+	if err := token.Claims(keys, &claims); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+
+	// Tokens are meant to be short-lived
+	if claims.Expiry == nil {
+		return &claims, fmt.Errorf("%w: no expiry", ErrInvalidToken)
+	}
+
+	err = claims.ValidateWithLeeway(jwt.Expected{
+		Issuer:      v.issuer,
+		AnyAudience: jwt.Audience{v.audience},
+		Time:        now,
+	}, v.leeway)
+
+	switch {
+	case errors.Is(err, jwt.ErrExpired):
+		return &claims, fmt.Errorf("%w at %s", ErrTokenExpired, claims.Expiry.Time())
+	case err != nil:
+		return &claims, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+
+	if claims.Namespace == "" || claims.Devbox == "" {
+		return &claims, fmt.Errorf("%w: no namespace or devbox claim", ErrInvalidToken)
+	}
+
+	return &claims, nil
+}
+
+// tokenCallback authenticates the token carried by the username or, failing
+// that, by the password. Tokens select their devbox, reached with its stored
+// private key since the client has none.
+func (g *Gateway) tokenCallback(
+	conn ssh.ConnMetadata,
+	password []byte,
+	state *authState,
+) (*ssh.Permissions, error) {
+	raw, user := string(password), conn.User()
+	if hasTokenUsername(user) {
+		raw, user = strings.TrimPrefix(user, TokenUsernamePrefix), ""
+	}
+
+	authLogger := state.logger.WithFields(log.Fields{
+		"auth_type":   "token",
+		"remote_addr": remoteAddr(conn.RemoteAddr()),
+		"user":        redactUser(conn.User()),
+	})
+
+	authLogger.Debug("authentication attempt")
+
+	claims, err := g.tokenVerifier.verify(context.Background(), raw, time.Now())
+	if claims != nil {
+		// The signature checked out, the claims identify the token
+		state.tokenSubject = claims.Subject
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	claimedUser := claims.User
+	if claimedUser == "" {
+		claimedUser = user
+	}
+
+	if claimedUser == "" {
+		return nil, fmt.Errorf("%w: no user claim", ErrInvalidToken)
+	}
+
+	info, ok := g.registry.GetDevboxInfo(claims.Namespace, claims.Devbox)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s/%s", ErrDevboxNotFound, claims.Namespace, claims.Devbox)
+	}
+
+	backendUser, err := g.backendUser(info, claimedUser, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := g.allowSourceAddress(conn, info, authLogger); err != nil {
+		return nil, err
+	}
+
+	tokenLogger := authLogger.WithFields(log.Fields{
+		"auth_mode":     AuthModeToken.String(),
+		"namespace":     info.Namespace,
+		"devbox":        info.DevboxName,
+		"token_subject": claims.Subject,
+		"token_id":      claims.ID,
+	})
+
+	tokenLogger.WithField("backend_user", backendUser).Info("authentication accept")
+
+	return &ssh.Permissions{
+		Extensions: map[string]string{
+			"username":      claimedUser,
+			"claimed_user":  claimedUser,
+			"backend_user":  backendUser,
+			"auth_mode":     AuthModeToken.String(),
+			"token_subject": claims.Subject,
+		},
+		ExtraData: map[any]any{
+			"devbox_info": info,
+			"logger":      tokenLogger,
+		},
+	}, nil
+}
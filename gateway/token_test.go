@@ -0,0 +1,500 @@
+package gateway_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/zijiren233/sshgate/gateway"
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	testTokenIssuer   = "https://auth.example.com"
+	testTokenAudience = "sshgate"
+)
+
+// tokenIssuer serves a JWKS and signs tokens with its keys
+type tokenIssuer struct {
+	server  *httptest.Server
+	fetches atomic.Int32
+
+	mu   sync.Mutex
+	keys jose.JSONWebKeySet
+	// unavailable makes the JWKS URL fail
+	unavailable bool
+}
+
+func newTokenIssuer(t *testing.T) *tokenIssuer {
+	t.Helper()
+
+	issuer := &tokenIssuer{}
+	issuer.server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, _ *http.Request) {
+			issuer.fetches.Add(1)
+
+			issuer.mu.Lock()
+			defer issuer.mu.Unlock()
+
+			if issuer.unavailable {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+
+			_ = json.NewEncoder(w).Encode(issuer.keys)
+		},
+	))
+	t.Cleanup(issuer.server.Close)
+
+	return issuer
+}
+
+// option enables token authentication with the issuer
+func (i *tokenIssuer) option() gateway.Option {
+	return gateway.WithTokenAuth(testTokenIssuer, testTokenAudience, i.server.URL)
+}
+
+// newKey returns a signing key with ID kid, published in the JWKS when publish
+// is set
+func (i *tokenIssuer) newKey(t *testing.T, kid string, publish bool) jose.Signer {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.ES256, Key: key},
+		(&jose.SignerOptions{}).WithHeader(jose.HeaderKey("kid"), kid),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+
+	if publish {
+		i.mu.Lock()
+		i.keys.Keys = append(i.keys.Keys, jose.JSONWebKey{
+			Key:       key.Public(),
+			KeyID:     kid,
+			Algorithm: string(jose.ES256),
+			Use:       "sig",
+		})
+		i.mu.Unlock()
+	}
+
+	return signer
+}
+
+// testTokenClaims returns the claims of a valid token selecting the test devbox
+func testTokenClaims() map[string]any {
+	return map[string]any{
+		"iss":       testTokenIssuer,
+		"aud":       testTokenAudience,
+		"sub":       "alice",
+		"exp":       time.Now().Add(5 * time.Minute).Unix(),
+		"namespace": "ns-test",
+		"devbox":    "test-devbox",
+	}
+}
+
+// signToken signs claims, with the given ones overriding testTokenClaims
+func signToken(t *testing.T, signer jose.Signer, override map[string]any) string {
+	t.Helper()
+
+	claims := testTokenClaims()
+	for name, value := range override {
+		if value == nil {
+			delete(claims, name)
+			continue
+		}
+
+		claims[name] = value
+	}
+
+	token, err := jwt.Signed(signer).Claims(claims).Serialize()
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+
+	return token
+}
+
+// dialToken dials the gateway as user, with password authentication unless
+// password is empty
+func dialToken(addr, user, password string) (*ssh.Client, error) {
+	var auth []ssh.AuthMethod
+	if password != "" {
+		auth = append(auth, ssh.Password(password))
+	}
+
+	return ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User: user,
+		Auth: auth,
+		//nolint:gosec // acceptable for testing
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+}
+
+// runTokenSession runs a session over a client authenticated with a token
+func runTokenSession(t *testing.T, client *ssh.Client) {
+	t.Helper()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+
+	if err := session.Run("exit 0"); err != nil {
+		t.Errorf("Session failed: %v", err)
+	}
+
+	client.Close()
+}
+
+func TestToken_Password(t *testing.T) {
+	env := newBackendTestEnv(t)
+	issuer := newTokenIssuer(t)
+	signer := issuer.newKey(t, "key-1", true)
+
+	auditOpt, auditPath := newAuditLog(t)
+	addr := env.start(t, issuer.option(), auditOpt)
+
+	client, err := dialToken(addr, "testuser", signToken(t, signer, nil))
+	if err != nil {
+		t.Fatalf("Failed to dial gateway with a token: %v", err)
+	}
+
+	runTokenSession(t, client)
+
+	record := waitForAudit(t, auditPath, gateway.AuditEventConnection)
+	checkAuditSchema(t, record, "channels")
+
+	for field, want := range map[string]string{
+		"user":          "testuser",
+		"auth_mode":     gateway.AuthModeToken.String(),
+		"token_subject": "alice",
+		"devbox":        "test-devbox",
+	} {
+		if got := record[field]; got != want {
+			t.Errorf("%s = %v, want %s", field, got, want)
+		}
+	}
+}
+
+func TestToken_Username(t *testing.T) {
+	env := newBackendTestEnv(t)
+	issuer := newTokenIssuer(t)
+	signer := issuer.newKey(t, "key-1", true)
+
+	auditOpt, auditPath := newAuditLog(t)
+	addr := env.start(t, issuer.option(), auditOpt)
+
+	token := signToken(t, signer, map[string]any{"user": "testuser"})
+
+	// No authentication method at all, the username carries the token
+	client, err := dialToken(addr, gateway.TokenUsernamePrefix+token, "")
+	if err != nil {
+		t.Fatalf("Failed to dial gateway with a token username: %v", err)
+	}
+
+	runTokenSession(t, client)
+
+	record := waitForAudit(t, auditPath, gateway.AuditEventConnection)
+	if got := record["user"]; got != gateway.TokenUsernamePrefix+"REDACTED" {
+		t.Errorf("user = %v, want the token redacted", got)
+	}
+
+	// A token without user claim needs the username to name the backend user
+	token = signToken(t, signer, nil)
+	if _, err := dialToken(addr, gateway.TokenUsernamePrefix+token, ""); err == nil {
+		t.Error("Dial with a token username without user claim succeeded")
+	}
+}
+
+func TestToken_OTP(t *testing.T) {
+	env := newOTPTestEnv(t, map[string][]byte{
+		registry.OTPSecretNamespaceKey("ns-test"): []byte(testOTPSecret),
+	})
+	issuer := newTokenIssuer(t)
+	signer := issuer.newKey(t, "key-1", true)
+
+	auditOpt, auditPath := newAuditLog(t)
+	addr := env.start(t, issuer.option(), auditOpt, gateway.WithOTP([]string{"ns-test"}, false))
+
+	tests := []struct {
+		name     string
+		user     string
+		password string
+	}{
+		{name: "Password", user: "testuser", password: signToken(t, signer, nil)},
+		{
+			name: "Username",
+			user: gateway.TokenUsernamePrefix +
+				signToken(t, signer, map[string]any{"user": "testuser"}),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The token alone is not enough
+			if _, err := dialToken(addr, tt.user, tt.password); err == nil {
+				t.Fatal("Dial with a token and no code succeeded")
+			}
+
+			auth := []ssh.AuthMethod{ssh.KeyboardInteractive(
+				func(_, _ string, questions []string, _ []bool) ([]string, error) {
+					answers := make([]string, len(questions))
+					for i := range answers {
+						answers[i] = totpAt(t, time.Now())
+					}
+
+					return answers, nil
+				},
+			)}
+			if tt.password != "" {
+				auth = append([]ssh.AuthMethod{ssh.Password(tt.password)}, auth...)
+			}
+
+			client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+				User: tt.user,
+				Auth: auth,
+				//nolint:gosec // acceptable for testing
+				HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+				Timeout:         5 * time.Second,
+			})
+			if err != nil {
+				t.Fatalf("Failed to dial gateway with a token and a code: %v", err)
+			}
+
+			runTokenSession(t, client)
+
+			record := waitForAudit(t, auditPath, gateway.AuditEventConnection)
+			if got := record["auth_factors"]; got != "token,otp" {
+				t.Errorf("auth_factors = %v, want token,otp", got)
+			}
+		})
+	}
+}
+
+func TestToken_Rejected(t *testing.T) {
+	tests := []struct {
+		name     string
+		override map[string]any
+		// foreignKey signs the token with a key missing from the JWKS
+		foreignKey bool
+		want       string
+	}{
+		{
+			name:     "expired",
+			override: map[string]any{"exp": time.Now().Add(-5 * time.Minute).Unix()},
+			want:     gateway.AuthFailureTokenExpired,
+		},
+		{
+			name:     "wrong audience",
+			override: map[string]any{"aud": "other"},
+			want:     gateway.AuthFailureBadToken,
+		},
+		{
+			name:     "wrong issuer",
+			override: map[string]any{"iss": "https://other.example.com"},
+			want:     gateway.AuthFailureBadToken,
+		},
+		{
+			name:     "not yet valid",
+			override: map[string]any{"nbf": time.Now().Add(5 * time.Minute).Unix()},
+			want:     gateway.AuthFailureBadToken,
+		},
+		{
+			name:     "no expiry",
+			override: map[string]any{"exp": nil},
+			want:     gateway.AuthFailureBadToken,
+		},
+		{
+			name:     "no devbox",
+			override: map[string]any{"devbox": nil},
+			want:     gateway.AuthFailureBadToken,
+		},
+		{
+			name:       "unknown key",
+			foreignKey: true,
+			want:       gateway.AuthFailureBadToken,
+		},
+		{
+			name:     "unknown devbox",
+			override: map[string]any{"devbox": "other-devbox"},
+			want:     gateway.AuthFailureDevboxNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newBackendTestEnv(t)
+			issuer := newTokenIssuer(t)
+			signer := issuer.newKey(t, "key-1", true)
+
+			if tt.foreignKey {
+				signer = issuer.newKey(t, "key-2", false)
+			}
+
+			addr := env.start(t, issuer.option())
+
+			token := signToken(t, signer, tt.override)
+			if _, err := dialToken(addr, "testuser", token); err == nil {
+				t.Fatal("Dial with a rejected token succeeded")
+			}
+
+			if got := env.gateway.AuthStats().Failures[tt.want]; got != 1 {
+				t.Errorf("%s failures = %d, want 1", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestToken_Leeway(t *testing.T) {
+	expired := map[string]any{"exp": time.Now().Add(-10 * time.Second).Unix()}
+
+	for _, leeway := range []time.Duration{0, 30 * time.Second} {
+		env := newBackendTestEnv(t)
+		issuer := newTokenIssuer(t)
+		signer := issuer.newKey(t, "key-1", true)
+		addr := env.start(t, issuer.option(), gateway.WithTokenLeeway(leeway))
+
+		client, err := dialToken(addr, "testuser", signToken(t, signer, expired))
+		if err == nil {
+			client.Close()
+		}
+
+		if got, want := err == nil, leeway > 0; got != want {
+			t.Errorf("Authenticated = %v (%v) with leeway %s", got, err, leeway)
+		}
+	}
+}
+
+func TestToken_HandshakeAudit(t *testing.T) {
+	env := newBackendTestEnv(t)
+	issuer := newTokenIssuer(t)
+	signer := issuer.newKey(t, "key-1", true)
+
+	auditOpt, auditPath := newAuditLog(t)
+	addr := env.start(t, issuer.option(), auditOpt)
+
+	token := signToken(t, signer, map[string]any{
+		"exp":  time.Now().Add(-5 * time.Minute).Unix(),
+		"user": "testuser",
+	})
+
+	if _, err := dialToken(addr, gateway.TokenUsernamePrefix+token, ""); err == nil {
+		t.Fatal("Dial with an expired token succeeded")
+	}
+
+	record := waitForAudit(t, auditPath, gateway.AuditEventHandshakeFailed)
+	checkAuditSchema(t, record, "channels")
+
+	for field, want := range map[string]string{
+		"user":          gateway.TokenUsernamePrefix + "REDACTED",
+		"auth_failure":  gateway.AuthFailureTokenExpired,
+		"token_subject": "alice",
+	} {
+		if got := record[field]; got != want {
+			t.Errorf("%s = %v, want %s", field, got, want)
+		}
+	}
+
+	data, err := os.ReadFile(auditPath)
+	if err != nil {
+		t.Fatalf("Failed to read audit log: %v", err)
+	}
+
+	if strings.Contains(string(data), token) {
+		t.Error("Audit log contains the raw token")
+	}
+}
+
+func TestToken_JWKSCache(t *testing.T) {
+	env := newBackendTestEnv(t)
+	issuer := newTokenIssuer(t)
+	signer := issuer.newKey(t, "key-1", true)
+	addr := env.start(t, issuer.option())
+
+	for range 2 {
+		client, err := dialToken(addr, "testuser", signToken(t, signer, nil))
+		if err != nil {
+			t.Fatalf("Failed to dial gateway with a token: %v", err)
+		}
+
+		client.Close()
+	}
+
+	if got := issuer.fetches.Load(); got != 1 {
+		t.Errorf("JWKS fetched %d times, want 1", got)
+	}
+
+	// A rotated in key is fetched, and the keys are kept when the JWKS URL fails
+	rotated := issuer.newKey(t, "key-2", true)
+
+	for range 2 {
+		client, err := dialToken(addr, "testuser", signToken(t, rotated, nil))
+		if err != nil {
+			t.Fatalf("Failed to dial gateway with a token of a rotated key: %v", err)
+		}
+
+		client.Close()
+
+		issuer.mu.Lock()
+		issuer.unavailable = true
+		issuer.mu.Unlock()
+	}
+
+	if got := issuer.fetches.Load(); got != 2 {
+		t.Errorf("JWKS fetched %d times, want 2", got)
+	}
+}
+
+func TestToken_KeysUnavailable(t *testing.T) {
+	env := newBackendTestEnv(t)
+	issuer := newTokenIssuer(t)
+	signer := issuer.newKey(t, "key-1", true)
+	issuer.unavailable = true
+
+	addr := env.start(t, issuer.option())
+
+	if _, err := dialToken(addr, "testuser", signToken(t, signer, nil)); err == nil {
+		t.Fatal("Dial without JWKS succeeded")
+	}
+
+	failures := env.gateway.AuthStats().Failures[gateway.AuthFailureTokenKeys]
+	if failures != 1 {
+		t.Errorf("token_keys_unavailable failures = %d, want 1", failures)
+	}
+}
+
+func TestToken_Disabled(t *testing.T) {
+	env := newBackendTestEnv(t)
+	issuer := newTokenIssuer(t)
+	signer := issuer.newKey(t, "key-1", true)
+	addr := env.start(t)
+
+	token := signToken(t, signer, map[string]any{"user": "testuser"})
+
+	if _, err := dialToken(addr, gateway.TokenUsernamePrefix+token, ""); err == nil {
+		t.Error("Dial with a token username succeeded with token authentication disabled")
+	}
+
+	if _, err := dialToken(addr, "testuser", token); err == nil {
+		t.Error("Dial with a token password succeeded with token authentication disabled")
+	}
+}
@@ -0,0 +1,193 @@
+package gateway
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zijiren233/sshgate/registry"
+)
+
+// TrafficStats counts the bytes moved, from the point of view of the client:
+// BytesIn were sent by the client, BytesOut were sent to it
+type TrafficStats struct {
+	BytesIn  uint64
+	BytesOut uint64
+}
+
+// trafficCounter accumulates bytes and rolls them up into its parent, so channel
+// counts add up to their connection's and connections' to their devbox's
+type trafficCounter struct {
+	in     atomic.Uint64
+	out    atomic.Uint64
+	parent *trafficCounter
+}
+
+func (c *trafficCounter) child() *trafficCounter {
+	return &trafficCounter{parent: c}
+}
+
+func (c *trafficCounter) addIn(n uint64) {
+	for ; c != nil; c = c.parent {
+		c.in.Add(n)
+	}
+}
+
+func (c *trafficCounter) addOut(n uint64) {
+	for ; c != nil; c = c.parent {
+		c.out.Add(n)
+	}
+}
+
+func (c *trafficCounter) stats() TrafficStats {
+	return TrafficStats{BytesIn: c.in.Load(), BytesOut: c.out.Load()}
+}
+
+// devboxTraffic holds the running traffic totals per devbox
+type devboxTraffic struct {
+	mu sync.Mutex
+	// namespace/devboxName -> counter
+	counters map[string]*trafficCounter
+}
+
+func newDevboxTraffic() *devboxTraffic {
+	return &devboxTraffic{counters: make(map[string]*trafficCounter)}
+}
+
+func (t *devboxTraffic) counter(namespace, devboxName string) *trafficCounter {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := namespace + "/" + devboxName
+
+	counter, ok := t.counters[key]
+	if !ok {
+		counter = &trafficCounter{}
+		t.counters[key] = counter
+	}
+
+	return counter
+}
+
+// handleRegistryEvent forgets the totals of deleted devboxes
+func (t *devboxTraffic) handleRegistryEvent(event registry.Event) {
+	if event.Type != registry.EventSecretDeleted {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.counters, event.Namespace+"/"+event.DevboxName)
+}
+
+// DevboxTraffic returns the running traffic totals of a devbox
+func (g *Gateway) DevboxTraffic(namespace, devboxName string) TrafficStats {
+	return g.traffic.counter(namespace, devboxName).stats()
+}
+
+// connIO identifies, shapes and accounts the data moved by a client connection
+type connIO struct {
+	// id is the connection ID, or the session ID of a channel
+	id string
+	// connID is the connection ID
+	connID string
+	// clientAddr is the address of the client
+	clientAddr string
+	// limiter is shared by every channel of the connection, nil if unlimited
+	limiter *bandwidthLimiter
+	traffic *trafficCounter
+	start   time.Time
+	// channels numbers the channels of the connection
+	channels *atomic.Uint64
+	// live is the connection, tracking its sessions
+	live *liveConn
+	// recording is the metadata of session recordings, nil if not recorded
+	recording *RecordingMetadata
+	// audit is the audit record of the connection, nil if not audited
+	audit *connAudit
+	// forceCommand replaces the commands requested by sessions, if set
+	forceCommand string
+	// sftpOnly restricts sessions to SFTP
+	sftpOnly bool
+	// motd is written to PTY shell sessions, empty for none
+	motd string
+}
+
+func (g *Gateway) newConnIO(connID string, info *registry.DevboxInfo, live *liveConn) *connIO {
+	return &connIO{
+		id:       connID,
+		connID:   connID,
+		live:     live,
+		limiter:  g.newBandwidthLimiter(info.Namespace),
+		traffic:  g.traffic.counter(info.Namespace, info.DevboxName).child(),
+		start:    time.Now(),
+		channels: &atomic.Uint64{},
+	}
+}
+
+// channel returns the connIO of a new channel, whose traffic rolls up into the
+// connection's. Its session ID extends the connection ID, so both are found
+// grepping the connection ID.
+func (c *connIO) channel() *connIO {
+	return &connIO{
+		id:        fmt.Sprintf("%s-%d", c.id, c.channels.Add(1)),
+		connID:    c.connID,
+		limiter:   c.limiter,
+		traffic:   c.traffic.child(),
+		start:     time.Now(),
+		channels:  c.channels,
+		live:      c.live,
+		recording: c.recording,
+		audit:     c.audit,
+
+		clientAddr:   c.clientAddr,
+		forceCommand: c.forceCommand,
+		sftpOnly:     c.sftpOnly,
+		motd:         c.motd,
+	}
+}
+
+// upstream wraps the client side of a copy to the backend
+func (c *connIO) upstream(r io.Reader) io.Reader {
+	return &countingReader{r: c.limiter.reader(r), add: c.traffic.addIn}
+}
+
+// downstream wraps the backend side of a copy to the client
+func (c *connIO) downstream(r io.Reader) io.Reader {
+	return &countingReader{r: c.limiter.reader(r), add: c.traffic.addOut}
+}
+
+// fields returns the traffic totals and bandwidth rates for log records
+func (c *connIO) fields() log.Fields {
+	stats := c.traffic.stats()
+	fields := log.Fields{
+		"bytes_in":  stats.BytesIn,
+		"bytes_out": stats.BytesOut,
+	}
+
+	if c.limiter != nil {
+		elapsed := time.Since(c.start).Seconds()
+		fields["bandwidth_limit_bps"] = c.limiter.limit
+		fields["bandwidth_observed_bps"] = int64(float64(stats.BytesIn+stats.BytesOut) / elapsed)
+	}
+
+	return fields
+}
+
+type countingReader struct {
+	r   io.Reader
+	add func(uint64)
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.add(uint64(n))
+	}
+
+	return n, err
+}
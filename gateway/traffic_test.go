@@ -0,0 +1,96 @@
+package gateway_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"golang.org/x/crypto/ssh"
+)
+
+// echoPayload sends payload through the mock backend's echo command and
+// checks that it comes back unchanged
+func echoPayload(t *testing.T, client *ssh.Client, payload []byte) {
+	t.Helper()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer session.Close()
+
+	var out bytes.Buffer
+
+	session.Stdin = bytes.NewReader(payload)
+	session.Stdout = &out
+
+	if err := session.Run("echo"); err != nil {
+		t.Fatalf("Echo failed: %v", err)
+	}
+
+	if !bytes.Equal(out.Bytes(), payload) {
+		t.Fatalf("Echo returned %d bytes, want %d", out.Len(), len(payload))
+	}
+}
+
+func TestTraffic_CountsChannelBytes(t *testing.T) {
+	const size = 256 << 10
+
+	env := newBackendTestEnv(t)
+	addr := env.start(t)
+
+	signer, err := ssh.ParsePrivateKey(env.privBytes)
+	if err != nil {
+		t.Fatalf("Failed to parse private key: %v", err)
+	}
+
+	dial := func() *ssh.Client {
+		client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+			User: "testuser",
+			Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			//nolint:gosec // acceptable for testing
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		})
+		if err != nil {
+			t.Fatalf("Failed to dial gateway: %v", err)
+		}
+
+		return client
+	}
+
+	payload := bytes.Repeat([]byte("sshgate"), size/7)
+
+	first := dial()
+	defer first.Close()
+
+	echoPayload(t, first, payload)
+	echoPayload(t, first, payload[:1024])
+
+	want := gateway.TrafficStats{
+		BytesIn:  uint64(len(payload) + 1024),
+		BytesOut: uint64(len(payload) + 1024),
+	}
+	if got := env.gateway.DevboxTraffic("ns-test", "test-devbox"); got != want {
+		t.Errorf("DevboxTraffic() = %+v, want %+v", got, want)
+	}
+
+	// Connections to the same devbox roll up into its totals
+	second := dial()
+	defer second.Close()
+
+	echoPayload(t, second, payload)
+
+	want.BytesIn += uint64(len(payload))
+	want.BytesOut += uint64(len(payload))
+
+	if got := env.gateway.DevboxTraffic("ns-test", "test-devbox"); got != want {
+		t.Errorf("DevboxTraffic() = %+v, want %+v", got, want)
+	}
+
+	idle := env.gateway.DevboxTraffic("ns-test", "other-devbox")
+	if idle != (gateway.TrafficStats{}) {
+		t.Errorf("DevboxTraffic() of an idle devbox = %+v, want zero", idle)
+	}
+}
@@ -0,0 +1,431 @@
+package gateway_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// runExecBackendServer runs a backend whose sessions run their commands with
+// the local shell, standing in for the sshd of devboxes to real clients like scp
+// and rsync
+func runExecBackendServer(
+	t testing.TB,
+	listener net.Listener,
+	hostKey ssh.Signer,
+	authorizedKey []byte,
+) {
+	t.Helper()
+
+	config := mockBackendConfig(t, hostKey, authorizedKey)
+	if config == nil {
+		return
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go handleExecBackendConnection(conn, config)
+	}
+}
+
+func handleExecBackendConnection(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+
+		go serveExecSession(channel, requests)
+	}
+}
+
+// serveExecSession runs the command of an exec request like sshd does: output
+// is sent in full, then the exit status, then the channel is closed
+func serveExecSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	for req := range requests {
+		if req.Type != "exec" {
+			if req.WantReply {
+				_ = req.Reply(req.Type == "env", nil)
+			}
+
+			continue
+		}
+
+		var exec struct{ Command string }
+		if err := ssh.Unmarshal(req.Payload, &exec); err != nil {
+			_ = req.Reply(false, nil)
+			return
+		}
+
+		if req.WantReply {
+			_ = req.Reply(true, nil)
+		}
+
+		go ssh.DiscardRequests(requests)
+
+		status := runExecCommand(channel, exec.Command)
+
+		payload := make([]byte, 4)
+		binary.BigEndian.PutUint32(payload, status)
+		_, _ = channel.SendRequest("exit-status", false, payload)
+		_ = channel.CloseWrite()
+
+		return
+	}
+}
+
+// runExecCommand runs command with the shell on the streams of channel,
+// returning its exit status
+func runExecCommand(channel ssh.Channel, command string) uint32 {
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Stdout = channel
+	cmd.Stderr = channel.Stderr()
+
+	// Copied apart from the command, Wait would wait for the client to end stdin
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return 255
+	}
+
+	if err := cmd.Start(); err != nil {
+		return 127
+	}
+
+	go func() {
+		_, _ = io.Copy(stdin, channel)
+		_ = stdin.Close()
+	}()
+
+	if err := cmd.Wait(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() >= 0 {
+			//nolint:gosec // exit codes are 0-255
+			return uint32(exitErr.ExitCode())
+		}
+
+		return 255
+	}
+
+	return 0
+}
+
+// transferClient runs the OpenSSH clients, scp and rsync, against a gateway
+type transferClient struct {
+	port string
+	// sshOptions are the options of every ssh run, selecting the mode
+	sshOptions []string
+	env        []string
+	agentMode  bool
+}
+
+// newTransferClient sets up OpenSSH clients in public key mode or, with agent,
+// in agent forwarding mode, skipping the test if they are not installed
+func newTransferClient(
+	t *testing.T,
+	addr string,
+	env *backendTestEnv,
+	agentMode bool,
+) *transferClient {
+	t.Helper()
+
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("ssh is not installed")
+	}
+
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "id")
+	user := "testuser"
+
+	client := &transferClient{env: os.Environ(), agentMode: agentMode}
+
+	if agentMode {
+		// The client authenticates with a key of its own, the devbox key is
+		// only forwarded in the agent
+		_, _, _, userKey := generateTestKeys(t)
+		writeFile(t, keyFile, userKey)
+
+		client.env = append(client.env, "SSH_AUTH_SOCK="+serveTestAgent(t, env.privBytes))
+		user = "testuser@test-test-devbox"
+	} else {
+		writeFile(t, keyFile, env.privBytes)
+	}
+
+	_, client.port, _ = net.SplitHostPort(addr)
+	client.sshOptions = []string{
+		"-F", "/dev/null",
+		"-i", keyFile,
+		"-o", "User=" + user,
+		"-o", "IdentitiesOnly=yes",
+		"-o", "BatchMode=yes",
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "LogLevel=ERROR",
+	}
+
+	if agentMode {
+		client.sshOptions = append(client.sshOptions, "-o", "ForwardAgent=yes")
+	}
+
+	return client
+}
+
+// writeFile writes a private file, as ssh requires of keys
+func writeFile(t *testing.T, name string, data []byte) {
+	t.Helper()
+
+	if err := os.WriteFile(name, data, 0o600); err != nil {
+		t.Fatalf("Failed to write %s: %v", name, err)
+	}
+}
+
+// serveTestAgent serves an agent holding privBytes, returning its socket path
+func serveTestAgent(t *testing.T, privBytes []byte) string {
+	t.Helper()
+
+	key, err := ssh.ParseRawPrivateKey(privBytes)
+	if err != nil {
+		t.Fatalf("Failed to parse private key: %v", err)
+	}
+
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		t.Fatalf("Failed to add key to keyring: %v", err)
+	}
+
+	// Socket paths are short, test temporary directories may not be
+	dir, err := os.MkdirTemp("", "agent")
+	if err != nil {
+		t.Fatalf("Failed to create agent directory: %v", err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	var lc net.ListenConfig
+
+	listener, err := lc.Listen(t.Context(), "unix", filepath.Join(dir, "sock"))
+	if err != nil {
+		t.Fatalf("Failed to listen for agent: %v", err)
+	}
+
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				_ = agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+// run runs an OpenSSH client, returning its combined output and exit code
+func (c *transferClient) run(t *testing.T, name string, args ...string) (string, int) {
+	t.Helper()
+
+	cmd := exec.CommandContext(t.Context(), name, args...)
+	cmd.Env = c.env
+
+	output, err := cmd.CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return string(output), exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatalf("Failed to run %s: %v", name, err)
+	}
+
+	return string(output), 0
+}
+
+// scp runs scp with the legacy protocol, which execs scp on the devbox
+func (c *transferClient) scp(t *testing.T, args ...string) (string, int) {
+	t.Helper()
+
+	scpArgs := append([]string{"-O", "-q", "-P", c.port}, c.sshOptions...)
+	// scp never forwards the agent unless asked to
+	if c.agentMode {
+		scpArgs = append(scpArgs, "-A")
+	}
+
+	return c.run(t, "scp", append(scpArgs, args...)...)
+}
+
+// rsync runs rsync over ssh, which execs a long rsync --server command line on
+// the devbox
+func (c *transferClient) rsync(t *testing.T, args ...string) (string, int) {
+	t.Helper()
+
+	sshCommand := "ssh -p " + c.port
+	for _, option := range c.sshOptions {
+		sshCommand += " " + strconv.Quote(option)
+	}
+
+	return c.run(t, "rsync", append([]string{"-a", "-e", sshCommand}, args...)...)
+}
+
+// remotePath names a path of the devbox, quoted for its shell as the legacy scp
+// protocol and rsync pass it on the command line
+func remotePath(path string) string {
+	return "127.0.0.1:'" + path + "'"
+}
+
+// writeRandomFile writes size random bytes to name
+func writeRandomFile(t *testing.T, name string, size int) []byte {
+	t.Helper()
+
+	data := make([]byte, size)
+	_, _ = rand.Read(data)
+	writeFile(t, name, data)
+
+	return data
+}
+
+// checkSameFile checks name holds want, bit for bit
+func checkSameFile(t *testing.T, name string, want []byte) {
+	t.Helper()
+
+	got, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", name, err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Fatalf("%s differs: %d bytes, want %d", name, len(got), len(want))
+	}
+}
+
+var transferModes = []struct {
+	name      string
+	agentMode bool
+}{
+	{name: "public key"},
+	{name: "agent forwarding", agentMode: true},
+}
+
+func TestTransfer_SCP(t *testing.T) {
+	if _, err := exec.LookPath("scp"); err != nil {
+		t.Skip("scp is not installed")
+	}
+
+	for _, mode := range transferModes {
+		t.Run(mode.name, func(t *testing.T) {
+			env := newBackendTestEnv(t)
+			env.execBackend = true
+			addr := env.start(t)
+
+			client := newTransferClient(t, addr, env, mode.agentMode)
+
+			local := t.TempDir()
+			// Spaces need quoting on the remote command line, see remotePath
+			remote := filepath.Join(t.TempDir(), "remote dir")
+			if err := os.Mkdir(remote, 0o700); err != nil {
+				t.Fatalf("Failed to create remote directory: %v", err)
+			}
+
+			files := map[string][]byte{
+				"empty":      writeRandomFile(t, filepath.Join(local, "empty"), 0),
+				"small file": writeRandomFile(t, filepath.Join(local, "small file"), 1000),
+				"large.bin":  writeRandomFile(t, filepath.Join(local, "large.bin"), 20<<20),
+				"window.bin": writeRandomFile(t, filepath.Join(local, "window.bin"), 2<<20+1),
+			}
+
+			args := make([]string, 0, len(files)+1)
+			for name := range files {
+				args = append(args, filepath.Join(local, name))
+			}
+
+			output, code := client.scp(t, append(args, remotePath(remote+"/"))...)
+			if code != 0 {
+				t.Fatalf("Upload exited %d: %s", code, output)
+			}
+
+			for name, data := range files {
+				checkSameFile(t, filepath.Join(remote, name), data)
+			}
+
+			download := t.TempDir()
+
+			output, code = client.scp(t, "-r", remotePath(remote), download)
+			if code != 0 {
+				t.Fatalf("Download exited %d: %s", code, output)
+			}
+
+			for name, data := range files {
+				checkSameFile(t, filepath.Join(download, "remote dir", name), data)
+			}
+
+			// Failures on the devbox come back as such
+			output, code = client.scp(t, remotePath(filepath.Join(remote, "missing")), download)
+			if code == 0 {
+				t.Fatalf("Downloading a missing file succeeded: %s", output)
+			}
+		})
+	}
+}
+
+func TestTransfer_Rsync(t *testing.T) {
+	if _, err := exec.LookPath("rsync"); err != nil {
+		t.Skip("rsync is not installed")
+	}
+
+	for _, mode := range transferModes {
+		t.Run(mode.name, func(t *testing.T) {
+			env := newBackendTestEnv(t)
+			env.execBackend = true
+			addr := env.start(t)
+
+			client := newTransferClient(t, addr, env, mode.agentMode)
+
+			local := t.TempDir()
+			data := writeRandomFile(t, filepath.Join(local, "data.bin"), 100<<20)
+			remote := t.TempDir()
+
+			output, code := client.rsync(t, local+"/", remotePath(remote+"/"))
+			if code != 0 {
+				t.Fatalf("rsync exited %d: %s", code, output)
+			}
+
+			checkSameFile(t, filepath.Join(remote, "data.bin"), data)
+
+			output, code = client.rsync(t, remotePath(filepath.Join(remote, "missing")), local)
+			if code == 0 {
+				t.Fatalf("Syncing a missing file succeeded: %s", output)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zijiren233/sshgate/registry"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	metricsv1beta1 "k8s.io/metrics/pkg/client/clientset/versioned/typed/metrics/v1beta1"
+)
+
+// resourceUsageTTL is how long the resource usage of a devbox is reused, so that
+// bursts of connections look it up once
+const resourceUsageTTL = 30 * time.Second
+
+// resourceUsage looks up the CPU and memory usage of devbox pods in
+// metrics-server for the MOTD. Lookups are best-effort: failures, metrics-server
+// being absent included, are cached like usages and show nothing.
+type resourceUsage struct {
+	podMetrics metricsv1beta1.PodMetricsesGetter
+	timeout    time.Duration
+	logger     *log.Entry
+
+	mu sync.Mutex
+	// namespace/devbox -> last lookup
+	lookups map[string]*usageLookup
+}
+
+// usageLookup is a lookup of the usage of a pod, done is closed once it completed
+type usageLookup struct {
+	pod     string
+	expires time.Time
+	done    chan struct{}
+	// usage is nil when the lookup failed
+	usage corev1.ResourceList
+}
+
+// newResourceUsage returns nil when podMetrics is nil
+func newResourceUsage(
+	podMetrics metricsv1beta1.PodMetricsesGetter,
+	timeout time.Duration,
+	logger *log.Entry,
+) *resourceUsage {
+	if podMetrics == nil {
+		return nil
+	}
+
+	return &resourceUsage{
+		podMetrics: podMetrics,
+		timeout:    timeout,
+		logger:     logger.WithField("component", "resource-usage"),
+		lookups:    make(map[string]*usageLookup),
+	}
+}
+
+// line describes the usage of the pod of a devbox against its limits, like
+// "CPU: 1.2/2 cores, Memory: 3.1/4 GiB". It is empty when the usage is unknown.
+func (u *resourceUsage) line(ctx context.Context, info *registry.DevboxInfo) string {
+	if u == nil || info.PodName == "" || info.PodIP == "" {
+		return ""
+	}
+
+	usage := u.usage(ctx, info)
+	if usage == nil {
+		return ""
+	}
+
+	var parts []string
+
+	if cpu, ok := usage[corev1.ResourceCPU]; ok {
+		parts = append(parts, "CPU: "+formatUsage(
+			cpu, info.PodLimits, corev1.ResourceCPU, "cores",
+			func(q resource.Quantity) float64 { return float64(q.MilliValue()) / 1000 },
+		))
+	}
+
+	if memory, ok := usage[corev1.ResourceMemory]; ok {
+		parts = append(parts, "Memory: "+formatUsage(
+			memory, info.PodLimits, corev1.ResourceMemory, "GiB",
+			func(q resource.Quantity) float64 { return float64(q.Value()) / (1 << 30) },
+		))
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// usage returns the usage of the pod of a devbox, from the cache if fresh.
+// Concurrent callers share a single lookup.
+func (u *resourceUsage) usage(ctx context.Context, info *registry.DevboxInfo) corev1.ResourceList {
+	key := info.Namespace + "/" + info.DevboxName
+	now := time.Now()
+
+	u.mu.Lock()
+
+	lookup, ok := u.lookups[key]
+	if !ok || lookup.pod != info.PodName || !now.Before(lookup.expires) {
+		// Forget the devboxes that were not connected to lately
+		for k, l := range u.lookups {
+			if !now.Before(l.expires) {
+				delete(u.lookups, k)
+			}
+		}
+
+		lookup = &usageLookup{
+			pod:     info.PodName,
+			expires: now.Add(resourceUsageTTL),
+			done:    make(chan struct{}),
+		}
+		u.lookups[key] = lookup
+
+		u.mu.Unlock()
+
+		lookup.usage = u.fetch(ctx, info.Namespace, info.PodName)
+		close(lookup.done)
+
+		return lookup.usage
+	}
+
+	u.mu.Unlock()
+
+	select {
+	case <-lookup.done:
+		return lookup.usage
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// fetch sums the usage of the containers of a pod, nil if it failed
+func (u *resourceUsage) fetch(ctx context.Context, namespace, pod string) corev1.ResourceList {
+	ctx, cancel := context.WithTimeout(ctx, u.timeout)
+	defer cancel()
+
+	metrics, err := u.podMetrics.PodMetricses(namespace).Get(ctx, pod, metav1.GetOptions{})
+	if err != nil {
+		u.logger.WithError(err).WithFields(log.Fields{
+			"namespace": namespace,
+			"pod":       pod,
+		}).Debug("Failed to get pod metrics")
+
+		return nil
+	}
+
+	usage := corev1.ResourceList{}
+
+	for _, container := range metrics.Containers {
+		for name, quantity := range container.Usage {
+			total := usage[name]
+			total.Add(quantity)
+			usage[name] = total
+		}
+	}
+
+	return usage
+}
+
+// formatUsage formats a usage in unit, over the limit of the resource if any
+func formatUsage(
+	usage resource.Quantity,
+	limits corev1.ResourceList,
+	name corev1.ResourceName,
+	unit string,
+	amount func(resource.Quantity) float64,
+) string {
+	formatted := formatAmount(amount(usage))
+
+	if limit, ok := limits[name]; ok {
+		formatted += "/" + formatAmount(amount(limit))
+	}
+
+	return fmt.Sprintf("%s %s", formatted, unit)
+}
+
+// formatAmount formats an amount with at most one decimal
+func formatAmount(amount float64) string {
+	return strings.TrimSuffix(strconv.FormatFloat(amount, 'f', 1, 64), ".0")
+}
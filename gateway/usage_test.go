@@ -0,0 +1,147 @@
+package gateway_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"github.com/zijiren233/sshgate/registry"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	metricsv1beta1 "k8s.io/metrics/pkg/apis/metrics/v1beta1"
+	metricsfake "k8s.io/metrics/pkg/client/clientset/versioned/fake"
+)
+
+// setPodLimits updates the test devbox pod with the given container limits
+func setPodLimits(t *testing.T, reg *registry.Registry, limits corev1.ResourceList) {
+	t.Helper()
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pod",
+			Namespace: "ns-test",
+			Labels: map[string]string{
+				registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: registry.DevboxOwnerKind, Name: "test-devbox"},
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "devbox", Resources: corev1.ResourceRequirements{Limits: limits}},
+			},
+		},
+		Status: corev1.PodStatus{PodIP: "127.0.0.1"},
+	}
+	if err := reg.UpdatePod(pod); err != nil {
+		t.Fatalf("Failed to update pod: %v", err)
+	}
+}
+
+// newMetricsServer returns a fake metrics-server client, with the metrics of the
+// test devbox pod unless cpu is empty
+func newMetricsServer(t *testing.T, cpu, memory string) *metricsfake.Clientset {
+	t.Helper()
+
+	metrics := metricsfake.NewSimpleClientset()
+	if cpu == "" {
+		return metrics
+	}
+
+	// The fake tracker files added PodMetrics under the podmetricses resource,
+	// while the client gets them from pods
+	gvr := metricsv1beta1.SchemeGroupVersion.WithResource("pods")
+
+	err := metrics.Tracker().Create(gvr, testPodMetrics(cpu, memory), "ns-test")
+	if err != nil {
+		t.Fatalf("Failed to add pod metrics: %v", err)
+	}
+
+	return metrics
+}
+
+// testPodMetrics returns metrics-server metrics of the test devbox pod
+func testPodMetrics(cpu, memory string) *metricsv1beta1.PodMetrics {
+	return &metricsv1beta1.PodMetrics{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "ns-test"},
+		Containers: []metricsv1beta1.ContainerMetrics{
+			{
+				Name: "devbox",
+				Usage: corev1.ResourceList{
+					corev1.ResourceCPU:    resource.MustParse(cpu),
+					corev1.ResourceMemory: resource.MustParse(memory),
+				},
+			},
+		},
+	}
+}
+
+func TestMOTD_ResourceUsage(t *testing.T) {
+	env := newBackendTestEnv(t)
+	metrics := newMetricsServer(t, "1200m", "3174Mi")
+	addr := env.start(t,
+		gateway.WithMOTD(true, gateway.DefaultMOTDTemplate),
+		gateway.WithMOTDResourceUsage(metrics.MetricsV1beta1(), time.Second),
+	)
+
+	setPodLimits(t, env.reg, corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse("2"),
+		corev1.ResourceMemory: resource.MustParse("4Gi"),
+	})
+
+	const want = "Connected to devbox test-devbox in namespace ns-test via sshgate\r\n" +
+		"CPU: 1.2/2 cores, Memory: 3.1/4 GiB\r\n"
+
+	for range 2 {
+		client := dialPublicKeyMode(t, addr, env)
+
+		if got := runShell(t, client); got != want {
+			t.Errorf("Output = %q, want %q", got, want)
+		}
+	}
+
+	// The second connection reuses the cached usage
+	if got := len(metrics.Actions()); got != 1 {
+		t.Errorf("Metrics looked up %d times, want 1", got)
+	}
+}
+
+func TestMOTD_ResourceUsageWithoutLimits(t *testing.T) {
+	env := newBackendTestEnv(t)
+	metrics := newMetricsServer(t, "300m", "512Mi")
+	addr := env.start(t,
+		gateway.WithMOTD(true, "{devbox}"),
+		gateway.WithMOTDResourceUsage(metrics.MetricsV1beta1(), time.Second),
+	)
+
+	setPodLimits(t, env.reg, nil)
+
+	client := dialPublicKeyMode(t, addr, env)
+
+	const want = "test-devbox\r\nCPU: 0.3 cores, Memory: 0.5 GiB\r\n"
+	if got := runShell(t, client); got != want {
+		t.Errorf("Output = %q, want %q", got, want)
+	}
+}
+
+func TestMOTD_ResourceUsageUnavailable(t *testing.T) {
+	env := newBackendTestEnv(t)
+
+	// metrics-server has no metrics of the pod
+	metrics := newMetricsServer(t, "", "")
+	addr := env.start(t,
+		gateway.WithMOTD(true, gateway.DefaultMOTDTemplate),
+		gateway.WithMOTDResourceUsage(metrics.MetricsV1beta1(), time.Second),
+	)
+
+	setPodLimits(t, env.reg, nil)
+
+	client := dialPublicKeyMode(t, addr, env)
+
+	const want = "Connected to devbox test-devbox in namespace ns-test via sshgate\r\n"
+	if got := runShell(t, client); got != want {
+		t.Errorf("Output = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,156 @@
+package gateway
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// isTrustedUserCertificate reports whether key is a certificate signed by a configured user CA
+func (g *Gateway) isTrustedUserCertificate(key ssh.PublicKey) (*ssh.Certificate, bool) {
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, false
+	}
+
+	if _, ok := g.userCAKeys[string(cert.SignatureKey.Marshal())]; !ok {
+		return nil, false
+	}
+
+	return cert, true
+}
+
+// authenticateCertificate authenticates a user certificate signed by a trusted user CA.
+// A principal of the form namespace/devbox grants access to that devbox.
+func (g *Gateway) authenticateCertificate(
+	conn ssh.ConnMetadata,
+	cert *ssh.Certificate,
+	authLogger *log.Entry,
+) (*ssh.Permissions, error) {
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("%w: certificate is not a user certificate", ErrInvalidCertificate)
+	}
+
+	username, claimedUser, principal, err := g.certificatePrincipal(conn.User(), cert)
+	if err != nil {
+		return nil, err
+	}
+
+	// CheckCert treats a certificate without principals as valid for everyone,
+	// a devbox is only granted by an explicit principal
+	if !slices.Contains(cert.ValidPrincipals, principal) {
+		return nil, fmt.Errorf(
+			"%w: certificate %q does not grant %s",
+			ErrInvalidCertificate,
+			cert.KeyId,
+			principal,
+		)
+	}
+
+	checker := &ssh.CertChecker{IsRevoked: g.isCertificateRevoked}
+	if err := checker.CheckCert(principal, cert); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCertificate, err)
+	}
+
+	namespace, devboxName, _ := strings.Cut(principal, "/")
+
+	info, ok := g.registry.GetDevboxInfo(namespace, devboxName)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s/%s", ErrDevboxNotFound, namespace, devboxName)
+	}
+
+	backendUser, err := g.backendUser(info, claimedUser, false)
+	if err != nil {
+		return nil, err
+	}
+
+	serial := strconv.FormatUint(cert.Serial, 10)
+
+	certLogger := authLogger.WithFields(log.Fields{
+		"namespace":   info.Namespace,
+		"devbox":      info.DevboxName,
+		"cert_key_id": cert.KeyId,
+		"cert_serial": serial,
+	})
+
+	certLogger.WithField("backend_user", backendUser).Info("authentication accept")
+
+	return &ssh.Permissions{
+		// Carries source-address so the server enforces it
+		CriticalOptions: cert.CriticalOptions,
+		Extensions: map[string]string{
+			"username":     username,
+			"claimed_user": claimedUser,
+			"backend_user": backendUser,
+			"auth_mode":    g.registeredKeyAuthMode().String(),
+			"cert_key_id":  cert.KeyId,
+			"cert_serial":  serial,
+			// The client agent holds the certificate, not a plain key
+			"key_fingerprint": ssh.FingerprintSHA256(cert),
+			// Revoking the certified key terminates the connection too
+			"cert_key_fingerprint": ssh.FingerprintSHA256(cert.Key),
+		},
+		ExtraData: map[any]any{
+			"devbox_info": info,
+			"logger":      certLogger,
+		},
+	}, nil
+}
+
+// certificatePrincipal selects the namespace/devbox principal used for the connection,
+// along with the username and backend user. A username in one of the forms of
+// UsernameParser selects the devbox explicitly, otherwise the certificate must grant
+// exactly one devbox.
+func (g *Gateway) certificatePrincipal(
+	user string,
+	cert *ssh.Certificate,
+) (username, backendUser, principal string, err error) {
+	parsed, parseErr := g.parser.Resolve(user)
+	if parseErr == nil || errors.Is(parseErr, ErrDevboxNotFound) {
+		return parsed.Username, parsed.Login(), parsed.Namespace + "/" + parsed.DevboxName, nil
+	}
+
+	login, user, err := g.parser.SplitBackendUser(user)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	var devboxPrincipals []string
+
+	for _, p := range cert.ValidPrincipals {
+		if strings.Contains(p, "/") {
+			devboxPrincipals = append(devboxPrincipals, p)
+		}
+	}
+
+	switch len(devboxPrincipals) {
+	case 0:
+		return "", "", "", fmt.Errorf(
+			"%w: certificate %q grants no namespace/devbox principal",
+			ErrInvalidCertificate,
+			cert.KeyId,
+		)
+	case 1:
+		return user, cmp.Or(login, user), devboxPrincipals[0], nil
+	default:
+		return "", "", "", fmt.Errorf(
+			"%w: certificate %q grants %d devboxes, select one with user@namespace-devbox",
+			ErrInvalidCertificate,
+			cert.KeyId,
+			len(devboxPrincipals),
+		)
+	}
+}
+
+// isCertificateRevoked reports whether a user certificate, or the key it
+// certifies, is on the revocation list
+func (g *Gateway) isCertificateRevoked(cert *ssh.Certificate) bool {
+	_, revoked := g.revokedFingerprint(cert)
+	return revoked
+}
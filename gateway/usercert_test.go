@@ -0,0 +1,174 @@
+package gateway_test
+
+import (
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"golang.org/x/crypto/ssh"
+)
+
+func signUserCert(
+	t *testing.T,
+	ca ssh.Signer,
+	key ssh.PublicKey,
+	principals []string,
+	validAfter, validBefore time.Time,
+) *ssh.Certificate {
+	t.Helper()
+
+	cert := &ssh.Certificate{
+		Key:             key,
+		Serial:          42,
+		CertType:        ssh.UserCert,
+		KeyId:           "alice@example.com",
+		ValidPrincipals: principals,
+		//nolint:gosec // test timestamps are always positive
+		ValidAfter: uint64(validAfter.Unix()),
+		//nolint:gosec // test timestamps are always positive
+		ValidBefore: uint64(validBefore.Unix()),
+	}
+
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatalf("Failed to sign user certificate: %v", err)
+	}
+
+	return cert
+}
+
+func TestPublicKeyCallback_UserCertificate(t *testing.T) {
+	env := newBackendTestEnv(t)
+	ca, _, _, _ := generateTestKeys(t)
+	otherCA, _, _, _ := generateTestKeys(t)
+	_, userPub, _, _ := generateTestKeys(t)
+
+	gw := gateway.New(env.hostKey, env.reg,
+		gateway.WithUserCAKeys([]string{string(ssh.MarshalAuthorizedKey(ca.PublicKey()))}),
+	)
+
+	now := time.Now()
+	valid := []time.Time{now.Add(-time.Hour), now.Add(time.Hour)}
+
+	tests := []struct {
+		name    string
+		user    string
+		cert    *ssh.Certificate
+		wantErr error
+	}{
+		{
+			name: "single devbox principal",
+			user: "testuser",
+			cert: signUserCert(t, ca, userPub, []string{"ns-test/test-devbox"}, valid[0], valid[1]),
+		},
+		{
+			name: "expired",
+			user: "testuser",
+			cert: signUserCert(t, ca, userPub, []string{"ns-test/test-devbox"},
+				now.Add(-2*time.Hour), now.Add(-time.Hour)),
+			wantErr: gateway.ErrInvalidCertificate,
+		},
+		{
+			name:    "no principals",
+			user:    "testuser",
+			cert:    signUserCert(t, ca, userPub, nil, valid[0], valid[1]),
+			wantErr: gateway.ErrInvalidCertificate,
+		},
+		{
+			name: "ambiguous principals",
+			user: "testuser",
+			cert: signUserCert(t, ca, userPub, []string{"ns-test/test-devbox", "ns-test/other"},
+				valid[0], valid[1]),
+			wantErr: gateway.ErrInvalidCertificate,
+		},
+		{
+			name: "username selects devbox not granted",
+			user: "testuser@team-devbox",
+			cert: signUserCert(t, ca, userPub, []string{"ns-test/test-devbox"},
+				valid[0], valid[1]),
+			wantErr: gateway.ErrInvalidCertificate,
+		},
+		{
+			name: "granted devbox does not exist",
+			user: "testuser",
+			cert: signUserCert(t, ca, userPub, []string{"ns-test/missing"},
+				valid[0], valid[1]),
+			wantErr: gateway.ErrDevboxNotFound,
+		},
+		{
+			name: "untrusted CA",
+			user: "testuser",
+			cert: signUserCert(t, otherCA, userPub, []string{"ns-test/test-devbox"},
+				valid[0], valid[1]),
+			wantErr: gateway.ErrUnknownKey,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			perms, err := gw.PublicKeyCallback(newMockConnMetadata(tt.user), tt.cert)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Expected error %v, got: %v", tt.wantErr, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Expected certificate to be accepted, got: %v", err)
+			}
+
+			info, err := gateway.GetDevboxInfoFromPermissions(perms)
+			if err != nil {
+				t.Fatalf("GetDevboxInfoFromPermissions() failed: %v", err)
+			}
+
+			if info.Namespace != "ns-test" || info.DevboxName != "test-devbox" {
+				t.Errorf("Devbox = %s/%s, want ns-test/test-devbox",
+					info.Namespace, info.DevboxName)
+			}
+
+			if got := perms.Extensions["cert_key_id"]; got != "alice@example.com" {
+				t.Errorf("cert_key_id = %q, want alice@example.com", got)
+			}
+
+			if got := perms.Extensions["cert_serial"]; got != "42" {
+				t.Errorf("cert_serial = %q, want 42", got)
+			}
+		})
+	}
+}
+
+func TestUserCertificate_EndToEnd(t *testing.T) {
+	env := newBackendTestEnv(t)
+	ca, _, _, _ := generateTestKeys(t)
+	userSigner, _, _, _ := generateTestKeys(t)
+
+	now := time.Now()
+	cert := signUserCert(t, ca, userSigner.PublicKey(), []string{"ns-test/test-devbox"},
+		now.Add(-time.Hour), now.Add(time.Hour))
+
+	certSigner, err := ssh.NewCertSigner(cert, userSigner)
+	if err != nil {
+		t.Fatalf("Failed to create cert signer: %v", err)
+	}
+
+	gw := gateway.New(env.hostKey, env.reg,
+		gateway.WithUserCAKeys([]string{string(ssh.MarshalAuthorizedKey(ca.PublicKey()))}),
+	)
+
+	client, err := dialGateway(t, gw, &ssh.ClientConfig{
+		User: "testuser",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(certSigner)},
+	})
+	if err != nil {
+		t.Fatalf("Expected certificate authentication to succeed, got: %v", err)
+	}
+	defer client.Close()
+
+	if got := gw.AuthStats().Successes; got != 1 {
+		t.Errorf("Successes = %d, want 1", got)
+	}
+}
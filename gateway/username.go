@@ -1,62 +1,290 @@
 package gateway
 
 import (
-	"errors"
 	"fmt"
 	"net/url"
 	"strings"
 )
 
-// UsernameParser parses username in format: username@short_user_namespace-devboxname
-type UsernameParser struct{}
+// Forms of usernames selecting a devbox
+const (
+	// UsernameFormSlash is username@namespace/devboxname, with the full namespace
+	UsernameFormSlash = "slash"
+	// UsernameFormUnderscore is username__namespace__devboxname, with the full
+	// namespace, for clients restricting the characters of usernames
+	UsernameFormUnderscore = "underscore"
+	// UsernameFormDash is username@short_user_namespace-devboxname, the ns- prefix
+	// of the namespace left out. It is ambiguous when either name has dashes.
+	UsernameFormDash = "dash"
+)
+
+// usernameSeparator separates the parts of the underscore form, Kubernetes
+// names cannot contain it
+const usernameSeparator = "__"
+
+// backendUserSeparator ends the optional backend user prefix of a username
+const backendUserSeparator = "+"
+
+// ParsedUsername is a username selecting a devbox
+type ParsedUsername struct {
+	Username   string
+	Namespace  string
+	DevboxName string
+	// Form is the form the devbox was selected with
+	Form string
+	// BackendUser is the explicit backend login user, empty when the username
+	// doubles as the backend user
+	BackendUser string
+}
+
+// Login returns the user logging into the backend
+func (p ParsedUsername) Login() string {
+	if p.BackendUser != "" {
+		return p.BackendUser
+	}
+
+	return p.Username
+}
+
+// UsernameParser parses usernames selecting a devbox, in any of the forms:
+//   - username@namespace/devboxname, e.g. ubuntu@ns-someteam/my-api
+//   - username__namespace__devboxname, e.g. ubuntu__ns-someteam__my-api
+//   - username@short_user_namespace-devboxname, e.g. ubuntu@someteam-my-api
+//
+// Usernames may be URL encoded, %40 standing for @ and %2F for /. Any form may be
+// prefixed with backenduser+ to log into the devbox as another user, e.g.
+// root+ubuntu@ns-someteam/my-api. Without a username, as in root+someteam-my-api
+// or root+ns-someteam/my-api, the backend user doubles as the username.
+type UsernameParser struct {
+	// Exists reports whether a devbox exists. It resolves the dash form, which is
+	// split at the dash giving the longest existing namespace. When nil, the dash
+	// form is split at the first dash.
+	Exists func(namespace, devboxName string) bool
+}
 
-// Parse parses the username format
-// Format: username@short_user_namespace-devboxname
-// Examples:
-//   - ubuntu@someteam-workspace
+// newUsernameParser returns a parser resolving dash form usernames against the
+// devboxes of reg
+func newUsernameParser(reg DevboxResolver) *UsernameParser {
+	return &UsernameParser{
+		Exists: func(namespace, devboxName string) bool {
+			_, ok := reg.GetDevboxInfo(namespace, devboxName)
+			return ok
+		},
+	}
+}
+
+// Parse parses a username selecting a devbox, see Resolve
 func (p *UsernameParser) Parse(input string) (username, namespace, devboxname string, err error) {
-	// URL decode (handle %2E, %2D, etc.)
-	decoded, err := url.QueryUnescape(input)
+	parsed, err := p.Resolve(input)
+
+	return parsed.Username, parsed.Namespace, parsed.DevboxName, err
+}
+
+// Resolve parses a username selecting a devbox. Malformed usernames return an
+// ErrInvalidUsername error. Dash form usernames matching no existing devbox
+// return an ErrDevboxNotFound error along with the names split at the first dash.
+func (p *UsernameParser) Resolve(input string) (ParsedUsername, error) {
+	// URL decode (handle %40, %2F, etc.), keeping + as the backend user separator
+	decoded, err := url.PathUnescape(input)
 	if err == nil {
 		input = decoded
 	}
 
-	// Cut at the first dot (separates username from target)
-	username, target, found := strings.Cut(input, "@")
+	backendUser, input, err := cutBackendUser(input)
+	if err != nil {
+		return ParsedUsername{}, err
+	}
+
+	parsed, err := p.resolve(backendUser, input)
+	parsed.BackendUser = backendUser
+
+	return parsed, err
+}
+
+// SplitBackendUser splits the optional backend user prefix off a username that
+// does not select a devbox, as used when the devbox is selected by public key
+func (p *UsernameParser) SplitBackendUser(input string) (backendUser, username string, err error) {
+	decoded, err := url.PathUnescape(input)
+	if err != nil || !strings.Contains(decoded, backendUserSeparator) {
+		return "", input, nil
+	}
+
+	return cutBackendUser(decoded)
+}
+
+// cutBackendUser cuts the backend user prefix off a decoded username
+func cutBackendUser(input string) (backendUser, rest string, err error) {
+	backendUser, rest, found := strings.Cut(input, backendUserSeparator)
 	if !found {
-		return "", "", "", fmt.Errorf(
-			"invalid format: expected username@namespace-devboxname, got: %s",
+		return "", input, nil
+	}
+
+	if backendUser == "" || rest == "" {
+		return "", "", fmt.Errorf(
+			"%w: expected backenduser+username, got: %s",
+			ErrInvalidUsername,
 			input,
 		)
 	}
 
-	if username == "" {
-		return "", "", "", errors.New("username cannot be empty")
+	return backendUser, rest, nil
+}
+
+// resolve parses a decoded username without its backend user prefix. Given a
+// backend user, the username may be left out.
+func (p *UsernameParser) resolve(backendUser, input string) (ParsedUsername, error) {
+	username, target, found := strings.Cut(input, "@")
+	if !found && backendUser != "" && !strings.Contains(input, usernameSeparator) {
+		username, target, found = backendUser, input, true
+	}
+
+	if !found {
+		username, namespace, devboxName, ok := cutUnderscoreForm(input)
+		if !ok {
+			return ParsedUsername{}, fmt.Errorf(
+				"%w: expected username@namespace/devboxname, "+
+					"username__namespace__devboxname or username@namespace-devboxname, got: %s",
+				ErrInvalidUsername,
+				input,
+			)
+		}
+
+		return newParsedUsername(username, namespace, devboxName, UsernameFormUnderscore)
+	}
+
+	if namespace, devboxName, found := strings.Cut(target, "/"); found {
+		return newParsedUsername(username, namespace, devboxName, UsernameFormSlash)
+	}
+
+	return p.resolveDashForm(username, target)
+}
+
+// cutUnderscoreForm splits username__namespace__devboxname, the username may
+// contain the separator
+func cutUnderscoreForm(input string) (username, namespace, devboxName string, ok bool) {
+	rest, devboxName, found := cutLast(input, usernameSeparator)
+	if !found {
+		return "", "", "", false
+	}
+
+	username, namespace, found = cutLast(rest, usernameSeparator)
+
+	return username, namespace, devboxName, found
+}
+
+func cutLast(s, sep string) (before, after string, found bool) {
+	i := strings.LastIndex(s, sep)
+	if i < 0 {
+		return s, "", false
 	}
 
-	// Cut at the dash (separates namespace from devboxname)
-	namespace, devboxname, found = strings.Cut(target, "-")
+	return s[:i], s[i+len(sep):], true
+}
+
+// resolveDashForm splits short_user_namespace-devboxname at the dash giving the
+// longest existing namespace, or at the first dash without a registry
+func (p *UsernameParser) resolveDashForm(username, target string) (ParsedUsername, error) {
+	short, devboxName, found := strings.Cut(target, "-")
 	if !found {
-		return "", "", "", fmt.Errorf(
-			"invalid format: expected namespace-devboxname, got: %s",
+		return ParsedUsername{}, fmt.Errorf(
+			"%w: expected namespace-devboxname, got: %s",
+			ErrInvalidUsername,
 			target,
 		)
 	}
 
-	if namespace == "" {
-		return "", "", "", errors.New("namespace cannot be empty")
+	parsed, err := newParsedUsername(username, "ns-"+short, devboxName, UsernameFormDash)
+	if err != nil || p.Exists == nil {
+		return parsed, err
+	}
+
+	matched := false
+
+	for i := range len(target) {
+		if target[i] != '-' {
+			continue
+		}
+
+		namespace, devboxName := "ns-"+target[:i], target[i+1:]
+		if validName(namespace) && validName(devboxName) && p.Exists(namespace, devboxName) {
+			parsed.Namespace, parsed.DevboxName = namespace, devboxName
+			matched = true
+		}
+	}
+
+	if !matched {
+		return parsed, fmt.Errorf("%w: no devbox matches %s", ErrDevboxNotFound, target)
+	}
+
+	return parsed, nil
+}
+
+func newParsedUsername(username, namespace, devboxName, form string) (ParsedUsername, error) {
+	if username == "" {
+		return ParsedUsername{}, fmt.Errorf("%w: username cannot be empty", ErrInvalidUsername)
+	}
+
+	if !validName(namespace) {
+		return ParsedUsername{}, fmt.Errorf(
+			"%w: invalid namespace %q",
+			ErrInvalidUsername,
+			namespace,
+		)
+	}
+
+	if !validName(devboxName) {
+		return ParsedUsername{}, fmt.Errorf(
+			"%w: invalid devbox name %q",
+			ErrInvalidUsername,
+			devboxName,
+		)
+	}
+
+	return ParsedUsername{
+		Username:   username,
+		Namespace:  namespace,
+		DevboxName: devboxName,
+		Form:       form,
+	}, nil
+}
+
+// validName reports whether s can be the name of a namespace or devbox: lower
+// case alphanumerics, dashes and dots, at most 253 characters
+func validName(s string) bool {
+	if s == "" || len(s) > 253 {
+		return false
+	}
+
+	for _, c := range s {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' && c != '.' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// SelectsDevbox reports whether a username attempts to select a devbox rather
+// than being a plain username
+func (p *UsernameParser) SelectsDevbox(input string) bool {
+	if decoded, err := url.PathUnescape(input); err == nil {
+		input = decoded
 	}
 
-	if devboxname == "" {
-		return "", "", "", errors.New("devboxname cannot be empty")
+	if strings.Contains(input, "@") || strings.Contains(input, usernameSeparator) {
+		return true
 	}
 
-	return username, "ns-" + namespace, devboxname, nil
+	// Without a username, a devbox follows the backend user prefix
+	_, rest, found := strings.Cut(input, backendUserSeparator)
+
+	return found && strings.ContainsAny(rest, "-/")
 }
 
-// Format formats username, namespace, and devboxname into the standard format
+// Format formats username, namespace, and devboxname into the unambiguous
+// username@namespace/devboxname form
 func (p *UsernameParser) Format(username, namespace, devboxname string) string {
-	return fmt.Sprintf("%s.%s-%s", username, namespace, devboxname)
+	return fmt.Sprintf("%s@%s/%s", username, namespace, devboxname)
 }
 
 // Validate validates the username format
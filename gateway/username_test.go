@@ -0,0 +1,375 @@
+package gateway_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// existingDevboxes returns an Exists func reporting the given namespace/devbox pairs
+func existingDevboxes(devboxes ...string) func(namespace, devboxName string) bool {
+	return func(namespace, devboxName string) bool {
+		for _, devbox := range devboxes {
+			if devbox == namespace+"/"+devboxName {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+func parsed(username, namespace, devboxName, form string) gateway.ParsedUsername {
+	return gateway.ParsedUsername{
+		Username:   username,
+		Namespace:  namespace,
+		DevboxName: devboxName,
+		Form:       form,
+	}
+}
+
+func TestUsernameParser_Resolve(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		exists    []string
+		want      gateway.ParsedUsername
+		wantErr   error
+		noExists  bool
+		wantGuess bool
+	}{
+		{
+			name:  "slash form",
+			input: "ubuntu@ns-team/my-api",
+			want:  parsed("ubuntu", "ns-team", "my-api", gateway.UsernameFormSlash),
+		},
+		{
+			name:  "slash form with dashed namespace",
+			input: "ubuntu@ns-my-team/api",
+			want:  parsed("ubuntu", "ns-my-team", "api", gateway.UsernameFormSlash),
+		},
+		{
+			name:  "slash form URL encoded",
+			input: "ubuntu%40ns-team%2Fmy-api",
+			want:  parsed("ubuntu", "ns-team", "my-api", gateway.UsernameFormSlash),
+		},
+		{
+			name:  "slash form namespace without prefix",
+			input: "root@default/box",
+			want:  parsed("root", "default", "box", gateway.UsernameFormSlash),
+		},
+		{
+			name:  "underscore form",
+			input: "ubuntu__ns-my-team__my-api",
+			want:  parsed("ubuntu", "ns-my-team", "my-api", gateway.UsernameFormUnderscore),
+		},
+		{
+			name:  "underscore form username with separator",
+			input: "my__user__ns-team__api",
+			want:  parsed("my__user", "ns-team", "api", gateway.UsernameFormUnderscore),
+		},
+		{
+			name:     "dash form without registry",
+			input:    "ubuntu@team-my-api",
+			noExists: true,
+			want:     parsed("ubuntu", "ns-team", "my-api", gateway.UsernameFormDash),
+		},
+		{
+			name:   "dash form dashed devbox",
+			input:  "ubuntu@team-my-api",
+			exists: []string{"ns-team/my-api"},
+			want:   parsed("ubuntu", "ns-team", "my-api", gateway.UsernameFormDash),
+		},
+		{
+			name:   "dash form dashed namespace",
+			input:  "ubuntu@my-team-api",
+			exists: []string{"ns-my-team/api"},
+			want:   parsed("ubuntu", "ns-my-team", "api", gateway.UsernameFormDash),
+		},
+		{
+			name:   "dash form longest namespace wins",
+			input:  "ubuntu@a-b-c",
+			exists: []string{"ns-a/b-c", "ns-a-b/c"},
+			want:   parsed("ubuntu", "ns-a-b", "c", gateway.UsernameFormDash),
+		},
+		{
+			name:   "dash form URL encoded",
+			input:  "ubuntu%40my-team-api",
+			exists: []string{"ns-my-team/api"},
+			want:   parsed("ubuntu", "ns-my-team", "api", gateway.UsernameFormDash),
+		},
+		{
+			name:      "dash form no devbox",
+			input:     "ubuntu@my-team-api",
+			exists:    []string{"ns-other/api"},
+			want:      parsed("ubuntu", "ns-my", "team-api", gateway.UsernameFormDash),
+			wantErr:   gateway.ErrDevboxNotFound,
+			wantGuess: true,
+		},
+		{name: "plain username", input: "ubuntu", wantErr: gateway.ErrInvalidUsername},
+		{name: "empty", input: "", wantErr: gateway.ErrInvalidUsername},
+		{name: "empty username", input: "@ns-team/api", wantErr: gateway.ErrInvalidUsername},
+		{name: "empty namespace", input: "ubuntu@/api", wantErr: gateway.ErrInvalidUsername},
+		{name: "empty devbox", input: "ubuntu@ns-team/", wantErr: gateway.ErrInvalidUsername},
+		{name: "extra slash", input: "ubuntu@ns-team/a/b", wantErr: gateway.ErrInvalidUsername},
+		{name: "upper case", input: "ubuntu@ns-Team/api", wantErr: gateway.ErrInvalidUsername},
+		{name: "dash form without dash", input: "ubuntu@team", wantErr: gateway.ErrInvalidUsername},
+		{
+			name:    "dash form trailing dash",
+			input:   "ubuntu@team-",
+			wantErr: gateway.ErrInvalidUsername,
+		},
+		{
+			name:    "underscore form missing devbox",
+			input:   "ubuntu__ns-team",
+			wantErr: gateway.ErrInvalidUsername,
+		},
+		{
+			name:    "underscore form empty namespace",
+			input:   "ubuntu____api",
+			wantErr: gateway.ErrInvalidUsername,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parser := &gateway.UsernameParser{}
+			if !tt.noExists {
+				parser.Exists = existingDevboxes(tt.exists...)
+			}
+
+			got, err := parser.Resolve(tt.input)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Resolve(%q) error = %v, want %v", tt.input, err, tt.wantErr)
+				}
+
+				if !tt.wantGuess {
+					return
+				}
+			} else if err != nil {
+				t.Fatalf("Resolve(%q) error = %v", tt.input, err)
+			}
+
+			if got != tt.want {
+				t.Errorf("Resolve(%q) = %+v, want %+v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUsernameParser_BackendUser(t *testing.T) {
+	tests := []struct {
+		input       string
+		username    string
+		backendUser string
+		login       string
+		wantErr     error
+	}{
+		{input: "ubuntu@ns-team/api", username: "ubuntu", login: "ubuntu"},
+		{input: "root+ubuntu@ns-team/api", username: "ubuntu", backendUser: "root", login: "root"},
+		{
+			input:       "root%2Bubuntu%40ns-team%2Fapi",
+			username:    "ubuntu",
+			backendUser: "root",
+			login:       "root",
+		},
+		{input: "root+ns-team/api", username: "root", backendUser: "root", login: "root"},
+		{input: "root+team-api", username: "root", backendUser: "root", login: "root"},
+		{
+			input:       "root+ubuntu__ns-team__api",
+			username:    "ubuntu",
+			backendUser: "root",
+			login:       "root",
+		},
+		{input: "+ubuntu@ns-team/api", wantErr: gateway.ErrInvalidUsername},
+		{input: "root+", wantErr: gateway.ErrInvalidUsername},
+		{input: "root+ubuntu", wantErr: gateway.ErrInvalidUsername},
+	}
+
+	parser := &gateway.UsernameParser{}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := parser.Resolve(tt.input)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Resolve(%q) error = %v, want %v", tt.input, err, tt.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Resolve(%q) error = %v", tt.input, err)
+			}
+
+			if got.Username != tt.username || got.BackendUser != tt.backendUser ||
+				got.Login() != tt.login {
+				t.Errorf(
+					"Resolve(%q) = %+v, login %q, want username %q, backend user %q, login %q",
+					tt.input, got, got.Login(), tt.username, tt.backendUser, tt.login,
+				)
+			}
+		})
+	}
+}
+
+func TestUsernameParser_SplitBackendUser(t *testing.T) {
+	tests := []struct {
+		input       string
+		backendUser string
+		username    string
+		wantErr     bool
+	}{
+		{input: "ubuntu", username: "ubuntu"},
+		{input: "root+ubuntu", backendUser: "root", username: "ubuntu"},
+		{input: "root%2Bubuntu", backendUser: "root", username: "ubuntu"},
+		{input: "root+", wantErr: true},
+		{input: "+ubuntu", wantErr: true},
+	}
+
+	parser := &gateway.UsernameParser{}
+
+	for _, tt := range tests {
+		backendUser, username, err := parser.SplitBackendUser(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("SplitBackendUser(%q) error = %v, want error %v", tt.input, err, tt.wantErr)
+		}
+
+		if backendUser != tt.backendUser || username != tt.username {
+			t.Errorf(
+				"SplitBackendUser(%q) = %q, %q, want %q, %q",
+				tt.input, backendUser, username, tt.backendUser, tt.username,
+			)
+		}
+	}
+}
+
+func TestUsernameParser_SelectsDevbox(t *testing.T) {
+	parser := &gateway.UsernameParser{}
+
+	for input, want := range map[string]bool{
+		"ubuntu":              false,
+		"ubuntu_1":            false,
+		"ubuntu@team-api":     true,
+		"ubuntu%40team-api":   true,
+		"ubuntu__ns-team__a":  true,
+		"ubuntu@ns-team/api":  true,
+		"ubuntu%40ns-team%2F": true,
+		"root+ubuntu":         false,
+		"root+team-api":       true,
+		"root+ns-team/api":    true,
+	} {
+		if got := parser.SelectsDevbox(input); got != want {
+			t.Errorf("SelectsDevbox(%q) = %v, want %v", input, got, want)
+		}
+	}
+}
+
+func FuzzUsernameParser_Resolve(f *testing.F) {
+	for _, seed := range []string{
+		"ubuntu@ns-team/my-api",
+		"ubuntu%40ns-team%2Fmy-api",
+		"ubuntu__ns-my-team__api",
+		"ubuntu@my-team-api",
+		"ubuntu",
+		"@/",
+		"%zz@a-b",
+		"root+ubuntu@ns-team/api",
+		"root+my-team-api",
+	} {
+		f.Add(seed)
+	}
+
+	parser := &gateway.UsernameParser{Exists: existingDevboxes("ns-my-team/api")}
+
+	f.Fuzz(func(t *testing.T, input string) {
+		got, err := parser.Resolve(input)
+		if err != nil {
+			if !errors.Is(err, gateway.ErrInvalidUsername) &&
+				!errors.Is(err, gateway.ErrDevboxNotFound) {
+				t.Fatalf("Resolve(%q) error = %v, want a typed error", input, err)
+			}
+
+			return
+		}
+
+		if got.Username == "" || got.Namespace == "" || got.DevboxName == "" {
+			t.Fatalf("Resolve(%q) = %+v, want every part", input, got)
+		}
+
+		// The slash form selects the same devbox unambiguously
+		formatted := parser.Format(got.Username, got.Namespace, got.DevboxName)
+
+		again, err := parser.Resolve(formatted)
+		if err != nil {
+			// The username of other forms may contain characters of the slash form
+			return
+		}
+
+		if again.Namespace != got.Namespace || again.DevboxName != got.DevboxName {
+			t.Fatalf("Resolve(%q) = %+v, want %+v", formatted, again, got)
+		}
+	})
+}
+
+func TestUsernameForms_AgentForwardMode(t *testing.T) {
+	env := newBackendTestEnv(t)
+	addr := env.start(t)
+
+	devboxKey, err := ssh.ParseRawPrivateKey(env.privBytes)
+	if err != nil {
+		t.Fatalf("Failed to parse private key: %v", err)
+	}
+
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: devboxKey}); err != nil {
+		t.Fatalf("Failed to add key to keyring: %v", err)
+	}
+
+	for _, user := range []string{
+		"testuser@ns-test/test-devbox",
+		"testuser%40ns-test%2Ftest-devbox",
+		"testuser__ns-test__test-devbox",
+		"testuser@test-test-devbox",
+	} {
+		t.Run(user, func(t *testing.T) {
+			userSigner, _, _, _ := generateTestKeys(t)
+
+			client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+				User: user,
+				Auth: []ssh.AuthMethod{ssh.PublicKeys(userSigner)},
+				//nolint:gosec // acceptable for testing
+				HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+				Timeout:         5 * time.Second,
+			})
+			if err != nil {
+				t.Fatalf("Failed to dial gateway: %v", err)
+			}
+			defer client.Close()
+
+			if err := agent.ForwardToAgent(client, keyring); err != nil {
+				t.Fatalf("Failed to forward agent: %v", err)
+			}
+
+			session, err := client.NewSession()
+			if err != nil {
+				t.Fatalf("Failed to create session: %v", err)
+			}
+			defer session.Close()
+
+			if err := agent.RequestAgentForwarding(session); err != nil {
+				t.Fatalf("Failed to request agent forwarding: %v", err)
+			}
+
+			if err := session.Run("exit 0"); err != nil {
+				t.Fatalf("Session through %s failed: %v", user, err)
+			}
+		})
+	}
+}
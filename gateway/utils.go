@@ -1,6 +1,9 @@
 package gateway
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"io"
 	"net"
 	"sync"
@@ -9,12 +12,88 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
+// localPeerAddr stands for peers connected over a Unix socket, which are local
+// and have no address of their own
+const localPeerAddr = "local"
+
+// newConnID returns a short random ID correlating the logs of a client connection
+func newConnID() string {
+	b := make([]byte, 6)
+	_, _ = rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// Environment variables passing the client of a connection to backend sessions,
+// whose own SSH_CLIENT and who show the gateway
+const (
+	ClientAddrEnv = "SSHGATE_CLIENT_ADDR"
+	ConnIDEnv     = "SSHGATE_CONNECTION_ID"
+)
+
+// sendSessionEnv passes the session ID, when configured, and the client address
+// and connection ID, unless disabled, to the backend session as environment
+// variables. It is called before any request of the client is forwarded, so
+// they are set before the shell or command starts. The backend may ignore them
+// unless its AcceptEnv allows them.
+func (g *Gateway) sendSessionEnv(backendChannel ssh.Channel, cio *connIO) {
+	if g.opts().SessionIDEnv != "" {
+		sendEnv(backendChannel, g.opts().SessionIDEnv, cio.id)
+	}
+
+	if g.opts().ClientEnv {
+		sendEnv(backendChannel, ClientAddrEnv, cio.clientAddr)
+		sendEnv(backendChannel, ConnIDEnv, cio.connID)
+	}
+}
+
+// sendEnv sets an environment variable of a backend session, without waiting
+// for the backend to accept it
+func sendEnv(backendChannel ssh.Channel, name, value string) {
+	_, _ = backendChannel.SendRequest("env", false, ssh.Marshal(struct {
+		Name  string
+		Value string
+	}{name, value}))
+}
+
+// remoteAddr formats the address of a client for logs
+func remoteAddr(addr net.Addr) string {
+	if addr == nil {
+		return localPeerAddr
+	}
+
+	if unixAddr, ok := addr.(*net.UnixAddr); ok {
+		if unixAddr.Name == "" || unixAddr.Name == "@" {
+			return localPeerAddr
+		}
+
+		return "unix:" + unixAddr.Name
+	}
+
+	return addr.String()
+}
+
 func (g *Gateway) proxyRequests(
 	in <-chan *ssh.Request,
 	out ssh.Channel,
 	logger *log.Entry,
 ) {
 	for req := range in {
+		if answerLocalRequest(req) {
+			continue
+		}
+
+		// Agent forwarding is never set up when the mode is disabled
+		if req.Type == agentRequestType && g.opts().agentForwardingModeDisabled() {
+			logger.Info("Refusing agent forwarding request, agent forwarding mode is disabled")
+
+			if req.WantReply {
+				_ = req.Reply(false, nil)
+			}
+
+			continue
+		}
+
 		ok, err := out.SendRequest(req.Type, req.WantReply, req.Payload)
 		if req.WantReply {
 			_ = req.Reply(ok, nil)
@@ -32,46 +111,133 @@ func (g *Gateway) proxyRequests(
 
 // proxyChannelWithRequests proxies data between two SSH channels while also
 // forwarding requests. It ensures that exit-status is forwarded before closing.
+// Data is shaped and accounted by cio, and recorded for PTY sessions of recorded
+// connections. Sessions of devboxes forcing a command run it instead of theirs.
+// PTY shell sessions start with the MOTD, if any.
+// Both channels are closed once ctx is done.
 func (g *Gateway) proxyChannelWithRequests(
+	ctx context.Context,
 	channel, backendChannel ssh.Channel,
 	clientReqs, backendReqs <-chan *ssh.Request,
+	cio *connIO,
 	logger *log.Entry,
 ) {
+	stop := context.AfterFunc(ctx, func() {
+		_ = channel.Close()
+		_ = backendChannel.Close()
+	})
+	defer stop()
+
+	rec := g.newSessionRecording(cio, channel, logger)
+	defer rec.close()
+
 	// Client to backend: requests and data
 	go func() {
-		g.proxyRequests(clientReqs, backendChannel, logger)
+		reqs := g.forceCommandRequests(
+			rec.watch(clientReqs),
+			backendChannel,
+			cio.forceCommand,
+			logger,
+		)
+
+		// Forced commands are no shells, whatever the client requested
+		g.proxyRequests(injectMOTD(reqs, channel, cio.motd), backendChannel, logger)
 	}()
 
 	go func() {
-		_, _ = io.Copy(backendChannel, channel)
+		_, _ = io.Copy(backendChannel, rec.upstream(cio.upstream(channel)))
 		_ = backendChannel.CloseWrite()
 	}()
 
 	// Backend to client: wait for both data and requests before CloseWrite
 	var backendToClientWg sync.WaitGroup
 
+	outputDone := make(chan struct{})
+
 	backendToClientWg.Go(func() {
-		_, _ = io.Copy(channel, backendChannel)
+		_, _ = io.Copy(channel, rec.downstream(cio.downstream(backendChannel)))
+		close(outputDone)
 		_ = channel.CloseWrite()
 	})
 
 	backendToClientWg.Go(func() {
-		g.proxyRequests(backendReqs, channel, logger)
+		reqs := exitAfterOutput(backendReqs, outputDone)
+		g.proxyRequests(reqs, channel, logger)
+
+		// The client is gone when forwarding stopped early
+		go ssh.DiscardRequests(reqs)
 	})
 
 	// Wait for backend->client to complete (data + exit-status)
 	backendToClientWg.Wait()
+
+	logger.WithFields(cio.fields()).Debug("Channel traffic")
 }
 
-// proxyChannelToConn proxies data between an SSH channel and a net.Conn
-func (g *Gateway) proxyChannelToConn(channel ssh.Channel, conn net.Conn) {
+// exitAfterOutput passes the requests of a backend session on, holding its exit
+// status back until outputDone is closed. Backends may report the exit before
+// the output has all been read, clients running many short commands, like
+// Ansible, take the exit as the end of the command and lose the rest.
+func exitAfterOutput(reqs <-chan *ssh.Request, outputDone <-chan struct{}) <-chan *ssh.Request {
+	out := make(chan *ssh.Request)
+
+	go func() {
+		defer close(out)
+
+		var held []*ssh.Request
+
+		for reqs != nil || (outputDone != nil && len(held) > 0) {
+			select {
+			case req, ok := <-reqs:
+				if !ok {
+					reqs = nil
+					continue
+				}
+
+				// Requests are still read meanwhile, the backend must not block
+				if outputDone != nil && (req.Type == "exit-status" || req.Type == "exit-signal") {
+					held = append(held, req)
+					continue
+				}
+
+				out <- req
+
+			case <-outputDone:
+				outputDone = nil
+
+				for _, req := range held {
+					out <- req
+				}
+
+				held = nil
+			}
+		}
+	}()
+
+	return out
+}
+
+// proxyChannelToConn proxies data between an SSH channel and a net.Conn,
+// shaped and accounted by cio. Both are closed once ctx is done.
+func (g *Gateway) proxyChannelToConn(
+	ctx context.Context,
+	channel ssh.Channel,
+	conn net.Conn,
+	cio *connIO,
+) {
+	stop := context.AfterFunc(ctx, func() {
+		_ = channel.Close()
+		_ = conn.Close()
+	})
+	defer stop()
+
 	var wg sync.WaitGroup
 	wg.Go(func() {
-		_, _ = io.Copy(channel, conn)
+		_, _ = io.Copy(channel, cio.downstream(conn))
 		_ = channel.CloseWrite()
 	})
 
-	_, _ = io.Copy(conn, channel)
+	_, _ = io.Copy(conn, cio.upstream(channel))
 	_ = conn.Close()
 
 	wg.Wait()
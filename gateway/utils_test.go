@@ -7,12 +7,15 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/zijiren233/sshgate/gateway"
 	"github.com/zijiren233/sshgate/registry"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
@@ -229,7 +232,7 @@ func TestExitStatusForwardingSequential(t *testing.T) {
 // runMockBackendServer runs a simple SSH server that accepts connections
 // and returns the specified exit code for any command
 func runMockBackendServer(
-	t *testing.T,
+	t testing.TB,
 	listener net.Listener,
 	hostKey ssh.Signer,
 	authorizedKey []byte,
@@ -237,6 +240,26 @@ func runMockBackendServer(
 ) {
 	t.Helper()
 
+	config := mockBackendConfig(t, hostKey, authorizedKey)
+	if config == nil {
+		return
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go handleMockBackendConnection(conn, config, defaultExitCode)
+	}
+}
+
+// mockBackendConfig returns the server config of the mock backend accepting
+// authorizedKey, given as an authorized key or a private key
+func mockBackendConfig(t testing.TB, hostKey ssh.Signer, authorizedKey []byte) *ssh.ServerConfig {
+	t.Helper()
+
 	// Parse the authorized public key
 	authorizedPubKey, _, _, _, err := ssh.ParseAuthorizedKey(authorizedKey)
 	if err != nil {
@@ -244,7 +267,7 @@ func runMockBackendServer(
 		signer, parseErr := ssh.ParsePrivateKey(authorizedKey)
 		if parseErr != nil {
 			t.Logf("Failed to parse authorized key: %v", parseErr)
-			return
+			return nil
 		}
 
 		authorizedPubKey = signer.PublicKey()
@@ -261,14 +284,7 @@ func runMockBackendServer(
 	}
 	config.AddHostKey(hostKey)
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			return
-		}
-
-		go handleMockBackendConnection(conn, config, defaultExitCode)
-	}
+	return config
 }
 
 func handleMockBackendConnection(conn net.Conn, config *ssh.ServerConfig, exitCode int) {
@@ -283,6 +299,19 @@ func handleMockBackendConnection(conn net.Conn, config *ssh.ServerConfig, exitCo
 	go ssh.DiscardRequests(reqs)
 
 	for newChannel := range chans {
+		// Forwarded ports of the mock backend echo what they receive
+		if newChannel.ChannelType() == "direct-tcpip" {
+			if ch, requests, err := newChannel.Accept(); err == nil {
+				go ssh.DiscardRequests(requests)
+				go func() {
+					defer ch.Close()
+					_, _ = io.Copy(ch, ch)
+				}()
+			}
+
+			continue
+		}
+
 		if newChannel.ChannelType() != "session" {
 			_ = newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
 			continue
@@ -296,9 +325,18 @@ func handleMockBackendConnection(conn net.Conn, config *ssh.ServerConfig, exitCo
 		go func(ch ssh.Channel, reqs <-chan *ssh.Request) {
 			defer ch.Close()
 
+			// env holds the environment variables set by the client
+			env := make(map[string]string)
+			// agentForwarded is set once the client asked for agent forwarding
+			agentForwarded := false
+			// received are the types of the requests received on the channel
+			var received []string
+
 			for req := range reqs {
+				received = append(received, req.Type)
+
 				switch req.Type {
-				case "exec", "shell":
+				case "exec", "shell", "subsystem":
 					if req.WantReply {
 						_ = req.Reply(true, nil)
 					}
@@ -314,9 +352,51 @@ func handleMockBackendConnection(conn net.Conn, config *ssh.ServerConfig, exitCo
 							if _, err := fmt.Sscanf(cmd, "exit %d", &parsedCode); err == nil {
 								actualExitCode = parsedCode
 							}
+
+							// "discard" consumes stdin until EOF before exiting
+							if cmd == "discard" {
+								_, _ = io.Copy(io.Discard, ch)
+							}
+
+							// "echo" sends stdin back until EOF before exiting
+							if cmd == "echo" {
+								_, _ = io.Copy(ch, ch)
+							}
+
+							// "printenv NAME" writes the value of an environment variable
+							if name, ok := strings.CutPrefix(cmd, "printenv "); ok {
+								_, _ = io.WriteString(ch, env[name])
+							}
+
+							// "requests" writes the types of the requests received so far
+							if cmd == "requests" {
+								_, _ = io.WriteString(ch, strings.Join(received, ","))
+							}
+
+							// "whoami" writes the user the gateway logged in as
+							if cmd == "whoami" {
+								_, _ = io.WriteString(ch, sshConn.User())
+							}
+
+							// "agent-list" writes the fingerprints of the forwarded agent
+							if cmd == "agent-list" {
+								_, _ = io.WriteString(ch, mockAgentList(sshConn, agentForwarded))
+							}
+
+							// "agent-hold" holds an agent channel until the gateway closes it
+							if cmd == "agent-hold" {
+								mockAgentHold(sshConn, ch)
+							}
 						}
 					}
 
+					// An "echo" subsystem sends stdin back until EOF, like "echo"
+					var subsystem struct{ Name string }
+					if req.Type == "subsystem" &&
+						ssh.Unmarshal(req.Payload, &subsystem) == nil && subsystem.Name == "echo" {
+						_, _ = io.Copy(ch, ch)
+					}
+
 					payload := make([]byte, 4)
 					//nolint:gosec // exit code is always 0-255 in tests
 					binary.BigEndian.PutUint32(payload, uint32(actualExitCode))
@@ -332,7 +412,24 @@ func handleMockBackendConnection(conn net.Conn, config *ssh.ServerConfig, exitCo
 
 					return
 
-				case "pty-req", "env":
+				case "env":
+					var kv struct{ Name, Value string }
+					if ssh.Unmarshal(req.Payload, &kv) == nil {
+						env[kv.Name] = kv.Value
+					}
+
+					if req.WantReply {
+						_ = req.Reply(true, nil)
+					}
+
+				case "pty-req":
+					if req.WantReply {
+						_ = req.Reply(true, nil)
+					}
+
+				case "auth-agent-req@openssh.com":
+					agentForwarded = true
+
 					if req.WantReply {
 						_ = req.Reply(true, nil)
 					}
@@ -347,6 +444,51 @@ func handleMockBackendConnection(conn net.Conn, config *ssh.ServerConfig, exitCo
 	}
 }
 
+// mockAgentList lists the identities of the agent forwarded to a backend
+// connection, one fingerprint per line
+func mockAgentList(conn ssh.Conn, forwarded bool) string {
+	if !forwarded {
+		return "no agent"
+	}
+
+	agentChannel, reqs, err := conn.OpenChannel("auth-agent@openssh.com", nil)
+	if err != nil {
+		return "agent unavailable"
+	}
+	defer agentChannel.Close()
+
+	go ssh.DiscardRequests(reqs)
+
+	keys, err := agent.NewClient(agentChannel).List()
+	if err != nil {
+		return "agent unavailable"
+	}
+
+	fingerprints := make([]string, 0, len(keys))
+	for _, key := range keys {
+		fingerprints = append(fingerprints, ssh.FingerprintSHA256(key))
+	}
+
+	return strings.Join(fingerprints, "\n")
+}
+
+// mockAgentHold opens an agent channel on a backend connection, writing "held"
+// then "released" to out once the gateway closes it
+func mockAgentHold(conn ssh.Conn, out io.Writer) {
+	agentChannel, reqs, err := conn.OpenChannel("auth-agent@openssh.com", nil)
+	if err != nil {
+		_, _ = io.WriteString(out, "agent unavailable\n")
+		return
+	}
+	defer agentChannel.Close()
+
+	go ssh.DiscardRequests(reqs)
+
+	_, _ = io.WriteString(out, "held\n")
+	_, _ = io.Copy(io.Discard, agentChannel)
+	_, _ = io.WriteString(out, "released\n")
+}
+
 // runSSHCommand connects to the gateway and runs a command, returning the exit code
 func runSSHCommand(t *testing.T, addr string, privateKey []byte, command string) (int, error) {
 	t.Helper()
@@ -396,7 +538,7 @@ func runSSHCommand(t *testing.T, addr string, privateKey []byte, command string)
 	return 0, nil
 }
 
-func mustAtoi(t *testing.T, s string) int {
+func mustAtoi(t testing.TB, s string) int {
 	t.Helper()
 
 	var n int
@@ -408,3 +550,170 @@ func mustAtoi(t *testing.T, s string) int {
 
 	return n
 }
+
+// backendTestEnv wires a registry, a mock backend SSH server and a gateway together
+type backendTestEnv struct {
+	reg             *registry.Registry
+	hostKey         ssh.Signer
+	backendKey      ssh.Signer
+	privBytes       []byte
+	backendListener *trackingListener
+	backendPort     int
+	exitCode        int
+	// execBackend runs the commands of sessions with the local shell, see
+	// runExecBackendServer, rather than the mock backend
+	execBackend bool
+	// gateway is set by start
+	gateway *gateway.Gateway
+}
+
+// newBackendTestEnv registers a devbox ns-test/test-devbox whose pod IP points to
+// a local listener for the mock backend server. In custom key mode the devbox
+// is selected with the username testuser@test-test-devbox. regOpts configure
+// the registry.
+func newBackendTestEnv(t testing.TB, regOpts ...registry.Option) *backendTestEnv {
+	t.Helper()
+
+	reg := registry.New(regOpts...)
+	hostKey, _, pubBytes, privBytes := generateTestKeys(t)
+	backendKey, _, _, _ := generateTestKeys(t)
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-secret",
+			Namespace: "ns-test",
+			Labels: map[string]string{
+				registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: registry.DevboxOwnerKind, Name: "test-devbox"},
+			},
+		},
+		Data: map[string][]byte{
+			registry.DevboxPublicKeyField:  pubBytes,
+			registry.DevboxPrivateKeyField: privBytes,
+		},
+	}
+	if err := reg.AddSecret(nil, secret); err != nil {
+		t.Fatalf("Failed to add secret: %v", err)
+	}
+
+	var lc net.ListenConfig
+
+	backendListener, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start backend listener: %v", err)
+	}
+
+	t.Cleanup(func() { backendListener.Close() })
+
+	_, backendPort, _ := net.SplitHostPort(backendListener.Addr().String())
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pod",
+			Namespace: "ns-test",
+			Labels: map[string]string{
+				registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: registry.DevboxOwnerKind, Name: "test-devbox"},
+			},
+		},
+		Status: corev1.PodStatus{
+			PodIP: "127.0.0.1",
+		},
+	}
+	if err := reg.UpdatePod(pod); err != nil {
+		t.Fatalf("Failed to update pod: %v", err)
+	}
+
+	return &backendTestEnv{
+		reg:             reg,
+		hostKey:         hostKey,
+		backendKey:      backendKey,
+		privBytes:       privBytes,
+		backendListener: &trackingListener{Listener: backendListener},
+		backendPort:     mustAtoi(t, backendPort),
+	}
+}
+
+// trackingListener records the connections accepted by the mock backend
+type trackingListener struct {
+	net.Listener
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	l.conns = append(l.conns, conn)
+	l.mu.Unlock()
+
+	return conn, nil
+}
+
+// accepted returns the number of accepted backend connections
+func (l *trackingListener) accepted() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.conns)
+}
+
+// dropAll closes every accepted backend connection
+func (l *trackingListener) dropAll() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, conn := range l.conns {
+		_ = conn.Close()
+	}
+}
+
+// start runs the mock backend server and a gateway accept loop,
+// returning the gateway listen address
+func (e *backendTestEnv) start(t testing.TB, opts ...gateway.Option) string {
+	t.Helper()
+
+	if e.execBackend {
+		go runExecBackendServer(t, e.backendListener, e.backendKey, e.privBytes)
+	} else {
+		go runMockBackendServer(t, e.backendListener, e.backendKey, e.privBytes, e.exitCode)
+	}
+
+	gw := gateway.New(e.hostKey, e.reg, append([]gateway.Option{
+		gateway.WithSSHBackendPort(e.backendPort),
+		gateway.WithSSHHandshakeTimeout(5 * time.Second),
+		gateway.WithBackendConnectTimeouts(5*time.Second, 5*time.Second),
+	}, opts...)...)
+	e.gateway = gw
+
+	var lc net.ListenConfig
+
+	gwListener, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start gateway listener: %v", err)
+	}
+
+	t.Cleanup(func() { gwListener.Close() })
+
+	go func() {
+		for {
+			conn, err := gwListener.Accept()
+			if err != nil {
+				return
+			}
+
+			go gw.HandleConnection(conn)
+		}
+	}()
+
+	return gwListener.Addr().String()
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/zijiren233/sshgate/config"
+	"github.com/zijiren233/sshgate/gateway"
+	"github.com/zijiren233/sshgate/hostkey"
+	"github.com/zijiren233/sshgate/kubeclient"
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Output formats of the hostkey command
+const (
+	hostKeyFormatKnownHosts     = "known_hosts"
+	hostKeyFormatFingerprint    = "fingerprint"
+	hostKeyFormatAuthorizedKeys = "authorized_keys"
+)
+
+// loadHostKeys loads the host key of the gateway and derives the keys of the
+// other configured types and of a rotation, returning the gateway options
+// serving them. client reads the host key secret, it may be nil when none is
+// configured.
+func loadHostKeys(
+	ctx context.Context,
+	cfg *config.Config,
+	client kubernetes.Interface,
+) (ssh.Signer, []gateway.Option, error) {
+	hostKeyOpts := []hostkey.Option{
+		hostkey.WithFile(cfg.SSHHostKeyFile),
+		hostkey.WithPEM(cfg.SSHHostKeyPEM),
+		hostkey.WithPassphrase(cfg.SSHHostKeyPassphrase),
+	}
+
+	if cfg.SSHHostKeySecret != "" {
+		namespace, name := cfg.SSHHostKeySecretRef()
+		hostKeyOpts = append(hostKeyOpts, hostkey.WithSecret(client, namespace, name))
+	}
+
+	// The seed is checked before any key is derived from it
+	checkSeed := func() error {
+		return hostkey.EnforceSeed(
+			cfg.SSHHostKeySeed, cfg.SSHHostKeySeedMinLength, cfg.SSHHostKeySeedStrictMode(),
+		)
+	}
+
+	fromSeed := cfg.SSHHostKeyFile == "" && cfg.SSHHostKeyPEM == "" && cfg.SSHHostKeySecret == ""
+	if fromSeed {
+		if err := checkSeed(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	hostKey, err := hostkey.LoadContext(ctx, cfg.SSHHostKeySeed, hostKeyOpts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("load host key: %w", err)
+	}
+
+	hostCert, err := hostkey.LoadCertificate(ctx, hostKey,
+		append(hostKeyOpts, hostkey.WithCertificateFile(cfg.SSHHostCertificateFile))...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Keys of the other configured types are derived from the seed once, RSA
+	// takes a while
+	hostKeyTypes, err := hostkey.ParseKeyTypes(cfg.SSHHostKeyTypes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	previousKeyTypes := slices.Clone(hostKeyTypes)
+	hostKeyTypes = slices.DeleteFunc(hostKeyTypes, func(t hostkey.KeyType) bool {
+		return t.PublicKeyType() == hostKey.PublicKey().Type()
+	})
+
+	// Along a host key read from a file, a PEM or a secret, keys are only
+	// derived from the seed when their types are listed, the default seed
+	// being well-known
+	if !fromSeed && !cfg.IsSet("SSH_HOST_KEY_TYPES") {
+		hostKeyTypes = nil
+	}
+
+	if !fromSeed && len(hostKeyTypes) > 0 {
+		if err := checkSeed(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	typedHostKeys, err := hostkey.GenerateDeterministicKeys(cfg.SSHHostKeySeed, hostKeyTypes...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var previousHostKeys []ssh.Signer
+
+	// Keys of the previous seeds are only derived while they are served
+	if graceUntil := cfg.SSHHostKeyGraceUntil(); time.Now().Before(graceUntil) {
+		for _, seed := range cfg.SSHHostKeyPreviousSeeds {
+			keys, err := hostkey.GenerateDeterministicKeys(seed, previousKeyTypes...)
+			if err != nil {
+				return nil, nil, fmt.Errorf("previous seed: %w", err)
+			}
+
+			previousHostKeys = append(previousHostKeys, keys...)
+		}
+	} else if len(cfg.SSHHostKeyPreviousSeeds) > 0 {
+		mainLog.WithField("grace_until", graceUntil.Format(time.RFC3339)).
+			Warn("Host key rotation grace period ended, previous seeds are ignored")
+	}
+
+	extraHostKeys, err := hostkey.LoadAll(cfg.SSHHostKeyExtraSeeds)
+	if err != nil {
+		return nil, nil, fmt.Errorf("load extra host keys: %w", err)
+	}
+
+	return hostKey, []gateway.Option{
+		gateway.WithHostKeys(typedHostKeys...),
+		gateway.WithHostCertificate(hostCert),
+		gateway.WithPreviousHostKeys(cfg.SSHHostKeyGraceUntil(), previousHostKeys...),
+		gateway.WithAdditionalHostKeys(extraHostKeys...),
+	}, nil
+}
+
+// runHostKeyCommand prints the host keys the gateway presents, as configured by
+// the environment and the flags in args, to provision clients before it is
+// deployed
+func runHostKeyCommand(ctx context.Context, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("hostkey", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: sshgate hostkey [flags]\n\n"+
+			"Prints the host keys the gateway presents, loaded from the same sources\n"+
+			"as the gateway, the SSH_HOST_KEY_* variables unless set by flags.\n\n")
+		flags.PrintDefaults()
+	}
+
+	format := flags.String("format", hostKeyFormatKnownHosts,
+		"output format: known_hosts, fingerprint or authorized_keys")
+	hostname := flags.String("hostname", "",
+		"host name, or host:port, of the known_hosts lines")
+	configFile := flags.String("config", "", "YAML configuration file of the gateway")
+	seed := flags.String("seed", "", "host key seed")
+	file := flags.String("file", "", "PEM file of the host key")
+	secret := flags.String("secret", "",
+		"secret holding the host key, namespace/name, created when missing")
+	kubeconfig := flags.String("kubeconfig", "", "kubeconfig of the cluster of the secret")
+	kubeContext := flags.String("context", "", "kubeconfig context")
+	types := flags.String("types", "",
+		"types of the host keys derived from the seed, comma separated")
+
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+
+		return err
+	}
+
+	var loadArgs []string
+	if *configFile != "" {
+		loadArgs = append(loadArgs, "--config", *configFile)
+	}
+
+	cfg, err := config.Load(loadArgs...)
+	if err != nil {
+		return fmt.Errorf("load configuration: %w", err)
+	}
+
+	// Flags set on the command line override the configuration
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "seed":
+			cfg.SSHHostKeySeed = *seed
+		case "file":
+			cfg.SSHHostKeyFile = *file
+		case "secret":
+			cfg.SSHHostKeySecret = *secret
+		case "kubeconfig":
+			cfg.Kubeconfig = *kubeconfig
+		case "context":
+			cfg.KubeContext = *kubeContext
+		case "types":
+			cfg.SSHHostKeyTypes = strings.Split(*types, ",")
+		}
+	})
+
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	if *format == hostKeyFormatKnownHosts && *hostname == "" {
+		return errors.New("--hostname is required for the known_hosts format")
+	}
+
+	var client kubernetes.Interface
+
+	if cfg.SSHHostKeySecret != "" {
+		kubeConfig, _, err := kubeclient.NewConfig(kubeClientOptions(cfg)...)
+		if err != nil {
+			return fmt.Errorf("create Kubernetes client: %w", err)
+		}
+
+		client, err = kubernetes.NewForConfig(kubeConfig)
+		if err != nil {
+			return fmt.Errorf("create Kubernetes client: %w", err)
+		}
+	}
+
+	hostKey, hostKeyOpts, err := loadHostKeys(ctx, cfg, client)
+	if err != nil {
+		return err
+	}
+
+	// The keys are picked by the gateway itself, as when serving
+	gw := gateway.New(hostKey, registry.New(), hostKeyOpts...)
+
+	return writeHostKeys(stdout, gw.HostKeys(), *format, *hostname)
+}
+
+// writeHostKeys writes a line per key in format
+func writeHostKeys(w io.Writer, keys []ssh.Signer, format, hostname string) error {
+	for _, key := range keys {
+		var line string
+
+		switch format {
+		case hostKeyFormatKnownHosts:
+			line = knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key.PublicKey())
+		case hostKeyFormatFingerprint:
+			line = ssh.FingerprintSHA256(key.PublicKey()) + " " + key.PublicKey().Type()
+		case hostKeyFormatAuthorizedKeys:
+			line = strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(key.PublicKey())), "\n")
+		default:
+			return fmt.Errorf("unknown format %q, must be known_hosts, fingerprint "+
+				"or authorized_keys", format)
+		}
+
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
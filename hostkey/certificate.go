@@ -0,0 +1,140 @@
+package hostkey
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// SecretCertificateField is the data field of the host key secret holding an
+// OpenSSH host certificate of the key, optional
+const SecretCertificateField = "ssh-certificate"
+
+// WithCertificateFile reads the host certificate of LoadCertificate from an
+// OpenSSH certificate file, as written by ssh-keygen -s, in place of the
+// certificate field of the host key secret. An empty path reads no file.
+func WithCertificateFile(path string) Option {
+	return func(o *options) {
+		o.certificateFile = path
+	}
+}
+
+// LoadCertificate loads the OpenSSH host certificate of signer, from the file of
+// WithCertificateFile, else from the SecretCertificateField of the secret of
+// WithSecret, and returns the signer presenting it. It returns nil when no
+// certificate is configured, and an error when the certificate is not a host
+// certificate of signer or is not valid now.
+func LoadCertificate(ctx context.Context, signer ssh.Signer, opts ...Option) (ssh.Signer, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	certBytes, err := o.loadCertificate(ctx)
+	if err != nil || certBytes == nil {
+		return nil, err
+	}
+
+	certSigner, err := NewCertSigner(signer, certBytes, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("host certificate: %w", err)
+	}
+
+	cert := Certificate(certSigner)
+
+	logger.WithFields(log.Fields{
+		"key_id":      cert.KeyId,
+		"principals":  cert.ValidPrincipals,
+		"fingerprint": ssh.FingerprintSHA256(cert.SignatureKey),
+		"expires":     CertificateExpiry(cert),
+	}).Info("Host certificate loaded")
+
+	return certSigner, nil
+}
+
+// loadCertificate returns the certificate of the file, else of the secret, nil
+// when none is configured
+func (o *options) loadCertificate(ctx context.Context) ([]byte, error) {
+	if o.certificateFile != "" {
+		certBytes, err := os.ReadFile(o.certificateFile)
+		if err != nil {
+			return nil, fmt.Errorf("read host certificate file: %w", err)
+		}
+
+		return certBytes, nil
+	}
+
+	if o.secretClient == nil {
+		return nil, nil
+	}
+
+	secret, err := o.secretClient.CoreV1().Secrets(o.secretNamespace).
+		Get(ctx, o.secretName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("host key secret %s/%s: %w", o.secretNamespace, o.secretName, err)
+	}
+
+	return secret.Data[SecretCertificateField], nil
+}
+
+// NewCertSigner returns signer presenting the OpenSSH host certificate
+// certBytes, checking that it certifies the key of signer and is valid at now
+func NewCertSigner(signer ssh.Signer, certBytes []byte, now time.Time) (ssh.Signer, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse certificate: %w", err)
+	}
+
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("not a certificate but a %s key", key.Type())
+	}
+
+	if cert.CertType != ssh.HostCert {
+		return nil, errors.New("not a host certificate")
+	}
+
+	if !bytes.Equal(cert.Key.Marshal(), signer.PublicKey().Marshal()) {
+		return nil, fmt.Errorf("certificate of key %s, not of the host key %s",
+			ssh.FingerprintSHA256(cert.Key), ssh.FingerprintSHA256(signer.PublicKey()))
+	}
+
+	validAfter := time.Unix(int64(cert.ValidAfter), 0) //nolint:gosec // times of certificates fit
+	if now.Before(validAfter) {
+		return nil, fmt.Errorf("certificate not valid before %s", validAfter.Format(time.RFC3339))
+	}
+
+	if expiry := CertificateExpiry(cert); !expiry.IsZero() && !now.Before(expiry) {
+		return nil, fmt.Errorf("certificate expired at %s", expiry.Format(time.RFC3339))
+	}
+
+	return ssh.NewCertSigner(cert, signer)
+}
+
+// Certificate returns the certificate presented by signer, nil when it presents
+// a plain key
+func Certificate(signer ssh.Signer) *ssh.Certificate {
+	cert, _ := signer.PublicKey().(*ssh.Certificate)
+	return cert
+}
+
+// CertificateExpiry returns when cert expires, the zero time when it never does
+func CertificateExpiry(cert *ssh.Certificate) time.Time {
+	if cert.ValidBefore == ssh.CertTimeInfinity {
+		return time.Time{}
+	}
+
+	return time.Unix(int64(cert.ValidBefore), 0) //nolint:gosec // times of certificates fit
+}
@@ -0,0 +1,183 @@
+package hostkey_test
+
+import (
+	"context"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/hostkey"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// hostCertificate returns a certificate of key of certType signed by a new CA,
+// valid from validAfter to validBefore, in authorized_keys format
+func hostCertificate(
+	t *testing.T,
+	key ssh.PublicKey,
+	certType uint32,
+	validAfter, validBefore time.Time,
+) []byte {
+	t.Helper()
+
+	ca, err := hostkey.GenerateDeterministicKey("ca")
+	if err != nil {
+		t.Fatalf("Failed to generate CA key: %v", err)
+	}
+
+	cert := &ssh.Certificate{
+		Key:      key,
+		CertType: certType,
+		KeyId:    "sshgate",
+		//nolint:gosec // test timestamps are always positive
+		ValidAfter: uint64(validAfter.Unix()),
+		//nolint:gosec // test timestamps are always positive
+		ValidBefore: uint64(validBefore.Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatalf("Failed to sign certificate: %v", err)
+	}
+
+	return ssh.MarshalAuthorizedKey(cert)
+}
+
+func TestNewCertSigner(t *testing.T) {
+	signer, err := hostkey.GenerateDeterministicKey("seed")
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	other, err := hostkey.GenerateDeterministicKey("other-seed")
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		cert    []byte
+		wantErr string
+	}{
+		{
+			name: "valid",
+			cert: hostCertificate(t, signer.PublicKey(), ssh.HostCert, now.Add(-time.Hour),
+				now.Add(time.Hour)),
+		},
+		{
+			name: "expired",
+			cert: hostCertificate(t, signer.PublicKey(), ssh.HostCert, now.Add(-2*time.Hour),
+				now.Add(-time.Hour)),
+			wantErr: "expired",
+		},
+		{
+			name: "not yet valid",
+			cert: hostCertificate(t, signer.PublicKey(), ssh.HostCert, now.Add(time.Hour),
+				now.Add(2*time.Hour)),
+			wantErr: "not valid before",
+		},
+		{
+			name: "other key",
+			cert: hostCertificate(t, other.PublicKey(), ssh.HostCert, now.Add(-time.Hour),
+				now.Add(time.Hour)),
+			wantErr: "not of the host key",
+		},
+		{
+			name: "user certificate",
+			cert: hostCertificate(t, signer.PublicKey(), ssh.UserCert, now.Add(-time.Hour),
+				now.Add(time.Hour)),
+			wantErr: "not a host certificate",
+		},
+		{
+			name:    "plain key",
+			cert:    ssh.MarshalAuthorizedKey(signer.PublicKey()),
+			wantErr: "not a certificate",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			certSigner, err := hostkey.NewCertSigner(signer, tt.cert, now)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("NewCertSigner() error = %v, want %q", err, tt.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("NewCertSigner() failed: %v", err)
+			}
+
+			if hostkey.Certificate(certSigner) == nil {
+				t.Error("NewCertSigner() returned a signer without certificate")
+			}
+		})
+	}
+}
+
+func TestLoadCertificate(t *testing.T) {
+	signer, err := hostkey.GenerateDeterministicKey("seed")
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	now := time.Now()
+	cert := hostCertificate(t, signer.PublicKey(), ssh.HostCert, now.Add(-time.Hour),
+		now.Add(time.Hour))
+
+	certFile := filepath.Join(t.TempDir(), "ssh_host_key-cert.pub")
+	if err := os.WriteFile(certFile, cert, 0o600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+
+	client := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "host-key", Namespace: "sshgate"},
+		Data:       map[string][]byte{hostkey.SecretCertificateField: cert},
+	})
+	noCertClient := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "host-key", Namespace: "sshgate"},
+	})
+
+	tests := []struct {
+		name     string
+		opts     []hostkey.Option
+		wantCert bool
+	}{
+		{name: "none"},
+		{
+			name:     "file",
+			opts:     []hostkey.Option{hostkey.WithCertificateFile(certFile)},
+			wantCert: true,
+		},
+		{
+			name:     "secret",
+			opts:     []hostkey.Option{hostkey.WithSecret(client, "sshgate", "host-key")},
+			wantCert: true,
+		},
+		{
+			name: "secret without certificate",
+			opts: []hostkey.Option{hostkey.WithSecret(noCertClient, "sshgate", "host-key")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			certSigner, err := hostkey.LoadCertificate(context.Background(), signer, tt.opts...)
+			if err != nil {
+				t.Fatalf("LoadCertificate() failed: %v", err)
+			}
+
+			if (certSigner != nil) != tt.wantCert {
+				t.Errorf("LoadCertificate() = %v, want a certificate: %v", certSigner, tt.wantCert)
+			}
+		})
+	}
+}
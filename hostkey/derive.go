@@ -0,0 +1,246 @@
+package hostkey
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha3"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"slices"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// KeyType is a type of host key derived from the seed
+type KeyType string
+
+const (
+	// KeyTypeED25519 is the ed25519 key of GenerateDeterministicKey
+	KeyTypeED25519 KeyType = "ed25519"
+	// KeyTypeECDSA is an ECDSA P-256 key
+	KeyTypeECDSA KeyType = "ecdsa"
+	// KeyTypeRSA is an RSA key of RSAKeyBits
+	KeyTypeRSA KeyType = "rsa"
+)
+
+// RSAKeyBits is the size of derived RSA keys
+const RSAKeyBits = 3072
+
+// rsaExponent is the public exponent of derived RSA keys
+const rsaExponent = 65537
+
+// PublicKeyType returns the SSH public key type of keys of the type
+func (t KeyType) PublicKeyType() string {
+	switch t {
+	case KeyTypeED25519:
+		return ssh.KeyAlgoED25519
+	case KeyTypeECDSA:
+		return ssh.KeyAlgoECDSA256
+	case KeyTypeRSA:
+		return ssh.KeyAlgoRSA
+	default:
+		return ""
+	}
+}
+
+// ParseKeyTypes parses host key type names, each listed once
+func ParseKeyTypes(names []string) ([]KeyType, error) {
+	types := make([]KeyType, 0, len(names))
+
+	for _, name := range names {
+		keyType := KeyType(name)
+
+		switch keyType {
+		case KeyTypeED25519, KeyTypeECDSA, KeyTypeRSA:
+		default:
+			return nil, fmt.Errorf("invalid host key type %q, must be ed25519, ecdsa or rsa", name)
+		}
+
+		if slices.Contains(types, keyType) {
+			return nil, fmt.Errorf("invalid host key types: %s listed twice", name)
+		}
+
+		types = append(types, keyType)
+	}
+
+	return types, nil
+}
+
+// GenerateDeterministicKeys derives a host key of each type from seed, in
+// order, logging how long each took. The ed25519 key is the one of
+// GenerateDeterministicKey, so that known_hosts entries of existing gateways
+// stay valid. The others are derived from independent key material expanded
+// from the seed with HKDF, replicas sharing the seed derive the same keys.
+func GenerateDeterministicKeys(seed string, types ...KeyType) ([]ssh.Signer, error) {
+	signers := make([]ssh.Signer, 0, len(types))
+
+	for _, keyType := range types {
+		start := time.Now()
+
+		signer, err := generateDeterministicKey(seed, keyType)
+		if err != nil {
+			return nil, fmt.Errorf("derive %s host key: %w", keyType, err)
+		}
+
+		logger.WithFields(log.Fields{
+			"type":        signer.PublicKey().Type(),
+			"fingerprint": GetFingerprint(signer),
+			"duration":    time.Since(start),
+		}).Info("Host key derived")
+
+		signers = append(signers, signer)
+	}
+
+	return signers, nil
+}
+
+// generateDeterministicKey derives the host key of keyType from seed
+func generateDeterministicKey(seed string, keyType KeyType) (ssh.Signer, error) {
+	var (
+		key crypto.Signer
+		err error
+	)
+
+	switch keyType {
+	case KeyTypeED25519:
+		return GenerateDeterministicKey(seed)
+	case KeyTypeECDSA:
+		key, err = deriveECDSAKey(seed)
+	case KeyTypeRSA:
+		key, err = deriveRSAKey(seed)
+	default:
+		return nil, fmt.Errorf("unknown host key type %q", keyType)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ssh.NewSignerFromSigner(key)
+}
+
+// keyMaterial expands seed into length bytes of key material for keyType
+func keyMaterial(seed string, keyType KeyType, length int) ([]byte, error) {
+	return hkdf.Key(sha256.New, []byte(seed), nil, "sshgate host key "+string(keyType), length)
+}
+
+// deriveECDSAKey derives a P-256 key, its scalar reduced into [1, n-1] from
+// key material longer than the order so that the bias is negligible
+func deriveECDSAKey(seed string) (*ecdsa.PrivateKey, error) {
+	curve := elliptic.P256()
+	order := curve.Params().N
+	size := (order.BitLen() + 7) / 8
+
+	material, err := keyMaterial(seed, KeyTypeECDSA, size+16)
+	if err != nil {
+		return nil, err
+	}
+
+	d := new(big.Int).SetBytes(material)
+	d.Mod(d, new(big.Int).Sub(order, big.NewInt(1)))
+	d.Add(d, big.NewInt(1))
+
+	return ecdsa.ParseRawPrivateKey(curve, d.FillBytes(make([]byte, size)))
+}
+
+// deriveRSAKey derives an RSA key of RSAKeyBits, its primes searched in the
+// output of SHAKE256 seeded with key material, as a DRBG
+func deriveRSAKey(seed string) (*rsa.PrivateKey, error) {
+	material, err := keyMaterial(seed, KeyTypeRSA, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	drbg := sha3.NewSHAKE256()
+	_, _ = drbg.Write(material)
+
+	for {
+		p, err := derivePrime(drbg, RSAKeyBits/2)
+		if err != nil {
+			return nil, err
+		}
+
+		q, err := derivePrime(drbg, RSAKeyBits/2)
+		if err != nil {
+			return nil, err
+		}
+
+		if p.Cmp(q) == 0 {
+			continue
+		}
+
+		key, err := rsaKeyFromPrimes(p, q)
+		if err != nil {
+			continue
+		}
+
+		return key, nil
+	}
+}
+
+// derivePrime returns the first prime of bits, with its two top bits set, at
+// or after a candidate read from drbg, that makes a valid RSA prime for
+// rsaExponent
+func derivePrime(drbg io.Reader, bits int) (*big.Int, error) {
+	buf := make([]byte, (bits+7)/8)
+	if _, err := io.ReadFull(drbg, buf); err != nil {
+		return nil, err
+	}
+
+	// The product of two such primes has exactly twice their bits
+	candidate := new(big.Int).SetBytes(buf)
+	candidate.SetBit(candidate, bits-1, 1)
+	candidate.SetBit(candidate, bits-2, 1)
+	candidate.SetBit(candidate, 0, 1)
+
+	e := big.NewInt(rsaExponent)
+	two := big.NewInt(2)
+	pMinus1 := new(big.Int)
+	gcd := new(big.Int)
+
+	for candidate.BitLen() == bits {
+		pMinus1.Sub(candidate, big.NewInt(1))
+
+		if gcd.GCD(nil, nil, e, pMinus1).IsInt64() && gcd.Int64() == 1 &&
+			candidate.ProbablyPrime(20) {
+			return candidate, nil
+		}
+
+		candidate.Add(candidate, two)
+	}
+
+	return nil, errors.New("no prime found")
+}
+
+// rsaKeyFromPrimes returns the RSA key of the primes p and q
+func rsaKeyFromPrimes(p, q *big.Int) (*rsa.PrivateKey, error) {
+	one := big.NewInt(1)
+	n := new(big.Int).Mul(p, q)
+	phi := new(big.Int).Mul(new(big.Int).Sub(p, one), new(big.Int).Sub(q, one))
+
+	d := new(big.Int).ModInverse(big.NewInt(rsaExponent), phi)
+	if d == nil {
+		return nil, errors.New("exponent not invertible")
+	}
+
+	key := &rsa.PrivateKey{
+		PublicKey: rsa.PublicKey{N: n, E: rsaExponent},
+		D:         d,
+		Primes:    []*big.Int{p, q},
+	}
+	key.Precompute()
+
+	if err := key.Validate(); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
@@ -0,0 +1,107 @@
+package hostkey_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"github.com/zijiren233/sshgate/hostkey"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestGenerateDeterministicKeys(t *testing.T) {
+	types := []hostkey.KeyType{hostkey.KeyTypeED25519, hostkey.KeyTypeECDSA, hostkey.KeyTypeRSA}
+
+	first, err := hostkey.GenerateDeterministicKeys("seed", types...)
+	if err != nil {
+		t.Fatalf("GenerateDeterministicKeys() failed: %v", err)
+	}
+
+	second, err := hostkey.GenerateDeterministicKeys("seed", types...)
+	if err != nil {
+		t.Fatalf("GenerateDeterministicKeys() failed: %v", err)
+	}
+
+	other, err := hostkey.GenerateDeterministicKeys("other-seed", types...)
+	if err != nil {
+		t.Fatalf("GenerateDeterministicKeys() failed: %v", err)
+	}
+
+	seen := make(map[string]hostkey.KeyType)
+
+	for i, keyType := range types {
+		fingerprint := hostkey.GetFingerprint(first[i])
+
+		if got := first[i].PublicKey().Type(); got != keyType.PublicKeyType() {
+			t.Errorf("%s key type = %s, want %s", keyType, got, keyType.PublicKeyType())
+		}
+
+		if hostkey.GetFingerprint(second[i]) != fingerprint {
+			t.Errorf("%s key differs between two derivations of the same seed", keyType)
+		}
+
+		if hostkey.GetFingerprint(other[i]) == fingerprint {
+			t.Errorf("%s key is the same for different seeds", keyType)
+		}
+
+		if previous, ok := seen[fingerprint]; ok {
+			t.Errorf("%s key is the same as the %s key", keyType, previous)
+		}
+
+		seen[fingerprint] = keyType
+
+		// The derived keys sign like any other
+		sig, err := first[i].Sign(rand.Reader, []byte("data"))
+		if err != nil {
+			t.Fatalf("%s key Sign() failed: %v", keyType, err)
+		}
+
+		if err := first[i].PublicKey().Verify([]byte("data"), sig); err != nil {
+			t.Errorf("%s key signature does not verify: %v", keyType, err)
+		}
+	}
+
+	// The ed25519 key stays the one of GenerateDeterministicKey for known_hosts
+	legacy, err := hostkey.GenerateDeterministicKey("seed")
+	if err != nil {
+		t.Fatalf("GenerateDeterministicKey() failed: %v", err)
+	}
+
+	if hostkey.GetFingerprint(first[0]) != hostkey.GetFingerprint(legacy) {
+		t.Error("Derived ed25519 key differs from GenerateDeterministicKey")
+	}
+
+	rsaKey, ok := first[2].PublicKey().(ssh.CryptoPublicKey).CryptoPublicKey().(*rsa.PublicKey)
+	if !ok {
+		t.Fatal("RSA key is not an RSA public key")
+	}
+
+	if bits := rsaKey.N.BitLen(); bits != hostkey.RSAKeyBits {
+		t.Errorf("RSA key size = %d, want %d", bits, hostkey.RSAKeyBits)
+	}
+}
+
+func TestParseKeyTypes(t *testing.T) {
+	tests := []struct {
+		name    string
+		names   []string
+		wantErr bool
+	}{
+		{name: "all", names: []string{"ed25519", "ecdsa", "rsa"}},
+		{name: "unknown", names: []string{"ed25519", "dsa"}, wantErr: true},
+		{name: "duplicate", names: []string{"rsa", "rsa"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			types, err := hostkey.ParseKeyTypes(tt.names)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseKeyTypes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if !tt.wantErr && len(types) != len(tt.names) {
+				t.Errorf("ParseKeyTypes() = %v, want %d types", types, len(tt.names))
+			}
+		})
+	}
+}
@@ -1,21 +1,171 @@
 package hostkey
 
 import (
+	"context"
 	"crypto/ed25519"
 	"crypto/sha256"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"os"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
+	"k8s.io/client-go/kubernetes"
 )
 
 var logger = log.WithField("component", "hostkey")
 
-// Load loads or generates a deterministic SSH host key based on seed
-func Load(seed string) (ssh.Signer, error) {
-	// Generate a deterministic key based on SSH_HOST_KEY_SEED
-	// This ensures multiple replicas generate the same key
-	return GenerateDeterministicKey(seed)
+// Source tells where a host key was loaded from
+type Source string
+
+const (
+	// SourceFile is a PEM file, see WithFile
+	SourceFile Source = "file"
+	// SourcePEM is a base64-encoded PEM, see WithPEM
+	SourcePEM Source = "pem"
+	// SourceSeed is derived from the seed, see GenerateDeterministicKey
+	SourceSeed Source = "seed"
+)
+
+// options are the key sources of Load, by priority
+type options struct {
+	file            string
+	pem             string
+	secretClient    kubernetes.Interface
+	secretNamespace string
+	secretName      string
+	passphrase      string
+	certificateFile string
+}
+
+// Option configures where Load reads the host key from
+type Option func(*options)
+
+// WithFile reads the host key from a PEM file, in place of the seed and of
+// WithPEM. An empty path reads no file.
+func WithFile(path string) Option {
+	return func(o *options) {
+		o.file = path
+	}
+}
+
+// WithPEM reads the host key from a base64-encoded PEM, as passed in the
+// environment, in place of the seed. An empty value reads no PEM.
+func WithPEM(encoded string) Option {
+	return func(o *options) {
+		o.pem = encoded
+	}
+}
+
+// WithPassphrase decrypts the host key read from a file, a PEM or a Secret
+func WithPassphrase(passphrase string) Option {
+	return func(o *options) {
+		o.passphrase = passphrase
+	}
+}
+
+// Load loads the SSH host key from the first source configured of a PEM file,
+// a base64-encoded PEM, a Secret and seed, from which a deterministic key is
+// derived. The type and fingerprint of the key are logged.
+func Load(seed string, opts ...Option) (ssh.Signer, error) {
+	return LoadContext(context.Background(), seed, opts...)
+}
+
+// LoadContext is Load, reading a Secret with ctx
+func LoadContext(ctx context.Context, seed string, opts ...Option) (ssh.Signer, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	signer, source, err := o.load(ctx, seed)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.WithFields(log.Fields{
+		"source":      source,
+		"type":        signer.PublicKey().Type(),
+		"fingerprint": GetFingerprint(signer),
+	}).Info("Host key loaded")
+
+	return signer, nil
+}
+
+// load returns the host key of the source of highest priority
+func (o *options) load(ctx context.Context, seed string) (ssh.Signer, Source, error) {
+	switch {
+	case o.file != "":
+		pemBytes, err := os.ReadFile(o.file)
+		if err != nil {
+			return nil, "", fmt.Errorf("read host key file: %w", err)
+		}
+
+		signer, err := parsePrivateKey(pemBytes, o.passphrase)
+		if err != nil {
+			return nil, "", fmt.Errorf("parse host key file %s: %w", o.file, err)
+		}
+
+		return signer, SourceFile, nil
+	case o.pem != "":
+		pemBytes, err := base64.StdEncoding.DecodeString(strings.TrimSpace(o.pem))
+		if err != nil {
+			return nil, "", fmt.Errorf("decode base64 host key PEM: %w", err)
+		}
+
+		signer, err := parsePrivateKey(pemBytes, o.passphrase)
+		if err != nil {
+			return nil, "", fmt.Errorf("parse host key PEM: %w", err)
+		}
+
+		return signer, SourcePEM, nil
+	case o.secretClient != nil:
+		signer, err := o.loadSecret(ctx)
+		return signer, SourceSecret, err
+	default:
+		signer, err := GenerateDeterministicKey(seed)
+		return signer, SourceSeed, err
+	}
+}
+
+// parsePrivateKey parses a PEM private key, decrypting it with passphrase when
+// it is encrypted
+func parsePrivateKey(pemBytes []byte, passphrase string) (ssh.Signer, error) {
+	signer, err := ssh.ParsePrivateKey(pemBytes)
+
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		return signer, err
+	}
+
+	if passphrase == "" {
+		return nil, errors.New("the key is encrypted and no passphrase is set")
+	}
+
+	signer, err = ssh.ParsePrivateKeyWithPassphrase(pemBytes, []byte(passphrase))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt: %w", err)
+	}
+
+	return signer, nil
+}
+
+// LoadAll loads a deterministic SSH host key for each seed, in order
+func LoadAll(seeds []string) ([]ssh.Signer, error) {
+	signers := make([]ssh.Signer, 0, len(seeds))
+
+	for _, seed := range seeds {
+		signer, err := Load(seed)
+		if err != nil {
+			return nil, err
+		}
+
+		signers = append(signers, signer)
+	}
+
+	return signers, nil
 }
 
 // GenerateDeterministicKey generates a deterministic ed25519 key from a seed string
@@ -31,11 +181,6 @@ func GenerateDeterministicKey(seed string) (ssh.Signer, error) {
 		return nil, fmt.Errorf("failed to create signer: %w", err)
 	}
 
-	// Log the public key fingerprint for verification
-	publicKey := signer.PublicKey()
-	fingerprint := ssh.FingerprintSHA256(publicKey)
-	logger.WithField("fingerprint", fingerprint).Info("Host key generated")
-
 	return signer, nil
 }
 
@@ -1,6 +1,13 @@
 package hostkey_test
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -128,3 +135,143 @@ func TestKeyType(t *testing.T) {
 		t.Errorf("Key type = %s, want ssh-ed25519", pubKey.Type())
 	}
 }
+
+func TestLoadAll(t *testing.T) {
+	signers, err := hostkey.LoadAll([]string{"current", "next"})
+	if err != nil {
+		t.Fatalf("LoadAll() failed: %v", err)
+	}
+
+	if len(signers) != 2 {
+		t.Fatalf("LoadAll() returned %d signers, want 2", len(signers))
+	}
+
+	next, err := hostkey.Load("next")
+	if err != nil {
+		t.Fatalf("Load() failed: %v", err)
+	}
+
+	if hostkey.GetFingerprint(signers[1]) != hostkey.GetFingerprint(next) {
+		t.Error("LoadAll() signers are not in seed order")
+	}
+}
+
+// encodedKey returns a fresh ECDSA private key as PEM, encrypted when
+// passphrase is set, along with its public key
+func encodedKey(t *testing.T, passphrase string) ([]byte, ssh.PublicKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	var block *pem.Block
+	if passphrase == "" {
+		block, err = ssh.MarshalPrivateKey(key, "")
+	} else {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(key, "", []byte(passphrase))
+	}
+
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	publicKey, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to create public key: %v", err)
+	}
+
+	return pem.EncodeToMemory(block), publicKey
+}
+
+func TestLoad_Sources(t *testing.T) {
+	filePEM, fileKey := encodedKey(t, "")
+	path := filepath.Join(t.TempDir(), "ssh_host_ecdsa_key")
+
+	if err := os.WriteFile(path, filePEM, 0o600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+
+	envPEM, envKey := encodedKey(t, "")
+	encoded := base64.StdEncoding.EncodeToString(envPEM)
+
+	encryptedPEM, encryptedKey := encodedKey(t, "hunter2")
+	encrypted := base64.StdEncoding.EncodeToString(encryptedPEM)
+
+	seedKey, err := hostkey.GenerateDeterministicKey("seed")
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		opts []hostkey.Option
+		want ssh.PublicKey
+	}{
+		{"seed", nil, seedKey.PublicKey()},
+		{"file", []hostkey.Option{hostkey.WithFile(path)}, fileKey},
+		{"pem", []hostkey.Option{hostkey.WithPEM(encoded)}, envKey},
+		{
+			"file over pem",
+			[]hostkey.Option{hostkey.WithFile(path), hostkey.WithPEM(encoded)},
+			fileKey,
+		},
+		{
+			"encrypted pem",
+			[]hostkey.Option{hostkey.WithPEM(encrypted), hostkey.WithPassphrase("hunter2")},
+			encryptedKey,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer, err := hostkey.Load("seed", tt.opts...)
+			if err != nil {
+				t.Fatalf("Load() failed: %v", err)
+			}
+
+			if got := hostkey.GetFingerprint(signer); got != ssh.FingerprintSHA256(tt.want) {
+				t.Errorf("Load() = %s, want %s", got, ssh.FingerprintSHA256(tt.want))
+			}
+		})
+	}
+}
+
+func TestLoad_InvalidKeys(t *testing.T) {
+	encryptedPEM, _ := encodedKey(t, "hunter2")
+	encrypted := base64.StdEncoding.EncodeToString(encryptedPEM)
+
+	tests := []struct {
+		name    string
+		opts    []hostkey.Option
+		wantErr string
+	}{
+		{
+			"missing file",
+			[]hostkey.Option{hostkey.WithFile(filepath.Join(t.TempDir(), "missing"))},
+			"read host key file",
+		},
+		{"not base64", []hostkey.Option{hostkey.WithPEM("not base64!")}, "decode base64"},
+		{
+			"not a key",
+			[]hostkey.Option{hostkey.WithPEM(base64.StdEncoding.EncodeToString([]byte("key")))},
+			"parse host key PEM",
+		},
+		{"no passphrase", []hostkey.Option{hostkey.WithPEM(encrypted)}, "no passphrase"},
+		{
+			"wrong passphrase",
+			[]hostkey.Option{hostkey.WithPEM(encrypted), hostkey.WithPassphrase("wrong")},
+			"decrypt",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := hostkey.Load("seed", tt.opts...)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Load() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
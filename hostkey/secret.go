@@ -0,0 +1,126 @@
+package hostkey
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// SecretPrivateKeyField is the data field of the host key secret holding
+	// the private key as PEM
+	SecretPrivateKeyField = corev1.SSHAuthPrivateKey
+	// SecretPublicKeyField is the data field of the host key secret holding the
+	// public key in authorized_keys format, for other components to consume
+	SecretPublicKeyField = "ssh-publickey"
+	// SecretFingerprintField is the data field of the host key secret holding
+	// the SHA256 fingerprint of the key
+	SecretFingerprintField = "fingerprint"
+)
+
+// SourceSecret is a Kubernetes Secret, see WithSecret
+const SourceSecret Source = "secret"
+
+// WithSecret reads the host key from the Secret namespace/name, in place of the
+// seed. When the Secret does not exist, a new ed25519 key is generated and the
+// Secret created with it, so that every replica of the gateway shares the key
+// of the first to start. WithFile and WithPEM take precedence.
+func WithSecret(client kubernetes.Interface, namespace, name string) Option {
+	return func(o *options) {
+		o.secretClient, o.secretNamespace, o.secretName = client, namespace, name
+	}
+}
+
+// loadSecret returns the host key of the Secret, creating the Secret with a
+// new key if it does not exist
+func (o *options) loadSecret(ctx context.Context) (ssh.Signer, error) {
+	secrets := o.secretClient.CoreV1().Secrets(o.secretNamespace)
+	ref := o.secretNamespace + "/" + o.secretName
+
+	secret, err := secrets.Get(ctx, o.secretName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		secret, err = o.createSecret(ctx)
+		// Another replica created the secret first, its key is the one to use
+		if apierrors.IsAlreadyExists(err) {
+			secret, err = secrets.Get(ctx, o.secretName, metav1.GetOptions{})
+		}
+	}
+
+	if apierrors.IsForbidden(err) {
+		return nil, fmt.Errorf(
+			"host key secret %s: the gateway needs get and create permissions on secrets "+
+				"in namespace %s: %w",
+			ref, o.secretNamespace, err,
+		)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("host key secret %s: %w", ref, err)
+	}
+
+	pemBytes, ok := secret.Data[SecretPrivateKeyField]
+	if !ok {
+		return nil, fmt.Errorf("host key secret %s has no %s field", ref, SecretPrivateKeyField)
+	}
+
+	signer, err := parsePrivateKey(pemBytes, o.passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("parse host key secret %s: %w", ref, err)
+	}
+
+	return signer, nil
+}
+
+// createSecret generates an ed25519 host key and creates the Secret holding it
+func (o *options) createSecret(ctx context.Context) (*corev1.Secret, error) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := ssh.MarshalPrivateKey(privateKey, "sshgate host key")
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      o.secretName,
+			Namespace: o.secretNamespace,
+			Labels:    map[string]string{"app.kubernetes.io/name": "sshgate"},
+		},
+		Type: corev1.SecretTypeSSHAuth,
+		Data: map[string][]byte{
+			SecretPrivateKeyField:  pem.EncodeToMemory(block),
+			SecretPublicKeyField:   ssh.MarshalAuthorizedKey(signer.PublicKey()),
+			SecretFingerprintField: []byte(GetFingerprint(signer)),
+		},
+	}
+
+	created, err := o.secretClient.CoreV1().Secrets(o.secretNamespace).
+		Create(ctx, secret, metav1.CreateOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	logger.WithFields(log.Fields{
+		"secret":      o.secretNamespace + "/" + o.secretName,
+		"fingerprint": GetFingerprint(signer),
+	}).Info("Host key generated and stored")
+
+	return created, nil
+}
@@ -0,0 +1,124 @@
+package hostkey_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/zijiren233/sshgate/hostkey"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// getHostKeySecret returns the host key secret of client
+func getHostKeySecret(t *testing.T, client *fake.Clientset) *corev1.Secret {
+	t.Helper()
+
+	secret, err := client.CoreV1().Secrets("sshgate").
+		Get(context.Background(), "host-key", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get secret failed: %v", err)
+	}
+
+	return secret
+}
+
+func TestLoad_SecretCreated(t *testing.T) {
+	client := fake.NewSimpleClientset()
+
+	signer, err := hostkey.Load("seed", hostkey.WithSecret(client, "sshgate", "host-key"))
+	if err != nil {
+		t.Fatalf("Load() failed: %v", err)
+	}
+
+	if signer.PublicKey().Type() != ssh.KeyAlgoED25519 {
+		t.Errorf("Generated key type = %s, want ed25519", signer.PublicKey().Type())
+	}
+
+	secret := getHostKeySecret(t, client)
+	fingerprint := hostkey.GetFingerprint(signer)
+
+	if got := string(secret.Data[hostkey.SecretFingerprintField]); got != fingerprint {
+		t.Errorf("Secret fingerprint = %s, want %s", got, fingerprint)
+	}
+
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(secret.Data[hostkey.SecretPublicKeyField])
+	if err != nil || ssh.FingerprintSHA256(publicKey) != fingerprint {
+		t.Errorf("Secret public key does not match the host key: %v", err)
+	}
+
+	// Other replicas read the key of the secret
+	again, err := hostkey.Load("seed", hostkey.WithSecret(client, "sshgate", "host-key"))
+	if err != nil {
+		t.Fatalf("Load() failed: %v", err)
+	}
+
+	if hostkey.GetFingerprint(again) != fingerprint {
+		t.Error("Second Load() returned another key")
+	}
+}
+
+func TestLoad_SecretRead(t *testing.T) {
+	keyPEM, publicKey := encodedKey(t, "")
+	client := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "host-key", Namespace: "sshgate"},
+		Data:       map[string][]byte{hostkey.SecretPrivateKeyField: keyPEM},
+	})
+
+	signer, err := hostkey.Load("seed", hostkey.WithSecret(client, "sshgate", "host-key"))
+	if err != nil {
+		t.Fatalf("Load() failed: %v", err)
+	}
+
+	if hostkey.GetFingerprint(signer) != ssh.FingerprintSHA256(publicKey) {
+		t.Error("Load() did not return the key of the secret")
+	}
+}
+
+func TestLoad_SecretCreationRace(t *testing.T) {
+	keyPEM, publicKey := encodedKey(t, "")
+	client := fake.NewSimpleClientset()
+
+	// Another replica creates the secret between the read and the creation
+	client.PrependReactor("create", "secrets",
+		func(action k8stesting.Action) (bool, runtime.Object, error) {
+			winner := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "host-key", Namespace: "sshgate"},
+				Data:       map[string][]byte{hostkey.SecretPrivateKeyField: keyPEM},
+			}
+			if err := client.Tracker().Add(winner); err != nil {
+				t.Errorf("Add secret failed: %v", err)
+			}
+
+			return true, nil, apierrors.NewAlreadyExists(
+				corev1.Resource("secrets"), "host-key")
+		})
+
+	signer, err := hostkey.Load("seed", hostkey.WithSecret(client, "sshgate", "host-key"))
+	if err != nil {
+		t.Fatalf("Load() failed: %v", err)
+	}
+
+	if hostkey.GetFingerprint(signer) != ssh.FingerprintSHA256(publicKey) {
+		t.Error("Load() did not return the key of the replica that won the race")
+	}
+}
+
+func TestLoad_SecretForbidden(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("get", "secrets",
+		func(k8stesting.Action) (bool, runtime.Object, error) {
+			return true, nil, apierrors.NewForbidden(
+				corev1.Resource("secrets"), "host-key", nil)
+		})
+
+	_, err := hostkey.Load("seed", hostkey.WithSecret(client, "sshgate", "host-key"))
+	if err == nil || !strings.Contains(err.Error(), "needs get and create permissions") {
+		t.Errorf("Load() error = %v, want a permission error", err)
+	}
+}
@@ -0,0 +1,121 @@
+package hostkey
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultSeed is the seed of the gateway when none is configured, anyone can
+// derive its host key
+const DefaultSeed = "sealos-devbox"
+
+// DefaultSeedMinLength is the minimum length of seeds, as generated by the chart
+const DefaultSeedMinLength = 32
+
+// minSeedEntropyBits is the minimum entropy of seeds, estimated from the
+// frequencies of their characters
+const minSeedEntropyBits = 64
+
+// weakSeeds are seeds guessed first, compared without case
+var weakSeeds = []string{
+	DefaultSeed, "devbox", "sealos", "sshgate", "seed", "secret", "password",
+	"changeme", "default", "test", "example",
+}
+
+// WeakSeedError tells why a seed is weak
+type WeakSeedError struct {
+	Reason string
+}
+
+func (e *WeakSeedError) Error() string {
+	return "weak host key seed: " + e.Reason
+}
+
+// CheckSeed returns a *WeakSeedError when seed is the default seed, a well-known
+// weak value, shorter than minLength or of too little entropy for its host key
+// to stay private
+func CheckSeed(seed string, minLength int) error {
+	if seed == DefaultSeed {
+		return &WeakSeedError{Reason: "it is the default seed " + DefaultSeed}
+	}
+
+	lower := strings.ToLower(strings.TrimSpace(seed))
+	for _, weak := range weakSeeds {
+		if lower == weak {
+			return &WeakSeedError{Reason: fmt.Sprintf("%q is a well-known value", seed)}
+		}
+	}
+
+	if length := len(seed); length < minLength {
+		return &WeakSeedError{
+			Reason: fmt.Sprintf("it is %d characters long, shorter than %d", length, minLength),
+		}
+	}
+
+	if bits := seedEntropyBits(seed); bits < minSeedEntropyBits {
+		return &WeakSeedError{
+			Reason: fmt.Sprintf("it has about %.0f bits of entropy, less than %d",
+				bits, minSeedEntropyBits),
+		}
+	}
+
+	return nil
+}
+
+// seedEntropyBits estimates the entropy of seed from the frequencies of its
+// bytes, so that repeated patterns count for little
+func seedEntropyBits(seed string) float64 {
+	counts := make(map[byte]int)
+	for i := range len(seed) {
+		counts[seed[i]]++
+	}
+
+	var perByte float64
+
+	for _, count := range counts {
+		p := float64(count) / float64(len(seed))
+		perByte -= p * math.Log2(p)
+	}
+
+	return perByte * float64(len(seed))
+}
+
+// EnforceSeed checks seed before any key is derived from it. When strict, a
+// weak seed is an error telling the operator what to do; otherwise a warning
+// with the fingerprint of the key anyone can derive is logged.
+func EnforceSeed(seed string, minLength int, strict bool) error {
+	err := CheckSeed(seed, minLength)
+	if err == nil {
+		return nil
+	}
+
+	if strict {
+		return fmt.Errorf(
+			"%w; anyone can derive the host private key from it. "+
+				"Set SSH_HOST_KEY_SEED to a random secret of at least %d characters, "+
+				"e.g. the output of `openssl rand -base64 48`, or load the host key with "+
+				"SSH_HOST_KEY_FILE, SSH_HOST_KEY_PEM or SSH_HOST_KEY_SECRET. "+
+				"Changing the seed changes the host key, list the old seed in "+
+				"SSH_HOST_KEY_PREVIOUS_SEEDS to keep it served during a grace period. "+
+				"To accept the seed anyway, in development only, set "+
+				"SSH_HOST_KEY_SEED_STRICT=false",
+			err, minLength,
+		)
+	}
+
+	entry := logger.WithError(err)
+
+	// The fingerprint tells which known_hosts entries trust the weak key
+	if signer, keyErr := GenerateDeterministicKey(seed); keyErr == nil {
+		entry = entry.WithField("fingerprint", GetFingerprint(signer))
+	}
+
+	entry.WithFields(log.Fields{"min_length": minLength}).
+		Warn("INSECURE HOST KEY SEED: anyone can derive the host private key, " +
+			"set SSH_HOST_KEY_SEED to a random secret before serving real users")
+
+	return nil
+}
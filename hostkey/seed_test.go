@@ -0,0 +1,91 @@
+package hostkey_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/zijiren233/sshgate/hostkey"
+)
+
+func TestCheckSeed(t *testing.T) {
+	tests := []struct {
+		name    string
+		seed    string
+		wantErr string
+	}{
+		{name: "default", seed: hostkey.DefaultSeed, wantErr: "default seed"},
+		{name: "well-known", seed: "ChangeMe", wantErr: "well-known"},
+		{name: "short", seed: "k3J9w-Qz7vN8rT1y", wantErr: "shorter than 32"},
+		{name: "repeated", seed: strings.Repeat("a", 48), wantErr: "entropy"},
+		{name: "pattern", seed: strings.Repeat("ab", 24), wantErr: "entropy"},
+		{name: "random", seed: "Zq4vN8rT1xLk6bWc3yHs9dGf2mJp7aUe"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := hostkey.CheckSeed(tt.seed, hostkey.DefaultSeedMinLength)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("CheckSeed() = %v, want nil", err)
+				}
+
+				return
+			}
+
+			var weak *hostkey.WeakSeedError
+			if !errors.As(err, &weak) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("CheckSeed() = %v, want a weak seed error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	// The minimum length is configurable
+	if err := hostkey.CheckSeed("k3J9w-Qz7vN8rT1y", 16); err != nil {
+		t.Errorf("CheckSeed() with min length 16 = %v, want nil", err)
+	}
+}
+
+func TestEnforceSeed(t *testing.T) {
+	hook := logtest.NewGlobal()
+	t.Cleanup(hook.Reset)
+
+	err := hostkey.EnforceSeed(hostkey.DefaultSeed, hostkey.DefaultSeedMinLength, true)
+
+	var weak *hostkey.WeakSeedError
+	if !errors.As(err, &weak) || !strings.Contains(err.Error(), "Set SSH_HOST_KEY_SEED") {
+		t.Errorf("Strict EnforceSeed() = %v, want a weak seed error telling what to do", err)
+	}
+
+	if len(hook.AllEntries()) != 0 {
+		t.Error("Strict EnforceSeed() logged, want only an error")
+	}
+
+	err = hostkey.EnforceSeed(hostkey.DefaultSeed, hostkey.DefaultSeedMinLength, false)
+	if err != nil {
+		t.Fatalf("Lenient EnforceSeed() = %v, want nil", err)
+	}
+
+	signer, err := hostkey.GenerateDeterministicKey(hostkey.DefaultSeed)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	entry := hook.LastEntry()
+	if entry == nil || entry.Level != log.WarnLevel ||
+		entry.Data["fingerprint"] != hostkey.GetFingerprint(signer) {
+		t.Errorf("Lenient EnforceSeed() logged %v, want a warning with the fingerprint", entry)
+	}
+
+	hook.Reset()
+
+	if err := hostkey.EnforceSeed("Zq4vN8rT1xLk6bWc3yHs9dGf2mJp7aUe", 32, true); err != nil {
+		t.Errorf("EnforceSeed() of a strong seed = %v, want nil", err)
+	}
+
+	if len(hook.AllEntries()) != 0 {
+		t.Error("EnforceSeed() of a strong seed logged a warning")
+	}
+}
@@ -0,0 +1,157 @@
+package main_test
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/gateway"
+	"github.com/zijiren233/sshgate/hostkey"
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// startGateway serves the host keys derived from seed on a loopback port,
+// returning its address
+func startGateway(t *testing.T, seed string, types ...hostkey.KeyType) string {
+	t.Helper()
+
+	keys, err := hostkey.GenerateDeterministicKeys(seed, types...)
+	if err != nil {
+		t.Fatalf("GenerateDeterministicKeys() failed: %v", err)
+	}
+
+	gw := gateway.New(keys[0], registry.New(), gateway.WithHostKeys(keys[1:]...))
+
+	var lc net.ListenConfig
+
+	ln, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start gateway listener: %v", err)
+	}
+
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go gw.HandleConnection(conn)
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// presentedHostKey returns the host key the gateway at addr presents for
+// algorithm, checked with callback
+func presentedHostKey(
+	t *testing.T,
+	addr, algorithm string,
+	callback ssh.HostKeyCallback,
+) (ssh.PublicKey, error) {
+	t.Helper()
+
+	var d net.Dialer
+
+	nConn, err := d.DialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial gateway: %v", err)
+	}
+	defer nConn.Close()
+
+	var presented ssh.PublicKey
+
+	var checkErr error
+
+	// Authentication fails without devboxes, the host key is checked before
+	_, _, _, _ = ssh.NewClientConn(nConn, addr, &ssh.ClientConfig{
+		User:              "testuser",
+		HostKeyAlgorithms: []string{algorithm},
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			presented = key
+			checkErr = callback(hostname, remote, key)
+
+			return checkErr
+		},
+		Timeout: 5 * time.Second,
+	})
+
+	if presented == nil {
+		t.Fatalf("Gateway presented no host key for %s", algorithm)
+	}
+
+	return presented, checkErr
+}
+
+func TestHostKeyCommand_MatchesHandshake(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the gateway")
+	}
+
+	binary := filepath.Join(t.TempDir(), "sshgate")
+
+	build := exec.CommandContext(context.Background(), "go", "build", "-o", binary, ".")
+	if output, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("go build failed: %v\n%s", err, output)
+	}
+
+	addr := startGateway(t, "test-seed", hostkey.KeyTypeED25519, hostkey.KeyTypeECDSA)
+
+	hostKeyCommand := func(format string) string {
+		cmd := exec.CommandContext(context.Background(), binary, "hostkey",
+			"--seed", "test-seed",
+			"--types", "ed25519,ecdsa",
+			"--format", format,
+			"--hostname", addr,
+		)
+		// The test seed is weak, as in development
+		cmd.Env = append(os.Environ(), "SSH_HOST_KEY_SEED_STRICT=false")
+		cmd.Stderr = os.Stderr
+
+		output, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("sshgate hostkey --format %s failed: %v", format, err)
+		}
+
+		return string(output)
+	}
+
+	knownHostsFile := filepath.Join(t.TempDir(), "known_hosts")
+
+	err := os.WriteFile(knownHostsFile, []byte(hostKeyCommand("known_hosts")), 0o600)
+	if err != nil {
+		t.Fatalf("Failed to write known_hosts: %v", err)
+	}
+
+	callback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		t.Fatalf("Failed to parse the known_hosts output: %v", err)
+	}
+
+	var fingerprints []string
+
+	for _, algorithm := range []string{ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256} {
+		key, err := presentedHostKey(t, addr, algorithm, callback)
+		if err != nil {
+			t.Errorf("Host key presented for %s is not in the known_hosts output: %v",
+				algorithm, err)
+		}
+
+		fingerprints = append(fingerprints, ssh.FingerprintSHA256(key)+" "+key.Type())
+	}
+
+	want := strings.Join(fingerprints, "\n") + "\n"
+	if got := hostKeyCommand("fingerprint"); got != want {
+		t.Errorf("Fingerprint output = %q, want %q", got, want)
+	}
+}
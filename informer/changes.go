@@ -0,0 +1,107 @@
+package informer
+
+import (
+	"bytes"
+	"maps"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// secretChanged reports whether an updated secret differs from the old one in
+// what the registry reads: its data, labels, annotations and owners. Resyncs
+// and changes of other fields are skipped.
+func secretChanged(oldSecret, newSecret *corev1.Secret) bool {
+	if oldSecret == nil || oldSecret.ResourceVersion == "" {
+		return true
+	}
+
+	if oldSecret.ResourceVersion == newSecret.ResourceVersion {
+		return false
+	}
+
+	return !maps.EqualFunc(oldSecret.Data, newSecret.Data, bytes.Equal) ||
+		objectMetaChanged(&oldSecret.ObjectMeta, &newSecret.ObjectMeta)
+}
+
+// podChanged reports whether an updated pod differs from the old one in what
+// the registry reads: its IPs, phase, readiness, container limits, deletion,
+// labels, annotations and owners. Resyncs and status heartbeats are skipped.
+func podChanged(oldPod, newPod *corev1.Pod) bool {
+	if oldPod == nil || oldPod.ResourceVersion == "" {
+		return true
+	}
+
+	if oldPod.ResourceVersion == newPod.ResourceVersion {
+		return false
+	}
+
+	oldReady, oldReported := podReadyCondition(oldPod)
+	newReady, newReported := podReadyCondition(newPod)
+
+	return oldPod.UID != newPod.UID ||
+		oldPod.Status.PodIP != newPod.Status.PodIP ||
+		!equality.Semantic.DeepEqual(oldPod.Status.PodIPs, newPod.Status.PodIPs) ||
+		oldPod.Status.Phase != newPod.Status.Phase ||
+		oldReady != newReady || oldReported != newReported ||
+		!oldPod.DeletionTimestamp.Equal(newPod.DeletionTimestamp) ||
+		!containerLimitsEqual(oldPod.Spec.Containers, newPod.Spec.Containers) ||
+		objectMetaChanged(&oldPod.ObjectMeta, &newPod.ObjectMeta)
+}
+
+// endpointSliceChanged reports whether an updated EndpointSlice differs from
+// the old one in what the registry reads: its endpoints, ports, labels,
+// annotations and owners. Resyncs are skipped.
+func endpointSliceChanged(oldSlice, newSlice *discoveryv1.EndpointSlice) bool {
+	if oldSlice == nil || oldSlice.ResourceVersion == "" {
+		return true
+	}
+
+	if oldSlice.ResourceVersion == newSlice.ResourceVersion {
+		return false
+	}
+
+	return !equality.Semantic.DeepEqual(oldSlice.Endpoints, newSlice.Endpoints) ||
+		!equality.Semantic.DeepEqual(oldSlice.Ports, newSlice.Ports) ||
+		objectMetaChanged(&oldSlice.ObjectMeta, &newSlice.ObjectMeta)
+}
+
+// objectMetaChanged reports whether the labels, annotations or owners of an
+// object changed
+func objectMetaChanged(oldMeta, newMeta *metav1.ObjectMeta) bool {
+	return !maps.Equal(oldMeta.Labels, newMeta.Labels) ||
+		!maps.Equal(oldMeta.Annotations, newMeta.Annotations) ||
+		!equality.Semantic.DeepEqual(oldMeta.OwnerReferences, newMeta.OwnerReferences)
+}
+
+// podReadyCondition returns whether the Ready condition of pod is true and
+// whether the pod reports it at all
+func podReadyCondition(pod *corev1.Pod) (ready, reported bool) {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue, true
+		}
+	}
+
+	return false, false
+}
+
+// containerLimitsEqual reports whether containers have the same resource limits
+func containerLimitsEqual(oldContainers, newContainers []corev1.Container) bool {
+	if len(oldContainers) != len(newContainers) {
+		return false
+	}
+
+	for i := range oldContainers {
+		if !equality.Semantic.DeepEqual(
+			oldContainers[i].Resources.Limits,
+			newContainers[i].Resources.Limits,
+		) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,177 @@
+package informer_test
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/zijiren233/sshgate/informer"
+	"github.com/zijiren233/sshgate/registry"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// operations returns how many times the registry applied operation
+func operations(t *testing.T, gatherer prometheus.Gatherer, operation string) float64 {
+	t.Helper()
+
+	families, err := gatherer.Gather()
+	if err != nil {
+		t.Fatalf("Gather failed: %v", err)
+	}
+
+	for _, family := range families {
+		if family.GetName() != "sshgate_registry_operations_total" {
+			continue
+		}
+
+		for _, metric := range family.GetMetric() {
+			for _, pair := range metric.GetLabel() {
+				if pair.GetName() == "operation" && pair.GetValue() == operation {
+					return metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+
+	return 0
+}
+
+// newCountingManager returns a manager whose registry counts its operations
+func newCountingManager() (*informer.Manager, prometheus.Gatherer) {
+	gatherer := prometheus.NewRegistry()
+	reg := registry.New(registry.WithMetrics(gatherer))
+
+	return informer.New(fake.NewSimpleClientset(), reg), gatherer
+}
+
+func TestHandlePodUpdate_SkipsNoOps(t *testing.T) {
+	_, pod := labeledDevbox(t, "devbox", nil)
+	pod.ResourceVersion = "1"
+	pod.Status.Conditions = []corev1.PodCondition{
+		{Type: corev1.PodReady, Status: corev1.ConditionTrue},
+	}
+
+	tests := []struct {
+		name    string
+		update  func(*corev1.Pod)
+		applied bool
+	}{
+		{name: "resync", update: func(*corev1.Pod) {}},
+		{
+			name: "status heartbeat",
+			update: func(p *corev1.Pod) {
+				p.ResourceVersion = "2"
+				p.Status.Conditions[0].LastProbeTime = metav1.Now()
+			},
+		},
+		{
+			name: "pod IP",
+			update: func(p *corev1.Pod) {
+				p.ResourceVersion = "2"
+				p.Status.PodIP = "10.0.0.2"
+			},
+			applied: true,
+		},
+		{
+			name: "readiness",
+			update: func(p *corev1.Pod) {
+				p.ResourceVersion = "2"
+				p.Status.Conditions[0].Status = corev1.ConditionFalse
+			},
+			applied: true,
+		},
+		{
+			name: "annotation",
+			update: func(p *corev1.Pod) {
+				p.ResourceVersion = "2"
+				p.Annotations = map[string]string{registry.SFTPOnlyAnnotation: "true"}
+			},
+			applied: true,
+		},
+		{
+			name: "deletion",
+			update: func(p *corev1.Pod) {
+				p.ResourceVersion = "2"
+				p.DeletionTimestamp = &metav1.Time{}
+			},
+			applied: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr, gatherer := newCountingManager()
+
+			updated := pod.DeepCopy()
+			tt.update(updated)
+			mgr.HandlePodUpdate(pod, updated)
+
+			want := 0.0
+			if tt.applied {
+				want = 1
+			}
+
+			if got := operations(t, gatherer, registry.OperationUpdatePod); got != want {
+				t.Errorf("UpdatePod applied %v times, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestHandleSecretUpdate_SkipsNoOps(t *testing.T) {
+	secret, _ := labeledDevbox(t, "devbox", nil)
+	secret.ResourceVersion = "1"
+
+	pubBytes, _ := generateTestKeys(t)
+
+	tests := []struct {
+		name    string
+		update  func(*corev1.Secret)
+		applied bool
+	}{
+		{name: "resync", update: func(*corev1.Secret) {}},
+		{
+			name: "unread metadata",
+			update: func(s *corev1.Secret) {
+				s.ResourceVersion = "2"
+				s.ManagedFields = []metav1.ManagedFieldsEntry{{Manager: "kubectl"}}
+			},
+		},
+		{
+			name: "key data",
+			update: func(s *corev1.Secret) {
+				s.ResourceVersion = "2"
+				s.Data[registry.DevboxPublicKeyField] = pubBytes
+			},
+			applied: true,
+		},
+		{
+			name: "annotation",
+			update: func(s *corev1.Secret) {
+				s.ResourceVersion = "2"
+				s.Annotations = map[string]string{registry.ForceCommandAnnotation: "true"}
+			},
+			applied: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr, gatherer := newCountingManager()
+
+			updated := secret.DeepCopy()
+			tt.update(updated)
+			mgr.HandleSecretUpdate(secret, updated)
+
+			want := 0.0
+			if tt.applied {
+				want = 1
+			}
+
+			if got := operations(t, gatherer, registry.OperationAddSecret); got != want {
+				t.Errorf("AddSecret applied %v times, want %v", got, want)
+			}
+		})
+	}
+}
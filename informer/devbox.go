@@ -0,0 +1,160 @@
+package informer
+
+import (
+	"fmt"
+	"slices"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zijiren233/sshgate/registry"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// DefaultDevboxResource is the Devbox custom resource of Sealos
+var DefaultDevboxResource = schema.GroupVersionResource{
+	Group:    "devbox.sealos.io",
+	Version:  "v1alpha1",
+	Resource: "devboxes",
+}
+
+// devboxSSHPortName names the container port of the SSH server in the ports of
+// Devbox custom resources
+const devboxSSHPortName = "devbox-ssh-port"
+
+// WithDevboxResource watches the Devbox custom resources of resource with
+// client. The desired state, display name and SSH port of devboxes are read
+// from their spec.state, spec.displayName and spec.config.ports. Without the
+// resource on the cluster, devboxes are only known from their secrets and pods.
+func WithDevboxResource(client dynamic.Interface, resource schema.GroupVersionResource) Option {
+	return func(m *Manager) {
+		m.dynamicClient, m.devboxResource = client, resource
+	}
+}
+
+// devboxResourceServed reports whether the cluster serves the Devbox custom
+// resource, logging why not
+func (m *Manager) devboxResourceServed() bool {
+	logger := m.logger.WithField("resource", m.devboxResource.String())
+
+	resources, err := m.clientset.Discovery().ServerResourcesForGroupVersion(
+		m.devboxResource.GroupVersion().String(),
+	)
+	if err != nil {
+		logger.WithError(err).Warn("Devbox resource unavailable, only reading secrets and pods")
+
+		return false
+	}
+
+	served := slices.ContainsFunc(resources.APIResources, func(resource metav1.APIResource) bool {
+		return resource.Name == m.devboxResource.Resource
+	})
+	if !served {
+		logger.Warn("Devbox resource not served, only reading secrets and pods")
+	}
+
+	return served
+}
+
+// setupDevboxResourceInformer sets up the Devbox custom resource informer of a
+// factory watching namespace
+func (m *Manager) setupDevboxResourceInformer(namespace string) (cache.SharedIndexInformer, error) {
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(
+		m.dynamicClient,
+		m.resyncPeriod,
+		namespace,
+		nil,
+	)
+	m.dynamicFactories = append(m.dynamicFactories, factory)
+
+	informer := factory.ForResource(m.devboxResource).Informer()
+
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    m.handleDevboxAdd,
+		UpdateFunc: m.handleDevboxUpdate,
+		DeleteFunc: m.handleDevboxDelete,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return informer, nil
+}
+
+// devboxFromObject reads a Devbox custom resource
+func devboxFromObject(obj *unstructured.Unstructured) registry.Devbox {
+	devbox := registry.Devbox{
+		Namespace: obj.GetNamespace(),
+		Name:      obj.GetName(),
+	}
+
+	state, _, _ := unstructured.NestedString(obj.Object, "spec", "state")
+	devbox.DesiredState = registry.ParseDesiredState(state)
+	devbox.DisplayName, _, _ = unstructured.NestedString(obj.Object, "spec", "displayName")
+
+	ports, _, _ := unstructured.NestedSlice(obj.Object, "spec", "config", "ports")
+	for _, port := range ports {
+		port, ok := port.(map[string]any)
+		if !ok || port["name"] != devboxSSHPortName {
+			continue
+		}
+
+		if containerPort, ok, _ := unstructured.NestedInt64(port, "containerPort"); ok &&
+			containerPort > 0 && containerPort <= 65535 {
+			devbox.SSHPort = int(containerPort)
+		}
+	}
+
+	return devbox
+}
+
+// Event handlers for Devbox custom resources
+func (m *Manager) handleDevboxAdd(obj any) {
+	defer m.metrics.event(KindDevbox, ActionAdd)()
+
+	m.updateDevbox(obj, ActionAdd)
+}
+
+func (m *Manager) handleDevboxUpdate(_, newObj any) {
+	defer m.metrics.event(KindDevbox, ActionUpdate)()
+
+	m.updateDevbox(newObj, ActionUpdate)
+}
+
+func (m *Manager) updateDevbox(obj any, action string) {
+	devbox, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		m.metrics.handlerError(KindDevbox, action)
+		m.logger.WithField("type", fmt.Sprintf("%T", obj)).
+			Error("Expected *unstructured.Unstructured")
+		return
+	}
+
+	m.registry.UpdateDevbox(devboxFromObject(devbox))
+}
+
+func (m *Manager) handleDevboxDelete(obj any) {
+	defer m.metrics.event(KindDevbox, ActionDelete)()
+
+	// The informer may have missed the deletion, only knowing the last state
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	devbox, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		m.metrics.handlerError(KindDevbox, ActionDelete)
+		m.logger.WithField("type", fmt.Sprintf("%T", obj)).
+			Error("Expected *unstructured.Unstructured")
+		return
+	}
+
+	m.logger.WithFields(log.Fields{
+		"namespace": devbox.GetNamespace(),
+		"devbox":    devbox.GetName(),
+	}).Debug("Devbox resource deleted")
+	m.registry.DeleteDevbox(devbox.GetNamespace(), devbox.GetName())
+}
@@ -0,0 +1,201 @@
+package informer_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/informer"
+	"github.com/zijiren233/sshgate/registry"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// devboxResource returns a Devbox custom resource in the default namespace
+func devboxResource(name, state, displayName string, sshPort int64) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "devbox.sealos.io/v1alpha1",
+		"kind":       "Devbox",
+		"metadata": map[string]any{
+			"namespace": "default",
+			"name":      name,
+		},
+		"spec": map[string]any{
+			"state":       state,
+			"displayName": displayName,
+			"config": map[string]any{
+				"ports": []any{
+					map[string]any{"name": "http", "containerPort": int64(8080)},
+					map[string]any{"name": "devbox-ssh-port", "containerPort": sshPort},
+				},
+			},
+		},
+	}}
+}
+
+// newDynamicClient returns a dynamic client serving the Devbox custom resources
+// devboxes, created rather than tracked as the tracker would guess their
+// resource from their kind
+func newDynamicClient(t *testing.T, devboxes ...*unstructured.Unstructured) dynamic.Interface {
+	t.Helper()
+
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(
+		runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{informer.DefaultDevboxResource: "DevboxList"},
+	)
+
+	for _, devbox := range devboxes {
+		_, err := client.Resource(informer.DefaultDevboxResource).
+			Namespace(devbox.GetNamespace()).
+			Create(context.Background(), devbox, metav1.CreateOptions{})
+		if err != nil {
+			t.Fatalf("Create() failed: %v", err)
+		}
+	}
+
+	return client
+}
+
+// servingDevboxResource makes clientset discover the Devbox custom resource
+func servingDevboxResource(clientset *fake.Clientset) {
+	clientset.Resources = []*metav1.APIResourceList{{
+		GroupVersion: informer.DefaultDevboxResource.GroupVersion().String(),
+		APIResources: []metav1.APIResource{{
+			Name:       informer.DefaultDevboxResource.Resource,
+			Namespaced: true,
+			Kind:       "Devbox",
+		}},
+	}}
+}
+
+// waitForDevbox waits for the devbox of reg named name to satisfy cond
+func waitForDevbox(
+	ctx context.Context,
+	t *testing.T,
+	reg *registry.Registry,
+	name string,
+	cond func(*registry.DevboxInfo, bool) bool,
+) {
+	t.Helper()
+
+	for {
+		if cond(reg.GetDevboxInfo("default", name)) {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			t.Fatalf("Devbox %s not updated", name)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestStartWithDevboxResource(t *testing.T) {
+	secret, pod := labeledDevbox(t, "devbox", nil)
+	clientset := fake.NewSimpleClientset(secret, pod)
+	servingDevboxResource(clientset)
+
+	dynamicClient := newDynamicClient(t, devboxResource("devbox", "Stopped", "My devbox", 2222))
+	devboxes := dynamicClient.Resource(informer.DefaultDevboxResource).Namespace("default")
+
+	reg := registry.New()
+	mgr := informer.New(clientset, reg,
+		informer.WithDevboxResource(dynamicClient, informer.DefaultDevboxResource),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := mgr.Start(ctx); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer mgr.Stop()
+
+	info, ok := reg.GetDevboxInfo("default", "devbox")
+	if !ok {
+		t.Fatal("Devbox not registered")
+	}
+
+	if info.DesiredState != registry.DesiredStateStopped || info.DisplayName != "My devbox" ||
+		info.SSHPort != 2222 || info.PodIP == "" {
+		t.Errorf("Devbox = %s, %q, port %d, pod IP %q, want Stopped, %q, port 2222 with its pod",
+			info.DesiredState, info.DisplayName, info.SSHPort, info.PodIP, "My devbox")
+	}
+
+	// Added before its secret and pod
+	_, err := devboxes.Create(ctx, devboxResource("late", "Running", "", 0), metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+
+	waitForDevbox(ctx, t, reg, "late", func(info *registry.DevboxInfo, ok bool) bool {
+		return ok && info.DesiredState == registry.DesiredStateRunning
+	})
+
+	// Updated
+	_, err = devboxes.Update(ctx, devboxResource("devbox", "Running", "Renamed", 0),
+		metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatalf("Update() failed: %v", err)
+	}
+
+	waitForDevbox(ctx, t, reg, "devbox", func(info *registry.DevboxInfo, ok bool) bool {
+		return ok && info.DesiredState == registry.DesiredStateRunning &&
+			info.DisplayName == "Renamed" && info.SSHPort == 0
+	})
+
+	// Deleted, the devbox is still known from its secret and pod
+	if err := devboxes.Delete(ctx, "devbox", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("Delete() failed: %v", err)
+	}
+
+	waitForDevbox(ctx, t, reg, "devbox", func(info *registry.DevboxInfo, ok bool) bool {
+		return ok && info.DesiredState == registry.DesiredStateUnknown &&
+			info.DisplayName == "" && info.PublicKey != nil
+	})
+
+	// Deleted, the devbox was only known from its custom resource
+	if err := devboxes.Delete(ctx, "late", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("Delete() failed: %v", err)
+	}
+
+	waitForDevbox(ctx, t, reg, "late", func(_ *registry.DevboxInfo, ok bool) bool {
+		return !ok
+	})
+}
+
+func TestStartWithoutDevboxResource(t *testing.T) {
+	secret, pod := labeledDevbox(t, "devbox", nil)
+	clientset := fake.NewSimpleClientset(secret, pod)
+
+	dynamicClient := newDynamicClient(t, devboxResource("devbox", "Stopped", "", 0))
+
+	reg := registry.New()
+	mgr := informer.New(clientset, reg,
+		informer.WithDevboxResource(dynamicClient, informer.DefaultDevboxResource),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The cluster does not serve the resource, the devbox is read as before
+	if err := mgr.Start(ctx); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer mgr.Stop()
+
+	info, ok := reg.GetDevboxInfo("default", "devbox")
+	if !ok || info.PodIP == "" {
+		t.Fatal("Devbox not registered with its pod")
+	}
+
+	if info.DesiredState != registry.DesiredStateUnknown {
+		t.Errorf("DesiredState = %q, want unknown", info.DesiredState)
+	}
+}
@@ -0,0 +1,146 @@
+package informer
+
+import (
+	"fmt"
+
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+// DiscoveryMode selects the objects the backends of devboxes are discovered from
+type DiscoveryMode string
+
+const (
+	// DiscoveryPods reaches devboxes at the IPs of their pods
+	DiscoveryPods DiscoveryMode = "pods"
+	// DiscoveryEndpointSlices reaches devboxes at the ready endpoints of the
+	// EndpointSlices of their Service, named after the devbox
+	DiscoveryEndpointSlices DiscoveryMode = "endpointslices"
+)
+
+// ParseDiscoveryMode parses a discovery mode, empty is DiscoveryPods
+func ParseDiscoveryMode(s string) (DiscoveryMode, error) {
+	switch mode := DiscoveryMode(s); mode {
+	case "":
+		return DiscoveryPods, nil
+	case DiscoveryPods, DiscoveryEndpointSlices:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid discovery mode %q, must be pods or endpointslices", s)
+	}
+}
+
+// WithDiscoveryMode selects whether the pods or the EndpointSlices of devboxes
+// are watched along with their secrets, the default is DiscoveryPods. The
+// EndpointSlices carry the label selector like secrets and pods, as copied from
+// their Service.
+func WithDiscoveryMode(mode DiscoveryMode) Option {
+	return func(m *Manager) {
+		m.discoveryMode = mode
+	}
+}
+
+// setupEndpointSliceInformer sets up the EndpointSlice informer of factory
+func (m *Manager) setupEndpointSliceInformer(
+	factory informers.SharedInformerFactory,
+) (cache.SharedIndexInformer, error) {
+	sliceInformer := factory.Discovery().V1().EndpointSlices().Informer()
+
+	err := sliceInformer.SetWatchErrorHandler(m.watchErrorHandler("endpointslice"))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = sliceInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    m.handleEndpointSliceAdd,
+		UpdateFunc: m.handleEndpointSliceUpdate,
+		DeleteFunc: m.handleEndpointSliceDelete,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return sliceInformer, nil
+}
+
+// ProcessEndpointSlice processes an EndpointSlice (for testing)
+func (m *Manager) ProcessEndpointSlice(slice *discoveryv1.EndpointSlice, action string) error {
+	switch action {
+	case "add":
+		m.handleEndpointSliceAdd(slice)
+	case "update":
+		m.handleEndpointSliceUpdate(nil, slice)
+	case "delete":
+		m.handleEndpointSliceDelete(slice)
+	default:
+		return fmt.Errorf("unknown action: %s", action)
+	}
+
+	return nil
+}
+
+// Event handlers for EndpointSlices
+func (m *Manager) handleEndpointSliceAdd(obj any) {
+	defer m.metrics.event(KindEndpointSlice, ActionAdd)()
+
+	slice, ok := obj.(*discoveryv1.EndpointSlice)
+	if !ok {
+		m.metrics.handlerError(KindEndpointSlice, ActionAdd)
+		m.logger.WithField("type", fmt.Sprintf("%T", obj)).
+			Error("Expected *discoveryv1.EndpointSlice")
+		return
+	}
+
+	m.recordSuccess()
+
+	if err := m.registry.UpdateEndpointSlice(slice); err != nil {
+		m.metrics.handlerError(KindEndpointSlice, ActionAdd)
+		m.logger.WithError(err).Error("Error adding endpoint slice")
+	}
+}
+
+func (m *Manager) handleEndpointSliceUpdate(oldObj, newObj any) {
+	defer m.metrics.event(KindEndpointSlice, ActionUpdate)()
+
+	slice, ok := newObj.(*discoveryv1.EndpointSlice)
+	if !ok {
+		m.metrics.handlerError(KindEndpointSlice, ActionUpdate)
+		m.logger.WithField("type", fmt.Sprintf("%T", newObj)).
+			Error("Expected *discoveryv1.EndpointSlice")
+		return
+	}
+
+	m.recordUpdate(oldObj, slice)
+
+	// Resyncs and changes of endpoint hints would only churn the registry
+	if oldSlice, ok := oldObj.(*discoveryv1.EndpointSlice); ok &&
+		!endpointSliceChanged(oldSlice, slice) {
+		return
+	}
+
+	if err := m.registry.UpdateEndpointSlice(slice); err != nil {
+		m.metrics.handlerError(KindEndpointSlice, ActionUpdate)
+		m.logger.WithError(err).Error("Error updating endpoint slice")
+	}
+}
+
+func (m *Manager) handleEndpointSliceDelete(obj any) {
+	defer m.metrics.event(KindEndpointSlice, ActionDelete)()
+
+	// The informer may have missed the deletion, only knowing the last state
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	slice, ok := obj.(*discoveryv1.EndpointSlice)
+	if !ok {
+		m.metrics.handlerError(KindEndpointSlice, ActionDelete)
+		m.logger.WithField("type", fmt.Sprintf("%T", obj)).
+			Error("Expected *discoveryv1.EndpointSlice")
+		return
+	}
+
+	m.recordSuccess()
+	m.registry.DeleteEndpointSlice(slice)
+}
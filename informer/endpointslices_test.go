@@ -0,0 +1,80 @@
+package informer_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/informer"
+	"github.com/zijiren233/sshgate/registry"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// devboxEndpointSlice returns an EndpointSlice of the Service of the devbox
+// named name, with a ready endpoint at address on port
+func devboxEndpointSlice(name, address string, port int32) *discoveryv1.EndpointSlice {
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name + "-abcde",
+			Namespace: "default",
+			Labels: map[string]string{
+				registry.DevboxPartOfLabel:   registry.DevboxPartOfValue,
+				discoveryv1.LabelServiceName: name,
+			},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Endpoints:   []discoveryv1.Endpoint{{Addresses: []string{address}}},
+		Ports:       []discoveryv1.EndpointPort{{Port: &port}},
+	}
+}
+
+func TestStartWithEndpointSlices(t *testing.T) {
+	secret, pod := labeledDevbox(t, "devbox", nil)
+	slice := devboxEndpointSlice("devbox", "10.0.1.1", 2222)
+	clientset := fake.NewSimpleClientset(secret, pod, slice)
+	reg := registry.New()
+	mgr := informer.New(clientset, reg,
+		informer.WithDiscoveryMode(informer.DiscoveryEndpointSlices))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := mgr.Start(ctx); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer mgr.Stop()
+
+	// The pod is not watched, the devbox is reached at its endpoint
+	info, ok := reg.GetDevboxInfo("default", "devbox")
+	if !ok || info.PublicKey == nil || info.PodIP != "10.0.1.1" || info.BackendPort != 2222 {
+		t.Fatalf("Devbox = %+v, want its key and endpoint 10.0.1.1:2222", info)
+	}
+
+	err := clientset.DiscoveryV1().EndpointSlices("default").
+		Delete(ctx, slice.Name, metav1.DeleteOptions{})
+	if err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	waitForDevbox(ctx, t, reg, "devbox", func(info *registry.DevboxInfo, ok bool) bool {
+		return ok && info.PodState() == registry.PodStateNone
+	})
+}
+
+func TestParseDiscoveryMode(t *testing.T) {
+	for value, want := range map[string]informer.DiscoveryMode{
+		"":               informer.DiscoveryPods,
+		"pods":           informer.DiscoveryPods,
+		"endpointslices": informer.DiscoveryEndpointSlices,
+	} {
+		if mode, err := informer.ParseDiscoveryMode(value); err != nil || mode != want {
+			t.Errorf("ParseDiscoveryMode(%q) = %q, %v, want %q", value, mode, err, want)
+		}
+	}
+
+	if _, err := informer.ParseDiscoveryMode("services"); err == nil {
+		t.Error("ParseDiscoveryMode(services) succeeded")
+	}
+}
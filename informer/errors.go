@@ -4,3 +4,9 @@ import "errors"
 
 // ErrCacheSyncFailed is returned when informer cache sync fails
 var ErrCacheSyncFailed = errors.New("failed to sync informer caches")
+
+// ErrAlreadyStarted is returned when starting a manager that is running
+var ErrAlreadyStarted = errors.New("informers already started")
+
+// ErrNotStarted is returned when reconciling a manager that is not running
+var ErrNotStarted = errors.New("informers not started")
@@ -0,0 +1,10 @@
+package informer
+
+// HandleSecretUpdate and HandlePodUpdate feed update events to the handlers
+func (m *Manager) HandleSecretUpdate(oldObj, newObj any) {
+	m.handleSecretUpdate(oldObj, newObj)
+}
+
+func (m *Manager) HandlePodUpdate(oldObj, newObj any) {
+	m.handlePodUpdate(oldObj, newObj)
+}
@@ -0,0 +1,237 @@
+package informer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// DefaultUnhealthyTimeout is how long the informers may fail to list and watch
+// before they are reported unhealthy, unless configured
+const DefaultUnhealthyTimeout = 5 * time.Minute
+
+// maxHealthCheckInterval bounds how often the health of the informers is checked
+const maxHealthCheckInterval = 5 * time.Second
+
+// Health is the state of the list and watch requests of the informers
+type Health struct {
+	// LastSuccess is when the informers last listed or received an event, the
+	// data of the registry may be as old
+	LastSuccess time.Time
+	// ConsecutiveFailures counts the failed list and watch requests since
+	ConsecutiveFailures int
+	// FailingSince is when the first of these failures happened
+	FailingSince time.Time
+	// LastError is the last failure, nil once the informers recover
+	LastError error
+	// Healthy is false once the informers failed for longer than the
+	// unhealthy timeout
+	Healthy bool
+}
+
+// Staleness returns how long ago the informers last listed or received an
+// event, zero before they did
+func (h Health) Staleness() time.Duration {
+	if h.LastSuccess.IsZero() {
+		return 0
+	}
+
+	return time.Since(h.LastSuccess)
+}
+
+// healthTracker records the failures and successes of the informers
+type healthTracker struct {
+	mu     sync.Mutex
+	health Health
+	// unhealthyReported is set once the failures outlasted the timeout, until
+	// the informers recover
+	unhealthyReported bool
+}
+
+// WithUnhealthyTimeout sets how long the informers may fail to list and watch
+// before they are reported unhealthy, zero never reports them unhealthy
+func WithUnhealthyTimeout(d time.Duration) Option {
+	return func(m *Manager) {
+		m.unhealthyTimeout = max(d, 0)
+	}
+}
+
+// WithUnhealthyHandler sets a function called once the informers turn
+// unhealthy, e.g. to exit the process for Kubernetes to restart it
+func WithUnhealthyHandler(handler func(Health)) Option {
+	return func(m *Manager) {
+		m.onUnhealthy = handler
+	}
+}
+
+// Health returns the state of the list and watch requests of the informers
+func (m *Manager) Health() Health {
+	m.tracker.mu.Lock()
+	defer m.tracker.mu.Unlock()
+
+	health := m.tracker.health
+	health.Healthy = !m.failedTooLong(health, time.Now())
+
+	return health
+}
+
+// failedTooLong reports whether the informers have been failing for longer
+// than the unhealthy timeout at now
+func (m *Manager) failedTooLong(health Health, now time.Time) bool {
+	return m.unhealthyTimeout > 0 && health.ConsecutiveFailures > 0 &&
+		now.Sub(health.FailingSince) >= m.unhealthyTimeout
+}
+
+// ReadyHandler serves the readiness of the gateway: 200 unless the informers
+// failed to list and watch for longer than the unhealthy timeout, 503 then
+func (m *Manager) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+
+		health := m.Health()
+		if !health.Healthy {
+			http.Error(w, fmt.Sprintf("informers failing since %s: %v",
+				health.FailingSince.Format(time.RFC3339), health.LastError),
+				http.StatusServiceUnavailable)
+
+			return
+		}
+
+		_, _ = io.WriteString(w, "ok\n")
+	})
+}
+
+// watchErrorHandler records the failures of the list and watch requests of
+// the informer of kind
+func (m *Manager) watchErrorHandler(kind string) cache.WatchErrorHandler {
+	return func(_ *cache.Reflector, err error) {
+		// Watches closed by the server or outdated are restarted, not failures
+		if errors.Is(err, io.EOF) || apierrors.IsResourceExpired(err) || apierrors.IsGone(err) {
+			return
+		}
+
+		m.recordFailure(kind, err)
+	}
+}
+
+// recordFailure records a failed list or watch request, logged with an
+// exponential backoff as the informers retry continuously
+func (m *Manager) recordFailure(kind string, err error) {
+	m.tracker.mu.Lock()
+	defer m.tracker.mu.Unlock()
+
+	health := &m.tracker.health
+	if health.ConsecutiveFailures == 0 {
+		health.FailingSince = time.Now()
+	}
+
+	health.ConsecutiveFailures++
+	health.LastError = err
+
+	// Logged on the 1st, 2nd, 4th, 8th... failure in a row
+	if bits.OnesCount(uint(health.ConsecutiveFailures)) == 1 {
+		m.logger.WithFields(log.Fields{
+			"kind":          kind,
+			"failures":      health.ConsecutiveFailures,
+			"failing_since": health.FailingSince,
+		}).WithError(err).Warn("Failed to list or watch, retrying")
+	}
+}
+
+// recordSuccess records a successful list or an event received
+func (m *Manager) recordSuccess() {
+	m.tracker.mu.Lock()
+	defer m.tracker.mu.Unlock()
+
+	health := &m.tracker.health
+	if health.ConsecutiveFailures > 0 {
+		m.logger.WithFields(log.Fields{
+			"failures": health.ConsecutiveFailures,
+			"failed":   time.Since(health.FailingSince).Round(time.Millisecond),
+		}).Info("Informers recovered")
+	}
+
+	health.LastSuccess = time.Now()
+	health.ConsecutiveFailures = 0
+	health.FailingSince = time.Time{}
+	health.LastError = nil
+	m.tracker.unhealthyReported = false
+}
+
+// recordUpdate records an update event, resyncs replay the cache and are not
+// successes
+func (m *Manager) recordUpdate(oldObj any, newObj metav1.Object) {
+	if old, ok := oldObj.(metav1.Object); ok &&
+		old.GetResourceVersion() == newObj.GetResourceVersion() {
+		return
+	}
+
+	m.recordSuccess()
+}
+
+// monitorHealth records the lists and events of informers, seen as changes of
+// their resource versions, and reports the informers unhealthy once they have
+// been failing for longer than the unhealthy timeout
+func (m *Manager) monitorHealth(ctx context.Context, informers []cache.SharedIndexInformer) {
+	interval := maxHealthCheckInterval
+	if m.unhealthyTimeout > 0 {
+		interval = min(interval, max(m.unhealthyTimeout/4, 10*time.Millisecond))
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	versions := make([]string, len(informers))
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for i, informer := range informers {
+			if version := informer.LastSyncResourceVersion(); version != versions[i] {
+				versions[i] = version
+				m.recordSuccess()
+			}
+		}
+
+		m.checkUnhealthy()
+	}
+}
+
+// checkUnhealthy reports the informers unhealthy once they have been failing
+// for longer than the unhealthy timeout
+func (m *Manager) checkUnhealthy() {
+	m.tracker.mu.Lock()
+
+	health := m.tracker.health
+	if m.tracker.unhealthyReported || !m.failedTooLong(health, time.Now()) {
+		m.tracker.mu.Unlock()
+		return
+	}
+
+	m.tracker.unhealthyReported = true
+	m.tracker.mu.Unlock()
+
+	m.logger.WithFields(log.Fields{
+		"failures":      health.ConsecutiveFailures,
+		"failing_since": health.FailingSince,
+		"last_success":  health.LastSuccess,
+	}).WithError(health.LastError).Error("Informers unhealthy, the registry is getting stale")
+
+	if m.onUnhealthy != nil {
+		m.onUnhealthy(health)
+	}
+}
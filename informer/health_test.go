@@ -0,0 +1,105 @@
+package informer_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/informer"
+	"github.com/zijiren233/sshgate/registry"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// readyStatus returns the status the ready handler of mgr answers with
+func readyStatus(mgr *informer.Manager) int {
+	recorder := httptest.NewRecorder()
+	mgr.ReadyHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	return recorder.Code
+}
+
+func TestHealth_APIServerUnreachable(t *testing.T) {
+	secret, _ := labeledDevbox(t, "devbox", nil)
+	clientset := fake.NewSimpleClientset(secret)
+
+	// The API server is unreachable until failing is cleared
+	var failing atomic.Bool
+	failing.Store(true)
+
+	errUnreachable := errors.New("dial tcp: connection refused")
+
+	clientset.PrependReactor("list", "*",
+		func(k8stesting.Action) (bool, runtime.Object, error) {
+			return failing.Load(), nil, errUnreachable
+		})
+	clientset.PrependWatchReactor("*",
+		func(k8stesting.Action) (bool, watch.Interface, error) {
+			return failing.Load(), nil, errUnreachable
+		})
+
+	unhealthy := make(chan informer.Health, 1)
+	reg := registry.New()
+	mgr := informer.New(clientset, reg,
+		informer.WithUnhealthyTimeout(100*time.Millisecond),
+		informer.WithUnhealthyHandler(func(health informer.Health) {
+			unhealthy <- health
+		}),
+	)
+
+	if status := readyStatus(mgr); status != http.StatusOK {
+		t.Errorf("Ready status before start = %d, want 200", status)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	started := make(chan error, 1)
+
+	go func() { started <- mgr.Start(ctx) }()
+	defer mgr.Stop()
+
+	select {
+	case health := <-unhealthy:
+		if health.ConsecutiveFailures == 0 || !errors.Is(health.LastError, errUnreachable) {
+			t.Errorf("Unhealthy with %d failures, last %v", health.ConsecutiveFailures,
+				health.LastError)
+		}
+	case <-ctx.Done():
+		t.Fatal("Unhealthy handler not called")
+	}
+
+	if health := mgr.Health(); health.Healthy || health.FailingSince.IsZero() {
+		t.Errorf("Health = %+v, want failing", health)
+	}
+
+	if status := readyStatus(mgr); status != http.StatusServiceUnavailable {
+		t.Errorf("Ready status = %d, want 503", status)
+	}
+
+	// The informers sync once the API server is back
+	failing.Store(false)
+
+	if err := <-started; err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+
+	health := mgr.Health()
+	if !health.Healthy || health.ConsecutiveFailures != 0 || health.LastSuccess.IsZero() {
+		t.Errorf("Health = %+v, want recovered", health)
+	}
+
+	if status := readyStatus(mgr); status != http.StatusOK {
+		t.Errorf("Ready status after recovery = %d, want 200", status)
+	}
+
+	if _, ok := reg.GetDevboxInfo("default", "devbox"); !ok {
+		t.Error("Devbox not registered after recovery")
+	}
+}
@@ -3,43 +3,195 @@ package informer
 import (
 	"context"
 	"fmt"
+	"slices"
+	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	"github.com/zijiren233/sshgate/registry"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
 )
 
+// DefaultResyncPeriod is the resync period of the informers unless configured
+const DefaultResyncPeriod = 30 * time.Second
+
+// FactoryFunc builds an informer factory, see
+// informers.NewSharedInformerFactoryWithOptions
+type FactoryFunc func(
+	client kubernetes.Interface,
+	defaultResync time.Duration,
+	options ...informers.SharedInformerOption,
+) informers.SharedInformerFactory
+
 // Manager manages Kubernetes informers for the gateway
 type Manager struct {
 	clientset    kubernetes.Interface
 	registry     *registry.Registry
 	resyncPeriod time.Duration
-	factory      informers.SharedInformerFactory
-	cancel       context.CancelFunc
-	logger       *log.Entry
+	// labelSelector restricts the listed and watched secrets and pods
+	labelSelector string
+	// namespaces are the namespaces of the watched secrets and pods, every
+	// namespace when empty. Each is watched by its own factory.
+	namespaces []string
+	// discoveryMode selects whether pods or EndpointSlices are watched
+	discoveryMode DiscoveryMode
+	// cluster names the member cluster watched, empty for the cluster of the
+	// gateway
+	cluster string
+	// transform is applied to the secrets and pods before they are cached
+	transform cache.TransformFunc
+	// newFactory builds the informer factories
+	newFactory FactoryFunc
+	factories  []informers.SharedInformerFactory
+	// unhealthyTimeout is how long the secret and pod informers may fail before
+	// they are reported unhealthy, to onUnhealthy if set
+	unhealthyTimeout time.Duration
+	onUnhealthy      func(Health)
+	tracker          healthTracker
+	// metrics instruments the event handlers, registered on metricsRegisterer
+	metrics           *metrics
+	metricsRegisterer prometheus.Registerer
+	// revocationNamespace and revocationName name the watched revocation
+	// ConfigMap, watched by its own factory restricted to it
+	revocationNamespace string
+	revocationName      string
+	configMapFactory    informers.SharedInformerFactory
+	// otpSecretNamespace and otpSecretName name the secret holding the TOTP
+	// secrets, watched by its own factory restricted to it whatever its labels
+	// and namespace
+	otpSecretNamespace string
+	otpSecretName      string
+	otpSecretFactory   informers.SharedInformerFactory
+	// dynamicClient watches the devboxResource custom resources, if set, with
+	// a factory per namespace
+	dynamicClient    dynamic.Interface
+	devboxResource   schema.GroupVersionResource
+	dynamicFactories []dynamicinformer.DynamicSharedInformerFactory
+	// reconcileInterval is how often the registry is reconciled with the
+	// caches of devboxInformers, the secret and pod informers
+	reconcileInterval time.Duration
+	devboxInformers   []cache.SharedIndexInformer
+	// mu guards the lifecycle of the informers: the factories, the informers,
+	// cancel and stopped. background waits for the health monitor and the
+	// periodic reconciliation of the running informers.
+	mu         sync.Mutex
+	cancel     context.CancelFunc
+	stopped    bool
+	background sync.WaitGroup
+	logger     *log.Entry
 }
 
 // Option configures the informer manager
 type Option func(*Manager)
 
-// WithResyncPeriod sets the resync period for the informers
+// WithResyncPeriod sets the resync period for the informers, zero or negative
+// periods keep DefaultResyncPeriod
 func WithResyncPeriod(d time.Duration) Option {
 	return func(m *Manager) {
+		if d <= 0 {
+			m.logger.WithField("resync_period", d).
+				Warn("Invalid informer resync period, using the default")
+
+			return
+		}
+
 		m.resyncPeriod = d
 	}
 }
 
+// WithTransform sets a function applied to the secrets and pods before they
+// are cached, e.g. to drop fields the registry never reads
+func WithTransform(transform cache.TransformFunc) Option {
+	return func(m *Manager) {
+		m.transform = transform
+	}
+}
+
+// WithFactory sets the function building the informer factories, tests use it
+// to observe how they are built
+func WithFactory(newFactory FactoryFunc) Option {
+	return func(m *Manager) {
+		if newFactory != nil {
+			m.newFactory = newFactory
+		}
+	}
+}
+
+// WithLabelSelector restricts the secrets and pods listed, watched and cached
+// to those matching selector, every object is watched when empty. The default
+// is DevboxPartOfLabel=DevboxPartOfValue.
+func WithLabelSelector(selector string) Option {
+	return func(m *Manager) {
+		m.labelSelector = selector
+	}
+}
+
+// WithNamespaces restricts the secrets and pods listed and watched to those of
+// namespaces, no namespace or an empty one watches the whole cluster
+func WithNamespaces(namespaces ...string) Option {
+	return func(m *Manager) {
+		m.namespaces = nil
+
+		for _, namespace := range namespaces {
+			if namespace == "" {
+				m.namespaces = nil
+				return
+			}
+
+			if !slices.Contains(m.namespaces, namespace) {
+				m.namespaces = append(m.namespaces, namespace)
+			}
+		}
+	}
+}
+
+// WithRevocationConfigMap watches the ConfigMap listing revoked key
+// fingerprints, only this ConfigMap is listed and watched
+func WithRevocationConfigMap(namespace, name string) Option {
+	return func(m *Manager) {
+		m.revocationNamespace, m.revocationName = namespace, name
+	}
+}
+
+// WithOTPSecret watches the secret holding the TOTP secrets, only this secret
+// is listed and watched. It is read whether or not it carries the devbox labels
+// and lies in the watched namespaces.
+func WithOTPSecret(namespace, name string) Option {
+	return func(m *Manager) {
+		m.otpSecretNamespace, m.otpSecretName = namespace, name
+	}
+}
+
+// WithCluster names the member cluster the clientset watches, logged along
+// with the informer messages. Each cluster is watched by its own manager,
+// feeding its own registry, so that a cluster failing to sync leaves the
+// others be; see registry.Federation.
+func WithCluster(name string) Option {
+	return func(m *Manager) {
+		m.cluster = name
+	}
+}
+
 // New creates a new informer manager
 func New(clientset kubernetes.Interface, reg *registry.Registry, opts ...Option) *Manager {
 	m := &Manager{
-		clientset:    clientset,
-		registry:     reg,
-		resyncPeriod: 30 * time.Second, // Default value
-		logger:       log.WithField("component", "informer"),
+		clientset:        clientset,
+		registry:         reg,
+		resyncPeriod:     DefaultResyncPeriod,
+		newFactory:       informers.NewSharedInformerFactoryWithOptions,
+		unhealthyTimeout: DefaultUnhealthyTimeout,
+		discoveryMode:    DiscoveryPods,
+		labelSelector:    registry.DevboxPartOfLabel + "=" + registry.DevboxPartOfValue,
+		logger:           log.WithField("component", "informer"),
 	}
 
 	// Apply options
@@ -47,31 +199,237 @@ func New(clientset kubernetes.Interface, reg *registry.Registry, opts ...Option)
 		opt(m)
 	}
 
+	if m.cluster != "" {
+		m.logger = m.logger.WithField("cluster", m.cluster)
+	}
+
+	m.metrics = newMetrics()
+	if err := m.metrics.register(m.metricsRegisterer); err != nil {
+		m.logger.WithError(err).Warn("Failed to register informer metrics")
+	}
+
 	return m
 }
 
-// Start initializes and starts all informers
+// Start initializes and starts all informers and waits for their caches to
+// sync. A stopped manager may be started again.
 func (m *Manager) Start(ctx context.Context) error {
+	ctx, synced, err := m.start(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Wait for cache sync, Stop aborts it
+	if !cache.WaitForCacheSync(ctx.Done(), synced...) {
+		return ErrCacheSyncFailed
+	}
+
+	logger := m.logger
+	if len(m.namespaces) > 0 {
+		logger = logger.WithField("namespaces", m.namespaces)
+	}
+
+	logger.Info("Informers synced successfully")
+
+	return nil
+}
+
+// start sets up and starts the informers, returning the context they run with
+// and their sync functions
+func (m *Manager) start(ctx context.Context) (context.Context, []cache.InformerSynced, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.cancel != nil {
+		return nil, nil, ErrAlreadyStarted
+	}
+
 	// Create a cancellable context for the informer lifecycle
 	ctx, m.cancel = context.WithCancel(ctx)
+	m.stopped = false
+
+	synced, devboxInformers, err := m.setupInformers(ctx)
+	if err != nil {
+		m.stopLocked()
+		return nil, nil, err
+	}
+
+	// Start informers
+	for _, factory := range m.factories {
+		factory.Start(ctx.Done())
+	}
+
+	for _, factory := range m.dynamicFactories {
+		factory.Start(ctx.Done())
+	}
+
+	m.devboxInformers = devboxInformers
+
+	// Failures to sync are reported too
+	m.background.Go(func() { m.monitorHealth(ctx, devboxInformers) })
+
+	if m.reconcileInterval > 0 {
+		m.background.Go(func() { m.reconcilePeriodically(ctx, devboxInformers) })
+	}
+
+	return ctx, synced, nil
+}
+
+// setupInformers sets up the informers, returning their sync functions and the
+// secret and pod informers
+func (m *Manager) setupInformers(
+	ctx context.Context,
+) ([]cache.InformerSynced, []cache.SharedIndexInformer, error) {
+	// One factory watches the whole cluster, or each namespace has its own
+	namespaces := m.namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+
+	var devboxInformers []cache.SharedIndexInformer
+
+	for _, namespace := range namespaces {
+		namespaceInformers, err := m.setupDevboxInformers(namespace)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		devboxInformers = append(devboxInformers, namespaceInformers...)
+	}
+
+	synced := make([]cache.InformerSynced, 0, len(devboxInformers)+1)
+	for _, informer := range devboxInformers {
+		synced = append(synced, informer.HasSynced)
+	}
+
+	// Setup Devbox custom resource informers, when the cluster serves them
+	if m.dynamicClient != nil && m.devboxResourceServed() {
+		for _, namespace := range namespaces {
+			informer, err := m.setupDevboxResourceInformer(namespace)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			synced = append(synced, informer.HasSynced)
+		}
+	}
+
+	// Setup revocation ConfigMap informer
+	if m.revocationName != "" {
+		configMapInformer, err := m.startConfigMapInformer(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		synced = append(synced, configMapInformer.HasSynced)
+	}
+
+	// Setup OTP secret informer
+	if m.otpSecretName != "" {
+		otpSecretInformer, err := m.startOTPSecretInformer(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		synced = append(synced, otpSecretInformer.HasSynced)
+	}
+
+	return synced, devboxInformers, nil
+}
+
+// Stop stops all informers and waits for their event handlers to return. It
+// may be called before Start and several times.
+func (m *Manager) Stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.stopLocked()
+}
+
+// stopLocked stops the informers with m.mu held
+func (m *Manager) stopLocked() {
+	if m.cancel == nil {
+		return
+	}
+
+	m.cancel()
+	m.cancel = nil
+
+	// Shutdown waits for the goroutines of the informers and their handlers
+	for _, factory := range m.factories {
+		factory.Shutdown()
+	}
+
+	for _, factory := range m.dynamicFactories {
+		factory.Shutdown()
+	}
+
+	if m.configMapFactory != nil {
+		m.configMapFactory.Shutdown()
+	}
+
+	if m.otpSecretFactory != nil {
+		m.otpSecretFactory.Shutdown()
+	}
+
+	m.background.Wait()
+
+	m.factories, m.dynamicFactories, m.configMapFactory = nil, nil, nil
+	m.otpSecretFactory = nil
+	m.devboxInformers = nil
+	m.stopped = true
+}
 
-	// Create informer factory
-	m.factory = informers.NewSharedInformerFactory(m.clientset, m.resyncPeriod)
+// setupDevboxInformers sets up the secret and pod, or EndpointSlice, informers
+// of a factory watching namespace
+func (m *Manager) setupDevboxInformers(namespace string) ([]cache.SharedIndexInformer, error) {
+	// Only devbox objects are cached
+	options := []informers.SharedInformerOption{
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = m.labelSelector
+		}),
+	}
+	if m.transform != nil {
+		options = append(options, informers.WithTransform(m.transform))
+	}
+
+	factory := m.newFactory(m.clientset, m.resyncPeriod, options...)
+	m.factories = append(m.factories, factory)
 
 	// Setup secret informer
-	secretInformer := m.factory.Core().V1().Secrets().Informer()
+	secretInformer := factory.Core().V1().Secrets().Informer()
+
+	err := secretInformer.SetWatchErrorHandler(m.watchErrorHandler("secret"))
+	if err != nil {
+		return nil, err
+	}
 
-	_, err := secretInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+	_, err = secretInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc:    m.handleSecretAdd,
 		UpdateFunc: m.handleSecretUpdate,
 		DeleteFunc: m.handleSecretDelete,
 	})
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if m.discoveryMode == DiscoveryEndpointSlices {
+		sliceInformer, err := m.setupEndpointSliceInformer(factory)
+		if err != nil {
+			return nil, err
+		}
+
+		return []cache.SharedIndexInformer{secretInformer, sliceInformer}, nil
 	}
 
 	// Setup pod informer
-	podInformer := m.factory.Core().V1().Pods().Informer()
+	podInformer := factory.Core().V1().Pods().Informer()
+
+	err = podInformer.SetWatchErrorHandler(m.watchErrorHandler("pod"))
+	if err != nil {
+		return nil, err
+	}
 
 	_, err = podInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc:    m.handlePodAdd,
@@ -79,37 +437,93 @@ func (m *Manager) Start(ctx context.Context) error {
 		DeleteFunc: m.handlePodDelete,
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Start informers
-	m.factory.Start(ctx.Done())
+	return []cache.SharedIndexInformer{secretInformer, podInformer}, nil
+}
 
-	// Wait for cache sync
-	if !cache.WaitForCacheSync(ctx.Done(), secretInformer.HasSynced, podInformer.HasSynced) {
-		return ErrCacheSyncFailed
+// startConfigMapInformer starts the informer of the revocation ConfigMap
+func (m *Manager) startConfigMapInformer(ctx context.Context) (cache.SharedIndexInformer, error) {
+	m.configMapFactory = m.newFactory(
+		m.clientset,
+		m.resyncPeriod,
+		informers.WithNamespace(m.revocationNamespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector(
+				"metadata.name", m.revocationName,
+			).String()
+		}),
+	)
+
+	configMapInformer := m.configMapFactory.Core().V1().ConfigMaps().Informer()
+
+	_, err := configMapInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    m.handleConfigMapAdd,
+		UpdateFunc: m.handleConfigMapUpdate,
+		DeleteFunc: m.handleConfigMapDelete,
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	m.logger.Info("Informers synced successfully")
+	m.configMapFactory.Start(ctx.Done())
 
-	return nil
+	return configMapInformer, nil
 }
 
-// Stop stops all informers
-func (m *Manager) Stop() {
-	if m.cancel != nil {
-		m.cancel()
-		m.cancel = nil
+// startOTPSecretInformer starts the informer of the OTP secret
+func (m *Manager) startOTPSecretInformer(ctx context.Context) (cache.SharedIndexInformer, error) {
+	m.otpSecretFactory = m.newFactory(
+		m.clientset,
+		m.resyncPeriod,
+		informers.WithNamespace(m.otpSecretNamespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector(
+				"metadata.name", m.otpSecretName,
+			).String()
+		}),
+	)
+
+	otpSecretInformer := m.otpSecretFactory.Core().V1().Secrets().Informer()
+
+	_, err := otpSecretInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    m.handleOTPSecretUpdate,
+		UpdateFunc: func(_, newObj any) { m.handleOTPSecretUpdate(newObj) },
+		DeleteFunc: m.handleOTPSecretDelete,
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	if m.factory != nil {
-		m.factory.Shutdown()
-	}
+	m.otpSecretFactory.Start(ctx.Done())
+
+	return otpSecretInformer, nil
+}
+
+// isOTPSecret reports whether secret is the OTP secret watched by its own
+// informer, the devbox secret informers leaving it to it
+func (m *Manager) isOTPSecret(secret *corev1.Secret) bool {
+	return m.otpSecretName != "" &&
+		secret.Namespace == m.otpSecretNamespace &&
+		secret.Name == m.otpSecretName
 }
 
-// IsStarted returns true if the manager has been started and factory is initialized
+// IsStarted returns true if the manager has been started and not stopped since
 func (m *Manager) IsStarted() bool {
-	return m.factory != nil
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.cancel != nil
+}
+
+// IsStopped returns true if the manager has been stopped and not started again
+// since, a manager never started is not stopped
+func (m *Manager) IsStopped() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.stopped
 }
 
 // ProcessSecret processes a secret (for testing)
@@ -131,8 +545,10 @@ func (m *Manager) ProcessSecret(secret *corev1.Secret, action string) error {
 // ProcessPod processes a pod (for testing)
 func (m *Manager) ProcessPod(pod *corev1.Pod, action string) error {
 	switch action {
-	case "add", "update":
+	case "add":
 		m.handlePodAdd(pod)
+	case "update":
+		m.handlePodUpdate(nil, pod)
 	case "delete":
 		m.handlePodDelete(pod)
 	default:
@@ -142,26 +558,55 @@ func (m *Manager) ProcessPod(pod *corev1.Pod, action string) error {
 	return nil
 }
 
+// ProcessConfigMap processes a ConfigMap (for testing)
+func (m *Manager) ProcessConfigMap(configMap *corev1.ConfigMap, action string) error {
+	switch action {
+	case "add":
+		m.handleConfigMapAdd(configMap)
+	case "update":
+		m.handleConfigMapUpdate(nil, configMap)
+	case "delete":
+		m.handleConfigMapDelete(configMap)
+	default:
+		return fmt.Errorf("unknown action: %s", action)
+	}
+
+	return nil
+}
+
 // Event handlers for secrets
 func (m *Manager) handleSecretAdd(obj any) {
+	defer m.metrics.event(KindSecret, ActionAdd)()
+
 	secret, ok := obj.(*corev1.Secret)
 	if !ok {
+		m.metrics.handlerError(KindSecret, ActionAdd)
 		m.logger.WithField("type", fmt.Sprintf("%T", obj)).Error("Expected *corev1.Secret")
 		return
 	}
 
+	m.recordSuccess()
+
+	if m.isOTPSecret(secret) {
+		return
+	}
+
 	if err := m.registry.AddSecret(nil, secret); err != nil {
+		m.metrics.handlerError(KindSecret, ActionAdd)
 		m.logger.WithError(err).Error("Error adding secret")
 	}
 }
 
 func (m *Manager) handleSecretUpdate(oldObj, newObj any) {
+	defer m.metrics.event(KindSecret, ActionUpdate)()
+
 	var oldSecret *corev1.Secret
 	if oldObj != nil {
 		var ok bool
 
 		oldSecret, ok = oldObj.(*corev1.Secret)
 		if !ok {
+			m.metrics.handlerError(KindSecret, ActionUpdate)
 			m.logger.WithField("type", fmt.Sprintf("%T", oldObj)).
 				Error("Expected *corev1.Secret for old object")
 			return
@@ -170,57 +615,173 @@ func (m *Manager) handleSecretUpdate(oldObj, newObj any) {
 
 	newSecret, ok := newObj.(*corev1.Secret)
 	if !ok {
+		m.metrics.handlerError(KindSecret, ActionUpdate)
 		m.logger.WithField("type", fmt.Sprintf("%T", newObj)).
 			Error("Expected *corev1.Secret for new object")
 		return
 	}
 
+	m.recordUpdate(oldObj, newSecret)
+
+	if m.isOTPSecret(newSecret) {
+		return
+	}
+
+	// Resyncs and changes the registry does not read would only churn it
+	if !secretChanged(oldSecret, newSecret) {
+		return
+	}
+
 	if err := m.registry.AddSecret(oldSecret, newSecret); err != nil {
+		m.metrics.handlerError(KindSecret, ActionUpdate)
 		m.logger.WithError(err).Error("Error updating secret")
 	}
 }
 
 func (m *Manager) handleSecretDelete(obj any) {
+	defer m.metrics.event(KindSecret, ActionDelete)()
+
 	secret, ok := obj.(*corev1.Secret)
 	if !ok {
+		m.metrics.handlerError(KindSecret, ActionDelete)
 		m.logger.WithField("type", fmt.Sprintf("%T", obj)).Error("Expected *corev1.Secret")
 		return
 	}
 
+	m.recordSuccess()
+
+	if m.isOTPSecret(secret) {
+		return
+	}
+
 	m.registry.DeleteSecret(secret)
 }
 
+// Event handlers for the OTP secret
+func (m *Manager) handleOTPSecretUpdate(obj any) {
+	defer m.metrics.event(KindSecret, ActionUpdate)()
+
+	secret, ok := obj.(*corev1.Secret)
+	if !ok {
+		m.metrics.handlerError(KindSecret, ActionUpdate)
+		m.logger.WithField("type", fmt.Sprintf("%T", obj)).Error("Expected *corev1.Secret")
+		return
+	}
+
+	if !m.isOTPSecret(secret) {
+		return
+	}
+
+	if err := m.registry.AddSecret(nil, secret); err != nil {
+		m.metrics.handlerError(KindSecret, ActionUpdate)
+		m.logger.WithError(err).Error("Error updating OTP secret")
+	}
+}
+
+func (m *Manager) handleOTPSecretDelete(obj any) {
+	defer m.metrics.event(KindSecret, ActionDelete)()
+
+	secret, ok := obj.(*corev1.Secret)
+	if !ok {
+		m.metrics.handlerError(KindSecret, ActionDelete)
+		m.logger.WithField("type", fmt.Sprintf("%T", obj)).Error("Expected *corev1.Secret")
+		return
+	}
+
+	if m.isOTPSecret(secret) {
+		m.registry.DeleteSecret(secret)
+	}
+}
+
 // Event handlers for pods
 func (m *Manager) handlePodAdd(obj any) {
+	defer m.metrics.event(KindPod, ActionAdd)()
+
 	pod, ok := obj.(*corev1.Pod)
 	if !ok {
+		m.metrics.handlerError(KindPod, ActionAdd)
 		m.logger.WithField("type", fmt.Sprintf("%T", obj)).Error("Expected *corev1.Pod")
 		return
 	}
 
+	m.recordSuccess()
+
 	if err := m.registry.UpdatePod(pod); err != nil {
+		m.metrics.handlerError(KindPod, ActionAdd)
 		m.logger.WithError(err).Error("Error adding pod")
 	}
 }
 
-func (m *Manager) handlePodUpdate(_, newObj any) {
+func (m *Manager) handlePodUpdate(oldObj, newObj any) {
+	defer m.metrics.event(KindPod, ActionUpdate)()
+
 	pod, ok := newObj.(*corev1.Pod)
 	if !ok {
+		m.metrics.handlerError(KindPod, ActionUpdate)
 		m.logger.WithField("type", fmt.Sprintf("%T", newObj)).Error("Expected *corev1.Pod")
 		return
 	}
 
+	m.recordUpdate(oldObj, pod)
+
+	// Status heartbeats and resyncs would only churn the registry
+	if oldPod, ok := oldObj.(*corev1.Pod); ok && !podChanged(oldPod, pod) {
+		return
+	}
+
 	if err := m.registry.UpdatePod(pod); err != nil {
+		m.metrics.handlerError(KindPod, ActionUpdate)
 		m.logger.WithError(err).Error("Error updating pod")
 	}
 }
 
 func (m *Manager) handlePodDelete(obj any) {
+	defer m.metrics.event(KindPod, ActionDelete)()
+
 	pod, ok := obj.(*corev1.Pod)
 	if !ok {
+		m.metrics.handlerError(KindPod, ActionDelete)
 		m.logger.WithField("type", fmt.Sprintf("%T", obj)).Error("Expected *corev1.Pod")
 		return
 	}
 
+	m.recordSuccess()
 	m.registry.DeletePod(pod)
 }
+
+// Event handlers for configmaps
+func (m *Manager) handleConfigMapAdd(obj any) {
+	defer m.metrics.event(KindConfigMap, ActionAdd)()
+
+	m.updateConfigMap(obj, ActionAdd)
+}
+
+func (m *Manager) handleConfigMapUpdate(_, newObj any) {
+	defer m.metrics.event(KindConfigMap, ActionUpdate)()
+
+	m.updateConfigMap(newObj, ActionUpdate)
+}
+
+func (m *Manager) updateConfigMap(obj any, action string) {
+	configMap, ok := obj.(*corev1.ConfigMap)
+	if !ok {
+		m.metrics.handlerError(KindConfigMap, action)
+		m.logger.WithField("type", fmt.Sprintf("%T", obj)).Error("Expected *corev1.ConfigMap")
+		return
+	}
+
+	m.registry.UpdateConfigMap(configMap)
+}
+
+func (m *Manager) handleConfigMapDelete(obj any) {
+	defer m.metrics.event(KindConfigMap, ActionDelete)()
+
+	configMap, ok := obj.(*corev1.ConfigMap)
+	if !ok {
+		m.metrics.handlerError(KindConfigMap, ActionDelete)
+		m.logger.WithField("type", fmt.Sprintf("%T", obj)).Error("Expected *corev1.ConfigMap")
+		return
+	}
+
+	m.registry.DeleteConfigMap(configMap)
+}
@@ -5,6 +5,10 @@ import (
 	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/pem"
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -13,7 +17,11 @@ import (
 	"golang.org/x/crypto/ssh"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/fake"
 	k8stesting "k8s.io/client-go/testing"
 )
@@ -420,3 +428,348 @@ func TestStartWithExistingResources(t *testing.T) {
 		t.Error("Manager not started after Start()")
 	}
 }
+
+func TestStartWithRevocationConfigMap(t *testing.T) {
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "revoked-keys", Namespace: "sshgate"},
+		Data:       map[string]string{"fingerprints": "SHA256:first # leaked\n"},
+	}
+
+	clientset := fake.NewSimpleClientset(configMap)
+	reg := registry.New(registry.WithRevocationConfigMap("sshgate", "revoked-keys"))
+	mgr := informer.New(clientset, reg, informer.WithRevocationConfigMap("sshgate", "revoked-keys"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := mgr.Start(ctx); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer mgr.Stop()
+
+	if !reg.IsRevoked("SHA256:first") {
+		t.Error("IsRevoked() = false after sync, want true")
+	}
+
+	// Updates are picked up without a restart
+	updated := configMap.DeepCopy()
+	updated.Data["fingerprints"] += "SHA256:second\n"
+
+	_, err := clientset.CoreV1().ConfigMaps("sshgate").Update(ctx, updated, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatalf("Update() failed: %v", err)
+	}
+
+	for !reg.IsRevoked("SHA256:second") {
+		select {
+		case <-ctx.Done():
+			t.Fatal("Revocation list update not picked up")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestStartWithOTPSecret(t *testing.T) {
+	// Neither labeled nor in a watched namespace
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "otp", Namespace: "sshgate"},
+		Data: map[string][]byte{
+			registry.OTPSecretNamespaceKey("tenant-a"): []byte("first"),
+		},
+	}
+
+	clientset := fake.NewSimpleClientset(secret)
+	reg := registry.New(registry.WithOTPSecret("sshgate", "otp"))
+	mgr := informer.New(clientset, reg,
+		informer.WithNamespaces("tenant-a"),
+		informer.WithOTPSecret("sshgate", "otp"),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := mgr.Start(ctx); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer mgr.Stop()
+
+	if got, _ := reg.OTPSecret("", "tenant-a"); string(got) != "first" {
+		t.Errorf("OTPSecret() = %q after sync, want first", got)
+	}
+
+	// waitForOTPSecret waits for the secret of tenant-a to be want, missing
+	// when empty
+	waitForOTPSecret := func(want string) {
+		t.Helper()
+
+		for {
+			if got, _ := reg.OTPSecret("", "tenant-a"); string(got) == want {
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				t.Fatalf("OTP secret %q not picked up", want)
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+
+	// Updates and deletion are picked up without a restart
+	updated := secret.DeepCopy()
+	updated.Data[registry.OTPSecretNamespaceKey("tenant-a")] = []byte("second")
+
+	_, err := clientset.CoreV1().Secrets("sshgate").Update(ctx, updated, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatalf("Update() failed: %v", err)
+	}
+
+	waitForOTPSecret("second")
+
+	err = clientset.CoreV1().Secrets("sshgate").Delete(ctx, "otp", metav1.DeleteOptions{})
+	if err != nil {
+		t.Fatalf("Delete() failed: %v", err)
+	}
+
+	waitForOTPSecret("")
+}
+
+// labeledDevbox returns the secret and pod of a devbox carrying extra labels
+func labeledDevbox(
+	t *testing.T,
+	name string,
+	extra map[string]string,
+) (*corev1.Secret, *corev1.Pod) {
+	t.Helper()
+
+	pubBytes, privBytes := generateTestKeys(t)
+
+	meta := metav1.ObjectMeta{
+		Namespace: "default",
+		Labels: map[string]string{
+			registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+		},
+		OwnerReferences: []metav1.OwnerReference{
+			{Kind: registry.DevboxOwnerKind, Name: name},
+		},
+	}
+	maps.Copy(meta.Labels, extra)
+
+	secret := &corev1.Secret{
+		ObjectMeta: *meta.DeepCopy(),
+		Data: map[string][]byte{
+			registry.DevboxPublicKeyField:  pubBytes,
+			registry.DevboxPrivateKeyField: privBytes,
+		},
+	}
+	secret.Name = name + "-secret"
+
+	pod := &corev1.Pod{
+		ObjectMeta: *meta.DeepCopy(),
+		Status:     corev1.PodStatus{PodIP: "10.0.0.1"},
+	}
+	pod.Name = name + "-pod"
+
+	return secret, pod
+}
+
+func TestStartWithLabelSelector(t *testing.T) {
+	selected, selectedPod := labeledDevbox(t, "selected", map[string]string{"team": "a"})
+	other, otherPod := labeledDevbox(t, "other", map[string]string{"team": "b"})
+
+	clientset := fake.NewSimpleClientset(selected, selectedPod, other, otherPod)
+
+	// Every list and watch of the informers carries the selector
+	var (
+		mu        sync.Mutex
+		selectors []string
+	)
+
+	record := func(action k8stesting.Action) {
+		var selector labels.Selector
+
+		switch action := action.(type) {
+		case k8stesting.ListAction:
+			selector = action.GetListRestrictions().Labels
+		case k8stesting.WatchAction:
+			selector = action.GetWatchRestrictions().Labels
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		selectors = append(selectors, action.GetVerb()+" "+action.GetResource().Resource+
+			" "+selector.String())
+	}
+
+	clientset.PrependReactor("list", "*",
+		func(action k8stesting.Action) (bool, runtime.Object, error) {
+			record(action)
+			return false, nil, nil
+		})
+	clientset.PrependWatchReactor("*",
+		func(action k8stesting.Action) (bool, watch.Interface, error) {
+			record(action)
+			return false, nil, nil
+		})
+
+	// The registry accepts both devboxes, only the informers tell them apart
+	reg := registry.New()
+	mgr := informer.New(clientset, reg, informer.WithLabelSelector("team=a"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := mgr.Start(ctx); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer mgr.Stop()
+
+	if _, ok := reg.GetDevboxInfo("default", "selected"); !ok {
+		t.Error("Selected devbox not registered")
+	}
+
+	if _, ok := reg.GetDevboxInfo("default", "other"); ok {
+		t.Error("Devbox outside the selector reached the registry")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, want := range []string{
+		"list secrets team=a", "list pods team=a", "watch secrets team=a", "watch pods team=a",
+	} {
+		if !slices.Contains(selectors, want) {
+			t.Errorf("Requests %q, want %q", selectors, want)
+		}
+	}
+}
+
+func TestStartWithNamespaces(t *testing.T) {
+	var objects []runtime.Object
+
+	for _, namespace := range []string{"tenant-a", "tenant-b", "tenant-c"} {
+		secret, pod := labeledDevbox(t, "devbox", nil)
+		secret.Namespace, pod.Namespace = namespace, namespace
+		objects = append(objects, secret, pod)
+	}
+
+	clientset := fake.NewSimpleClientset(objects...)
+	reg := registry.New()
+	mgr := informer.New(clientset, reg, informer.WithNamespaces("tenant-a", "tenant-b"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := mgr.Start(ctx); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer mgr.Stop()
+
+	for _, namespace := range []string{"tenant-a", "tenant-b"} {
+		if info, ok := reg.GetDevboxInfo(namespace, "devbox"); !ok || info.PodIP == "" {
+			t.Errorf("Devbox of %s not registered with its pod", namespace)
+		}
+	}
+
+	// Devboxes created later are only seen in the watched namespaces
+	for _, namespace := range []string{"tenant-c", "tenant-a"} {
+		secret, _ := labeledDevbox(t, "late", nil)
+		secret.Namespace = namespace
+
+		_, err := clientset.CoreV1().Secrets(namespace).Create(ctx, secret, metav1.CreateOptions{})
+		if err != nil {
+			t.Fatalf("Create() failed: %v", err)
+		}
+	}
+
+	for {
+		if _, ok := reg.GetDevboxInfo("tenant-a", "late"); ok {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			t.Fatal("Devbox created in a watched namespace not registered")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	for _, name := range []string{"devbox", "late"} {
+		if _, ok := reg.GetDevboxInfo("tenant-c", name); ok {
+			t.Errorf("Devbox %s outside the watched namespaces reached the registry", name)
+		}
+	}
+}
+
+func TestFactoryResyncPeriod(t *testing.T) {
+	tests := []struct {
+		name   string
+		period time.Duration
+		want   time.Duration
+	}{
+		{name: "configured", period: 5 * time.Minute, want: 5 * time.Minute},
+		{name: "zero", period: 0, want: informer.DefaultResyncPeriod},
+		{name: "negative", period: -time.Second, want: informer.DefaultResyncPeriod},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu      sync.Mutex
+				periods []time.Duration
+			)
+
+			newFactory := func(
+				client kubernetes.Interface,
+				defaultResync time.Duration,
+				options ...informers.SharedInformerOption,
+			) informers.SharedInformerFactory {
+				mu.Lock()
+				defer mu.Unlock()
+
+				periods = append(periods, defaultResync)
+
+				return informers.NewSharedInformerFactoryWithOptions(
+					client, defaultResync, options...)
+			}
+
+			var transformed atomic.Int32
+
+			secret, _ := labeledDevbox(t, "devbox", nil)
+			secret.Namespace = "tenant-a"
+
+			mgr := informer.New(fake.NewSimpleClientset(secret), registry.New(),
+				informer.WithResyncPeriod(tt.period),
+				informer.WithNamespaces("tenant-a", "tenant-b"),
+				informer.WithRevocationConfigMap("sshgate", "revoked-keys"),
+				informer.WithFactory(newFactory),
+				informer.WithTransform(func(obj any) (any, error) {
+					transformed.Add(1)
+					return obj, nil
+				}),
+			)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			if err := mgr.Start(ctx); err != nil {
+				t.Fatalf("Start() failed: %v", err)
+			}
+			defer mgr.Stop()
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			// One factory per namespace and one for the revocation ConfigMap
+			want := []time.Duration{tt.want, tt.want, tt.want}
+			if !slices.Equal(periods, want) {
+				t.Errorf("Factory resync periods = %v, want %v", periods, want)
+			}
+
+			if transformed.Load() == 0 {
+				t.Error("Transform not applied to the cached secret")
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package informer_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/informer"
+	"github.com/zijiren233/sshgate/registry"
+	"go.uber.org/goleak"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestStartStop_Repeated(t *testing.T) {
+	secret, pod := labeledDevbox(t, "devbox", nil)
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "sshgate", Name: "revoked-keys"},
+	}
+	clientset := fake.NewSimpleClientset(secret, pod, configMap)
+	servingDevboxResource(clientset)
+
+	reg := registry.New()
+	mgr := informer.New(clientset, reg,
+		informer.WithNamespaces("default", "other"),
+		informer.WithRevocationConfigMap("sshgate", "revoked-keys"),
+		informer.WithDevboxResource(
+			newDynamicClient(t, devboxResource("devbox", "Running", "", 0)),
+			informer.DefaultDevboxResource,
+		),
+	)
+
+	// Safe before Start
+	mgr.Stop()
+
+	if mgr.IsStarted() || mgr.IsStopped() {
+		t.Errorf("Manager never started is started %t, stopped %t", mgr.IsStarted(),
+			mgr.IsStopped())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	startStop := func() {
+		t.Helper()
+
+		if err := mgr.Start(ctx); err != nil {
+			t.Fatalf("Start() failed: %v", err)
+		}
+
+		if !mgr.IsStarted() || mgr.IsStopped() {
+			t.Errorf("Manager started is started %t, stopped %t", mgr.IsStarted(),
+				mgr.IsStopped())
+		}
+
+		if err := mgr.Start(ctx); !errors.Is(err, informer.ErrAlreadyStarted) {
+			t.Errorf("Start() of a running manager = %v, want ErrAlreadyStarted", err)
+		}
+
+		mgr.Stop()
+		mgr.Stop()
+
+		if mgr.IsStarted() || !mgr.IsStopped() {
+			t.Errorf("Manager stopped is started %t, stopped %t", mgr.IsStarted(),
+				mgr.IsStopped())
+		}
+	}
+
+	// Warm up so lazily started goroutines are part of the baseline
+	startStop()
+
+	baseline := goleak.IgnoreCurrent()
+
+	for range 10 {
+		startStop()
+	}
+
+	goleak.VerifyNone(t, baseline)
+
+	if info, ok := reg.GetDevboxInfo("default", "devbox"); !ok || info.PodIP == "" ||
+		info.DesiredState != registry.DesiredStateRunning {
+		t.Error("Devbox not registered with its pod and custom resource")
+	}
+}
+
+func TestStop_AbortsStart(t *testing.T) {
+	// The API server is unreachable, the caches never sync
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("list", "*", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("dial tcp: connection refused")
+	})
+
+	mgr := informer.New(clientset, registry.New())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	started := make(chan error, 1)
+
+	go func() { started <- mgr.Start(ctx) }()
+
+	for !mgr.IsStarted() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mgr.Stop()
+
+	select {
+	case err := <-started:
+		if !errors.Is(err, informer.ErrCacheSyncFailed) {
+			t.Errorf("Start() = %v, want ErrCacheSyncFailed", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("Stop did not abort Start")
+	}
+}
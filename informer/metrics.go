@@ -0,0 +1,109 @@
+package informer
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Kinds of the objects whose events are counted by the sshgate_informer_*
+// metrics
+const (
+	KindSecret    = "secret"
+	KindPod       = "pod"
+	KindConfigMap = "configmap"
+	KindDevbox    = "devbox"
+	// EndpointSlices replace pods with DiscoveryEndpointSlices
+	KindEndpointSlice = "endpointslice"
+)
+
+// Actions of the events counted by the sshgate_informer_* metrics
+const (
+	ActionAdd    = "add"
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+)
+
+// metrics instruments the event handlers of a manager. Labels are only the
+// kind and action of events, keeping the number of series bounded.
+type metrics struct {
+	events          *prometheus.CounterVec
+	handlerErrors   *prometheus.CounterVec
+	handlerDuration *prometheus.HistogramVec
+	collectors      []prometheus.Collector
+}
+
+func newMetrics() *metrics {
+	labels := []string{"kind", "action"}
+
+	m := &metrics{
+		events: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sshgate_informer_events_total",
+			Help: "Events received by the informers, by kind and action.",
+		}, labels),
+		handlerErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sshgate_informer_handler_errors_total",
+			Help: "Events the informer handlers failed to apply, by kind and action.",
+		}, labels),
+		handlerDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "sshgate_informer_handler_duration_seconds",
+			Help: "Time the informer handlers took to apply events, by kind and action.",
+			// From 10µs to about 2.6s
+			Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+		}, labels),
+	}
+
+	// Every label value is exported from the start
+	for _, kind := range []string{
+		KindSecret, KindPod, KindConfigMap, KindDevbox, KindEndpointSlice,
+	} {
+		for _, action := range []string{ActionAdd, ActionUpdate, ActionDelete} {
+			m.events.WithLabelValues(kind, action)
+			m.handlerErrors.WithLabelValues(kind, action)
+			m.handlerDuration.WithLabelValues(kind, action)
+		}
+	}
+
+	m.collectors = []prometheus.Collector{m.events, m.handlerErrors, m.handlerDuration}
+
+	return m
+}
+
+// WithMetrics registers the metrics of the informers on registerer, they are
+// not exposed otherwise
+func WithMetrics(registerer prometheus.Registerer) Option {
+	return func(m *Manager) {
+		m.metricsRegisterer = registerer
+	}
+}
+
+// register registers the metrics on registerer, a nil registerer registers none
+func (m *metrics) register(registerer prometheus.Registerer) error {
+	if registerer == nil {
+		return nil
+	}
+
+	for _, collector := range m.collectors {
+		if err := registerer.Register(collector); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// event counts an event of kind and returns a function observing how long its
+// handler took, to be deferred
+func (m *metrics) event(kind, action string) func() {
+	m.events.WithLabelValues(kind, action).Inc()
+
+	start := time.Now()
+
+	return func() {
+		m.handlerDuration.WithLabelValues(kind, action).Observe(time.Since(start).Seconds())
+	}
+}
+
+func (m *metrics) handlerError(kind, action string) {
+	m.handlerErrors.WithLabelValues(kind, action).Inc()
+}
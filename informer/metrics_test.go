@@ -0,0 +1,134 @@
+package informer_test
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/zijiren233/sshgate/informer"
+	"github.com/zijiren233/sshgate/registry"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// informerMetric returns the series of name gathered from gatherer for the
+// events of kind and action
+func informerMetric(
+	t *testing.T,
+	gatherer prometheus.Gatherer,
+	name, kind, action string,
+) *dto.Metric {
+	t.Helper()
+
+	families, err := gatherer.Gather()
+	if err != nil {
+		t.Fatalf("Gather failed: %v", err)
+	}
+
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+
+		for _, metric := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, pair := range metric.GetLabel() {
+				labels[pair.GetName()] = pair.GetValue()
+			}
+
+			if len(labels) == 2 && labels["kind"] == kind && labels["action"] == action {
+				return metric
+			}
+		}
+	}
+
+	t.Fatalf("No series %s{kind=%q,action=%q}", name, kind, action)
+
+	return nil
+}
+
+func TestMetrics(t *testing.T) {
+	gatherer := prometheus.NewRegistry()
+	mgr := informer.New(fake.NewSimpleClientset(), registry.New(),
+		informer.WithMetrics(gatherer))
+
+	// Every series is exported before any event
+	for _, kind := range []string{
+		informer.KindSecret, informer.KindPod, informer.KindConfigMap, informer.KindDevbox,
+		informer.KindEndpointSlice,
+	} {
+		for _, action := range []string{
+			informer.ActionAdd, informer.ActionUpdate, informer.ActionDelete,
+		} {
+			events := informerMetric(t, gatherer, "sshgate_informer_events_total", kind, action)
+			if v := events.GetCounter().GetValue(); v != 0 {
+				t.Errorf("events{kind=%q,action=%q} = %v, want 0", kind, action, v)
+			}
+		}
+	}
+
+	var secrets []*corev1.Secret
+
+	for _, name := range []string{"a", "b", "c"} {
+		secret, pod := labeledDevbox(t, name, nil)
+		secrets = append(secrets, secret)
+
+		if err := mgr.ProcessSecret(secret, "add"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := mgr.ProcessPod(pod, "add"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := mgr.ProcessPod(pod, "update"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := mgr.ProcessSecret(secrets[0], "delete"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A secret without an owner fails to apply
+	orphan := secrets[1].DeepCopy()
+	orphan.Name, orphan.OwnerReferences = "orphan", nil
+
+	if err := mgr.ProcessSecret(orphan, "update"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		kind, action string
+		events       float64
+		errors       float64
+	}{
+		{kind: informer.KindSecret, action: informer.ActionAdd, events: 3},
+		{kind: informer.KindSecret, action: informer.ActionUpdate, events: 1, errors: 1},
+		{kind: informer.KindSecret, action: informer.ActionDelete, events: 1},
+		{kind: informer.KindPod, action: informer.ActionAdd, events: 3},
+		{kind: informer.KindPod, action: informer.ActionUpdate, events: 3},
+		{kind: informer.KindPod, action: informer.ActionDelete},
+	}
+
+	for _, w := range want {
+		events := informerMetric(t, gatherer, "sshgate_informer_events_total", w.kind, w.action)
+		if v := events.GetCounter().GetValue(); v != w.events {
+			t.Errorf("events{kind=%q,action=%q} = %v, want %v", w.kind, w.action, v, w.events)
+		}
+
+		errors := informerMetric(t, gatherer, "sshgate_informer_handler_errors_total",
+			w.kind, w.action)
+		if v := errors.GetCounter().GetValue(); v != w.errors {
+			t.Errorf("handler_errors{kind=%q,action=%q} = %v, want %v",
+				w.kind, w.action, v, w.errors)
+		}
+
+		duration := informerMetric(t, gatherer, "sshgate_informer_handler_duration_seconds",
+			w.kind, w.action)
+		if n := duration.GetHistogram().GetSampleCount(); float64(n) != w.events {
+			t.Errorf("handler_duration{kind=%q,action=%q} has %d samples, want %v",
+				w.kind, w.action, n, w.events)
+		}
+	}
+}
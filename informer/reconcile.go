@@ -0,0 +1,135 @@
+package informer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/zijiren233/sshgate/registry"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// WithReconcileInterval reconciles the registry with the informer caches every
+// interval, zero never does
+func WithReconcileInterval(interval time.Duration) Option {
+	return func(m *Manager) {
+		m.reconcileInterval = max(interval, 0)
+	}
+}
+
+// Reconcile rebuilds the registry from the informer caches once they synced,
+// see registry.Registry.Resync: the secrets and pods, or EndpointSlices, the
+// registry missed are applied, and the devboxes and pods it holds that are gone
+// are removed. The event handlers keep running meanwhile.
+func (m *Manager) Reconcile(ctx context.Context) error {
+	_, err := m.reconcileRunning(ctx)
+	return err
+}
+
+// reconcileRunning reconciles the registry with the caches of the running
+// informers
+func (m *Manager) reconcileRunning(ctx context.Context) (registry.ResyncStats, error) {
+	m.mu.Lock()
+	informers := slices.Clone(m.devboxInformers)
+	running := m.cancel != nil
+	m.mu.Unlock()
+
+	if !running {
+		return registry.ResyncStats{}, ErrNotStarted
+	}
+
+	return m.reconcile(ctx, informers)
+}
+
+// reconcile reconciles the registry with the caches of the secret and pod, or
+// EndpointSlice, informers
+func (m *Manager) reconcile(
+	ctx context.Context,
+	informers []cache.SharedIndexInformer,
+) (registry.ResyncStats, error) {
+	synced := make([]cache.InformerSynced, 0, len(informers))
+	for _, informer := range informers {
+		synced = append(synced, informer.HasSynced)
+	}
+
+	if !cache.WaitForCacheSync(ctx.Done(), synced...) {
+		return registry.ResyncStats{}, ErrCacheSyncFailed
+	}
+
+	listedAt := time.Now()
+
+	var (
+		secrets        []*corev1.Secret
+		pods           []*corev1.Pod
+		endpointSlices []*discoveryv1.EndpointSlice
+	)
+
+	for _, informer := range informers {
+		for _, obj := range informer.GetStore().List() {
+			switch obj := obj.(type) {
+			case *corev1.Secret:
+				secrets = append(secrets, obj)
+			case *corev1.Pod:
+				pods = append(pods, obj)
+			case *discoveryv1.EndpointSlice:
+				endpointSlices = append(endpointSlices, obj)
+			}
+		}
+	}
+
+	return m.registry.Resync(listedAt, secrets, pods, endpointSlices), nil
+}
+
+// reconcilePeriodically reconciles the registry with the caches of informers
+// every reconcile interval until ctx is done
+func (m *Manager) reconcilePeriodically(
+	ctx context.Context,
+	informers []cache.SharedIndexInformer,
+) {
+	ticker := time.NewTicker(m.reconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if _, err := m.reconcile(ctx, informers); err != nil && ctx.Err() == nil {
+			m.logger.WithError(err).Warn("Failed to reconcile the registry")
+		}
+	}
+}
+
+// ReconcileHandler reconciles the registry on POST requests, answering with
+// the changes applied as JSON
+func (m *Manager) ReconcileHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		stats, err := m.reconcileRunning(r.Context())
+
+		switch {
+		case errors.Is(err, ErrNotStarted):
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(stats)
+	})
+}
@@ -0,0 +1,119 @@
+package informer_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/informer"
+	"github.com/zijiren233/sshgate/registry"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// reconcileRequest posts to the reconcile handler of mgr
+func reconcileRequest(mgr *informer.Manager, method string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	mgr.ReconcileHandler().ServeHTTP(recorder,
+		httptest.NewRequest(method, "/debug/reconcile", nil))
+
+	return recorder
+}
+
+// divergeRegistry makes reg miss the pod of the devbox named devbox and hold
+// the devbox named ghost, gone from the cluster
+func divergeRegistry(t *testing.T, reg *registry.Registry) {
+	t.Helper()
+
+	_, pod := labeledDevbox(t, "devbox", nil)
+	reg.DeletePod(pod)
+
+	ghost, ghostPod := labeledDevbox(t, "ghost", nil)
+	if err := reg.AddSecret(nil, ghost); err != nil {
+		t.Fatalf("AddSecret failed: %v", err)
+	}
+
+	if err := reg.UpdatePod(ghostPod); err != nil {
+		t.Fatalf("UpdatePod failed: %v", err)
+	}
+}
+
+// converged reports whether reg matches the cluster again
+func converged(reg *registry.Registry) bool {
+	info, ok := reg.GetDevboxInfo("default", "devbox")
+	_, ghostKnown := reg.GetDevboxInfo("default", "ghost")
+
+	return ok && info.PodIP == "10.0.0.1" && !ghostKnown
+}
+
+func TestReconcileHandler(t *testing.T) {
+	secret, pod := labeledDevbox(t, "devbox", nil)
+	// Objects held at their version are not applied again
+	secret.ResourceVersion, pod.ResourceVersion = "1", "1"
+	reg := registry.New()
+	mgr := informer.New(fake.NewSimpleClientset(secret, pod), reg)
+
+	if code := reconcileRequest(mgr, http.MethodPost).Code; code != http.StatusServiceUnavailable {
+		t.Errorf("Reconcile before Start = %d, want 503", code)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := mgr.Start(ctx); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer mgr.Stop()
+
+	divergeRegistry(t, reg)
+
+	if code := reconcileRequest(mgr, http.MethodGet).Code; code != http.StatusMethodNotAllowed {
+		t.Errorf("GET = %d, want 405", code)
+	}
+
+	recorder := reconcileRequest(mgr, http.MethodPost)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Reconcile = %d: %s", recorder.Code, recorder.Body)
+	}
+
+	var stats registry.ResyncStats
+	if err := json.NewDecoder(recorder.Body).Decode(&stats); err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+
+	want := registry.ResyncStats{PodsApplied: 1, SecretsRemoved: 1}
+	if stats != want {
+		t.Errorf("Reconcile = %+v, want %+v", stats, want)
+	}
+
+	if !converged(reg) {
+		t.Error("Registry not converged with the cluster")
+	}
+}
+
+func TestReconcileInterval(t *testing.T) {
+	secret, pod := labeledDevbox(t, "devbox", nil)
+	reg := registry.New()
+	mgr := informer.New(fake.NewSimpleClientset(secret, pod), reg,
+		informer.WithReconcileInterval(20*time.Millisecond))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := mgr.Start(ctx); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer mgr.Stop()
+
+	divergeRegistry(t, reg)
+
+	for !converged(reg) {
+		select {
+		case <-ctx.Done():
+			t.Fatal("Registry not converged with the cluster")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
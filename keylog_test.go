@@ -0,0 +1,110 @@
+package main_test
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// logMethods are the methods of loggers, logrus and the standard library, whose
+// arguments end up in the logs
+var logMethods = map[string]bool{
+	"WithField": true, "WithFields": true,
+	"Trace": true, "Tracef": true, "Debug": true, "Debugf": true,
+	"Info": true, "Infof": true, "Print": true, "Printf": true, "Println": true,
+	"Warn": true, "Warnf": true, "Error": true, "Errorf": true,
+	"Fatal": true, "Fatalf": true, "Panic": true, "Panicf": true,
+}
+
+// keyNames are the identifiers and fields holding key material: private keys,
+// public key blobs and the data of secrets
+var keyNames = map[string]bool{
+	"PrivateKey": true, "privateKey": true, "privateKeyPEM": true, "privateKeyData": true,
+	"PublicKey": true, "publicKey": true, "publicKeyData": true,
+	"marshaledPublicKey": true, "pubKeyStr": true, "Marshal": true,
+	"MarshalAuthorizedKey": true, "Data": true,
+}
+
+// fingerprintFuncs turn keys into what may be logged
+var fingerprintFuncs = map[string]bool{
+	"FingerprintSHA256": true, "FingerprintLegacyMD5": true,
+}
+
+// keyReference returns the name of the key material expr refers to outside of
+// a fingerprint, if any
+func keyReference(expr ast.Node) string {
+	var found string
+
+	ast.Inspect(expr, func(node ast.Node) bool {
+		if found != "" {
+			return false
+		}
+
+		switch node := node.(type) {
+		case *ast.CallExpr:
+			if sel, ok := node.Fun.(*ast.SelectorExpr); ok && fingerprintFuncs[sel.Sel.Name] {
+				return false
+			}
+		case *ast.SelectorExpr:
+			if keyNames[node.Sel.Name] {
+				found = node.Sel.Name
+			}
+		case *ast.Ident:
+			if keyNames[node.Name] {
+				found = node.Name
+			}
+		}
+
+		return true
+	})
+
+	return found
+}
+
+// TestLogsCarryNoKeyMaterial scans the log statements of the registry and the
+// gateway, they may log fingerprints of keys but never keys
+func TestLogsCarryNoKeyMaterial(t *testing.T) {
+	for _, dir := range []string{".", "registry", "gateway", "informer"} {
+		files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+		if err != nil {
+			t.Fatalf("Glob failed: %v", err)
+		}
+
+		fset := token.NewFileSet()
+
+		for _, path := range files {
+			if strings.HasSuffix(path, "_test.go") {
+				continue
+			}
+
+			file, err := parser.ParseFile(fset, path, nil, 0)
+			if err != nil {
+				t.Fatalf("Failed to parse %s: %v", path, err)
+			}
+
+			ast.Inspect(file, func(node ast.Node) bool {
+				call, ok := node.(*ast.CallExpr)
+				if !ok {
+					return true
+				}
+
+				sel, ok := call.Fun.(*ast.SelectorExpr)
+				if !ok || !logMethods[sel.Sel.Name] {
+					return true
+				}
+
+				for _, arg := range call.Args {
+					if name := keyReference(arg); name != "" {
+						t.Errorf("%s: %s logs %s, log its fingerprint instead",
+							fset.Position(call.Pos()), sel.Sel.Name, name)
+					}
+				}
+
+				return true
+			})
+		}
+	}
+}
@@ -0,0 +1,206 @@
+// Package kubeclient builds the configuration of the Kubernetes clients of the
+// gateway
+package kubeclient
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	// DefaultQPS and DefaultBurst rate limit the requests to the API server,
+	// well above the client-go defaults throttling the initial lists of large
+	// clusters
+	DefaultQPS   = 50
+	DefaultBurst = 100
+)
+
+// Source is where the configuration of Kubernetes clients was loaded from
+type Source string
+
+const (
+	// SourceInCluster is the service account of the pod of the gateway
+	SourceInCluster Source = "in-cluster"
+	// SourceKubeconfig is a kubeconfig file
+	SourceKubeconfig Source = "kubeconfig"
+)
+
+// Loader loads the configurations of Kubernetes clients, see DefaultLoader
+type Loader interface {
+	// InClusterConfig loads the configuration of the service account of the
+	// pod, failing outside a cluster
+	InClusterConfig() (*rest.Config, error)
+	// KubeconfigConfig loads the configuration of context in the kubeconfig
+	// files of path, a list of the OS path list separator. The default files
+	// and their current context are used when empty.
+	KubeconfigConfig(path, context string) (*rest.Config, error)
+}
+
+// DefaultLoader loads configurations with client-go
+var DefaultLoader Loader = defaultLoader{}
+
+type defaultLoader struct{}
+
+func (defaultLoader) InClusterConfig() (*rest.Config, error) {
+	return rest.InClusterConfig()
+}
+
+func (defaultLoader) KubeconfigConfig(path, context string) (*rest.Config, error) {
+	// KUBECONFIG, else ~/.kube/config
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if path != "" {
+		rules.Precedence = filepath.SplitList(path)
+	}
+
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		rules,
+		&clientcmd.ConfigOverrides{CurrentContext: context},
+	).ClientConfig()
+}
+
+// options configure NewConfig
+type options struct {
+	kubeconfig string
+	context    string
+	qps        float32
+	burst      int
+	timeout    time.Duration
+	userAgent  string
+	loader     Loader
+}
+
+// Option configures NewConfig
+type Option func(*options)
+
+// WithKubeconfig reads the kubeconfig files of path outside a cluster, the
+// default ones when empty. A context forces the kubeconfig files to be read,
+// in a cluster too, and selects the context used.
+func WithKubeconfig(path, context string) Option {
+	return func(o *options) {
+		o.kubeconfig, o.context = path, context
+	}
+}
+
+// WithRateLimit sets the requests per second and the burst allowed to the
+// clients, zero keeps the defaults
+func WithRateLimit(qps float32, burst int) Option {
+	return func(o *options) {
+		if qps > 0 {
+			o.qps = qps
+		}
+
+		if burst > 0 {
+			o.burst = burst
+		}
+	}
+}
+
+// WithTimeout bounds the requests of the clients, zero does not. Watches are
+// bounded too, the informers reopen them.
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.timeout = max(timeout, 0)
+	}
+}
+
+// WithUserAgent sets the user agent of the clients, the default is UserAgent
+func WithUserAgent(userAgent string) Option {
+	return func(o *options) {
+		if userAgent != "" {
+			o.userAgent = userAgent
+		}
+	}
+}
+
+// WithLoader sets the loader of the configurations, tests use it to run in or
+// out of a cluster
+func WithLoader(loader Loader) Option {
+	return func(o *options) {
+		if loader != nil {
+			o.loader = loader
+		}
+	}
+}
+
+// NewConfig returns the configuration of Kubernetes clients: the service
+// account of the pod in a cluster, falling back to the kubeconfig files
+// outside, along with its source
+func NewConfig(opts ...Option) (*rest.Config, Source, error) {
+	o := options{
+		qps:       DefaultQPS,
+		burst:     DefaultBurst,
+		userAgent: UserAgent(),
+		loader:    DefaultLoader,
+	}
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	config, source, err := o.load()
+	if err != nil {
+		return nil, "", err
+	}
+
+	config.QPS, config.Burst = o.qps, o.burst
+	config.Timeout = o.timeout
+	config.UserAgent = o.userAgent
+
+	log.WithFields(log.Fields{
+		"component": "kubeclient",
+		"source":    source,
+		"host":      config.Host,
+		"context":   o.context,
+		"qps":       config.QPS,
+		"burst":     config.Burst,
+		"timeout":   config.Timeout,
+	}).Info("Configured Kubernetes client")
+
+	return config, source, nil
+}
+
+// load loads the configuration and returns its source
+func (o *options) load() (*rest.Config, Source, error) {
+	if o.context == "" {
+		config, err := o.loader.InClusterConfig()
+		if err == nil {
+			return config, SourceInCluster, nil
+		}
+	}
+
+	config, err := o.loader.KubeconfigConfig(o.kubeconfig, o.context)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to load kubeconfig: %w", err)
+	}
+
+	return config, SourceKubeconfig, nil
+}
+
+// UserAgent returns the user agent of the gateway, sshgate/<version> with the
+// module version or the VCS revision it was built from
+func UserAgent() string {
+	version := "devel"
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "sshgate/" + version
+	}
+
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return "sshgate/" + info.Main.Version
+	}
+
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" && setting.Value != "" {
+			version = setting.Value[:min(len(setting.Value), 12)]
+		}
+	}
+
+	return "sshgate/" + version
+}
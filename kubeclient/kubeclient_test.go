@@ -0,0 +1,182 @@
+package kubeclient_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/kubeclient"
+	"k8s.io/client-go/rest"
+)
+
+// fakeLoader loads configurations of fake hosts, in a cluster or not
+type fakeLoader struct {
+	inCluster bool
+	// path and context are those the kubeconfig files were loaded with
+	path, context string
+	loaded        bool
+}
+
+func (l *fakeLoader) InClusterConfig() (*rest.Config, error) {
+	if !l.inCluster {
+		return nil, rest.ErrNotInCluster
+	}
+
+	return &rest.Config{Host: "https://in-cluster"}, nil
+}
+
+func (l *fakeLoader) KubeconfigConfig(path, context string) (*rest.Config, error) {
+	l.path, l.context, l.loaded = path, context, true
+
+	if context == "missing" {
+		return nil, errors.New(`context "missing" does not exist`)
+	}
+
+	return &rest.Config{Host: "https://kubeconfig"}, nil
+}
+
+func TestNewConfig_Source(t *testing.T) {
+	tests := []struct {
+		name       string
+		inCluster  bool
+		path       string
+		context    string
+		wantSource kubeclient.Source
+		wantHost   string
+	}{
+		{
+			name:       "in cluster",
+			inCluster:  true,
+			path:       "/etc/kubeconfig",
+			wantSource: kubeclient.SourceInCluster,
+			wantHost:   "https://in-cluster",
+		},
+		{
+			name:       "kubeconfig fallback",
+			path:       "/etc/kubeconfig",
+			wantSource: kubeclient.SourceKubeconfig,
+			wantHost:   "https://kubeconfig",
+		},
+		{
+			name:       "context in cluster",
+			inCluster:  true,
+			context:    "staging",
+			wantSource: kubeclient.SourceKubeconfig,
+			wantHost:   "https://kubeconfig",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loader := &fakeLoader{inCluster: tt.inCluster}
+
+			config, source, err := kubeclient.NewConfig(
+				kubeclient.WithLoader(loader),
+				kubeclient.WithKubeconfig(tt.path, tt.context),
+			)
+			if err != nil {
+				t.Fatalf("NewConfig() failed: %v", err)
+			}
+
+			if source != tt.wantSource || config.Host != tt.wantHost {
+				t.Errorf("NewConfig() = %s from %s, want %s from %s",
+					config.Host, source, tt.wantHost, tt.wantSource)
+			}
+
+			if loader.loaded && (loader.path != tt.path || loader.context != tt.context) {
+				t.Errorf("Kubeconfig loaded with %q, %q, want %q, %q",
+					loader.path, loader.context, tt.path, tt.context)
+			}
+		})
+	}
+}
+
+func TestNewConfig_MissingContext(t *testing.T) {
+	_, _, err := kubeclient.NewConfig(
+		kubeclient.WithLoader(&fakeLoader{inCluster: true}),
+		kubeclient.WithKubeconfig("", "missing"),
+	)
+	if err == nil {
+		t.Error("NewConfig() with a missing context succeeded")
+	}
+}
+
+func TestNewConfig_Client(t *testing.T) {
+	loader := &fakeLoader{inCluster: true}
+
+	config, _, err := kubeclient.NewConfig(kubeclient.WithLoader(loader))
+	if err != nil {
+		t.Fatalf("NewConfig() failed: %v", err)
+	}
+
+	if config.QPS != kubeclient.DefaultQPS || config.Burst != kubeclient.DefaultBurst ||
+		config.Timeout != 0 {
+		t.Errorf("Default QPS %v, burst %d, timeout %s", config.QPS, config.Burst, config.Timeout)
+	}
+
+	if !strings.HasPrefix(config.UserAgent, "sshgate/") {
+		t.Errorf("UserAgent = %q, want sshgate/<version>", config.UserAgent)
+	}
+
+	config, _, err = kubeclient.NewConfig(
+		kubeclient.WithLoader(loader),
+		kubeclient.WithRateLimit(200, 400),
+		kubeclient.WithTimeout(30*time.Second),
+		kubeclient.WithUserAgent("sshgate/test"),
+	)
+	if err != nil {
+		t.Fatalf("NewConfig() failed: %v", err)
+	}
+
+	if config.QPS != 200 || config.Burst != 400 || config.Timeout != 30*time.Second ||
+		config.UserAgent != "sshgate/test" {
+		t.Errorf("Configured QPS %v, burst %d, timeout %s, user agent %q",
+			config.QPS, config.Burst, config.Timeout, config.UserAgent)
+	}
+}
+
+func TestDefaultLoader_Context(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kubeconfig")
+
+	err := os.WriteFile(path, []byte(`apiVersion: v1
+kind: Config
+clusters:
+- name: prod
+  cluster: {server: "https://prod.example.com"}
+- name: staging
+  cluster: {server: "https://staging.example.com"}
+users:
+- name: gateway
+  user: {token: secret}
+contexts:
+- name: prod
+  context: {cluster: prod, user: gateway}
+- name: staging
+  context: {cluster: staging, user: gateway}
+current-context: prod
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for context, want := range map[string]string{
+		"":        "https://prod.example.com",
+		"staging": "https://staging.example.com",
+	} {
+		config, err := kubeclient.DefaultLoader.KubeconfigConfig(path, context)
+		if err != nil {
+			t.Fatalf("KubeconfigConfig(%q) failed: %v", context, err)
+		}
+
+		if config.Host != want {
+			t.Errorf("KubeconfigConfig(%q) = %s, want %s", context, config.Host, want)
+		}
+	}
+
+	if _, err := kubeclient.DefaultLoader.KubeconfigConfig(path, "missing"); err == nil {
+		t.Error("KubeconfigConfig() with a missing context succeeded")
+	}
+}
@@ -0,0 +1,204 @@
+// Package listen creates the listening socket of the SSH gateway
+package listen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Options holds listener configuration options
+type Options struct {
+	// ReusePort sets SO_REUSEPORT so a new process can bind the address
+	// while the old one is still accepting
+	ReusePort bool
+	// FD is an inherited listening socket used instead of binding, 0 disables it
+	FD int
+	// SocketMode is the permission of Unix socket files
+	SocketMode os.FileMode
+	// SocketUID and SocketGID own Unix socket files, -1 keeps the process' own
+	SocketUID int
+	SocketGID int
+}
+
+// Option is a function that configures Options
+type Option func(*Options)
+
+// WithReusePort sets whether the listening socket is bound with SO_REUSEPORT
+func WithReusePort(reusePort bool) Option {
+	return func(o *Options) {
+		o.ReusePort = reusePort
+	}
+}
+
+// WithInheritedFD sets the file descriptor of a listening socket passed by the
+// parent process, taking precedence over binding the address
+func WithInheritedFD(fd int) Option {
+	return func(o *Options) {
+		o.FD = fd
+	}
+}
+
+// WithSocketMode sets the permission of Unix socket files
+func WithSocketMode(mode os.FileMode) Option {
+	return func(o *Options) {
+		o.SocketMode = mode
+	}
+}
+
+// WithSocketOwner sets the owner of Unix socket files, -1 leaves an id unchanged
+func WithSocketOwner(uid, gid int) Option {
+	return func(o *Options) {
+		o.SocketUID = uid
+		o.SocketGID = gid
+	}
+}
+
+func newOptions(opts []Option) *Options {
+	options := &Options{
+		SocketMode: 0o660,
+		SocketUID:  -1,
+		SocketGID:  -1,
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	return options
+}
+
+// ErrReusePortUnsupported is returned when SO_REUSEPORT is unavailable on the platform
+var ErrReusePortUnsupported = errors.New("SO_REUSEPORT is not supported on this platform")
+
+// Listen returns a listener for addr. Addresses of the form unix:///path/to/socket
+// listen on a Unix socket, others on TCP like net.Listen.
+func Listen(ctx context.Context, addr string, opts ...Option) (net.Listener, error) {
+	options := newOptions(opts)
+
+	logger := log.WithField("component", "listen")
+
+	if options.FD > 0 {
+		ln, err := fileListener(options.FD)
+		if err != nil {
+			return nil, err
+		}
+
+		logger.WithFields(log.Fields{
+			"fd":   options.FD,
+			"addr": ln.Addr().String(),
+		}).Info("Using inherited listener")
+
+		return ln, nil
+	}
+
+	if path, ok := strings.CutPrefix(addr, UnixScheme); ok {
+		return listenUnix(ctx, path, options)
+	}
+
+	var lc net.ListenConfig
+
+	if options.ReusePort {
+		lc.Control = reusePortControl
+	}
+
+	ln, err := lc.Listen(ctx, network(addr), addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.ReusePort {
+		logger.WithField("addr", ln.Addr().String()).Info("Listening with SO_REUSEPORT")
+	}
+
+	return ln, nil
+}
+
+// ListenAll returns a TCP listener for each address, or the inherited listener
+// alone if one is configured. If any address can't be bound, the listeners already
+// created are closed and the error names the address.
+func ListenAll(ctx context.Context, addrs []string, opts ...Option) ([]net.Listener, error) {
+	options := newOptions(opts)
+
+	if options.FD > 0 {
+		ln, err := Listen(ctx, "", opts...)
+		if err != nil {
+			return nil, err
+		}
+
+		return []net.Listener{ln}, nil
+	}
+
+	listeners := make([]net.Listener, 0, len(addrs))
+
+	for _, addr := range addrs {
+		ln, err := Listen(ctx, addr, opts...)
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+
+			return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+		}
+
+		listeners = append(listeners, ln)
+	}
+
+	return listeners, nil
+}
+
+// network returns the network for addr. Literal IPv4 and IPv6 hosts bind a single
+// address family, so 0.0.0.0:22 and [::]:22 can be listened on side by side.
+func network(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "tcp"
+	}
+
+	ip := net.ParseIP(host)
+
+	switch {
+	case ip == nil:
+		return "tcp"
+	case ip.To4() != nil:
+		return "tcp4"
+	default:
+		return "tcp6"
+	}
+}
+
+func fileListener(fd int) (net.Listener, error) {
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("listener-fd-%d", fd))
+	if f == nil {
+		return nil, fmt.Errorf("invalid listener file descriptor %d", fd)
+	}
+	// net.FileListener duplicates the descriptor
+	defer f.Close()
+
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to use inherited listener fd %d: %w", fd, err)
+	}
+
+	return ln, nil
+}
+
+// FileMode is a file permission parsed from an octal string such as 0660
+type FileMode os.FileMode
+
+// UnmarshalText parses an octal file permission
+func (m *FileMode) UnmarshalText(text []byte) error {
+	mode, err := strconv.ParseUint(string(text), 8, 32)
+	if err != nil || mode > 0o777 {
+		return fmt.Errorf("invalid file mode %q, expected octal permissions", text)
+	}
+
+	*m = FileMode(mode)
+
+	return nil
+}
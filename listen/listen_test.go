@@ -0,0 +1,281 @@
+package listen_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/listen"
+)
+
+// acceptAll counts connections accepted by ln until it is closed
+func acceptAll(ln net.Listener, mu *sync.Mutex, count *int) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+
+		mu.Lock()
+		*count++
+		mu.Unlock()
+
+		conn.Close()
+	}
+}
+
+func TestListen_ReusePortSharesAddress(t *testing.T) {
+	ctx := context.Background()
+
+	first, err := listen.Listen(ctx, "127.0.0.1:0", listen.WithReusePort(true))
+	if err != nil {
+		t.Fatalf("Listen() failed: %v", err)
+	}
+	defer first.Close()
+
+	addr := first.Addr().String()
+
+	second, err := listen.Listen(ctx, addr, listen.WithReusePort(true))
+	if err != nil {
+		t.Fatalf("Second Listen() on %s failed: %v", addr, err)
+	}
+	defer second.Close()
+
+	var (
+		mu             sync.Mutex
+		firstAccepted  int
+		secondAccepted int
+	)
+
+	go acceptAll(first, &mu, &firstAccepted)
+	go acceptAll(second, &mu, &secondAccepted)
+
+	// The kernel spreads connections by hash, keep dialing until both accepted one
+	var d net.Dialer
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+
+		conn.Close()
+
+		mu.Lock()
+		done := firstAccepted > 0 && secondAccepted > 0
+		mu.Unlock()
+
+		if done {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Accepted %d and %d connections, want both listeners to accept",
+				firstAccepted, secondAccepted)
+		}
+	}
+}
+
+func TestListen_DefaultDoesNotShareAddress(t *testing.T) {
+	ctx := context.Background()
+
+	first, err := listen.Listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() failed: %v", err)
+	}
+	defer first.Close()
+
+	second, err := listen.Listen(ctx, first.Addr().String())
+	if err == nil {
+		second.Close()
+		t.Fatal("Expected second Listen() on the same address to fail")
+	}
+}
+
+func TestListen_InheritedFD(t *testing.T) {
+	var lc net.ListenConfig
+
+	parent, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() failed: %v", err)
+	}
+	defer parent.Close()
+
+	tcpListener, ok := parent.(*net.TCPListener)
+	if !ok {
+		t.Fatal("Listener is not a TCP listener")
+	}
+
+	// File duplicates the socket like passing it to a child process would
+	f, err := tcpListener.File()
+	if err != nil {
+		t.Fatalf("File() failed: %v", err)
+	}
+	defer f.Close()
+
+	ln, err := listen.Listen(context.Background(), "ignored:0", listen.WithInheritedFD(int(f.Fd())))
+	if err != nil {
+		t.Fatalf("Listen() with inherited fd failed: %v", err)
+	}
+	defer ln.Close()
+
+	if ln.Addr().String() != parent.Addr().String() {
+		t.Errorf("Inherited listener address = %s, want %s", ln.Addr(), parent.Addr())
+	}
+
+	// Stop the parent accepting so the connection must go to the inherited listener
+	parent.Close()
+
+	go func() {
+		var d net.Dialer
+
+		conn, err := d.DialContext(context.Background(), "tcp", ln.Addr().String())
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept() on inherited listener failed: %v", err)
+	}
+
+	conn.Close()
+}
+
+func TestListen_InvalidFD(t *testing.T) {
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", os.DevNull, err)
+	}
+	defer devNull.Close()
+
+	_, err = listen.Listen(context.Background(), "", listen.WithInheritedFD(int(devNull.Fd())))
+	if err == nil {
+		t.Error("Expected error for a descriptor that is not a socket")
+	}
+}
+
+func TestListenAll_DualStack(t *testing.T) {
+	ctx := context.Background()
+
+	probe, err := listen.Listen(ctx, "0.0.0.0:0")
+	if err != nil {
+		t.Fatalf("Listen() failed: %v", err)
+	}
+
+	_, port, _ := net.SplitHostPort(probe.Addr().String())
+	probe.Close()
+
+	listeners, err := listen.ListenAll(ctx, []string{
+		net.JoinHostPort("0.0.0.0", port),
+		net.JoinHostPort("::", port),
+	})
+	if err != nil {
+		t.Skipf("IPv6 is unavailable: %v", err)
+	}
+
+	for _, ln := range listeners {
+		ln.Close()
+	}
+
+	if len(listeners) != 2 {
+		t.Errorf("ListenAll() returned %d listeners, want 2", len(listeners))
+	}
+}
+
+func TestListenAll_FailureNamesAddress(t *testing.T) {
+	ctx := context.Background()
+
+	taken, err := listen.Listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() failed: %v", err)
+	}
+	defer taken.Close()
+
+	addr := taken.Addr().String()
+
+	_, err = listen.ListenAll(ctx, []string{"127.0.0.1:0", addr})
+	if err == nil {
+		t.Fatal("Expected ListenAll() to fail on a bound address")
+	}
+
+	if !strings.Contains(err.Error(), addr) {
+		t.Errorf("Error %q does not name %s", err, addr)
+	}
+}
+
+func TestListen_UnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gw.sock")
+
+	// A stale socket file left behind by a crashed process
+	stale, err := net.Listen("unix", path) //nolint:noctx // acceptable for testing
+	if err != nil {
+		t.Fatalf("Failed to create stale socket: %v", err)
+	}
+
+	if unixListener, ok := stale.(*net.UnixListener); ok {
+		unixListener.SetUnlinkOnClose(false)
+	}
+
+	stale.Close()
+
+	ln, err := listen.Listen(context.Background(), "unix://"+path, listen.WithSocketMode(0o600))
+	if err != nil {
+		t.Fatalf("Listen() failed: %v", err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat() failed: %v", err)
+	}
+
+	if fi.Mode().Perm() != 0o600 {
+		t.Errorf("Socket mode = %o, want 600", fi.Mode().Perm())
+	}
+
+	// A live socket is never replaced
+	if _, err := listen.Listen(context.Background(), "unix://"+path); err == nil {
+		t.Error("Expected Listen() on a socket in use to fail")
+	}
+
+	ln.Close()
+
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Socket file not removed on close: %v", err)
+	}
+}
+
+func TestListen_UnixSocketKeepsRegularFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gw.sock")
+	if err := os.WriteFile(path, []byte("data"), 0o600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	if _, err := listen.Listen(context.Background(), "unix://"+path); err == nil {
+		t.Error("Expected Listen() over a regular file to fail")
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Regular file was removed: %v", err)
+	}
+}
+
+func TestFileMode_UnmarshalText(t *testing.T) {
+	var mode listen.FileMode
+
+	if err := mode.UnmarshalText([]byte("0660")); err != nil || mode != 0o660 {
+		t.Errorf("UnmarshalText(0660) = %o, %v, want 660", mode, err)
+	}
+
+	if err := mode.UnmarshalText([]byte("rw-rw----")); err == nil {
+		t.Error("Expected error for a non-octal mode")
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix || solaris
+
+package listen
+
+import "syscall"
+
+func reusePortControl(_, _ string, _ syscall.RawConn) error {
+	return ErrReusePortUnsupported
+}
@@ -0,0 +1,84 @@
+package listen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// UnixScheme prefixes listen addresses of Unix sockets
+const UnixScheme = "unix://"
+
+// listenUnix listens on the Unix socket at path, replacing a stale socket file
+// left behind by a previous process. The socket file is removed when the listener
+// is closed.
+func listenUnix(ctx context.Context, path string, options *Options) (net.Listener, error) {
+	if path == "" {
+		return nil, errors.New("empty unix socket path")
+	}
+
+	if err := removeStaleSocket(ctx, path); err != nil {
+		return nil, err
+	}
+
+	var lc net.ListenConfig
+
+	ln, err := lc.Listen(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, options.SocketMode); err != nil {
+		_ = ln.Close()
+		return nil, fmt.Errorf("failed to set unix socket mode: %w", err)
+	}
+
+	if options.SocketUID >= 0 || options.SocketGID >= 0 {
+		if err := os.Chown(path, options.SocketUID, options.SocketGID); err != nil {
+			_ = ln.Close()
+			return nil, fmt.Errorf("failed to set unix socket owner: %w", err)
+		}
+	}
+
+	log.WithField("component", "listen").
+		WithField("path", path).
+		Info("Listening on unix socket")
+
+	return ln, nil
+}
+
+// removeStaleSocket removes the socket file at path unless a process still accepts on it.
+// Files that are not sockets are never removed.
+func removeStaleSocket(ctx context.Context, path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a unix socket", path)
+	}
+
+	d := net.Dialer{Timeout: time.Second}
+
+	conn, err := d.DialContext(ctx, "unix", path)
+	if err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("unix socket %s is in use by another process", path)
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove stale unix socket: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,317 @@
+package listen
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/websocket"
+)
+
+// WebSocketOptions holds WebSocket listener configuration options
+type WebSocketOptions struct {
+	// Path is the HTTP path accepting WebSocket upgrades
+	Path string
+	// TLSCertFile and TLSKeyFile enable TLS when both are set
+	TLSCertFile string
+	TLSKeyFile  string
+	// BearerToken, when set, must be presented in the Authorization header
+	BearerToken string
+	// TrustedProxies are CIDRs or IPs whose X-Forwarded-For header is honored
+	TrustedProxies []string
+}
+
+// WebSocketOption is a function that configures WebSocketOptions
+type WebSocketOption func(*WebSocketOptions)
+
+// WithWebSocketPath sets the HTTP path accepting WebSocket upgrades
+func WithWebSocketPath(path string) WebSocketOption {
+	return func(o *WebSocketOptions) {
+		o.Path = path
+	}
+}
+
+// WithWebSocketTLS serves WebSockets over TLS with the given certificate and key files
+func WithWebSocketTLS(certFile, keyFile string) WebSocketOption {
+	return func(o *WebSocketOptions) {
+		o.TLSCertFile = certFile
+		o.TLSKeyFile = keyFile
+	}
+}
+
+// WithWebSocketBearerToken requires clients to present token as a bearer token
+func WithWebSocketBearerToken(token string) WebSocketOption {
+	return func(o *WebSocketOptions) {
+		o.BearerToken = token
+	}
+}
+
+// WithWebSocketTrustedProxies sets the proxies whose X-Forwarded-For header
+// determines the client address
+func WithWebSocketTrustedProxies(proxies []string) WebSocketOption {
+	return func(o *WebSocketOptions) {
+		o.TrustedProxies = proxies
+	}
+}
+
+// DefaultWebSocketPath is the default HTTP path accepting WebSocket upgrades
+const DefaultWebSocketPath = "/ssh"
+
+// webSocketListener is a net.Listener whose connections carry an SSH byte stream
+// in binary WebSocket messages
+type webSocketListener struct {
+	server  *http.Server
+	addr    webSocketAddr
+	trusted []*net.IPNet
+	token   string
+
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// webSocketAddr is the address of a WebSocket listener, such as wss://0.0.0.0:443/ssh
+type webSocketAddr string
+
+func (a webSocketAddr) Network() string { return "websocket" }
+
+func (a webSocketAddr) String() string { return string(a) }
+
+// ListenWebSocket listens on addr for WebSocket upgrades, returning a listener
+// whose connections carry the SSH byte stream of plain binary messages, as sent
+// by websocat-style ProxyCommand tooling
+func ListenWebSocket(
+	ctx context.Context,
+	addr string,
+	opts ...WebSocketOption,
+) (net.Listener, error) {
+	options := &WebSocketOptions{Path: DefaultWebSocketPath}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	trusted, err := parseTrustedProxies(options.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := "ws"
+
+	var tlsConfig *tls.Config
+
+	if options.TLSCertFile != "" || options.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(options.TLSCertFile, options.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load websocket TLS key pair: %w", err)
+		}
+
+		tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+		scheme = "wss"
+	}
+
+	ln, err := Listen(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	wl := &webSocketListener{
+		addr:    webSocketAddr(scheme + "://" + ln.Addr().String() + options.Path),
+		trusted: trusted,
+		token:   options.BearerToken,
+		conns:   make(chan net.Conn),
+		done:    make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(options.Path, wl)
+
+	wl.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		TLSConfig:         tlsConfig,
+	}
+
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+
+	go func() {
+		if err := wl.server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.WithField("component", "listen").
+				WithField("addr", wl.addr.String()).
+				WithError(err).
+				Error("WebSocket server stopped")
+		}
+	}()
+
+	return wl, nil
+}
+
+func (l *webSocketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting WebSocket upgrades, established connections are kept
+func (l *webSocketListener) Close() error {
+	var err error
+
+	l.closeOnce.Do(func() {
+		close(l.done)
+		err = l.server.Close()
+	})
+
+	return err
+}
+
+func (l *webSocketListener) Addr() net.Addr {
+	return l.addr
+}
+
+func (l *webSocketListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if l.token != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(l.token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	remote := l.clientAddr(r)
+
+	websocket.Server{
+		// Clients are SSH tools rather than browsers, they send no Origin
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			ws.PayloadType = websocket.BinaryFrame
+
+			conn := &webSocketConn{
+				Conn:   ws,
+				local:  l.addr,
+				remote: remote,
+				closed: make(chan struct{}),
+			}
+
+			select {
+			case l.conns <- conn:
+			case <-l.done:
+				return
+			}
+
+			// The WebSocket is closed as soon as the handler returns
+			<-conn.closed
+		},
+	}.ServeHTTP(w, r)
+}
+
+// clientAddr returns the address of the client, taken from X-Forwarded-For
+// when the request comes from a trusted proxy
+func (l *webSocketListener) clientAddr(r *http.Request) net.Addr {
+	host, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return webSocketAddr(r.RemoteAddr)
+	}
+
+	peer := &net.TCPAddr{IP: net.ParseIP(host)}
+	_, _ = fmt.Sscanf(port, "%d", &peer.Port)
+
+	if !l.isTrusted(peer.IP) {
+		return peer
+	}
+
+	// Walk the chain from the closest hop, the first untrusted address is the client
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+
+		if !l.isTrusted(ip) || i == 0 {
+			return &net.TCPAddr{IP: ip}
+		}
+	}
+
+	return peer
+}
+
+func (l *webSocketListener) isTrusted(ip net.IP) bool {
+	for _, network := range l.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(proxies))
+
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", proxy)
+			}
+
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// webSocketConn adapts a server WebSocket to the SSH byte stream of a net.Conn
+type webSocketConn struct {
+	*websocket.Conn
+
+	local     net.Addr
+	remote    net.Addr
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *webSocketConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *webSocketConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *webSocketConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() { close(c.closed) })
+
+	return err
+}
@@ -0,0 +1,153 @@
+package listen_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/zijiren233/sshgate/listen"
+	"golang.org/x/net/websocket"
+)
+
+// dialWebSocket opens a binary WebSocket to the listener with extra headers
+func dialWebSocket(ln net.Listener, header http.Header) (*websocket.Conn, error) {
+	host := ln.Addr().String()[len("ws://"):]
+
+	config, err := websocket.NewConfig("ws://"+host, "http://localhost/")
+	if err != nil {
+		return nil, err
+	}
+
+	config.Header = header
+
+	ws, err := config.DialContext(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	ws.PayloadType = websocket.BinaryFrame
+
+	return ws, nil
+}
+
+func TestListenWebSocket_BridgesBinaryStream(t *testing.T) {
+	ln, err := listen.ListenWebSocket(context.Background(), "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenWebSocket() failed: %v", err)
+	}
+	defer ln.Close()
+
+	ws, err := dialWebSocket(ln, nil)
+	if err != nil {
+		t.Fatalf("Failed to dial websocket: %v", err)
+	}
+	defer ws.Close()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept() failed: %v", err)
+	}
+	defer conn.Close()
+
+	// Two messages read back as one stream
+	go func() {
+		_, _ = ws.Write([]byte("SSH-2.0-"))
+		_, _ = ws.Write([]byte("client\r\n"))
+	}()
+
+	buf := make([]byte, len("SSH-2.0-client\r\n"))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+
+	if string(buf) != "SSH-2.0-client\r\n" {
+		t.Errorf("Read %q, want %q", buf, "SSH-2.0-client\r\n")
+	}
+}
+
+func TestListenWebSocket_RequiresBearerToken(t *testing.T) {
+	ln, err := listen.ListenWebSocket(context.Background(), "127.0.0.1:0",
+		listen.WithWebSocketBearerToken("secret"),
+	)
+	if err != nil {
+		t.Fatalf("ListenWebSocket() failed: %v", err)
+	}
+	defer ln.Close()
+
+	if ws, err := dialWebSocket(ln, http.Header{"Authorization": {"Bearer wrong"}}); err == nil {
+		ws.Close()
+		t.Error("Expected upgrade with a wrong token to be refused")
+	}
+
+	ws, err := dialWebSocket(ln, http.Header{"Authorization": {"Bearer secret"}})
+	if err != nil {
+		t.Fatalf("Upgrade with the token failed: %v", err)
+	}
+	defer ws.Close()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept() failed: %v", err)
+	}
+
+	conn.Close()
+}
+
+func TestListenWebSocket_RemoteAddrFromTrustedProxy(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted []string
+		xff     string
+		want    string
+	}{
+		{"untrusted peer", nil, "203.0.113.7", "127.0.0.1"},
+		{"trusted peer", []string{"127.0.0.1"}, "203.0.113.7", "203.0.113.7"},
+		{
+			"proxy chain",
+			[]string{"127.0.0.0/8", "10.0.0.0/8"},
+			"203.0.113.7, 10.1.2.3",
+			"203.0.113.7",
+		},
+		{"spoofed hop", []string{"127.0.0.1"}, "198.51.100.1, 203.0.113.7", "203.0.113.7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := listen.ListenWebSocket(context.Background(), "127.0.0.1:0",
+				listen.WithWebSocketTrustedProxies(tt.trusted),
+			)
+			if err != nil {
+				t.Fatalf("ListenWebSocket() failed: %v", err)
+			}
+			defer ln.Close()
+
+			ws, err := dialWebSocket(ln, http.Header{"X-Forwarded-For": {tt.xff}})
+			if err != nil {
+				t.Fatalf("Failed to dial websocket: %v", err)
+			}
+			defer ws.Close()
+
+			conn, err := ln.Accept()
+			if err != nil {
+				t.Fatalf("Accept() failed: %v", err)
+			}
+			defer conn.Close()
+
+			host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			if host != tt.want {
+				t.Errorf("RemoteAddr() host = %s, want %s", host, tt.want)
+			}
+		})
+	}
+}
+
+func TestListenWebSocket_InvalidTrustedProxy(t *testing.T) {
+	_, err := listen.ListenWebSocket(context.Background(), "127.0.0.1:0",
+		listen.WithWebSocketTrustedProxies([]string{"not-an-ip"}),
+	)
+	if err == nil {
+		t.Error("Expected error for an invalid trusted proxy")
+	}
+}
@@ -0,0 +1,341 @@
+package logger
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat is the format of the time of rotation in the names of
+// rotated files, sortable and free of colons
+const backupTimeFormat = "2006-01-02T15-04-05.000000000"
+
+// compressSuffix is appended to the names of compressed rotated files
+const compressSuffix = ".gz"
+
+// Rotation holds the rotation settings of a log file
+type Rotation struct {
+	// Size in bytes past which the file is rotated, 0 disables rotation
+	MaxSize int64
+	// Number of rotated files kept, 0 keeps them all
+	MaxBackups int
+	// Age past which rotated files are removed, 0 keeps them
+	MaxAge time.Duration
+	// Gzip rotated files
+	Compress bool
+}
+
+// File is a log file rotated once it grows past Rotation.MaxSize: the file is
+// renamed after the time of rotation, as in sshgate-2006-01-02T15-04-05.000000000.log
+// for sshgate.log, and a new one is created. It is safe for concurrent use.
+type File struct {
+	path string
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	rotation Rotation
+
+	// serializes the compression and removal of rotated files
+	millMu sync.Mutex
+}
+
+// OpenFile opens the log file at path, creating it and its directory if needed,
+// logs being appended to it
+func OpenFile(path string, rotation Rotation) (*File, error) {
+	f := &File{path: path, rotation: rotation}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Path returns the path of the file
+func (f *File) Path() string {
+	return f.path
+}
+
+// SetRotation sets the rotation settings applied from the next write on
+func (f *File) SetRotation(rotation Rotation) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.rotation = rotation
+}
+
+// Write writes p to the file, rotating it first when p would grow it past
+// Rotation.MaxSize. A line is never split across files, and a file is only
+// rotated once something was written to it.
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+
+	if f.file == nil {
+		f.mu.Unlock()
+		return 0, os.ErrClosed
+	}
+
+	var rotateErr error
+
+	rotation := f.rotation
+	rotated := false
+
+	if rotation.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > rotation.MaxSize {
+		// Logs are kept in the current file when it cannot be rotated
+		rotateErr = f.rotate()
+		rotated = rotateErr == nil
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+
+	f.mu.Unlock()
+
+	if rotated {
+		if err := f.mill(rotation); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to clean up rotated log files: %v\n", err)
+		}
+	}
+
+	return n, errors.Join(err, rotateErr)
+}
+
+// Reopen closes the file and opens its path again, for the file to be
+// rotated by another program such as logrotate: once it renamed the file,
+// logs go to a new one
+func (f *File) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file != nil {
+		if err := f.file.Close(); err != nil {
+			return fmt.Errorf("close log file: %w", err)
+		}
+
+		f.file = nil
+	}
+
+	return f.open()
+}
+
+// Close closes the file, writes failing afterwards
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+
+	err := f.file.Close()
+	f.file = nil
+
+	return err
+}
+
+// open opens the file at its path, f.mu being held
+func (f *File) open() error {
+	if err := os.MkdirAll(filepath.Dir(f.path), 0o750); err != nil {
+		return fmt.Errorf("create log directory: %w", err)
+	}
+
+	//nolint:gosec // the path comes from the operator's configuration
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("open log file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("stat log file: %w", err)
+	}
+
+	f.file = file
+	f.size = info.Size()
+
+	return nil
+}
+
+// rotate renames the file after the current time and opens a new one, f.mu
+// being held. The file is opened again when it cannot be renamed.
+func (f *File) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("close log file: %w", err)
+	}
+
+	f.file = nil
+
+	renameErr := os.Rename(f.path, f.backupPath(time.Now()))
+	if renameErr != nil {
+		renameErr = fmt.Errorf("rotate log file: %w", renameErr)
+	}
+
+	if err := f.open(); err != nil {
+		return errors.Join(renameErr, err)
+	}
+
+	return renameErr
+}
+
+// backupPath returns the path of the file rotated at t, later times being
+// taken while a file of that path exists
+func (f *File) backupPath(t time.Time) string {
+	dir, prefix, ext := f.nameParts()
+
+	for {
+		path := filepath.Join(dir, prefix+t.Format(backupTimeFormat)+ext)
+		if _, err := os.Lstat(path); errors.Is(err, os.ErrNotExist) {
+			return path
+		}
+
+		t = t.Add(time.Nanosecond)
+	}
+}
+
+// nameParts returns the directory of the file, and the prefix and the extension
+// of the names of its rotated files
+func (f *File) nameParts() (dir, prefix, ext string) {
+	dir, name := filepath.Split(f.path)
+	ext = filepath.Ext(name)
+
+	return dir, strings.TrimSuffix(name, ext) + "-", ext
+}
+
+// backup is a rotated file
+type backup struct {
+	path    string
+	rotated time.Time
+}
+
+// Backups returns the paths of the rotated files, the most recent first
+func (f *File) Backups() ([]string, error) {
+	backups, err := f.backups()
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(backups))
+	for _, b := range backups {
+		paths = append(paths, b.path)
+	}
+
+	return paths, nil
+}
+
+// backups returns the rotated files, the most recent first
+func (f *File) backups() ([]backup, error) {
+	dir, prefix, ext := f.nameParts()
+
+	entries, err := os.ReadDir(filepath.Clean(dir))
+	if err != nil {
+		return nil, fmt.Errorf("read log directory: %w", err)
+	}
+
+	var backups []backup
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		stamp := strings.TrimPrefix(strings.TrimSuffix(name, compressSuffix), prefix)
+		if !strings.HasSuffix(stamp, ext) {
+			continue
+		}
+
+		rotated, err := time.ParseInLocation(backupTimeFormat, strings.TrimSuffix(stamp, ext),
+			time.Local)
+		if err != nil {
+			continue
+		}
+
+		backups = append(backups, backup{path: filepath.Join(dir, name), rotated: rotated})
+	}
+
+	slices.SortFunc(backups, func(a, b backup) int {
+		return b.rotated.Compare(a.rotated)
+	})
+
+	return backups, nil
+}
+
+// mill removes the rotated files past rotation.MaxBackups or rotation.MaxAge,
+// and compresses the others when rotation.Compress is set
+func (f *File) mill(rotation Rotation) error {
+	f.millMu.Lock()
+	defer f.millMu.Unlock()
+
+	backups, err := f.backups()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+
+	for i, b := range backups {
+		tooMany := rotation.MaxBackups > 0 && i >= rotation.MaxBackups
+		tooOld := rotation.MaxAge > 0 && time.Since(b.rotated) > rotation.MaxAge
+
+		switch {
+		case tooMany || tooOld:
+			if err := os.Remove(b.path); err != nil {
+				errs = append(errs, err)
+			}
+		case rotation.Compress && !strings.HasSuffix(b.path, compressSuffix):
+			if err := compressFile(b.path); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// compressFile gzips the file at path into path.gz and removes it
+func compressFile(path string) (err error) {
+	//nolint:gosec // rotated log files, named after the configured one
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	//nolint:gosec // rotated log files, named after the configured one
+	dst, err := os.OpenFile(path+compressSuffix, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = os.Remove(dst.Name())
+		}
+	}()
+
+	gz := gzip.NewWriter(dst)
+
+	if _, err := io.Copy(gz, src); err != nil {
+		dst.Close()
+		return fmt.Errorf("compress %s: %w", path, err)
+	}
+
+	if err := gz.Close(); err != nil {
+		dst.Close()
+		return fmt.Errorf("compress %s: %w", path, err)
+	}
+
+	if err := dst.Close(); err != nil {
+		return fmt.Errorf("compress %s: %w", path, err)
+	}
+
+	return os.Remove(path)
+}
@@ -0,0 +1,298 @@
+package logger_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zijiren233/sshgate/logger"
+)
+
+// openFile opens a log file in a temporary directory
+func openFile(t *testing.T, rotation logger.Rotation) *logger.File {
+	t.Helper()
+
+	f, err := logger.OpenFile(filepath.Join(t.TempDir(), "sshgate.log"), rotation)
+	if err != nil {
+		t.Fatalf("OpenFile() failed: %v", err)
+	}
+
+	t.Cleanup(func() { _ = f.Close() })
+
+	return f
+}
+
+// writeLines writes n lines of 20 bytes to f, numbered from first
+func writeLines(t *testing.T, f *logger.File, first, n int) {
+	t.Helper()
+
+	for i := first; i < first+n; i++ {
+		if _, err := fmt.Fprintf(f, "line %014d\n", i); err != nil {
+			t.Fatalf("Write() failed: %v", err)
+		}
+	}
+}
+
+// readLogFile returns the content of a log file, gunzipped when compressed
+func readLogFile(t *testing.T, path string) string {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", path, err)
+	}
+
+	if !strings.HasSuffix(path, ".gz") {
+		return string(data)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to gunzip %s: %v", path, err)
+	}
+
+	data, err = io.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("Failed to gunzip %s: %v", path, err)
+	}
+
+	return string(data)
+}
+
+// backups returns the rotated files of f
+func backups(t *testing.T, f *logger.File) []string {
+	t.Helper()
+
+	paths, err := f.Backups()
+	if err != nil {
+		t.Fatalf("Backups() failed: %v", err)
+	}
+
+	return paths
+}
+
+func TestFile_RotatesPastMaxSize(t *testing.T) {
+	f := openFile(t, logger.Rotation{MaxSize: 100})
+
+	// 5 lines of 20 bytes fill a file, the 12 lines fill 2 and start a third
+	writeLines(t, f, 0, 12)
+
+	paths := backups(t, f)
+	if len(paths) != 2 {
+		t.Fatalf("Backups() = %v, want 2 rotated files", paths)
+	}
+
+	// The most recent rotated file holds the lines written before the current file
+	want := "line 00000000000005\n"
+	if got := readLogFile(t, paths[0]); !strings.HasPrefix(got, want) {
+		t.Errorf("Most recent rotated file starts with %q, want %q", got, want)
+	}
+
+	for _, path := range paths {
+		if size := len(readLogFile(t, path)); size != 100 {
+			t.Errorf("%s holds %d bytes, want 100", path, size)
+		}
+
+		if !strings.HasPrefix(filepath.Base(path), "sshgate-") ||
+			!strings.HasSuffix(path, ".log") {
+			t.Errorf("Rotated file %s is not named after sshgate.log", path)
+		}
+	}
+
+	if got := readLogFile(t, f.Path()); got != "line 00000000000010\nline 00000000000011\n" {
+		t.Errorf("Current file = %q, want the last 2 lines", got)
+	}
+}
+
+func TestFile_MaxBackups(t *testing.T) {
+	f := openFile(t, logger.Rotation{MaxSize: 20, MaxBackups: 2})
+
+	writeLines(t, f, 0, 6)
+
+	paths := backups(t, f)
+	if len(paths) != 2 {
+		t.Fatalf("Backups() = %v, want 2 rotated files", paths)
+	}
+
+	// The oldest are removed
+	if got := readLogFile(t, paths[1]); got != "line 00000000000003\n" {
+		t.Errorf("Oldest rotated file kept = %q, want line 3", got)
+	}
+}
+
+func TestFile_MaxAge(t *testing.T) {
+	f := openFile(t, logger.Rotation{MaxSize: 20, MaxAge: time.Hour})
+
+	old := filepath.Join(filepath.Dir(f.Path()), "sshgate-"+
+		time.Now().Add(-2*time.Hour).Format("2006-01-02T15-04-05.000000000")+".log")
+	if err := os.WriteFile(old, []byte("old\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write rotated file: %v", err)
+	}
+
+	writeLines(t, f, 0, 2)
+
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("Rotated file older than MaxAge was kept: %v", err)
+	}
+
+	if paths := backups(t, f); len(paths) != 1 {
+		t.Errorf("Backups() = %v, want the file just rotated", paths)
+	}
+}
+
+func TestFile_Compress(t *testing.T) {
+	f := openFile(t, logger.Rotation{MaxSize: 20, Compress: true})
+
+	writeLines(t, f, 0, 3)
+
+	paths := backups(t, f)
+	if len(paths) != 2 {
+		t.Fatalf("Backups() = %v, want 2 rotated files", paths)
+	}
+
+	for i, path := range paths {
+		if !strings.HasSuffix(path, ".log.gz") {
+			t.Errorf("Rotated file %s is not compressed", path)
+			continue
+		}
+
+		want := fmt.Sprintf("line %014d\n", 1-i)
+		if got := readLogFile(t, path); got != want {
+			t.Errorf("%s = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestFile_ConcurrentWrites(t *testing.T) {
+	f := openFile(t, logger.Rotation{MaxSize: 1000, Compress: true})
+
+	const writers, lines = 20, 100
+
+	var wg sync.WaitGroup
+
+	for w := range writers {
+		wg.Go(func() {
+			writeLines(t, f, w*lines, lines)
+		})
+	}
+
+	wg.Wait()
+
+	// Every line is written once, whole, whatever file it went to
+	var content strings.Builder
+
+	content.WriteString(readLogFile(t, f.Path()))
+
+	for _, path := range backups(t, f) {
+		data := readLogFile(t, path)
+		if len(data) > 1000 {
+			t.Errorf("%s holds %d bytes, past MaxSize", path, len(data))
+		}
+
+		content.WriteString(data)
+	}
+
+	seen := make(map[string]bool)
+
+	for line := range strings.Lines(content.String()) {
+		if len(line) != 20 || seen[line] {
+			t.Errorf("Line %q is split or written twice", line)
+		}
+
+		seen[line] = true
+	}
+
+	if len(seen) != writers*lines {
+		t.Errorf("%d lines written, want %d", len(seen), writers*lines)
+	}
+}
+
+func TestFile_Reopen(t *testing.T) {
+	f := openFile(t, logger.Rotation{})
+
+	writeLines(t, f, 0, 1)
+
+	// logrotate renames the file, then signals the gateway to reopen it
+	rotated := f.Path() + ".1"
+	if err := os.Rename(f.Path(), rotated); err != nil {
+		t.Fatalf("Failed to rename log file: %v", err)
+	}
+
+	writeLines(t, f, 1, 1)
+
+	if err := f.Reopen(); err != nil {
+		t.Fatalf("Reopen() failed: %v", err)
+	}
+
+	writeLines(t, f, 2, 1)
+
+	if got := readLogFile(t, rotated); got != "line 00000000000000\nline 00000000000001\n" {
+		t.Errorf("Renamed file = %q, want the lines written before Reopen()", got)
+	}
+
+	if got := readLogFile(t, f.Path()); got != "line 00000000000002\n" {
+		t.Errorf("Reopened file = %q, want the line written after Reopen()", got)
+	}
+}
+
+func TestInitLog_Outputs(t *testing.T) {
+	t.Cleanup(func() { _ = logger.InitLog() })
+
+	tests := []struct {
+		name       string
+		output     string
+		wantStdout bool
+		wantFile   bool
+	}{
+		{name: "Stdout", output: logger.OutputStdout, wantStdout: true},
+		{name: "File", output: logger.OutputFile, wantFile: true},
+		{name: "Both", output: logger.OutputBoth, wantStdout: true, wantFile: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "sshgate.log")
+			stdout := &bytes.Buffer{}
+
+			err := logger.InitLog(
+				logger.WithFormat("json"),
+				logger.WithOutput(tt.output),
+				logger.WithStdout(stdout),
+				logger.WithFile(path, logger.Rotation{}),
+			)
+			if err != nil {
+				t.Fatalf("InitLog() failed: %v", err)
+			}
+
+			log.Info("written")
+
+			// Switching back to stdout closes the file
+			if err := logger.InitLog(logger.WithStdout(io.Discard)); err != nil {
+				t.Fatalf("InitLog() failed: %v", err)
+			}
+
+			if got := strings.Contains(stdout.String(), `"msg":"written"`); got != tt.wantStdout {
+				t.Errorf("Written to stdout = %t, want %t", got, tt.wantStdout)
+			}
+
+			data, _ := os.ReadFile(path)
+			if got := strings.Contains(string(data), `"msg":"written"`); got != tt.wantFile {
+				t.Errorf("Written to the file = %t, want %t", got, tt.wantFile)
+			}
+		})
+	}
+}
+
+func TestInitLog_MissingFile(t *testing.T) {
+	if err := logger.InitLog(logger.WithOutput(logger.OutputFile)); err == nil {
+		t.Error("InitLog() succeeded without a log file, want an error")
+	}
+}
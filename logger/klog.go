@@ -0,0 +1,88 @@
+package logger
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-logr/logr"
+	log "github.com/sirupsen/logrus"
+)
+
+// stdlibWriter writes the lines of the standard library logger, such as the
+// errors of net/http servers, as info logs
+type stdlibWriter struct {
+	logger *log.Entry
+}
+
+func (w stdlibWriter) Write(p []byte) (int, error) {
+	w.logger.Info(strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+// klogSink is a logr.LogSink writing klog logs: info logs of verbosity 0 as
+// info logs, more verbose ones as debug logs
+type klogSink struct {
+	logger *log.Entry
+}
+
+var _ logr.LogSink = (*klogSink)(nil)
+
+func (s *klogSink) Init(logr.RuntimeInfo) {}
+
+func (s *klogSink) Enabled(level int) bool {
+	return s.logger.Logger.IsLevelEnabled(klogLevel(level))
+}
+
+func (s *klogSink) Info(level int, msg string, keysAndValues ...any) {
+	s.logger.WithFields(klogFields(keysAndValues)).Log(klogLevel(level), msg)
+}
+
+func (s *klogSink) Error(err error, msg string, keysAndValues ...any) {
+	s.logger.WithFields(klogFields(keysAndValues)).WithError(err).Error(msg)
+}
+
+func (s *klogSink) WithValues(keysAndValues ...any) logr.LogSink {
+	return &klogSink{logger: s.logger.WithFields(klogFields(keysAndValues))}
+}
+
+func (s *klogSink) WithName(name string) logr.LogSink {
+	if prefix, ok := s.logger.Data["logger"].(string); ok {
+		name = prefix + "/" + name
+	}
+
+	return &klogSink{logger: s.logger.WithField("logger", name)}
+}
+
+// klogLevel returns the level of the logs of klog verbosity level
+func klogLevel(level int) log.Level {
+	if level > 0 {
+		return log.DebugLevel
+	}
+
+	return log.InfoLevel
+}
+
+// klogFields returns the fields of the key and value pairs of a klog log, a
+// key without a value being logged with an empty one. Values other than
+// strings, numbers and booleans are logged as strings, the JSON format failing
+// on those it cannot marshal.
+func klogFields(keysAndValues []any) log.Fields {
+	fields := make(log.Fields, len(keysAndValues)/2)
+
+	for i := 0; i < len(keysAndValues); i += 2 {
+		var value any
+		if i+1 < len(keysAndValues) {
+			value = keysAndValues[i+1]
+		}
+
+		switch value.(type) {
+		case nil, string, bool, int, int32, int64, uint, uint32, uint64, float32, float64:
+		default:
+			value = fmt.Sprint(value)
+		}
+
+		fields[fmt.Sprint(keysAndValues[i])] = value
+	}
+
+	return fields
+}
@@ -0,0 +1,215 @@
+package logger
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultLimiterMaxKeys is the number of kinds of logs a Limiter counts by
+// default, the least recently logged being forgotten first
+const DefaultLimiterMaxKeys = 4096
+
+// Limiter rate limits similar logs, such as the failures to reach a devbox a
+// client retrying every second causes: logs of the same message and values of
+// the key fields are written at most burst times per interval, the others
+// being counted and summed up by a log once the interval is over. Only the
+// logs written with Log go through it, call sites opting in; audit-relevant
+// logs must not. A nil Limiter writes every log.
+type Limiter struct {
+	burst    int
+	interval time.Duration
+	maxKeys  int
+
+	mu      sync.Mutex
+	records map[string]*list.Element
+	// records, the least recently logged last
+	lru *list.List
+}
+
+// limitRecord counts the logs of a key in the current interval
+type limitRecord struct {
+	key    string
+	msg    string
+	level  log.Level
+	logger *log.Logger
+	// fields of the summary: the key fields and the component
+	fields log.Fields
+
+	start      time.Time
+	count      int
+	suppressed int
+}
+
+// NewLimiter returns a Limiter writing burst logs of a kind per interval,
+// counting maxKeys kinds at most. It returns nil, writing every log, when burst
+// or interval is not positive.
+func NewLimiter(burst int, interval time.Duration, maxKeys int) *Limiter {
+	if burst <= 0 || interval <= 0 {
+		return nil
+	}
+
+	if maxKeys <= 0 {
+		maxKeys = DefaultLimiterMaxKeys
+	}
+
+	return &Limiter{
+		burst:    burst,
+		interval: interval,
+		maxKeys:  maxKeys,
+		records:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// Log writes msg at level with entry, unless burst logs of msg with the same
+// values of the fields of entry named by keys were written in the current
+// interval. The summary of the logs suppressed in the previous interval is
+// written first.
+func (l *Limiter) Log(entry *log.Entry, level log.Level, msg string, keys ...string) {
+	if l == nil {
+		entry.Log(level, msg)
+		return
+	}
+
+	// Logs below the level are not written, nor counted
+	if !entry.Logger.IsLevelEnabled(level) {
+		return
+	}
+
+	key := limitKey(entry, msg, keys)
+	now := time.Now()
+
+	l.mu.Lock()
+
+	var summaries []*limitRecord
+
+	element, ok := l.records[key]
+	if ok {
+		l.lru.MoveToFront(element)
+	} else {
+		for len(l.records) >= l.maxKeys {
+			if evicted := l.evict(); evicted.suppressed > 0 {
+				summaries = append(summaries, evicted)
+			}
+		}
+
+		element = l.lru.PushFront(newLimitRecord(entry, level, msg, key, keys, now))
+		l.records[key] = element
+	}
+
+	record, _ := element.Value.(*limitRecord)
+
+	if now.Sub(record.start) >= l.interval {
+		if record.suppressed > 0 {
+			summary := *record
+			summaries = append(summaries, &summary)
+		}
+
+		record.start, record.count, record.suppressed = now, 0, 0
+	}
+
+	record.count++
+
+	write := record.count <= l.burst
+	if !write {
+		record.suppressed++
+	}
+
+	l.mu.Unlock()
+
+	for _, summary := range summaries {
+		l.summarize(summary)
+	}
+
+	if write {
+		entry.Log(level, msg)
+	}
+}
+
+// Flush writes the summaries of the logs suppressed so far and forgets them,
+// for them to be written on shutdown
+func (l *Limiter) Flush() {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+
+	var summaries []*limitRecord
+
+	for l.lru.Len() > 0 {
+		if record := l.evict(); record.suppressed > 0 {
+			summaries = append(summaries, record)
+		}
+	}
+
+	l.mu.Unlock()
+
+	for _, summary := range summaries {
+		l.summarize(summary)
+	}
+}
+
+// evict forgets the least recently logged record and returns it, l.mu being
+// held
+func (l *Limiter) evict() *limitRecord {
+	record, _ := l.lru.Remove(l.lru.Back()).(*limitRecord)
+	delete(l.records, record.key)
+
+	return record
+}
+
+// summarize writes the number of logs of record suppressed
+func (l *Limiter) summarize(record *limitRecord) {
+	record.logger.WithFields(record.fields).
+		WithField("suppressed", record.suppressed).
+		Log(record.level, fmt.Sprintf("Suppressed %d similar messages in the last %s: %s",
+			record.suppressed, l.interval, record.msg))
+}
+
+// newLimitRecord returns the record of the logs of key, msg with the values of
+// the fields of entry named by keys
+func newLimitRecord(
+	entry *log.Entry,
+	level log.Level,
+	msg, key string,
+	keys []string,
+	now time.Time,
+) *limitRecord {
+	fields := make(log.Fields, len(keys)+1)
+	if component, ok := entry.Data["component"]; ok {
+		fields["component"] = component
+	}
+
+	for _, k := range keys {
+		fields[k] = entry.Data[k]
+	}
+
+	return &limitRecord{
+		key:    key,
+		msg:    msg,
+		level:  level,
+		logger: entry.Logger,
+		fields: fields,
+		start:  now,
+	}
+}
+
+// limitKey returns the key of the logs of msg with the values of the fields
+// of entry named by keys
+func limitKey(entry *log.Entry, msg string, keys []string) string {
+	var b strings.Builder
+
+	b.WriteString(msg)
+
+	for _, k := range keys {
+		fmt.Fprintf(&b, "\x00%s=%v", k, entry.Data[k])
+	}
+
+	return b.String()
+}
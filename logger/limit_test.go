@@ -0,0 +1,183 @@
+package logger_test
+
+import (
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/zijiren233/sshgate/logger"
+)
+
+// devboxLogger returns a logger entry of a devbox, and the hook of its logs
+func devboxLogger(devbox string) (*log.Entry, *logtest.Hook) {
+	l, hook := logtest.NewNullLogger()
+
+	return l.WithFields(log.Fields{
+		"component": "gateway",
+		"devbox":    devbox,
+		"conn_id":   "c1",
+	}), hook
+}
+
+// messages returns the messages of the logs of hook
+func messages(hook *logtest.Hook) []string {
+	var msgs []string
+	for _, entry := range hook.AllEntries() {
+		msgs = append(msgs, entry.Message)
+	}
+
+	return msgs
+}
+
+func TestLimiter_Suppresses(t *testing.T) {
+	limiter := logger.NewLimiter(2, time.Hour, 0)
+	entry, hook := devboxLogger("devbox-a")
+
+	for range 5 {
+		limiter.Log(entry, log.ErrorLevel, "Failed to connect to backend", "devbox")
+	}
+
+	if got := messages(hook); len(got) != 2 {
+		t.Errorf("Logs written = %v, want 2", got)
+	}
+
+	// Other messages and other values of the key fields are counted apart
+	limiter.Log(entry, log.ErrorLevel, "Devbox not running", "devbox")
+	limiter.Log(entry.WithField("devbox", "devbox-b"), log.ErrorLevel,
+		"Failed to connect to backend", "devbox")
+
+	// Fields outside the key do not tell logs apart
+	limiter.Log(entry.WithField("conn_id", "c2"), log.ErrorLevel,
+		"Failed to connect to backend", "devbox")
+
+	if got := messages(hook); len(got) != 4 {
+		t.Errorf("Logs written = %v, want 4", got)
+	}
+}
+
+func TestLimiter_Summary(t *testing.T) {
+	const interval = 50 * time.Millisecond
+
+	limiter := logger.NewLimiter(1, interval, 0)
+	entry, hook := devboxLogger("devbox-a")
+
+	for range 4 {
+		limiter.Log(entry, log.WarnLevel, "Failed to connect to backend", "devbox")
+	}
+
+	time.Sleep(interval)
+
+	limiter.Log(entry, log.WarnLevel, "Failed to connect to backend", "devbox")
+
+	entries := hook.AllEntries()
+	if len(entries) != 3 {
+		t.Fatalf("Logs written = %v, want the first, the summary and the last", messages(hook))
+	}
+
+	summary := entries[1]
+
+	want := "Suppressed 3 similar messages in the last 50ms: Failed to connect to backend"
+	if summary.Message != want {
+		t.Errorf("Summary = %q, want %q", summary.Message, want)
+	}
+
+	if summary.Level != log.WarnLevel {
+		t.Errorf("Summary level = %s, want warning", summary.Level)
+	}
+
+	if summary.Data["suppressed"] != 3 || summary.Data["devbox"] != "devbox-a" ||
+		summary.Data["component"] != "gateway" {
+		t.Errorf("Summary fields = %v, want suppressed, devbox and component", summary.Data)
+	}
+
+	// The connection of one of the suppressed logs is not the summary's
+	if _, ok := summary.Data["conn_id"]; ok {
+		t.Errorf("Summary fields = %v, want no conn_id", summary.Data)
+	}
+
+	// Without suppressed logs, no summary
+	time.Sleep(interval)
+	hook.Reset()
+
+	limiter.Log(entry, log.WarnLevel, "Failed to connect to backend", "devbox")
+
+	if got := messages(hook); len(got) != 1 {
+		t.Errorf("Logs written = %v, want the log alone", got)
+	}
+}
+
+func TestLimiter_Eviction(t *testing.T) {
+	limiter := logger.NewLimiter(1, time.Hour, 2)
+	entry, hook := devboxLogger("devbox-a")
+
+	limiter.Log(entry, log.ErrorLevel, "Failed to connect to backend", "devbox")
+	limiter.Log(entry, log.ErrorLevel, "Failed to connect to backend", "devbox")
+
+	// devbox-a is the least recently logged once devbox-c is counted
+	for _, devbox := range []string{"devbox-b", "devbox-c"} {
+		limiter.Log(entry.WithField("devbox", devbox), log.ErrorLevel,
+			"Failed to connect to backend", "devbox")
+	}
+
+	want := []string{
+		"Failed to connect to backend",
+		"Failed to connect to backend",
+		"Suppressed 1 similar messages in the last 1h0m0s: Failed to connect to backend",
+		"Failed to connect to backend",
+	}
+
+	got := messages(hook)
+	if len(got) != len(want) {
+		t.Fatalf("Logs written = %v, want %v", got, want)
+	}
+
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Log %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+
+	// Forgotten, devbox-a is written again
+	hook.Reset()
+	limiter.Log(entry, log.ErrorLevel, "Failed to connect to backend", "devbox")
+
+	if got := messages(hook); len(got) != 1 {
+		t.Errorf("Logs written = %v, want the log of the evicted key", got)
+	}
+}
+
+func TestLimiter_Flush(t *testing.T) {
+	limiter := logger.NewLimiter(1, time.Hour, 0)
+	entry, hook := devboxLogger("devbox-a")
+
+	for range 3 {
+		limiter.Log(entry, log.ErrorLevel, "Failed to connect to backend", "devbox")
+	}
+
+	limiter.Flush()
+
+	want := "Suppressed 2 similar messages in the last 1h0m0s: Failed to connect to backend"
+	if got := messages(hook); len(got) != 2 || got[1] != want {
+		t.Errorf("Logs written = %v, want the log and %q", got, want)
+	}
+}
+
+func TestLimiter_Disabled(t *testing.T) {
+	limiter := logger.NewLimiter(0, time.Minute, 0)
+	if limiter != nil {
+		t.Fatal("NewLimiter() with no burst is not nil")
+	}
+
+	entry, hook := devboxLogger("devbox-a")
+
+	for range 3 {
+		limiter.Log(entry, log.ErrorLevel, "Failed to connect to backend", "devbox")
+	}
+
+	limiter.Flush()
+
+	if got := messages(hook); len(got) != 3 {
+		t.Errorf("Logs written = %v, want every log", got)
+	}
+}
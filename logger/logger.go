@@ -1,12 +1,24 @@
 package logger
 
 import (
+	"fmt"
+	"io"
 	stdlog "log"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/go-logr/logr"
 	log "github.com/sirupsen/logrus"
+	"k8s.io/klog/v2"
+)
+
+// Log outputs
+const (
+	OutputStdout = "stdout"
+	OutputFile   = "file"
+	OutputBoth   = "both"
 )
 
 // Options holds logger configuration options
@@ -14,6 +26,11 @@ type Options struct {
 	Debug  bool
 	Level  string
 	Format string
+	// Output is OutputStdout, OutputFile or OutputBoth
+	Output   string
+	Stdout   io.Writer
+	File     string
+	Rotation Rotation
 }
 
 // Option is a function that configures Options
@@ -40,13 +57,84 @@ func WithFormat(format string) Option {
 	}
 }
 
-// InitLog initializes the logger with the given options
-func InitLog(opts ...Option) {
+// WithOutput sets where logs are written: OutputStdout, OutputFile or
+// OutputBoth
+func WithOutput(output string) Option {
+	return func(o *Options) {
+		o.Output = output
+	}
+}
+
+// WithStdout sets the writer standing for stdout
+func WithStdout(stdout io.Writer) Option {
+	return func(o *Options) {
+		o.Stdout = stdout
+	}
+}
+
+// WithFile sets the log file of OutputFile and OutputBoth, and its rotation
+func WithFile(path string, rotation Rotation) Option {
+	return func(o *Options) {
+		o.File = path
+		o.Rotation = rotation
+	}
+}
+
+var (
+	// fileMu guards file
+	fileMu sync.Mutex
+	// file is the log file written to, kept open across calls to InitLog
+	// naming it
+	file *File
+)
+
+// ReopenFile reopens the log file written to, if any, for it to be rotated by
+// another program such as logrotate
+func ReopenFile() error {
+	fileMu.Lock()
+	defer fileMu.Unlock()
+
+	if file == nil {
+		return nil
+	}
+
+	return file.Reopen()
+}
+
+// setFile makes the file at path, none when empty, the log file written to,
+// returning it and the previous one, to be closed once no longer written to
+func setFile(path string, rotation Rotation) (next, previous *File, err error) {
+	fileMu.Lock()
+	defer fileMu.Unlock()
+
+	if file != nil && file.Path() == path {
+		file.SetRotation(rotation)
+		return file, nil, nil
+	}
+
+	if path != "" {
+		if next, err = OpenFile(path, rotation); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	previous, file = file, next
+
+	return next, previous, nil
+}
+
+// InitLog initializes the logger with the given options. The standard library
+// logger and klog, logging for the Kubernetes client, are written through it,
+// so that every line follows its level and format. Nothing changes when the
+// log file cannot be opened.
+func InitLog(opts ...Option) error {
 	// Default options
 	options := &Options{
 		Debug:  false,
 		Level:  "info",
 		Format: "text",
+		Output: OutputStdout,
+		Stdout: os.Stdout,
 	}
 
 	// Apply provided options
@@ -56,6 +144,32 @@ func InitLog(opts ...Option) {
 
 	l := log.StandardLogger()
 
+	toFile := options.Output == OutputFile || options.Output == OutputBoth
+	if toFile && options.File == "" {
+		return fmt.Errorf("no log file for output %s", options.Output)
+	}
+
+	path := ""
+	if toFile {
+		path = options.File
+	}
+
+	f, previous, err := setFile(path, options.Rotation)
+	if err != nil {
+		return err
+	}
+
+	var output io.Writer
+
+	switch options.Output {
+	case OutputFile:
+		output = f
+	case OutputBoth:
+		output = io.MultiWriter(options.Stdout, f)
+	default:
+		output = options.Stdout
+	}
+
 	// Set log level based on configuration
 	level := strings.ToLower(options.Level)
 	switch level {
@@ -78,8 +192,16 @@ func InitLog(opts ...Option) {
 		l.SetReportCaller(false)
 	}
 
-	l.SetOutput(os.Stdout)
-	stdlog.SetOutput(l.Writer())
+	l.SetOutput(output)
+
+	// Writes to the previous file are done once the output is switched
+	if previous != nil {
+		_ = previous.Close()
+	}
+
+	stdlog.SetFlags(0)
+	stdlog.SetOutput(stdlibWriter{logger: l.WithField("component", "stdlib")})
+	klog.SetLogger(logr.New(&klogSink{logger: l.WithField("component", "kubernetes")}))
 
 	// Set formatter based on configuration
 	if options.Format == "json" {
@@ -88,8 +210,8 @@ func InitLog(opts ...Option) {
 		})
 	} else {
 		l.SetFormatter(&log.TextFormatter{
-			ForceColors:      true,
-			DisableColors:    false,
+			ForceColors:      !toFile,
+			DisableColors:    toFile,
 			ForceQuote:       options.Debug,
 			DisableQuote:     !options.Debug,
 			DisableSorting:   false,
@@ -98,4 +220,34 @@ func InitLog(opts ...Option) {
 			QuoteEmptyFields: true,
 		})
 	}
+
+	return nil
+}
+
+// NewAuditLogger returns a logger writing JSON audit records to output, which is
+// stdout, stderr or the path of a file records are appended to. It is independent
+// of the standard logger: records are always written, whatever its level and format.
+func NewAuditLogger(output string) (*log.Logger, error) {
+	l := log.New()
+	l.SetLevel(log.InfoLevel)
+	l.SetFormatter(&log.JSONFormatter{
+		TimestampFormat: time.RFC3339Nano,
+	})
+
+	switch output {
+	case "stdout":
+		l.SetOutput(os.Stdout)
+	case "stderr":
+		l.SetOutput(os.Stderr)
+	default:
+		//nolint:gosec // the path comes from the operator's configuration
+		f, err := os.OpenFile(output, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit log: %w", err)
+		}
+
+		l.SetOutput(f)
+	}
+
+	return l, nil
 }
@@ -2,35 +2,78 @@ package main
 
 import (
 	"context"
-	"log"
-	"net"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
 	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
 	"github.com/zijiren233/sshgate/config"
+	"github.com/zijiren233/sshgate/events"
 	"github.com/zijiren233/sshgate/gateway"
-	"github.com/zijiren233/sshgate/hostkey"
 	"github.com/zijiren233/sshgate/informer"
+	"github.com/zijiren233/sshgate/kubeclient"
+	"github.com/zijiren233/sshgate/listen"
 	"github.com/zijiren233/sshgate/logger"
 	"github.com/zijiren233/sshgate/pprof"
 	"github.com/zijiren233/sshgate/registry"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
+	metrics "k8s.io/metrics/pkg/client/clientset/versioned"
 )
 
+// mainLog logs the startup and shutdown of the process
+var mainLog = log.WithField("component", "main")
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "hostkey" {
+		if err := runHostKeyCommand(context.Background(), os.Args[2:], os.Stdout); err != nil {
+			mainLog.WithError(err).Fatal("Failed to run hostkey")
+		}
+
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "check-config" {
+		if err := runCheckConfigCommand(os.Args[2:], os.Stdout); err != nil {
+			mainLog.WithError(err).Fatal("Failed to load configuration")
+		}
+
+		return
+	}
+
 	// Load configuration
-	cfg, err := config.Load()
+	cfg, err := config.Load(os.Args[1:]...)
 	if err != nil {
-		log.Fatalf("Failed to load configuration: %v", err)
+		mainLog.WithError(err).Fatal("Failed to load configuration")
 	}
 
 	// Initialize logger with configuration
-	logger.InitLog(
-		logger.WithDebug(cfg.Debug),
-		logger.WithLevel(cfg.LogLevel),
-		logger.WithFormat(cfg.LogFormat),
-	)
+	if err := logger.InitLog(logOptions(cfg)...); err != nil {
+		mainLog.WithError(err).Fatal("Failed to initialize logging")
+	}
+
+	if cfg.IsSet("ENABLE_AGENT_FORWARD") {
+		mainLog.Warn("ENABLE_AGENT_FORWARD is deprecated, use DISABLE_AGENT_FORWARDING_MODE instead")
+	}
+
+	if cfg.DumpRequested() {
+		dump, err := cfg.Dump()
+		if err != nil {
+			mainLog.WithError(err).Fatal("Failed to dump configuration")
+		}
+
+		_, _ = os.Stderr.Write(dump)
+	}
 
 	// Start pprof server if enabled
 	if cfg.PprofEnabled {
@@ -40,69 +83,375 @@ func main() {
 	}
 
 	// Create Kubernetes client
-	clientset, err := createKubernetesClient()
+	kubeConfig, _, err := kubeclient.NewConfig(kubeClientOptions(cfg)...)
+	if err != nil {
+		mainLog.WithError(err).Fatal("Failed to create Kubernetes client")
+	}
+
+	clientset, err := kubernetes.NewForConfig(kubeConfig)
 	if err != nil {
-		log.Fatalf("Failed to create Kubernetes client: %v", err)
+		mainLog.WithError(err).Fatal("Failed to create Kubernetes client")
 	}
 
 	// Create devbox registry
-	reg := registry.New()
+	registryOpts := []registry.Option{
+		registry.WithSkipPrivateKeys(cfg.Gateway.DisablePublicKeyMode),
+		registry.WithBackendAddressing(
+			registry.BackendAddressing(cfg.BackendAddressing),
+			cfg.BackendHostTemplate,
+		),
+		registry.WithIPFamily(registry.IPFamily(cfg.BackendIPFamily)),
+		registry.WithKeyFields(cfg.DevboxPublicKeyFields, cfg.DevboxPrivateKeyFields),
+		registry.WithSelectorLabel(cfg.DevboxSelectorLabelRef()),
+		registry.WithOwnerKind(cfg.DevboxOwnerKind),
+	}
+
+	// OTP secrets and revoked keys are only read from the cluster of the gateway
+	reg := registry.New(append(registryOpts,
+		registry.WithOTPSecret(cfg.OTPSecretRef()),
+		registry.WithRevocationConfigMap(cfg.RevocationConfigMapRef()),
+		registry.WithMetrics(clusterMetrics(cfg, "")),
+	)...)
+
+	if cfg.DebugRegistryEnabled {
+		pprof.Handle("/debug/registry", reg.DebugHandler())
+	}
 
 	// Setup and start informers
-	infMgr := informer.New(clientset, reg,
+	clusterInformerOpts := []informer.Option{
 		informer.WithResyncPeriod(cfg.InformerResyncPeriod),
+		informer.WithLabelSelector(cfg.DevboxSelectorLabel),
+		informer.WithNamespaces(cfg.InformerNamespaces...),
+		informer.WithDiscoveryMode(informer.DiscoveryMode(cfg.DiscoveryMode)),
+		informer.WithUnhealthyTimeout(cfg.InformerUnhealthyTimeout),
+		informer.WithReconcileInterval(cfg.InformerReconcileInterval),
+	}
+
+	informerOpts := append(slices.Clone(clusterInformerOpts),
+		informer.WithRevocationConfigMap(cfg.RevocationConfigMapRef()),
+		informer.WithOTPSecret(cfg.OTPSecretRef()),
+		informer.WithMetrics(clusterMetrics(cfg, "")),
 	)
 
-	ctx := context.Background()
-	if err := infMgr.Start(ctx); err != nil {
-		log.Fatalf("Failed to start informers: %v", err)
+	// Kubernetes restarts the gateway rather than letting it serve stale devboxes
+	if cfg.InformerUnhealthyExit {
+		informerOpts = append(informerOpts, informer.WithUnhealthyHandler(
+			func(health informer.Health) {
+				mainLog.WithField("failing_since", health.FailingSince.Format(time.RFC3339)).
+					WithError(health.LastError).
+					Fatal("Informers failing, exiting")
+			},
+		))
 	}
 
-	// Load SSH server host key
-	hostKey, err := hostkey.Load(cfg.SSHHostKeySeed)
+	devboxResourceOpt, err := devboxResourceOption(cfg, kubeConfig)
 	if err != nil {
-		log.Fatalf("Failed to load host key: %v", err)
+		mainLog.WithError(err).Fatal("Failed to create Kubernetes dynamic client")
 	}
 
-	// Create gateway with embedded options
-	gw := gateway.New(hostKey, reg, gateway.WithOptions(cfg.Gateway))
+	informerOpts = append(informerOpts, devboxResourceOpt)
 
-	// Start SSH server
-	//nolint:noctx
-	listener, err := net.Listen("tcp", cfg.SSHListenAddr)
+	infMgr := informer.New(clientset, reg, informerOpts...)
+	pprof.Handle("/debug/reconcile", infMgr.ReconcileHandler())
+
+	if cfg.HealthListenAddr != "" {
+		go func() {
+			if err := serveHealth(cfg.HealthListenAddr, infMgr.ReadyHandler()); err != nil {
+				mainLog.WithField("addr", cfg.HealthListenAddr).
+					WithError(err).
+					Fatal("Failed to serve health checks")
+			}
+		}()
+	}
+
+	// Devboxes of the last snapshot are served while the informers sync
+	warmStart := false
+
+	if cfg.RegistrySnapshotPath != "" {
+		loaded, err := reg.LoadSnapshot(cfg.RegistrySnapshotPath)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+		case err != nil:
+			mainLog.WithField("path", cfg.RegistrySnapshotPath).
+				WithError(err).
+				Warn("Ignoring registry snapshot")
+		default:
+			warmStart = loaded > 0
+		}
+	}
+
+	// Canceled on shutdown, closing the listeners removes Unix socket files
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+
+	startInformers := func() {
+		if err := infMgr.Start(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			mainLog.WithError(err).Fatal("Failed to start informers")
+		}
+
+		reg.Reconcile()
+		reg.LogCollisions()
+	}
+
+	if warmStart {
+		go startInformers()
+	} else {
+		startInformers()
+	}
+
+	// Devboxes of remote clusters are served behind those of the cluster of
+	// the gateway, each cluster watched apart so that one failing to sync
+	// leaves the others be
+	var resolver gateway.DevboxResolver = reg
+
+	var remoteMgrs []*informer.Manager
+
+	if len(cfg.Clusters) > 0 {
+		registries := []*registry.Registry{reg}
+
+		for _, cluster := range cfg.Clusters {
+			remoteReg, remoteMgr, err := newRemoteCluster(cfg, cluster, registryOpts,
+				clusterInformerOpts)
+			if err != nil {
+				mainLog.WithField("cluster", cluster).WithError(err).Error("Skipping cluster")
+				continue
+			}
+
+			registries = append(registries, remoteReg)
+			remoteMgrs = append(remoteMgrs, remoteMgr)
+
+			go func() {
+				if err := remoteMgr.Start(ctx); err != nil {
+					if ctx.Err() == nil {
+						mainLog.WithField("cluster", cluster).
+							WithError(err).
+							Error("Failed to start informers of cluster")
+					}
+
+					return
+				}
+
+				remoteReg.Reconcile()
+				remoteReg.LogCollisions()
+			}()
+		}
+
+		resolver = registry.NewFederation(registries...)
+	}
+
+	snapshotsDone := make(chan struct{})
+
+	if cfg.RegistrySnapshotPath != "" {
+		go func() {
+			defer close(snapshotsDone)
+			reg.PersistSnapshots(ctx, cfg.RegistrySnapshotPath, cfg.RegistrySnapshotInterval)
+		}()
+	} else {
+		close(snapshotsDone)
+	}
+
+	// Load SSH server host keys
+	hostKey, hostKeyOpts, err := loadHostKeys(ctx, cfg, clientset)
 	if err != nil {
-		log.Fatal(err)
+		mainLog.WithError(err).Fatal("Failed to load host keys")
 	}
 
-	log.Printf("SSH Gateway listening on %s", cfg.SSHListenAddr)
+	// Summaries of the logs suppressed are written on shutdown
+	logLimiter := logger.NewLimiter(cfg.LogRepeatLimit, cfg.LogRepeatInterval,
+		logger.DefaultLimiterMaxKeys)
+	defer logLimiter.Flush()
+
+	gatewayOpts := append([]gateway.Option{gateway.WithOptions(cfg.Gateway.Options())},
+		hostKeyOpts...)
+	gatewayOpts = append(gatewayOpts,
+		gateway.WithLogLimiter(logLimiter),
+		gateway.WithMetrics(prometheus.DefaultRegisterer),
+	)
 
-	for {
-		conn, err := listener.Accept()
+	if cfg.AuditLogOutput != "" {
+		auditLogger, err := logger.NewAuditLogger(cfg.AuditLogOutput)
 		if err != nil {
-			log.Printf("Accept error: %v", err)
-			continue
+			mainLog.WithError(err).Fatal("Failed to create audit logger")
 		}
 
-		go gw.HandleConnection(conn)
+		gatewayOpts = append(gatewayOpts,
+			gateway.WithAuditLogger(auditLogger, cfg.Gateway.AuditLogSessions),
+		)
 	}
-}
 
-// createKubernetesClient creates a Kubernetes clientset
-func createKubernetesClient() (*kubernetes.Clientset, error) {
-	// Try in-cluster config first
-	config, err := rest.InClusterConfig()
-	if err != nil {
-		// Fallback to kubeconfig
-		kubeconfig := os.Getenv("KUBECONFIG")
-		if kubeconfig == "" {
-			kubeconfig = os.Getenv("HOME") + "/.kube/config"
+	stopRecorder := func() {}
+
+	if cfg.KubernetesEventsEnabled {
+		var recorder record.EventRecorder
+
+		recorder, stopRecorder = events.NewRecorder(clientset)
+		gatewayOpts = append(gatewayOpts,
+			gateway.WithEventRecorder(recorder, cfg.Gateway.KubernetesEventInterval),
+		)
+	}
+
+	if cfg.Gateway.MOTDResourceUsage {
+		metricsClient, err := metrics.NewForConfig(kubeConfig)
+		if err != nil {
+			mainLog.WithError(err).Fatal("Failed to create metrics client")
 		}
 
-		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+		gatewayOpts = append(gatewayOpts,
+			gateway.WithMOTDResourceUsage(
+				metricsClient.MetricsV1beta1(),
+				cfg.Gateway.MOTDResourceUsageTimeout,
+			),
+		)
+	}
+
+	// Create gateway with embedded options
+	gw := gateway.New(hostKey, resolver, gatewayOpts...)
+	gw.LogOptions()
+
+	// Start SSH server
+	listeners, err := listen.ListenAll(ctx, cfg.SSHListenAddrs,
+		listen.WithReusePort(cfg.SSHListenReusePort),
+		listen.WithInheritedFD(cfg.SSHListenFD),
+		listen.WithSocketMode(os.FileMode(cfg.SSHListenSocketMode)),
+		listen.WithSocketOwner(cfg.SSHListenSocketUID, cfg.SSHListenSocketGID),
+	)
+	if err != nil {
+		mainLog.WithError(err).Fatal("Failed to listen")
+	}
+
+	if cfg.WebSocketListenAddr != "" {
+		wsListener, err := listen.ListenWebSocket(ctx, cfg.WebSocketListenAddr,
+			listen.WithWebSocketPath(cfg.WebSocketPath),
+			listen.WithWebSocketTLS(cfg.WebSocketTLSCertFile, cfg.WebSocketTLSKeyFile),
+			listen.WithWebSocketBearerToken(cfg.WebSocketBearerToken),
+			listen.WithWebSocketTrustedProxies(cfg.WebSocketTrustedProxies),
+		)
 		if err != nil {
-			return nil, err
+			mainLog.WithField("addr", cfg.WebSocketListenAddr).
+				WithError(err).
+				Fatal("Failed to listen for websockets")
 		}
+
+		listeners = append(listeners, wsListener)
+	}
+
+	go reloadOnSIGHUP(ctx, gw, cfg, os.Args[1:])
+
+	gw.Serve(ctx, listeners...)
+	stopRecorder()
+	stop()
+	infMgr.Stop()
+
+	for _, remoteMgr := range remoteMgrs {
+		remoteMgr.Stop()
+	}
+
+	<-snapshotsDone
+}
+
+// kubeClientOptions returns the options of the client of the cluster of the
+// gateway
+func kubeClientOptions(cfg *config.Config) []kubeclient.Option {
+	return []kubeclient.Option{
+		kubeclient.WithKubeconfig(cfg.Kubeconfig, cfg.KubeContext),
+		kubeclient.WithRateLimit(cfg.KubeAPIQPS, cfg.KubeAPIBurst),
+		kubeclient.WithTimeout(cfg.KubeAPITimeout),
+	}
+}
+
+// clusterMetrics returns the registerer of the registry and informer metrics
+// of a cluster, labeled by cluster once remote clusters are watched, empty for
+// the cluster of the gateway
+func clusterMetrics(cfg *config.Config, cluster string) prometheus.Registerer {
+	if len(cfg.Clusters) == 0 {
+		return prometheus.DefaultRegisterer
+	}
+
+	return prometheus.WrapRegistererWith(
+		prometheus.Labels{"cluster": cluster},
+		prometheus.DefaultRegisterer,
+	)
+}
+
+// devboxResourceOption watches the Devbox custom resources of the cluster of
+// kubeConfig when configured, it is a no-op option otherwise
+func devboxResourceOption(cfg *config.Config, kubeConfig *rest.Config) (informer.Option, error) {
+	gvr, ok := cfg.DevboxResourceGVR()
+	if !ok {
+		return func(*informer.Manager) {}, nil
+	}
+
+	dynamicClient, err := dynamic.NewForConfig(kubeConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return informer.WithDevboxResource(dynamicClient, gvr), nil
+}
+
+// newRemoteCluster returns the registry of the devboxes of the remote cluster
+// named by a kubeconfig context and the informer manager feeding it
+func newRemoteCluster(
+	cfg *config.Config,
+	cluster string,
+	registryOpts []registry.Option,
+	informerOpts []informer.Option,
+) (*registry.Registry, *informer.Manager, error) {
+	kubeConfig, _, err := kubeclient.NewConfig(
+		kubeclient.WithKubeconfig(cfg.Kubeconfig, cluster),
+		kubeclient.WithRateLimit(cfg.KubeAPIQPS, cfg.KubeAPIBurst),
+		kubeclient.WithTimeout(cfg.KubeAPITimeout),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	clientset, err := kubernetes.NewForConfig(kubeConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	devboxResourceOpt, err := devboxResourceOption(cfg, kubeConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reg := registry.New(append(slices.Clone(registryOpts),
+		registry.WithCluster(cluster),
+		registry.WithMetrics(clusterMetrics(cfg, cluster)),
+	)...)
+
+	if cfg.DebugRegistryEnabled {
+		pprof.Handle("/debug/registry/"+cluster, reg.DebugHandler())
+	}
+
+	mgr := informer.New(clientset, reg, append(slices.Clone(informerOpts),
+		informer.WithCluster(cluster),
+		informer.WithMetrics(clusterMetrics(cfg, cluster)),
+		devboxResourceOpt,
+	)...)
+
+	return reg, mgr, nil
+}
+
+// serveHealth serves /healthz, answering while the process runs, /readyz with
+// ready and /metrics on addr
+func serveHealth(addr string, ready http.Handler) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "ok\n")
+	})
+	mux.Handle("/readyz", ready)
+	mux.Handle("/metrics", promhttp.Handler())
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
 	}
 
-	return kubernetes.NewForConfig(config)
+	return server.ListenAndServe()
 }
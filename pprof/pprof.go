@@ -18,6 +18,12 @@ func init() {
 	http.DefaultServeMux = http.NewServeMux()
 }
 
+// Handle registers handler for pattern on the pprof server, next to the
+// profiles. Handlers may be registered once the server runs.
+func Handle(pattern string, handler http.Handler) {
+	pprofMux.Handle(pattern, handler)
+}
+
 // RunPprofServer starts the pprof server on 127.0.0.1:port
 func RunPprofServer(port int) error {
 	addr := fmt.Sprintf("127.0.0.1:%d", port)
@@ -0,0 +1,55 @@
+package registry
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ParseAllowedCIDRs parses a comma-separated list of CIDRs, IPv4 or IPv6. Bare
+// addresses allow that single address.
+func ParseAllowedCIDRs(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+
+	for cidr := range strings.SplitSeq(s, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+			}
+
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+		}
+
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+// setAllowedCIDRs sets the allowed CIDRs annotated on the devbox. An invalid
+// annotation is logged and marks the devbox, it is never silently treated as
+// allowing any network.
+func (r *Registry) setAllowedCIDRs(info *DevboxInfo, logger *log.Entry) {
+	prefixes, _, err := info.AnnotationCIDRs(allowedCIDRsName)
+	if err != nil {
+		logger.WithError(err).Warn("Invalid allowed CIDRs annotation")
+	}
+
+	info.AllowedCIDRs = prefixes
+	info.AllowedCIDRsInvalid = err != nil
+}
@@ -0,0 +1,150 @@
+package registry_test
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/zijiren233/sshgate/registry"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseAllowedCIDRs(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{value: "", want: nil},
+		{value: "10.0.0.0/8, 203.0.113.0/24", want: []string{"10.0.0.0/8", "203.0.113.0/24"}},
+		{value: "2001:db8::/32", want: []string{"2001:db8::/32"}},
+		{value: "10.1.2.3/8", want: []string{"10.0.0.0/8"}},
+		{value: "192.0.2.7,2001:db8::1", want: []string{"192.0.2.7/32", "2001:db8::1/128"}},
+		{value: "::ffff:192.0.2.7", want: []string{"192.0.2.7/32"}},
+		{value: "10.0.0.0/8,,", want: []string{"10.0.0.0/8"}},
+		{value: "10.0.0.0/33", wantErr: true},
+		{value: "10.0.0.0/8,office", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			prefixes, err := registry.ParseAllowedCIDRs(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseAllowedCIDRs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			var got []string
+			for _, prefix := range prefixes {
+				got = append(got, prefix.String())
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("ParseAllowedCIDRs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowedCIDRsAnnotation(t *testing.T) {
+	r := registry.New()
+	_, pubBytes, _ := generateTestKeyPair(t)
+
+	meta := metav1.ObjectMeta{
+		Namespace: "ns-test",
+		Labels: map[string]string{
+			registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+		},
+		OwnerReferences: []metav1.OwnerReference{
+			{Kind: registry.DevboxOwnerKind, Name: "test-devbox"},
+		},
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: *meta.DeepCopy(),
+		Data:       map[string][]byte{registry.DevboxPublicKeyField: pubBytes},
+	}
+	secret.Name = "test-secret"
+	secret.Annotations = map[string]string{registry.AllowedCIDRsAnnotation: "10.0.0.0/8"}
+
+	pod := &corev1.Pod{
+		ObjectMeta: *meta.DeepCopy(),
+		Status:     corev1.PodStatus{PodIP: "10.0.0.1"},
+	}
+	pod.Name = "test-pod"
+
+	steps := []struct {
+		name        string
+		apply       func() error
+		want        []netip.Prefix
+		wantInvalid bool
+	}{
+		{
+			name:  "secret annotation",
+			apply: func() error { return r.AddSecret(nil, secret) },
+			want:  []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		},
+		{
+			name: "pod annotation takes precedence",
+			apply: func() error {
+				pod.Annotations = map[string]string{
+					registry.AllowedCIDRsAnnotation: "2001:db8::/32",
+				}
+				return r.UpdatePod(pod)
+			},
+			want: []netip.Prefix{netip.MustParsePrefix("2001:db8::/32")},
+		},
+		{
+			name:  "secret update keeps the pod annotation",
+			apply: func() error { return r.AddSecret(secret, secret) },
+			want:  []netip.Prefix{netip.MustParsePrefix("2001:db8::/32")},
+		},
+		{
+			name: "invalid pod annotation",
+			apply: func() error {
+				pod.Annotations = map[string]string{registry.AllowedCIDRsAnnotation: "office"}
+				return r.UpdatePod(pod)
+			},
+			wantInvalid: true,
+		},
+		{
+			name: "legacy pod annotation",
+			apply: func() error {
+				pod.Annotations = map[string]string{
+					registry.LegacyAnnotationPrefix + "allowed-cidrs": "203.0.113.0/24",
+				}
+				return r.UpdatePod(pod)
+			},
+			want: []netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")},
+		},
+		{
+			name: "annotation preferred over the legacy one",
+			apply: func() error {
+				pod.Annotations[registry.AllowedCIDRsAnnotation] = "2001:db8::/32"
+				return r.UpdatePod(pod)
+			},
+			want: []netip.Prefix{netip.MustParsePrefix("2001:db8::/32")},
+		},
+		{
+			name: "pod annotation removed",
+			apply: func() error {
+				pod.Annotations = nil
+				return r.UpdatePod(pod)
+			},
+			want: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		},
+	}
+
+	for _, step := range steps {
+		if err := step.apply(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+
+		info, _ := r.GetDevboxInfo("ns-test", "test-devbox")
+		if !slices.Equal(info.AllowedCIDRs, step.want) ||
+			info.AllowedCIDRsInvalid != step.wantInvalid {
+			t.Errorf("%s: AllowedCIDRs = %v, invalid %v, want %v, invalid %v", step.name,
+				info.AllowedCIDRs, info.AllowedCIDRsInvalid, step.want, step.wantInvalid)
+		}
+	}
+}
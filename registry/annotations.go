@@ -0,0 +1,179 @@
+package registry
+
+import (
+	"fmt"
+	"maps"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// AnnotationPrefix prefixes the pod and secret annotations configuring a
+	// devbox, they are collected into DevboxInfo.Annotations without it
+	AnnotationPrefix = "sshgate.io/"
+	// LegacyAnnotationPrefix is the former prefix of the annotations, those are
+	// collected under the same names unless also set with AnnotationPrefix
+	LegacyAnnotationPrefix = "devbox.sealos.io/ssh-"
+)
+
+// Names of the annotations the registry reads, without AnnotationPrefix
+const (
+	backendAddressingName = "backend-addressing"
+	backendHostName       = "backend-host"
+	sessionRecordingName  = "session-recording"
+	forceCommandName      = "force-command"
+	sftpOnlyName          = "sftp-only"
+	backendUsersName      = "backend-users"
+	backendUserName       = "backend-user"
+	motdName              = "motd"
+	allowedCIDRsName      = "allowed-cidrs"
+)
+
+// collectAnnotations returns the annotations with AnnotationPrefix, or else
+// LegacyAnnotationPrefix, keyed by their name without it, nil when there are none
+func collectAnnotations(annotations map[string]string) map[string]string {
+	var collected map[string]string
+
+	for key, value := range annotations {
+		name, ok := strings.CutPrefix(key, AnnotationPrefix)
+		if !ok {
+			name, ok = strings.CutPrefix(key, LegacyAnnotationPrefix)
+			if _, set := annotations[AnnotationPrefix+name]; ok && set {
+				continue
+			}
+		}
+
+		if !ok || name == "" {
+			continue
+		}
+
+		if collected == nil {
+			collected = make(map[string]string)
+		}
+
+		collected[name] = value
+	}
+
+	return collected
+}
+
+// setAnnotations records the annotations collected from the pod and the secret,
+// the pod ones taking precedence
+func (info *DevboxInfo) setAnnotations(pod, secret map[string]string) {
+	info.podAnnotations, info.secretAnnotations = pod, secret
+
+	if len(pod) == 0 && len(secret) == 0 {
+		info.Annotations = nil
+		return
+	}
+
+	merged := maps.Clone(secret)
+	if merged == nil {
+		merged = make(map[string]string, len(pod))
+	}
+
+	maps.Copy(merged, pod)
+	info.Annotations = merged
+}
+
+// Annotation returns the value of the annotation AnnotationPrefix+name of the
+// devbox, annotated on its pod or else its secret, and whether it is set
+func (info *DevboxInfo) Annotation(name string) (string, bool) {
+	value, ok := info.Annotations[name]
+	return strings.TrimSpace(value), ok
+}
+
+// AnnotationInt returns the annotation name parsed as an integer, and whether
+// it is set. Malformed values are errors, never taken as unset.
+func (info *DevboxInfo) AnnotationInt(name string) (int, bool, error) {
+	value, ok := info.Annotation(name)
+	if !ok {
+		return 0, false, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, true, fmt.Errorf("invalid %s%s annotation %q: not an integer",
+			AnnotationPrefix, name, value)
+	}
+
+	return n, true, nil
+}
+
+// AnnotationBool returns the annotation name parsed as a boolean, and whether
+// it is set. Malformed values are errors, never taken as unset.
+func (info *DevboxInfo) AnnotationBool(name string) (bool, bool, error) {
+	value, ok := info.Annotation(name)
+	if !ok {
+		return false, false, nil
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, true, fmt.Errorf("invalid %s%s annotation %q: not a boolean",
+			AnnotationPrefix, name, value)
+	}
+
+	return b, true, nil
+}
+
+// AnnotationCIDRs returns the annotation name parsed as a comma-separated list
+// of CIDRs, see ParseAllowedCIDRs, and whether it is set. Malformed values are
+// errors, never taken as unset.
+func (info *DevboxInfo) AnnotationCIDRs(name string) ([]netip.Prefix, bool, error) {
+	value, ok := info.Annotation(name)
+	if !ok {
+		return nil, false, nil
+	}
+
+	prefixes, err := ParseAllowedCIDRs(value)
+	if err != nil {
+		return nil, true, fmt.Errorf("invalid %s%s annotation: %w", AnnotationPrefix, name, err)
+	}
+
+	return prefixes, true, nil
+}
+
+// applyAnnotations sets the settings of info read from its annotations. Invalid
+// values are logged and ignored, but for the allowed CIDRs, see setAllowedCIDRs.
+func (r *Registry) applyAnnotations(info *DevboxInfo) {
+	logger := r.logger.WithFields(log.Fields{
+		"namespace": info.Namespace,
+		"devbox":    info.DevboxName,
+	})
+
+	recordSessions, _, err := info.AnnotationBool(sessionRecordingName)
+	if err != nil {
+		logger.WithError(err).Warn("Ignoring session recording annotation")
+	}
+
+	info.RecordSessions = recordSessions
+
+	info.SFTPOnly = nil
+	if sftpOnly, ok, err := info.AnnotationBool(sftpOnlyName); err != nil {
+		logger.WithError(err).Warn("Ignoring SFTP only annotation")
+	} else if ok {
+		info.SFTPOnly = &sftpOnly
+	}
+
+	info.MOTD = nil
+	if template, ok := info.Annotation(motdName); ok {
+		info.MOTD = &template
+	}
+
+	info.ForceCommand, _ = info.Annotation(forceCommandName)
+	info.BackendUser, _ = info.Annotation(backendUserName)
+	info.BackendUsers = nil
+
+	users, _ := info.Annotation(backendUsersName)
+	for user := range strings.SplitSeq(users, ",") {
+		if user = strings.TrimSpace(user); user != "" {
+			info.BackendUsers = append(info.BackendUsers, user)
+		}
+	}
+
+	r.setAllowedCIDRs(info, logger)
+}
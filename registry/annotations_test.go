@@ -0,0 +1,261 @@
+package registry_test
+
+import (
+	"maps"
+	"testing"
+
+	"github.com/zijiren233/sshgate/registry"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestAnnotations_Precedence(t *testing.T) {
+	reg := registry.New()
+	_, pubBytes, _ := generateTestKeyPair(t)
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "test-secret",
+			Namespace:       "ns-test",
+			ResourceVersion: "1",
+			Labels: map[string]string{
+				registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+			},
+			Annotations: map[string]string{
+				registry.AnnotationPrefix + "ssh-port":  "2222",
+				registry.AnnotationPrefix + "sftp-only": "true",
+				registry.AnnotationPrefix:               "nameless",
+				"example.com/ssh-port":                  "22",
+				registry.DesiredStateAnnotation:         "Running",
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: registry.DevboxOwnerKind, Name: "test-devbox"},
+			},
+		},
+		Data: map[string][]byte{registry.DevboxPublicKeyField: pubBytes},
+	}
+
+	if err := reg.AddSecret(nil, secret); err != nil {
+		t.Fatalf("AddSecret failed: %v", err)
+	}
+
+	annotations := func() map[string]string {
+		info, ok := reg.GetDevboxInfo("ns-test", "test-devbox")
+		if !ok {
+			t.Fatal("Devbox not found")
+		}
+
+		return info.Annotations
+	}
+
+	want := map[string]string{"ssh-port": "2222", "sftp-only": "true"}
+	if got := annotations(); !maps.Equal(got, want) {
+		t.Fatalf("Annotations = %v, want %v", got, want)
+	}
+
+	// Pod annotations override secret ones
+	pod := newListTestPod("ns-test", "test-devbox", "10.0.0.1")
+	pod.Annotations[registry.AnnotationPrefix+"ssh-port"] = "2200"
+	pod.Annotations[registry.AnnotationPrefix+"backend-user"] = "ubuntu"
+
+	if err := reg.UpdatePod(pod); err != nil {
+		t.Fatalf("UpdatePod failed: %v", err)
+	}
+
+	want = map[string]string{
+		"ssh-port": "2200", "sftp-only": "true", "backend-user": "ubuntu", "backend-users": "root,ubuntu",
+	}
+	if got := annotations(); !maps.Equal(got, want) {
+		t.Fatalf("Annotations = %v, want %v", got, want)
+	}
+
+	// Annotation changes alone propagate, and secret changes keep the pod ones
+	updated := secret.DeepCopy()
+	updated.ResourceVersion = "2"
+	updated.Annotations = map[string]string{registry.AnnotationPrefix + "ssh-port": "2022"}
+
+	if err := reg.AddSecret(secret, updated); err != nil {
+		t.Fatalf("AddSecret failed: %v", err)
+	}
+
+	want = map[string]string{"ssh-port": "2200", "backend-user": "ubuntu", "backend-users": "root,ubuntu"}
+	if got := annotations(); !maps.Equal(got, want) {
+		t.Fatalf("Annotations = %v, want %v", got, want)
+	}
+
+	updatedPod := pod.DeepCopy()
+	delete(updatedPod.Annotations, registry.AnnotationPrefix+"ssh-port")
+
+	if err := reg.UpdatePod(updatedPod); err != nil {
+		t.Fatalf("UpdatePod failed: %v", err)
+	}
+
+	want = map[string]string{"ssh-port": "2022", "backend-user": "ubuntu", "backend-users": "root,ubuntu"}
+	if got := annotations(); !maps.Equal(got, want) {
+		t.Fatalf("Annotations = %v, want %v", got, want)
+	}
+}
+
+func TestAnnotations_LegacyPrefix(t *testing.T) {
+	reg := registry.New()
+	_, pubBytes, _ := generateTestKeyPair(t)
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-secret",
+			Namespace: "ns-test",
+			Labels: map[string]string{
+				registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+			},
+			Annotations: map[string]string{
+				registry.LegacyAnnotationPrefix + "sftp-only":    "false",
+				registry.SFTPOnlyAnnotation:                      "true",
+				registry.LegacyAnnotationPrefix + "backend-user": "ubuntu",
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: registry.DevboxOwnerKind, Name: "test-devbox"},
+			},
+		},
+		Data: map[string][]byte{registry.DevboxPublicKeyField: pubBytes},
+	}
+
+	if err := reg.AddSecret(nil, secret); err != nil {
+		t.Fatalf("AddSecret failed: %v", err)
+	}
+
+	info, ok := reg.GetDevboxInfo("ns-test", "test-devbox")
+	if !ok {
+		t.Fatal("Devbox not found")
+	}
+
+	want := map[string]string{"sftp-only": "true", "backend-user": "ubuntu"}
+	if !maps.Equal(info.Annotations, want) {
+		t.Errorf("Annotations = %v, want %v", info.Annotations, want)
+	}
+
+	if info.SFTPOnly == nil || !*info.SFTPOnly {
+		t.Errorf("SFTPOnly = %v, want true", info.SFTPOnly)
+	}
+
+	if info.BackendUser != "ubuntu" {
+		t.Errorf("BackendUser = %q, want ubuntu", info.BackendUser)
+	}
+}
+
+func TestAnnotations_Typed(t *testing.T) {
+	info := &registry.DevboxInfo{Annotations: map[string]string{
+		"port":      " 2222 ",
+		"bad-port":  "22a",
+		"enabled":   "true",
+		"disabled":  "0",
+		"bad-bool":  "yes please",
+		"cidrs":     "10.0.0.0/8, 192.0.2.7",
+		"bad-cidrs": "10.0.0.0/8,office",
+		"empty":     "",
+	}}
+
+	if value, ok := info.Annotation("port"); !ok || value != "2222" {
+		t.Errorf("Annotation(port) = %q, %v, want 2222, true", value, ok)
+	}
+
+	if value, ok := info.Annotation("missing"); ok || value != "" {
+		t.Errorf("Annotation(missing) = %q, %v, want unset", value, ok)
+	}
+
+	if value, ok, err := info.AnnotationInt("port"); err != nil || !ok || value != 2222 {
+		t.Errorf("AnnotationInt(port) = %d, %v, %v, want 2222", value, ok, err)
+	}
+
+	for _, name := range []string{"bad-port", "empty", "enabled"} {
+		if _, ok, err := info.AnnotationInt(name); err == nil || !ok {
+			t.Errorf("AnnotationInt(%s) = %v, %v, want a malformed value error", name, ok, err)
+		}
+	}
+
+	if _, ok, err := info.AnnotationInt("missing"); ok || err != nil {
+		t.Errorf("AnnotationInt(missing) = %v, %v, want unset", ok, err)
+	}
+
+	for name, want := range map[string]bool{"enabled": true, "disabled": false} {
+		if value, ok, err := info.AnnotationBool(name); err != nil || !ok || value != want {
+			t.Errorf("AnnotationBool(%s) = %v, %v, %v, want %v", name, value, ok, err, want)
+		}
+	}
+
+	if _, ok, err := info.AnnotationBool("bad-bool"); err == nil || !ok {
+		t.Errorf("AnnotationBool(bad-bool) = %v, %v, want a malformed value error", ok, err)
+	}
+
+	prefixes, ok, err := info.AnnotationCIDRs("cidrs")
+	if err != nil || !ok || len(prefixes) != 2 || prefixes[1].String() != "192.0.2.7/32" {
+		t.Errorf("AnnotationCIDRs(cidrs) = %v, %v, %v", prefixes, ok, err)
+	}
+
+	if _, ok, err := info.AnnotationCIDRs("bad-cidrs"); err == nil || !ok {
+		t.Errorf("AnnotationCIDRs(bad-cidrs) = %v, %v, want a malformed value error", ok, err)
+	}
+
+	if _, ok, err := info.AnnotationCIDRs("missing"); ok || err != nil {
+		t.Errorf("AnnotationCIDRs(missing) = %v, %v, want unset", ok, err)
+	}
+}
+
+func TestUpdateDevbox_DesiredStatePrecedence(t *testing.T) {
+	reg := registry.New()
+	_, pubBytes, _ := generateTestKeyPair(t)
+
+	devbox := func() *registry.DevboxInfo {
+		info, ok := reg.GetDevboxInfo("ns-test", "test-devbox")
+		if !ok {
+			t.Fatal("Devbox not found")
+		}
+
+		return info
+	}
+
+	// Known from its custom resource first
+	reg.UpdateDevbox(registry.Devbox{
+		Namespace:    "ns-test",
+		Name:         "test-devbox",
+		DesiredState: registry.DesiredStateStopped,
+		SSHPort:      2222,
+	})
+
+	if info := devbox(); info.DesiredState != registry.DesiredStateStopped || info.SSHPort != 2222 {
+		t.Fatalf("Devbox = %s, port %d, want Stopped, port 2222", info.DesiredState, info.SSHPort)
+	}
+
+	// The custom resource takes precedence over the annotation of the secret
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "test-secret",
+			Namespace:       "ns-test",
+			ResourceVersion: "1",
+			Labels: map[string]string{
+				registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+			},
+			Annotations: map[string]string{registry.DesiredStateAnnotation: "running"},
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: registry.DevboxOwnerKind, Name: "test-devbox"},
+			},
+		},
+		Data: map[string][]byte{registry.DevboxPublicKeyField: pubBytes},
+	}
+
+	if err := reg.AddSecret(nil, secret); err != nil {
+		t.Fatalf("AddSecret failed: %v", err)
+	}
+
+	if info := devbox(); info.DesiredState != registry.DesiredStateStopped ||
+		info.PublicKey == nil {
+		t.Fatalf("Devbox = %s with key %t, want Stopped with its key", info.DesiredState,
+			info.PublicKey != nil)
+	}
+
+	// The annotation applies again once the custom resource is deleted
+	reg.DeleteDevbox("ns-test", "test-devbox")
+
+	if info := devbox(); info.DesiredState != registry.DesiredStateRunning || info.SSHPort != 0 {
+		t.Fatalf("Devbox = %s, port %d, want Running, no port", info.DesiredState, info.SSHPort)
+	}
+}
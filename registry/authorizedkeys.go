@@ -0,0 +1,132 @@
+package registry
+
+import (
+	"bufio"
+	"bytes"
+	"maps"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// DevboxAuthorizedKeysField is the secret data field holding additional public
+// keys of the devbox in authorized_keys format, written by its users
+const DevboxAuthorizedKeysField = "SSHGATE_AUTHORIZED_KEYS"
+
+// KeySource tells which of the keys of a devbox a client authenticated with
+type KeySource string
+
+const (
+	// KeySourcePrimary is the devbox key issued by the controller
+	KeySourcePrimary KeySource = "primary"
+	// KeySourceAuthorizedKeys is a key added by users to DevboxAuthorizedKeysField
+	KeySourceAuthorizedKeys KeySource = "authorized_keys"
+)
+
+// AuthorizedKey is a public key added by users to a devbox
+type AuthorizedKey struct {
+	PublicKey ssh.PublicKey
+	// Comment is the comment of the authorized_keys line, usually naming the
+	// owner of the key
+	Comment string
+}
+
+// KeySource returns which key of the devbox key is, with the comment of user
+// added keys. It returns an empty source when key is none of them.
+func (info *DevboxInfo) KeySource(key ssh.PublicKey) (source KeySource, comment string) {
+	marshaled := key.Marshal()
+
+	if info.PublicKey != nil && bytes.Equal(info.PublicKey.Marshal(), marshaled) {
+		return KeySourcePrimary, ""
+	}
+
+	for _, authorized := range info.AuthorizedKeys {
+		if bytes.Equal(authorized.PublicKey.Marshal(), marshaled) {
+			return KeySourceAuthorizedKeys, authorized.Comment
+		}
+	}
+
+	return "", ""
+}
+
+// parseAuthorizedKeys parses the authorized_keys lines of a devbox, skipping
+// blank lines and comments. Malformed lines are skipped with a warning, they
+// must not lock users out of the devbox.
+func parseAuthorizedKeys(data []byte, logger *log.Entry) []AuthorizedKey {
+	var keys []AuthorizedKey
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 || text[0] == '#' {
+			continue
+		}
+
+		publicKey, comment, _, _, err := ssh.ParseAuthorizedKey(text)
+		if err != nil {
+			logger.WithField("line", line).WithError(err).Warn("Skipping malformed authorized key")
+			continue
+		}
+
+		keys = append(keys, AuthorizedKey{PublicKey: publicKey, Comment: comment})
+	}
+
+	return keys
+}
+
+// setAuthorizedKeys replaces the user added keys of a devbox, it must be called
+// with r.devboxMu held. The sets of devboxes of keys are replaced rather than
+// modified, lookups read them without r.devboxMu.
+func (r *Registry) setAuthorizedKeys(info *DevboxInfo, devboxKey string, keys []AuthorizedKey) {
+	for _, key := range info.AuthorizedKeys {
+		marshaled := string(key.PublicKey.Marshal())
+
+		devboxes, _ := r.authorizedKeyToDevboxes.get(marshaled)
+		if _, ok := devboxes[devboxKey]; !ok {
+			continue
+		}
+
+		if len(devboxes) == 1 {
+			r.authorizedKeyToDevboxes.delete(marshaled)
+			continue
+		}
+
+		devboxes = maps.Clone(devboxes)
+		delete(devboxes, devboxKey)
+		r.authorizedKeyToDevboxes.set(marshaled, devboxes)
+	}
+
+	for _, key := range keys {
+		marshaled := string(key.PublicKey.Marshal())
+
+		devboxes, _ := r.authorizedKeyToDevboxes.get(marshaled)
+		if _, ok := devboxes[devboxKey]; ok {
+			continue
+		}
+
+		devboxes = maps.Clone(devboxes)
+		if devboxes == nil {
+			devboxes = make(map[string]struct{}, 1)
+		}
+
+		devboxes[devboxKey] = struct{}{}
+		r.authorizedKeyToDevboxes.set(marshaled, devboxes)
+	}
+
+	info.AuthorizedKeys = keys
+}
+
+// authorizedKeyDevbox returns the only devbox a user added key was added to.
+// Keys added to several devboxes select none, the username has to.
+func (r *Registry) authorizedKeyDevbox(marshaled string) (string, bool) {
+	devboxes, _ := r.authorizedKeyToDevboxes.get(marshaled)
+	if len(devboxes) != 1 {
+		return "", false
+	}
+
+	for devboxKey := range devboxes {
+		return devboxKey, true
+	}
+
+	return "", false
+}
@@ -0,0 +1,141 @@
+package registry_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// authorizedKeysSecret returns the secret of a devbox with user added keys
+func authorizedKeysSecret(t *testing.T, devboxName, authorizedKeys string) *corev1.Secret {
+	t.Helper()
+
+	_, pubBytes, _ := generateTestKeyPair(t)
+
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      devboxName + "-secret",
+			Namespace: "test-ns",
+			Labels: map[string]string{
+				registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: registry.DevboxOwnerKind, Name: devboxName},
+			},
+		},
+		Data: map[string][]byte{
+			registry.DevboxPublicKeyField:      pubBytes,
+			registry.DevboxAuthorizedKeysField: []byte(authorizedKeys),
+		},
+	}
+}
+
+// authorizedKeyLine returns an authorized_keys line of key with comment
+func authorizedKeyLine(key ssh.PublicKey, comment string) string {
+	return strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(key)), "\n") + " " + comment + "\n"
+}
+
+func TestAddSecret_AuthorizedKeys(t *testing.T) {
+	r := registry.New()
+
+	laptop, _, _ := generateTestKeyPair(t)
+	desktop, _, _ := generateTestKeyPair(t)
+
+	secret := authorizedKeysSecret(t, "test-devbox",
+		"# keys of the team\n\n"+
+			authorizedKeyLine(laptop, "alice@laptop")+
+			"ssh-ed25519 not-base64 broken@line\n"+
+			authorizedKeyLine(desktop, "bob@desktop"),
+	)
+	if err := r.AddSecret(nil, secret); err != nil {
+		t.Fatalf("AddSecret() with a malformed line failed: %v", err)
+	}
+
+	for _, tt := range []struct {
+		key     ssh.PublicKey
+		comment string
+	}{
+		{key: laptop, comment: "alice@laptop"},
+		{key: desktop, comment: "bob@desktop"},
+	} {
+		info, ok := r.GetByPublicKey(tt.key)
+		if !ok || info.DevboxName != "test-devbox" {
+			t.Fatalf("GetByPublicKey() of %s = %v, %v, want test-devbox", tt.comment, info, ok)
+		}
+
+		source, comment := info.KeySource(tt.key)
+		if source != registry.KeySourceAuthorizedKeys || comment != tt.comment {
+			t.Errorf("KeySource() = %s, %q, want authorized_keys, %q", source, comment, tt.comment)
+		}
+	}
+
+	// The primary key still works
+	primary, _, _, _, _ := ssh.ParseAuthorizedKey(secret.Data[registry.DevboxPublicKeyField])
+	if info, ok := r.GetByPublicKey(primary); !ok {
+		t.Error("GetByPublicKey() of the primary key failed")
+	} else if source, _ := info.KeySource(primary); source != registry.KeySourcePrimary {
+		t.Errorf("KeySource() of the primary key = %s, want primary", source)
+	}
+
+	// Removing a line removes its key on the next update
+	updated := secret.DeepCopy()
+	updated.Data[registry.DevboxAuthorizedKeysField] = []byte(authorizedKeyLine(desktop, "bob"))
+
+	if err := r.AddSecret(secret, updated); err != nil {
+		t.Fatalf("AddSecret() update failed: %v", err)
+	}
+
+	if _, ok := r.GetByPublicKey(laptop); ok {
+		t.Error("GetByPublicKey() found a removed authorized key")
+	}
+
+	if _, ok := r.GetByPublicKey(desktop); !ok {
+		t.Error("GetByPublicKey() lost a kept authorized key")
+	}
+
+	// Deleting the secret removes every key
+	r.DeleteSecret(updated)
+
+	if _, ok := r.GetByPublicKey(desktop); ok {
+		t.Error("GetByPublicKey() found an authorized key of a deleted secret")
+	}
+}
+
+func TestAddSecret_SharedAuthorizedKey(t *testing.T) {
+	r := registry.New()
+
+	laptop, _, _ := generateTestKeyPair(t)
+	line := authorizedKeyLine(laptop, "alice@laptop")
+
+	first := authorizedKeysSecret(t, "first-devbox", line)
+	for _, secret := range []*corev1.Secret{first, authorizedKeysSecret(t, "second-devbox", line)} {
+		if err := r.AddSecret(nil, secret); err != nil {
+			t.Fatalf("AddSecret() failed: %v", err)
+		}
+	}
+
+	// A key added to several devboxes selects none of them
+	if info, ok := r.GetByPublicKey(laptop); ok {
+		t.Errorf("GetByPublicKey() of a shared key = %s, want none", info.DevboxName)
+	}
+
+	info, ok := r.GetDevboxInfo("test-ns", "second-devbox")
+	if !ok {
+		t.Fatal("GetDevboxInfo() failed")
+	}
+
+	if source, _ := info.KeySource(laptop); source != registry.KeySourceAuthorizedKeys {
+		t.Errorf("KeySource() of a shared key = %q, want authorized_keys", source)
+	}
+
+	// Once removed from one devbox, it selects the other
+	r.DeleteSecret(first)
+
+	if info, ok := r.GetByPublicKey(laptop); !ok || info.DevboxName != "second-devbox" {
+		t.Errorf("GetByPublicKey() = %v, %v, want second-devbox", info, ok)
+	}
+}
@@ -0,0 +1,183 @@
+package registry_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// benchDevboxes is the number of devboxes of the registries of benchmarks
+const benchDevboxes = 100_000
+
+var (
+	benchOnce    sync.Once
+	benchSecrets []*corev1.Secret
+	benchKeys    []ssh.PublicKey
+)
+
+// benchFixtures returns the secrets of benchDevboxes devboxes and their public
+// keys, generated once for all benchmarks
+func benchFixtures(b *testing.B) ([]*corev1.Secret, []ssh.PublicKey) {
+	b.Helper()
+
+	benchOnce.Do(func() {
+		for i := range benchDevboxes {
+			pub, _, err := ed25519.GenerateKey(rand.Reader)
+			if err != nil {
+				b.Fatalf("Failed to generate key: %v", err)
+			}
+
+			publicKey, err := ssh.NewPublicKey(pub)
+			if err != nil {
+				b.Fatalf("Failed to create SSH public key: %v", err)
+			}
+
+			benchKeys = append(benchKeys, publicKey)
+			benchSecrets = append(benchSecrets, &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:            fmt.Sprintf("devbox-%d", i),
+					Namespace:       fmt.Sprintf("ns-%d", i%1000),
+					ResourceVersion: "1",
+					Labels: map[string]string{
+						registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+					},
+					OwnerReferences: []metav1.OwnerReference{
+						{Kind: registry.DevboxOwnerKind, Name: fmt.Sprintf("devbox-%d", i)},
+					},
+				},
+				Data: map[string][]byte{
+					registry.DevboxPublicKeyField: ssh.MarshalAuthorizedKey(publicKey),
+				},
+			})
+		}
+	})
+
+	return benchSecrets, benchKeys
+}
+
+// discardLogs discards the logs of the registry during the benchmark, logging
+// every secret would be measured rather than the registry
+func discardLogs(b *testing.B) {
+	b.Helper()
+
+	out := log.StandardLogger().Out
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(out) })
+}
+
+// reportLatencies reports the median and 99th percentile of latencies
+func reportLatencies(b *testing.B, latencies []time.Duration) {
+	b.Helper()
+
+	if len(latencies) == 0 {
+		return
+	}
+
+	slices.Sort(latencies)
+	b.ReportMetric(float64(latencies[len(latencies)/2].Nanoseconds()), "p50-ns/lookup")
+	b.ReportMetric(float64(latencies[len(latencies)*99/100].Nanoseconds()), "p99-ns/lookup")
+}
+
+// BenchmarkGetByPublicKey_DuringResync looks devboxes up while the informer
+// resyncs all their secrets over and over, as during a resync storm
+func BenchmarkGetByPublicKey_DuringResync(b *testing.B) {
+	secrets, keys := benchFixtures(b)
+	discardLogs(b)
+
+	reg := registry.New(registry.WithSkipPrivateKeys(true))
+	for _, secret := range secrets {
+		if err := reg.AddSecret(nil, secret); err != nil {
+			b.Fatalf("AddSecret failed: %v", err)
+		}
+	}
+
+	done := make(chan struct{})
+
+	var wg sync.WaitGroup
+
+	wg.Go(func() {
+		for {
+			for _, secret := range secrets {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				if err := reg.AddSecret(secret, secret); err != nil {
+					b.Errorf("AddSecret failed: %v", err)
+					return
+				}
+			}
+		}
+	})
+
+	latencies := make([]time.Duration, 0, 1<<20)
+
+	for i := 0; b.Loop(); i++ {
+		start := time.Now()
+
+		if _, ok := reg.GetByPublicKey(keys[i%len(keys)]); !ok {
+			b.Fatal("Devbox not found")
+		}
+
+		latencies = append(latencies, time.Since(start))
+	}
+
+	close(done)
+	wg.Wait()
+
+	reportLatencies(b, latencies)
+}
+
+// BenchmarkAddSecret_Resync resyncs the secrets of benchDevboxes devboxes while
+// lookups keep coming, reporting the time of a whole resync
+func BenchmarkAddSecret_Resync(b *testing.B) {
+	secrets, keys := benchFixtures(b)
+	discardLogs(b)
+
+	reg := registry.New(registry.WithSkipPrivateKeys(true))
+	for _, secret := range secrets {
+		if err := reg.AddSecret(nil, secret); err != nil {
+			b.Fatalf("AddSecret failed: %v", err)
+		}
+	}
+
+	done := make(chan struct{})
+
+	var wg sync.WaitGroup
+
+	wg.Go(func() {
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			reg.GetByPublicKey(keys[i%len(keys)])
+		}
+	})
+
+	for b.Loop() {
+		for _, secret := range secrets {
+			if err := reg.AddSecret(secret, secret); err != nil {
+				b.Fatalf("AddSecret failed: %v", err)
+			}
+		}
+	}
+
+	close(done)
+	wg.Wait()
+}
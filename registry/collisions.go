@@ -0,0 +1,126 @@
+package registry
+
+import (
+	"slices"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// KeyCollision is a public key held by the secrets of several devboxes, as when
+// secrets are copied across namespaces
+type KeyCollision struct {
+	// Fingerprint is the SHA256 fingerprint of the key
+	Fingerprint string
+	// Owners are the devboxes holding the key as namespace/devbox, in the order
+	// they claimed it. The key routes to the first, the others are not found by
+	// it.
+	Owners []string
+}
+
+// claimPublicKey maps a public key to devboxKey, whose secret holds it. A key
+// already held by another devbox keeps routing to it: copying the key of a
+// devbox into another secret must not take its connections over. The claim of
+// devboxKey is kept for when the holder releases the key. Must be called with
+// r.devboxMu held.
+func (r *Registry) claimPublicKey(
+	publicKey ssh.PublicKey,
+	marshaled, devboxKey string,
+	logger *log.Entry,
+) {
+	owners, colliding := r.keyOwners[marshaled]
+	if !colliding {
+		holder, ok := r.publicKeyToNamespaceDevbox.get(marshaled)
+		if !ok || holder == devboxKey {
+			r.publicKeyToNamespaceDevbox.set(marshaled, devboxKey)
+			return
+		}
+
+		owners = []string{holder}
+	}
+
+	if slices.Contains(owners, devboxKey) {
+		return
+	}
+
+	owners = append(owners, devboxKey)
+	r.keyOwners[marshaled] = owners
+	r.metrics.keyCollision()
+
+	logger.WithFields(log.Fields{
+		"fingerprint": ssh.FingerprintSHA256(publicKey),
+		"owner":       owners[0],
+		"owners":      strings.Join(owners, ","),
+	}).Warn("Public key already held by another devbox, keeping it routed to its owner")
+}
+
+// releasePublicKey unmaps a public key from devboxKey, whose secret no longer
+// holds it. A key held by other devboxes routes to the one that claimed it
+// first of the others.
+// Must be called with r.devboxMu held.
+func (r *Registry) releasePublicKey(marshaled, devboxKey string) {
+	owners, colliding := r.keyOwners[marshaled]
+	if !colliding {
+		if holder, _ := r.publicKeyToNamespaceDevbox.get(marshaled); holder == devboxKey {
+			r.publicKeyToNamespaceDevbox.delete(marshaled)
+		}
+
+		return
+	}
+
+	owners = slices.DeleteFunc(owners, func(owner string) bool { return owner == devboxKey })
+	r.publicKeyToNamespaceDevbox.set(marshaled, owners[0])
+
+	if len(owners) == 1 {
+		delete(r.keyOwners, marshaled)
+	} else {
+		r.keyOwners[marshaled] = owners
+	}
+}
+
+// Collisions returns the public keys currently held by several devboxes,
+// sorted by fingerprint
+func (r *Registry) Collisions() []KeyCollision {
+	r.devboxMu.Lock()
+	defer r.devboxMu.Unlock()
+
+	collisions := make([]KeyCollision, 0, len(r.keyOwners))
+
+	for marshaled, owners := range r.keyOwners {
+		publicKey, err := ssh.ParsePublicKey([]byte(marshaled))
+		if err != nil {
+			continue
+		}
+
+		collisions = append(collisions, KeyCollision{
+			Fingerprint: ssh.FingerprintSHA256(publicKey),
+			Owners:      slices.Clone(owners),
+		})
+	}
+
+	slices.SortFunc(collisions, func(a, b KeyCollision) int {
+		return strings.Compare(a.Fingerprint, b.Fingerprint)
+	})
+
+	return collisions
+}
+
+// LogCollisions logs every public key currently held by several devboxes
+func (r *Registry) LogCollisions() {
+	for _, collision := range r.Collisions() {
+		r.logger.WithFields(log.Fields{
+			"fingerprint": collision.Fingerprint,
+			"owner":       collision.Owners[0],
+			"owners":      strings.Join(collision.Owners, ","),
+		}).Warn("Public key held by several devboxes")
+	}
+}
+
+// collidingKeys returns the number of public keys held by several devboxes
+func (r *Registry) collidingKeys() int {
+	r.devboxMu.Lock()
+	defer r.devboxMu.Unlock()
+
+	return len(r.keyOwners)
+}
@@ -0,0 +1,154 @@
+package registry_test
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// copiedSecret returns a copy of secret in namespace, as copied by users
+func copiedSecret(secret *corev1.Secret, namespace string) *corev1.Secret {
+	copied := secret.DeepCopy()
+	copied.Namespace = namespace
+
+	return copied
+}
+
+// keyOwner returns the devbox a public key routes to as namespace/devbox
+func keyOwner(r *registry.Registry, key ssh.PublicKey) string {
+	info, ok := r.GetByPublicKey(key)
+	if !ok {
+		return ""
+	}
+
+	return info.Namespace + "/" + info.DevboxName
+}
+
+func TestAddSecret_KeyCollision(t *testing.T) {
+	original, publicKey := snapshotSecret(t, "test-devbox")
+	original.Namespace = "ns-b"
+	copied := copiedSecret(original, "ns-a")
+
+	// The key keeps routing to the devbox that held it first, a copy in a
+	// namespace sorting earlier does not take it over
+	for _, order := range [][]*corev1.Secret{{original, copied}, {copied, original}} {
+		first := order[0].Namespace + "/test-devbox"
+		second := order[1].Namespace + "/test-devbox"
+
+		gatherer := prometheus.NewRegistry()
+		r := registry.New(registry.WithMetrics(gatherer))
+
+		for _, secret := range order {
+			if err := r.AddSecret(nil, secret); err != nil {
+				t.Fatalf("AddSecret failed: %v", err)
+			}
+		}
+
+		// Resyncs are no new collisions
+		if err := r.AddSecret(order[1], order[1]); err != nil {
+			t.Fatalf("AddSecret failed: %v", err)
+		}
+
+		if owner := keyOwner(r, publicKey); owner != first {
+			t.Errorf("Key routes to %q, want %s", owner, first)
+		}
+
+		want := []registry.KeyCollision{{
+			Fingerprint: ssh.FingerprintSHA256(publicKey),
+			Owners:      []string{first, second},
+		}}
+		got := r.Collisions()
+		if !slices.EqualFunc(got, want, func(a, b registry.KeyCollision) bool {
+			return a.Fingerprint == b.Fingerprint && slices.Equal(a.Owners, b.Owners)
+		}) {
+			t.Errorf("Collisions() = %v, want %v", got, want)
+		}
+
+		for _, name := range []string{
+			"sshgate_registry_key_collisions_total", "sshgate_registry_colliding_keys",
+		} {
+			if value := metricValue(t, gatherer, name, "", ""); value != 1 {
+				t.Errorf("%s = %v, want 1", name, value)
+			}
+		}
+	}
+}
+
+func TestDeleteSecret_KeyCollision(t *testing.T) {
+	original, publicKey := snapshotSecret(t, "test-devbox")
+	copies := []*corev1.Secret{
+		copiedSecret(original, "ns-a"),
+		copiedSecret(original, "ns-b"),
+		copiedSecret(original, "ns-c"),
+	}
+
+	r := registry.New()
+
+	for _, secret := range copies {
+		if err := r.AddSecret(nil, secret); err != nil {
+			t.Fatalf("AddSecret failed: %v", err)
+		}
+	}
+
+	// Deleting a devbox the key does not route to leaves the routing alone
+	r.DeleteSecret(copies[1])
+
+	if owner := keyOwner(r, publicKey); owner != "ns-a/test-devbox" {
+		t.Errorf("Key routes to %q after deleting ns-b, want ns-a/test-devbox", owner)
+	}
+
+	// The key routes to the next devbox holding it once the first is gone
+	r.DeleteSecret(copies[0])
+
+	if owner := keyOwner(r, publicKey); owner != "ns-c/test-devbox" {
+		t.Errorf("Key routes to %q after deleting ns-a, want ns-c/test-devbox", owner)
+	}
+
+	if collisions := r.Collisions(); len(collisions) != 0 {
+		t.Errorf("Collisions() = %v, want none", collisions)
+	}
+
+	r.DeleteSecret(copies[2])
+
+	if owner := keyOwner(r, publicKey); owner != "" {
+		t.Errorf("Key routes to %q after deleting every devbox, want none", owner)
+	}
+}
+
+func TestAddSecret_KeyCollisionRotation(t *testing.T) {
+	original, publicKey := snapshotSecret(t, "test-devbox")
+	first := copiedSecret(original, "ns-a")
+	second := copiedSecret(original, "ns-b")
+
+	r := registry.New()
+
+	for _, secret := range []*corev1.Secret{first, second} {
+		if err := r.AddSecret(nil, secret); err != nil {
+			t.Fatalf("AddSecret failed: %v", err)
+		}
+	}
+
+	// The first devbox gets a key of its own
+	rotated, rotatedKey := snapshotSecret(t, "test-devbox")
+	rotated.Namespace = "ns-a"
+
+	if err := r.AddSecret(first, rotated); err != nil {
+		t.Fatalf("AddSecret failed: %v", err)
+	}
+
+	if owner := keyOwner(r, publicKey); owner != "ns-b/test-devbox" {
+		t.Errorf("Shared key routes to %q, want ns-b/test-devbox", owner)
+	}
+
+	if owner := keyOwner(r, rotatedKey); owner != "ns-a/test-devbox" {
+		t.Errorf("Rotated key routes to %q, want ns-a/test-devbox", owner)
+	}
+
+	if collisions := r.Collisions(); len(collisions) != 0 {
+		t.Errorf("Collisions() = %v, want none", collisions)
+	}
+}
@@ -0,0 +1,158 @@
+package registry
+
+import (
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DebugDevbox describes a devbox in the registry dump served by DebugHandler.
+// Keys are described by their fingerprints only.
+type DebugDevbox struct {
+	Namespace string `json:"namespace"`
+	Devbox    string `json:"devbox"`
+	Cluster   string `json:"cluster,omitempty"`
+	// Fingerprint is the SHA256 fingerprint of the public key of the devbox
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// AuthorizedKeyFingerprints are the fingerprints of the keys added by users
+	AuthorizedKeyFingerprints []string `json:"authorized_key_fingerprints,omitempty"`
+	// PrivateKeyCached reports whether the private key of the devbox is cached
+	PrivateKeyCached bool             `json:"private_key_cached"`
+	PodName          string           `json:"pod_name,omitempty"`
+	PodIP            string           `json:"pod_ip,omitempty"`
+	PodState         PodState         `json:"pod_state"`
+	DesiredState     DesiredState     `json:"desired_state,omitempty"`
+	DisplayName      string           `json:"display_name,omitempty"`
+	SSHPort          int              `json:"ssh_port,omitempty"`
+	BackendPort      int              `json:"backend_port,omitempty"`
+	Pods             []DebugDevboxPod `json:"pods,omitempty"`
+	// Stale is set while the devbox is only known from a snapshot
+	Stale           bool      `json:"stale,omitempty"`
+	SecretUpdatedAt time.Time `json:"secret_updated_at,omitzero"`
+	PodUpdatedAt    time.Time `json:"pod_updated_at,omitzero"`
+}
+
+// DebugDevboxPod describes a pod of a devbox in the registry dump
+type DebugDevboxPod struct {
+	Name        string   `json:"name"`
+	IP          string   `json:"ip,omitempty"`
+	State       PodState `json:"state"`
+	Terminating bool     `json:"terminating,omitempty"`
+	// DebugClone is set on the pods never selected, see DevboxPod.Controlled
+	DebugClone bool `json:"debug_clone,omitempty"`
+}
+
+// debugDump is the body of the responses of DebugHandler
+type debugDump struct {
+	Devboxes []DebugDevbox `json:"devboxes"`
+}
+
+// debugDevbox describes info in the registry dump
+func (info *DevboxInfo) debugDevbox() DebugDevbox {
+	devbox := DebugDevbox{
+		Namespace:        info.Namespace,
+		Devbox:           info.DevboxName,
+		Cluster:          info.Cluster,
+		PrivateKeyCached: info.PrivateKey != nil,
+		PodName:          info.PodName,
+		PodIP:            info.PodIP,
+		PodState:         info.PodState(),
+		DesiredState:     info.DesiredState,
+		DisplayName:      info.DisplayName,
+		SSHPort:          info.SSHPort,
+		BackendPort:      info.BackendPort,
+		Stale:            info.Stale(),
+		SecretUpdatedAt:  info.SecretUpdatedAt,
+		PodUpdatedAt:     info.PodUpdatedAt,
+	}
+
+	if info.PublicKey != nil {
+		devbox.Fingerprint = ssh.FingerprintSHA256(info.PublicKey)
+	}
+
+	for _, key := range info.AuthorizedKeys {
+		devbox.AuthorizedKeyFingerprints = append(devbox.AuthorizedKeyFingerprints,
+			ssh.FingerprintSHA256(key.PublicKey))
+	}
+
+	for _, pod := range info.Pods {
+		devbox.Pods = append(devbox.Pods, DebugDevboxPod{
+			Name:        pod.Name,
+			IP:          pod.IP,
+			State:       pod.State(),
+			Terminating: pod.Terminating,
+			DebugClone:  !info.selectable(pod),
+		})
+	}
+
+	return devbox
+}
+
+// DebugDevboxes describes the devboxes of namespace and named devbox, any when
+// empty, holding the key of fingerprint if set, ordered by namespace then name
+func (r *Registry) DebugDevboxes(namespace, devbox, fingerprint string) []DebugDevbox {
+	var infos []*DevboxInfo
+
+	// Snapshots are never modified, they are described once the shards are
+	// released
+	r.devboxToInfo.forEach(func(_ string, info *DevboxInfo) {
+		if (namespace == "" || info.Namespace == namespace) &&
+			(devbox == "" || info.DevboxName == devbox) {
+			infos = append(infos, info)
+		}
+	})
+
+	devboxes := make([]DebugDevbox, 0, len(infos))
+
+	for _, info := range infos {
+		described := info.debugDevbox()
+		if fingerprint != "" && described.Fingerprint != fingerprint &&
+			!slices.Contains(described.AuthorizedKeyFingerprints, fingerprint) {
+			continue
+		}
+
+		devboxes = append(devboxes, described)
+	}
+
+	slices.SortFunc(devboxes, func(a, b DebugDevbox) int {
+		return cmp.Or(cmp.Compare(a.Namespace, b.Namespace), cmp.Compare(a.Devbox, b.Devbox))
+	})
+
+	return devboxes
+}
+
+// DebugHandler serves a dump of the registry as JSON, to debug routing:
+//
+//	GET /debug/registry?namespace=ns&devbox=name&fingerprint=SHA256:...
+//
+// Every parameter is optional and narrows the devboxes down, fingerprint to
+// the devboxes the key reaches. Private keys and public key blobs are never
+// served, only fingerprints. Serve it to administrators only.
+func (r *Registry) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		query := req.URL.Query()
+		dump := debugDump{Devboxes: r.DebugDevboxes(
+			query.Get("namespace"),
+			query.Get("devbox"),
+			query.Get("fingerprint"),
+		)}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+
+		if err := json.NewEncoder(w).Encode(dump); err != nil {
+			r.logger.WithError(err).Warn("Failed to write registry dump")
+		}
+	})
+}
@@ -0,0 +1,114 @@
+package registry_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// getDump requests the registry dump with query, returning its devboxes and body
+func getDump(t *testing.T, r *registry.Registry, query string) ([]registry.DebugDevbox, []byte) {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	r.DebugHandler().ServeHTTP(recorder, httptest.NewRequest(
+		http.MethodGet, "/debug/registry"+query, nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Status = %d, want 200", recorder.Code)
+	}
+
+	var dump struct {
+		Devboxes []registry.DebugDevbox `json:"devboxes"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &dump); err != nil {
+		t.Fatalf("Failed to parse dump: %v", err)
+	}
+
+	return dump.Devboxes, recorder.Body.Bytes()
+}
+
+func TestDebugHandler(t *testing.T) {
+	r := registry.New()
+
+	secret, publicKey := snapshotSecret(t, "test-devbox")
+	laptop, _, _ := generateTestKeyPair(t)
+	secret.Data[registry.DevboxAuthorizedKeysField] = []byte(
+		authorizedKeyLine(laptop, "alice@laptop"),
+	)
+
+	other, _ := snapshotSecret(t, "other-devbox")
+	other.Namespace = "other-ns"
+
+	for _, s := range []*corev1.Secret{secret, other} {
+		if err := r.AddSecret(nil, s); err != nil {
+			t.Fatalf("AddSecret failed: %v", err)
+		}
+	}
+
+	if err := r.UpdatePod(newListTestPod("test-ns", "test-devbox", "10.0.0.1")); err != nil {
+		t.Fatalf("UpdatePod failed: %v", err)
+	}
+
+	devboxes, body := getDump(t, r, "")
+	if len(devboxes) != 2 || devboxes[0].Namespace != "other-ns" {
+		t.Fatalf("Devboxes = %+v, want both devboxes by namespace", devboxes)
+	}
+
+	// Keys are only described by their fingerprints
+	for _, material := range [][]byte{
+		[]byte("PRIVATE KEY"),
+		[]byte(strings.Fields(string(ssh.MarshalAuthorizedKey(publicKey)))[1]),
+		[]byte(strings.Fields(string(ssh.MarshalAuthorizedKey(laptop)))[1]),
+	} {
+		if bytes.Contains(body, material) {
+			t.Errorf("Dump holds key material %.20s", material)
+		}
+	}
+
+	devbox := devboxes[1]
+	if devbox.Fingerprint != ssh.FingerprintSHA256(publicKey) || !devbox.PrivateKeyCached ||
+		devbox.PodIP != "10.0.0.1" || devbox.PodState != registry.PodStateReady ||
+		devbox.SecretUpdatedAt.IsZero() || devbox.PodUpdatedAt.IsZero() {
+		t.Errorf("Devbox = %+v", devbox)
+	}
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{query: "?namespace=other-ns", want: "other-devbox"},
+		{query: "?namespace=test-ns&devbox=test-devbox", want: "test-devbox"},
+		{query: "?devbox=missing", want: ""},
+		{query: "?fingerprint=" + ssh.FingerprintSHA256(laptop), want: "test-devbox"},
+		{query: "?fingerprint=SHA256:unknown", want: ""},
+	}
+
+	for _, tt := range tests {
+		devboxes, _ := getDump(t, r, strings.ReplaceAll(tt.query, "+", "%2B"))
+
+		var got string
+		if len(devboxes) == 1 {
+			got = devboxes[0].Devbox
+		}
+
+		if got != tt.want || len(devboxes) > 1 {
+			t.Errorf("%s: devboxes = %+v, want %q", tt.query, devboxes, tt.want)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	r.DebugHandler().ServeHTTP(recorder, httptest.NewRequest(
+		http.MethodPost, "/debug/registry", nil))
+
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST status = %d, want 405", recorder.Code)
+	}
+}
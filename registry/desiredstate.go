@@ -0,0 +1,28 @@
+package registry
+
+import "strings"
+
+// DesiredState is the state requested for a devbox, which its pod may not
+// have reached yet
+type DesiredState string
+
+const (
+	// DesiredStateUnknown means the requested state of the devbox is not known
+	DesiredStateUnknown DesiredState = ""
+	// DesiredStateRunning means the devbox was asked to run
+	DesiredStateRunning DesiredState = "Running"
+	// DesiredStateStopped means the devbox was stopped on purpose
+	DesiredStateStopped DesiredState = "Stopped"
+)
+
+// ParseDesiredState parses the value of DesiredStateAnnotation or of the state
+// of a Devbox custom resource, ignoring case, any other value is unknown
+func ParseDesiredState(value string) DesiredState {
+	for _, state := range []DesiredState{DesiredStateRunning, DesiredStateStopped} {
+		if strings.EqualFold(strings.TrimSpace(value), string(state)) {
+			return state
+		}
+	}
+
+	return DesiredStateUnknown
+}
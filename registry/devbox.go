@@ -0,0 +1,109 @@
+package registry
+
+import (
+	"cmp"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Devbox is what the registry reads of a Devbox custom resource
+type Devbox struct {
+	Namespace string
+	Name      string
+	// DesiredState is the state requested for the devbox, it takes precedence
+	// over DesiredStateAnnotation
+	DesiredState DesiredState
+	// DisplayName is the name users know the devbox by, if any
+	DisplayName string
+	// SSHPort overrides the backend SSH port of the gateway when not zero
+	SSHPort int
+}
+
+// UpdateDevbox applies the Devbox custom resource of a devbox, known before
+// its secret and pod or not
+func (r *Registry) UpdateDevbox(devbox Devbox) {
+	key := fmt.Sprintf("%s/%s", devbox.Namespace, devbox.Name)
+
+	r.devboxMu.Lock()
+
+	info, exists := r.devboxToInfo.get(key)
+	if exists {
+		// Resyncs replay unchanged resources
+		if info.devbox != nil && *info.devbox == devbox {
+			r.devboxMu.Unlock()
+			return
+		}
+
+		info = info.clone()
+	} else {
+		info = &DevboxInfo{
+			Namespace:  devbox.Namespace,
+			DevboxName: devbox.Name,
+			Cluster:    r.cluster,
+		}
+	}
+
+	info.setDevbox(&devbox)
+	r.devboxToInfo.set(key, info)
+
+	r.devboxMu.Unlock()
+
+	r.logger.WithFields(log.Fields{
+		"namespace":     devbox.Namespace,
+		"devbox":        devbox.Name,
+		"desired_state": devbox.DesiredState,
+	}).Debug("Updating devbox")
+}
+
+// DeleteDevbox drops what the Devbox custom resource of a devbox set, and the
+// devbox when the registry knows neither its secret nor its pods
+func (r *Registry) DeleteDevbox(namespace, name string) {
+	key := fmt.Sprintf("%s/%s", namespace, name)
+
+	r.devboxMu.Lock()
+
+	info, ok := r.devboxToInfo.get(key)
+	if !ok || info.devbox == nil {
+		r.devboxMu.Unlock()
+		return
+	}
+
+	if info.PublicKey == nil && len(info.Pods) == 0 && len(info.endpointSlices) == 0 {
+		r.devboxToInfo.delete(key)
+	} else {
+		info = info.clone()
+		info.setDevbox(nil)
+		r.devboxToInfo.set(key, info)
+	}
+
+	r.devboxMu.Unlock()
+
+	r.logger.WithFields(log.Fields{
+		"namespace": namespace,
+		"devbox":    name,
+	}).Debug("Removing devbox")
+}
+
+// setDevbox sets the Devbox custom resource of info, nil once deleted
+func (info *DevboxInfo) setDevbox(devbox *Devbox) {
+	info.devbox = devbox
+	info.DisplayName, info.SSHPort = "", 0
+
+	if devbox != nil {
+		info.DisplayName, info.SSHPort = devbox.DisplayName, devbox.SSHPort
+	}
+
+	info.setDesiredState()
+}
+
+// setDesiredState sets the desired state of info from its Devbox custom
+// resource, taking precedence, and its secret
+func (info *DevboxInfo) setDesiredState() {
+	var devbox DesiredState
+	if info.devbox != nil {
+		devbox = info.devbox.DesiredState
+	}
+
+	info.DesiredState = cmp.Or(devbox, info.secretDesiredState)
+}
@@ -0,0 +1,305 @@
+package registry
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+)
+
+// endpointSSHPortNames name the port of the SSH server in the EndpointSlices
+// of devboxes, in order of preference. A slice with a single port needs none.
+var endpointSSHPortNames = []string{"devbox-ssh-port", "ssh"}
+
+// DevboxEndpoint is a ready endpoint of the Service of a devbox. Devboxes are
+// reached at their endpoints rather than their pods in EndpointSlice discovery.
+type DevboxEndpoint struct {
+	// Addresses are the addresses of the endpoint, of the address type of its
+	// slice
+	Addresses []string
+	// Port is the target port of the SSH server, zero when the slice does not
+	// tell it
+	Port int
+	// PodName is the name of the pod the endpoint targets, if any
+	PodName string
+
+	// slice is the name of the EndpointSlice listing the endpoint
+	slice string
+}
+
+// sortEndpoints orders endpoints by pod and address, so that the selection
+// does not depend on event order
+func sortEndpoints(endpoints []DevboxEndpoint) {
+	slices.SortFunc(endpoints, func(a, b DevboxEndpoint) int {
+		return cmp.Or(
+			cmp.Compare(a.PodName, b.PodName),
+			cmp.Compare(a.Addresses[0], b.Addresses[0]),
+			cmp.Compare(a.slice, b.slice),
+		)
+	})
+}
+
+// setEndpointSlice replaces the endpoints of the slice named name, at version,
+// among the endpoints of info
+func (info *DevboxInfo) setEndpointSlice(name, version string, endpoints []DevboxEndpoint) {
+	kept := slices.DeleteFunc(slices.Clone(info.Endpoints), func(e DevboxEndpoint) bool {
+		return e.slice == name
+	})
+	kept = append(kept, endpoints...)
+	sortEndpoints(kept)
+
+	info.Endpoints = kept
+	info.endpointSlices = maps.Clone(info.endpointSlices)
+
+	if info.endpointSlices == nil {
+		info.endpointSlices = make(map[string]string)
+	}
+
+	info.endpointSlices[name] = version
+}
+
+// removeEndpointSlice removes the endpoints of the slice named name from info,
+// reporting whether it was found
+func (info *DevboxInfo) removeEndpointSlice(name string) bool {
+	if _, ok := info.endpointSlices[name]; !ok {
+		return false
+	}
+
+	info.Endpoints = slices.DeleteFunc(slices.Clone(info.Endpoints), func(e DevboxEndpoint) bool {
+		return e.slice == name
+	})
+	info.endpointSlices = maps.Clone(info.endpointSlices)
+	delete(info.endpointSlices, name)
+
+	return true
+}
+
+// hasEndpointSliceVersion reports whether info holds slice at its resource
+// version, as when the informer resyncs
+func (info *DevboxInfo) hasEndpointSliceVersion(slice *discoveryv1.EndpointSlice) bool {
+	version, ok := info.endpointSlices[slice.Name]
+	return ok && slice.ResourceVersion != "" && version == slice.ResourceVersion
+}
+
+// UpdateEndpointSlice sets the ready endpoints of the Service of a devbox from
+// one of its EndpointSlices. The Service is named after the devbox, like the
+// DNS name of DefaultBackendHostTemplate, and the slice carries the selector
+// label of devbox objects.
+func (r *Registry) UpdateEndpointSlice(slice *discoveryv1.EndpointSlice) error {
+	if !r.isDevboxObject(slice.Labels) {
+		return nil
+	}
+
+	r.metrics.operation(OperationUpdateEndpointSlice)
+
+	devboxName := slice.Labels[discoveryv1.LabelServiceName]
+	if devboxName == "" {
+		r.metrics.parseFailure(ParseFailureOwner)
+		return fmt.Errorf("endpoint slice %s/%s has no service", slice.Namespace, slice.Name)
+	}
+
+	key := fmt.Sprintf("%s/%s", slice.Namespace, devboxName)
+	endpoints := readyEndpoints(slice)
+
+	r.logger.WithFields(log.Fields{
+		"namespace":      slice.Namespace,
+		"devbox":         devboxName,
+		"endpoint_slice": slice.Name,
+		"endpoints":      len(endpoints),
+	}).Info("Updating endpoint slice")
+
+	r.devboxMu.Lock()
+
+	info, exists := r.devboxToInfo.get(key)
+	if exists {
+		info = info.clone()
+	} else {
+		info = &DevboxInfo{
+			Namespace:  slice.Namespace,
+			DevboxName: devboxName,
+			Cluster:    r.cluster,
+		}
+	}
+
+	previousIP := info.PodIP
+	info.stalePod = false
+
+	if !info.hasEndpointSliceVersion(slice) {
+		info.PodUpdatedAt = time.Now()
+	}
+
+	info.setEndpointSlice(slice.Name, slice.ResourceVersion, endpoints)
+	r.selectPod(info)
+	r.devboxToInfo.set(key, info)
+	snapshot := info.redactedCopy()
+
+	r.devboxMu.Unlock()
+
+	if info.PodIP != previousIP {
+		r.notify(Event{
+			Type:       EventPodIPChanged,
+			Namespace:  slice.Namespace,
+			DevboxName: devboxName,
+			PodIP:      snapshot.PodIP,
+			Info:       &snapshot,
+		})
+	}
+
+	return nil
+}
+
+// DeleteEndpointSlice removes an EndpointSlice of a devbox from the registry
+func (r *Registry) DeleteEndpointSlice(slice *discoveryv1.EndpointSlice) {
+	devboxName := slice.Labels[discoveryv1.LabelServiceName]
+	if !r.isDevboxObject(slice.Labels) || devboxName == "" {
+		return
+	}
+
+	r.deleteEndpointSlice(slice.Namespace, devboxName, slice.Name)
+}
+
+// deleteEndpointSlice removes the EndpointSlice named name of a devbox,
+// reporting whether the registry held it
+func (r *Registry) deleteEndpointSlice(namespace, devboxName, name string) bool {
+	r.metrics.operation(OperationDeleteEndpointSlice)
+
+	key := fmt.Sprintf("%s/%s", namespace, devboxName)
+	sliceLogger := r.logger.WithFields(log.Fields{
+		"namespace":      namespace,
+		"devbox":         devboxName,
+		"endpoint_slice": name,
+	})
+
+	r.devboxMu.Lock()
+
+	info, ok := r.devboxToInfo.get(key)
+	if ok {
+		info = info.clone()
+	}
+
+	if !ok || !info.removeEndpointSlice(name) {
+		r.devboxMu.Unlock()
+		sliceLogger.Debug("Ignoring deletion of an unknown endpoint slice")
+
+		return false
+	}
+
+	previousIP := info.PodIP
+	info.PodUpdatedAt = time.Now()
+	r.selectPod(info)
+	r.devboxToInfo.set(key, info)
+	snapshot := info.redactedCopy()
+
+	r.devboxMu.Unlock()
+
+	sliceLogger.WithField("endpoints", len(snapshot.Endpoints)).Info("Removing endpoint slice")
+
+	switch {
+	case len(snapshot.Endpoints) == 0 && len(snapshot.Pods) == 0:
+		r.notify(Event{
+			Type:       EventPodDeleted,
+			Namespace:  namespace,
+			DevboxName: devboxName,
+			Info:       &snapshot,
+		})
+	case snapshot.PodIP != previousIP:
+		r.notify(Event{
+			Type:       EventPodIPChanged,
+			Namespace:  namespace,
+			DevboxName: devboxName,
+			PodIP:      snapshot.PodIP,
+			Info:       &snapshot,
+		})
+	}
+
+	return true
+}
+
+// selectEndpoint sets the pod fields of info from its preferred endpoint, the
+// first of the preferred IP family. Devboxes are reached at the address of the
+// endpoint, on its port.
+func (r *Registry) selectEndpoint(info *DevboxInfo) {
+	selected := info.Endpoints[0]
+
+	for _, endpoint := range info.Endpoints {
+		if r.ofIPFamily(endpoint.Addresses[0]) {
+			selected = endpoint
+			break
+		}
+	}
+
+	ip := selected.Addresses[0]
+
+	// The endpoints of the other address type of the pod, in dual-stack clusters
+	ips := slices.Clone(selected.Addresses)
+
+	for _, endpoint := range info.Endpoints {
+		if selected.PodName != "" && endpoint.PodName == selected.PodName &&
+			endpoint.slice != selected.slice {
+			ips = append(ips, endpoint.Addresses...)
+		}
+	}
+
+	// Probes of the previous endpoint say nothing about the new one
+	if info.PodIP != ip {
+		info.Health = BackendHealth{}
+	}
+
+	info.PodIP, info.PodIPs, info.PodName = ip, ips, selected.PodName
+	info.PodPhase, info.PodReady, info.podReadyReported = corev1.PodRunning, true, true
+	info.Addressing, info.BackendHost = BackendAddressingPodIP, ""
+	info.BackendPort = selected.Port
+}
+
+// readyEndpoints returns the ready endpoints of slice, serving endpoints count
+// as ready when the slice does not report their readiness
+func readyEndpoints(slice *discoveryv1.EndpointSlice) []DevboxEndpoint {
+	port := endpointSlicePort(slice)
+
+	var endpoints []DevboxEndpoint
+
+	for _, endpoint := range slice.Endpoints {
+		if len(endpoint.Addresses) == 0 ||
+			endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+			continue
+		}
+
+		devboxEndpoint := DevboxEndpoint{
+			Addresses: slices.Clone(endpoint.Addresses),
+			Port:      port,
+			slice:     slice.Name,
+		}
+
+		if ref := endpoint.TargetRef; ref != nil && ref.Kind == "Pod" {
+			devboxEndpoint.PodName = ref.Name
+		}
+
+		endpoints = append(endpoints, devboxEndpoint)
+	}
+
+	return endpoints
+}
+
+// endpointSlicePort returns the target port of the SSH server in slice, the
+// port of one of endpointSSHPortNames or the only port of the slice, zero if
+// neither
+func endpointSlicePort(slice *discoveryv1.EndpointSlice) int {
+	for _, name := range endpointSSHPortNames {
+		for _, port := range slice.Ports {
+			if port.Name != nil && *port.Name == name && port.Port != nil {
+				return int(*port.Port)
+			}
+		}
+	}
+
+	if len(slice.Ports) == 1 && slice.Ports[0].Port != nil {
+		return int(*slice.Ports[0].Port)
+	}
+
+	return 0
+}
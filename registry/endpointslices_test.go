@@ -0,0 +1,243 @@
+package registry_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/registry"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// newEndpointSlice returns an EndpointSlice of the Service of a devbox of the
+// test-ns namespace, listing endpoints on ports
+func newEndpointSlice(
+	devboxName, name string,
+	addressType discoveryv1.AddressType,
+	ports []discoveryv1.EndpointPort,
+	endpoints ...discoveryv1.Endpoint,
+) *discoveryv1.EndpointSlice {
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			Namespace:       "test-ns",
+			ResourceVersion: "1",
+			Labels: map[string]string{
+				registry.DevboxPartOfLabel:   registry.DevboxPartOfValue,
+				discoveryv1.LabelServiceName: devboxName,
+			},
+		},
+		AddressType: addressType,
+		Endpoints:   endpoints,
+		Ports:       ports,
+	}
+}
+
+// endpoint returns an endpoint of the pod named podName at address
+func endpoint(podName, address string, ready bool) discoveryv1.Endpoint {
+	return discoveryv1.Endpoint{
+		Addresses:  []string{address},
+		Conditions: discoveryv1.EndpointConditions{Ready: &ready},
+		TargetRef:  &corev1.ObjectReference{Kind: "Pod", Name: podName},
+	}
+}
+
+// endpointPort returns an endpoint port named name, unnamed when empty
+func endpointPort(name string, port int32) discoveryv1.EndpointPort {
+	endpointPort := discoveryv1.EndpointPort{Port: &port}
+	if name != "" {
+		endpointPort.Name = &name
+	}
+
+	return endpointPort
+}
+
+func TestUpdateEndpointSlice(t *testing.T) {
+	tests := []struct {
+		name      string
+		family    registry.IPFamily
+		ports     []discoveryv1.EndpointPort
+		endpoints []discoveryv1.Endpoint
+		wantIP    string
+		wantPod   string
+		wantPort  int
+		wantState registry.PodState
+	}{
+		{
+			name:      "single port",
+			ports:     []discoveryv1.EndpointPort{endpointPort("", 2222)},
+			endpoints: []discoveryv1.Endpoint{endpoint("devbox-1", "10.0.0.1", true)},
+			wantIP:    "10.0.0.1",
+			wantPod:   "devbox-1",
+			wantPort:  2222,
+			wantState: registry.PodStateReady,
+		},
+		{
+			name: "named ssh port",
+			ports: []discoveryv1.EndpointPort{
+				endpointPort("http", 8080), endpointPort("devbox-ssh-port", 22),
+			},
+			endpoints: []discoveryv1.Endpoint{endpoint("devbox-1", "10.0.0.1", true)},
+			wantIP:    "10.0.0.1",
+			wantPod:   "devbox-1",
+			wantPort:  22,
+			wantState: registry.PodStateReady,
+		},
+		{
+			name:  "unknown port",
+			ports: []discoveryv1.EndpointPort{endpointPort("a", 1), endpointPort("b", 2)},
+			endpoints: []discoveryv1.Endpoint{
+				endpoint("devbox-1", "10.0.0.1", true),
+			},
+			wantIP:    "10.0.0.1",
+			wantPod:   "devbox-1",
+			wantState: registry.PodStateReady,
+		},
+		{
+			name:  "not ready endpoint skipped",
+			ports: []discoveryv1.EndpointPort{endpointPort("", 22)},
+			endpoints: []discoveryv1.Endpoint{
+				endpoint("devbox-1", "10.0.0.1", false),
+				endpoint("devbox-2", "10.0.0.2", true),
+			},
+			wantIP:    "10.0.0.2",
+			wantPod:   "devbox-2",
+			wantPort:  22,
+			wantState: registry.PodStateReady,
+		},
+		{
+			name:      "no ready endpoint",
+			ports:     []discoveryv1.EndpointPort{endpointPort("", 22)},
+			endpoints: []discoveryv1.Endpoint{endpoint("devbox-1", "10.0.0.1", false)},
+			wantState: registry.PodStateNone,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := registry.New()
+
+			slice := newEndpointSlice("devbox", "devbox-abcde", discoveryv1.AddressTypeIPv4,
+				tt.ports, tt.endpoints...)
+			if err := reg.UpdateEndpointSlice(slice); err != nil {
+				t.Fatalf("UpdateEndpointSlice failed: %v", err)
+			}
+
+			info, ok := reg.GetDevboxInfo("test-ns", "devbox")
+			if !ok {
+				t.Fatal("Devbox not registered")
+			}
+
+			if info.PodIP != tt.wantIP || info.PodName != tt.wantPod ||
+				info.BackendPort != tt.wantPort || info.PodState() != tt.wantState {
+				t.Errorf("Devbox reached at %s:%d of %q (%s), want %s:%d of %q (%s)",
+					info.PodIP, info.BackendPort, info.PodName, info.PodState(),
+					tt.wantIP, tt.wantPort, tt.wantPod, tt.wantState)
+			}
+		})
+	}
+}
+
+func TestUpdateEndpointSlice_DualStack(t *testing.T) {
+	reg := registry.New(registry.WithIPFamily(registry.IPFamilyIPv6))
+	ports := []discoveryv1.EndpointPort{endpointPort("", 22)}
+
+	for _, slice := range []*discoveryv1.EndpointSlice{
+		newEndpointSlice("devbox", "devbox-v4", discoveryv1.AddressTypeIPv4, ports,
+			endpoint("devbox-1", "10.0.0.1", true)),
+		newEndpointSlice("devbox", "devbox-v6", discoveryv1.AddressTypeIPv6, ports,
+			endpoint("devbox-1", "fd00::1", true)),
+	} {
+		if err := reg.UpdateEndpointSlice(slice); err != nil {
+			t.Fatalf("UpdateEndpointSlice failed: %v", err)
+		}
+	}
+
+	info, _ := reg.GetDevboxInfo("test-ns", "devbox")
+	if info.PodIP != "fd00::1" || len(info.PodIPs) != 2 {
+		t.Errorf("Devbox reached at %s of %v, want fd00::1 of both families",
+			info.PodIP, info.PodIPs)
+	}
+}
+
+func TestDeleteEndpointSlice(t *testing.T) {
+	reg := registry.New()
+	ports := []discoveryv1.EndpointPort{endpointPort("", 22)}
+
+	var events []registry.Event
+
+	reg.Subscribe(func(e registry.Event) { events = append(events, e) })
+
+	first := newEndpointSlice("devbox", "devbox-1", discoveryv1.AddressTypeIPv4, ports,
+		endpoint("devbox-1", "10.0.0.1", true))
+	second := newEndpointSlice("devbox", "devbox-2", discoveryv1.AddressTypeIPv4, ports,
+		endpoint("devbox-2", "10.0.0.2", true))
+
+	for _, slice := range []*discoveryv1.EndpointSlice{first, second} {
+		if err := reg.UpdateEndpointSlice(slice); err != nil {
+			t.Fatalf("UpdateEndpointSlice failed: %v", err)
+		}
+	}
+
+	reg.DeleteEndpointSlice(first)
+
+	if info, _ := reg.GetDevboxInfo("test-ns", "devbox"); info.PodIP != "10.0.0.2" {
+		t.Errorf("Devbox reached at %s, want the remaining endpoint", info.PodIP)
+	}
+
+	reg.DeleteEndpointSlice(second)
+
+	info, ok := reg.GetDevboxInfo("test-ns", "devbox")
+	if !ok || info.PodState() != registry.PodStateNone || info.BackendPort != 0 {
+		t.Errorf("Devbox without endpoints = %+v", info)
+	}
+
+	if last := events[len(events)-1]; last.Type != registry.EventPodDeleted {
+		t.Errorf("Last event = %v, want EventPodDeleted", last.Type)
+	}
+}
+
+func TestResync_EndpointSlices(t *testing.T) {
+	reg := registry.New()
+	ports := []discoveryv1.EndpointPort{endpointPort("", 22)}
+
+	kept := newEndpointSlice("kept", "kept-1", discoveryv1.AddressTypeIPv4, ports,
+		endpoint("kept-1", "10.0.0.1", true))
+	gone := newEndpointSlice("gone", "gone-1", discoveryv1.AddressTypeIPv4, ports,
+		endpoint("gone-1", "10.0.0.2", true))
+
+	for _, slice := range []*discoveryv1.EndpointSlice{kept, gone} {
+		if err := reg.UpdateEndpointSlice(slice); err != nil {
+			t.Fatalf("UpdateEndpointSlice failed: %v", err)
+		}
+	}
+
+	// The deletion of a slice and a new devbox were missed
+	added := newEndpointSlice("added", "added-1", discoveryv1.AddressTypeIPv4, ports,
+		endpoint("added-1", "10.0.0.3", true))
+	listed := []*discoveryv1.EndpointSlice{kept, added}
+
+	stats := reg.Resync(time.Now(), nil, nil, listed)
+
+	want := registry.ResyncStats{
+		EndpointSlicesApplied: 1,
+		EndpointSlicesRemoved: 1,
+		DevboxesRemoved:       1,
+	}
+	if stats != want {
+		t.Errorf("Resync() = %+v, want %+v", stats, want)
+	}
+
+	if info, ok := reg.GetDevboxInfo("test-ns", "added"); !ok || info.PodIP != "10.0.0.3" {
+		t.Error("Devbox added not reached at its endpoint")
+	}
+
+	if _, ok := reg.GetDevboxInfo("test-ns", "gone"); ok {
+		t.Error("Devbox gone still registered")
+	}
+
+	if stats := reg.Resync(time.Now(), nil, nil, listed); stats != (registry.ResyncStats{}) {
+		t.Errorf("Second Resync() = %+v, want no change", stats)
+	}
+}
@@ -0,0 +1,166 @@
+package registry
+
+import (
+	"golang.org/x/crypto/ssh"
+)
+
+// Federation resolves devboxes across the registries of several clusters, each
+// registry fed by the informers of its cluster. A cluster failing to sync only
+// leaves its own registry stale.
+//
+// Registries take precedence in order, the registry of the cluster of the
+// gateway first: a devbox, by namespace and name, known to several clusters
+// resolves to the first registry holding it and the others are shadowed, the
+// keys of shadowed devboxes reach nothing. Keys held by devboxes of several
+// clusters thus reach the devbox of the first cluster.
+type Federation struct {
+	registries []*Registry
+}
+
+// NewFederation returns a Federation of registries, in order of precedence
+func NewFederation(registries ...*Registry) *Federation {
+	return &Federation{registries: registries}
+}
+
+// shadowed reports whether a registry preceding the i-th holds the devbox
+func (f *Federation) shadowed(i int, namespace, devboxName string) bool {
+	for _, r := range f.registries[:i] {
+		if _, ok := r.GetDevboxInfo(namespace, devboxName); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// owner returns the registry the devbox resolves to
+func (f *Federation) owner(namespace, devboxName string) (*Registry, bool) {
+	for _, r := range f.registries {
+		if _, ok := r.GetDevboxInfo(namespace, devboxName); ok {
+			return r, true
+		}
+	}
+
+	return nil, false
+}
+
+// GetByPublicKey returns the devbox a key reaches in the first registry where
+// it reaches a devbox that is not shadowed
+func (f *Federation) GetByPublicKey(publicKey ssh.PublicKey) (*DevboxInfo, bool) {
+	for i, r := range f.registries {
+		info, ok := r.GetByPublicKey(publicKey)
+		if ok && !f.shadowed(i, info.Namespace, info.DevboxName) {
+			return info, true
+		}
+	}
+
+	return nil, false
+}
+
+// GetDevboxInfo returns a devbox from the first registry holding it
+func (f *Federation) GetDevboxInfo(namespace, devboxName string) (*DevboxInfo, bool) {
+	for _, r := range f.registries {
+		if info, ok := r.GetDevboxInfo(namespace, devboxName); ok {
+			return info, true
+		}
+	}
+
+	return nil, false
+}
+
+// Devboxes returns a snapshot of every devbox of the registries, shadowed
+// devboxes aside
+func (f *Federation) Devboxes() []DevboxInfo {
+	var devboxes []DevboxInfo
+
+	seen := make(map[[2]string]struct{})
+
+	for _, r := range f.registries {
+		current := r.Devboxes()
+
+		for _, info := range current {
+			if _, ok := seen[[2]string{info.Namespace, info.DevboxName}]; !ok {
+				devboxes = append(devboxes, info)
+			}
+		}
+
+		for _, info := range current {
+			seen[[2]string{info.Namespace, info.DevboxName}] = struct{}{}
+		}
+	}
+
+	return devboxes
+}
+
+// BackendHealth returns the probed reachability of the backend of a devbox
+func (f *Federation) BackendHealth(namespace, devboxName string) (BackendHealth, bool) {
+	r, ok := f.owner(namespace, devboxName)
+	if !ok {
+		return BackendHealth{}, false
+	}
+
+	return r.BackendHealth(namespace, devboxName)
+}
+
+// UpdateBackendHealth applies update to the backend health of a devbox in the
+// registry it resolves to, see Registry.UpdateBackendHealth
+func (f *Federation) UpdateBackendHealth(
+	namespace, devboxName, podIP string,
+	update func(*BackendHealth),
+) bool {
+	r, ok := f.owner(namespace, devboxName)
+	if !ok {
+		return false
+	}
+
+	return r.UpdateBackendHealth(namespace, devboxName, podIP, update)
+}
+
+// IsRevoked reports whether any registry revokes the key of a SHA256
+// fingerprint, a key revoked in one cluster is revoked in all
+func (f *Federation) IsRevoked(fingerprint string) bool {
+	for _, r := range f.registries {
+		if r.IsRevoked(fingerprint) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// OTPSecret returns the TOTP secret of a key fingerprint from the first
+// registry holding one, see Registry.OTPSecret
+func (f *Federation) OTPSecret(fingerprint, namespace string) ([]byte, bool) {
+	for _, r := range f.registries {
+		if secret, ok := r.OTPSecret(fingerprint, namespace); ok {
+			return secret, true
+		}
+	}
+
+	return nil, false
+}
+
+// Subscribe calls fn after every change of the registries, except the changes
+// of shadowed devboxes, and returns a function removing the subscriptions. A
+// devbox no longer shadowed, as its devbox of a preceding cluster is gone, is
+// only reported by its next change.
+func (f *Federation) Subscribe(fn func(Event)) (unsubscribe func()) {
+	unsubscribes := make([]func(), 0, len(f.registries))
+
+	for i, r := range f.registries {
+		unsubscribes = append(unsubscribes, r.Subscribe(func(event Event) {
+			if event.Type != EventKeysRevoked &&
+				f.shadowed(i, event.Namespace, event.DevboxName) {
+				return
+			}
+
+			fn(event)
+		}))
+	}
+
+	return func() {
+		for _, unsubscribe := range unsubscribes {
+			unsubscribe()
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package registry_test
+
+import (
+	"testing"
+
+	"github.com/zijiren233/sshgate/registry"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestFederation(t *testing.T) {
+	local := registry.New()
+	remote := registry.New(registry.WithCluster("remote"))
+	federation := registry.NewFederation(local, remote)
+
+	var events []registry.Event
+
+	federation.Subscribe(func(e registry.Event) { events = append(events, e) })
+
+	// The same devbox in both clusters, and a devbox only in the remote one
+	shared, sharedKey := snapshotSecret(t, "shared")
+	remoteOnly, remoteKey := snapshotSecret(t, "remote-only")
+	// The remote copy of the shared devbox holds another key
+	remoteShared, remoteSharedKey := snapshotSecret(t, "shared")
+
+	if err := local.AddSecret(nil, shared); err != nil {
+		t.Fatalf("AddSecret failed: %v", err)
+	}
+
+	for _, secret := range []*corev1.Secret{remoteOnly, remoteShared} {
+		if err := remote.AddSecret(nil, secret); err != nil {
+			t.Fatalf("AddSecret failed: %v", err)
+		}
+	}
+
+	if info, ok := federation.GetByPublicKey(sharedKey); !ok || info.Cluster != "" {
+		t.Error("Shared devbox not resolved to the local cluster")
+	}
+
+	if info, ok := federation.GetByPublicKey(remoteKey); !ok || info.Cluster != "remote" {
+		t.Error("Remote devbox not resolved to the remote cluster")
+	}
+
+	if _, ok := federation.GetByPublicKey(remoteSharedKey); ok {
+		t.Error("Key of a shadowed devbox resolved")
+	}
+
+	if devboxes := federation.Devboxes(); len(devboxes) != 2 {
+		t.Errorf("Devboxes() = %d devboxes, want 2", len(devboxes))
+	}
+
+	// Only the events of the local shared devbox and of the remote-only one
+	if len(events) != 2 || events[0].Cluster != "" || events[1].Cluster != "remote" {
+		t.Errorf("Events = %+v, want the shadowed devbox filtered", events)
+	}
+
+	if err := remote.UpdatePod(resyncPod("shared", "shared-1", "10.1.0.1", "1")); err != nil {
+		t.Fatalf("UpdatePod failed: %v", err)
+	}
+
+	if info, _ := federation.GetDevboxInfo("test-ns", "shared"); info.PodIP != "" {
+		t.Errorf("Shared devbox reached at the remote pod %s", info.PodIP)
+	}
+
+	// The remote devbox takes over once the local one is gone
+	local.DeleteSecret(shared)
+
+	if info, ok := federation.GetByPublicKey(remoteSharedKey); !ok || info.PodIP != "10.1.0.1" {
+		t.Error("Remote devbox not resolved once the local one is gone")
+	}
+}
@@ -0,0 +1,77 @@
+package registry
+
+import (
+	"slices"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Secret data fields of the kubernetes.io/ssh-auth secret type, for devbox
+// controllers following its convention
+const (
+	SSHAuthPublicKeyField  = "ssh-publickey"
+	SSHAuthPrivateKeyField = corev1.SSHAuthPrivateKey
+)
+
+// WithKeyFields sets the secret data fields holding the public and the private
+// key of devboxes, each tried in order. Empty lists keep DevboxPublicKeyField
+// and DevboxPrivateKeyField.
+func WithKeyFields(publicKeyFields, privateKeyFields []string) Option {
+	return func(r *Registry) {
+		if len(publicKeyFields) > 0 {
+			r.publicKeyFields = slices.Clone(publicKeyFields)
+		}
+
+		if len(privateKeyFields) > 0 {
+			r.privateKeyFields = slices.Clone(privateKeyFields)
+		}
+	}
+}
+
+// WithSelectorLabel sets the label, key and value, of the secrets and pods of
+// devboxes. An empty key keeps DevboxPartOfLabel=DevboxPartOfValue.
+func WithSelectorLabel(key, value string) Option {
+	return func(r *Registry) {
+		if key != "" {
+			r.selectorLabel, r.selectorValue = key, value
+		}
+	}
+}
+
+// WithOwnerKind sets the kind of the owner reference naming the devbox of
+// secrets and pods, an empty kind keeps DevboxOwnerKind
+func WithOwnerKind(kind string) Option {
+	return func(r *Registry) {
+		if kind != "" {
+			r.ownerKind = kind
+		}
+	}
+}
+
+// isDevboxObject reports whether an object carries the selector label of devboxes
+func (r *Registry) isDevboxObject(labels map[string]string) bool {
+	return labels[r.selectorLabel] == r.selectorValue
+}
+
+// secretField returns the data of the first of fields the secret holds
+func secretField(secret *corev1.Secret, fields []string) ([]byte, bool) {
+	for _, field := range fields {
+		if data, ok := secret.Data[field]; ok {
+			return data, true
+		}
+	}
+
+	return nil, false
+}
+
+// devboxOwner returns the owner reference naming the devbox of an object
+func (r *Registry) devboxOwner(refs []metav1.OwnerReference) (metav1.OwnerReference, bool) {
+	for _, ref := range refs {
+		if ref.Kind == r.ownerKind {
+			return ref, true
+		}
+	}
+
+	return metav1.OwnerReference{}, false
+}
@@ -0,0 +1,99 @@
+package registry_test
+
+import (
+	"testing"
+
+	"github.com/zijiren233/sshgate/registry"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// sshAuthSecret returns a kubernetes.io/ssh-auth secret of a devbox owned by a
+// Workspace and labeled by another controller
+func sshAuthSecret(t *testing.T) *corev1.Secret {
+	t.Helper()
+
+	_, pubBytes, privBytes := generateTestKeyPair(t)
+
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-devbox-ssh",
+			Namespace: "test-ns",
+			Labels:    map[string]string{"example.com/workspace": "true"},
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: "Workspace", Name: "test-devbox"},
+			},
+		},
+		Type: corev1.SecretTypeSSHAuth,
+		Data: map[string][]byte{
+			registry.SSHAuthPublicKeyField:  pubBytes,
+			registry.SSHAuthPrivateKeyField: privBytes,
+		},
+	}
+}
+
+func TestAddSecret_SSHAuthLayout(t *testing.T) {
+	secret := sshAuthSecret(t)
+
+	// The default layout ignores the secret
+	if err := registry.New().AddSecret(nil, secret); err != nil {
+		t.Fatalf("AddSecret failed: %v", err)
+	}
+
+	r := registry.New(
+		registry.WithKeyFields(
+			[]string{registry.DevboxPublicKeyField, registry.SSHAuthPublicKeyField},
+			[]string{registry.DevboxPrivateKeyField, registry.SSHAuthPrivateKeyField},
+		),
+		registry.WithSelectorLabel("example.com/workspace", "true"),
+		registry.WithOwnerKind("Workspace"),
+	)
+
+	if err := r.AddSecret(nil, secret); err != nil {
+		t.Fatalf("AddSecret failed: %v", err)
+	}
+
+	info, ok := r.GetDevboxInfo("test-ns", "test-devbox")
+	if !ok {
+		t.Fatal("Devbox not registered")
+	}
+
+	if info.PrivateKey == nil || info.DevboxRef.Kind != "Workspace" {
+		t.Errorf("Devbox = %+v, want its private key and Workspace owner", info)
+	}
+
+	if _, ok := r.GetByPublicKey(info.PublicKey); !ok {
+		t.Error("Devbox not found by its public key")
+	}
+
+	pod := newListTestPod("test-ns", "test-devbox", "10.0.0.1")
+	pod.Labels = map[string]string{"example.com/workspace": "true"}
+	pod.OwnerReferences = []metav1.OwnerReference{{Kind: "Workspace", Name: "test-devbox"}}
+
+	if err := r.UpdatePod(pod); err != nil {
+		t.Fatalf("UpdatePod failed: %v", err)
+	}
+
+	if info, _ := r.GetDevboxInfo("test-ns", "test-devbox"); info.PodIP != "10.0.0.1" {
+		t.Errorf("PodIP = %q, want 10.0.0.1", info.PodIP)
+	}
+
+	// The first field found is used
+	other, pubBytes, _ := generateTestKeyPair(t)
+	secret.Data[registry.DevboxPublicKeyField] = pubBytes
+
+	if err := r.AddSecret(nil, secret); err != nil {
+		t.Fatalf("AddSecret failed: %v", err)
+	}
+
+	if info, _ := r.GetDevboxInfo("test-ns", "test-devbox"); info.PublicKey == nil ||
+		string(info.PublicKey.Marshal()) != string(other.Marshal()) {
+		t.Error("Public key not read from the first field")
+	}
+
+	r.DeleteSecret(secret)
+
+	if _, ok := r.GetByPublicKey(other); ok {
+		t.Error("Devbox still found after deleting its secret")
+	}
+}
@@ -0,0 +1,113 @@
+package registry
+
+import (
+	"maps"
+	"slices"
+	"strings"
+)
+
+// ListFilter selects the devboxes returned by List, the zero value selects all
+type ListFilter struct {
+	// Namespace selects the devboxes of a namespace
+	Namespace string
+	// NamePrefix selects the devboxes whose name starts with it
+	NamePrefix string
+	// RunningOnly selects the devboxes with a pod IP
+	RunningOnly bool
+	// After resumes a listing after the devbox of this namespace/name key, the
+	// Next of the previous page
+	After string
+	// Limit caps the number of devboxes returned, 0 is unlimited
+	Limit int
+}
+
+// ListPage is a page of devboxes returned by List
+type ListPage struct {
+	Devboxes []DevboxInfo
+	// Next is the After of the following page, empty on the last page
+	Next string
+}
+
+// matches reports whether the filter selects the devbox of key
+func (f ListFilter) matches(key string, info *DevboxInfo) bool {
+	switch {
+	case f.Namespace != "" && info.Namespace != f.Namespace:
+		return false
+	case !strings.HasPrefix(info.DevboxName, f.NamePrefix):
+		return false
+	case f.RunningOnly && info.PodIP == "":
+		return false
+	case f.After != "" && key <= f.After:
+		return false
+	default:
+		return true
+	}
+}
+
+// List returns copies of the devboxes selected by filter, ordered by namespace
+// then name so large registries page stably. The copies share nothing with the
+// registry and leave out the private key of the devboxes.
+func (r *Registry) List(filter ListFilter) ListPage {
+	type entry struct {
+		key  string
+		info *DevboxInfo
+	}
+
+	var entries []entry
+
+	r.devboxToInfo.forEach(func(key string, info *DevboxInfo) {
+		if filter.matches(key, info) {
+			entries = append(entries, entry{key: key, info: info})
+		}
+	})
+
+	// namespace/name keys sort by namespace first, names and namespaces
+	// cannot contain a slash
+	slices.SortFunc(entries, func(a, b entry) int {
+		return strings.Compare(a.key, b.key)
+	})
+
+	var page ListPage
+	if filter.Limit > 0 && len(entries) > filter.Limit {
+		entries = entries[:filter.Limit]
+		page.Next = entries[len(entries)-1].key
+	}
+
+	page.Devboxes = make([]DevboxInfo, 0, len(entries))
+	for _, entry := range entries {
+		page.Devboxes = append(page.Devboxes, entry.info.redactedCopy())
+	}
+
+	return page
+}
+
+// Count returns the number of devboxes in the registry
+func (r *Registry) Count() int {
+	return r.devboxToInfo.len()
+}
+
+// redactedCopy returns a deep copy of info without its private key
+func (info *DevboxInfo) redactedCopy() DevboxInfo {
+	c := *info
+	c.PrivateKey = nil
+	c.PodIPs = slices.Clone(info.PodIPs)
+	c.Pods = slices.Clone(info.Pods)
+	c.Endpoints = slices.Clone(info.Endpoints)
+	c.AuthorizedKeys = slices.Clone(info.AuthorizedKeys)
+	c.BackendUsers = slices.Clone(info.BackendUsers)
+	c.AllowedCIDRs = slices.Clone(info.AllowedCIDRs)
+	c.PodLimits = info.PodLimits.DeepCopy()
+	c.Annotations = maps.Clone(info.Annotations)
+
+	if info.SFTPOnly != nil {
+		sftpOnly := *info.SFTPOnly
+		c.SFTPOnly = &sftpOnly
+	}
+
+	if info.MOTD != nil {
+		motd := *info.MOTD
+		c.MOTD = &motd
+	}
+
+	return c
+}
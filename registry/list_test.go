@@ -0,0 +1,259 @@
+package registry_test
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/zijiren233/sshgate/registry"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// newListTestPod returns the pod of a devbox, running when podIP is set
+func newListTestPod(namespace, devboxName, podIP string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      devboxName + "-pod",
+			Namespace: namespace,
+			Labels: map[string]string{
+				registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+			},
+			Annotations: map[string]string{
+				registry.BackendUsersAnnotation: "root,ubuntu",
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: registry.DevboxOwnerKind, Name: devboxName},
+			},
+		},
+		Status: corev1.PodStatus{PodIP: podIP},
+	}
+}
+
+func devboxKeys(devboxes []registry.DevboxInfo) []string {
+	keys := make([]string, 0, len(devboxes))
+	for _, info := range devboxes {
+		keys = append(keys, info.Namespace+"/"+info.DevboxName)
+	}
+
+	return keys
+}
+
+func TestList_Filters(t *testing.T) {
+	reg := registry.New()
+
+	for _, pod := range []*corev1.Pod{
+		newListTestPod("ns-b", "web", "10.0.0.3"),
+		newListTestPod("ns-a", "web-2", "10.0.0.2"),
+		newListTestPod("ns-a", "api", ""),
+		newListTestPod("ns-a", "web-1", "10.0.0.1"),
+	} {
+		if err := reg.UpdatePod(pod); err != nil {
+			t.Fatalf("UpdatePod failed: %v", err)
+		}
+	}
+
+	_, pubBytes, privBytes := generateTestKeyPair(t)
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web-1",
+			Namespace: "ns-a",
+			Labels: map[string]string{
+				registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: registry.DevboxOwnerKind, Name: "web-1"},
+			},
+		},
+		Data: map[string][]byte{
+			registry.DevboxPublicKeyField:  pubBytes,
+			registry.DevboxPrivateKeyField: privBytes,
+		},
+	}
+	if err := reg.AddSecret(nil, secret); err != nil {
+		t.Fatalf("AddSecret failed: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		filter registry.ListFilter
+		want   []string
+	}{
+		{
+			name: "all",
+			want: []string{"ns-a/api", "ns-a/web-1", "ns-a/web-2", "ns-b/web"},
+		},
+		{
+			name:   "namespace",
+			filter: registry.ListFilter{Namespace: "ns-b"},
+			want:   []string{"ns-b/web"},
+		},
+		{
+			name:   "name prefix",
+			filter: registry.ListFilter{NamePrefix: "web-"},
+			want:   []string{"ns-a/web-1", "ns-a/web-2"},
+		},
+		{
+			name:   "running only",
+			filter: registry.ListFilter{Namespace: "ns-a", RunningOnly: true},
+			want:   []string{"ns-a/web-1", "ns-a/web-2"},
+		},
+		{
+			name:   "unknown namespace",
+			filter: registry.ListFilter{Namespace: "ns-c"},
+			want:   []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page := reg.List(tt.filter)
+			if got := devboxKeys(page.Devboxes); !slices.Equal(got, tt.want) {
+				t.Errorf("List() = %v, want %v", got, tt.want)
+			}
+
+			if page.Next != "" {
+				t.Errorf("Next = %q on an unlimited listing", page.Next)
+			}
+		})
+	}
+
+	if count := reg.Count(); count != 4 {
+		t.Errorf("Count() = %d, want 4", count)
+	}
+
+	devboxes := reg.List(registry.ListFilter{Namespace: "ns-a", NamePrefix: "web-1"}).Devboxes
+	if len(devboxes) != 1 {
+		t.Fatalf("Got %d devboxes, want 1", len(devboxes))
+	}
+
+	listed := devboxes[0]
+	if listed.PublicKey == nil {
+		t.Error("PublicKey was left out")
+	}
+
+	if listed.PrivateKey != nil {
+		t.Error("PrivateKey was not redacted")
+	}
+
+	// Copies share nothing with the registry
+	listed.PodIPs[0] = "10.9.9.9"
+	listed.BackendUsers[0] = "mallory"
+
+	info, _ := reg.GetDevboxInfo("ns-a", "web-1")
+	if info.PodIPs[0] != "10.0.0.1" || info.BackendUsers[0] != "root" {
+		t.Errorf("Modifying a listed devbox modified the registry: %v %v",
+			info.PodIPs, info.BackendUsers)
+	}
+
+	if info.PrivateKey == nil {
+		t.Error("Listing redacted the private key of the registry")
+	}
+}
+
+func TestList_Pagination(t *testing.T) {
+	reg := registry.New()
+
+	var want []string
+
+	for i := range 25 {
+		namespace := fmt.Sprintf("ns-%d", i%3)
+		name := fmt.Sprintf("devbox-%02d", i)
+
+		if err := reg.UpdatePod(newListTestPod(namespace, name, "10.0.0.1")); err != nil {
+			t.Fatalf("UpdatePod failed: %v", err)
+		}
+
+		want = append(want, namespace+"/"+name)
+	}
+
+	slices.Sort(want)
+
+	var (
+		got   []string
+		pages int
+	)
+
+	filter := registry.ListFilter{Limit: 10}
+	for {
+		page := reg.List(filter)
+		got = append(got, devboxKeys(page.Devboxes)...)
+		pages++
+
+		if page.Next == "" {
+			break
+		}
+
+		filter.After = page.Next
+	}
+
+	if pages != 3 {
+		t.Errorf("Listed %d pages, want 3", pages)
+	}
+
+	if !slices.Equal(got, want) {
+		t.Errorf("Pages listed %v, want %v", got, want)
+	}
+}
+
+func TestList_ConcurrentMutation(t *testing.T) {
+	reg := registry.New()
+
+	pods := make([]*corev1.Pod, 0, 50)
+	for i := range 50 {
+		pods = append(pods, newListTestPod("ns-test", fmt.Sprintf("devbox-%02d", i), "10.0.0.1"))
+	}
+
+	var wg sync.WaitGroup
+
+	stop := make(chan struct{})
+
+	for i := range 4 {
+		wg.Go(func() {
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				pod := pods[(n*4+i)%len(pods)].DeepCopy()
+				if n%3 == 0 {
+					reg.DeletePod(pod)
+					continue
+				}
+
+				pod.Status.PodIP = fmt.Sprintf("10.0.%d.%d", i, n%250)
+				if err := reg.UpdatePod(pod); err != nil {
+					t.Errorf("UpdatePod failed: %v", err)
+					return
+				}
+			}
+		})
+	}
+
+	for range 200 {
+		page := reg.List(registry.ListFilter{Limit: 20})
+		if len(page.Devboxes) > 20 {
+			t.Fatalf("Listed %d devboxes over the limit", len(page.Devboxes))
+		}
+
+		if keys := devboxKeys(page.Devboxes); !slices.IsSorted(keys) {
+			t.Fatalf("Listing is not ordered: %v", keys)
+		}
+
+		for i := range page.Devboxes {
+			// Copies are safe to modify while the registry changes
+			page.Devboxes[i].PodIPs = append(page.Devboxes[i].PodIPs, "10.9.9.9")
+		}
+
+		if count := reg.Count(); count > len(pods) {
+			t.Fatalf("Count() = %d over the %d devboxes", count, len(pods))
+		}
+	}
+
+	close(stop)
+	wg.Wait()
+}
@@ -0,0 +1,159 @@
+package registry
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Operations counted by the sshgate_registry_operations_total metric
+const (
+	OperationAddSecret    = "add_secret"
+	OperationDeleteSecret = "delete_secret"
+	OperationUpdatePod    = "update_pod"
+	OperationDeletePod    = "delete_pod"
+	// EndpointSlices replace pods in EndpointSlice discovery
+	OperationUpdateEndpointSlice = "update_endpoint_slice"
+	OperationDeleteEndpointSlice = "delete_endpoint_slice"
+)
+
+// Parse failures counted by the sshgate_registry_parse_failures_total metric
+const (
+	ParseFailurePublicKey  = "public_key"
+	ParseFailurePrivateKey = "private_key"
+	ParseFailureOwner      = "owner"
+)
+
+// metrics instruments a registry. Labels never name devboxes, keeping the
+// number of series bounded.
+type metrics struct {
+	operations    *prometheus.CounterVec
+	parseFailures *prometheus.CounterVec
+	keyLookups    *prometheus.CounterVec
+	keyCollisions prometheus.Counter
+	collectors    []prometheus.Collector
+}
+
+func newMetrics(r *Registry) *metrics {
+	m := &metrics{
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sshgate_registry_operations_total",
+			Help: "Secret and pod changes applied to the registry, by operation.",
+		}, []string{"operation"}),
+		parseFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sshgate_registry_parse_failures_total",
+			Help: "Devbox secrets and pods the registry failed to parse, by what failed.",
+		}, []string{"kind"}),
+		keyLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sshgate_registry_key_lookups_total",
+			Help: "Lookups of devboxes by public key, by result (hit or miss).",
+		}, []string{"result"}),
+		keyCollisions: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "sshgate_registry_key_collisions_total",
+			Help: "Devbox secrets found holding the public key of another devbox.",
+		}),
+	}
+
+	// Counting when scraped never drifts from the registry
+	devboxes := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "sshgate_registry_devboxes",
+		Help: "Devboxes in the registry.",
+	}, func() float64 { return float64(r.Count()) })
+	running := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "sshgate_registry_devboxes_with_pod_ip",
+		Help: "Devboxes in the registry with a pod IP.",
+	}, func() float64 {
+		return float64(r.countDevboxes(func(info *DevboxInfo) bool { return info.PodIP != "" }))
+	})
+	privateKeys := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "sshgate_registry_private_keys",
+		Help: "Devboxes in the registry with their private key cached.",
+	}, func() float64 {
+		return float64(r.countDevboxes(func(info *DevboxInfo) bool {
+			return info.PrivateKey != nil
+		}))
+	})
+	collidingKeys := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "sshgate_registry_colliding_keys",
+		Help: "Public keys held by the secrets of several devboxes.",
+	}, func() float64 { return float64(r.collidingKeys()) })
+
+	// Every label value is exported from the start
+	for _, operation := range []string{
+		OperationAddSecret, OperationDeleteSecret, OperationUpdatePod, OperationDeletePod,
+		OperationUpdateEndpointSlice, OperationDeleteEndpointSlice,
+	} {
+		m.operations.WithLabelValues(operation)
+	}
+
+	for _, kind := range []string{
+		ParseFailurePublicKey, ParseFailurePrivateKey, ParseFailureOwner,
+	} {
+		m.parseFailures.WithLabelValues(kind)
+	}
+
+	m.keyLookups.WithLabelValues("hit")
+	m.keyLookups.WithLabelValues("miss")
+
+	m.collectors = []prometheus.Collector{
+		m.operations, m.parseFailures, m.keyLookups, m.keyCollisions,
+		devboxes, running, privateKeys, collidingKeys,
+	}
+
+	return m
+}
+
+// WithMetrics registers the metrics of the registry on registerer, they are
+// not exposed otherwise
+func WithMetrics(registerer prometheus.Registerer) Option {
+	return func(r *Registry) {
+		r.metricsRegisterer = registerer
+	}
+}
+
+// register registers the metrics on registerer, a nil registerer registers none
+func (m *metrics) register(registerer prometheus.Registerer) error {
+	if registerer == nil {
+		return nil
+	}
+
+	for _, collector := range m.collectors {
+		if err := registerer.Register(collector); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *metrics) operation(operation string) {
+	m.operations.WithLabelValues(operation).Inc()
+}
+
+func (m *metrics) parseFailure(kind string) {
+	m.parseFailures.WithLabelValues(kind).Inc()
+}
+
+func (m *metrics) keyLookup(hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+
+	m.keyLookups.WithLabelValues(result).Inc()
+}
+
+func (m *metrics) keyCollision() {
+	m.keyCollisions.Inc()
+}
+
+// countDevboxes returns the number of devboxes matching match
+func (r *Registry) countDevboxes(match func(*DevboxInfo) bool) int {
+	n := 0
+
+	r.devboxToInfo.forEach(func(_ string, info *DevboxInfo) {
+		if match(info) {
+			n++
+		}
+	})
+
+	return n
+}
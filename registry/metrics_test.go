@@ -0,0 +1,197 @@
+package registry_test
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/zijiren233/sshgate/registry"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// metricValue returns the value of the series of name gathered from gatherer
+// with the label set to value, or of its only series when label is empty
+func metricValue(t *testing.T, gatherer prometheus.Gatherer, name, label, value string) float64 {
+	t.Helper()
+
+	families, err := gatherer.Gather()
+	if err != nil {
+		t.Fatalf("Gather failed: %v", err)
+	}
+
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+
+		for _, metric := range family.GetMetric() {
+			matches := label == ""
+			for _, pair := range metric.GetLabel() {
+				if pair.GetName() == label && pair.GetValue() == value {
+					matches = true
+				}
+			}
+
+			if !matches {
+				continue
+			}
+
+			if counter := metric.GetCounter(); counter != nil {
+				return counter.GetValue()
+			}
+
+			return metric.GetGauge().GetValue()
+		}
+	}
+
+	t.Fatalf("No series %s{%s=%q}", name, label, value)
+
+	return 0
+}
+
+func TestMetrics(t *testing.T) {
+	promReg := prometheus.NewRegistry()
+	reg := registry.New(registry.WithMetrics(promReg))
+
+	operation := func(operation string) float64 {
+		return metricValue(t, promReg, "sshgate_registry_operations_total", "operation", operation)
+	}
+	parseFailure := func(kind string) float64 {
+		return metricValue(t, promReg, "sshgate_registry_parse_failures_total", "kind", kind)
+	}
+	keyLookup := func(result string) float64 {
+		return metricValue(t, promReg, "sshgate_registry_key_lookups_total", "result", result)
+	}
+	gauge := func(name string) float64 {
+		return metricValue(t, promReg, name, "", "")
+	}
+
+	// Every series is exported before anything happens
+	for _, name := range []string{
+		registry.OperationAddSecret, registry.OperationDeleteSecret,
+		registry.OperationUpdatePod, registry.OperationDeletePod,
+	} {
+		if v := operation(name); v != 0 {
+			t.Errorf("operations{operation=%q} = %v, want 0", name, v)
+		}
+	}
+
+	pubKey, pubBytes, privBytes := generateTestKeyPair(t)
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-secret",
+			Namespace: "ns-test",
+			Labels: map[string]string{
+				registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: registry.DevboxOwnerKind, Name: "test-devbox"},
+			},
+		},
+		Data: map[string][]byte{
+			registry.DevboxPublicKeyField:  pubBytes,
+			registry.DevboxPrivateKeyField: privBytes,
+		},
+	}
+
+	if err := reg.AddSecret(nil, secret); err != nil {
+		t.Fatalf("AddSecret failed: %v", err)
+	}
+
+	if v := operation(registry.OperationAddSecret); v != 1 {
+		t.Errorf("add_secret = %v, want 1", v)
+	}
+
+	if v := gauge("sshgate_registry_devboxes"); v != 1 {
+		t.Errorf("devboxes = %v, want 1", v)
+	}
+
+	if v := gauge("sshgate_registry_private_keys"); v != 1 {
+		t.Errorf("private_keys = %v, want 1", v)
+	}
+
+	if v := gauge("sshgate_registry_devboxes_with_pod_ip"); v != 0 {
+		t.Errorf("devboxes_with_pod_ip = %v, want 0", v)
+	}
+
+	pod := newListTestPod("ns-test", "test-devbox", "10.0.0.1")
+	if err := reg.UpdatePod(pod); err != nil {
+		t.Fatalf("UpdatePod failed: %v", err)
+	}
+
+	if v := operation(registry.OperationUpdatePod); v != 1 {
+		t.Errorf("update_pod = %v, want 1", v)
+	}
+
+	if v := gauge("sshgate_registry_devboxes_with_pod_ip"); v != 1 {
+		t.Errorf("devboxes_with_pod_ip = %v, want 1", v)
+	}
+
+	// Lookups
+	reg.GetByPublicKey(pubKey)
+
+	otherKey, _, _ := generateTestKeyPair(t)
+	reg.GetByPublicKey(otherKey)
+	reg.GetByPublicKey(otherKey)
+
+	if hits, misses := keyLookup("hit"), keyLookup("miss"); hits != 1 || misses != 2 {
+		t.Errorf("key lookups = %v hits and %v misses, want 1 and 2", hits, misses)
+	}
+
+	// Parse failures
+	badKey := secret.DeepCopy()
+	badKey.Name = "bad-key"
+	badKey.Data[registry.DevboxPublicKeyField] = []byte("not a key")
+
+	if err := reg.AddSecret(nil, badKey); err == nil {
+		t.Error("AddSecret of an invalid public key succeeded")
+	}
+
+	noOwner := secret.DeepCopy()
+	noOwner.Name = "no-owner"
+	noOwner.OwnerReferences = nil
+
+	if err := reg.AddSecret(nil, noOwner); err == nil {
+		t.Error("AddSecret without an owner succeeded")
+	}
+
+	badPrivateKey := secret.DeepCopy()
+	badPrivateKey.Data[registry.DevboxPrivateKeyField] = []byte("not a key")
+	badPrivateKey.ResourceVersion = "2"
+
+	if err := reg.AddSecret(secret, badPrivateKey); err != nil {
+		t.Fatalf("AddSecret failed: %v", err)
+	}
+
+	for kind, want := range map[string]float64{
+		registry.ParseFailurePublicKey:  1,
+		registry.ParseFailureOwner:      1,
+		registry.ParseFailurePrivateKey: 1,
+	} {
+		if v := parseFailure(kind); v != want {
+			t.Errorf("parse_failures{kind=%q} = %v, want %v", kind, v, want)
+		}
+	}
+
+	if v := operation(registry.OperationAddSecret); v != 4 {
+		t.Errorf("add_secret = %v, want 4", v)
+	}
+
+	// Deletions
+	reg.DeletePod(pod)
+
+	if v := operation(registry.OperationDeletePod); v != 1 {
+		t.Errorf("delete_pod = %v, want 1", v)
+	}
+
+	reg.DeleteSecret(badPrivateKey)
+
+	if v := operation(registry.OperationDeleteSecret); v != 1 {
+		t.Errorf("delete_secret = %v, want 1", v)
+	}
+
+	if v := gauge("sshgate_registry_devboxes"); v != 0 {
+		t.Errorf("devboxes = %v, want 0", v)
+	}
+}
@@ -0,0 +1,83 @@
+package registry
+
+import (
+	"encoding/base64"
+	"maps"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// OTPSecretKeyPrefix prefixes the keys of the OTP secret holding the TOTP
+	// secret of a public key, see OTPSecretKey
+	OTPSecretKeyPrefix = "key."
+	// OTPSecretNamespacePrefix prefixes the keys of the OTP secret holding the
+	// TOTP secret shared by the keys without their own in a namespace
+	OTPSecretNamespacePrefix = "namespace."
+)
+
+// WithOTPSecret sets the Kubernetes Secret holding the TOTP secrets of second
+// factor authentication. Its data is keyed by OTPSecretKey and OTPSecretNamespaceKey.
+func WithOTPSecret(namespace, name string) Option {
+	return func(r *Registry) {
+		r.otpSecretNamespace, r.otpSecretName = namespace, name
+	}
+}
+
+// OTPSecretKey returns the key of the TOTP secret of a public key in the OTP
+// secret, given its SHA256 fingerprint. Secret keys cannot hold the fingerprint
+// itself, its base64 part is written in the URL-safe alphabet.
+func OTPSecretKey(fingerprint string) string {
+	hash, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(fingerprint, "SHA256:"))
+	if err != nil {
+		return ""
+	}
+
+	return OTPSecretKeyPrefix + base64.RawURLEncoding.EncodeToString(hash)
+}
+
+// OTPSecretNamespaceKey returns the key of the TOTP secret of a namespace in the
+// OTP secret
+func OTPSecretNamespaceKey(namespace string) string {
+	return OTPSecretNamespacePrefix + namespace
+}
+
+// OTPSecret returns the TOTP secret of a public key, given its SHA256 fingerprint,
+// falling back to the one of the namespace
+func (r *Registry) OTPSecret(fingerprint, namespace string) ([]byte, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if key := OTPSecretKey(fingerprint); key != "" {
+		if secret, ok := r.otpSecrets[key]; ok {
+			return secret, true
+		}
+	}
+
+	secret, ok := r.otpSecrets[OTPSecretNamespaceKey(namespace)]
+
+	return secret, ok
+}
+
+// isOTPSecret reports whether secret is the configured OTP secret
+func (r *Registry) isOTPSecret(secret *corev1.Secret) bool {
+	return r.otpSecretName != "" &&
+		secret.Namespace == r.otpSecretNamespace &&
+		secret.Name == r.otpSecretName
+}
+
+// setOTPSecrets replaces the TOTP secrets, nil when the OTP secret is deleted
+func (r *Registry) setOTPSecrets(data map[string][]byte) {
+	r.logger.WithFields(log.Fields{
+		"namespace": r.otpSecretNamespace,
+		"name":      r.otpSecretName,
+		"entries":   len(data),
+	}).Info("Updating OTP secrets")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.otpSecrets = maps.Clone(data)
+}
@@ -0,0 +1,76 @@
+package registry_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestOTPSecretKey(t *testing.T) {
+	const fingerprint = "SHA256:+/8AAP/+AAD//wAA//8AAP//AAD//wAA//8AAP8"
+
+	key := registry.OTPSecretKey(fingerprint)
+
+	// Secret keys may only hold alphanumerics, '-', '_' and '.'
+	if strings.ContainsAny(key, "+/:") || !strings.HasPrefix(key, registry.OTPSecretKeyPrefix) {
+		t.Errorf("OTPSecretKey() = %q, want a valid secret key", key)
+	}
+
+	if got := registry.OTPSecretKey("not a fingerprint"); got != "" {
+		t.Errorf("OTPSecretKey() of an invalid fingerprint = %q, want empty", got)
+	}
+}
+
+func TestOTPSecret(t *testing.T) {
+	pubKey, _, _ := generateTestKeyPair(t)
+	fingerprint := ssh.FingerprintSHA256(pubKey)
+
+	r := registry.New(registry.WithOTPSecret("sshgate", "otp"))
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "otp", Namespace: "sshgate"},
+		Data: map[string][]byte{
+			registry.OTPSecretKey(fingerprint):          []byte("KEY"),
+			registry.OTPSecretNamespaceKey("ns-shared"): []byte("NAMESPACE"),
+		},
+	}
+	if err := r.AddSecret(nil, secret); err != nil {
+		t.Fatalf("AddSecret() failed: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		fingerprint string
+		namespace   string
+		want        string
+	}{
+		{name: "key secret", fingerprint: fingerprint, namespace: "ns-shared", want: "KEY"},
+		{
+			name:        "namespace secret",
+			fingerprint: "SHA256:other",
+			namespace:   "ns-shared",
+			want:        "NAMESPACE",
+		},
+		{name: "none", fingerprint: "SHA256:other", namespace: "ns-other"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := r.OTPSecret(tt.fingerprint, tt.namespace)
+			if string(got) != tt.want || ok != (tt.want != "") {
+				t.Errorf("OTPSecret() = %q, %v, want %q", got, ok, tt.want)
+			}
+		})
+	}
+
+	// Deleting the secret disables every TOTP secret
+	r.DeleteSecret(secret)
+
+	if _, ok := r.OTPSecret(fingerprint, "ns-shared"); ok {
+		t.Error("OTPSecret() found a secret after the OTP secret was deleted")
+	}
+}
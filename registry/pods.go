@@ -0,0 +1,165 @@
+package registry
+
+import (
+	"cmp"
+	"slices"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// DevboxPod is one of the pods of a devbox. A devbox briefly has several pods
+// while restarting, or when debug clones of its pod run.
+type DevboxPod struct {
+	Name string
+	UID  types.UID
+	// IP is the pod IP used to reach the pod, of the preferred family if any
+	IP string
+	// IPs are all the IPs of the pod
+	IPs     []string
+	Phase   corev1.PodPhase
+	Ready   bool
+	Created time.Time
+	// Terminating is set once the pod is being deleted. Its IP is ignored, as
+	// the pod is about to go away while its status still reports it.
+	Terminating bool
+	// Controlled is set when the devbox is the controller of the pod. Debug
+	// clones copy the labels and owner references of a pod, not its controller.
+	Controlled bool
+
+	// readyReported is set when the pod reports a Ready condition at all
+	readyReported bool
+	// pod is the pod object the settings of the devbox are read from when the
+	// pod is selected, informer objects are never modified
+	pod *corev1.Pod
+}
+
+// newDevboxPod returns the devbox pod of pod, reached at podIP unless it is
+// terminating, controlled by the devbox or not
+func newDevboxPod(pod *corev1.Pod, podIP string, podIPs []string, controlled bool) DevboxPod {
+	ready, reported := podReady(pod)
+	terminating := pod.DeletionTimestamp != nil
+
+	if terminating {
+		podIP, podIPs = "", nil
+	}
+
+	return DevboxPod{
+		Name:          pod.Name,
+		UID:           pod.UID,
+		IP:            podIP,
+		IPs:           podIPs,
+		Phase:         pod.Status.Phase,
+		Ready:         ready && !terminating,
+		Created:       pod.CreationTimestamp.Time,
+		Terminating:   terminating,
+		Controlled:    controlled,
+		readyReported: reported,
+		pod:           pod,
+	}
+}
+
+// State returns whether the pod is gone, not ready or ready, see
+// DevboxInfo.PodState. Terminating pods are gone.
+func (p *DevboxPod) State() PodState {
+	if p.Terminating {
+		return PodStateNone
+	}
+
+	return podState(p.Phase, p.IP, p.Ready, p.readyReported)
+}
+
+// is reports whether p is pod, by UID or by name when either has no UID
+func (p *DevboxPod) is(pod *corev1.Pod) bool {
+	if p.UID != "" && pod.UID != "" {
+		return p.UID == pod.UID
+	}
+
+	return p.Name == pod.Name
+}
+
+// podStateRanks orders pod states by preference for routing
+var podStateRanks = map[PodState]int{
+	PodStateReady:    2,
+	PodStateStarting: 1,
+	PodStateNone:     0,
+}
+
+// sortPods orders pods by preference for routing: ready pods first, then the
+// newest, then by name so that the selection does not depend on event order
+func sortPods(pods []DevboxPod) {
+	slices.SortFunc(pods, func(a, b DevboxPod) int {
+		return cmp.Or(
+			cmp.Compare(podStateRanks[b.State()], podStateRanks[a.State()]),
+			b.Created.Compare(a.Created),
+			cmp.Compare(a.Name, b.Name),
+			cmp.Compare(a.UID, b.UID),
+		)
+	})
+}
+
+// setPod replaces or adds the entry of pod among the pods of info, reselecting
+// the pod the devbox is reached at
+func (info *DevboxInfo) setPod(pod DevboxPod) {
+	if pod.Controlled {
+		info.controlledPods = true
+	}
+
+	pods := slices.DeleteFunc(slices.Clone(info.Pods), func(p DevboxPod) bool {
+		return p.is(pod.pod)
+	})
+	pods = append(pods, pod)
+	sortPods(pods)
+
+	info.Pods = pods
+}
+
+// selectable reports whether the devbox may be reached at pod: once a pod the
+// devbox controls was seen, the pods it does not control are debug clones and
+// never selected. Owner references marking no controller at all leave every
+// pod selectable.
+func (info *DevboxInfo) selectable(pod DevboxPod) bool {
+	return pod.Controlled || !info.controlledPods
+}
+
+// HasAddress reports whether ip is an address of one of the pods of the devbox
+// not being deleted, or of one of its endpoints
+func (info *DevboxInfo) HasAddress(ip string) bool {
+	for _, pod := range info.Pods {
+		if !pod.Terminating && (pod.IP == ip || slices.Contains(pod.IPs, ip)) {
+			return true
+		}
+	}
+
+	for _, endpoint := range info.Endpoints {
+		if slices.Contains(endpoint.Addresses, ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasPodVersion reports whether info has an entry of pod at its resource
+// version, as when the informer resyncs
+func (info *DevboxInfo) hasPodVersion(pod *corev1.Pod) bool {
+	return pod.ResourceVersion != "" && slices.ContainsFunc(info.Pods, func(p DevboxPod) bool {
+		return p.is(pod) && p.pod.ResourceVersion == pod.ResourceVersion
+	})
+}
+
+// removePod removes the entry of pod from the pods of info, reporting whether
+// it was found
+func (info *DevboxInfo) removePod(pod *corev1.Pod) bool {
+	pods := slices.DeleteFunc(slices.Clone(info.Pods), func(p DevboxPod) bool {
+		return p.is(pod)
+	})
+	if len(pods) == len(info.Pods) {
+		return false
+	}
+
+	info.Pods = pods
+
+	return true
+}
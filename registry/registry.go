@@ -3,8 +3,13 @@ package registry
 import (
 	"bytes"
 	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
 	corev1 "k8s.io/api/core/v1"
@@ -12,62 +17,512 @@ import (
 )
 
 const (
-	// DevboxPublicKeyField is the secret data field containing the public key
+	// DevboxPublicKeyField is the default secret data field containing the
+	// public key, see WithKeyFields
 	DevboxPublicKeyField = "SEALOS_DEVBOX_PUBLIC_KEY"
-	// DevboxPrivateKeyField is the secret data field containing the private key
+	// DevboxPrivateKeyField is the default secret data field containing the
+	// private key, see WithKeyFields
 	DevboxPrivateKeyField = "SEALOS_DEVBOX_PRIVATE_KEY"
-	// DevboxPartOfLabel is the label key for identifying devbox resources
+	// DevboxPartOfLabel is the default label key for identifying devbox
+	// resources, see WithSelectorLabel
 	DevboxPartOfLabel = "app.kubernetes.io/part-of"
-	// DevboxPartOfValue is the expected label value for devbox resources
+	// DevboxPartOfValue is the default expected label value for devbox resources
 	DevboxPartOfValue = "devbox"
-	// DevboxOwnerKind is the owner reference kind for devbox resources
+	// DevboxOwnerKind is the default owner reference kind for devbox resources,
+	// see WithOwnerKind
 	DevboxOwnerKind = "Devbox"
+	// BackendAddressingAnnotation is the pod annotation overriding the backend
+	// addressing mode of a devbox
+	BackendAddressingAnnotation = AnnotationPrefix + backendAddressingName
+	// BackendHostAnnotation is the pod annotation naming the DNS host, such as a
+	// service, of a devbox addressed by DNS
+	BackendHostAnnotation = AnnotationPrefix + backendHostName
+	// SessionRecordingAnnotation is the pod or secret annotation opting the
+	// interactive sessions of a devbox into recording when set to "true"
+	SessionRecordingAnnotation = AnnotationPrefix + sessionRecordingName
+	// ForceCommandAnnotation is the pod or secret annotation of a command run by
+	// every session of the devbox in place of the one requested by the client,
+	// like the ForceCommand of sshd
+	ForceCommandAnnotation = AnnotationPrefix + forceCommandName
+	// SFTPOnlyAnnotation is the pod or secret annotation restricting the sessions
+	// of the devbox to SFTP when "true", or lifting the gateway default when "false"
+	SFTPOnlyAnnotation = AnnotationPrefix + sftpOnlyName
+	// BackendUsersAnnotation is the pod or secret annotation restricting the
+	// users clients may log into the devbox as, a comma-separated list
+	BackendUsersAnnotation = AnnotationPrefix + backendUsersName
+	// BackendUserAnnotation is the pod or secret annotation naming the user
+	// clients log into the devbox as, whatever user they claim, overriding the
+	// default backend user of the gateway
+	BackendUserAnnotation = AnnotationPrefix + backendUserName
+	// MOTDAnnotation is the pod or secret annotation overriding the MOTD template
+	// of the gateway for the devbox, an empty value shows no MOTD
+	MOTDAnnotation = AnnotationPrefix + motdName
+	// AllowedCIDRsAnnotation is the pod or secret annotation restricting the
+	// client networks the devbox is reachable from, a comma-separated list of
+	// CIDRs
+	AllowedCIDRsAnnotation = AnnotationPrefix + allowedCIDRsName
+	// DesiredStateAnnotation is the secret annotation the devbox controller
+	// mirrors the state requested for the devbox into, Running or Stopped
+	DesiredStateAnnotation = "devbox.sealos.io/desired-state"
+	// DefaultBackendHostTemplate is the DNS name of devboxes addressed by DNS,
+	// {namespace} and {devbox} are substituted
+	DefaultBackendHostTemplate = "{devbox}.{namespace}.svc"
 )
 
-// DevboxInfo stores information about a devbox
+// BackendAddressing selects how the gateway addresses the SSH server of a devbox
+type BackendAddressing string
+
+const (
+	// BackendAddressingPodIP dials the pod IP
+	BackendAddressingPodIP BackendAddressing = "pod-ip"
+	// BackendAddressingDNS dials a DNS name, falling back to the pod IP
+	BackendAddressingDNS BackendAddressing = "dns"
+)
+
+// ParseBackendAddressing parses a backend addressing mode
+func ParseBackendAddressing(s string) (BackendAddressing, error) {
+	switch mode := BackendAddressing(s); mode {
+	case BackendAddressingPodIP, BackendAddressingDNS:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid backend addressing %q, must be pod-ip or dns", s)
+	}
+}
+
+// IPFamily selects the address family of the pod IP used to reach a devbox
+type IPFamily string
+
+const (
+	// IPFamilyAny uses the primary pod IP, whatever its family
+	IPFamilyAny IPFamily = ""
+	// IPFamilyIPv4 prefers an IPv4 pod IP
+	IPFamilyIPv4 IPFamily = "ipv4"
+	// IPFamilyIPv6 prefers an IPv6 pod IP
+	IPFamilyIPv6 IPFamily = "ipv6"
+)
+
+// ParseIPFamily parses an IP family, the empty string means any family
+func ParseIPFamily(s string) (IPFamily, error) {
+	switch family := IPFamily(s); family {
+	case IPFamilyAny, IPFamilyIPv4, IPFamilyIPv6:
+		return family, nil
+	default:
+		return "", fmt.Errorf("invalid IP family %q, must be ipv4 or ipv6", s)
+	}
+}
+
+// DevboxInfo stores information about a devbox. The registry hands out
+// snapshots, replaced on every change, that must not be modified.
 type DevboxInfo struct {
 	Namespace  string
 	DevboxName string
-	PodIP      string
+	// Cluster is the name of the member cluster running the devbox, empty for
+	// the cluster of the gateway, see WithCluster
+	Cluster string
+	// PodIP is the pod IP used to reach the devbox, of the preferred family if any
+	PodIP string
+	// PodIPs are all the IPs of the pod, more than one in dual-stack clusters
+	PodIPs     []string
 	PublicKey  ssh.PublicKey
 	PrivateKey ssh.Signer
+	// AuthorizedKeys are the keys added by users besides PublicKey, they reach
+	// the devbox like it
+	AuthorizedKeys []AuthorizedKey
+	// Addressing is how the gateway addresses the backend, empty means by pod IP
+	Addressing BackendAddressing
+	// BackendHost is the DNS name of the backend when addressed by DNS
+	BackendHost string
+	// RecordSessions is set when the devbox opts its interactive sessions into recording
+	RecordSessions bool
+	// Health is the probed reachability of the backend, read it with BackendHealth
+	Health BackendHealth
+	// DevboxRef references the Devbox object owning the secret, Kubernetes
+	// events about the devbox are recorded on it
+	DevboxRef corev1.ObjectReference
+	// ForceCommand is run by every session in place of the requested one, if set
+	ForceCommand string
+	// SFTPOnly overrides the SFTP only default of the gateway when not nil
+	SFTPOnly *bool
+	// BackendUsers are the users clients may log into the devbox as, any user
+	// when empty
+	BackendUsers []string
+	// BackendUser is the user clients log into the devbox as, unless a backend
+	// user map rule of the gateway applies. Empty uses the gateway default.
+	BackendUser string
+	// MOTD overrides the MOTD template of the gateway when not nil
+	MOTD *string
+	// Pods are the current pods of the devbox, the pod it is reached at first.
+	// PodName, PodIP and the other pod fields describe that pod.
+	Pods []DevboxPod
+	// PodName is the name of the pod of the devbox, metrics are looked up by it
+	PodName string
+	// PodPhase is the phase of the pod of the devbox
+	PodPhase corev1.PodPhase
+	// PodReady is set when the pod reports its Ready condition true
+	PodReady bool
+	// PodLimits are the resource limits of the containers of the pod, summed
+	PodLimits corev1.ResourceList
+	// AllowedCIDRs are the client networks the devbox is reachable from, any
+	// network when empty
+	AllowedCIDRs []netip.Prefix
+	// AllowedCIDRsInvalid is set when the allowed CIDRs annotation does not
+	// parse, the gateway then refuses or accepts every client per its configuration
+	AllowedCIDRsInvalid bool
+	// Annotations are the AnnotationPrefix annotations of the pod and the
+	// secret, without the prefix, the pod ones taking precedence. Read them
+	// with Annotation and its typed variants.
+	Annotations map[string]string
+	// SecretUpdatedAt and PodUpdatedAt are when the registry last applied a
+	// change of the secret and of the pods of the devbox, resyncs aside
+	SecretUpdatedAt time.Time
+	PodUpdatedAt    time.Time
+	// DesiredState is the state requested for the devbox, telling a devbox
+	// stopped on purpose from one whose pod is missing
+	DesiredState DesiredState
+	// DisplayName is the name users know the devbox by, from its Devbox
+	// custom resource
+	DisplayName string
+	// SSHPort overrides the backend SSH port of the gateway when not zero
+	SSHPort int
+	// Endpoints are the ready endpoints of the devbox in EndpointSlice
+	// discovery, where it has no pods. PodIP, PodName and BackendPort describe
+	// the endpoint it is reached at.
+	Endpoints []DevboxEndpoint
+	// BackendPort is the target port of the endpoint the devbox is reached at,
+	// it overrides SSHPort when not zero
+	BackendPort int
+
+	// devbox is the Devbox custom resource of the devbox, nil when unknown
+	devbox *Devbox
+	// secretDesiredState is the desired state annotated on the secret
+	secretDesiredState DesiredState
+	// secretVersion is the resource version of the secret last applied
+	secretVersion string
+	// endpointSlices are the resource versions of the EndpointSlices of the
+	// devbox by name, slices without ready endpoints included
+	endpointSlices map[string]string
+	// AnnotationPrefix annotations of the pod and of the secret
+	podAnnotations    map[string]string
+	secretAnnotations map[string]string
+	// marshaledPublicKey is PublicKey in wire format, compared by lookups
+	marshaledPublicKey string
+	// staleSecret and stalePod are set on devboxes loaded from a snapshot until
+	// the informers report their secret and pod
+	staleSecret bool
+	stalePod    bool
+	// podReadyReported is set when the pod reports a Ready condition at all
+	podReadyReported bool
+	// controlledPods is set once a pod the devbox controls was seen, see
+	// selectable
+	controlledPods bool
+}
+
+// PodState is the state of the pod of a devbox, see DevboxInfo.PodState
+type PodState string
+
+const (
+	// PodStateNone means the devbox has no pod, or its pod terminated
+	PodStateNone PodState = "none"
+	// PodStateStarting means the pod of the devbox is not ready yet, or no
+	// longer ready
+	PodStateStarting PodState = "starting"
+	// PodStateReady means the pod of the devbox is running and ready
+	PodStateReady PodState = "ready"
+)
+
+// PodState returns whether the devbox has no pod, a pod that is not ready or a
+// ready pod. Pods without IP are not running unless pending, pods with an IP
+// reporting no Ready condition are taken as ready.
+func (info *DevboxInfo) PodState() PodState {
+	return podState(info.PodPhase, info.PodIP, info.PodReady, info.podReadyReported)
+}
+
+// podState returns the state of a pod in phase reached at podIP, readyReported
+// when it reports a Ready condition
+func podState(phase corev1.PodPhase, podIP string, ready, readyReported bool) PodState {
+	switch {
+	case phase == corev1.PodSucceeded || phase == corev1.PodFailed:
+		return PodStateNone
+	case phase == corev1.PodPending:
+		return PodStateStarting
+	case podIP == "":
+		return PodStateNone
+	case readyReported && !ready:
+		return PodStateStarting
+	default:
+		return PodStateReady
+	}
+}
+
+// podReady returns whether pod reports its Ready condition true, and whether it
+// reports a Ready condition at all
+func podReady(pod *corev1.Pod) (ready, reported bool) {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue, true
+		}
+	}
+
+	return false, false
+}
+
+// clone returns a copy of info to modify and store in place of it, as the
+// DevboxInfo handed out by the registry are never modified. Fields are replaced
+// rather than modified in place, so the copy may share their contents.
+func (info *DevboxInfo) clone() *DevboxInfo {
+	c := *info
+	return &c
+}
+
+// BackendHealth is the reachability of the SSH server of a devbox, as probed by
+// the gateway. The zero value means the backend was never probed.
+type BackendHealth struct {
+	// Unreachable is set once enough consecutive probes failed
+	Unreachable bool
+	// UnreachableSince is the time of the first of the consecutive failed probes
+	UnreachableSince time.Time
+	// LastSuccess is the time of the last successful probe
+	LastSuccess time.Time
+	// ConsecutiveFailures counts the failed probes since the last success
+	ConsecutiveFailures int
+	// LastError is the error of the last failed probe
+	LastError string
+}
+
+// EventType identifies a kind of registry change
+type EventType int
+
+const (
+	// EventPodIPChanged is emitted when the pod IP of a devbox changes
+	EventPodIPChanged EventType = iota + 1
+	// EventPodDeleted is emitted when the pod of a devbox is deleted
+	EventPodDeleted
+	// EventSecretDeleted is emitted when the secret of a devbox is deleted
+	EventSecretDeleted
+	// EventPublicKeyChanged is emitted when the public key of a devbox is replaced
+	EventPublicKeyChanged
+	// EventKeysRevoked is emitted when key fingerprints are added to the
+	// revocation list, it concerns no devbox in particular
+	EventKeysRevoked
+	// EventSecretAdded is emitted when the secret of a devbox is added
+	EventSecretAdded
+	// EventSecretUpdated is emitted when the secret of a devbox is updated
+	EventSecretUpdated
+)
+
+// Event describes a change of a devbox in the registry
+type Event struct {
+	Type       EventType
+	Namespace  string
+	DevboxName string
+	// Cluster is the cluster of the registry, see DevboxInfo.Cluster
+	Cluster string
+	// PodIP is the pod IP after the change
+	PodIP string
+	// Fingerprints are the SHA256 fingerprints of the keys newly revoked
+	Fingerprints []string
+	// Info is a snapshot of the devbox after the change, without its private
+	// key. It is nil once the devbox left the registry.
+	Info *DevboxInfo
 }
 
 // Registry manages the mapping between SSH public keys and devbox pods
 type Registry struct {
-	mu sync.RWMutex
+	// devboxMu serializes the changes of devboxes, keeping the maps below
+	// consistent with each other. Lookups only lock the shards they read, they
+	// never wait for the changes of other devboxes.
+	devboxMu sync.Mutex
 	// publicKey (string) -> namespace/devboxName
-	publicKeyToNamespaceDevbox map[string]string
+	publicKeyToNamespaceDevbox *shardedMap[string]
+	// publicKey (string) -> namespace/devboxName of every devbox holding it,
+	// sorted, for the keys held by several devboxes. Guarded by devboxMu.
+	keyOwners map[string][]string
+	// user added publicKey (string) -> namespace/devboxName -> struct{}, a key
+	// may be added to several devboxes. Sets are replaced, never modified.
+	authorizedKeyToDevboxes *shardedMap[map[string]struct{}]
 	// namespace/devboxName -> DevboxInfo
-	devboxToInfo map[string]*DevboxInfo
-	logger       *log.Entry
+	devboxToInfo *shardedMap[*DevboxInfo]
+	// mu guards the OTP secrets and the revoked fingerprints
+	mu sync.RWMutex
+	// skipPrivateKeys disables parsing and caching of devbox private keys
+	skipPrivateKeys bool
+	// publicKeyFields and privateKeyFields are the secret data fields holding
+	// the keys of devboxes, tried in order
+	publicKeyFields  []string
+	privateKeyFields []string
+	// selectorLabel and selectorValue label the secrets and pods of devboxes
+	selectorLabel string
+	selectorValue string
+	// ownerKind is the kind of the owner reference naming the devbox
+	ownerKind string
+	// addressing and hostTemplate address backends unless a pod annotation overrides them
+	addressing   BackendAddressing
+	hostTemplate string
+	// ipFamily is the preferred family of the pod IP of dual-stack pods
+	ipFamily IPFamily
+	// cluster names the member cluster the devboxes are watched in, empty for
+	// the cluster of the gateway
+	cluster string
+	// otpSecretNamespace and otpSecretName name the secret holding TOTP secrets
+	otpSecretNamespace string
+	otpSecretName      string
+	// OTP secret key -> TOTP secret
+	otpSecrets map[string][]byte
+	// revocationNamespace and revocationName name the ConfigMap listing revoked
+	// key fingerprints
+	revocationNamespace string
+	revocationName      string
+	// SHA256 fingerprint -> struct{}
+	revokedFingerprints map[string]struct{}
+	// revocationStale is set while the revoked fingerprints come from a snapshot
+	revocationStale   bool
+	logger            *log.Entry
+	metrics           *metrics
+	metricsRegisterer prometheus.Registerer
+
+	subMu       sync.Mutex
+	nextSubID   int
+	subscribers map[int]func(Event)
+}
+
+// Option configures the registry
+type Option func(*Registry)
+
+// WithSkipPrivateKeys sets whether devbox private keys are ignored.
+// When enabled, the private key fields are never parsed or kept in memory.
+func WithSkipPrivateKeys(skip bool) Option {
+	return func(r *Registry) {
+		r.skipPrivateKeys = skip
+	}
+}
+
+// WithBackendAddressing sets how backends are addressed by default, and the
+// template of their DNS name when addressed by DNS, an empty template keeps
+// DefaultBackendHostTemplate
+func WithBackendAddressing(addressing BackendAddressing, hostTemplate string) Option {
+	return func(r *Registry) {
+		r.addressing = addressing
+
+		if hostTemplate != "" {
+			r.hostTemplate = hostTemplate
+		}
+	}
+}
+
+// WithIPFamily sets the preferred family of the pod IP used to reach devboxes
+// with both IPv4 and IPv6 pod IPs. Pods without an IP of that family are
+// reached by their primary pod IP.
+func WithIPFamily(family IPFamily) Option {
+	return func(r *Registry) {
+		r.ipFamily = family
+	}
+}
+
+// WithCluster names the member cluster the registry holds the devboxes of,
+// their DevboxInfo and events carry it. The default, empty, is the cluster the
+// gateway runs in, see Federation.
+func WithCluster(name string) Option {
+	return func(r *Registry) {
+		r.cluster = name
+	}
 }
 
 // New creates a new Registry instance
-func New() *Registry {
-	return &Registry{
-		publicKeyToNamespaceDevbox: make(map[string]string),
-		devboxToInfo:               make(map[string]*DevboxInfo),
+func New(opts ...Option) *Registry {
+	r := &Registry{
+		publicKeyToNamespaceDevbox: newShardedMap[string](),
+		keyOwners:                  make(map[string][]string),
+		authorizedKeyToDevboxes:    newShardedMap[map[string]struct{}](),
+		devboxToInfo:               newShardedMap[*DevboxInfo](),
 		logger:                     log.WithField("component", "registry"),
+		subscribers:                make(map[int]func(Event)),
+		addressing:                 BackendAddressingPodIP,
+		hostTemplate:               DefaultBackendHostTemplate,
+		publicKeyFields:            []string{DevboxPublicKeyField},
+		privateKeyFields:           []string{DevboxPrivateKeyField},
+		selectorLabel:              DevboxPartOfLabel,
+		selectorValue:              DevboxPartOfValue,
+		ownerKind:                  DevboxOwnerKind,
+	}
+
+	// Apply options
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	if r.cluster != "" {
+		r.logger = r.logger.WithField("cluster", r.cluster)
+	}
+
+	r.metrics = newMetrics(r)
+	if err := r.metrics.register(r.metricsRegisterer); err != nil {
+		r.logger.WithError(err).Warn("Failed to register registry metrics")
+	}
+
+	return r
+}
+
+// Subscribe registers fn to be called after every devbox change and returns a
+// function removing the subscription. fn is called without the registry lock held
+// from the goroutine applying the change, so it must not block, slow consumers
+// use Watch.
+func (r *Registry) Subscribe(fn func(Event)) (unsubscribe func()) {
+	r.subMu.Lock()
+	defer r.subMu.Unlock()
+
+	id := r.nextSubID
+	r.nextSubID++
+	r.subscribers[id] = fn
+
+	return func() {
+		r.subMu.Lock()
+		defer r.subMu.Unlock()
+
+		delete(r.subscribers, id)
+	}
+}
+
+// notify delivers event to all subscribers, it must be called without r.mu held
+func (r *Registry) notify(event Event) {
+	event.Cluster = r.cluster
+
+	r.subMu.Lock()
+	subscribers := make([]func(Event), 0, len(r.subscribers))
+	for _, fn := range r.subscribers {
+		subscribers = append(subscribers, fn)
+	}
+	r.subMu.Unlock()
+
+	for _, fn := range subscribers {
+		fn(event)
 	}
 }
 
 // AddSecret processes a Secret and adds it to the registry.
 // If old is provided, it will clean up stale data from the old secret.
 func (r *Registry) AddSecret(oldSecret, newSecret *corev1.Secret) error {
+	if r.isOTPSecret(newSecret) {
+		r.setOTPSecrets(newSecret.Data)
+		return nil
+	}
+
 	// Check if this is a devbox secret
-	if newSecret.Labels[DevboxPartOfLabel] != DevboxPartOfValue {
+	if !r.isDevboxObject(newSecret.Labels) {
 		return nil
 	}
 
+	r.metrics.operation(OperationAddSecret)
+
 	// Get public key from secret
-	publicKeyData, ok := newSecret.Data[DevboxPublicKeyField]
+	publicKeyData, ok := secretField(newSecret, r.publicKeyFields)
 	if !ok {
+		r.metrics.parseFailure(ParseFailurePublicKey)
+
 		return fmt.Errorf(
 			"secret %s/%s missing %s",
 			newSecret.Namespace,
 			newSecret.Name,
-			DevboxPublicKeyField,
+			strings.Join(r.publicKeyFields, " or "),
 		)
 	}
 
@@ -77,20 +532,23 @@ func (r *Registry) AddSecret(oldSecret, newSecret *corev1.Secret) error {
 	// Parse public key
 	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(firstLine)
 	if err != nil {
+		r.metrics.parseFailure(ParseFailurePublicKey)
 		return fmt.Errorf("failed to parse public key: %w", err)
 	}
 
 	// Get devbox name from ownerReferences
-	devboxName := getDevboxNameFromOwnerReferences(newSecret.OwnerReferences)
+	devboxName := r.devboxName(newSecret.OwnerReferences)
 	if devboxName == "" {
+		r.metrics.parseFailure(ParseFailureOwner)
 		return fmt.Errorf("secret %s/%s has no Devbox owner", newSecret.Namespace, newSecret.Name)
 	}
 
 	// Parse private key if available
 	var privateKey ssh.Signer
-	if privateKeyData, ok := newSecret.Data[DevboxPrivateKeyField]; ok {
+	if privateKeyData, ok := secretField(newSecret, r.privateKeyFields); ok && !r.skipPrivateKeys {
 		privateKey, err = ssh.ParsePrivateKey(privateKeyData)
 		if err != nil {
+			r.metrics.parseFailure(ParseFailurePrivateKey)
 			r.logger.WithFields(log.Fields{
 				"namespace": newSecret.Namespace,
 				"devbox":    devboxName,
@@ -101,161 +559,562 @@ func (r *Registry) AddSecret(oldSecret, newSecret *corev1.Secret) error {
 	devboxKey := fmt.Sprintf("%s/%s", newSecret.Namespace, devboxName)
 	pubKeyStr := string(publicKey.Marshal())
 
-	r.logger.WithFields(log.Fields{
+	secretLogger := r.logger.WithFields(log.Fields{
 		"namespace": newSecret.Namespace,
 		"devbox":    devboxName,
-	}).Info("Adding secret")
+	})
+
+	authorizedKeys := parseAuthorizedKeys(newSecret.Data[DevboxAuthorizedKeysField], secretLogger)
 
-	r.mu.Lock()
-	defer r.mu.Unlock()
+	secretLogger.WithField("authorized_keys", len(authorizedKeys)).Info("Adding secret")
+
+	r.devboxMu.Lock()
 
 	// Clean up old public key mapping if old secret provided
 	if oldSecret != nil {
-		if oldKeyData, ok := oldSecret.Data[DevboxPublicKeyField]; ok {
+		if oldKeyData, ok := secretField(oldSecret, r.publicKeyFields); ok {
 			oldFirstLine := bytes.SplitN(oldKeyData, []byte("\n"), 2)[0]
 			if oldPubKey, _, _, _, err := ssh.ParseAuthorizedKey(oldFirstLine); err == nil {
 				oldPubKeyStr := string(oldPubKey.Marshal())
 				if oldPubKeyStr != pubKeyStr {
-					delete(r.publicKeyToNamespaceDevbox, oldPubKeyStr)
+					r.releasePublicKey(oldPubKeyStr, devboxKey)
 				}
 			}
 		}
 	}
 
-	info, exists := r.devboxToInfo[devboxKey]
-	if !exists {
+	info, exists := r.devboxToInfo.get(devboxKey)
+	if exists {
+		info = info.clone()
+	} else {
 		info = &DevboxInfo{
 			Namespace:  newSecret.Namespace,
 			DevboxName: devboxName,
+			Cluster:    r.cluster,
 		}
-		r.devboxToInfo[devboxKey] = info
 	}
 
-	info.PublicKey = publicKey
+	// Devboxes are known from their pod before their secret is added
+	eventType := EventSecretUpdated
+	if info.PublicKey == nil {
+		eventType = EventSecretAdded
+	}
+
+	// Periodic resyncs of the informer leave the secret unchanged
+	resync := oldSecret != nil && oldSecret.ResourceVersion != "" &&
+		oldSecret.ResourceVersion == newSecret.ResourceVersion
+
+	// The replaced key must stop authenticating even without the old secret at hand
+	keyChanged := info.PublicKey != nil && string(info.PublicKey.Marshal()) != pubKeyStr
+	if keyChanged {
+		r.releasePublicKey(info.marshaledPublicKey, devboxKey)
+
+		secretLogger.WithFields(log.Fields{
+			"old_fingerprint": ssh.FingerprintSHA256(info.PublicKey),
+			"fingerprint":     ssh.FingerprintSHA256(publicKey),
+		}).Info("Rotating devbox key")
+	}
+
+	info.PublicKey, info.marshaledPublicKey = publicKey, pubKeyStr
 	info.PrivateKey = privateKey
-	r.publicKeyToNamespaceDevbox[pubKeyStr] = devboxKey
+
+	if !resync {
+		info.SecretUpdatedAt = time.Now()
+	}
+
+	info.staleSecret = false
+	info.secretVersion = newSecret.ResourceVersion
+	r.setAuthorizedKeys(info, devboxKey, authorizedKeys)
+	info.DevboxRef = r.devboxObjectReference(newSecret.Namespace, newSecret.OwnerReferences)
+	info.setAnnotations(info.podAnnotations, collectAnnotations(newSecret.Annotations))
+	r.applyAnnotations(info)
+	info.secretDesiredState = ParseDesiredState(newSecret.Annotations[DesiredStateAnnotation])
+	info.setDesiredState()
+	r.devboxToInfo.set(devboxKey, info)
+	r.claimPublicKey(publicKey, pubKeyStr, devboxKey, secretLogger)
+	snapshot := info.redactedCopy()
+
+	r.devboxMu.Unlock()
+
+	if keyChanged {
+		r.notify(Event{
+			Type:       EventPublicKeyChanged,
+			Namespace:  newSecret.Namespace,
+			DevboxName: devboxName,
+			Info:       &snapshot,
+		})
+	}
+
+	if !resync {
+		r.notify(Event{
+			Type:       eventType,
+			Namespace:  newSecret.Namespace,
+			DevboxName: devboxName,
+			Info:       &snapshot,
+		})
+	}
 
 	return nil
 }
 
 // DeleteSecret removes a Secret from the registry
 func (r *Registry) DeleteSecret(secret *corev1.Secret) {
-	devboxName := getDevboxNameFromOwnerReferences(secret.OwnerReferences)
+	if r.isOTPSecret(secret) {
+		r.setOTPSecrets(nil)
+		return
+	}
+
+	devboxName := r.devboxName(secret.OwnerReferences)
 	if devboxName == "" {
 		return
 	}
 
+	r.metrics.operation(OperationDeleteSecret)
+
 	key := fmt.Sprintf("%s/%s", secret.Namespace, devboxName)
 	r.logger.WithFields(log.Fields{
 		"namespace": secret.Namespace,
 		"devbox":    devboxName,
 	}).Info("Removing secret")
 
-	r.mu.Lock()
-	defer r.mu.Unlock()
+	r.devboxMu.Lock()
 
-	if info, ok := r.devboxToInfo[key]; ok {
-		if info.PublicKey != nil {
-			delete(r.publicKeyToNamespaceDevbox, string(info.PublicKey.Marshal()))
-		}
+	info, ok := r.devboxToInfo.get(key)
+	// A secret replaced by one with another key may be deleted after the
+	// replacement was added, it must not take the new key with it
+	if ok && info.PublicKey != nil && !r.holdsPublicKey(secret, info.PublicKey) {
+		r.devboxMu.Unlock()
+		r.logger.WithFields(log.Fields{
+			"namespace": secret.Namespace,
+			"devbox":    devboxName,
+		}).Info("Ignoring deletion of a replaced secret")
+
+		return
+	}
+
+	if ok {
+		r.deleteDevboxLocked(key, info)
+	}
+
+	r.devboxMu.Unlock()
+
+	if ok {
+		r.notify(Event{
+			Type:       EventSecretDeleted,
+			Namespace:  secret.Namespace,
+			DevboxName: devboxName,
+		})
+	}
+}
 
-		delete(r.devboxToInfo, key)
+// deleteDevboxLocked removes the devbox of key and the keys it holds, with
+// r.devboxMu held
+func (r *Registry) deleteDevboxLocked(key string, info *DevboxInfo) {
+	if info.PublicKey != nil {
+		r.releasePublicKey(info.marshaledPublicKey, key)
 	}
+
+	r.setAuthorizedKeys(info.clone(), key, nil)
+	r.devboxToInfo.delete(key)
+}
+
+// holdsPublicKey reports whether secret holds key as the public key of its devbox,
+// a secret without a parsable public key is taken to hold it
+func (r *Registry) holdsPublicKey(secret *corev1.Secret, key ssh.PublicKey) bool {
+	publicKeyData, ok := secretField(secret, r.publicKeyFields)
+	if !ok {
+		return true
+	}
+
+	firstLine := bytes.SplitN(publicKeyData, []byte("\n"), 2)[0]
+
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(firstLine)
+	if err != nil {
+		return true
+	}
+
+	return bytes.Equal(publicKey.Marshal(), key.Marshal())
 }
 
 // UpdatePod updates the pod IP for a devbox.
 func (r *Registry) UpdatePod(pod *corev1.Pod) error {
 	// Check if this is a devbox pod
-	if pod.Labels[DevboxPartOfLabel] != DevboxPartOfValue {
+	if !r.isDevboxObject(pod.Labels) {
 		return nil
 	}
 
+	r.metrics.operation(OperationUpdatePod)
+
 	// Get devbox name from ownerReferences
-	devboxName := getDevboxNameFromOwnerReferences(pod.OwnerReferences)
+	devboxName := r.devboxName(pod.OwnerReferences)
 	if devboxName == "" {
+		r.metrics.parseFailure(ParseFailureOwner)
 		return fmt.Errorf("pod %s/%s has no Devbox owner", pod.Namespace, pod.Name)
 	}
 
 	key := fmt.Sprintf("%s/%s", pod.Namespace, devboxName)
+	podIP, podIPs := r.podIPs(pod)
 
 	r.logger.WithFields(log.Fields{
-		"namespace": pod.Namespace,
-		"devbox":    devboxName,
-		"pod_ip":    pod.Status.PodIP,
+		"namespace":   pod.Namespace,
+		"devbox":      devboxName,
+		"pod":         pod.Name,
+		"pod_ip":      podIP,
+		"pod_phase":   pod.Status.Phase,
+		"terminating": pod.DeletionTimestamp != nil,
 	}).Info("Updating pod IP")
 
-	r.mu.Lock()
-	defer r.mu.Unlock()
+	r.devboxMu.Lock()
 
-	info, exists := r.devboxToInfo[key]
-	if !exists {
+	info, exists := r.devboxToInfo.get(key)
+	if exists {
+		info = info.clone()
+	} else {
 		info = &DevboxInfo{
 			Namespace:  pod.Namespace,
 			DevboxName: devboxName,
+			Cluster:    r.cluster,
 		}
-		r.devboxToInfo[key] = info
 	}
 
-	// Update PodIP even if empty (pod may be restarting)
-	info.PodIP = pod.Status.PodIP
+	previousIP := info.PodIP
+	info.stalePod = false
+
+	if !info.hasPodVersion(pod) {
+		info.PodUpdatedAt = time.Now()
+	}
+
+	owner, _ := r.devboxOwner(pod.OwnerReferences)
+	controlled := owner.Controller != nil && *owner.Controller
+
+	info.setPod(newDevboxPod(pod, podIP, podIPs, controlled))
+	r.selectPod(info)
+	r.devboxToInfo.set(key, info)
+	snapshot := info.redactedCopy()
+
+	r.devboxMu.Unlock()
+
+	if info.PodIP != previousIP {
+		r.notify(Event{
+			Type:       EventPodIPChanged,
+			Namespace:  pod.Namespace,
+			DevboxName: devboxName,
+			PodIP:      snapshot.PodIP,
+			Info:       &snapshot,
+		})
+	}
 
 	return nil
 }
 
+// selectPod sets the pod fields of info from its preferred pod, debug clones
+// aside, or from its preferred endpoint when it has no pods
+func (r *Registry) selectPod(info *DevboxInfo) {
+	if len(info.Pods) == 0 && len(info.Endpoints) > 0 {
+		r.selectEndpoint(info)
+		return
+	}
+
+	info.BackendPort = 0
+
+	i := slices.IndexFunc(info.Pods, info.selectable)
+	if i < 0 {
+		info.PodIP, info.PodIPs, info.PodName = "", nil, ""
+		info.PodPhase, info.PodReady, info.podReadyReported = "", false, false
+
+		return
+	}
+
+	selected := info.Pods[i]
+	pod := selected.pod
+
+	// Probes of the previous pod say nothing about the new one
+	if info.PodIP != selected.IP {
+		info.Health = BackendHealth{}
+	}
+
+	// Update PodIP even if empty (pod may be restarting)
+	info.PodIP = selected.IP
+	info.PodIPs = selected.IPs
+	info.setAnnotations(collectAnnotations(pod.Annotations), info.secretAnnotations)
+	info.Addressing, info.BackendHost = r.backendAddressing(info)
+	r.applyAnnotations(info)
+	info.PodName = selected.Name
+	info.PodPhase = selected.Phase
+	info.PodReady, info.podReadyReported = selected.Ready, selected.readyReported
+	info.PodLimits = podLimits(pod)
+}
+
 // DeletePod removes a pod from the registry
 func (r *Registry) DeletePod(pod *corev1.Pod) {
-	devboxName := getDevboxNameFromOwnerReferences(pod.OwnerReferences)
+	devboxName := r.devboxName(pod.OwnerReferences)
 	if devboxName == "" {
 		return
 	}
 
+	r.metrics.operation(OperationDeletePod)
+
 	key := fmt.Sprintf("%s/%s", pod.Namespace, devboxName)
-	r.logger.WithFields(log.Fields{
+	podLogger := r.logger.WithFields(log.Fields{
 		"namespace": pod.Namespace,
 		"devbox":    devboxName,
-	}).Info("Removing pod IP")
+		"pod":       pod.Name,
+	})
+
+	r.devboxMu.Lock()
+
+	info, ok := r.devboxToInfo.get(key)
+	if ok {
+		info = info.clone()
+	}
+
+	// The old pod of a restarted devbox may be deleted after its replacement
+	// was added, it only takes its own entry with it
+	if !ok || !info.removePod(pod) {
+		r.devboxMu.Unlock()
+		podLogger.Debug("Ignoring deletion of an unknown pod")
 
-	r.mu.Lock()
-	defer r.mu.Unlock()
+		return
+	}
+
+	previousIP := info.PodIP
+	info.PodUpdatedAt = time.Now()
+	r.selectPod(info)
+	r.devboxToInfo.set(key, info)
+	snapshot := info.redactedCopy()
+
+	r.devboxMu.Unlock()
 
-	if info, ok := r.devboxToInfo[key]; ok {
-		info.PodIP = ""
+	podLogger.WithField("pods", len(snapshot.Pods)).Info("Removing pod")
+
+	switch {
+	case len(snapshot.Pods) == 0:
+		r.notify(Event{
+			Type:       EventPodDeleted,
+			Namespace:  pod.Namespace,
+			DevboxName: devboxName,
+			Info:       &snapshot,
+		})
+	case snapshot.PodIP != previousIP:
+		r.notify(Event{
+			Type:       EventPodIPChanged,
+			Namespace:  pod.Namespace,
+			DevboxName: devboxName,
+			PodIP:      snapshot.PodIP,
+			Info:       &snapshot,
+		})
 	}
 }
 
-// GetByPublicKey retrieves DevboxInfo by SSH public key
+// GetByPublicKey retrieves DevboxInfo by SSH public key, the primary key of a
+// devbox or a key added by users to a single devbox. The DevboxInfo is a
+// snapshot, later changes of the devbox do not show in it.
 func (r *Registry) GetByPublicKey(publicKey ssh.PublicKey) (*DevboxInfo, bool) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+	marshaled := string(publicKey.Marshal())
+
+	key, ok := r.publicKeyToNamespaceDevbox.get(marshaled)
+	primary := ok
 
-	key, ok := r.publicKeyToNamespaceDevbox[string(publicKey.Marshal())]
 	if !ok {
-		return nil, false
+		key, ok = r.authorizedKeyDevbox(marshaled)
 	}
 
-	info, ok := r.devboxToInfo[key]
+	var info *DevboxInfo
+	if ok {
+		info, ok = r.devboxToInfo.get(key)
+	}
+
+	// The maps are read one after the other, the key may have been replaced
+	// in between
+	switch {
+	case !ok:
+	case primary:
+		ok = info.marshaledPublicKey == marshaled
+	default:
+		source, _ := info.KeySource(publicKey)
+		ok = source == KeySourceAuthorizedKeys
+	}
+
+	r.metrics.keyLookup(ok)
 
 	return info, ok
 }
 
-// GetDevboxInfo retrieves DevboxInfo by namespace and devbox name
+// GetDevboxInfo retrieves DevboxInfo by namespace and devbox name, as a snapshot
 func (r *Registry) GetDevboxInfo(namespace, devboxName string) (*DevboxInfo, bool) {
+	return r.devboxToInfo.get(fmt.Sprintf("%s/%s", namespace, devboxName))
+}
+
+// Devboxes returns a snapshot of every devbox in the registry
+func (r *Registry) Devboxes() []DevboxInfo {
+	devboxes := make([]DevboxInfo, 0, r.devboxToInfo.len())
+
+	r.devboxToInfo.forEach(func(_ string, info *DevboxInfo) {
+		devboxes = append(devboxes, *info)
+	})
+
+	return devboxes
+}
+
+// BackendHealth returns the probed reachability of the backend of a devbox
+func (r *Registry) BackendHealth(namespace, devboxName string) (BackendHealth, bool) {
+	info, ok := r.devboxToInfo.get(fmt.Sprintf("%s/%s", namespace, devboxName))
+	if !ok {
+		return BackendHealth{}, false
+	}
+
+	return info.Health, true
+}
+
+// UpdateBackendHealth applies update to the backend health of a devbox, unless
+// its pod IP is no longer podIP, in which case the probe result is stale
+func (r *Registry) UpdateBackendHealth(
+	namespace, devboxName, podIP string,
+	update func(*BackendHealth),
+) bool {
 	key := fmt.Sprintf("%s/%s", namespace, devboxName)
 
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+	r.devboxMu.Lock()
+	defer r.devboxMu.Unlock()
 
-	info, ok := r.devboxToInfo[key]
+	info, ok := r.devboxToInfo.get(key)
+	if !ok || info.PodIP != podIP {
+		return false
+	}
 
-	return info, ok
+	info = info.clone()
+	update(&info.Health)
+	r.devboxToInfo.set(key, info)
+
+	return true
 }
 
-func getDevboxNameFromOwnerReferences(refs []metav1.OwnerReference) string {
-	for _, ref := range refs {
-		if ref.Kind == DevboxOwnerKind {
-			return ref.Name
+// backendAddressing returns how the backend of the selected pod of a devbox
+// is addressed, with its DNS name when addressed by DNS
+func (r *Registry) backendAddressing(info *DevboxInfo) (BackendAddressing, string) {
+	addressing := r.addressing
+
+	value, hasAddressing := info.podAnnotations[backendAddressingName]
+	if hasAddressing {
+		parsed, err := ParseBackendAddressing(value)
+		if err != nil {
+			r.logger.WithFields(log.Fields{
+				"namespace": info.Namespace,
+				"devbox":    info.DevboxName,
+			}).WithError(err).Warn("Ignoring backend addressing annotation")
+		} else {
+			addressing = parsed
 		}
 	}
 
-	return ""
+	// A backend host annotation on its own opts the devbox into DNS addressing
+	host := info.podAnnotations[backendHostName]
+	if host != "" && !hasAddressing {
+		addressing = BackendAddressingDNS
+	}
+
+	if addressing != BackendAddressingDNS {
+		return addressing, ""
+	}
+
+	if host == "" {
+		host = strings.NewReplacer(
+			"{namespace}", info.Namespace,
+			"{devbox}", info.DevboxName,
+		).Replace(r.hostTemplate)
+	}
+
+	return addressing, host
+}
+
+// podLimits sums the resource limits of the containers of a pod, a resource
+// some container has no limit for is left out as the pod is not bound by it
+func podLimits(pod *corev1.Pod) corev1.ResourceList {
+	if len(pod.Spec.Containers) == 0 {
+		return nil
+	}
+
+	limits := pod.Spec.Containers[0].Resources.Limits.DeepCopy()
+
+	for _, container := range pod.Spec.Containers[1:] {
+		for name, total := range limits {
+			limit, ok := container.Resources.Limits[name]
+			if !ok {
+				delete(limits, name)
+				continue
+			}
+
+			total.Add(limit)
+			limits[name] = total
+		}
+	}
+
+	return limits
+}
+
+// podIPs returns the pod IP of the preferred family, falling back to the
+// primary pod IP, along with every IP of the pod
+func (r *Registry) podIPs(pod *corev1.Pod) (string, []string) {
+	ips := make([]string, 0, len(pod.Status.PodIPs)+1)
+	for _, podIP := range pod.Status.PodIPs {
+		if podIP.IP != "" {
+			ips = append(ips, podIP.IP)
+		}
+	}
+
+	// PodIPs may be left unset, PodIP always holds the primary IP
+	if len(ips) == 0 && pod.Status.PodIP != "" {
+		ips = append(ips, pod.Status.PodIP)
+	}
+
+	if r.ipFamily != IPFamilyAny {
+		for _, ip := range ips {
+			if r.ofIPFamily(ip) {
+				return ip, ips
+			}
+		}
+	}
+
+	if pod.Status.PodIP == "" && len(ips) > 0 {
+		return ips[0], ips
+	}
+
+	return pod.Status.PodIP, ips
+}
+
+// ofIPFamily reports whether ip is of the preferred IP family, any IP is
+// without preference
+func (r *Registry) ofIPFamily(ip string) bool {
+	if r.ipFamily == IPFamilyAny {
+		return true
+	}
+
+	addr, err := netip.ParseAddr(ip)
+
+	return err == nil && addr.Unmap().Is4() == (r.ipFamily == IPFamilyIPv4)
+}
+
+// devboxObjectReference returns a reference to the Devbox owner of an object
+func (r *Registry) devboxObjectReference(
+	namespace string,
+	refs []metav1.OwnerReference,
+) corev1.ObjectReference {
+	ref, ok := r.devboxOwner(refs)
+	if !ok {
+		return corev1.ObjectReference{}
+	}
+
+	return corev1.ObjectReference{
+		APIVersion: ref.APIVersion,
+		Kind:       ref.Kind,
+		Namespace:  namespace,
+		Name:       ref.Name,
+		UID:        ref.UID,
+	}
+}
+
+// devboxName returns the name of the Devbox owner of an object, empty if none
+func (r *Registry) devboxName(refs []metav1.OwnerReference) string {
+	ref, _ := r.devboxOwner(refs)
+	return ref.Name
 }
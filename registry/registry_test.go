@@ -1,18 +1,25 @@
 package registry_test
 
 import (
+	"bytes"
 	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/pem"
+	"fmt"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/zijiren233/sshgate/registry"
 	"golang.org/x/crypto/ssh"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 )
 
-func generateTestKeyPair(t *testing.T) (ssh.PublicKey, []byte, []byte) {
+func generateTestKeyPair(t testing.TB) (ssh.PublicKey, []byte, []byte) {
 	t.Helper()
 
 	pub, priv, err := ed25519.GenerateKey(rand.Reader)
@@ -126,6 +133,58 @@ func TestAddSecret(t *testing.T) {
 	if info.DevboxName != "test-devbox" {
 		t.Errorf("DevboxName = %s, want test-devbox", info.DevboxName)
 	}
+
+	if ref := info.DevboxRef; ref.Kind != registry.DevboxOwnerKind ||
+		ref.Namespace != "test-ns" || ref.Name != "test-devbox" {
+		t.Errorf("DevboxRef = %+v, want the test-ns/test-devbox Devbox", ref)
+	}
+}
+
+func TestAddSecret_SkipPrivateKeys(t *testing.T) {
+	r := registry.New(registry.WithSkipPrivateKeys(true))
+	pubKey, pubBytes, privBytes := generateTestKeyPair(t)
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-secret",
+			Namespace: "test-ns",
+			Labels: map[string]string{
+				registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: registry.DevboxOwnerKind, Name: "test-devbox"},
+			},
+		},
+		Data: map[string][]byte{
+			registry.DevboxPublicKeyField:  pubBytes,
+			registry.DevboxPrivateKeyField: privBytes,
+		},
+	}
+	if err := r.AddSecret(nil, secret); err != nil {
+		t.Fatalf("AddSecret() failed: %v", err)
+	}
+
+	info, ok := r.GetByPublicKey(pubKey)
+	if !ok {
+		t.Fatal("Failed to get devbox by public key")
+	}
+
+	// No field of the cached devbox info may hold private key material
+	signerType := reflect.TypeFor[ssh.Signer]()
+
+	v := reflect.ValueOf(info).Elem()
+	for i := range v.NumField() {
+		field := v.Field(i)
+		if field.Kind() == reflect.Interface && !field.IsNil() &&
+			field.Elem().Type().Implements(signerType) {
+			t.Errorf("DevboxInfo.%s retains a private key", v.Type().Field(i).Name)
+		}
+
+		if field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Uint8 &&
+			bytes.Contains(field.Bytes(), privBytes) {
+			t.Errorf("DevboxInfo.%s retains private key bytes", v.Type().Field(i).Name)
+		}
+	}
 }
 
 func TestDeleteSecret(t *testing.T) {
@@ -347,3 +406,1423 @@ func TestConcurrentAccess(t *testing.T) {
 		<-done
 	}
 }
+
+func TestConcurrentAccess_Snapshots(t *testing.T) {
+	r := registry.New()
+	pubKey, pubBytes, privBytes := generateTestKeyPair(t)
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-secret",
+			Namespace: "test-ns",
+			Labels: map[string]string{
+				registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: registry.DevboxOwnerKind, Name: "test-devbox"},
+			},
+		},
+		Data: map[string][]byte{
+			registry.DevboxPublicKeyField:  pubBytes,
+			registry.DevboxPrivateKeyField: privBytes,
+		},
+	}
+
+	if err := r.AddSecret(nil, secret); err != nil {
+		t.Fatalf("AddSecret failed: %v", err)
+	}
+
+	pod := func(podIP string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "test-pod",
+				Namespace: "test-ns",
+				Labels: map[string]string{
+					registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+				},
+				OwnerReferences: []metav1.OwnerReference{
+					{Kind: registry.DevboxOwnerKind, Name: "test-devbox"},
+				},
+			},
+			Status: corev1.PodStatus{PodIP: podIP},
+		}
+	}
+
+	var wg sync.WaitGroup
+
+	// Writers change every field readers look at while they read, the race
+	// detector flags readers of a modified DevboxInfo
+	for i := range 4 {
+		wg.Go(func() {
+			for n := range 500 {
+				podIP := fmt.Sprintf("10.0.%d.%d", i, n%250)
+
+				switch n % 4 {
+				case 0:
+					r.DeletePod(pod(podIP))
+				case 1:
+					if err := r.AddSecret(secret, secret); err != nil {
+						t.Errorf("AddSecret failed: %v", err)
+					}
+				default:
+					if err := r.UpdatePod(pod(podIP)); err != nil {
+						t.Errorf("UpdatePod failed: %v", err)
+					}
+
+					r.UpdateBackendHealth("test-ns", "test-devbox", podIP,
+						func(h *registry.BackendHealth) { h.ConsecutiveFailures++ })
+				}
+			}
+		})
+	}
+
+	for range 4 {
+		wg.Go(func() {
+			for range 2000 {
+				info, ok := r.GetByPublicKey(pubKey)
+				if !ok {
+					t.Error("GetByPublicKey() found no devbox")
+					return
+				}
+
+				// A snapshot does not change while it is read
+				podIP := info.PodIP
+				_ = info.PrivateKey
+				_ = info.Health.ConsecutiveFailures
+				_ = info.PodIPs
+
+				if info.PodIP != podIP {
+					t.Errorf("Pod IP changed from %s to %s in a snapshot", podIP, info.PodIP)
+					return
+				}
+
+				if info, ok := r.GetDevboxInfo("test-ns", "test-devbox"); ok {
+					_ = info.PodIP
+				}
+			}
+		})
+	}
+
+	wg.Wait()
+}
+
+func TestConcurrentAccess_KeyRotation(t *testing.T) {
+	r := registry.New()
+
+	// Each devbox rotates between two keys while they are looked up, a lookup
+	// must never return a devbox whose key is not the one looked up
+	const devboxes = 8
+
+	secrets := make([][2]*corev1.Secret, devboxes)
+	keys := make([][2]ssh.PublicKey, devboxes)
+
+	for i := range devboxes {
+		for j := range 2 {
+			secret, publicKey := snapshotSecret(t, fmt.Sprintf("devbox-%d", i))
+			secrets[i][j], keys[i][j] = secret, publicKey
+		}
+
+		if err := r.AddSecret(nil, secrets[i][0]); err != nil {
+			t.Fatalf("AddSecret failed: %v", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+
+	for i := range devboxes {
+		wg.Go(func() {
+			for n := range 200 {
+				if err := r.AddSecret(secrets[i][n%2], secrets[i][(n+1)%2]); err != nil {
+					t.Errorf("AddSecret failed: %v", err)
+					return
+				}
+			}
+		})
+	}
+
+	for range 4 {
+		wg.Go(func() {
+			for n := range 4000 {
+				key := keys[n%devboxes][n/devboxes%2]
+
+				info, ok := r.GetByPublicKey(key)
+				if !ok {
+					continue
+				}
+
+				if source, _ := info.KeySource(key); source != registry.KeySourcePrimary {
+					t.Errorf("GetByPublicKey() returned %s without the key looked up",
+						info.DevboxName)
+					return
+				}
+			}
+		})
+	}
+
+	wg.Wait()
+}
+
+func TestSubscribe_PodEvents(t *testing.T) {
+	reg := registry.New()
+
+	var events []registry.Event
+
+	unsubscribe := reg.Subscribe(func(e registry.Event) { events = append(events, e) })
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pod",
+			Namespace: "ns-test",
+			Labels: map[string]string{
+				registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: registry.DevboxOwnerKind, Name: "test-devbox"},
+			},
+		},
+		Status: corev1.PodStatus{PodIP: "10.0.0.1"},
+	}
+
+	if err := reg.UpdatePod(pod); err != nil {
+		t.Fatalf("UpdatePod failed: %v", err)
+	}
+
+	// An unchanged IP is not an event
+	if err := reg.UpdatePod(pod); err != nil {
+		t.Fatalf("UpdatePod failed: %v", err)
+	}
+
+	reg.DeletePod(pod)
+
+	want := []registry.EventType{registry.EventPodIPChanged, registry.EventPodDeleted}
+	if len(events) != len(want) {
+		t.Fatalf("Got %d events, want %d", len(events), len(want))
+	}
+
+	for i, e := range events {
+		if e.Type != want[i] || e.Namespace != "ns-test" || e.DevboxName != "test-devbox" {
+			t.Errorf("Event %d = %+v, want type %d for ns-test/test-devbox", i, e, want[i])
+		}
+	}
+
+	unsubscribe()
+
+	if err := reg.UpdatePod(pod); err != nil {
+		t.Fatalf("UpdatePod failed: %v", err)
+	}
+
+	if len(events) != len(want) {
+		t.Errorf("Got an event after unsubscribing")
+	}
+}
+
+func TestDeletePod_ReplacedPod(t *testing.T) {
+	reg := registry.New()
+
+	var events []registry.Event
+
+	reg.Subscribe(func(e registry.Event) { events = append(events, e) })
+
+	created := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	newPod := func(name, uid, podIP string, age time.Duration) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              name,
+				Namespace:         "ns-test",
+				UID:               types.UID(uid),
+				CreationTimestamp: metav1.NewTime(created.Add(-age)),
+				Labels: map[string]string{
+					registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+				},
+				OwnerReferences: []metav1.OwnerReference{
+					{Kind: registry.DevboxOwnerKind, Name: "test-devbox"},
+				},
+			},
+			Status: corev1.PodStatus{PodIP: podIP},
+		}
+	}
+
+	podIP := func() string {
+		info, ok := reg.GetDevboxInfo("ns-test", "test-devbox")
+		if !ok {
+			t.Fatal("Devbox not found")
+		}
+
+		return info.PodIP
+	}
+
+	oldPod := newPod("test-devbox-old", "uid-old", "10.0.0.1", time.Hour)
+	if err := reg.UpdatePod(oldPod); err != nil {
+		t.Fatalf("UpdatePod failed: %v", err)
+	}
+
+	replacement := newPod("test-devbox-new", "uid-new", "10.0.0.2", 0)
+	if err := reg.UpdatePod(replacement); err != nil {
+		t.Fatalf("UpdatePod failed: %v", err)
+	}
+
+	// The old pod terminates and is deleted after its replacement was added
+	terminating := oldPod.DeepCopy()
+	terminating.Status.PodIP = ""
+
+	if err := reg.UpdatePod(terminating); err != nil {
+		t.Fatalf("UpdatePod failed: %v", err)
+	}
+
+	reg.DeletePod(terminating)
+
+	if got := podIP(); got != "10.0.0.2" {
+		t.Errorf("PodIP = %q after the old pod left, want 10.0.0.2", got)
+	}
+
+	if len(events) != 2 {
+		t.Errorf("Got %d events, want the 2 pod IP changes: %+v", len(events), events)
+	}
+
+	// A pod recreated under the same name is another pod
+	recreated := newPod("test-devbox-new", "uid-recreated", "10.0.0.3", -time.Hour)
+	if err := reg.UpdatePod(recreated); err != nil {
+		t.Fatalf("UpdatePod failed: %v", err)
+	}
+
+	reg.DeletePod(replacement)
+
+	if got := podIP(); got != "10.0.0.3" {
+		t.Errorf("PodIP = %q after the replaced pod was deleted, want 10.0.0.3", got)
+	}
+
+	reg.DeletePod(recreated)
+
+	if got := podIP(); got != "" {
+		t.Errorf("PodIP = %q after the current pod was deleted, want none", got)
+	}
+}
+
+func TestUpdatePod_TerminatingPod(t *testing.T) {
+	reg := registry.New()
+
+	var events []registry.Event
+
+	reg.Subscribe(func(e registry.Event) { events = append(events, e) })
+
+	podIP := func() string {
+		info, ok := reg.GetDevboxInfo("test-ns", "devbox")
+		if !ok {
+			t.Fatal("Devbox not found")
+		}
+
+		return info.PodIP
+	}
+
+	current := resyncPod("devbox", "devbox-1", "10.0.0.1", "1")
+	if err := reg.UpdatePod(current); err != nil {
+		t.Fatalf("UpdatePod failed: %v", err)
+	}
+
+	// The pod is being deleted, its status still reports its IP
+	terminating := current.DeepCopy()
+	terminating.ResourceVersion = "2"
+	terminating.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+
+	if err := reg.UpdatePod(terminating); err != nil {
+		t.Fatalf("UpdatePod failed: %v", err)
+	}
+
+	if got := podIP(); got != "" {
+		t.Errorf("PodIP = %q once the pod terminates, want none", got)
+	}
+
+	if last := events[len(events)-1]; last.Type != registry.EventPodIPChanged || last.PodIP != "" {
+		t.Errorf("Last event = %+v, want the pod IP cleared", last)
+	}
+
+	// The replacement pod starts while the old one is still being deleted
+	replacement := resyncPod("devbox", "devbox-2", "10.0.0.2", "1")
+	replacement.Status.Phase = corev1.PodPending
+
+	if err := reg.UpdatePod(replacement); err != nil {
+		t.Fatalf("UpdatePod failed: %v", err)
+	}
+
+	// Resyncs deliver the terminating pod again, with its IP
+	if err := reg.UpdatePod(terminating); err != nil {
+		t.Fatalf("UpdatePod failed: %v", err)
+	}
+
+	info, _ := reg.GetDevboxInfo("test-ns", "devbox")
+	if info.PodIP != "10.0.0.2" || info.PodState() != registry.PodStateStarting {
+		t.Errorf("Devbox reached at %q (%s), want the starting replacement",
+			info.PodIP, info.PodState())
+	}
+
+	stats := reg.Resync(time.Now(), nil, []*corev1.Pod{terminating, replacement}, nil)
+	if stats != (registry.ResyncStats{}) {
+		t.Errorf("Resync() = %+v, want no change", stats)
+	}
+
+	if got := podIP(); got != "10.0.0.2" {
+		t.Errorf("PodIP = %q after a resync, want 10.0.0.2", got)
+	}
+
+	reg.DeletePod(terminating)
+
+	if got := podIP(); got != "10.0.0.2" {
+		t.Errorf("PodIP = %q once the old pod is deleted, want 10.0.0.2", got)
+	}
+}
+
+func TestUpdatePod_PodState(t *testing.T) {
+	ready := func(status corev1.ConditionStatus) []corev1.PodCondition {
+		return []corev1.PodCondition{
+			{Type: corev1.PodScheduled, Status: corev1.ConditionTrue},
+			{Type: corev1.PodReady, Status: status},
+		}
+	}
+
+	tests := []struct {
+		name       string
+		status     corev1.PodStatus
+		want       registry.PodState
+		wantReady  bool
+		wantPhase  corev1.PodPhase
+		deletedPod bool
+	}{
+		{
+			name:      "pending without IP",
+			status:    corev1.PodStatus{Phase: corev1.PodPending},
+			want:      registry.PodStateStarting,
+			wantPhase: corev1.PodPending,
+		},
+		{
+			name: "container creating",
+			status: corev1.PodStatus{
+				Phase:      corev1.PodPending,
+				PodIP:      "10.0.0.1",
+				Conditions: ready(corev1.ConditionFalse),
+			},
+			want:      registry.PodStateStarting,
+			wantPhase: corev1.PodPending,
+		},
+		{
+			name: "running not ready",
+			status: corev1.PodStatus{
+				Phase:      corev1.PodRunning,
+				PodIP:      "10.0.0.1",
+				Conditions: ready(corev1.ConditionFalse),
+			},
+			want:      registry.PodStateStarting,
+			wantPhase: corev1.PodRunning,
+		},
+		{
+			name: "running ready",
+			status: corev1.PodStatus{
+				Phase:      corev1.PodRunning,
+				PodIP:      "10.0.0.1",
+				Conditions: ready(corev1.ConditionTrue),
+			},
+			want:      registry.PodStateReady,
+			wantReady: true,
+			wantPhase: corev1.PodRunning,
+		},
+		{
+			name: "running without Ready condition",
+			status: corev1.PodStatus{
+				Phase: corev1.PodRunning,
+				PodIP: "10.0.0.1",
+			},
+			want:      registry.PodStateReady,
+			wantPhase: corev1.PodRunning,
+		},
+		{
+			name: "ready condition unknown",
+			status: corev1.PodStatus{
+				Phase:      corev1.PodRunning,
+				PodIP:      "10.0.0.1",
+				Conditions: ready(corev1.ConditionUnknown),
+			},
+			want:      registry.PodStateStarting,
+			wantPhase: corev1.PodRunning,
+		},
+		{
+			name: "failed",
+			status: corev1.PodStatus{
+				Phase:      corev1.PodFailed,
+				PodIP:      "10.0.0.1",
+				Conditions: ready(corev1.ConditionFalse),
+			},
+			want:      registry.PodStateNone,
+			wantPhase: corev1.PodFailed,
+		},
+		{
+			name:      "succeeded",
+			status:    corev1.PodStatus{Phase: corev1.PodSucceeded},
+			want:      registry.PodStateNone,
+			wantPhase: corev1.PodSucceeded,
+		},
+		{
+			name: "deleted",
+			status: corev1.PodStatus{
+				Phase:      corev1.PodRunning,
+				PodIP:      "10.0.0.1",
+				Conditions: ready(corev1.ConditionTrue),
+			},
+			want:       registry.PodStateNone,
+			deletedPod: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := registry.New()
+
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-pod",
+					Namespace: "ns-test",
+					Labels: map[string]string{
+						registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+					},
+					OwnerReferences: []metav1.OwnerReference{
+						{Kind: registry.DevboxOwnerKind, Name: "test-devbox"},
+					},
+				},
+				Status: tt.status,
+			}
+
+			if err := reg.UpdatePod(pod); err != nil {
+				t.Fatalf("UpdatePod failed: %v", err)
+			}
+
+			if tt.deletedPod {
+				reg.DeletePod(pod)
+			}
+
+			info, ok := reg.GetDevboxInfo("ns-test", "test-devbox")
+			if !ok {
+				t.Fatal("Devbox not found")
+			}
+
+			if got := info.PodState(); got != tt.want {
+				t.Errorf("PodState() = %s, want %s", got, tt.want)
+			}
+
+			if info.PodReady != tt.wantReady || info.PodPhase != tt.wantPhase {
+				t.Errorf("PodReady, PodPhase = %v, %q, want %v, %q",
+					info.PodReady, info.PodPhase, tt.wantReady, tt.wantPhase)
+			}
+		})
+	}
+}
+
+func TestUpdatePod_ReadinessTransitions(t *testing.T) {
+	reg := registry.New()
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pod",
+			Namespace: "ns-test",
+			Labels: map[string]string{
+				registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: registry.DevboxOwnerKind, Name: "test-devbox"},
+			},
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning, PodIP: "10.0.0.1"},
+	}
+
+	// Ready, then not ready under node pressure, then ready again
+	for _, status := range []corev1.ConditionStatus{
+		corev1.ConditionTrue, corev1.ConditionFalse, corev1.ConditionTrue,
+	} {
+		pod = pod.DeepCopy()
+		pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: status}}
+
+		if err := reg.UpdatePod(pod); err != nil {
+			t.Fatalf("UpdatePod failed: %v", err)
+		}
+
+		info, _ := reg.GetDevboxInfo("ns-test", "test-devbox")
+
+		want := registry.PodStateStarting
+		if status == corev1.ConditionTrue {
+			want = registry.PodStateReady
+		}
+
+		if got := info.PodState(); got != want {
+			t.Errorf("PodState() with Ready %s = %s, want %s", status, got, want)
+		}
+	}
+}
+
+func TestUpdatePod_RestartOverlap(t *testing.T) {
+	created := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	newPod := func(
+		name, podIP string,
+		age time.Duration,
+		ready corev1.ConditionStatus,
+	) *corev1.Pod {
+		phase := corev1.PodRunning
+		if podIP == "" {
+			phase = corev1.PodPending
+		}
+
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              name,
+				Namespace:         "ns-test",
+				UID:               types.UID(name),
+				CreationTimestamp: metav1.NewTime(created.Add(-age)),
+				Labels: map[string]string{
+					registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+				},
+				OwnerReferences: []metav1.OwnerReference{
+					{Kind: registry.DevboxOwnerKind, Name: "test-devbox"},
+				},
+			},
+			Status: corev1.PodStatus{
+				Phase:      phase,
+				PodIP:      podIP,
+				Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: ready}},
+			},
+		}
+	}
+
+	oldPod := newPod("old", "10.0.0.1", time.Hour, corev1.ConditionTrue)
+	newPending := newPod("new", "", 0, corev1.ConditionFalse)
+	newStarting := newPod("new", "10.0.0.2", 0, corev1.ConditionFalse)
+	newReady := newPod("new", "10.0.0.2", 0, corev1.ConditionTrue)
+
+	steps := []struct {
+		name   string
+		update *corev1.Pod
+		delete *corev1.Pod
+		pod    string
+		ip     string
+		pods   int
+	}{
+		{name: "old ready", update: oldPod, pod: "old", ip: "10.0.0.1", pods: 1},
+		{name: "new pending", update: newPending, pod: "old", ip: "10.0.0.1", pods: 2},
+		{name: "new starting", update: newStarting, pod: "old", ip: "10.0.0.1", pods: 2},
+		{name: "new ready", update: newReady, pod: "new", ip: "10.0.0.2", pods: 2},
+		{name: "old deleted", delete: oldPod, pod: "new", ip: "10.0.0.2", pods: 1},
+	}
+
+	reg := registry.New()
+
+	var events []registry.Event
+
+	reg.Subscribe(func(e registry.Event) { events = append(events, e) })
+
+	for _, step := range steps {
+		if step.update != nil {
+			if err := reg.UpdatePod(step.update); err != nil {
+				t.Fatalf("%s: UpdatePod failed: %v", step.name, err)
+			}
+		} else {
+			reg.DeletePod(step.delete)
+		}
+
+		info, _ := reg.GetDevboxInfo("ns-test", "test-devbox")
+		if info.PodName != step.pod || info.PodIP != step.ip ||
+			len(info.Pods) != step.pods {
+			t.Errorf("%s: routed to %s at %s among %d pods, want %s at %s among %d",
+				step.name, info.PodName, info.PodIP, len(info.Pods),
+				step.pod, step.ip, step.pods)
+		}
+	}
+
+	// The IP changed once to the old pod, once when the new pod got ready
+	if len(events) != 2 || events[1].Type != registry.EventPodIPChanged ||
+		events[1].PodIP != "10.0.0.2" {
+		t.Errorf("Events = %+v, want the pod IP changed to 10.0.0.1 then 10.0.0.2", events)
+	}
+
+	// The selection does not depend on the order of events
+	reversed := registry.New()
+	for _, pod := range []*corev1.Pod{newReady, oldPod} {
+		if err := reversed.UpdatePod(pod); err != nil {
+			t.Fatalf("UpdatePod failed: %v", err)
+		}
+	}
+
+	if info, _ := reversed.GetDevboxInfo("ns-test", "test-devbox"); info.PodName != "new" {
+		t.Errorf("Routed to %s with events reversed, want new", info.PodName)
+	}
+
+	// Deleting the routed pod falls back to the other one
+	reversed.DeletePod(newReady)
+
+	if info, _ := reversed.GetDevboxInfo("ns-test", "test-devbox"); info.PodName != "old" ||
+		info.PodIP != "10.0.0.1" {
+		t.Errorf("Routed to %s at %s after deleting the new pod, want old at 10.0.0.1",
+			info.PodName, info.PodIP)
+	}
+}
+
+func TestUpdatePod_DebugClone(t *testing.T) {
+	newPod := func(name, podIP string, age time.Duration, controller *bool) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              name,
+				Namespace:         "ns-test",
+				UID:               types.UID(name),
+				CreationTimestamp: metav1.NewTime(time.Now().Add(-age)),
+				Labels: map[string]string{
+					registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+				},
+				OwnerReferences: []metav1.OwnerReference{
+					{Kind: registry.DevboxOwnerKind, Name: "test-devbox", Controller: controller},
+				},
+			},
+			Status: corev1.PodStatus{
+				Phase:      corev1.PodRunning,
+				PodIP:      podIP,
+				Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: "True"}},
+			},
+		}
+	}
+
+	controlled := true
+	devboxPod := newPod("devbox", "10.0.0.1", time.Hour, &controlled)
+	// Newer and ready, the clone copied the owner references but no controller
+	clone := newPod("devbox-debug", "10.0.0.2", 0, nil)
+
+	reg := registry.New()
+	for _, pod := range []*corev1.Pod{devboxPod, clone} {
+		if err := reg.UpdatePod(pod); err != nil {
+			t.Fatalf("UpdatePod failed: %v", err)
+		}
+	}
+
+	info, _ := reg.GetDevboxInfo("ns-test", "test-devbox")
+	if info.PodName != "devbox" || len(info.Pods) != 2 {
+		t.Errorf("Routed to %s among %d pods, want devbox among 2", info.PodName, len(info.Pods))
+	}
+
+	// Nor is the clone selected once the pod of the devbox is gone
+	reg.DeletePod(devboxPod)
+
+	info, _ = reg.GetDevboxInfo("ns-test", "test-devbox")
+	if info.PodName != "" || info.PodIP != "" || info.HasAddress("10.0.0.1") {
+		t.Errorf("Routed to %s at %s with the clone alone, want no pod", info.PodName, info.PodIP)
+	}
+
+	if !info.HasAddress("10.0.0.2") {
+		t.Error("HasAddress() of the clone = false, want true")
+	}
+}
+
+func TestUpdatePod_BackendAddressing(t *testing.T) {
+	newPod := func(annotations map[string]string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "test-pod",
+				Namespace:   "ns-test",
+				Annotations: annotations,
+				Labels: map[string]string{
+					registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+				},
+				OwnerReferences: []metav1.OwnerReference{
+					{Kind: registry.DevboxOwnerKind, Name: "test-devbox"},
+				},
+			},
+			Status: corev1.PodStatus{PodIP: "10.0.0.1"},
+		}
+	}
+
+	dns := registry.WithBackendAddressing(registry.BackendAddressingDNS, "")
+
+	tests := []struct {
+		name           string
+		opts           []registry.Option
+		annotations    map[string]string
+		wantAddressing registry.BackendAddressing
+		wantHost       string
+	}{
+		{
+			name:           "default pod IP",
+			wantAddressing: registry.BackendAddressingPodIP,
+		},
+		{
+			name:           "default DNS template",
+			opts:           []registry.Option{dns},
+			wantAddressing: registry.BackendAddressingDNS,
+			wantHost:       "test-devbox.ns-test.svc",
+		},
+		{
+			name: "custom template",
+			opts: []registry.Option{registry.WithBackendAddressing(
+				registry.BackendAddressingDNS,
+				"{devbox}-ssh.{namespace}.svc.cluster.local",
+			)},
+			wantAddressing: registry.BackendAddressingDNS,
+			wantHost:       "test-devbox-ssh.ns-test.svc.cluster.local",
+		},
+		{
+			name:           "host annotation opts in",
+			annotations:    map[string]string{registry.BackendHostAnnotation: "ssh.ns-test.svc"},
+			wantAddressing: registry.BackendAddressingDNS,
+			wantHost:       "ssh.ns-test.svc",
+		},
+		{
+			name: "addressing annotation opts out",
+			opts: []registry.Option{dns},
+			annotations: map[string]string{
+				registry.BackendAddressingAnnotation: "pod-ip",
+				registry.BackendHostAnnotation:       "ssh.ns-test.svc",
+			},
+			wantAddressing: registry.BackendAddressingPodIP,
+		},
+		{
+			name:           "invalid annotation ignored",
+			opts:           []registry.Option{dns},
+			annotations:    map[string]string{registry.BackendAddressingAnnotation: "bogus"},
+			wantAddressing: registry.BackendAddressingDNS,
+			wantHost:       "test-devbox.ns-test.svc",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := registry.New(tt.opts...)
+
+			if err := r.UpdatePod(newPod(tt.annotations)); err != nil {
+				t.Fatalf("UpdatePod failed: %v", err)
+			}
+
+			info, ok := r.GetDevboxInfo("ns-test", "test-devbox")
+			if !ok {
+				t.Fatal("DevboxInfo not found after UpdatePod")
+			}
+
+			if info.Addressing != tt.wantAddressing || info.BackendHost != tt.wantHost {
+				t.Errorf("Addressing, BackendHost = %s, %q, want %s, %q",
+					info.Addressing, info.BackendHost, tt.wantAddressing, tt.wantHost)
+			}
+		})
+	}
+}
+
+func TestUpdatePod_IPFamily(t *testing.T) {
+	dualStack := corev1.PodStatus{
+		PodIP:  "10.0.0.1",
+		PodIPs: []corev1.PodIP{{IP: "10.0.0.1"}, {IP: "fd00::1"}},
+	}
+
+	tests := []struct {
+		name   string
+		family registry.IPFamily
+		status corev1.PodStatus
+		wantIP string
+	}{
+		{
+			name:   "IPv6 only",
+			status: corev1.PodStatus{PodIP: "fd00::1", PodIPs: []corev1.PodIP{{IP: "fd00::1"}}},
+			wantIP: "fd00::1",
+		},
+		{
+			name:   "IPv6 only with IPv4 preferred",
+			family: registry.IPFamilyIPv4,
+			status: corev1.PodStatus{PodIP: "fd00::1", PodIPs: []corev1.PodIP{{IP: "fd00::1"}}},
+			wantIP: "fd00::1",
+		},
+		{
+			name:   "dual-stack primary",
+			status: dualStack,
+			wantIP: "10.0.0.1",
+		},
+		{
+			name:   "dual-stack IPv6 preferred",
+			family: registry.IPFamilyIPv6,
+			status: dualStack,
+			wantIP: "fd00::1",
+		},
+		{
+			name:   "dual-stack IPv4 preferred",
+			family: registry.IPFamilyIPv4,
+			status: dualStack,
+			wantIP: "10.0.0.1",
+		},
+		{
+			name:   "PodIPs unset",
+			family: registry.IPFamilyIPv6,
+			status: corev1.PodStatus{PodIP: "10.0.0.1"},
+			wantIP: "10.0.0.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := registry.New(registry.WithIPFamily(tt.family))
+
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-pod",
+					Namespace: "ns-test",
+					Labels: map[string]string{
+						registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+					},
+					OwnerReferences: []metav1.OwnerReference{
+						{Kind: registry.DevboxOwnerKind, Name: "test-devbox"},
+					},
+				},
+				Status: tt.status,
+			}
+			if err := r.UpdatePod(pod); err != nil {
+				t.Fatalf("UpdatePod failed: %v", err)
+			}
+
+			info, ok := r.GetDevboxInfo("ns-test", "test-devbox")
+			if !ok {
+				t.Fatal("DevboxInfo not found after UpdatePod")
+			}
+
+			if info.PodIP != tt.wantIP {
+				t.Errorf("PodIP = %s, want %s", info.PodIP, tt.wantIP)
+			}
+
+			wantIPs := max(len(tt.status.PodIPs), 1)
+			if len(info.PodIPs) != wantIPs {
+				t.Errorf("PodIPs = %v, want %d IPs", info.PodIPs, wantIPs)
+			}
+		})
+	}
+}
+
+func TestUpdateBackendHealth(t *testing.T) {
+	r := registry.New()
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pod",
+			Namespace: "ns-test",
+			Labels: map[string]string{
+				registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: registry.DevboxOwnerKind, Name: "test-devbox"},
+			},
+		},
+		Status: corev1.PodStatus{PodIP: "10.0.0.1"},
+	}
+	if err := r.UpdatePod(pod); err != nil {
+		t.Fatalf("UpdatePod failed: %v", err)
+	}
+
+	markUnreachable := func(h *registry.BackendHealth) { h.Unreachable = true }
+
+	// Probes of a previous pod IP are stale
+	if r.UpdateBackendHealth("ns-test", "test-devbox", "10.0.0.2", markUnreachable) {
+		t.Error("UpdateBackendHealth() applied a probe of another pod IP")
+	}
+
+	if !r.UpdateBackendHealth("ns-test", "test-devbox", "10.0.0.1", markUnreachable) {
+		t.Fatal("UpdateBackendHealth() ignored a probe of the current pod IP")
+	}
+
+	if health, _ := r.BackendHealth("ns-test", "test-devbox"); !health.Unreachable {
+		t.Error("Backend not marked unreachable")
+	}
+
+	// A new pod IP resets the health
+	pod.Status.PodIP = "10.0.0.2"
+	if err := r.UpdatePod(pod); err != nil {
+		t.Fatalf("UpdatePod failed: %v", err)
+	}
+
+	if health, _ := r.BackendHealth("ns-test", "test-devbox"); health.Unreachable {
+		t.Error("Backend still unreachable after the pod IP changed")
+	}
+}
+
+func TestSubscribe_PublicKeyChanged(t *testing.T) {
+	r := registry.New()
+
+	var events []registry.Event
+
+	// Every secret change is also a secret event, only key changes matter here
+	r.Subscribe(func(e registry.Event) {
+		if e.Type == registry.EventPublicKeyChanged {
+			events = append(events, e)
+		}
+	})
+
+	newSecret := func(pubBytes, privBytes []byte) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "test-secret",
+				Namespace: "ns-test",
+				Labels: map[string]string{
+					registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+				},
+				OwnerReferences: []metav1.OwnerReference{
+					{Kind: registry.DevboxOwnerKind, Name: "test-devbox"},
+				},
+			},
+			Data: map[string][]byte{
+				registry.DevboxPublicKeyField:  pubBytes,
+				registry.DevboxPrivateKeyField: privBytes,
+			},
+		}
+	}
+
+	oldPub, oldPubBytes, oldPrivBytes := generateTestKeyPair(t)
+	_, newPubBytes, newPrivBytes := generateTestKeyPair(t)
+
+	// Adding a devbox and resyncing an unchanged secret are not key changes
+	for range 2 {
+		if err := r.AddSecret(nil, newSecret(oldPubBytes, oldPrivBytes)); err != nil {
+			t.Fatalf("AddSecret failed: %v", err)
+		}
+	}
+
+	if len(events) != 0 {
+		t.Fatalf("Got %d events, want none", len(events))
+	}
+
+	if err := r.AddSecret(nil, newSecret(newPubBytes, newPrivBytes)); err != nil {
+		t.Fatalf("AddSecret failed: %v", err)
+	}
+
+	if len(events) != 1 || events[0].Type != registry.EventPublicKeyChanged {
+		t.Fatalf("Events = %+v, want one EventPublicKeyChanged", events)
+	}
+
+	// The replaced key is forgotten even without the old secret
+	if _, ok := r.GetByPublicKey(oldPub); ok {
+		t.Error("Replaced public key still maps to the devbox")
+	}
+}
+
+func TestAddSecret_KeyRotation(t *testing.T) {
+	r := registry.New()
+
+	newSecret := func(name string, pubBytes []byte) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "ns-test",
+				Labels: map[string]string{
+					registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+				},
+				OwnerReferences: []metav1.OwnerReference{
+					{Kind: registry.DevboxOwnerKind, Name: "test-devbox"},
+				},
+			},
+			Data: map[string][]byte{registry.DevboxPublicKeyField: pubBytes},
+		}
+	}
+
+	resolves := func(key ssh.PublicKey) bool {
+		info, ok := r.GetByPublicKey(key)
+		return ok && info.DevboxName == "test-devbox"
+	}
+
+	firstPub, firstPubBytes, _ := generateTestKeyPair(t)
+	secondPub, secondPubBytes, _ := generateTestKeyPair(t)
+	thirdPub, thirdPubBytes, _ := generateTestKeyPair(t)
+
+	first := newSecret("test-secret", firstPubBytes)
+	if err := r.AddSecret(nil, first); err != nil {
+		t.Fatalf("AddSecret failed: %v", err)
+	}
+
+	second := newSecret("test-secret", secondPubBytes)
+	if err := r.AddSecret(first, second); err != nil {
+		t.Fatalf("AddSecret failed: %v", err)
+	}
+
+	if resolves(firstPub) {
+		t.Error("Rotated out key still resolves")
+	}
+
+	if !resolves(secondPub) {
+		t.Error("Rotated in key does not resolve")
+	}
+
+	// A recreated secret may be added before the deletion of the one it replaces
+	third := newSecret("test-secret-2", thirdPubBytes)
+	if err := r.AddSecret(nil, third); err != nil {
+		t.Fatalf("AddSecret failed: %v", err)
+	}
+
+	r.DeleteSecret(second)
+
+	if resolves(secondPub) {
+		t.Error("Key of the deleted secret still resolves")
+	}
+
+	if !resolves(thirdPub) {
+		t.Error("Deleting the replaced secret removed the key of its replacement")
+	}
+
+	r.DeleteSecret(third)
+
+	if resolves(thirdPub) {
+		t.Error("Key of the deleted secret still resolves")
+	}
+}
+
+func TestUpdatePod_SessionRecordingAnnotation(t *testing.T) {
+	r := registry.New()
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test-pod",
+			Namespace:   "ns-test",
+			Annotations: map[string]string{registry.SessionRecordingAnnotation: "true"},
+			Labels: map[string]string{
+				registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: registry.DevboxOwnerKind, Name: "test-devbox"},
+			},
+		},
+		Status: corev1.PodStatus{PodIP: "10.0.0.1"},
+	}
+
+	for _, want := range []bool{true, false} {
+		if !want {
+			delete(pod.Annotations, registry.SessionRecordingAnnotation)
+		}
+
+		if err := r.UpdatePod(pod); err != nil {
+			t.Fatalf("UpdatePod failed: %v", err)
+		}
+
+		info, _ := r.GetDevboxInfo("ns-test", "test-devbox")
+		if info.RecordSessions != want {
+			t.Errorf("RecordSessions = %v, want %v", info.RecordSessions, want)
+		}
+	}
+}
+
+func TestForceCommandAnnotation(t *testing.T) {
+	r := registry.New()
+	_, pubBytes, _ := generateTestKeyPair(t)
+
+	meta := metav1.ObjectMeta{
+		Namespace: "ns-test",
+		Labels: map[string]string{
+			registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+		},
+		OwnerReferences: []metav1.OwnerReference{
+			{Kind: registry.DevboxOwnerKind, Name: "test-devbox"},
+		},
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: *meta.DeepCopy(),
+		Data:       map[string][]byte{registry.DevboxPublicKeyField: pubBytes},
+	}
+	secret.Name = "test-secret"
+	secret.Annotations = map[string]string{registry.ForceCommandAnnotation: "audit-shell"}
+
+	pod := &corev1.Pod{
+		ObjectMeta: *meta.DeepCopy(),
+		Status:     corev1.PodStatus{PodIP: "10.0.0.1"},
+	}
+	pod.Name = "test-pod"
+
+	steps := []struct {
+		name  string
+		apply func() error
+		want  string
+	}{
+		{
+			name:  "secret annotation",
+			apply: func() error { return r.AddSecret(nil, secret) },
+			want:  "audit-shell",
+		},
+		{
+			name: "pod annotation takes precedence",
+			apply: func() error {
+				pod.Annotations = map[string]string{registry.ForceCommandAnnotation: "tmux attach"}
+				return r.UpdatePod(pod)
+			},
+			want: "tmux attach",
+		},
+		{
+			name:  "secret update keeps the pod annotation",
+			apply: func() error { return r.AddSecret(secret, secret) },
+			want:  "tmux attach",
+		},
+		{
+			name: "legacy pod annotation",
+			apply: func() error {
+				pod.Annotations = map[string]string{registry.LegacyAnnotationPrefix + "force-command": "screen -x"}
+				return r.UpdatePod(pod)
+			},
+			want: "screen -x",
+		},
+		{
+			name: "annotation preferred over the legacy one",
+			apply: func() error {
+				pod.Annotations[registry.ForceCommandAnnotation] = "tmux attach"
+				return r.UpdatePod(pod)
+			},
+			want: "tmux attach",
+		},
+		{
+			name: "pod annotation removed",
+			apply: func() error {
+				pod.Annotations = nil
+				return r.UpdatePod(pod)
+			},
+			want: "audit-shell",
+		},
+	}
+
+	for _, step := range steps {
+		if err := step.apply(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+
+		info, _ := r.GetDevboxInfo("ns-test", "test-devbox")
+		if info.ForceCommand != step.want {
+			t.Errorf("%s: ForceCommand = %q, want %q", step.name, info.ForceCommand, step.want)
+		}
+	}
+}
+
+func TestUpdatePod_SFTPOnlyAnnotation(t *testing.T) {
+	enabled, disabled := true, false
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        *bool
+	}{
+		{name: "absent"},
+		{
+			name:        "enabled",
+			annotations: map[string]string{registry.SFTPOnlyAnnotation: "true"},
+			want:        &enabled,
+		},
+		{
+			name:        "disabled",
+			annotations: map[string]string{registry.SFTPOnlyAnnotation: "false"},
+			want:        &disabled,
+		},
+		{
+			name:        "invalid",
+			annotations: map[string]string{registry.SFTPOnlyAnnotation: "sometimes"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := registry.New()
+
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "test-pod",
+					Namespace:   "ns-test",
+					Annotations: tt.annotations,
+					Labels: map[string]string{
+						registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+					},
+					OwnerReferences: []metav1.OwnerReference{
+						{Kind: registry.DevboxOwnerKind, Name: "test-devbox"},
+					},
+				},
+				Status: corev1.PodStatus{PodIP: "10.0.0.1"},
+			}
+			if err := r.UpdatePod(pod); err != nil {
+				t.Fatalf("UpdatePod failed: %v", err)
+			}
+
+			info, _ := r.GetDevboxInfo("ns-test", "test-devbox")
+			if (info.SFTPOnly == nil) != (tt.want == nil) ||
+				(tt.want != nil && *info.SFTPOnly != *tt.want) {
+				t.Errorf("SFTPOnly = %v, want %v", info.SFTPOnly, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdatePod_BackendUsersAnnotation(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        []string
+	}{
+		{name: "absent"},
+		{name: "empty", annotations: map[string]string{registry.BackendUsersAnnotation: " , "}},
+		{
+			name:        "list",
+			annotations: map[string]string{registry.BackendUsersAnnotation: "root, ubuntu,"},
+			want:        []string{"root", "ubuntu"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := registry.New()
+
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "test-pod",
+					Namespace:   "ns-test",
+					Annotations: tt.annotations,
+					Labels: map[string]string{
+						registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+					},
+					OwnerReferences: []metav1.OwnerReference{
+						{Kind: registry.DevboxOwnerKind, Name: "test-devbox"},
+					},
+				},
+				Status: corev1.PodStatus{PodIP: "10.0.0.1"},
+			}
+			if err := r.UpdatePod(pod); err != nil {
+				t.Fatalf("UpdatePod failed: %v", err)
+			}
+
+			info, _ := r.GetDevboxInfo("ns-test", "test-devbox")
+			if !reflect.DeepEqual(info.BackendUsers, tt.want) {
+				t.Errorf("BackendUsers = %v, want %v", info.BackendUsers, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdatePod_BackendUserAnnotation(t *testing.T) {
+	r := registry.New()
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test-pod",
+			Namespace:   "ns-test",
+			Annotations: map[string]string{registry.BackendUserAnnotation: " devbox "},
+			Labels: map[string]string{
+				registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: registry.DevboxOwnerKind, Name: "test-devbox"},
+			},
+		},
+		Status: corev1.PodStatus{PodIP: "10.0.0.1"},
+	}
+	if err := r.UpdatePod(pod); err != nil {
+		t.Fatalf("UpdatePod failed: %v", err)
+	}
+
+	info, _ := r.GetDevboxInfo("ns-test", "test-devbox")
+	if info.BackendUser != "devbox" {
+		t.Errorf("BackendUser = %q, want devbox", info.BackendUser)
+	}
+
+	pod.Annotations = nil
+	if err := r.UpdatePod(pod); err != nil {
+		t.Fatalf("UpdatePod failed: %v", err)
+	}
+
+	info, _ = r.GetDevboxInfo("ns-test", "test-devbox")
+	if info.BackendUser != "" {
+		t.Errorf("BackendUser = %q after the annotation was removed, want none", info.BackendUser)
+	}
+}
+
+func TestUpdatePod_MOTDAnnotation(t *testing.T) {
+	template, empty := "Welcome to {devbox}", ""
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        *string
+	}{
+		{name: "absent"},
+		{
+			name:        "template",
+			annotations: map[string]string{registry.MOTDAnnotation: template},
+			want:        &template,
+		},
+		{
+			name:        "empty",
+			annotations: map[string]string{registry.MOTDAnnotation: ""},
+			want:        &empty,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := registry.New()
+
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "test-pod",
+					Namespace:   "ns-test",
+					Annotations: tt.annotations,
+					Labels: map[string]string{
+						registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+					},
+					OwnerReferences: []metav1.OwnerReference{
+						{Kind: registry.DevboxOwnerKind, Name: "test-devbox"},
+					},
+				},
+				Status: corev1.PodStatus{PodIP: "10.0.0.1"},
+			}
+			if err := r.UpdatePod(pod); err != nil {
+				t.Fatalf("UpdatePod failed: %v", err)
+			}
+
+			info, _ := r.GetDevboxInfo("ns-test", "test-devbox")
+			if (info.MOTD == nil) != (tt.want == nil) ||
+				(tt.want != nil && *info.MOTD != *tt.want) {
+				t.Errorf("MOTD = %v, want %v", info.MOTD, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdatePod_PodLimits(t *testing.T) {
+	limits := func(cpu, memory string) corev1.ResourceRequirements {
+		list := corev1.ResourceList{corev1.ResourceCPU: resource.MustParse(cpu)}
+		if memory != "" {
+			list[corev1.ResourceMemory] = resource.MustParse(memory)
+		}
+
+		return corev1.ResourceRequirements{Limits: list}
+	}
+
+	r := registry.New()
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pod",
+			Namespace: "ns-test",
+			Labels: map[string]string{
+				registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: registry.DevboxOwnerKind, Name: "test-devbox"},
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "devbox", Resources: limits("1500m", "4Gi")},
+				// The pod is not bound in memory by a container without limit
+				{Name: "sidecar", Resources: limits("500m", "")},
+			},
+		},
+		Status: corev1.PodStatus{PodIP: "10.0.0.1"},
+	}
+	if err := r.UpdatePod(pod); err != nil {
+		t.Fatalf("UpdatePod failed: %v", err)
+	}
+
+	info, _ := r.GetDevboxInfo("ns-test", "test-devbox")
+	if info.PodName != "test-pod" {
+		t.Errorf("PodName = %q, want test-pod", info.PodName)
+	}
+
+	cpu, ok := info.PodLimits[corev1.ResourceCPU]
+	if !ok || cpu.Cmp(resource.MustParse("2")) != 0 {
+		t.Errorf("CPU limit = %v, want 2", info.PodLimits)
+	}
+
+	if _, ok := info.PodLimits[corev1.ResourceMemory]; ok {
+		t.Errorf("Limits = %v, want no memory limit", info.PodLimits)
+	}
+}
@@ -0,0 +1,263 @@
+package registry
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ResyncStats counts the changes a resync applied to the registry
+type ResyncStats struct {
+	// SecretsApplied and PodsApplied count the secrets and pods the registry
+	// did not hold at their resource version
+	SecretsApplied int `json:"secrets_applied"`
+	PodsApplied    int `json:"pods_applied"`
+	// SecretsRemoved and PodsRemoved count the secrets and pods the registry
+	// held but that are gone
+	SecretsRemoved int `json:"secrets_removed"`
+	PodsRemoved    int `json:"pods_removed"`
+	// EndpointSlicesApplied and EndpointSlicesRemoved count the same for the
+	// EndpointSlices of EndpointSlice discovery
+	EndpointSlicesApplied int `json:"endpoint_slices_applied"`
+	EndpointSlicesRemoved int `json:"endpoint_slices_removed"`
+	// DevboxesRemoved counts the devboxes left with neither secret, pod,
+	// EndpointSlice nor Devbox custom resource
+	DevboxesRemoved int `json:"devboxes_removed"`
+}
+
+// Resync converges the registry to secrets, pods and endpointSlices, every
+// devbox secret, pod and EndpointSlice of the cluster as cached by the
+// informers at listedAt. Changes the
+// registry missed are applied, objects it already holds at their resource
+// version are skipped, and the devboxes and pods it holds that are gone are
+// removed, as deletions missed during an outage of the API server would leave
+// them. Devboxes changed by events since listedAt are left to these events.
+func (r *Registry) Resync(
+	listedAt time.Time,
+	secrets []*corev1.Secret,
+	pods []*corev1.Pod,
+	endpointSlices []*discoveryv1.EndpointSlice,
+) ResyncStats {
+	var stats ResyncStats
+
+	// Devbox keys of the listed objects
+	listedSecrets := make(map[string]*corev1.Secret, len(secrets))
+
+	for _, secret := range secrets {
+		if key, ok := r.devboxKey(secret.Namespace, secret.Labels, secret.OwnerReferences); ok &&
+			!r.isOTPSecret(secret) {
+			listedSecrets[key] = secret
+		}
+	}
+
+	listedPods := make(map[string][]*corev1.Pod, len(pods))
+
+	for _, pod := range pods {
+		if key, ok := r.devboxKey(pod.Namespace, pod.Labels, pod.OwnerReferences); ok {
+			listedPods[key] = append(listedPods[key], pod)
+		}
+	}
+
+	listedSlices := make(map[string][]*discoveryv1.EndpointSlice, len(endpointSlices))
+
+	for _, slice := range endpointSlices {
+		if devboxName := slice.Labels[discoveryv1.LabelServiceName]; devboxName != "" &&
+			r.isDevboxObject(slice.Labels) {
+			key := fmt.Sprintf("%s/%s", slice.Namespace, devboxName)
+			listedSlices[key] = append(listedSlices[key], slice)
+		}
+	}
+
+	// Removals first, applying bumps the update times they are checked against.
+	// removedPods records when the pods of a devbox were last removed, events
+	// are only those applied since.
+	held := make(map[string]*DevboxInfo)
+	removedPods := make(map[string]time.Time)
+
+	r.devboxToInfo.forEach(func(key string, info *DevboxInfo) {
+		held[key] = info
+	})
+
+	for key, info := range held {
+		if info.PublicKey != nil && listedSecrets[key] == nil {
+			if r.removeSecret(key, listedAt) {
+				stats.SecretsRemoved++
+			}
+
+			continue
+		}
+
+		if info.PodUpdatedAt.After(listedAt) {
+			continue
+		}
+
+		for _, pod := range info.Pods {
+			if pod.pod != nil && !slices.ContainsFunc(listedPods[key], pod.is) {
+				r.DeletePod(pod.pod)
+				removedPods[key] = time.Now()
+				stats.PodsRemoved++
+			}
+		}
+
+		for name := range info.endpointSlices {
+			listed := slices.ContainsFunc(listedSlices[key],
+				func(slice *discoveryv1.EndpointSlice) bool { return slice.Name == name })
+			if !listed && r.deleteEndpointSlice(info.Namespace, info.DevboxName, name) {
+				removedPods[key] = time.Now()
+				stats.EndpointSlicesRemoved++
+			}
+		}
+
+		if r.removeEmptyDevbox(key) {
+			stats.DevboxesRemoved++
+		}
+	}
+
+	for key, secret := range listedSecrets {
+		if info, ok := r.devboxToInfo.get(key); ok && (info.SecretUpdatedAt.After(listedAt) ||
+			secret.ResourceVersion != "" && info.secretVersion == secret.ResourceVersion) {
+			continue
+		}
+
+		// A secret that fails to parse keeps its devbox, as on update events
+		if err := r.AddSecret(nil, secret); err != nil {
+			r.logger.WithError(err).Warn("Failed to resync secret")
+			continue
+		}
+
+		stats.SecretsApplied++
+	}
+
+	for key, pods := range listedPods {
+		since := listedAt
+		if removedAt, removed := removedPods[key]; removed {
+			since = removedAt
+		}
+
+		info, ok := r.devboxToInfo.get(key)
+		if ok && info.PodUpdatedAt.After(since) {
+			continue
+		}
+
+		for _, pod := range pods {
+			if ok && info.hasPodVersion(pod) {
+				continue
+			}
+
+			if err := r.UpdatePod(pod); err != nil {
+				r.logger.WithError(err).Warn("Failed to resync pod")
+				continue
+			}
+
+			stats.PodsApplied++
+		}
+	}
+
+	for key, endpointSlices := range listedSlices {
+		since := listedAt
+		if removedAt, removed := removedPods[key]; removed {
+			since = removedAt
+		}
+
+		info, ok := r.devboxToInfo.get(key)
+		if ok && info.PodUpdatedAt.After(since) {
+			continue
+		}
+
+		for _, slice := range endpointSlices {
+			if ok && info.hasEndpointSliceVersion(slice) {
+				continue
+			}
+
+			if err := r.UpdateEndpointSlice(slice); err != nil {
+				r.logger.WithError(err).Warn("Failed to resync endpoint slice")
+				continue
+			}
+
+			stats.EndpointSlicesApplied++
+		}
+	}
+
+	r.logger.WithFields(log.Fields{
+		"secrets_applied":         stats.SecretsApplied,
+		"secrets_removed":         stats.SecretsRemoved,
+		"pods_applied":            stats.PodsApplied,
+		"pods_removed":            stats.PodsRemoved,
+		"devboxes_removed":        stats.DevboxesRemoved,
+		"endpoint_slices_applied": stats.EndpointSlicesApplied,
+		"endpoint_slices_removed": stats.EndpointSlicesRemoved,
+	}).Info("Resynced registry")
+
+	return stats
+}
+
+// devboxKey returns the key of the devbox of an object, false unless it is a
+// devbox object with a Devbox owner
+func (r *Registry) devboxKey(
+	namespace string,
+	labels map[string]string,
+	refs []metav1.OwnerReference,
+) (string, bool) {
+	if !r.isDevboxObject(labels) {
+		return "", false
+	}
+
+	devboxName := r.devboxName(refs)
+	if devboxName == "" {
+		return "", false
+	}
+
+	return fmt.Sprintf("%s/%s", namespace, devboxName), true
+}
+
+// removeSecret removes the devbox of key, whose secret was gone at listedAt,
+// reporting whether the registry still held it unchanged since
+func (r *Registry) removeSecret(key string, listedAt time.Time) bool {
+	r.devboxMu.Lock()
+
+	info, ok := r.devboxToInfo.get(key)
+	if !ok || info.PublicKey == nil || info.SecretUpdatedAt.After(listedAt) {
+		r.devboxMu.Unlock()
+		return false
+	}
+
+	r.deleteDevboxLocked(key, info)
+
+	r.devboxMu.Unlock()
+
+	r.metrics.operation(OperationDeleteSecret)
+	r.logger.WithFields(log.Fields{
+		"namespace": info.Namespace,
+		"devbox":    info.DevboxName,
+	}).Info("Removing secret gone from the cluster")
+
+	r.notify(Event{
+		Type:       EventSecretDeleted,
+		Namespace:  info.Namespace,
+		DevboxName: info.DevboxName,
+	})
+
+	return true
+}
+
+// removeEmptyDevbox removes the devbox of key once it has neither secret, pod,
+// EndpointSlice nor Devbox custom resource, reporting whether it did
+func (r *Registry) removeEmptyDevbox(key string) bool {
+	r.devboxMu.Lock()
+	defer r.devboxMu.Unlock()
+
+	info, ok := r.devboxToInfo.get(key)
+	if !ok || info.PublicKey != nil || len(info.Pods) > 0 || len(info.endpointSlices) > 0 ||
+		info.devbox != nil || info.Stale() {
+		return false
+	}
+
+	r.devboxToInfo.delete(key)
+
+	return true
+}
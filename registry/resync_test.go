@@ -0,0 +1,128 @@
+package registry_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// resyncPod returns the pod of a devbox of the test-ns namespace at version
+func resyncPod(devboxName, name, podIP, version string) *corev1.Pod {
+	pod := newListTestPod("test-ns", devboxName, podIP)
+	pod.Name, pod.UID, pod.ResourceVersion = name, types.UID(name), version
+
+	return pod
+}
+
+func TestResync_Converges(t *testing.T) {
+	reg := registry.New()
+
+	kept, keptKey := snapshotSecret(t, "kept")
+	kept.ResourceVersion = "1"
+	keptPod := resyncPod("kept", "kept-1", "10.0.0.1", "1")
+	restarted := resyncPod("kept", "kept-2", "10.0.0.2", "1")
+
+	deleted, deletedKey := snapshotSecret(t, "deleted")
+	deleted.ResourceVersion = "1"
+	orphanPod := resyncPod("podless", "podless-1", "10.0.0.3", "1")
+
+	for _, secret := range []*corev1.Secret{kept, deleted} {
+		if err := reg.AddSecret(nil, secret); err != nil {
+			t.Fatalf("AddSecret failed: %v", err)
+		}
+	}
+
+	for _, pod := range []*corev1.Pod{keptPod, restarted, orphanPod} {
+		if err := reg.UpdatePod(pod); err != nil {
+			t.Fatalf("UpdatePod failed: %v", err)
+		}
+	}
+
+	// The cluster diverged: the deletions of a secret and of two pods, the
+	// rotation of a key and a new devbox were missed
+	rotated, rotatedKey := snapshotSecret(t, "kept")
+	rotated.ResourceVersion = "2"
+	added, addedKey := snapshotSecret(t, "added")
+	added.ResourceVersion = "1"
+	addedPod := resyncPod("added", "added-1", "10.0.0.4", "1")
+
+	stats := reg.Resync(time.Now(),
+		[]*corev1.Secret{rotated, added},
+		[]*corev1.Pod{restarted, addedPod},
+		nil,
+	)
+
+	want := registry.ResyncStats{
+		SecretsApplied:  2,
+		PodsApplied:     1,
+		SecretsRemoved:  1,
+		PodsRemoved:     2,
+		DevboxesRemoved: 1,
+	}
+	if stats != want {
+		t.Errorf("Resync() = %+v, want %+v", stats, want)
+	}
+
+	if info, ok := reg.GetDevboxInfo("test-ns", "kept"); !ok || info.PodIP != "10.0.0.2" ||
+		len(info.Pods) != 1 {
+		t.Errorf("Devbox kept not reached at its remaining pod: %+v", info)
+	}
+
+	for name, lookup := range map[string]struct {
+		key  ssh.PublicKey
+		want bool
+	}{
+		"old key":     {keptKey, false},
+		"rotated key": {rotatedKey, true},
+		"deleted":     {deletedKey, false},
+		"added":       {addedKey, true},
+	} {
+		if _, ok := reg.GetByPublicKey(lookup.key); ok != lookup.want {
+			t.Errorf("Lookup of the %s = %t, want %t", name, ok, lookup.want)
+		}
+	}
+
+	for _, name := range []string{"deleted", "podless"} {
+		if _, ok := reg.GetDevboxInfo("test-ns", name); ok {
+			t.Errorf("Devbox %s still registered", name)
+		}
+	}
+
+	// Converged, a second resync changes nothing
+	stats = reg.Resync(time.Now(),
+		[]*corev1.Secret{rotated, added},
+		[]*corev1.Pod{restarted, addedPod},
+		nil,
+	)
+	if stats != (registry.ResyncStats{}) {
+		t.Errorf("Second Resync() = %+v, want no change", stats)
+	}
+}
+
+func TestResync_KeepsLaterEvents(t *testing.T) {
+	reg := registry.New()
+
+	// Listed before the devbox was added
+	listedAt := time.Now()
+
+	secret, publicKey := snapshotSecret(t, "late")
+	if err := reg.AddSecret(nil, secret); err != nil {
+		t.Fatalf("AddSecret failed: %v", err)
+	}
+
+	if err := reg.UpdatePod(resyncPod("late", "late-1", "10.0.0.1", "1")); err != nil {
+		t.Fatalf("UpdatePod failed: %v", err)
+	}
+
+	if stats := reg.Resync(listedAt, nil, nil, nil); stats != (registry.ResyncStats{}) {
+		t.Errorf("Resync() = %+v, want no change", stats)
+	}
+
+	if info, ok := reg.GetByPublicKey(publicKey); !ok || info.PodIP != "10.0.0.1" {
+		t.Error("Devbox added after the listing removed")
+	}
+}
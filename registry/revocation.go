@@ -0,0 +1,123 @@
+package registry
+
+import (
+	"bufio"
+	"slices"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// revokedFingerprintPrefix starts the SHA256 fingerprints of the revocation list
+const revokedFingerprintPrefix = "SHA256:"
+
+// WithRevocationConfigMap sets the ConfigMap listing revoked key fingerprints.
+// Every data value holds SHA256 fingerprints, one per line, as printed by
+// ssh-keygen -l. Blank lines and text after # are ignored.
+func WithRevocationConfigMap(namespace, name string) Option {
+	return func(r *Registry) {
+		r.revocationNamespace, r.revocationName = namespace, name
+	}
+}
+
+// IsRevoked reports whether the key with the SHA256 fingerprint is revoked
+func (r *Registry) IsRevoked(fingerprint string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	_, ok := r.revokedFingerprints[fingerprint]
+
+	return ok
+}
+
+// UpdateConfigMap processes a ConfigMap, only the revocation ConfigMap is used.
+// Fingerprints newly revoked are announced with an EventKeysRevoked event.
+func (r *Registry) UpdateConfigMap(configMap *corev1.ConfigMap) {
+	if !r.isRevocationConfigMap(configMap) {
+		return
+	}
+
+	r.setRevokedFingerprints(parseRevokedFingerprints(configMap, r.logger))
+}
+
+// DeleteConfigMap processes a deleted ConfigMap, deleting the revocation
+// ConfigMap revokes no key anymore
+func (r *Registry) DeleteConfigMap(configMap *corev1.ConfigMap) {
+	if !r.isRevocationConfigMap(configMap) {
+		return
+	}
+
+	r.setRevokedFingerprints(nil)
+}
+
+// isRevocationConfigMap reports whether configMap is the revocation ConfigMap
+func (r *Registry) isRevocationConfigMap(configMap *corev1.ConfigMap) bool {
+	return r.revocationName != "" &&
+		configMap.Namespace == r.revocationNamespace &&
+		configMap.Name == r.revocationName
+}
+
+// setRevokedFingerprints replaces the revoked fingerprints
+func (r *Registry) setRevokedFingerprints(fingerprints map[string]struct{}) {
+	r.logger.WithFields(log.Fields{
+		"namespace":    r.revocationNamespace,
+		"name":         r.revocationName,
+		"fingerprints": len(fingerprints),
+	}).Info("Updating revoked key fingerprints")
+
+	r.mu.Lock()
+
+	var revoked []string
+
+	for fingerprint := range fingerprints {
+		if _, ok := r.revokedFingerprints[fingerprint]; !ok {
+			revoked = append(revoked, fingerprint)
+		}
+	}
+
+	r.revokedFingerprints = fingerprints
+	r.revocationStale = false
+
+	r.mu.Unlock()
+
+	if len(revoked) > 0 {
+		slices.Sort(revoked)
+		r.notify(Event{Type: EventKeysRevoked, Fingerprints: revoked})
+	}
+}
+
+// parseRevokedFingerprints returns the fingerprints listed by the revocation
+// ConfigMap. Lines other than fingerprints are skipped with a warning.
+func parseRevokedFingerprints(
+	configMap *corev1.ConfigMap,
+	logger *log.Entry,
+) map[string]struct{} {
+	fingerprints := make(map[string]struct{})
+
+	for key, value := range configMap.Data {
+		scanner := bufio.NewScanner(strings.NewReader(value))
+		for line := 1; scanner.Scan(); line++ {
+			text, _, _ := strings.Cut(scanner.Text(), "#")
+
+			text = strings.TrimSpace(text)
+			if text == "" {
+				continue
+			}
+
+			if !strings.HasPrefix(text, revokedFingerprintPrefix) ||
+				strings.ContainsAny(text, " \t") {
+				logger.WithFields(log.Fields{
+					"key":  key,
+					"line": line,
+				}).Warn("Skipping invalid revoked key fingerprint")
+
+				continue
+			}
+
+			fingerprints[text] = struct{}{}
+		}
+	}
+
+	return fingerprints
+}
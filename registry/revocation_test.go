@@ -0,0 +1,77 @@
+package registry_test
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/zijiren233/sshgate/registry"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// revocationConfigMap returns the revocation ConfigMap with data
+func revocationConfigMap(name, data string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "sshgate"},
+		Data:       map[string]string{"fingerprints": data},
+	}
+}
+
+func TestUpdateConfigMap_Revocation(t *testing.T) {
+	r := registry.New(registry.WithRevocationConfigMap("sshgate", "revoked-keys"))
+
+	var events []registry.Event
+
+	defer r.Subscribe(func(event registry.Event) { events = append(events, event) })()
+
+	r.UpdateConfigMap(revocationConfigMap("revoked-keys",
+		"# leaked on 2026-10-01\n\n"+
+			"SHA256:first  # alice laptop\n"+
+			"not a fingerprint\n"+
+			"SHA256:second\n",
+	))
+
+	for _, fingerprint := range []string{"SHA256:first", "SHA256:second"} {
+		if !r.IsRevoked(fingerprint) {
+			t.Errorf("IsRevoked(%s) = false, want true", fingerprint)
+		}
+	}
+
+	if r.IsRevoked("not a fingerprint") {
+		t.Error("IsRevoked() of an invalid line = true, want false")
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("got %d events, want 1", len(events))
+	}
+
+	if event := events[0]; event.Type != registry.EventKeysRevoked ||
+		!slices.Equal(event.Fingerprints, []string{"SHA256:first", "SHA256:second"}) {
+		t.Errorf("event = %+v, want both fingerprints revoked", event)
+	}
+
+	// Only newly revoked fingerprints are announced
+	r.UpdateConfigMap(revocationConfigMap("revoked-keys", "SHA256:second\nSHA256:third\n"))
+
+	if len(events) != 2 || !slices.Equal(events[1].Fingerprints, []string{"SHA256:third"}) {
+		t.Errorf("events = %+v, want SHA256:third revoked", events)
+	}
+
+	if r.IsRevoked("SHA256:first") {
+		t.Error("IsRevoked() of a removed fingerprint = true, want false")
+	}
+
+	// Other ConfigMaps are ignored
+	r.UpdateConfigMap(revocationConfigMap("other", "SHA256:other\n"))
+
+	if r.IsRevoked("SHA256:other") {
+		t.Error("IsRevoked() of another ConfigMap = true, want false")
+	}
+
+	// Deleting the ConfigMap revokes nothing
+	r.DeleteConfigMap(revocationConfigMap("revoked-keys", ""))
+
+	if r.IsRevoked("SHA256:third") {
+		t.Error("IsRevoked() after deletion = true, want false")
+	}
+}
@@ -0,0 +1,93 @@
+package registry
+
+import (
+	"hash/maphash"
+	"sync"
+)
+
+// shardCount is the number of shards of the maps of the registry
+const shardCount = 64
+
+// shardedMap is a map split into shards, each with its own lock, so that readers
+// only wait for writers of the same shard. Values are never modified once
+// stored, they are replaced.
+type shardedMap[V any] struct {
+	seed   maphash.Seed
+	shards [shardCount]mapShard[V]
+}
+
+type mapShard[V any] struct {
+	mu sync.RWMutex
+	m  map[string]V
+}
+
+func newShardedMap[V any]() *shardedMap[V] {
+	s := &shardedMap[V]{seed: maphash.MakeSeed()}
+	for i := range s.shards {
+		s.shards[i].m = make(map[string]V)
+	}
+
+	return s
+}
+
+func (s *shardedMap[V]) shard(key string) *mapShard[V] {
+	return &s.shards[maphash.String(s.seed, key)%shardCount]
+}
+
+func (s *shardedMap[V]) get(key string) (V, bool) {
+	shard := s.shard(key)
+
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	value, ok := shard.m[key]
+
+	return value, ok
+}
+
+func (s *shardedMap[V]) set(key string, value V) {
+	shard := s.shard(key)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	shard.m[key] = value
+}
+
+func (s *shardedMap[V]) delete(key string) {
+	shard := s.shard(key)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	delete(shard.m, key)
+}
+
+// len returns the number of entries, shards are counted one after the other
+func (s *shardedMap[V]) len() int {
+	n := 0
+
+	for i := range s.shards {
+		shard := &s.shards[i]
+
+		shard.mu.RLock()
+		n += len(shard.m)
+		shard.mu.RUnlock()
+	}
+
+	return n
+}
+
+// forEach calls fn for every entry, shards are visited one after the other
+// with their lock held, so fn must not modify the map
+func (s *shardedMap[V]) forEach(fn func(key string, value V)) {
+	for i := range s.shards {
+		shard := &s.shards[i]
+
+		shard.mu.RLock()
+		for key, value := range shard.m {
+			fn(key, value)
+		}
+		shard.mu.RUnlock()
+	}
+}
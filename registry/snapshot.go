@@ -0,0 +1,442 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// SnapshotVersion is the version of the snapshot format written by SaveSnapshot
+	SnapshotVersion = 2
+	// snapshotMagic starts the header line of snapshot files
+	snapshotMagic = "sshgate-registry-snapshot"
+)
+
+var (
+	// ErrSnapshotCorrupt is returned when a snapshot file is truncated or damaged
+	ErrSnapshotCorrupt = errors.New("corrupt registry snapshot")
+	// ErrSnapshotVersion is returned when a snapshot file has an unsupported version
+	ErrSnapshotVersion = errors.New("unsupported registry snapshot version")
+)
+
+// snapshotData is the body of a snapshot file, following its header line
+type snapshotData struct {
+	SavedAt             time.Time        `json:"saved_at"`
+	Devboxes            []snapshotDevbox `json:"devboxes"`
+	RevokedFingerprints []string         `json:"revoked_fingerprints,omitempty"`
+}
+
+// snapshotDevbox is the public data of a devbox kept in snapshots, never its
+// private key
+type snapshotDevbox struct {
+	Namespace         string                 `json:"namespace"`
+	Devbox            string                 `json:"devbox"`
+	PublicKey         string                 `json:"public_key,omitempty"`
+	AuthorizedKeys    string                 `json:"authorized_keys,omitempty"`
+	DevboxRef         corev1.ObjectReference `json:"devbox_ref"`
+	PodName           string                 `json:"pod_name,omitempty"`
+	PodIP             string                 `json:"pod_ip,omitempty"`
+	PodIPs            []string               `json:"pod_ips,omitempty"`
+	BackendPort       int                    `json:"backend_port,omitempty"`
+	Addressing        BackendAddressing      `json:"addressing,omitempty"`
+	BackendHost       string                 `json:"backend_host,omitempty"`
+	PodAnnotations    map[string]string      `json:"pod_annotations,omitempty"`
+	SecretAnnotations map[string]string      `json:"secret_annotations,omitempty"`
+	SecretUpdatedAt   time.Time              `json:"secret_updated_at,omitzero"`
+	PodUpdatedAt      time.Time              `json:"pod_updated_at,omitzero"`
+	DesiredState      DesiredState           `json:"desired_state,omitempty"`
+}
+
+// Stale reports whether the devbox was loaded from a snapshot and its secret or
+// pod has not been seen by the informers since. Stale data may be outdated, it
+// is replaced as the informers catch up and dropped by Reconcile.
+func (info *DevboxInfo) Stale() bool {
+	return info.staleSecret || info.stalePod
+}
+
+// SaveSnapshot writes the public data of the registry to path: the keys, pods
+// and settings of the devboxes and the revoked fingerprints, never private keys.
+// The file is replaced atomically, a crash never leaves a partial snapshot.
+func (r *Registry) SaveSnapshot(path string) error {
+	data := snapshotData{SavedAt: time.Now()}
+
+	r.devboxToInfo.forEach(func(_ string, info *DevboxInfo) {
+		data.Devboxes = append(data.Devboxes, info.snapshotDevbox())
+	})
+
+	r.mu.RLock()
+
+	for fingerprint := range r.revokedFingerprints {
+		data.RevokedFingerprints = append(data.RevokedFingerprints, fingerprint)
+	}
+
+	r.mu.RUnlock()
+
+	slices.SortFunc(data.Devboxes, func(a, b snapshotDevbox) int {
+		return strings.Compare(a.Namespace+"/"+a.Devbox, b.Namespace+"/"+b.Devbox)
+	})
+	slices.Sort(data.RevokedFingerprints)
+
+	body, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to encode registry snapshot: %w", err)
+	}
+
+	checksum := sha256.Sum256(body)
+	header := fmt.Sprintf(
+		"%s %d %s\n", snapshotMagic, SnapshotVersion, hex.EncodeToString(checksum[:]),
+	)
+
+	if err := writeFileAtomic(path, append([]byte(header), body...)); err != nil {
+		return fmt.Errorf("failed to write registry snapshot: %w", err)
+	}
+
+	r.logger.WithFields(log.Fields{
+		"path":     path,
+		"devboxes": len(data.Devboxes),
+	}).Debug("Saved registry snapshot")
+
+	return nil
+}
+
+// LoadSnapshot loads a snapshot written by SaveSnapshot, returning the number
+// of devboxes loaded. Devboxes already known are kept as they are. Loaded
+// devboxes are Stale until the informers confirm them; call it before starting
+// the informers and Reconcile once they synced.
+func (r *Registry) LoadSnapshot(path string) (int, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	data, err := decodeSnapshot(content)
+	if err != nil {
+		return 0, err
+	}
+
+	snapshotLogger := r.logger.WithFields(log.Fields{
+		"path":     path,
+		"saved_at": data.SavedAt,
+	})
+
+	r.devboxMu.Lock()
+
+	loaded := 0
+
+	for _, devbox := range data.Devboxes {
+		devboxKey := fmt.Sprintf("%s/%s", devbox.Namespace, devbox.Devbox)
+		if _, ok := r.devboxToInfo.get(devboxKey); ok {
+			continue
+		}
+
+		devboxLogger := snapshotLogger.WithFields(log.Fields{
+			"namespace": devbox.Namespace,
+			"devbox":    devbox.Devbox,
+		})
+
+		info, err := r.devboxFromSnapshot(devbox, snapshotLogger)
+		if err != nil {
+			devboxLogger.WithError(err).Warn("Skipping devbox of registry snapshot")
+
+			continue
+		}
+
+		authorizedKeys := info.AuthorizedKeys
+		info.AuthorizedKeys = nil
+		r.setAuthorizedKeys(info, devboxKey, authorizedKeys)
+		r.devboxToInfo.set(devboxKey, info)
+
+		if info.PublicKey != nil {
+			r.claimPublicKey(info.PublicKey, info.marshaledPublicKey, devboxKey, devboxLogger)
+		}
+
+		loaded++
+	}
+
+	r.devboxMu.Unlock()
+
+	r.mu.Lock()
+
+	// Keys revoked while the gateway was down stay revoked until the revocation
+	// ConfigMap is seen again
+	if r.revocationName != "" && r.revokedFingerprints == nil {
+		r.revokedFingerprints = make(map[string]struct{}, len(data.RevokedFingerprints))
+		for _, fingerprint := range data.RevokedFingerprints {
+			r.revokedFingerprints[fingerprint] = struct{}{}
+		}
+
+		r.revocationStale = true
+	}
+
+	r.mu.Unlock()
+
+	snapshotLogger.WithField("devboxes", loaded).Info("Loaded registry snapshot")
+
+	return loaded, nil
+}
+
+// Reconcile drops what the informers did not confirm of the snapshot loaded:
+// devboxes whose secret is gone and pods that are gone, announcing it like
+// deletions. Call it once the informers synced.
+func (r *Registry) Reconcile() {
+	var events []Event
+
+	r.devboxMu.Lock()
+
+	stale := make(map[string]*DevboxInfo)
+
+	r.devboxToInfo.forEach(func(devboxKey string, info *DevboxInfo) {
+		if info.Stale() {
+			stale[devboxKey] = info
+		}
+	})
+
+	for devboxKey, info := range stale {
+		info = info.clone()
+
+		// The secret was deleted while the gateway was down
+		if info.staleSecret {
+			r.releasePublicKey(info.marshaledPublicKey, devboxKey)
+
+			r.setAuthorizedKeys(info, devboxKey, nil)
+			r.devboxToInfo.delete(devboxKey)
+
+			events = append(events, Event{
+				Type:       EventSecretDeleted,
+				Namespace:  info.Namespace,
+				DevboxName: info.DevboxName,
+			})
+
+			continue
+		}
+
+		// The pod was deleted while the gateway was down
+		info.stalePod = false
+		r.selectPod(info)
+
+		if info.PublicKey == nil {
+			r.devboxToInfo.delete(devboxKey)
+			events = append(events, Event{
+				Type:       EventPodDeleted,
+				Namespace:  info.Namespace,
+				DevboxName: info.DevboxName,
+			})
+
+			continue
+		}
+
+		r.devboxToInfo.set(devboxKey, info)
+		snapshot := info.redactedCopy()
+		events = append(events, Event{
+			Type:       EventPodDeleted,
+			Namespace:  info.Namespace,
+			DevboxName: info.DevboxName,
+			Info:       &snapshot,
+		})
+	}
+
+	r.devboxMu.Unlock()
+
+	r.mu.Lock()
+	revocationStale := r.revocationStale
+	r.revocationStale = false
+	r.mu.Unlock()
+
+	r.logger.WithField("dropped", len(events)).Info("Reconciled registry snapshot")
+
+	// The revocation ConfigMap was deleted while the gateway was down
+	if revocationStale {
+		r.setRevokedFingerprints(nil)
+	}
+
+	for _, event := range events {
+		r.notify(event)
+	}
+}
+
+// PersistSnapshots saves a snapshot to path every interval, and a last one when
+// ctx is done, until then it blocks. Failures are logged, the gateway keeps
+// serving without snapshots.
+func (r *Registry) PersistSnapshots(ctx context.Context, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if err := r.SaveSnapshot(path); err != nil {
+				r.logger.WithError(err).Error("Failed to save registry snapshot on shutdown")
+			}
+
+			return
+		}
+
+		if err := r.SaveSnapshot(path); err != nil {
+			r.logger.WithError(err).Error("Failed to save registry snapshot")
+		}
+	}
+}
+
+// snapshotDevbox returns the public data of info kept in snapshots
+func (info *DevboxInfo) snapshotDevbox() snapshotDevbox {
+	devbox := snapshotDevbox{
+		Namespace:         info.Namespace,
+		Devbox:            info.DevboxName,
+		DevboxRef:         info.DevboxRef,
+		PodName:           info.PodName,
+		PodIP:             info.PodIP,
+		PodIPs:            info.PodIPs,
+		BackendPort:       info.BackendPort,
+		Addressing:        info.Addressing,
+		BackendHost:       info.BackendHost,
+		PodAnnotations:    info.podAnnotations,
+		SecretAnnotations: info.secretAnnotations,
+		SecretUpdatedAt:   info.SecretUpdatedAt,
+		PodUpdatedAt:      info.PodUpdatedAt,
+		DesiredState:      info.DesiredState,
+	}
+
+	if info.PublicKey != nil {
+		devbox.PublicKey = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(info.PublicKey)))
+	}
+
+	var authorizedKeys strings.Builder
+
+	for _, key := range info.AuthorizedKeys {
+		authorizedKeys.Write(bytes.TrimSpace(ssh.MarshalAuthorizedKey(key.PublicKey)))
+
+		if key.Comment != "" {
+			authorizedKeys.WriteString(" " + key.Comment)
+		}
+
+		authorizedKeys.WriteString("\n")
+	}
+
+	devbox.AuthorizedKeys = authorizedKeys.String()
+
+	return devbox
+}
+
+// devboxFromSnapshot returns the stale devbox info of a snapshot devbox
+func (r *Registry) devboxFromSnapshot(
+	devbox snapshotDevbox,
+	logger *log.Entry,
+) (*DevboxInfo, error) {
+	info := &DevboxInfo{
+		Namespace:       devbox.Namespace,
+		DevboxName:      devbox.Devbox,
+		Cluster:         r.cluster,
+		DevboxRef:       devbox.DevboxRef,
+		PodName:         devbox.PodName,
+		PodIP:           devbox.PodIP,
+		PodIPs:          devbox.PodIPs,
+		BackendPort:     devbox.BackendPort,
+		Addressing:      devbox.Addressing,
+		BackendHost:     devbox.BackendHost,
+		AuthorizedKeys:  parseAuthorizedKeys([]byte(devbox.AuthorizedKeys), logger),
+		SecretUpdatedAt: devbox.SecretUpdatedAt,
+		PodUpdatedAt:    devbox.PodUpdatedAt,
+		DesiredState:    devbox.DesiredState,
+		staleSecret:     devbox.PublicKey != "",
+		stalePod:        devbox.PodIP != "",
+	}
+
+	if devbox.PublicKey != "" {
+		publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(devbox.PublicKey))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse public key: %w", err)
+		}
+
+		info.PublicKey, info.marshaledPublicKey = publicKey, string(publicKey.Marshal())
+	}
+
+	if !info.Stale() {
+		return nil, errors.New("devbox has neither key nor pod")
+	}
+
+	if devbox.PodIP != "" {
+		info.PodPhase = corev1.PodRunning
+	}
+
+	info.setAnnotations(devbox.PodAnnotations, devbox.SecretAnnotations)
+	r.applyAnnotations(info)
+
+	return info, nil
+}
+
+// decodeSnapshot checks the header of a snapshot file and decodes its body
+func decodeSnapshot(content []byte) (*snapshotData, error) {
+	header, body, ok := bytes.Cut(content, []byte("\n"))
+	if !ok {
+		return nil, fmt.Errorf("%w: missing header", ErrSnapshotCorrupt)
+	}
+
+	fields := strings.Fields(string(header))
+	if len(fields) != 3 || fields[0] != snapshotMagic {
+		return nil, fmt.Errorf("%w: invalid header", ErrSnapshotCorrupt)
+	}
+
+	version, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid version %q", ErrSnapshotCorrupt, fields[1])
+	}
+
+	if version != SnapshotVersion {
+		return nil, fmt.Errorf("%w %d, want %d", ErrSnapshotVersion, version, SnapshotVersion)
+	}
+
+	checksum := sha256.Sum256(body)
+	if fields[2] != hex.EncodeToString(checksum[:]) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrSnapshotCorrupt)
+	}
+
+	var data snapshotData
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrSnapshotCorrupt, err)
+	}
+
+	return &data, nil
+}
+
+// writeFileAtomic replaces the file at path with content, readable by its owner
+// only, by renaming a synced temporary file over it
+func writeFileAtomic(path string, content []byte) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
@@ -0,0 +1,302 @@
+package registry_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/zijiren233/sshgate/registry"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// snapshotSecret returns the secret of a devbox of namespace test-ns holding
+// its key pair, returning its public key too
+func snapshotSecret(t *testing.T, devboxName string) (*corev1.Secret, ssh.PublicKey) {
+	t.Helper()
+
+	secret := authorizedKeysSecret(t, devboxName, "")
+
+	publicKey, pubBytes, privBytes := generateTestKeyPair(t)
+	secret.Data[registry.DevboxPublicKeyField] = pubBytes
+	secret.Data[registry.DevboxPrivateKeyField] = privBytes
+
+	return secret, publicKey
+}
+
+func TestSnapshot_RoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.snapshot")
+	source := registry.New(registry.WithRevocationConfigMap("sshgate", "revoked-keys"))
+
+	secret, publicKey := snapshotSecret(t, "test-devbox")
+	laptop, _, _ := generateTestKeyPair(t)
+	secret.Data[registry.DevboxAuthorizedKeysField] = []byte(
+		authorizedKeyLine(laptop, "alice@laptop"),
+	)
+	secret.Annotations = map[string]string{registry.ForceCommandAnnotation: "uptime"}
+
+	if err := source.AddSecret(nil, secret); err != nil {
+		t.Fatalf("AddSecret failed: %v", err)
+	}
+
+	pod := newListTestPod("test-ns", "test-devbox", "10.0.0.1")
+	pod.Annotations[registry.AllowedCIDRsAnnotation] = "10.0.0.0/8"
+
+	if err := source.UpdatePod(pod); err != nil {
+		t.Fatalf("UpdatePod failed: %v", err)
+	}
+
+	source.UpdateConfigMap(revocationConfigMap("revoked-keys", "SHA256:leaked\n"))
+
+	if err := source.SaveSnapshot(path); err != nil {
+		t.Fatalf("SaveSnapshot failed: %v", err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+
+	if bytes.Contains(content, []byte("PRIVATE KEY")) {
+		t.Error("Snapshot holds a private key")
+	}
+
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("Snapshot file mode = %v, %v, want 0600", info.Mode().Perm(), err)
+	}
+
+	reg := registry.New(registry.WithRevocationConfigMap("sshgate", "revoked-keys"))
+
+	loaded, err := reg.LoadSnapshot(path)
+	if err != nil || loaded != 1 {
+		t.Fatalf("LoadSnapshot() = %d, %v, want 1 devbox", loaded, err)
+	}
+
+	info, ok := reg.GetByPublicKey(publicKey)
+	if !ok {
+		t.Fatal("Devbox not found by its public key")
+	}
+
+	if !info.Stale() || info.PrivateKey != nil {
+		t.Errorf("Stale() = %v with private key %v, want stale without private key",
+			info.Stale(), info.PrivateKey)
+	}
+
+	if info.PodIP != "10.0.0.1" || info.PodState() != registry.PodStateReady {
+		t.Errorf("Pod IP %q in state %s, want 10.0.0.1 ready", info.PodIP, info.PodState())
+	}
+
+	if info.ForceCommand != "uptime" || len(info.AllowedCIDRs) != 1 ||
+		!slices.Equal(info.BackendUsers, []string{"root", "ubuntu"}) {
+		t.Errorf("Settings not restored: %+v", info)
+	}
+
+	if _, ok := reg.GetByPublicKey(laptop); !ok {
+		t.Error("Devbox not found by its authorized key")
+	}
+
+	if !reg.IsRevoked("SHA256:leaked") {
+		t.Error("Revocation not restored")
+	}
+
+	// Fresh data confirms the devbox
+	if err := reg.AddSecret(nil, secret); err != nil {
+		t.Fatalf("AddSecret failed: %v", err)
+	}
+
+	if err := reg.UpdatePod(pod); err != nil {
+		t.Fatalf("UpdatePod failed: %v", err)
+	}
+
+	if info, _ := reg.GetByPublicKey(publicKey); info.Stale() || info.PrivateKey == nil {
+		t.Errorf("Stale() = %v after the informers confirmed the devbox", info.Stale())
+	}
+}
+
+func TestSnapshot_Corruption(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "registry.snapshot")
+	source := registry.New()
+
+	secret, _ := snapshotSecret(t, "test-devbox")
+	if err := source.AddSecret(nil, secret); err != nil {
+		t.Fatalf("AddSecret failed: %v", err)
+	}
+
+	if err := source.SaveSnapshot(path); err != nil {
+		t.Fatalf("SaveSnapshot failed: %v", err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+
+	header, body, _ := bytes.Cut(content, []byte("\n"))
+	header = bytes.Replace(header,
+		fmt.Appendf(nil, " %d ", registry.SnapshotVersion),
+		fmt.Appendf(nil, " %d ", registry.SnapshotVersion+1), 1)
+	flipped := slices.Clone(content)
+	flipped[len(flipped)-10] ^= 0x01
+
+	tests := []struct {
+		name    string
+		content []byte
+		want    error
+	}{
+		{name: "truncated", content: content[:len(content)/2], want: registry.ErrSnapshotCorrupt},
+		{name: "flipped bit", content: flipped, want: registry.ErrSnapshotCorrupt},
+		{name: "no header", content: body, want: registry.ErrSnapshotCorrupt},
+		{name: "empty", content: nil, want: registry.ErrSnapshotCorrupt},
+		{
+			name:    "future version",
+			content: slices.Concat(header, []byte("\n"), body),
+			want:    registry.ErrSnapshotVersion,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			corrupt := filepath.Join(dir, "corrupt.snapshot")
+			if err := os.WriteFile(corrupt, tt.content, 0o600); err != nil {
+				t.Fatalf("WriteFile failed: %v", err)
+			}
+
+			reg := registry.New()
+
+			loaded, err := reg.LoadSnapshot(corrupt)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("LoadSnapshot() error = %v, want %v", err, tt.want)
+			}
+
+			if loaded != 0 || reg.Count() != 0 {
+				t.Errorf("Loaded %d devboxes from a corrupt snapshot", reg.Count())
+			}
+		})
+	}
+
+	if _, err := registry.New().LoadSnapshot(filepath.Join(dir, "missing")); !errors.Is(
+		err, fs.ErrNotExist) {
+		t.Errorf("LoadSnapshot() error = %v, want fs.ErrNotExist", err)
+	}
+}
+
+func TestSnapshot_Reconcile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.snapshot")
+	source := registry.New(registry.WithRevocationConfigMap("sshgate", "revoked-keys"))
+
+	secrets := make(map[string]*corev1.Secret)
+	keys := make(map[string]ssh.PublicKey)
+
+	for _, name := range []string{"kept", "rotated", "deleted"} {
+		secrets[name], keys[name] = snapshotSecret(t, name)
+		if err := source.AddSecret(nil, secrets[name]); err != nil {
+			t.Fatalf("AddSecret failed: %v", err)
+		}
+
+		if err := source.UpdatePod(newListTestPod("test-ns", name, "10.0.0.1")); err != nil {
+			t.Fatalf("UpdatePod failed: %v", err)
+		}
+	}
+
+	source.UpdateConfigMap(revocationConfigMap("revoked-keys", "SHA256:leaked\n"))
+
+	if err := source.SaveSnapshot(path); err != nil {
+		t.Fatalf("SaveSnapshot failed: %v", err)
+	}
+
+	reg := registry.New(registry.WithRevocationConfigMap("sshgate", "revoked-keys"))
+	if _, err := reg.LoadSnapshot(path); err != nil {
+		t.Fatalf("LoadSnapshot failed: %v", err)
+	}
+
+	var events []registry.Event
+
+	defer reg.Subscribe(func(event registry.Event) { events = append(events, event) })()
+
+	// The informers sync: the pod of kept got another IP, the key of rotated
+	// changed and its pod is gone, deleted and the revocation ConfigMap are gone
+	if err := reg.AddSecret(nil, secrets["kept"]); err != nil {
+		t.Fatalf("AddSecret failed: %v", err)
+	}
+
+	if err := reg.UpdatePod(newListTestPod("test-ns", "kept", "10.0.0.2")); err != nil {
+		t.Fatalf("UpdatePod failed: %v", err)
+	}
+
+	rotated, _ := snapshotSecret(t, "rotated")
+	if err := reg.AddSecret(nil, rotated); err != nil {
+		t.Fatalf("AddSecret failed: %v", err)
+	}
+
+	// Stale lookups contradicted by fresh data fail
+	if _, ok := reg.GetByPublicKey(keys["rotated"]); ok {
+		t.Error("Replaced key of a stale devbox still found")
+	}
+
+	reg.Reconcile()
+
+	var got []string
+	for _, event := range events {
+		got = append(got, event.DevboxName+":"+eventTypeName(event.Type))
+	}
+
+	want := []string{
+		"kept:secret_updated", "kept:pod_ip_changed",
+		"rotated:public_key_changed", "rotated:secret_updated", "rotated:pod_deleted",
+		"deleted:secret_deleted",
+	}
+	slices.Sort(got)
+	slices.Sort(want)
+
+	if !slices.Equal(got, want) {
+		t.Errorf("Events = %v, want %v", got, want)
+	}
+
+	if info, ok := reg.GetDevboxInfo("test-ns", "kept"); !ok || info.Stale() ||
+		info.PodIP != "10.0.0.2" {
+		t.Errorf("kept = %+v, want the fresh pod IP", info)
+	}
+
+	if info, ok := reg.GetDevboxInfo("test-ns", "rotated"); !ok || info.Stale() ||
+		info.PodState() != registry.PodStateNone {
+		t.Errorf("rotated = %+v, want no pod", info)
+	}
+
+	if _, ok := reg.GetByPublicKey(keys["deleted"]); ok {
+		t.Error("Devbox with a deleted secret still found")
+	}
+
+	if reg.Count() != 2 {
+		t.Errorf("Count() = %d, want 2", reg.Count())
+	}
+
+	if reg.IsRevoked("SHA256:leaked") {
+		t.Error("Revocation of a deleted ConfigMap kept")
+	}
+}
+
+// eventTypeName returns a readable name of an event type
+func eventTypeName(eventType registry.EventType) string {
+	switch eventType {
+	case registry.EventPodIPChanged:
+		return "pod_ip_changed"
+	case registry.EventPodDeleted:
+		return "pod_deleted"
+	case registry.EventSecretDeleted:
+		return "secret_deleted"
+	case registry.EventPublicKeyChanged:
+		return "public_key_changed"
+	case registry.EventSecretAdded:
+		return "secret_added"
+	case registry.EventSecretUpdated:
+		return "secret_updated"
+	default:
+		return "other"
+	}
+}
@@ -0,0 +1,147 @@
+package registry
+
+import (
+	"slices"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultWatchBuffer is the number of events queued for a watcher when Watch
+// is given no buffer size
+const DefaultWatchBuffer = 64
+
+// watcher queues the events of a subscription for a consumer receiving them
+// at its own pace
+type watcher struct {
+	mu    sync.Mutex
+	queue []Event
+	size  int
+	// wake is signaled when an event is queued
+	wake chan struct{}
+	// done is closed when the watch stops
+	done   chan struct{}
+	out    chan Event
+	logger *log.Entry
+}
+
+// Watch returns a channel receiving the registry events from now on and a
+// function stopping the watch, after which the channel is closed. Unlike
+// Subscribe callbacks, receivers may be slow: up to buffer events wait for them,
+// DefaultWatchBuffer when buffer is not positive. A waiting event is replaced by
+// a later one of the same type and devbox, carrying the latest snapshot, and
+// waiting revocations are merged. Once buffer events wait, the oldest is dropped.
+func (r *Registry) Watch(buffer int) (<-chan Event, func()) {
+	if buffer <= 0 {
+		buffer = DefaultWatchBuffer
+	}
+
+	w := &watcher{
+		size:   buffer,
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+		out:    make(chan Event),
+		logger: r.logger,
+	}
+
+	unsubscribe := r.Subscribe(w.push)
+
+	go w.run()
+
+	var once sync.Once
+
+	return w.out, func() {
+		once.Do(func() {
+			unsubscribe()
+			close(w.done)
+		})
+	}
+}
+
+// push queues event without blocking, coalescing it with a waiting event of
+// the same type and devbox
+func (w *watcher) push(event Event) {
+	w.mu.Lock()
+
+	if i := slices.IndexFunc(w.queue, event.coalesces); i >= 0 {
+		if event.Type == EventKeysRevoked {
+			event.Fingerprints = mergeFingerprints(w.queue[i].Fingerprints, event.Fingerprints)
+		}
+
+		w.queue[i] = event
+	} else {
+		if len(w.queue) >= w.size {
+			dropped := w.queue[0]
+			w.queue = slices.Delete(w.queue, 0, 1)
+
+			w.logger.WithFields(log.Fields{
+				"namespace": dropped.Namespace,
+				"devbox":    dropped.DevboxName,
+				"event":     dropped.Type,
+			}).Warn("Dropping registry event of a slow watcher")
+		}
+
+		w.queue = append(w.queue, event)
+	}
+
+	w.mu.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pop removes the oldest waiting event
+func (w *watcher) pop() (Event, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.queue) == 0 {
+		return Event{}, false
+	}
+
+	event := w.queue[0]
+	w.queue = slices.Delete(w.queue, 0, 1)
+
+	return event, true
+}
+
+// run delivers the waiting events until the watch stops
+func (w *watcher) run() {
+	defer close(w.out)
+
+	for {
+		event, ok := w.pop()
+		if !ok {
+			select {
+			case <-w.wake:
+				continue
+			case <-w.done:
+				return
+			}
+		}
+
+		select {
+		case w.out <- event:
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// coalesces reports whether the waiting event queued may be replaced by e, a
+// change of the same kind to the same devbox. Revocations concern no devbox.
+func (e Event) coalesces(queued Event) bool {
+	return e.Type == queued.Type &&
+		e.Namespace == queued.Namespace &&
+		e.DevboxName == queued.DevboxName
+}
+
+// mergeFingerprints returns the sorted union of two sorted fingerprint lists
+func mergeFingerprints(a, b []string) []string {
+	merged := slices.Concat(a, b)
+	slices.Sort(merged)
+
+	return slices.Compact(merged)
+}
@@ -0,0 +1,244 @@
+package registry_test
+
+import (
+	"fmt"
+	"runtime"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/sshgate/registry"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// receiveEvent returns the next event of a watch, failing after a second
+func receiveEvent(t *testing.T, events <-chan registry.Event) registry.Event {
+	t.Helper()
+
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for an event")
+		return registry.Event{}
+	}
+}
+
+// receiveIdle returns the events of a watch until none comes for a while
+func receiveIdle(events <-chan registry.Event) []registry.Event {
+	var received []registry.Event
+
+	for {
+		select {
+		case event := <-events:
+			received = append(received, event)
+		case <-time.After(100 * time.Millisecond):
+			return received
+		}
+	}
+}
+
+func TestWatch_Events(t *testing.T) {
+	reg := registry.New()
+
+	events, stop := reg.Watch(0)
+	defer stop()
+
+	_, pubBytes, privBytes := generateTestKeyPair(t)
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "test-secret",
+			Namespace:       "ns-test",
+			ResourceVersion: "1",
+			Labels: map[string]string{
+				registry.DevboxPartOfLabel: registry.DevboxPartOfValue,
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: registry.DevboxOwnerKind, Name: "test-devbox"},
+			},
+		},
+		Data: map[string][]byte{
+			registry.DevboxPublicKeyField:  pubBytes,
+			registry.DevboxPrivateKeyField: privBytes,
+		},
+	}
+
+	if err := reg.AddSecret(nil, secret); err != nil {
+		t.Fatalf("AddSecret failed: %v", err)
+	}
+
+	event := receiveEvent(t, events)
+	if event.Type != registry.EventSecretAdded || event.DevboxName != "test-devbox" {
+		t.Fatalf("Event = %+v, want EventSecretAdded of test-devbox", event)
+	}
+
+	if event.Info == nil || event.Info.PublicKey == nil || event.Info.PrivateKey != nil {
+		t.Errorf("Snapshot = %+v, want the public key without the private key", event.Info)
+	}
+
+	if err := reg.UpdatePod(newListTestPod("ns-test", "test-devbox", "10.0.0.1")); err != nil {
+		t.Fatalf("UpdatePod failed: %v", err)
+	}
+
+	event = receiveEvent(t, events)
+	if event.Type != registry.EventPodIPChanged || event.Info == nil ||
+		event.Info.PodIP != "10.0.0.1" || event.Info.PublicKey == nil {
+		t.Fatalf("Event = %+v, want EventPodIPChanged with a snapshot of the devbox", event)
+	}
+
+	// Resyncs are no updates
+	if err := reg.AddSecret(secret, secret); err != nil {
+		t.Fatalf("AddSecret failed: %v", err)
+	}
+
+	updated := secret.DeepCopy()
+	updated.ResourceVersion = "2"
+
+	if err := reg.AddSecret(secret, updated); err != nil {
+		t.Fatalf("AddSecret failed: %v", err)
+	}
+
+	if event = receiveEvent(t, events); event.Type != registry.EventSecretUpdated {
+		t.Fatalf("Event = %+v, want EventSecretUpdated", event)
+	}
+
+	reg.DeleteSecret(updated)
+
+	event = receiveEvent(t, events)
+	if event.Type != registry.EventSecretDeleted || event.Info != nil {
+		t.Fatalf("Event = %+v, want EventSecretDeleted without a snapshot", event)
+	}
+
+	if received := receiveIdle(events); len(received) != 0 {
+		t.Errorf("Got unexpected events %+v", received)
+	}
+}
+
+func TestWatch_Coalescing(t *testing.T) {
+	reg := registry.New(registry.WithRevocationConfigMap("sshgate", "revoked-keys"))
+
+	events, stop := reg.Watch(4)
+	defer stop()
+
+	// Nobody receives while the pod IP changes, waiting changes coalesce. The
+	// first change may already be on its way to the receiver.
+	for i := range 10 {
+		pod := newListTestPod("ns-test", "test-devbox", fmt.Sprintf("10.0.0.%d", i+1))
+		if err := reg.UpdatePod(pod); err != nil {
+			t.Fatalf("UpdatePod failed: %v", err)
+		}
+	}
+
+	received := receiveIdle(events)
+	if len(received) == 0 || len(received) > 2 {
+		t.Fatalf("Got %d events, want the changes coalesced", len(received))
+	}
+
+	if last := received[len(received)-1]; last.Info.PodIP != "10.0.0.10" {
+		t.Errorf("Last event has pod IP %s, want the latest 10.0.0.10", last.Info.PodIP)
+	}
+
+	// Revocations merge
+	reg.UpdateConfigMap(revocationConfigMap("revoked-keys", "SHA256:first\n"))
+	reg.UpdateConfigMap(revocationConfigMap("revoked-keys", "SHA256:first\nSHA256:second\n"))
+	reg.UpdateConfigMap(revocationConfigMap("revoked-keys", "SHA256:third\n"))
+
+	var fingerprints []string
+
+	received = receiveIdle(events)
+	for _, event := range received {
+		fingerprints = append(fingerprints, event.Fingerprints...)
+	}
+
+	if len(received) > 2 {
+		t.Errorf("Got %d revocation events, want them merged", len(received))
+	}
+
+	slices.Sort(fingerprints)
+
+	if want := []string{"SHA256:first", "SHA256:second", "SHA256:third"}; !slices.Equal(
+		fingerprints, want) {
+		t.Errorf("Revoked %v, want %v", fingerprints, want)
+	}
+
+	// Changes of distinct devboxes past the buffer drop the oldest
+	for i := range 20 {
+		pod := newListTestPod("ns-test", fmt.Sprintf("devbox-%02d", i), "10.0.0.1")
+		if err := reg.UpdatePod(pod); err != nil {
+			t.Fatalf("UpdatePod failed: %v", err)
+		}
+	}
+
+	received = receiveIdle(events)
+	if len(received) > 5 {
+		t.Errorf("Got %d events, want at most the buffer and one on its way", len(received))
+	}
+
+	if last := received[len(received)-1]; last.DevboxName != "devbox-19" {
+		t.Errorf("Last event is of %s, want the newest devbox-19", last.DevboxName)
+	}
+}
+
+func TestWatch_StopDuringDelivery(t *testing.T) {
+	reg := registry.New()
+	goroutines := runtime.NumGoroutine()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			name, podIP := fmt.Sprintf("devbox-%d", i%8), fmt.Sprintf("10.0.0.%d", i%250)
+			if err := reg.UpdatePod(newListTestPod("ns-test", name, podIP)); err != nil {
+				t.Errorf("UpdatePod failed: %v", err)
+				return
+			}
+		}
+	}()
+
+	for range 10 {
+		events, stop := reg.Watch(2)
+
+		for range 5 {
+			receiveEvent(t, events)
+		}
+
+		stop()
+		stop()
+
+		// The channel closes while changes keep coming
+		deadline := time.After(time.Second)
+
+	drain:
+		for {
+			select {
+			case _, ok := <-events:
+				if !ok {
+					break drain
+				}
+			case <-deadline:
+				t.Fatal("Watch channel not closed after stopping")
+			}
+		}
+	}
+
+	done <- struct{}{}
+
+	// With the changes stopped, stopped watches leave no goroutine behind
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Errorf("%d goroutines left, want %d", n, goroutines)
+	}
+}
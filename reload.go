@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+
+	"github.com/zijiren233/sshgate/config"
+	"github.com/zijiren233/sshgate/gateway"
+	"github.com/zijiren233/sshgate/logger"
+)
+
+// reloadableLogOptions are applied on reload by initializing the logger again
+var reloadableLogOptions = []string{
+	"DEBUG", "LOG_LEVEL", "LOG_FORMAT",
+	"LOG_OUTPUT", "LOG_FILE", "LOG_FILE_MAX_SIZE", "LOG_FILE_MAX_BACKUPS", "LOG_FILE_MAX_AGE",
+	"LOG_FILE_COMPRESS",
+}
+
+// logOptions returns the options of the logger of cfg
+func logOptions(cfg *config.Config) []logger.Option {
+	return []logger.Option{
+		logger.WithDebug(cfg.Debug),
+		logger.WithLevel(cfg.LogLevel),
+		logger.WithFormat(cfg.LogFormat),
+		logger.WithOutput(cfg.LogOutput),
+		logger.WithFile(cfg.LogFile, cfg.LogRotation()),
+	}
+}
+
+// reloadOnSIGHUP loads the configuration from args again on SIGHUP until ctx is
+// done, applying the logging options and the gateway.ReloadableOptions. The log
+// file is reopened first, for logrotate to rotate it.
+func reloadOnSIGHUP(ctx context.Context, gw *gateway.Gateway, cfg *config.Config, args []string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if err := logger.ReopenFile(); err != nil {
+				mainLog.WithError(err).Error("Failed to reopen the log file")
+			}
+
+			if err := reloadConfig(gw, cfg, args); err != nil {
+				mainLog.WithError(err).Error("Configuration not reloaded, keeping the running one")
+			}
+		}
+	}
+}
+
+// reloadConfig loads the configuration from args and applies its reloadable
+// options, cfg being the running configuration, logging the options applied
+// and those that require a restart
+func reloadConfig(gw *gateway.Gateway, cfg *config.Config, args []string) error {
+	next, err := config.Load(args...)
+	if err != nil {
+		return err
+	}
+
+	reloadable := slices.Clone(reloadableLogOptions)
+	for _, name := range gateway.ReloadableOptions {
+		reloadable = append(reloadable, config.GatewayOptionKey(name))
+	}
+
+	var applied, restart []string
+
+	for _, key := range cfg.Changed(next) {
+		if slices.Contains(reloadable, key) {
+			applied = append(applied, key)
+		} else {
+			restart = append(restart, key)
+		}
+	}
+
+	if len(applied) > 0 {
+		// Gateway options are applied first, nothing being applied when they
+		// are invalid
+		if _, err := gw.Reload(next.Gateway.Options()); err != nil {
+			return err
+		}
+
+		// Logging options fail when the log file cannot be opened, the gateway
+		// options being applied all the same
+		if err := logger.InitLog(logOptions(next)...); err != nil {
+			cfg.Set(next, slices.DeleteFunc(applied, func(key string) bool {
+				return slices.Contains(reloadableLogOptions, key)
+			})...)
+
+			return err
+		}
+
+		cfg.Set(next, applied...)
+	}
+
+	switch {
+	case len(applied) == 0 && len(restart) == 0:
+		mainLog.Info("Configuration reloaded, nothing changed")
+	case len(applied) > 0:
+		mainLog.WithField("applied", applied).
+			Info("Configuration reloaded, applied to new connections")
+	}
+
+	if len(restart) > 0 {
+		mainLog.WithField("restart_required", restart).
+			Warn("Configuration changes not applied, they require a restart")
+	}
+
+	return nil
+}
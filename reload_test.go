@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zijiren233/sshgate/config"
+	"github.com/zijiren233/sshgate/gateway"
+	"github.com/zijiren233/sshgate/hostkey"
+	"github.com/zijiren233/sshgate/logger"
+	"github.com/zijiren233/sshgate/registry"
+)
+
+func TestReloadConfig_InvalidGatewayOptionsKeepLogging(t *testing.T) {
+	cfg, err := config.Load("--log-level=info")
+	if err != nil {
+		t.Fatalf("Load() failed: %v", err)
+	}
+
+	if err := logger.InitLog(logOptions(cfg)...); err != nil {
+		t.Fatalf("InitLog() failed: %v", err)
+	}
+
+	keys, err := hostkey.GenerateDeterministicKeys("reload-test-seed", hostkey.KeyTypeED25519)
+	if err != nil {
+		t.Fatalf("GenerateDeterministicKeys() failed: %v", err)
+	}
+
+	// The running options are invalid, so is any reload of them
+	gw := gateway.New(keys[0], registry.New(), gateway.WithServerVersion("OpenSSH_9.9"))
+
+	err = reloadConfig(gw, cfg, []string{"--log-level=debug", "--banner=reloaded"})
+	if err == nil {
+		t.Fatal("reloadConfig() succeeded, want an error")
+	}
+
+	if level := log.GetLevel(); level != log.InfoLevel {
+		t.Errorf("Log level = %s after a failed reload, want info", level)
+	}
+
+	if cfg.LogLevel != "info" {
+		t.Errorf("LogLevel = %s after a failed reload, want info", cfg.LogLevel)
+	}
+
+	if banner := gw.Options().Banner; banner != "" {
+		t.Errorf("Banner = %q after a failed reload, want none", banner)
+	}
+}